@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Adopting existing artifacts: a scan walks directories (those listed under
+// scanDirectories in porter.json, by default the conversion directory and
+// /data) and optionally an S3 or GCS bucket for disk images Porter didn't
+// create, and records them in the catalog as "adopted" entries, so they can be
+// listed, checked and deleted like Porter's own. Local images are fingerprinted
+// (format and virtual size from the image tool, and a SHA-256); bucket objects
+// are recorded by name and size, without downloading them.
+
+// The bucket to scan: a destination profile, or the cloud and bucket directly
+type AdoptBucket struct {
+	Profile   string `json:"profile,omitempty"`
+	Cloud     string `json:"cloud,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	URL       string `json:"url,omitempty"`
+	Region    string `json:"region,omitempty"`
+	PathStyle bool   `json:"pathStyle,omitempty"`
+}
+
+type AdoptRequest struct {
+	// Directories to walk, each under one of scanDirectories (default: all of them)
+	Directories []string     `json:"directories,omitempty"`
+	Bucket      *AdoptBucket `json:"bucket,omitempty"`
+	// Report what would be adopted without changing the catalog
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// An image the scan passed over, and why
+type AdoptSkipped struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+type AdoptResult struct {
+	Adopted []CatalogEntry `json:"adopted"`
+	Skipped []AdoptSkipped `json:"skipped"`
+}
+
+// The directories a scan may walk
+func scanDirectories() []string {
+	if len(config.ScanDirectories) > 0 {
+		return config.ScanDirectories
+	}
+	return []string{convertDir, "/data"}
+}
+
+// Whether a file looks like a disk image or appliance Porter handles
+func isAdoptableImage(name string) bool {
+	return diskFormatForPath(name) != "" || strings.EqualFold(filepath.Ext(name), ".ova")
+}
+
+// Whether the catalog already has an entry for a destination
+func (c *catalog) has(destination string) bool {
+	c.Lock()
+	defer c.Unlock()
+	for _, entry := range c.Entries {
+		if entry.Destination == destination {
+			return true
+		}
+	}
+	return false
+}
+
+// Describe a local image for the catalog
+func fingerprintImage(ctx context.Context, file string, info fs.FileInfo) (CatalogEntry, error) {
+	entry := CatalogEntry{Kind: "adopted", Cloud: "local", Destination: file, Size: info.Size()}
+	if diskFormatForPath(file) != "" {
+		image, err := imageTools().info(ctx, file)
+		if err != nil {
+			return entry, err
+		}
+		entry.Format, entry.VirtualSize = image.Format, image.VirtualSize
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, &contextReader{ctx: ctx, r: f}); err != nil {
+		return entry, fmt.Errorf("computing the checksum of %s failed: %w", file, err)
+	}
+	entry.Checksums = map[string]string{"sha256": hex.EncodeToString(h.Sum(nil))}
+	return entry, nil
+}
+
+// A reader that stops when its context is done, so an abandoned scan stops hashing
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Walk a directory for images not in the catalog
+func scanDirectory(ctx context.Context, dir string, result *AdoptResult) error {
+	return filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && file == dir {
+				return nil
+			}
+			result.Skipped = append(result.Skipped, AdoptSkipped{Path: file, Reason: err.Error()})
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if d.IsDir() || !isAdoptableImage(file) {
+			return nil
+		}
+		if artifactCatalog.has(file) {
+			result.Skipped = append(result.Skipped, AdoptSkipped{Path: file, Reason: "already in the catalog"})
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			result.Skipped = append(result.Skipped, AdoptSkipped{Path: file, Reason: err.Error()})
+			return nil
+		}
+		// Files a job or conversion is still writing are left for a later scan
+		release, err := tryLockWorkspace("catalog scan", []string{file}, nil)
+		if err != nil {
+			result.Skipped = append(result.Skipped, AdoptSkipped{Path: file, Reason: err.Error()})
+			return nil
+		}
+		entry, err := fingerprintImage(ctx, file, info)
+		release()
+		if err != nil {
+			result.Skipped = append(result.Skipped, AdoptSkipped{Path: file, Reason: err.Error()})
+			return nil
+		}
+		result.Adopted = append(result.Adopted, entry)
+		return nil
+	})
+}
+
+// List a bucket for images not in the catalog
+func scanBucket(ctx context.Context, b AdoptBucket, result *AdoptResult) *APIError {
+	if b.Profile != "" {
+		profile, ok := findDestinationProfile(b.Profile)
+		if !ok {
+			return &APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown destination profile: %s"), b.Profile),
+				Remediation: "Use a profile defined under 'destinations' in porter.json."}
+		}
+		if b.Cloud == "" {
+			b.Cloud = profile.Cloud
+		}
+		if b.Bucket == "" {
+			b.Bucket = profile.Bucket
+		}
+		if b.Prefix == "" {
+			b.Prefix = profile.Target
+		}
+		if b.URL == "" {
+			b.URL, b.Region, b.PathStyle = profile.URL, profile.Region, profile.PathStyle
+		}
+	}
+	if b.Bucket == "" {
+		return &APIError{Code: errCodeInvalidRequest, Message: "The bucket to scan has no name",
+			Remediation: "Pass 'bucket', or a profile that sets one."}
+	}
+	prefix := strings.TrimPrefix(b.Prefix, "/")
+
+	var objects []DestinationObject
+	var scheme string
+	var err error
+	entry := CatalogEntry{Kind: "adopted", Cloud: b.Cloud}
+	switch b.Cloud {
+	case "aws":
+		endpoint := uploadSettings{URL: b.URL, Region: b.Region, PathStyle: b.PathStyle}.s3Endpoint()
+		entry.Endpoint, entry.Region, entry.PathStyle = b.URL, b.Region, b.PathStyle
+		scheme = "s3://"
+		err = providerCall(ctx, endpoint.breakerName(), func(ctx context.Context) error {
+			objects, err = listS3Objects(ctx, endpoint, b.Bucket, prefix)
+			return err
+		})
+	case "gcp":
+		scheme = "gs://"
+		err = providerCall(ctx, "gcp", func(ctx context.Context) error {
+			objects, err = listGCSObjects(ctx, b.Bucket, prefix)
+			return err
+		})
+	default:
+		return &APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Scanning %s buckets is not supported"), b.Cloud),
+			Remediation: "Scan an aws (S3 or S3-compatible) or gcp bucket."}
+	}
+	if err != nil {
+		return &APIError{Code: errCodeProviderFailed, Message: fmt.Sprintf(tr("Failed to list bucket %s"), b.Bucket), Details: err.Error(),
+			Remediation: "Check the bucket exists and your credentials can list it."}
+	}
+	for _, object := range objects {
+		destination := scheme + path.Join(b.Bucket, object.Name)
+		if !isAdoptableImage(object.Name) {
+			continue
+		}
+		if artifactCatalog.has(destination) {
+			result.Skipped = append(result.Skipped, AdoptSkipped{Path: destination, Reason: "already in the catalog"})
+			continue
+		}
+		adopted := entry
+		adopted.Destination, adopted.Size = destination, object.Size
+		result.Adopted = append(result.Adopted, adopted)
+	}
+	return nil
+}
+
+// Handler for POST /api/catalog/scan: find images Porter didn't create and add
+// them to the catalog
+func catalogScanHandler(w http.ResponseWriter, r *http.Request) {
+	var req AdoptRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Invalid request body", Details: err.Error()})
+			return
+		}
+	}
+	allowed := scanDirectories()
+	dirs := req.Directories
+	if len(dirs) == 0 {
+		dirs = allowed
+	}
+	for _, dir := range dirs {
+		permitted := false
+		for _, root := range allowed {
+			if rel, err := filepath.Rel(root, dir); err == nil && filepath.IsAbs(dir) && !strings.HasPrefix(rel, "..") {
+				permitted = true
+			}
+		}
+		if !permitted {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Directory not open to scanning: %s"), dir),
+				Remediation: fmt.Sprintf(tr("Scan one of %s or a folder under it, or add it to scanDirectories in porter.json."), strings.Join(allowed, ", "))})
+			return
+		}
+	}
+
+	var result AdoptResult
+	for _, dir := range dirs {
+		fmt.Printf("Scanning %s for existing images\n", dir)
+		if err := scanDirectory(r.Context(), filepath.Clean(dir), &result); err != nil {
+			writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+				Message: fmt.Sprintf(tr("Scanning %s failed"), dir), Details: err.Error()})
+			return
+		}
+	}
+	if req.Bucket != nil {
+		fmt.Printf("Scanning bucket %s for existing images\n", req.Bucket.Bucket)
+		if apiErr := scanBucket(r.Context(), *req.Bucket, &result); apiErr != nil {
+			status := http.StatusBadRequest
+			if apiErr.Code == errCodeProviderFailed {
+				status = http.StatusBadGateway
+			}
+			writeAPIError(w, status, *apiErr)
+			return
+		}
+	}
+
+	if !req.DryRun {
+		for i, entry := range result.Adopted {
+			result.Adopted[i] = artifactCatalog.add(entry)
+		}
+	}
+	fmt.Printf("Catalog scan found %d image(s) to adopt, skipped %d (dry run: %t)\n",
+		len(result.Adopted), len(result.Skipped), req.DryRun)
+	if result.Adopted == nil {
+		result.Adopted = []CatalogEntry{}
+	}
+	if result.Skipped == nil {
+		result.Skipped = []AdoptSkipped{}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Alibaba Cloud: images are uploaded to an OSS bucket and, with createImage,
+// imported as ECS custom images with ImportImage, through the aliyun CLI.
+// ImportImage needs the AliyunECSImageImportDefaultRole RAM role to read the bucket.
+
+// How long to wait for an ECS image import to finish
+const alibabaImageImportTimeout = 3 * time.Hour
+
+// ImportImage's disk format names for Porter's converted images
+var alibabaImageFormats = map[string]string{
+	".raw":   "RAW",
+	".vhd":   "VHD",
+	".qcow2": "QCOW2",
+}
+
+// Upload one image to OSS, returning the oss:// URI of the object
+func uploadToAlibaba(job *Job, s uploadSettings, file string) (string, error) {
+	key := filepath.Base(file)
+	if s.Target != "" {
+		key = strings.Trim(s.Target, "/") + "/" + key
+	}
+	ossURI := "oss://" + s.Bucket + "/" + key
+
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Uploading %s to Alibaba OSS: %s (%.2f MB)",
+		filepath.Base(file), ossURI, float64(fileInfo.Size())/(1024*1024))
+
+	args := []string{"oss", "cp", file, ossURI, "--region", s.Region, "-f"}
+	if len(s.Metadata) > 0 {
+		args = append(args, "--meta", alibabaMetaArg(s.Metadata))
+	}
+	cmd := toolCommand(job.ctx, "aliyun", args...)
+	pending := pendingUploads.start("alibaba", ossURI, "")
+	if err := runJobCommand(job, cmd); err != nil {
+		abandonUpload(pending)
+		return "", fmt.Errorf("Alibaba OSS upload failed for %s: %w", file, err)
+	}
+	pendingUploads.finish(pending.ID)
+	return ossURI, nil
+}
+
+// Import an uploaded OSS object as an ECS custom image and wait for it to become
+// available, returning the ID of the image
+func importAlibabaImage(job *Job, s uploadSettings, file, ossURI string) (string, error) {
+	format, ok := alibabaImageFormats[strings.ToLower(filepath.Ext(file))]
+	if !ok {
+		return "", fmt.Errorf("ECS cannot import %s; convert to RAW, VHD or QCOW2", filepath.Base(file))
+	}
+	key := strings.TrimPrefix(ossURI, "oss://"+s.Bucket+"/")
+	name := alibabaImageName(job, file)
+	osType := "linux"
+	if strings.HasPrefix(strings.ToLower(s.OSName), "windows") {
+		osType = "windows"
+	}
+	importArgs := []string{"ecs", "ImportImage",
+		"--RegionId", s.Region,
+		"--ImageName", name,
+		"--OSType", osType,
+		"--Platform", s.OSName,
+		"--Architecture", archName(guestArch(job, file), [2]string{"x86_64", "arm64"}),
+		"--DiskDeviceMapping.1.OSSBucket", s.Bucket,
+		"--DiskDeviceMapping.1.OSSObject", key,
+		"--DiskDeviceMapping.1.Format", format,
+		"--Description", "Imported by Porter job " + job.ID}
+	if s.ResourceGroup != "" {
+		importArgs = append(importArgs, "--ResourceGroupId", s.ResourceGroup)
+	}
+	job.setStatus("Importing ECS image %s in %s", name, s.Region)
+	out, err := toolCommand(job.ctx, "aliyun", importArgs...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("ImportImage failed for %s: %w: %s", ossURI, err, strings.TrimSpace(string(out)))
+	}
+	var imported struct {
+		ImageID string `json:"ImageId"`
+	}
+	if err := json.Unmarshal(out, &imported); err != nil || imported.ImageID == "" {
+		return "", fmt.Errorf("unexpected ImportImage output: %s", strings.TrimSpace(string(out)))
+	}
+	job.logf("Importing ECS image %s (%s)", name, imported.ImageID)
+
+	task := CloudTask{Kind: "ECS image import", ID: imported.ImageID, Status: "Waiting"}
+	err = waitForCloudTask(job, task, alibabaImageImportTimeout, func(t *CloudTask) (bool, error) {
+		status, progress, err := alibabaImageStatus(job, s.Region, t.ID)
+		if err != nil {
+			return false, err
+		}
+		t.Status, t.Percentage = status, parsePercentage(progress)
+		switch status {
+		case "Available":
+			return true, nil
+		case "CreateFailed", "UnAvailable":
+			return false, fmt.Errorf("ECS image import of %s ended in state %s; check the image's import task in the ECS console", ossURI, status)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return imported.ImageID, err
+	}
+	job.logf("ECS image %s is available", imported.ImageID)
+	return imported.ImageID, nil
+}
+
+// The status and progress (e.g. "45%") of an ECS image
+func alibabaImageStatus(job *Job, region, imageID string) (string, string, error) {
+	out, err := toolCommand(job.ctx, "aliyun", "ecs", "DescribeImages", "--RegionId", region,
+		"--ImageId", imageID, "--Status", "Creating,Waiting,Available,UnAvailable,CreateFailed").Output()
+	if err != nil {
+		return "", "", fmt.Errorf("DescribeImages failed for %s: %w", imageID, err)
+	}
+	var resp struct {
+		Images struct {
+			Image []struct {
+				Status   string `json:"Status"`
+				Progress string `json:"Progress"`
+			} `json:"Image"`
+		} `json:"Images"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return "", "", fmt.Errorf("unexpected DescribeImages output: %w", err)
+	}
+	if len(resp.Images.Image) == 0 {
+		return "", "", fmt.Errorf("ECS image %s not found", imageID)
+	}
+	return resp.Images.Image[0].Status, resp.Images.Image[0].Progress, nil
+}
+
+// ECS image names are 2-128 characters, starting with a letter
+func alibabaImageName(job *Job, file string) string {
+	name := job.Spec.Name
+	if name == "" {
+		name = baseNameWithoutExt(file)
+	}
+	if name == "" || !strings.ContainsAny(name[:1], "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		name = "porter-" + name
+	}
+	name += "-" + job.ID
+	if len(name) > 128 {
+		name = name[:128]
+	}
+	return name
+}
+
+// Build the --meta argument for aliyun oss cp (key:value pairs separated by #)
+func alibabaMetaArg(metadata map[string]string) string {
+	var pairs []string
+	for _, pair := range keyValuePairs(metadata) {
+		k, v, _ := strings.Cut(pair, "=")
+		pairs = append(pairs, "X-Oss-Meta-"+k+":"+v)
+	}
+	return strings.Join(pairs, "#")
+}
+
+// List objects under a prefix in an OSS bucket. aliyun oss ls prints a table
+// whose rows end in size, storage class, ETag and oss:// URI.
+func listOSSObjects(ctx context.Context, region, bucket, prefix string) ([]DestinationObject, error) {
+	args := []string{"oss", "ls", "oss://" + bucket + "/" + prefix}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	out, err := toolCommand(ctx, "aliyun", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("aliyun oss ls failed: %w", err)
+	}
+	var objects []DestinationObject
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasPrefix(fields[len(fields)-1], "oss://") {
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[len(fields)-4], 10, 64)
+		objects = append(objects, DestinationObject{
+			Name:         strings.TrimPrefix(fields[len(fields)-1], "oss://"+bucket+"/"),
+			Size:         size,
+			LastModified: strings.Join(fields[:len(fields)-4], " "),
+		})
+	}
+	return objects, nil
+}
+
+func deleteOSSObject(region, uri string) error {
+	args := []string{"oss", "rm", uri, "-f"}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	out, err := toolCommand(context.Background(), "aliyun", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+func checkAlibabaCredentials(ctx context.Context) error {
+	return runQuiet(toolCommand(ctx, "aliyun", "sts", "GetCallerIdentity"))
+}
+
+func listAlibabaRegions(ctx context.Context) ([]string, error) {
+	out, err := toolCommand(ctx, "aliyun", "ecs", "DescribeRegions").Output()
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Regions struct {
+			Region []struct {
+				RegionID string `json:"RegionId"`
+			} `json:"Region"`
+		} `json:"Regions"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, err
+	}
+	var regions []string
+	for _, r := range resp.Regions.Region {
+		regions = append(regions, r.RegionID)
+	}
+	return regions, nil
+}
+
+// Handler to fetch Alibaba OSS buckets dynamically
+func alibabaBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := providerOutput(r.Context(), "alibaba", "aliyun", "oss", "ls")
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list OSS buckets",
+			Remediation: "Check that the aliyun CLI is installed and ~/.aliyun credentials are mounted."})
+		return
+	}
+	var buckets []string
+	for _, field := range strings.Fields(string(out)) {
+		if strings.HasPrefix(field, "oss://") {
+			buckets = append(buckets, strings.TrimSuffix(strings.TrimPrefix(field, "oss://"), "/"))
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"buckets": listOrEmpty(buckets)})
+}
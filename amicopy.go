@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// AMI copies: once an AMI is imported or registered, aws jobs with
+// targetRegions copy it to each of those regions with ec2 copy-image, and with
+// shareAccounts share it and its copies with other AWS accounts (launch
+// permission on the AMI, and create-volume permission on its snapshots so the
+// accounts can copy it in turn). The copies run side by side in AWS and are
+// followed one after another, each as the job's cloud task, and each file's
+// result lists them with their AMI IDs and states. A copy that fails leaves
+// the AMI and the other copies in place and shows up as a job warning.
+
+var (
+	awsRegionPattern  = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+	awsAccountPattern = regexp.MustCompile(`^\d{12}$`)
+)
+
+// A copy of an image in another region
+type ImageCopy struct {
+	Region string `json:"region"`
+	Image  string `json:"image,omitempty"`
+	// pending, available or failed
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+}
+
+// Check an aws job's targetRegions and shareAccounts
+func validateAMICopies(s uploadSettings) *APIError {
+	if !s.CreateImage {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message:     "targetRegions and shareAccounts are for the AMIs aws jobs import",
+			Remediation: "Pass 'createImage' as well, or leave out 'targetRegions' and 'shareAccounts'."}
+	}
+	if len(s.TargetRegions) > 0 && s.Region == "" {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message:     "Copying AMIs to other regions needs the region they are imported in",
+			Remediation: "Pass 'region' as well (e.g. us-east-1)."}
+	}
+	for _, region := range s.TargetRegions {
+		if !awsRegionPattern.MatchString(region) || region == s.Region {
+			return &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Invalid target region: %s"), region),
+				Remediation: "Use AWS region names (e.g. eu-west-1) other than the job's 'region'."}
+		}
+	}
+	for _, account := range s.ShareAccounts {
+		if !awsAccountPattern.MatchString(account) {
+			return &APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Invalid AWS account ID: %s"), account), Remediation: "Use 12-digit account IDs."}
+		}
+	}
+	return nil
+}
+
+// Share an AMI, copy it to the job's target regions and share the copies,
+// returning the copies
+func copyAMI(job *Job, s uploadSettings, file, image string) []ImageCopy {
+	if len(s.ShareAccounts) > 0 {
+		if err := shareAMI(job, s.Region, image, s.ShareAccounts); err != nil {
+			job.warnf("Sharing %s failed: %s", image, err)
+		}
+	}
+	if len(s.TargetRegions) == 0 {
+		return nil
+	}
+
+	// Start every copy first, so they run at the same time
+	copies := make([]ImageCopy, len(s.TargetRegions))
+	for i, region := range s.TargetRegions {
+		copies[i] = ImageCopy{Region: region, State: "pending"}
+		job.setStatus("Copying %s from %s to %s", image, s.Region, region)
+		id, err := startAMICopy(job, s, file, image, region)
+		if err != nil {
+			copies[i].State, copies[i].Error = "failed", err.Error()
+			job.warnf("Copying %s to %s failed: %s", image, region, err)
+			continue
+		}
+		copies[i].Image = id
+		job.logf("Copying %s to %s as %s", image, region, id)
+	}
+
+	for i := range copies {
+		c := &copies[i]
+		if c.State != "pending" {
+			continue
+		}
+		if job.ctx.Err() != nil {
+			c.State, c.Error = "failed", "cancelled"
+			continue
+		}
+		if err := waitForAMICopy(job, c); err != nil {
+			c.State, c.Error = "failed", err.Error()
+			if job.ctx.Err() != nil {
+				c.Error = "cancelled"
+			}
+			job.warnf("Copying %s to %s failed: %s", image, c.Region, err)
+			continue
+		}
+		c.State = "available"
+		job.logf("AMI copy %s is available in %s", c.Image, c.Region)
+		if len(s.ShareAccounts) > 0 {
+			if err := shareAMI(job, c.Region, c.Image, s.ShareAccounts); err != nil {
+				job.warnf("Sharing %s in %s failed: %s", c.Image, c.Region, err)
+			}
+		}
+	}
+
+	// A copy still pending when the job was cancelled is deregistered, which
+	// stops it
+	if job.ctx.Err() != nil && !mocked("aws") {
+		for _, c := range copies {
+			if c.Image != "" && c.Error == "cancelled" {
+				if err := runQuiet(toolCommand(context.Background(), "aws", "ec2", "deregister-image", "--image-id", c.Image, "--region", c.Region)); err != nil {
+					job.warnf("Stopping the copy %s in %s failed: %s", c.Image, c.Region, err)
+				}
+			}
+		}
+	}
+	available := 0
+	for _, c := range copies {
+		if c.State == "available" {
+			available++
+		}
+	}
+	job.logf("Copied %s to %d of %d region(s)", image, available, len(copies))
+	return copies
+}
+
+// Start copying an AMI to a region, returning the copy's AMI ID
+func startAMICopy(job *Job, s uploadSettings, file, image, region string) (string, error) {
+	if mocked("aws") {
+		return fmt.Sprintf("ami-%017x", rand.Int63()), nil
+	}
+	out, err := toolCommand(job.ctx, "aws", "ec2", "copy-image", "--source-image-id", image, "--source-region", s.Region,
+		"--region", region, "--name", amiName(job, file),
+		"--description", "Copied by Porter job "+job.ID+" from "+image+" in "+s.Region,
+		"--tag-specifications", "ResourceType=image,Tags=[{Key=porter-job,Value="+job.ID+"}]",
+		"--query", "ImageId", "--output", "text").CombinedOutput()
+	id := strings.TrimSpace(string(out))
+	if err != nil {
+		return "", fmt.Errorf("copy-image failed: %w: %s", err, id)
+	}
+	if !strings.HasPrefix(id, "ami-") {
+		return "", fmt.Errorf("unexpected copy-image output: %s", id)
+	}
+	return id, nil
+}
+
+// Wait for a copy to become available
+func waitForAMICopy(job *Job, c *ImageCopy) error {
+	task := CloudTask{Kind: "AMI copy", ID: c.Image + " in " + c.Region, Status: "pending"}
+	if mocked("aws") {
+		return mockImport(job, task.Kind, task.ID, "the copy of "+c.Image+" to "+c.Region)
+	}
+	return waitForCloudTask(job, task, awsImportTimeout, func(t *CloudTask) (bool, error) {
+		out, err := toolCommand(job.ctx, "aws", "ec2", "describe-images", "--image-ids", c.Image, "--region", c.Region,
+			"--query", "Images[0].[State, StateReason.Message]", "--output", "text").Output()
+		if err != nil {
+			return false, fmt.Errorf("describe-images failed for %s: %w", c.Image, err)
+		}
+		fields := strings.SplitN(strings.TrimSpace(string(out)), "\t", 2)
+		t.Status = fields[0]
+		switch fields[0] {
+		case "available":
+			return true, nil
+		case "failed", "error", "invalid", "deregistered":
+			reason := ""
+			if len(fields) > 1 && fields[1] != "None" {
+				reason = ": " + fields[1]
+			}
+			return false, fmt.Errorf("AMI copy %s is %s%s", c.Image, fields[0], reason)
+		}
+		return false, nil
+	})
+}
+
+// Let accounts launch an AMI in a region and create volumes from its
+// snapshots
+func shareAMI(job *Job, region, image string, accounts []string) error {
+	job.setStatus("Sharing %s with %s", image, strings.Join(accounts, ", "))
+	if mocked("aws") {
+		job.logf("Mock mode: shared %s with %s", image, strings.Join(accounts, ", "))
+		return nil
+	}
+	withRegion := func(args ...string) []string {
+		if region != "" {
+			args = append(args, "--region", region)
+		}
+		return args
+	}
+	var users []string
+	for _, account := range accounts {
+		users = append(users, "{UserId="+account+"}")
+	}
+	out, err := toolCommand(job.ctx, "aws", withRegion("ec2", "modify-image-attribute", "--image-id", image,
+		"--launch-permission", "Add=["+strings.Join(users, ",")+"]")...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("modify-image-attribute failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	out, err = toolCommand(job.ctx, "aws", withRegion("ec2", "describe-images", "--image-ids", image,
+		"--query", "Images[0].BlockDeviceMappings[].Ebs.SnapshotId", "--output", "text")...).Output()
+	if err != nil {
+		return fmt.Errorf("describe-images failed for %s: %w", image, err)
+	}
+	for _, snapshot := range slices.Compact(strings.Fields(string(out))) {
+		out, err := toolCommand(job.ctx, "aws", withRegion(append([]string{"ec2", "modify-snapshot-attribute", "--snapshot-id", snapshot,
+			"--attribute", "createVolumePermission", "--operation-type", "add", "--user-ids"}, accounts...)...)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("modify-snapshot-attribute failed for %s: %w: %s", snapshot, err, strings.TrimSpace(string(out)))
+		}
+	}
+	job.logf("Shared %s with %s", image, strings.Join(accounts, ", "))
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error codes returned in APIError.Code
+const (
+	errCodeInvalidRequest       = "invalid_request"
+	errCodeNotFound             = "not_found"
+	errCodeUnauthorized         = "unauthorized"
+	errCodeMethodNotAllowed     = "method_not_allowed"
+	errCodeConflict             = "conflict"
+	errCodeIdempotencyKeyReused = "idempotency_key_reused"
+	errCodeUnsupportedFormat    = "unsupported_format"
+	errCodeInsufficientStorage  = "insufficient_storage"
+	errCodeProviderFailed       = "provider_failed"
+	errCodeProviderUnavailable  = "provider_unavailable"
+	errCodeInternal             = "internal_error"
+)
+
+// APIError is the JSON body returned by every API endpoint on failure
+type APIError struct {
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	Details     string `json:"details,omitempty"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// Write a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Write a structured API error and log it. Constant messages are translated
+// here; ones built from values are translated as formats where they are built,
+// as fmt.Sprintf(tr(format), ...), since the formatted text has no translation.
+func writeAPIError(w http.ResponseWriter, status int, apiErr APIError) {
+	apiErr.Message, apiErr.Remediation = tr(apiErr.Message), tr(apiErr.Remediation)
+	fmt.Printf("API error %d %s: %s\n", status, apiErr.Code, apiErr.Message)
+	if apiErr.Details != "" {
+		fmt.Printf("  Details: %s\n", apiErr.Details)
+	}
+	writeJSON(w, status, apiErr)
+}
+
+// Whether the client asked for JSON rather than an HTML page
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// Report an error from a form handler: structured JSON for API clients, plain text otherwise
+func respondError(w http.ResponseWriter, r *http.Request, status int, apiErr APIError) {
+	if wantsJSON(r) {
+		writeAPIError(w, status, apiErr)
+		return
+	}
+	msg := tr(apiErr.Message)
+	if apiErr.Details != "" {
+		msg += ": " + apiErr.Details
+	}
+	http.Error(w, msg, status)
+}
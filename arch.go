@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Guest architecture: x86_64 or aarch64, as virt-inspector finds it in the
+// guest's binaries, else as the OVF's guest type names it (VMware's arm-*
+// guest IDs are aarch64, other *64Guest IDs x86_64). Destinations that only
+// run one architecture say so in their readiness requirements, so an aarch64
+// appliance isn't imported as an x86_64 AMI without a warning, and artifacts
+// that record an architecture (ECS imports, Incus images, containerdisks)
+// record the guest's.
+
+const (
+	archX86_64  = "x86_64"
+	archAArch64 = "aarch64"
+)
+
+// The canonical name of an architecture as virt-inspector, OCI or clouds write it
+func normalizeArch(arch string) string {
+	switch strings.ToLower(strings.TrimSpace(arch)) {
+	case "x86_64", "amd64", "x64":
+		return archX86_64
+	case "aarch64", "arm64":
+		return archAArch64
+	case "i386", "i486", "i586", "i686", "x86":
+		return "i686"
+	}
+	return strings.ToLower(strings.TrimSpace(arch))
+}
+
+// The architecture an OVF guest type implies, or "" if it doesn't say
+func ovfArch(osType string) string {
+	osType = strings.ToLower(osType)
+	switch {
+	case osType == "":
+		return ""
+	case strings.HasPrefix(osType, "arm-") || strings.Contains(osType, "arm64") || strings.Contains(osType, "aarch64"):
+		return archAArch64
+	case strings.HasSuffix(osType, "64guest") || strings.HasSuffix(osType, "-64"):
+		return archX86_64
+	case strings.HasSuffix(osType, "guest"):
+		return "i686"
+	}
+	return ""
+}
+
+// The architecture of a disk's guest: from the job's readiness checks, else
+// from its OVF; "" if neither says
+func guestArch(job *Job, file string) string {
+	job.mu.Lock()
+	for _, report := range job.Readiness {
+		if diskVMDKName(report.Disk) == diskVMDKName(file) && report.Architecture != "" {
+			job.mu.Unlock()
+			return report.Architecture
+		}
+	}
+	job.mu.Unlock()
+	return ovfArch(hardwareForDisk(file).OSType)
+}
+
+// Warn when a disk's guest can't run on the job's destination. Disks the
+// readiness checks covered were already warned about.
+func checkGuestArch(job *Job, s uploadSettings, file string) {
+	req, ok := cloudReadinessRequirements[s.Cloud]
+	if !ok || len(req.Architectures) == 0 {
+		return
+	}
+	switch s.Cloud {
+	case "aws", "azure", "gcp", "ibm", "alibaba":
+		// A storage upload runs nothing until an image is made from it
+		if !s.CreateImage {
+			return
+		}
+	}
+	job.mu.Lock()
+	for _, report := range job.Readiness {
+		if diskVMDKName(report.Disk) == diskVMDKName(file) && report.Architecture != "" {
+			job.mu.Unlock()
+			return
+		}
+	}
+	job.mu.Unlock()
+	if arch := guestArch(job, file); arch != "" && !slices.Contains(req.Architectures, arch) {
+		job.warnf("%s", archMismatch(filepath.Base(file), arch, s.Cloud, req))
+	}
+}
+
+// Why a guest of arch can't run on a cloud
+func archMismatch(disk, arch, cloud string, req cloudRequirements) string {
+	message := fmt.Sprintf("%s is an %s guest, but %s only runs %s", disk, arch, cloud, strings.Join(req.Architectures, " and "))
+	if req.ArchitectureNote != "" {
+		message += "; " + req.ArchitectureNote
+	}
+	return message
+}
+
+// An architecture, or x86_64 if unknown, as a target names it: with
+// names[0] for x86_64 and names[1] for aarch64
+func archName(arch string, names [2]string) string {
+	if arch == archAArch64 {
+		return names[1]
+	}
+	return names[0]
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Artifact repositories: JFrog Artifactory generic repositories and Sonatype
+// Nexus raw repositories, for teams that keep golden images as versioned
+// artifacts. Each disk is published at <repository>/<path>/<version>/<file>,
+// with the repository as bucket, the path as target and a version (the
+// upload time, 20060102.150405, unless given). The server url is the base
+// Artifactory URL (https://host/artifactory) or Nexus URL (https://host).
+//
+// Checksums are uploaded with the disk: Artifactory is sent its SHA-1, SHA-256
+// and MD5 as X-Checksum headers and rejects the upload if the data doesn't
+// match. Nexus computes its own SHA-1 (served as <file>.sha1), which is compared
+// with Porter's afterwards, and a <file>.sha256 is published beside the disk
+// for consumers.
+//
+// Credentials come from the artifactory or nexus destination profile whose url
+// the server is under (username and password, or an Artifactory access token),
+// or from ARTIFACTORY_TOKEN, ARTIFACTORY_USERNAME and ARTIFACTORY_PASSWORD, or
+// NEXUS_USERNAME and NEXUS_PASSWORD.
+
+// Checksums computed for every published artifact
+var artifactChecksums = []string{"sha256", "sha1", "md5"}
+
+// The environment variable naming the server of a repository target
+func artifactServerEnv(cloud string) string {
+	return strings.ToUpper(cloud) + "_URL"
+}
+
+// Add the credentials for a repository server URL to a request: those of the
+// profile the URL is under, else the environment's, which only go to URLs
+// under the environment's server or a profile's
+func authorizeArtifactRequest(req *http.Request, cloud string) {
+	rawURL := req.URL.String()
+	configured := false
+	for _, profile := range config.Destinations {
+		if profile.Cloud != cloud || profile.URL == "" || !urlUnder(rawURL, profile.URL) {
+			continue
+		}
+		if profile.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+os.ExpandEnv(profile.Token))
+			return
+		}
+		if profile.Username != "" {
+			req.SetBasicAuth(profile.Username, profile.Password)
+			return
+		}
+		configured = true
+	}
+	if server := os.Getenv(artifactServerEnv(cloud)); !configured && (server == "" || !urlUnder(rawURL, server)) {
+		return
+	}
+	prefix := strings.ToUpper(cloud)
+	if token := os.Getenv(prefix + "_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if user := os.Getenv(prefix + "_USERNAME"); user != "" {
+		req.SetBasicAuth(user, os.Getenv(prefix+"_PASSWORD"))
+	}
+}
+
+// Send a request to a repository server, turning error statuses into errors
+// carrying the response body
+func artifactRequest(ctx context.Context, cloud, method, rawURL string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body == nil {
+		req.Header.Set("Accept", "application/json")
+	}
+	authorizeArtifactRequest(req, cloud)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		return resp, fmt.Errorf("%s %s: %s: %s", method, rawURL, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// The URL of a path in a repository; Nexus serves repositories under /repository
+func artifactURL(cloud, server, repository, p string) string {
+	base := strings.TrimRight(server, "/")
+	if cloud == "nexus" {
+		base += "/repository"
+	}
+	return joinEscapedURL(base, path.Join(repository, p))
+}
+
+// The version an upload is published as
+func artifactVersion(s uploadSettings, now time.Time) string {
+	if s.Version != "" {
+		return s.Version
+	}
+	return now.UTC().Format("20060102.150405")
+}
+
+// Publish one file to an artifact repository, returning its URL and SHA-256
+func uploadToArtifactRepo(job *Job, s uploadSettings, file string) (string, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	sums, err := checksumFileForJob(job, file, artifactChecksums)
+	if err != nil {
+		return "", "", err
+	}
+
+	version := artifactVersion(s, job.CreatedAt)
+	dest := artifactURL(s.Cloud, s.URL, s.Bucket, path.Join(s.Target, version, filepath.Base(file)))
+	job.setStatus("Publishing %s as version %s: %s (%.2f MB)",
+		filepath.Base(file), version, dest, float64(info.Size())/(1024*1024))
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPut, dest, &jobReader{job: job, r: f})
+	if err != nil {
+		return "", "", err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if s.Cloud == "artifactory" {
+		req.Header.Set("X-Checksum-Sha256", sums["sha256"])
+		req.Header.Set("X-Checksum-Sha1", sums["sha1"])
+		// X-Checksum is the MD5
+		req.Header.Set("X-Checksum", sums["md5"])
+	}
+	authorizeArtifactRequest(req, s.Cloud)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("publishing %s failed: %w", file, err)
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return "", "", fmt.Errorf("publishing %s failed: %s: %s", file, resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	if s.Cloud == "nexus" {
+		if err := verifyNexusChecksum(job, dest, sums["sha1"]); err != nil {
+			return "", "", err
+		}
+		sidecar := strings.NewReader(sums["sha256"] + "  " + filepath.Base(file) + "\n")
+		resp, err := artifactRequest(job.ctx, s.Cloud, http.MethodPut, dest+".sha256", sidecar,
+			http.Header{"Content-Type": {"text/plain"}})
+		if err != nil {
+			// The disk itself is verified, so this doesn't fail the upload
+			job.warnf("Publishing the SHA-256 of %s failed: %s", filepath.Base(file), err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+	job.logf("Published %s as %s (sha256 %s)", filepath.Base(file), dest, sums["sha256"])
+	return dest, sums["sha256"], nil
+}
+
+// Compare the SHA-1 Nexus computed for an asset with Porter's
+func verifyNexusChecksum(job *Job, dest, sha1 string) error {
+	resp, err := artifactRequest(job.ctx, "nexus", http.MethodGet, dest+".sha1", nil, nil)
+	if err != nil {
+		return fmt.Errorf("reading the checksum Nexus stored failed: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || !strings.EqualFold(fields[0], sha1) {
+		return fmt.Errorf("checksum mismatch for %s: Nexus stored SHA-1 %s, expected %s", dest, strings.TrimSpace(string(data)), sha1)
+	}
+	return nil
+}
+
+// Delete a published artifact and, on Nexus, the checksum file beside it
+func deleteArtifactRepoFile(cloud, rawURL string) error {
+	resp, err := artifactRequest(context.Background(), cloud, http.MethodDelete, rawURL, nil, nil)
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+		return err
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+	if cloud == "nexus" {
+		if resp, err := artifactRequest(context.Background(), cloud, http.MethodDelete, rawURL+".sha256", nil, nil); err == nil {
+			resp.Body.Close()
+		}
+	}
+	return nil
+}
+
+// List the artifacts under a path in a repository
+func listArtifactRepoObjects(ctx context.Context, cloud, server, repository, prefix string) ([]DestinationObject, error) {
+	if cloud == "nexus" {
+		return listNexusAssets(ctx, server, repository, prefix)
+	}
+	var listing struct {
+		Files []struct {
+			URI          string `json:"uri"`
+			Size         int64  `json:"size"`
+			LastModified string `json:"lastModified"`
+			Folder       bool   `json:"folder"`
+		} `json:"files"`
+	}
+	endpoint := joinEscapedURL(strings.TrimRight(server, "/")+"/api/storage", path.Join(repository, prefix)) + "?list&deep=1"
+	resp, err := artifactRequest(ctx, cloud, http.MethodGet, endpoint, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, fmt.Errorf("failed to parse the Artifactory listing: %w", err)
+	}
+	var objects []DestinationObject
+	for _, file := range listing.Files {
+		if file.Folder {
+			continue
+		}
+		objects = append(objects, DestinationObject{
+			Name:         path.Join(prefix, strings.TrimPrefix(file.URI, "/")),
+			Size:         file.Size,
+			LastModified: file.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+// List the assets of a Nexus repository under a path, page by page
+func listNexusAssets(ctx context.Context, server, repository, prefix string) ([]DestinationObject, error) {
+	var objects []DestinationObject
+	token := ""
+	for {
+		query := url.Values{"repository": {repository}}
+		if token != "" {
+			query.Set("continuationToken", token)
+		}
+		var page struct {
+			Items []struct {
+				Path         string `json:"path"`
+				FileSize     int64  `json:"fileSize"`
+				LastModified string `json:"lastModified"`
+			} `json:"items"`
+			ContinuationToken string `json:"continuationToken"`
+		}
+		endpoint := strings.TrimRight(server, "/") + "/service/rest/v1/assets?" + query.Encode()
+		resp, err := artifactRequest(ctx, "nexus", http.MethodGet, endpoint, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the Nexus asset listing: %w", err)
+		}
+		for _, item := range page.Items {
+			name := strings.TrimPrefix(item.Path, "/")
+			if prefix != "" && !strings.HasPrefix(name, strings.TrimSuffix(prefix, "/")+"/") {
+				continue
+			}
+			if strings.HasSuffix(name, ".sha256") || strings.HasSuffix(name, ".sha1") {
+				continue
+			}
+			objects = append(objects, DestinationObject{Name: name, Size: item.FileSize, LastModified: item.LastModified})
+		}
+		if page.ContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.ContinuationToken
+	}
+}
+
+// Confirm a server is configured and accepts Porter's credentials
+func checkArtifactRepoCredentials(cloud string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		server := os.Getenv(artifactServerEnv(cloud))
+		if server == "" {
+			for _, profile := range config.Destinations {
+				if profile.Cloud == cloud && profile.URL != "" {
+					server = profile.URL
+					break
+				}
+			}
+		}
+		if server == "" {
+			return fmt.Errorf("no %s server configured; set %s or add a %s destination profile", cloud, artifactServerEnv(cloud), cloud)
+		}
+		endpoint := strings.TrimRight(server, "/") + "/api/repositories"
+		if cloud == "nexus" {
+			endpoint = strings.TrimRight(server, "/") + "/service/rest/v1/repositories"
+		}
+		resp, err := artifactRequest(ctx, cloud, http.MethodGet, endpoint, nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuthorizeArtifactRequest(t *testing.T) {
+	saved := config.Destinations
+	defer func() { config.Destinations = saved }()
+	config.Destinations = map[string]DestinationProfile{
+		"golden": {Cloud: "artifactory", URL: "https://artifacts.example.com/artifactory", Token: "profile-token"},
+		"nexus":  {Cloud: "nexus", URL: "https://nexus.example.com", Username: "deployer", Password: "pw"},
+	}
+	t.Setenv("ARTIFACTORY_URL", "https://jfrog.example.com/artifactory")
+	t.Setenv("ARTIFACTORY_TOKEN", "env-token")
+	tests := []struct {
+		cloud, url, want string
+	}{
+		{"artifactory", "https://artifacts.example.com/artifactory/images/web01/1.0/disk.qcow2", "Bearer profile-token"},
+		{"artifactory", "https://artifacts.example.com.evil.tld/artifactory/images/disk.qcow2", ""},
+		{"artifactory", "https://artifacts.example.com/artifactory-old/images/disk.qcow2", ""},
+		{"artifactory", "https://jfrog.example.com/artifactory/images/disk.qcow2", "Bearer env-token"},
+		{"artifactory", "https://attacker.example.net/artifactory/images/disk.qcow2", ""},
+		{"nexus", "https://nexus.example.com/repository/raw/disk.qcow2", "Basic ZGVwbG95ZXI6cHc="},
+		{"nexus", "https://artifacts.example.com/artifactory/images/disk.qcow2", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPut, tt.url, nil)
+		authorizeArtifactRequest(req, tt.cloud)
+		if got := req.Header.Get("Authorization"); got != tt.want {
+			t.Errorf("%s %s: Authorization %q, want %q", tt.cloud, tt.url, got, tt.want)
+		}
+	}
+}
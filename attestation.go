@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Artifact attestations: when attestation.mode is set in porter.json, each
+// completed job gets an in-toto statement of what it produced. Its subjects are
+// the uploaded artifacts with their SHA-256 digests. Its predicate is SLSA
+// provenance v1 describing the pipeline: the job's parameters, the source, and
+// each conversion, guest step and upload with its digest. cosign signs the
+// statement, either with a key (mode "key": attestation.key or COSIGN_KEY, a
+// key file or KMS URI, its password in COSIGN_PASSWORD) or keyless through
+// Sigstore (mode "keyless", with an OIDC token in SIGSTORE_ID_TOKEN). The
+// statement and cosign's bundle are kept with the transfer reports, for
+// platform teams to check with cosign verify-blob before importing the images.
+
+type AttestationConfig struct {
+	// "key" or "keyless"; unset, no attestations are made
+	Mode string `json:"mode,omitempty"`
+	// cosign key file or KMS URI for mode "key" (default COSIGN_KEY)
+	Key string `json:"key,omitempty"`
+}
+
+const (
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+	porterBuildType     = "https://github.com/michaelcade/porter/pipeline/v1"
+	// cosign signs keyless through Fulcio and Rekor, so give it time
+	attestationTimeout = 5 * time.Minute
+)
+
+// Check the attestation settings, turning attestations off if they are unusable
+func (c *Config) validateAttestation(path string) {
+	switch c.Attestation.Mode {
+	case "", "keyless":
+	case "key":
+		if c.Attestation.Key == "" && os.Getenv("COSIGN_KEY") == "" {
+			fmt.Printf("Warning: attestation.mode key needs attestation.key or COSIGN_KEY in config %s (attestations disabled)\n", path)
+			c.Attestation = AttestationConfig{}
+		}
+	default:
+		fmt.Printf("Warning: unknown attestation.mode '%s' in config %s (attestations disabled)\n", c.Attestation.Mode, path)
+		c.Attestation = AttestationConfig{}
+	}
+}
+
+// A subject or other artifact: SLSA's ResourceDescriptor
+type resourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type inTotoStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []resourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     slsaProvenance       `json:"predicate"`
+}
+
+type slsaProvenance struct {
+	BuildDefinition struct {
+		BuildType            string               `json:"buildType"`
+		ExternalParameters   JobSpec              `json:"externalParameters"`
+		ResolvedDependencies []resourceDescriptor `json:"resolvedDependencies,omitempty"`
+	} `json:"buildDefinition"`
+	RunDetails struct {
+		Builder struct {
+			ID string `json:"id"`
+		} `json:"builder"`
+		Metadata struct {
+			InvocationID string     `json:"invocationId"`
+			StartedOn    *time.Time `json:"startedOn,omitempty"`
+			FinishedOn   *time.Time `json:"finishedOn,omitempty"`
+		} `json:"metadata"`
+		// The pipeline's steps, in order
+		Byproducts []resourceDescriptor `json:"byproducts,omitempty"`
+	} `json:"runDetails"`
+}
+
+func attestationPath(id, ext string) string {
+	return filepath.Join(reportDir, id+".intoto."+ext)
+}
+
+// SHA-256 of a local file
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// The statement for a completed job. Uploads with no SHA-256 recorded are
+// hashed from the file that was uploaded.
+func buildAttestation(job *Job) (inTotoStatement, error) {
+	snap := job.snapshot()
+	statement := inTotoStatement{Type: inTotoStatementType, Subject: []resourceDescriptor{}, PredicateType: slsaProvenanceType}
+	p := &statement.Predicate
+	p.BuildDefinition.BuildType = porterBuildType
+	p.BuildDefinition.ExternalParameters = snap.Spec
+	// Credentials don't belong in a published attestation: the spec has no
+	// password, and a SAS URL's signature is dropped
+	if u, err := url.Parse(snap.Spec.URL); err == nil && u.RawQuery != "" {
+		u.RawQuery = ""
+		p.BuildDefinition.ExternalParameters.URL = u.String()
+	}
+	if snap.Spec.Source != "" {
+		p.BuildDefinition.ResolvedDependencies = append(p.BuildDefinition.ResolvedDependencies, resourceDescriptor{Name: "source", URI: snap.Spec.Source})
+	}
+	host, _ := os.Hostname()
+	p.RunDetails.Builder.ID = "porter://" + host
+	p.RunDetails.Metadata.InvocationID = snap.ID
+	p.RunDetails.Metadata.StartedOn, p.RunDetails.Metadata.FinishedOn = snap.StartedAt, snap.FinishedAt
+
+	steps := &p.RunDetails.Byproducts
+	for _, c := range snap.Conversions {
+		*steps = append(*steps, resourceDescriptor{Name: "convert", URI: "file://" + c.Output,
+			Digest:      map[string]string{"sha256": c.Checksum},
+			Annotations: map[string]string{"input": c.Input, "format": c.Format, "subformat": c.Subformat}})
+	}
+	for _, step := range snap.Spec.GuestSteps {
+		*steps = append(*steps, resourceDescriptor{Name: "guest-step", Annotations: map[string]string{"step": step}})
+	}
+	for _, r := range snap.Results {
+		if r.Error != "" {
+			continue
+		}
+		sum := r.Checksum
+		if sum == "" {
+			sum = r.Checksums["sha256"]
+		}
+		if sum == "" {
+			var err error
+			if sum, err = fileSHA256(r.File); err != nil {
+				return statement, fmt.Errorf("hashing %s failed: %w", r.File, err)
+			}
+		}
+		digest := map[string]string{"sha256": sum}
+		upload := resourceDescriptor{Name: "upload", URI: r.Destination, Digest: digest,
+			Annotations: map[string]string{"file": r.File, "cloud": snap.Spec.Cloud}}
+		if r.Image != "" {
+			upload.Annotations["image"] = r.Image
+		}
+		*steps = append(*steps, upload)
+		statement.Subject = append(statement.Subject, resourceDescriptor{Name: r.Destination, Digest: digest})
+	}
+	return statement, nil
+}
+
+// Write and sign the attestation of a job that has just completed; run in the
+// background since hashing and keyless signing take a while
+func attestJob(job *Job) {
+	// Any warning comes after the job's history was saved
+	defer jobs.saveHistory()
+	statement, err := buildAttestation(job)
+	if err != nil {
+		job.warnf("No attestation made: %s", err)
+		return
+	}
+	if len(statement.Subject) == 0 {
+		return
+	}
+	data, _ := json.MarshalIndent(statement, "", "  ")
+	path := attestationPath(job.ID, "json")
+	if err = os.MkdirAll(reportDir, 0755); err == nil {
+		err = os.WriteFile(path, append(data, '\n'), 0644)
+	}
+	if err != nil {
+		job.warnf("Could not save the attestation: %s", err)
+		return
+	}
+
+	bundle := attestationPath(job.ID, "bundle")
+	args := []string{"sign-blob", "--yes", "--bundle", bundle}
+	if config.Attestation.Mode == "key" {
+		key := config.Attestation.Key
+		if key == "" {
+			key = os.Getenv("COSIGN_KEY")
+		}
+		args = append(args, "--key", key)
+	} else if token := os.Getenv("SIGSTORE_ID_TOKEN"); token != "" {
+		args = append(args, "--identity-token", token)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), attestationTimeout)
+	defer cancel()
+	out, err := toolCommand(ctx, "cosign", append(args, path)...).CombinedOutput()
+	if err != nil {
+		os.Remove(bundle)
+		job.warnf("Signing the attestation with cosign failed (the unsigned statement is kept): %s: %s", err, strings.TrimSpace(string(out)))
+		return
+	}
+	job.logf("Attestation of %d artifact(s) signed with cosign (%s)", len(statement.Subject), config.Attestation.Mode)
+}
+
+// Handler for GET /api/jobs/{id}/attestation: a job's in-toto statement, or
+// with ?part=bundle the cosign bundle signing it
+func jobAttestationHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !filepath.IsLocal(id) || strings.ContainsAny(id, `/\`) {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("No attestation for job: %s"), id)})
+		return
+	}
+	ext, name := "json", "porter-attestation-"+id+".intoto.json"
+	switch r.URL.Query().Get("part") {
+	case "", "statement":
+	case "bundle":
+		ext, name = "bundle", "porter-attestation-"+id+".bundle"
+	default:
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Unknown attestation part: %s"), r.URL.Query().Get("part")), Remediation: "Use part=statement or part=bundle."})
+		return
+	}
+	data, err := os.ReadFile(attestationPath(id, ext))
+	if err != nil {
+		remediation := "Attestations are made for completed jobs when attestation.mode is set in porter.json."
+		if ext == "bundle" {
+			remediation = "The statement was not signed; see the job's warnings."
+		}
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("No attestation for job: %s"), id), Remediation: remediation})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Write(data)
+}
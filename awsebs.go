@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EBS direct uploads (awsImport ebs): rather than staging a disk in S3 for VM
+// Import, a raw disk is written straight into a new EBS snapshot with the EBS
+// direct APIs (start-snapshot, put-snapshot-block, complete-snapshot), and with
+// createImage an AMI is registered from the snapshot as for import-snapshot.
+// No bucket, vmimport role or import task is involved. A new snapshot reads as
+// zeros where nothing was written, so blocks of zeros aren't sent and sparse
+// disks go up in a fraction of their size. If Porter stops partway, AWS
+// cancels the snapshot once no block has arrived for ebsSnapshotTimeout
+// minutes.
+
+const (
+	// EBS direct APIs write 512 KiB blocks
+	ebsBlockSize = 512 << 10
+	// put-snapshot-block calls in flight per file
+	ebsWorkers = 16
+	// Tries per block before the upload fails
+	ebsBlockAttempts = 3
+	// Minutes without writes before AWS cancels an unfinished snapshot
+	ebsSnapshotTimeout = 60
+)
+
+var ebsZeroBlock = make([]byte, ebsBlockSize)
+
+// A block of the disk to write
+type ebsBlock struct {
+	Index    int64
+	Data     []byte
+	Checksum string
+}
+
+// Write a raw disk into a new EBS snapshot, returning the snapshot ID
+func uploadToEBS(job *Job, s uploadSettings, file string) (string, error) {
+	if diskFormatForPath(file) != "raw" {
+		return "", fmt.Errorf("EBS snapshots are written from raw disks, not %s; convert to raw", filepath.Base(file))
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	gib := (info.Size() + 1<<30 - 1) >> 30
+	if mocked("aws") {
+		id := fmt.Sprintf("snap-%017x", rand.Int63())
+		job.setStatus("Mock mode: writing %s into EBS snapshot %s (%d GiB)", filepath.Base(file), id, gib)
+		if err := mockImport(job, "EBS snapshot", id, "the snapshot of "+filepath.Base(file)); err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+	region := func(args ...string) []string {
+		if s.Region != "" {
+			args = append(args, "--region", s.Region)
+		}
+		return args
+	}
+
+	args := region("ebs", "start-snapshot", "--volume-size", strconv.FormatInt(gib, 10),
+		"--timeout", strconv.Itoa(ebsSnapshotTimeout), "--description", "Written by Porter job "+job.ID+" from "+filepath.Base(file),
+		"--output", "json")
+	tags := []string{"Key=porter-job,Value=" + job.ID}
+	for _, pair := range keyValuePairs(s.Tags) {
+		key, value, _ := strings.Cut(pair, "=")
+		tags = append(tags, "Key="+key+",Value="+value)
+	}
+	args = append(append(args, "--tags"), tags...)
+	out, err := toolCommand(job.ctx, "aws", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("start-snapshot failed for %s: %w: %s", filepath.Base(file), err, strings.TrimSpace(string(out)))
+	}
+	var started struct {
+		SnapshotID string `json:"SnapshotId"`
+	}
+	if err := json.Unmarshal(out, &started); err != nil || started.SnapshotID == "" {
+		return "", fmt.Errorf("unexpected start-snapshot output: %s", strings.TrimSpace(string(out)))
+	}
+	snapshotID := started.SnapshotID
+	job.logf("Writing %s into EBS snapshot %s (%d GiB)", filepath.Base(file), snapshotID, gib)
+
+	written, checksum, err := putEBSBlocks(job, s, file, snapshotID, info.Size())
+	if err == nil {
+		job.setStatus("Completing EBS snapshot %s", snapshotID)
+		out, err = toolCommand(job.ctx, "aws", region("ebs", "complete-snapshot", "--snapshot-id", snapshotID,
+			"--changed-blocks-count", strconv.Itoa(written), "--checksum", checksum,
+			"--checksum-algorithm", "SHA256", "--checksum-aggregation-method", "LINEAR", "--output", "json")...).CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("complete-snapshot failed for %s: %w: %s", snapshotID, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err == nil {
+		task := CloudTask{Kind: "EBS snapshot", ID: snapshotID, Status: "pending"}
+		err = waitForCloudTask(job, task, awsImportTimeout, func(t *CloudTask) (bool, error) {
+			out, err := toolCommand(job.ctx, "aws", region("ec2", "describe-snapshots", "--snapshot-ids", snapshotID,
+				"--query", "Snapshots[0].{state: State, progress: Progress, message: StateMessage}", "--output", "json")...).Output()
+			if err != nil {
+				return false, fmt.Errorf("describe-snapshots failed for %s: %w", snapshotID, err)
+			}
+			var status struct {
+				State    string `json:"state"`
+				Progress string `json:"progress"`
+				Message  string `json:"message"`
+			}
+			if err := json.Unmarshal(out, &status); err != nil {
+				return false, fmt.Errorf("unexpected describe-snapshots output: %w", err)
+			}
+			t.Status, t.Percentage = status.State, parsePercentage(status.Progress)
+			switch status.State {
+			case "completed":
+				return true, nil
+			case "error":
+				return false, fmt.Errorf("EBS snapshot %s failed: %s", snapshotID, status.Message)
+			}
+			return false, nil
+		})
+	}
+	if err != nil {
+		if deleteErr := deleteEBSSnapshot(s.Region, snapshotID); deleteErr != nil {
+			job.warnf("Deleting unfinished EBS snapshot %s failed (AWS cancels it after %d minutes without writes): %s", snapshotID, ebsSnapshotTimeout, deleteErr)
+		}
+		return "", err
+	}
+	job.logf("EBS snapshot %s written from %s", snapshotID, filepath.Base(file))
+	return snapshotID, nil
+}
+
+// Write the blocks of a file that aren't all zeros, ebsWorkers at a time,
+// returning how many were written and the LINEAR aggregate of their SHA-256s
+func putEBSBlocks(job *Job, s uploadSettings, file, snapshotID string, size int64) (int, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	ctx, cancel := context.WithCancel(job.ctx)
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		// The checksums of the blocks sent, in index order
+		sums [][]byte
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+	blocks := make(chan ebsBlock)
+	var wg sync.WaitGroup
+	for range ebsWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tmp, err := os.CreateTemp("", "porter-ebs-*.block")
+			if err != nil {
+				fail(err)
+				return
+			}
+			tmp.Close()
+			defer os.Remove(tmp.Name())
+			for block := range blocks {
+				if err := putEBSBlock(ctx, s, snapshotID, tmp.Name(), block); err != nil {
+					fail(fmt.Errorf("put-snapshot-block %d of %s failed: %w", block.Index, snapshotID, err))
+				}
+			}
+		}()
+	}
+
+	total := (size + ebsBlockSize - 1) / ebsBlockSize
+	r := &jobReader{job: job, r: f}
+	var skipped int64
+	for index := int64(0); index < total && ctx.Err() == nil; index++ {
+		if index%2048 == 0 {
+			job.setStatus("Writing %s into EBS snapshot %s: %d of %d MB (%d MB of zeros skipped)",
+				filepath.Base(file), snapshotID, index/2, total/2, skipped/2)
+		}
+		// The last block is padded with zeros
+		data := make([]byte, ebsBlockSize)
+		if _, err := io.ReadFull(r, data); err != nil && err != io.ErrUnexpectedEOF {
+			fail(err)
+			break
+		}
+		if bytes.Equal(data, ebsZeroBlock) {
+			skipped++
+			continue
+		}
+		sum := sha256.Sum256(data)
+		sums = append(sums, sum[:])
+		select {
+		case blocks <- ebsBlock{Index: index, Data: data, Checksum: base64.StdEncoding.EncodeToString(sum[:])}:
+		case <-ctx.Done():
+		}
+	}
+	close(blocks)
+	wg.Wait()
+	if firstErr != nil {
+		return 0, "", firstErr
+	}
+	if err := job.ctx.Err(); err != nil {
+		return 0, "", err
+	}
+
+	// The aggregate checksum hashes the blocks' checksums in index order
+	aggregate := sha256.New()
+	for _, sum := range sums {
+		aggregate.Write(sum)
+	}
+	job.logf("Wrote %d of %d blocks of %s; %d were zeros", len(sums), total, filepath.Base(file), skipped)
+	return len(sums), base64.StdEncoding.EncodeToString(aggregate.Sum(nil)), nil
+}
+
+// Write one block through a scratch file, retrying failures
+func putEBSBlock(ctx context.Context, s uploadSettings, snapshotID, scratch string, block ebsBlock) error {
+	if err := os.WriteFile(scratch, block.Data, 0600); err != nil {
+		return err
+	}
+	args := []string{"ebs", "put-snapshot-block", "--snapshot-id", snapshotID,
+		"--block-index", strconv.FormatInt(block.Index, 10), "--block-data", "fileb://" + scratch,
+		"--data-length", strconv.Itoa(ebsBlockSize), "--checksum", block.Checksum, "--checksum-algorithm", "SHA256"}
+	if s.Region != "" {
+		args = append(args, "--region", s.Region)
+	}
+	var err error
+	for attempt := 1; attempt <= ebsBlockAttempts && ctx.Err() == nil; attempt++ {
+		var out []byte
+		if out, err = toolCommand(ctx, "aws", args...).CombinedOutput(); err == nil {
+			return nil
+		}
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+// Delete an EBS snapshot
+func deleteEBSSnapshot(region, snapshotID string) error {
+	args := []string{"ec2", "delete-snapshot", "--snapshot-id", snapshotID}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	return runQuiet(toolCommand(context.Background(), "aws", args...))
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AWS VM Import: with createImage, a disk uploaded to S3 is imported as an AMI
+// with ec2 import-image, booting as UEFI or legacy BIOS as the disk does. The
+// vmimport service role must be able to read the bucket. The job follows the
+// import task until the AMI is available, which takes from a few minutes to
+// over an hour. Known failures are reported with their cause and fix, and once
+// fixed the failed imports of a job can be re-run from the objects it uploaded.
+
+// How long to wait for an import task to finish
+const awsImportTimeout = 4 * time.Hour
+
+// Times an import AWS fails on its side is tried
+const awsImportAttempts = 3
+
+// What a known import failure means and what fixes it
+type ImportDiagnosis struct {
+	Cause  string `json:"cause"`
+	Remedy string `json:"remedy"`
+	// Whether the fix changes the disk, so the job must be run again, rather
+	// than the import re-run from the uploaded object (POST /api/jobs/{id}/reimport)
+	Reupload bool `json:"reupload,omitempty"`
+	// Failures AWS causes, retried as they are, and failures for the boot mode,
+	// retried with the other one
+	transient bool
+	bootMode  bool
+}
+
+// Known VM Import failures, by their status message, most specific first
+var awsImportFailures = []struct {
+	pattern   *regexp.Regexp
+	diagnosis ImportDiagnosis
+}{
+	{regexp.MustCompile(`(?i)boot ?mode|uefi|legacy.bios`), ImportDiagnosis{
+		Cause:    "The disk doesn't boot the way it was imported (UEFI or legacy BIOS)",
+		Remedy:   "Re-run the import with the other bootMode",
+		bootMode: true}},
+	{regexp.MustCompile(`(?i)403|forbidden|access denied|not authori[sz]ed|vmimport|role`), ImportDiagnosis{
+		Cause:  "The vmimport service role can't read the uploaded object",
+		Remedy: "Create the vmimport role and give it read access to the bucket (see the VM Import/Export docs), then re-run the import"}},
+	{regexp.MustCompile(`(?i)unsupported kernel`), ImportDiagnosis{
+		Cause:    "VM Import doesn't support the guest's kernel",
+		Remedy:   "Update the guest to a kernel on VM Import's supported list, then run the job again",
+		Reupload: true}},
+	{regexp.MustCompile(`(?i)initramfs|initrd|driver`), ImportDiagnosis{
+		Cause:    "The guest lacks drivers EC2 boots with (NVMe, ENA or Xen storage and network drivers)",
+		Remedy:   "For Linux, rebuild the initramfs with them, e.g. with a guest hook running dracut -f --regenerate-all --add-drivers \"nvme ena xen-blkfront xen-netfront\"; for Windows, run the job again with the inject-virtio guest step",
+		Reupload: true}},
+	{regexp.MustCompile(`(?i)firstbootfailure|failed to boot|inaccessible.boot.device|0x0*7b`), ImportDiagnosis{
+		Cause:    "The guest failed to boot or reach the network during the import, usually for lack of boot-start storage drivers or because of leftover VMware drivers",
+		Remedy:   "Run the job again with the inject-virtio and remove-vmware-tools guest steps",
+		Reupload: true}},
+	{regexp.MustCompile(`(?i)grub|bootloader|menu\.lst|default kernel`), ImportDiagnosis{
+		Cause:    "VM Import couldn't work out the guest's boot configuration",
+		Remedy:   "Make sure the guest has a single GRUB configuration with a default kernel, then run the job again",
+		Reupload: true}},
+	{regexp.MustCompile(`(?i)unknown os|missing os files|no valid partitions|unsupported (os|windows|operating)`), ImportDiagnosis{
+		Cause:  "VM Import couldn't find a supported operating system on the disk",
+		Remedy: "Check the job uploaded the VM's boot disk and that its operating system is on VM Import's supported list"}},
+	{regexp.MustCompile(`(?i)internal ?error|server ?error|service unavailable|throttl|try again`), ImportDiagnosis{
+		Cause:     "AWS failed the import on its side",
+		Remedy:    "Re-run the import",
+		transient: true}},
+}
+
+// An import that failed, with what fixes it if the failure is a known one
+type importError struct {
+	Message   string
+	Diagnosis *ImportDiagnosis
+}
+
+func (e *importError) Error() string {
+	if e.Diagnosis == nil {
+		return e.Message
+	}
+	return fmt.Sprintf("%s. %s. %s", e.Message, e.Diagnosis.Cause, e.Diagnosis.Remedy)
+}
+
+// Look up a failed import's status message among the known failures
+func diagnoseAWSImport(message string) *ImportDiagnosis {
+	for _, failure := range awsImportFailures {
+		if failure.pattern.MatchString(message) {
+			diagnosis := failure.diagnosis
+			return &diagnosis
+		}
+	}
+	return nil
+}
+
+// VM Import's disk format names for Porter's converted images
+var awsImportFormats = map[string]string{
+	".vmdk": "VMDK",
+	".vhd":  "VHD",
+	".raw":  "RAW",
+	".img":  "RAW",
+}
+
+// Import an uploaded S3 object as an AMI, with import-image or, for
+// import-snapshot and register-image, runAWSSnapshotImport (see
+// awssnapshot.go), returning the AMI ID. The boot mode
+// follows the disk's firmware unless given. Failures AWS causes are retried, and
+// an import that fails for the boot mode is retried once with the other one;
+// other known failures come back as an *importError saying what fixes them.
+func importAWSImage(job *Job, s uploadSettings, file, s3Uri, bootMode string) (string, error) {
+	if _, ok := awsImportFormats[strings.ToLower(filepath.Ext(file))]; !ok {
+		return "", fmt.Errorf("VM Import cannot import %s; convert to VMDK, VHD or RAW", filepath.Base(file))
+	}
+	chosen := bootMode != ""
+	if !chosen {
+		bootMode = awsBootMode(job, file)
+	}
+	run := runAWSImport
+	if awsImportMethod(job, s, file) == awsImportSnapshot {
+		run = runAWSSnapshotImport
+	}
+	attempt, flipped := 1, false
+	for {
+		imageID, err := run(job, s, file, s3Uri, bootMode)
+		var importErr *importError
+		if err == nil || !errors.As(err, &importErr) || importErr.Diagnosis == nil || job.ctx.Err() != nil {
+			return imageID, err
+		}
+		switch {
+		case importErr.Diagnosis.transient && attempt < awsImportAttempts:
+			attempt++
+			job.logf("%s; retrying the import (attempt %d of %d)", importErr.Message, attempt, awsImportAttempts)
+		case importErr.Diagnosis.bootMode && !chosen && !flipped:
+			flipped = true
+			bootMode = map[string]string{"uefi": "legacy-bios", "legacy-bios": "uefi"}[bootMode]
+			job.logf("%s; retrying the import with boot mode %s", importErr.Message, bootMode)
+		default:
+			return "", err
+		}
+	}
+}
+
+// The boot mode of a file's disk: uefi or legacy-bios as its firmware is
+func awsBootMode(job *Job, file string) string {
+	firmware, _ := readinessForDisk(job, file)
+	if firmware == "uefi" || (firmware == "" && hardwareForDisk(file).Firmware == "efi") {
+		return "uefi"
+	}
+	return "legacy-bios"
+}
+
+// Run one import of an S3 object with a boot mode and wait for it
+func runAWSImport(job *Job, s uploadSettings, file, s3Uri, bootMode string) (string, error) {
+	if mocked("aws") {
+		return mockAWSImport(job, s3Uri, bootMode)
+	}
+	format := awsImportFormats[strings.ToLower(filepath.Ext(file))]
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(s3Uri, "s3://"), "/")
+	containers, err := json.Marshal([]map[string]interface{}{{
+		"Description": filepath.Base(file),
+		"Format":      format,
+		"UserBucket":  map[string]string{"S3Bucket": bucket, "S3Key": key},
+	}})
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"ec2", "import-image", "--disk-containers", string(containers),
+		"--boot-mode", bootMode, "--description", "Imported by Porter job " + job.ID, "--output", "json"}
+	if s.Region != "" {
+		args = append(args, "--region", s.Region)
+	}
+	job.setStatus("Importing %s as an AMI (%s boot)", s3Uri, bootMode)
+	out, err := toolCommand(job.ctx, "aws", args...).CombinedOutput()
+	if err != nil {
+		return "", &importError{Message: fmt.Sprintf("import-image failed for %s: %s: %s", s3Uri, err, strings.TrimSpace(string(out))),
+			Diagnosis: diagnoseAWSImport(string(out))}
+	}
+	var started struct {
+		ImportTaskID string `json:"ImportTaskId"`
+	}
+	if err := json.Unmarshal(out, &started); err != nil || started.ImportTaskID == "" {
+		return "", fmt.Errorf("unexpected import-image output: %s", strings.TrimSpace(string(out)))
+	}
+
+	var imageID string
+	task := CloudTask{Kind: "AWS import-image", ID: started.ImportTaskID, Status: "pending"}
+	err = waitForCloudTask(job, task, awsImportTimeout, func(t *CloudTask) (bool, error) {
+		args := []string{"ec2", "describe-import-image-tasks", "--import-task-ids", t.ID, "--output", "json"}
+		if s.Region != "" {
+			args = append(args, "--region", s.Region)
+		}
+		out, err := toolCommand(job.ctx, "aws", args...).Output()
+		if err != nil {
+			return false, fmt.Errorf("describe-import-image-tasks failed for %s: %w", t.ID, err)
+		}
+		var resp struct {
+			ImportImageTasks []struct {
+				Status        string `json:"Status"`
+				StatusMessage string `json:"StatusMessage"`
+				Progress      string `json:"Progress"`
+				ImageID       string `json:"ImageId"`
+			} `json:"ImportImageTasks"`
+		}
+		if err := json.Unmarshal(out, &resp); err != nil {
+			return false, fmt.Errorf("unexpected describe-import-image-tasks output: %w", err)
+		}
+		if len(resp.ImportImageTasks) == 0 {
+			return false, fmt.Errorf("import task %s not found", t.ID)
+		}
+		status := resp.ImportImageTasks[0]
+		// Active tasks say what they are doing (e.g. converting, booting) in the message
+		t.Status, t.Percentage = status.Status, parsePercentage(status.Progress)
+		if status.StatusMessage != "" {
+			t.Status += ": " + status.StatusMessage
+		}
+		switch status.Status {
+		case "completed":
+			imageID = status.ImageID
+			return true, nil
+		case "deleting", "deleted":
+			return false, &importError{Message: fmt.Sprintf("AWS import of %s failed: %s", s3Uri, status.StatusMessage),
+				Diagnosis: diagnoseAWSImport(status.StatusMessage)}
+		}
+		return false, nil
+	})
+	if err != nil && job.ctx.Err() != nil {
+		// Don't leave the import running for a cancelled job
+		cancelArgs := []string{"ec2", "cancel-import-task", "--import-task-id", started.ImportTaskID}
+		if s.Region != "" {
+			cancelArgs = append(cancelArgs, "--region", s.Region)
+		}
+		if cancelErr := runQuiet(toolCommand(context.Background(), "aws", cancelArgs...)); cancelErr != nil {
+			job.warnf("Cancelling import task %s failed: %s", started.ImportTaskID, cancelErr)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	job.logf("AMI %s is available", imageID)
+	return imageID, nil
+}
+
+// Handler for POST /api/jobs/{id}/reimport: re-run the failed AMI imports of an
+// AWS job from the objects it uploaded, once what made them fail is fixed,
+// optionally with another bootMode
+func jobReimportHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	var body struct {
+		BootMode string `json:"bootMode"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Invalid JSON body", Details: err.Error()})
+			return
+		}
+	}
+	if body.BootMode != "" && body.BootMode != "uefi" && body.BootMode != "legacy-bios" {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Invalid boot mode: %s"), body.BootMode), Remediation: "Use uefi or legacy-bios, or leave bootMode out to follow the disk."})
+		return
+	}
+	if job.settings.Cloud != "aws" || !job.settings.CreateImage || job.state() != jobFailed {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message: fmt.Sprintf(tr("Only failed AWS jobs that import AMIs have imports to re-run: %s"), job.ID)})
+		return
+	}
+
+	// Uploaded objects and written EBS snapshots have a destination; files
+	// that failed to upload don't
+	var failed []int
+	job.mu.Lock()
+	for i, result := range job.Results {
+		if result.Error != "" && (strings.HasPrefix(result.Destination, "s3://") || strings.HasPrefix(result.Destination, "snap-")) {
+			failed = append(failed, i)
+		}
+	}
+	if len(failed) > 0 {
+		job.done = make(chan struct{})
+	}
+	job.mu.Unlock()
+	if len(failed) == 0 {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message: fmt.Sprintf(tr("No failed imports to re-run in job %s"), job.ID), Remediation: "Files that failed to upload need the job to be run again."})
+		return
+	}
+
+	job.setState(jobRunning)
+	go reimportAWSImages(job, failed, body.BootMode)
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+// Re-run the imports of the given results, cataloguing the uploads that now
+// have an AMI, and finish the job again
+func reimportAWSImages(job *Job, indexes []int, bootMode string) {
+	s := job.settings
+	var imported int
+	for _, i := range indexes {
+		job.mu.Lock()
+		result := job.Results[i]
+		job.mu.Unlock()
+
+		job.logf("Re-running the import of %s", result.Destination)
+		var image string
+		var err error
+		if snapshotID := result.Destination; strings.HasPrefix(snapshotID, "snap-") {
+			if bootMode == "" {
+				bootMode = awsBootMode(job, result.File)
+			}
+			image, err = registerAMI(job, s, result.File, snapshotID, bootMode)
+		} else {
+			image, err = importAWSImage(job, s, result.File, result.Destination, bootMode)
+		}
+		result.Error, result.Diagnosis = "", nil
+		if err != nil {
+			job.logf("%s", err)
+			result.Error = err.Error()
+			var importErr *importError
+			if errors.As(err, &importErr) {
+				result.Diagnosis = importErr.Diagnosis
+			}
+		} else {
+			result.Image = image
+			result.Copies = copyAMI(job, s, result.File, image)
+			imported++
+			job.logf("✅ AMI imported: %s (image %s)", result.Destination, image)
+			artifactCatalog.add(CatalogEntry{Kind: "upload", Cloud: s.Cloud, Source: result.File, Destination: result.Destination,
+				Size: result.Size, Checksums: result.Checksums, Endpoint: s.URL, Region: s.Region, PathStyle: s.PathStyle})
+		}
+		job.mu.Lock()
+		job.Results[i] = result
+		job.mu.Unlock()
+		if job.ctx.Err() != nil {
+			break
+		}
+	}
+
+	state := jobCompleted
+	job.mu.Lock()
+	for _, result := range job.Results {
+		if result.Error != "" {
+			state = jobFailed
+		}
+	}
+	if job.ctx.Err() != nil {
+		state = jobCancelled
+	}
+	job.Message += fmt.Sprintf("\nRe-ran %d import(s): %d imported, %d failed\n", len(indexes), imported, len(indexes)-imported)
+	done := job.done
+	job.mu.Unlock()
+
+	job.setStatus("Re-ran %d import(s): %d imported", len(indexes), imported)
+	job.setState(state)
+	close(done)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// AMIs through import-snapshot and register-image: rather than ec2
+// import-image, which converts the guest and only makes x86_64 AMIs, the
+// uploaded disk becomes an EBS snapshot as it is, and an AMI is registered
+// from it: HVM with ENA, a gp3 root volume, and the boot mode and
+// architecture of the guest. This is how aarch64 (Graviton) guests are
+// imported, and suits Linux guests that already run on EC2. Nothing is
+// installed in the guest, so it needs the NVMe and ENA drivers already, and
+// Windows AMIs made this way carry no Windows license.
+
+const (
+	awsImportImage    = "image"
+	awsImportSnapshot = "snapshot"
+	// EBS direct writes, without a bucket; see awsebs.go
+	awsImportEBS = "ebs"
+	// The root device of registered AMIs
+	awsRootDevice = "/dev/xvda"
+)
+
+// Characters AMI names can't hold
+var amiNameInvalid = regexp.MustCompile(`[^A-Za-z0-9()\[\]./'@_ -]+`)
+
+// How an upload becomes an AMI: the job's awsImport, else import-snapshot for
+// aarch64 guests (which import-image can't import) and import-image otherwise
+func awsImportMethod(job *Job, s uploadSettings, file string) string {
+	arch := guestArch(job, file)
+	switch {
+	case s.AWSImport == awsImportImage && arch == archAArch64:
+		job.warnf("%s is an aarch64 guest, which ec2 import-image can't import; use awsImport snapshot", filepath.Base(file))
+	case (s.AWSImport == awsImportSnapshot || s.AWSImport == awsImportEBS) && s.CreateImage && isWindowsGuest(hardwareForDisk(file), ""):
+		job.warnf("%s is a Windows guest: an AMI registered from its snapshot has no Windows license, and gets no EC2 drivers; use awsImport image for license-included Windows", filepath.Base(file))
+	}
+	if s.AWSImport != "" {
+		return s.AWSImport
+	}
+	if arch == archAArch64 {
+		return awsImportSnapshot
+	}
+	return awsImportImage
+}
+
+// The name of the AMI registered from a file, unique to the job
+func amiName(job *Job, file string) string {
+	name := strings.Trim(amiNameInvalid.ReplaceAllString(baseNameWithoutExt(filepath.Base(file)), "-"), "-")
+	if job.Spec.Name != "" {
+		name = strings.Trim(amiNameInvalid.ReplaceAllString(job.Spec.Name, "-"), "-") + "-" + name
+	}
+	name += "-" + job.ID
+	if len(name) > 128 {
+		name = name[len(name)-128:]
+	}
+	return name
+}
+
+// Import an S3 object as an EBS snapshot and register an AMI from it with a
+// boot mode, returning the AMI ID
+func runAWSSnapshotImport(job *Job, s uploadSettings, file, s3Uri, bootMode string) (string, error) {
+	if mocked("aws") {
+		return mockAWSImport(job, s3Uri, bootMode)
+	}
+	region := func(args ...string) []string {
+		if s.Region != "" {
+			args = append(args, "--region", s.Region)
+		}
+		return args
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(s3Uri, "s3://"), "/")
+	container, err := json.Marshal(map[string]interface{}{
+		"Description": filepath.Base(file),
+		"Format":      awsImportFormats[strings.ToLower(filepath.Ext(file))],
+		"UserBucket":  map[string]string{"S3Bucket": bucket, "S3Key": key},
+	})
+	if err != nil {
+		return "", err
+	}
+	job.setStatus("Importing %s as an EBS snapshot", s3Uri)
+	out, err := toolCommand(job.ctx, "aws", region("ec2", "import-snapshot", "--disk-container", string(container),
+		"--description", "Imported by Porter job "+job.ID, "--output", "json")...).CombinedOutput()
+	if err != nil {
+		return "", &importError{Message: fmt.Sprintf("import-snapshot failed for %s: %s: %s", s3Uri, err, strings.TrimSpace(string(out))),
+			Diagnosis: diagnoseAWSImport(string(out))}
+	}
+	var started struct {
+		ImportTaskID string `json:"ImportTaskId"`
+	}
+	if err := json.Unmarshal(out, &started); err != nil || started.ImportTaskID == "" {
+		return "", fmt.Errorf("unexpected import-snapshot output: %s", strings.TrimSpace(string(out)))
+	}
+
+	var snapshotID string
+	task := CloudTask{Kind: "AWS import-snapshot", ID: started.ImportTaskID, Status: "pending"}
+	err = waitForCloudTask(job, task, awsImportTimeout, func(t *CloudTask) (bool, error) {
+		out, err := toolCommand(job.ctx, "aws", region("ec2", "describe-import-snapshot-tasks", "--import-task-ids", t.ID, "--output", "json")...).Output()
+		if err != nil {
+			return false, fmt.Errorf("describe-import-snapshot-tasks failed for %s: %w", t.ID, err)
+		}
+		var resp struct {
+			ImportSnapshotTasks []struct {
+				SnapshotTaskDetail struct {
+					Status        string `json:"Status"`
+					StatusMessage string `json:"StatusMessage"`
+					Progress      string `json:"Progress"`
+					SnapshotID    string `json:"SnapshotId"`
+				} `json:"SnapshotTaskDetail"`
+			} `json:"ImportSnapshotTasks"`
+		}
+		if err := json.Unmarshal(out, &resp); err != nil {
+			return false, fmt.Errorf("unexpected describe-import-snapshot-tasks output: %w", err)
+		}
+		if len(resp.ImportSnapshotTasks) == 0 {
+			return false, fmt.Errorf("import task %s not found", t.ID)
+		}
+		status := resp.ImportSnapshotTasks[0].SnapshotTaskDetail
+		t.Status, t.Percentage = status.Status, parsePercentage(status.Progress)
+		if status.StatusMessage != "" {
+			t.Status += ": " + status.StatusMessage
+		}
+		switch status.Status {
+		case "completed":
+			snapshotID = status.SnapshotID
+			return true, nil
+		case "deleting", "deleted", "error":
+			return false, &importError{Message: fmt.Sprintf("AWS snapshot import of %s failed: %s", s3Uri, status.StatusMessage),
+				Diagnosis: diagnoseAWSImport(status.StatusMessage)}
+		}
+		return false, nil
+	})
+	if err != nil && job.ctx.Err() != nil {
+		if cancelErr := runQuiet(toolCommand(context.Background(), "aws", region("ec2", "cancel-import-task", "--import-task-id", started.ImportTaskID)...)); cancelErr != nil {
+			job.warnf("Cancelling import task %s failed: %s", started.ImportTaskID, cancelErr)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	job.logf("Snapshot %s imported from %s", snapshotID, s3Uri)
+	return registerAMI(job, s, file, snapshotID, bootMode)
+}
+
+// Register an AMI from a snapshot of a file's disk with a boot mode,
+// returning the AMI ID
+func registerAMI(job *Job, s uploadSettings, file, snapshotID, bootMode string) (string, error) {
+	if mocked("aws") {
+		return mockAWSImport(job, snapshotID, bootMode)
+	}
+	region := func(args ...string) []string {
+		if s.Region != "" {
+			args = append(args, "--region", s.Region)
+		}
+		return args
+	}
+	// Graviton instances only boot through UEFI
+	arch := archName(guestArch(job, file), [2]string{"x86_64", "arm64"})
+	if arch == "arm64" {
+		bootMode = "uefi"
+	}
+	mappings, _ := json.Marshal([]map[string]interface{}{{
+		"DeviceName": awsRootDevice,
+		"Ebs":        map[string]interface{}{"SnapshotId": snapshotID, "VolumeType": "gp3", "DeleteOnTermination": true},
+	}})
+	name := amiName(job, file)
+	job.setStatus("Registering AMI %s (%s, %s boot) from snapshot %s", name, arch, bootMode, snapshotID)
+	out, err := toolCommand(job.ctx, "aws", region("ec2", "register-image", "--name", name,
+		"--description", "Registered by Porter job "+job.ID+" from "+filepath.Base(file),
+		"--architecture", arch, "--boot-mode", bootMode, "--virtualization-type", "hvm", "--ena-support",
+		"--root-device-name", awsRootDevice, "--block-device-mappings", string(mappings),
+		"--query", "ImageId", "--output", "text")...).CombinedOutput()
+	// On failure the snapshot is kept, so the AMI can be registered by hand
+	imageID := strings.TrimSpace(string(out))
+	if err != nil {
+		return "", fmt.Errorf("register-image failed for snapshot %s: %w: %s", snapshotID, err, imageID)
+	}
+	if !strings.HasPrefix(imageID, "ami-") {
+		return "", fmt.Errorf("unexpected register-image output for snapshot %s: %s", snapshotID, imageID)
+	}
+	job.logf("AMI %s registered from snapshot %s", imageID, snapshotID)
+	return imageID, nil
+}
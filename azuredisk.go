@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Azure managed disks, uploaded directly: Porter creates an empty disk ready
+// for upload (az disk create --upload-type Upload) the size of the fixed VHD,
+// gets a write SAS for it (az disk grant-access), writes the VHD's pages that
+// aren't all zeros with Put Page over HTTPS as it does for page blobs, and
+// revokes the SAS, which leaves a managed disk to create VMs from. No storage
+// account is involved and no blob is left behind to convert. The disk gets the
+// Hyper-V generation, and Trusted Launch, its VM needs.
+
+const (
+	// How long the write SAS lasts; revoking it ends the upload sooner
+	azureDiskAccessSeconds = 24 * 60 * 60
+	vhdFooterSize          = 512
+	vhdFixedDiskType       = 2
+)
+
+// The resource ID of a managed disk
+func azureDiskID(subscription, resourceGroup, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/disks/%s", subscription, resourceGroup, name)
+}
+
+// Run az for its output, with its error output in the error
+func azOutput(ctx context.Context, args ...string) (string, error) {
+	out, err := toolCommand(ctx, "az", args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return strings.TrimSpace(string(out)), err
+}
+
+// Check that a file is a fixed VHD of a whole number of MB, as managed disk
+// uploads must be
+func checkFixedVHD(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	footer := make([]byte, vhdFooterSize)
+	if info.Size() < vhdFooterSize {
+		return fmt.Errorf("%s is too small to be a VHD", filepath.Base(file))
+	}
+	if _, err := f.ReadAt(footer, info.Size()-vhdFooterSize); err != nil && err != io.EOF {
+		return err
+	}
+	if string(footer[:8]) != "conectix" || binary.BigEndian.Uint32(footer[60:64]) != vhdFixedDiskType {
+		return fmt.Errorf("%s is not a fixed VHD; convert it to vpc with subformat fixed", filepath.Base(file))
+	}
+	if (info.Size()-vhdFooterSize)%(1<<20) != 0 {
+		return fmt.Errorf("%s is not a whole number of MB; convert it to vpc with subformat fixed, which keeps Azure's sizes", filepath.Base(file))
+	}
+	return nil
+}
+
+// Upload a fixed VHD into a new managed disk, returning the disk's resource ID
+func uploadToAzureDisk(job *Job, s uploadSettings, file string, p vmPlatform) (string, error) {
+	if !strings.EqualFold(filepath.Ext(file), ".vhd") {
+		return "", fmt.Errorf("Azure managed disks are uploaded from fixed VHDs, not %s; convert to vpc with subformat fixed", filepath.Base(file))
+	}
+	if err := checkFixedVHD(file); err != nil {
+		return "", err
+	}
+	name := imageResourceName(job, file)
+	osType := azureOSType(job, s, file)
+	st, err := openUploadStream(job, s, file)
+	if err != nil {
+		return "", err
+	}
+	defer st.Close()
+	job.setStatus("Uploading %s to Azure managed disk %s in %s (generation %d, %.2f MB)",
+		filepath.Base(file), name, s.ResourceGroup, p.Generation, float64(st.Size)/(1024*1024))
+	if mocked("azuredisk") {
+		if err := mockTransfer(job, st.Size); err != nil {
+			return "", err
+		}
+		if err := mockChaos("the upload of " + filepath.Base(file)); err != nil {
+			return "", err
+		}
+		return azureDiskID(mockSubscription, s.ResourceGroup, name), nil
+	}
+
+	common := []string{"--name", name, "--resource-group", s.ResourceGroup}
+	if s.Subscription != "" {
+		common = append(common, "--subscription", s.Subscription)
+	}
+	args := append([]string{"disk", "create"}, common...)
+	args = append(args, "--upload-type", "Upload", "--upload-size-bytes", fmt.Sprint(st.Size),
+		"--os-type", osType, "--hyper-v-generation", fmt.Sprintf("V%d", p.Generation), "--query", "id", "--output", "tsv")
+	if p.SecureBoot || p.TPM {
+		args = append(args, "--security-type", "TrustedLaunch")
+	}
+	if guestArch(job, file) == archAArch64 {
+		args = append(args, "--architecture", "Arm64")
+	}
+	if s.StorageClass != "" {
+		args = append(args, "--sku", s.StorageClass)
+	}
+	if s.Region != "" {
+		args = append(args, "--location", s.Region)
+	}
+	if len(s.Tags) > 0 {
+		args = append(append(args, "--tags"), keyValuePairs(s.Tags)...)
+	}
+	id, err := azOutput(job.ctx, args...)
+	if err != nil {
+		return "", fmt.Errorf("creating Azure managed disk %s failed: %w", name, err)
+	}
+
+	pending := pendingUploads.start("azuredisk", id, s.Subscription)
+	err = writeAzureDisk(job, st, id)
+	if err != nil {
+		abandonUpload(pending)
+		return "", fmt.Errorf("Azure managed disk upload failed for %s: %w", file, err)
+	}
+	pendingUploads.finish(pending.ID)
+	st.finish()
+	job.logf("Create the VM with: az vm create -g %s -n <vm> --attach-os-disk %s --os-type %s%s", s.ResourceGroup, name, osType, azureTrustedLaunchArgs(p))
+	return id, nil
+}
+
+// Write a stream into a disk created for upload, revoking the write SAS after
+func writeAzureDisk(job *Job, st *uploadStream, id string) error {
+	// The CLI calls the SAS accessSas or, in older versions, accessSAS
+	sasURL, err := azOutput(job.ctx, "disk", "grant-access", "--ids", id, "--access-level", "Write",
+		"--duration-in-seconds", fmt.Sprint(azureDiskAccessSeconds), "--query", "accessSas || accessSAS", "--output", "tsv")
+	if err != nil {
+		return fmt.Errorf("getting a write SAS failed: %w", err)
+	}
+	u, err := url.Parse(sasURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("az returned no usable SAS for %s", id)
+	}
+	query := u.Query()
+	query.Set("comp", "page")
+	u.RawQuery = query.Encode()
+	err = putAzurePages(job, st, u.String())
+	// The disk can only be attached, or deleted, once access is revoked
+	if _, revokeErr := azOutput(context.Background(), "disk", "revoke-access", "--ids", id); revokeErr != nil && err == nil {
+		err = fmt.Errorf("revoking the write SAS failed: %w", revokeErr)
+	}
+	return err
+}
+
+// The az vm create flags for a Trusted Launch disk
+func azureTrustedLaunchArgs(p vmPlatform) string {
+	if !p.SecureBoot && !p.TPM {
+		return ""
+	}
+	return fmt.Sprintf(" --security-type TrustedLaunch --enable-secure-boot %t --enable-vtpm %t", p.SecureBoot, p.TPM)
+}
+
+// Delete a managed disk, first ending any upload still open on it
+func deleteAzureDisk(id string) error {
+	toolCommand(context.Background(), "az", "disk", "revoke-access", "--ids", id).Run()
+	_, err := azOutput(context.Background(), "disk", "delete", "--ids", id, "--yes")
+	if err != nil && strings.Contains(err.Error(), "ResourceNotFound") {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Azure images created after the upload: an azure job that only uploaded its
+// VHDs (without createImage) can turn them into deployable images later,
+// once the VM's generation is settled, without uploading them again. VHDs are
+// always uploaded as page blobs (see azurePageBlob), which az image create
+// takes as they are.
+
+// Handler for POST /api/jobs/{id}/azure-image: create Azure images (or Trusted
+// Launch OS disks) from the VHDs a finished azure job uploaded, optionally
+// choosing the generation with {"generation": 1 or 2}
+func jobAzureImageHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	var body struct {
+		Generation    int    `json:"generation"`
+		SecureBoot    *bool  `json:"secureBoot"`
+		TPM           *bool  `json:"tpm"`
+		ResourceGroup string `json:"resourceGroup"`
+		Region        string `json:"region"`
+		OSName        string `json:"osName"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Invalid JSON body", Details: err.Error()})
+			return
+		}
+	}
+	if body.Generation != 0 && body.Generation != 1 && body.Generation != 2 {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Invalid generation: %d"), body.Generation), Remediation: "Use 1 (BIOS) or 2 (UEFI), or leave generation out to follow the disk."})
+		return
+	}
+	if state := job.state(); job.settings.Cloud != "azure" || (state != jobCompleted && state != jobFailed) {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message: fmt.Sprintf(tr("Only finished azure jobs have VHDs to create images from: %s"), job.ID)})
+		return
+	}
+
+	s := job.settings
+	s.CreateImage = true
+	if body.Generation != 0 {
+		s.Generation = body.Generation
+	}
+	if body.SecureBoot != nil {
+		s.SecureBoot = body.SecureBoot
+	}
+	if body.TPM != nil {
+		s.TPM = body.TPM
+	}
+	if body.ResourceGroup != "" {
+		s.ResourceGroup = body.ResourceGroup
+	}
+	if body.Region != "" {
+		s.Region = body.Region
+	}
+	if body.OSName != "" {
+		s.OSName = body.OSName
+	}
+	if s.ResourceGroup == "" {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "Creating an Azure image needs a resource group", Remediation: "Pass 'resourceGroup', and optionally 'region' as the location."})
+		return
+	}
+
+	// Uploaded VHDs that don't have an image yet
+	var pending []int
+	job.mu.Lock()
+	for i, result := range job.Results {
+		if result.Error == "" && result.Image == "" && strings.HasPrefix(result.Destination, "azure://") &&
+			strings.EqualFold(filepath.Ext(result.Destination), ".vhd") {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) > 0 {
+		job.done = make(chan struct{})
+	}
+	job.mu.Unlock()
+	if len(pending) == 0 {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message: fmt.Sprintf(tr("No uploaded VHDs without an image in job %s"), job.ID), Remediation: "Images are created from VHDs; convert the disks to vpc and upload them again."})
+		return
+	}
+
+	job.setState(jobRunning)
+	go createAzureImages(job, s, pending)
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+// Create the images of the given results and finish the job again. A failure
+// leaves the upload as it was, with a warning, so it can be tried again.
+func createAzureImages(job *Job, s uploadSettings, indexes []int) {
+	var created int
+	for _, i := range indexes {
+		job.mu.Lock()
+		result := job.Results[i]
+		job.mu.Unlock()
+
+		platform, err := platformForDisk(job, s, result.File)
+		var image string
+		if err == nil {
+			image, err = createAzureImage(job, s, result.File, result.Destination, platform)
+		}
+		if err != nil {
+			job.warnf("No Azure image created from %s: %s", result.Destination, err)
+		} else {
+			created++
+			job.logf("✅ Azure image created: %s (image %s)", result.Destination, image)
+			job.mu.Lock()
+			job.Results[i].Image = image
+			job.mu.Unlock()
+		}
+		if job.ctx.Err() != nil {
+			break
+		}
+	}
+
+	state := jobCompleted
+	job.mu.Lock()
+	for _, result := range job.Results {
+		if result.Error != "" {
+			state = jobFailed
+		}
+	}
+	if job.ctx.Err() != nil {
+		state = jobCancelled
+	}
+	job.Message += fmt.Sprintf("\nCreated %d of %d Azure image(s)\n", created, len(indexes))
+	done := job.done
+	job.mu.Unlock()
+
+	job.setStatus("Created %d of %d Azure image(s)", created, len(indexes))
+	job.setState(state)
+	close(done)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Azure uploads with a SAS URL, for environments without the az CLI or where
+// it can't log in. A container SAS URL
+// (https://account.blob.core.windows.net/container?sv=...&sig=...) with
+// create and write permissions lets Porter send the blob itself over HTTPS:
+// in blocks committed with Put Block List, or, for VHDs (see azurePageBlob),
+// as a page blob written with Put Page, leaving out the pages that are all
+// zeros. Each request is retried on its own, so a dropped connection costs one
+// block rather than the file. The SAS comes from the request's url, an azure
+// profile's url or AZURE_STORAGE_SAS_URL; catalog deletes and the cleanup of
+// failed uploads use that of a profile or AZURE_STORAGE_SAS_URL for the same
+// container (which needs delete permission), else az.
+
+const (
+	azureAPIVersion = "2021-08-06"
+	// Page blob writes: at most 4 MB, in 512-byte pages
+	azurePageSize      = 512
+	azurePageWriteSize = 4 << 20
+	// Block blobs hold up to 50,000 blocks of up to 4000 MB
+	azureMinBlockSize = 8 << 20
+	azureMaxBlocks    = 50000
+)
+
+// A parsed container SAS URL
+type azureSAS struct {
+	Account   string
+	Container string
+	// The container's URL and the SAS query
+	base  string
+	query url.Values
+}
+
+// Parse a container SAS URL. Emulators (Azurite) put the account in the path:
+// http://127.0.0.1:10000/devstoreaccount1/container?...
+func parseAzureSAS(raw string) (azureSAS, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return azureSAS{}, fmt.Errorf("invalid Azure SAS URL")
+	}
+	query := u.Query()
+	if query.Get("sig") == "" {
+		return azureSAS{}, fmt.Errorf("the Azure SAS URL for %s%s has no signature (sig)", u.Host, u.Path)
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	sas := azureSAS{query: query}
+	switch len(segments) {
+	case 1:
+		sas.Account, _, _ = strings.Cut(u.Hostname(), ".")
+		sas.Container = segments[0]
+	case 2:
+		sas.Account, sas.Container = segments[0], segments[1]
+	}
+	if sas.Account == "" || sas.Container == "" {
+		return azureSAS{}, fmt.Errorf("the Azure SAS URL for %s%s is not for a container", u.Host, u.Path)
+	}
+	u.RawQuery = ""
+	sas.base = strings.TrimRight(u.String(), "/")
+	return sas, nil
+}
+
+// The URL of a blob in the container, with the SAS and any extra parameters
+func (sas azureSAS) blobURL(blob string, extra url.Values) string {
+	query := url.Values{}
+	for key, values := range sas.query {
+		query[key] = values
+	}
+	for key, values := range extra {
+		query[key] = values
+	}
+	return joinEscapedURL(sas.base, blob) + "?" + query.Encode()
+}
+
+// The SAS for a container from a profile or AZURE_STORAGE_SAS_URL, if there is one
+func azureSASFor(account, container string) (azureSAS, bool) {
+	candidates := []string{os.Getenv("AZURE_STORAGE_SAS_URL")}
+	for _, profile := range config.Destinations {
+		if profile.Cloud == "azure" && profile.URL != "" {
+			candidates = append(candidates, profile.URL)
+		}
+	}
+	for _, raw := range candidates {
+		if sas, err := parseAzureSAS(raw); err == nil && sas.Account == account && sas.Container == container {
+			return sas, true
+		}
+	}
+	return azureSAS{}, false
+}
+
+// Send one request to Blob Storage, retrying server errors and dropped
+// connections; body is resent from the start on each try
+func azureBlobRequest(ctx context.Context, method, target string, body []byte, headers map[string]string) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(body))
+		req.Header.Set("x-ms-version", azureAPIVersion)
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil && resp.StatusCode < 300 {
+			resp.Body.Close()
+			return resp, nil
+		}
+		if err == nil {
+			data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+			err = httpStatusError{code: resp.StatusCode,
+				message: fmt.Sprintf("%s %s: %s: %s", method, strings.SplitN(target, "?", 2)[0], resp.Status, azureErrorMessage(data))}
+		}
+		var status httpStatusError
+		if ctx.Err() != nil || attempt == httpUploadAttempts ||
+			(errors.As(err, &status) && status.code < 500 && status.code != http.StatusTooManyRequests) {
+			return nil, err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// The message of a Blob Storage error response
+func azureErrorMessage(data []byte) string {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(data, &body) == nil && body.Code != "" {
+		message, _, _ := strings.Cut(body.Message, "\n")
+		return body.Code + ": " + message
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// Headers setting a blob's metadata and tags
+func azureBlobHeaders(s uploadSettings) map[string]string {
+	headers := map[string]string{"x-ms-blob-content-type": "application/octet-stream"}
+	for key, value := range s.Metadata {
+		headers["x-ms-meta-"+key] = value
+	}
+	if len(s.Tags) > 0 {
+		tags := url.Values{}
+		for key, value := range s.Tags {
+			tags.Set(key, value)
+		}
+		headers["x-ms-tags"] = tags.Encode()
+	}
+	return headers
+}
+
+// Upload one file with a container SAS, returning the azure:// URI it was written to
+func uploadToAzureSAS(job *Job, s uploadSettings, file string) (string, error) {
+	sas, err := parseAzureSAS(s.URL)
+	if err != nil {
+		return "", err
+	}
+	blobName := filepath.Base(file)
+	if s.Target != "" {
+		blobName = strings.TrimPrefix(s.Target, "/") + "/" + blobName
+	}
+	blobURI := azureBlobURI(sas.Account, sas.Container, blobName)
+	st, err := openUploadStream(job, s, file)
+	if err != nil {
+		return "", err
+	}
+	defer st.Close()
+	kind := "block"
+	if azurePageBlob(s, file) {
+		kind = "page"
+	}
+	job.setStatus("Uploading %s to Azure with a SAS as a %s blob: %s/%s/%s (%.2f MB)",
+		filepath.Base(file), kind, sas.Account, sas.Container, blobName, float64(st.FileSize)/(1024*1024))
+	if mocked("azure") {
+		return mockUpload(job, blobURI, file)
+	}
+
+	pending := pendingUploads.start("azure", blobURI, s.Subscription)
+	if kind == "page" {
+		err = putAzurePageBlob(job, s, sas, blobName, st)
+	} else {
+		err = putAzureBlockBlob(job, s, sas, blobName, st)
+	}
+	if err != nil {
+		abandonUpload(pending)
+		return "", fmt.Errorf("Azure upload failed for %s: %w", file, err)
+	}
+	pendingUploads.finish(pending.ID)
+	st.finish()
+	return blobURI, nil
+}
+
+// Send a stream as blocks and commit them as the blob
+func putAzureBlockBlob(job *Job, s uploadSettings, sas azureSAS, blob string, st *uploadStream) error {
+	blockSize := int64(azureMinBlockSize)
+	if needed := (st.Size + azureMaxBlocks - 1) / azureMaxBlocks; needed > blockSize {
+		// Whole MBs, so the blocks stay aligned
+		blockSize = (needed + 1<<20 - 1) &^ (1<<20 - 1)
+	}
+	buf := make([]byte, blockSize)
+	var list strings.Builder
+	list.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(st, buf)
+		if n > 0 {
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("porter-%08d", i)))
+			target := sas.blobURL(blob, url.Values{"comp": {"block"}, "blockid": {id}})
+			if _, err := azureBlobRequest(job.ctx, http.MethodPut, target, buf[:n], nil); err != nil {
+				return err
+			}
+			fmt.Fprintf(&list, "<Latest>%s</Latest>", id)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	list.WriteString("</BlockList>")
+	_, err := azureBlobRequest(job.ctx, http.MethodPut, sas.blobURL(blob, url.Values{"comp": {"blocklist"}}),
+		[]byte(list.String()), azureBlobHeaders(s))
+	return err
+}
+
+// Create a page blob the size of the stream and write its pages that aren't
+// all zeros; VHDs are whole pages, as page blobs must be
+func putAzurePageBlob(job *Job, s uploadSettings, sas azureSAS, blob string, st *uploadStream) error {
+	if st.Size%azurePageSize != 0 {
+		return fmt.Errorf("page blobs must be a multiple of %d bytes, and %s is %d bytes; convert it to a fixed VHD", azurePageSize, st.Name, st.Size)
+	}
+	headers := azureBlobHeaders(s)
+	headers["x-ms-blob-type"] = "PageBlob"
+	headers["x-ms-blob-content-length"] = fmt.Sprint(st.Size)
+	if _, err := azureBlobRequest(job.ctx, http.MethodPut, sas.blobURL(blob, nil), nil, headers); err != nil {
+		return err
+	}
+	return putAzurePages(job, st, sas.blobURL(blob, url.Values{"comp": {"page"}}))
+}
+
+// Write the pages of a stream that aren't all zeros to an existing page blob,
+// given its Put Page URL; managed disks take their uploads the same way
+func putAzurePages(job *Job, st *uploadStream, target string) error {
+	buf := make([]byte, azurePageWriteSize)
+	var offset, skipped int64
+	for {
+		n, err := io.ReadFull(st, buf)
+		if n > 0 {
+			if isZero(buf[:n]) {
+				skipped += int64(n)
+			} else {
+				headers := map[string]string{
+					"x-ms-page-write": "update",
+					"x-ms-range":      fmt.Sprintf("bytes=%d-%d", offset, offset+int64(n)-1),
+				}
+				if _, err := azureBlobRequest(job.ctx, http.MethodPut, target, buf[:n], headers); err != nil {
+					return err
+				}
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		job.logf("Skipped %.2f MB of empty pages in %s", float64(skipped)/(1024*1024), st.Name)
+	}
+	return nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Delete a blob with a container SAS
+func deleteAzureBlobSAS(sas azureSAS, blob string) error {
+	_, err := azureBlobRequest(context.Background(), http.MethodDelete, sas.blobURL(blob, nil), nil, nil)
+	var status httpStatusError
+	if errors.As(err, &status) && status.code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// Discard the blocks of an upload that never committed, as
+// discardAzureUncommittedBlocks does with az: a blob that doesn't exist is
+// committed empty and deleted, and one that does is left alone
+func discardAzureBlocksSAS(sas azureSAS, blob string) error {
+	_, err := azureBlobRequest(context.Background(), http.MethodHead, sas.blobURL(blob, nil), nil, nil)
+	var status httpStatusError
+	if !errors.As(err, &status) || status.code != http.StatusNotFound {
+		return err
+	}
+	empty := []byte(`<?xml version="1.0" encoding="utf-8"?><BlockList></BlockList>`)
+	if _, err := azureBlobRequest(context.Background(), http.MethodPut, sas.blobURL(blob, url.Values{"comp": {"blocklist"}}), empty, nil); err != nil {
+		return err
+	}
+	return deleteAzureBlobSAS(sas, blob)
+}
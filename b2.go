@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Backblaze B2, in one of two modes. With a region (the one in the bucket's S3
+// endpoint, e.g. us-west-004) Porter uses B2's S3-compatible API through the
+// aws CLI, see s3compat.go; objects are s3:// URIs on that endpoint. Without one
+// it uses the native B2 API through the b2 CLI, and objects are b2://bucket/key.
+// Both take an application key from B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY,
+// or from a b2 destination profile's username and password.
+
+// Regions with S3-compatible endpoints
+var b2Regions = []string{"us-west-000", "us-west-001", "us-west-002", "us-west-004", "us-east-005", "eu-central-003", "ca-east-006"}
+
+var b2RegionPattern = regexp.MustCompile(`^[a-z]+-[a-z]+-[0-9]{3}$`)
+
+const b2Domain = ".backblazeb2.com"
+
+func b2S3Endpoint(region string) string {
+	return "https://s3." + region + b2Domain
+}
+
+// The application key for B2, from the environment or a b2 profile
+func b2Credentials() (string, string, bool) {
+	if id, key := os.Getenv("B2_APPLICATION_KEY_ID"), os.Getenv("B2_APPLICATION_KEY"); id != "" && key != "" {
+		return id, key, true
+	}
+	for _, profile := range config.Destinations {
+		if profile.Cloud == "b2" && profile.Username != "" {
+			return profile.Username, profile.Password, true
+		}
+	}
+	return "", "", false
+}
+
+// Keys for B2's S3-compatible endpoints
+func b2S3Credentials(endpointURL string) (string, string, bool) {
+	if !strings.HasSuffix(endpointURL, b2Domain) {
+		return "", "", false
+	}
+	return b2Credentials()
+}
+
+// A b2 CLI command with the application key in its environment
+func b2Command(ctx context.Context, args ...string) *exec.Cmd {
+	cmd := toolCommand(ctx, "b2", args...)
+	if id, key, ok := b2Credentials(); ok {
+		setToolEnv(cmd, "B2_APPLICATION_KEY_ID="+id, "B2_APPLICATION_KEY="+key)
+	}
+	return cmd
+}
+
+// The settings of an upload in S3-compatible mode
+func b2S3Settings(s uploadSettings) uploadSettings {
+	s.URL, s.PathStyle = b2S3Endpoint(s.Region), false
+	return s
+}
+
+// Upload one file to a B2 bucket, returning its s3:// or b2:// URI
+func uploadToB2(job *Job, s uploadSettings, file string) (string, error) {
+	// B2 has no object tags or S3 additional checksums, so tags are stored as
+	// file info (metadata) in both modes
+	info := map[string]string{}
+	for k, v := range s.Metadata {
+		info[k] = v
+	}
+	for k, v := range s.Tags {
+		info[k] = v
+	}
+	if s.Region != "" {
+		s = b2S3Settings(s)
+		s.Metadata, s.Tags, s.Checksums = info, nil, nil
+		return uploadToAWS(job, s, file)
+	}
+
+	key := filepath.Base(file)
+	if s.Target != "" {
+		key = strings.Trim(s.Target, "/") + "/" + key
+	}
+	uri := "b2://" + s.Bucket + "/" + key
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Uploading %s to Backblaze B2: %s (%.2f MB)",
+		filepath.Base(file), uri, float64(fileInfo.Size())/(1024*1024))
+
+	// Large files go up as B2 large files; the CLI cancels its own unfinished
+	// ones when interrupted
+	args := []string{"file", "upload", "--no-progress"}
+	for _, pair := range keyValuePairs(info) {
+		args = append(args, "--info", pair)
+	}
+	args = append(args, s.Bucket, file, key)
+	if err := runJobCommand(job, b2Command(job.ctx, args...)); err != nil {
+		return "", fmt.Errorf("B2 upload failed for %s: %w", file, err)
+	}
+	return uri, nil
+}
+
+// Delete every version of a file uploaded with the native API
+func deleteB2File(uri string) error {
+	out, err := b2Command(context.Background(), "rm", "--versions", uri).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// List files under a prefix in a bucket with the native API
+func listB2Files(ctx context.Context, bucket, prefix string) ([]DestinationObject, error) {
+	out, err := b2Command(ctx, "ls", "--json", "--recursive", "b2://"+bucket+"/"+prefix).Output()
+	if err != nil {
+		return nil, fmt.Errorf("b2 ls failed: %w", err)
+	}
+	var files []struct {
+		FileName        string `json:"fileName"`
+		Size            int64  `json:"size"`
+		UploadTimestamp int64  `json:"uploadTimestamp"`
+	}
+	if err := json.Unmarshal(out, &files); err != nil {
+		return nil, fmt.Errorf("failed to parse B2 listing: %w", err)
+	}
+	var objects []DestinationObject
+	for _, f := range files {
+		objects = append(objects, DestinationObject{Name: f.FileName, Size: f.Size,
+			LastModified: time.UnixMilli(f.UploadTimestamp).UTC().Format(time.RFC3339)})
+	}
+	return objects, nil
+}
+
+// The buckets the application key can see, through the S3-compatible endpoint
+// of a region or the native API when region is empty
+func listB2Buckets(ctx context.Context, region string) ([]string, error) {
+	if region != "" {
+		s := b2S3Settings(uploadSettings{Region: region})
+		out, err := s.s3Endpoint().command(ctx, "s3api", "list-buckets", "--query", "Buckets[].Name", "--output", "text").CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+		var names []string
+		for _, name := range strings.Fields(string(out)) {
+			if name != "None" {
+				names = append(names, name)
+			}
+		}
+		return names, nil
+	}
+	out, err := b2Command(ctx, "bucket", "list", "--json").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	var buckets []struct {
+		BucketName string `json:"bucketName"`
+	}
+	if err := json.Unmarshal(out, &buckets); err != nil {
+		return nil, fmt.Errorf("unexpected b2 bucket list output: %w", err)
+	}
+	var names []string
+	for _, b := range buckets {
+		names = append(names, b.BucketName)
+	}
+	return names, nil
+}
+
+func checkB2Credentials(ctx context.Context) error {
+	if _, _, ok := b2Credentials(); !ok {
+		return errors.New("B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY are not set and no b2 profile has a key")
+	}
+	return runQuiet(b2Command(ctx, "account", "get"))
+}
+
+func listB2Regions(ctx context.Context) ([]string, error) {
+	return b2Regions, nil
+}
+
+// Handler for GET /b2/buckets?region=: the buckets the application key can see
+func b2BucketsHandler(w http.ResponseWriter, r *http.Request) {
+	region := r.URL.Query().Get("region")
+	if region != "" && !b2RegionPattern.MatchString(region) {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Invalid B2 region: %s"), region), Remediation: "Pass the region of the bucket's S3 endpoint (e.g. us-west-004), or no region to use the native API."})
+		return
+	}
+	if _, _, ok := b2Credentials(); !ok {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message:     "No B2 application key",
+			Remediation: "Set B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY, or add a b2 destination profile with the key ID as username and the key as password."})
+		return
+	}
+	var buckets []string
+	err := providerCall(r.Context(), "b2", func(ctx context.Context) error {
+		var err error
+		buckets, err = listB2Buckets(ctx, region)
+		return err
+	})
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list B2 buckets",
+			Remediation: "Check the application key is valid. Keys restricted to one bucket can't list buckets; pass the bucket name directly."})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"buckets": listOrEmpty(buckets)})
+}
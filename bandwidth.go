@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth classes: a cap on the upload bandwidth of the whole instance,
+// shared between classes of destination by weight, so that urgent migrations
+// to production aren't starved by bulk copies to archive storage. With
+// {"capMBps": 100, "shares": {"prod": 80, "test": 20}} prod uploads together
+// get 80 MB/s and test uploads 20 MB/s while both are sending; a class with
+// nothing to send lends its share to the others. A job's class is its
+// bandwidthClass, else its destination profile's, else the default class;
+// jobs with none aren't held to the cap. The classes are enforced where the
+// per-job limit is, on the uploads Porter streams itself (see stream.go), and
+// a job's own limit still applies within its class's share.
+type BandwidthClassConfig struct {
+	CapMBps float64            `json:"capMBps,omitempty"`
+	Shares  map[string]float64 `json:"shares,omitempty"`
+	Default string             `json:"default,omitempty"`
+}
+
+// Check the bandwidth class settings
+func (c *Config) validateBandwidthClasses(path string) {
+	b := &c.BandwidthClasses
+	for class, share := range b.Shares {
+		if share <= 0 {
+			fmt.Printf("Warning: bandwidthClasses.shares.%s must be positive in config %s (ignoring the class)\n", class, path)
+			delete(b.Shares, class)
+		}
+	}
+	if b.Default != "" && b.Shares[b.Default] == 0 {
+		fmt.Printf("Warning: bandwidthClasses.default '%s' in config %s is not one of the shares (jobs without a class are not capped)\n", b.Default, path)
+		b.Default = ""
+	}
+	if b.CapMBps <= 0 || len(b.Shares) == 0 {
+		b.CapMBps = 0
+		return
+	}
+	var classes []string
+	for _, class := range b.names() {
+		classes = append(classes, fmt.Sprintf("%s %.0f%%", class, b.shareOf(class)*100))
+	}
+	fmt.Printf("Upload bandwidth capped at %g MB/s: %s\n", b.CapMBps, strings.Join(classes, ", "))
+}
+
+// The classes configured, sorted
+func (b BandwidthClassConfig) names() []string {
+	var names []string
+	for class := range b.Shares {
+		names = append(names, class)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// A class's share of the cap when every class is sending
+func (b BandwidthClassConfig) shareOf(class string) float64 {
+	total := 0.0
+	for _, share := range b.Shares {
+		total += share
+	}
+	return b.Shares[class] / total
+}
+
+// A job's class, "" when it isn't capped
+func bandwidthClass(s uploadSettings) string {
+	if config.BandwidthClasses.CapMBps <= 0 {
+		return ""
+	}
+	if s.BandwidthClass != "" {
+		return s.BandwidthClass
+	}
+	return config.BandwidthClasses.Default
+}
+
+// Check a job's class
+func validateBandwidthClass(s uploadSettings) *APIError {
+	if s.BandwidthClass == "" || config.BandwidthClasses.Shares[s.BandwidthClass] > 0 {
+		return nil
+	}
+	remediation := "Bandwidth classes are set under bandwidthClasses in porter.json; none are configured."
+	if names := config.BandwidthClasses.names(); len(names) > 0 {
+		remediation = "Use one of: " + strings.Join(names, ", ")
+	}
+	return &APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Unknown bandwidth class: %s"), s.BandwidthClass), Remediation: remediation}
+}
+
+// Paces the streams of all classes, reserving each read's time on its class's
+// schedule at the class's current rate
+var bandwidthClasses = struct {
+	sync.Mutex
+	// Streams sending in each class, and when each class may next send
+	active map[string]int
+	next   map[string]time.Time
+}{active: map[string]int{}, next: map[string]time.Time{}}
+
+// A class's rate in bytes per second: its share of the cap among the classes
+// sending; callers hold the lock
+func classRate(class string) float64 {
+	b := config.BandwidthClasses
+	total := 0.0
+	for c, n := range bandwidthClasses.active {
+		if n > 0 {
+			total += b.Shares[c]
+		}
+	}
+	if total == 0 {
+		total = b.Shares[class]
+	}
+	return b.CapMBps * 1024 * 1024 * b.Shares[class] / total
+}
+
+// A reader held to its class's share of the cap while it is open
+type classReader struct {
+	r      io.Reader
+	class  string
+	clock  pacingClock
+	closed bool
+}
+
+func newClassReader(r io.Reader, class string, clock pacingClock) *classReader {
+	bandwidthClasses.Lock()
+	bandwidthClasses.active[class]++
+	bandwidthClasses.Unlock()
+	return &classReader{r: r, class: class, clock: clock}
+}
+
+func (c *classReader) Read(p []byte) (int, error) {
+	// Small reads keep the class's streams interleaved
+	if limit := int(config.BandwidthClasses.CapMBps * 1024 * 1024 / 20); limit > 0 && len(p) > limit {
+		p = p[:limit]
+	}
+	n, err := c.r.Read(p)
+	if n > 0 {
+		bandwidthClasses.Lock()
+		now := c.clock.Now()
+		// Time lost oversleeping is made up; a class that has been idle starts afresh
+		start := bandwidthClasses.next[c.class]
+		if start.Before(now.Add(-time.Second / 20)) {
+			start = now
+		}
+		end := start.Add(time.Duration(float64(n) / classRate(c.class) * float64(time.Second)))
+		bandwidthClasses.next[c.class] = end
+		bandwidthClasses.Unlock()
+		c.clock.Sleep(end.Sub(now))
+	}
+	return n, err
+}
+
+// Stop counting the stream as sending
+func (c *classReader) Close() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	bandwidthClasses.Lock()
+	bandwidthClasses.active[c.class]--
+	bandwidthClasses.Unlock()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// Set up bandwidth classes for a test, restoring the configuration and the
+// classes' state after it
+func withBandwidthClasses(t *testing.T, b BandwidthClassConfig) {
+	saved := config.BandwidthClasses
+	config.BandwidthClasses = b
+	t.Cleanup(func() {
+		config.BandwidthClasses = saved
+		bandwidthClasses.Lock()
+		bandwidthClasses.active = map[string]int{}
+		bandwidthClasses.next = map[string]time.Time{}
+		bandwidthClasses.Unlock()
+	})
+}
+
+func TestClassRate(t *testing.T) {
+	withBandwidthClasses(t, BandwidthClassConfig{CapMBps: 100, Shares: map[string]float64{"prod": 80, "test": 20}})
+	const mb = 1024 * 1024
+	tests := []struct {
+		active map[string]int
+		class  string
+		want   float64
+	}{
+		{map[string]int{"prod": 1, "test": 2}, "prod", 80 * mb},
+		{map[string]int{"prod": 1, "test": 2}, "test", 20 * mb},
+		{map[string]int{"prod": 0, "test": 1}, "test", 100 * mb},
+		{map[string]int{"prod": 1}, "prod", 100 * mb},
+		{map[string]int{}, "test", 100 * mb},
+	}
+	for _, tt := range tests {
+		bandwidthClasses.Lock()
+		bandwidthClasses.active = tt.active
+		got := classRate(tt.class)
+		bandwidthClasses.Unlock()
+		if got != tt.want {
+			t.Errorf("classRate(%s) with %v sending = %.0f, want %.0f", tt.class, tt.active, got, tt.want)
+		}
+	}
+}
+
+func TestClassReaderPacing(t *testing.T) {
+	withBandwidthClasses(t, BandwidthClassConfig{CapMBps: 1, Shares: map[string]float64{"prod": 80, "test": 20}})
+	// 200 KiB at the whole 1 MiB/s cap
+	const size = 200 << 10
+	whole := time.Second * size / (1 << 20)
+	tests := []struct {
+		name string
+		// When the class was last due to send, relative to the read
+		next time.Duration
+		// Streams of the other class sending at the same time
+		others int
+		want   time.Duration
+	}{
+		{"idle class", -time.Minute, 0, whole},
+		{"behind schedule", -40 * time.Millisecond, 0, whole - 40*time.Millisecond},
+		{"ahead of schedule", 300 * time.Millisecond, 0, whole + 300*time.Millisecond},
+		{"sharing the cap", -time.Minute, 1, whole * 100 / 80},
+	}
+	for _, tt := range tests {
+		clock := &fakeClock{now: time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)}
+		bandwidthClasses.Lock()
+		bandwidthClasses.active["test"] = tt.others
+		bandwidthClasses.next["prod"] = clock.now.Add(tt.next)
+		bandwidthClasses.Unlock()
+		c := newClassReader(zeroReader{}, "prod", clock)
+		io.ReadFull(c, make([]byte, size))
+		c.Close()
+		if got := clock.take(); got < tt.want-time.Millisecond || got > tt.want+time.Millisecond {
+			t.Errorf("%s: 200 KiB at a 1 MiB/s cap waited %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Boot tests: a quick local check that a job's disk boots, before it is pushed
+// to a cluster or cloud. The disk runs under qemu in a container on the Docker
+// or Podman engine Porter can reach (the runner image, bootTest.image in
+// porter.json, needs qemu-system-x86_64 and OVMF), with its serial console in
+// the job's log and ports forwarded from the engine's host to the guest, e.g.
+// 2222:22 to ssh in. A containerdisk archive is first loaded into the engine,
+// so the image is there to push, and the disk booted is the one in the image.
+// Other jobs boot the first disk they uploaded or copied. The disk is copied
+// into the runner container with the engine's cp, so Porter's paths don't need
+// to be visible to the engine.
+//
+// The test passes when a login prompt appears on the serial console within
+// timeoutMinutes; guests without a serial console (such as Windows) are left
+// running to check through the forwarded ports. Either way the container is
+// removed after keepMinutes, or when the test is stopped.
+type BootTestConfig struct {
+	// docker or podman (default tools.runtime, else whichever is installed)
+	Runtime string `json:"runtime,omitempty"`
+	// Image with qemu-system-x86_64 to run disks in
+	Image          string `json:"image,omitempty"`
+	TimeoutMinutes int    `json:"timeoutMinutes,omitempty"`
+	KeepMinutes    int    `json:"keepMinutes,omitempty"`
+}
+
+// A job's boot test
+type BootTest struct {
+	// starting, booting, booted, running (no login prompt seen), stopped or failed
+	State     string    `json:"state"`
+	Message   string    `json:"message,omitempty"`
+	Runtime   string    `json:"runtime"`
+	Container string    `json:"container"`
+	Disk      string    `json:"disk"`
+	Image     string    `json:"image,omitempty"`
+	Ports     []string  `json:"ports"`
+	StartedAt time.Time `json:"startedAt"`
+	StopsAt   time.Time `json:"stopsAt"`
+}
+
+const (
+	defaultBootTestImage = "docker.io/tianon/qemu"
+	// Debian's OVMF build, for disks that boot through UEFI
+	bootTestOVMF = "/usr/share/ovmf/OVMF.fd"
+)
+
+// A login prompt on the serial console
+var bootTestLoginPrompt = regexp.MustCompile(`(?i)login:\s*$`)
+
+// host:guest port forwards
+var bootTestPortPattern = regexp.MustCompile(`^(\d{1,5}):(\d{1,5})$`)
+
+// Stop functions of the boot tests running, by job ID
+var bootTests = struct {
+	sync.Mutex
+	stop map[string]func()
+}{stop: map[string]func(){}}
+
+// Restore the boot test defaults porter.json blanks
+func (c *Config) validateBootTest() {
+	if c.BootTest.Image == "" {
+		c.BootTest.Image = defaultBootTestImage
+	}
+	if c.BootTest.TimeoutMinutes <= 0 {
+		c.BootTest.TimeoutMinutes = 5
+	}
+	if c.BootTest.KeepMinutes <= 0 {
+		c.BootTest.KeepMinutes = 30
+	}
+}
+
+// The container engine to run boot tests with, "" if there is none
+func bootTestRuntime() string {
+	for _, runtime := range []string{config.BootTest.Runtime, config.Tools.Runtime, "docker", "podman"} {
+		if runtime == "" {
+			continue
+		}
+		if _, err := exec.LookPath(runtime); err == nil {
+			return runtime
+		}
+	}
+	return ""
+}
+
+// The disk a job's boot test runs: a containerdisk's archive and image, or
+// the first file the job uploaded
+func bootTestDisk(job *Job) (disk, image string, ok bool) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	for _, result := range job.Results {
+		if result.Error != "" || result.Destination == "" {
+			continue
+		}
+		if job.settings.Cloud == "containerdisk" {
+			if info, err := os.Stat(result.Destination); err == nil && !info.IsDir() {
+				return result.Destination, result.Image, true
+			}
+		}
+		for _, file := range []string{result.Destination, result.File} {
+			if diskFormatForPath(file) != "" {
+				if _, err := os.Stat(file); err == nil {
+					return file, "", true
+				}
+			}
+		}
+	}
+	return "", "", false
+}
+
+// The qemu command line for a disk at path in the runner container
+func bootTestQemuArgs(hw ovfHardware, windows, uefi bool, path, format string, ports []string) []string {
+	args := []string{"qemu-system-x86_64", "-m", strconv.FormatInt(hw.MemoryMB, 10), "-smp", strconv.Itoa(hw.CPUs),
+		"-display", "none", "-serial", "stdio", "-monitor", "none"}
+	if _, err := os.Stat("/dev/kvm"); err == nil {
+		args = append(args, "-enable-kvm", "-cpu", "host")
+	}
+	if uefi {
+		args = append(args, "-bios", bootTestOVMF)
+	}
+	// Windows guests may not have VirtIO drivers yet
+	bus, nic := "virtio", "virtio-net-pci"
+	if windows {
+		bus, nic = "ide", "e1000"
+	}
+	args = append(args, "-drive", fmt.Sprintf("file=%s,format=%s,if=%s", path, format, bus))
+	netdev := "user,model=" + nic
+	for _, port := range ports {
+		host, guest, _ := strings.Cut(port, ":")
+		netdev += fmt.Sprintf(",hostfwd=tcp::%s-:%s", host, guest)
+	}
+	return append(args, "-nic", netdev)
+}
+
+// Run an engine command, returning its output as the error if it fails
+func runBootTestCommand(ctx context.Context, runtime string, args ...string) error {
+	out, err := exec.CommandContext(ctx, runtime, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w: %s", runtime, args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Update a job's boot test; snapshots share the old one, so it is copied
+func (j *Job) setBootTest(update func(t *BootTest)) {
+	j.mu.Lock()
+	t := *j.BootTest
+	update(&t)
+	j.BootTest = &t
+	j.mu.Unlock()
+	j.progressed()
+}
+
+// Start the runner container for a job's disk and watch it boot. The job was
+// reopened by the handler; it is finished again once the test has a result,
+// while the container keeps running until it is stopped.
+func runBootTest(job *Job, runtime, disk, image string, ports []string) {
+	job.mu.Lock()
+	container := job.BootTest.Container
+	job.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			exec.Command(runtime, "rm", "-f", container).Run()
+			bootTests.Lock()
+			delete(bootTests.stop, job.ID)
+			bootTests.Unlock()
+		})
+	}
+	bootTests.Lock()
+	bootTests.stop[job.ID] = stop
+	bootTests.Unlock()
+
+	finished := false
+	finish := func(state, message string) {
+		job.setBootTest(func(t *BootTest) { t.State, t.Message = state, message })
+		if finished {
+			return
+		}
+		finished = true
+		job.setStatus("Boot test: %s", message)
+		job.mu.Lock()
+		done := job.done
+		job.mu.Unlock()
+		job.setState(jobCompleted)
+		close(done)
+	}
+	fail := func(err error) {
+		stop()
+		finish("failed", err.Error())
+	}
+
+	// The disk's hardware and firmware, from the file the job converted
+	source := disk
+	job.mu.Lock()
+	for _, result := range job.Results {
+		if result.Destination == disk {
+			source = result.File
+		}
+	}
+	job.mu.Unlock()
+	hw := hardwareForDisk(source)
+	firmware, productName := readinessForDisk(job, source)
+	uefi := hw.Firmware == "efi"
+	if firmware != "" {
+		uefi = firmware == "uefi"
+	}
+
+	path, format := "/tmp/"+filepath.Base(disk), diskFormatForPath(disk)
+	if image != "" {
+		job.setStatus("Boot test: loading %s into %s", image, runtime)
+		if err := runBootTestCommand(ctx, runtime, "load", "-i", disk); err != nil {
+			fail(err)
+			return
+		}
+		job.logf("Loaded %s into %s", image, runtime)
+		name := job.Spec.Name
+		if name == "" {
+			name = hw.Name
+		}
+		path, format = "/tmp/disk/"+strings.ReplaceAll(name, "/", "-")+".qcow2", "qcow2"
+	}
+
+	args := []string{"create", "--rm", "--name", container}
+	for _, port := range ports {
+		host, _, _ := strings.Cut(port, ":")
+		args = append(args, "-p", host+":"+host)
+	}
+	if _, err := os.Stat("/dev/kvm"); err == nil {
+		args = append(args, "--device", "/dev/kvm")
+	} else {
+		job.warnf("Boot test: no /dev/kvm, so %s boots under emulation and slowly; pass --device /dev/kvm to Porter's container to use KVM", filepath.Base(disk))
+	}
+	args = append(args, config.BootTest.Image)
+	args = append(args, bootTestQemuArgs(hw, isWindowsGuest(hw, productName), uefi, path, format, ports)...)
+	job.setStatus("Boot test: creating container %s from %s", container, config.BootTest.Image)
+	if err := runBootTestCommand(ctx, runtime, args...); err != nil {
+		fail(err)
+		return
+	}
+
+	job.setStatus("Boot test: copying %s into %s", filepath.Base(disk), container)
+	if image != "" {
+		// Copy the disk out of the containerdisk image, through a container
+		// created from it that never runs
+		holder := container + "-disk"
+		if err := runBootTestCommand(ctx, runtime, "create", "--name", holder, image, "/disk"); err != nil {
+			fail(err)
+			return
+		}
+		defer exec.Command(runtime, "rm", "-f", holder).Run()
+		out := exec.CommandContext(ctx, runtime, "cp", holder+":/disk", "-")
+		in := exec.CommandContext(ctx, runtime, "cp", "-", container+":/tmp")
+		pipe, err := out.StdoutPipe()
+		if err == nil {
+			in.Stdin = pipe
+			err = out.Start()
+		}
+		if err == nil {
+			err = in.Run()
+			if waitErr := out.Wait(); err == nil {
+				err = waitErr
+			}
+		}
+		if err != nil {
+			fail(fmt.Errorf("copying the disk out of %s failed: %w", image, err))
+			return
+		}
+	} else if err := runBootTestCommand(ctx, runtime, "cp", disk, container+":"+path); err != nil {
+		fail(err)
+		return
+	}
+
+	cmd := exec.CommandContext(ctx, runtime, "start", "-a", container)
+	console, err := cmd.StdoutPipe()
+	if err == nil {
+		cmd.Stderr = cmd.Stdout
+		err = cmd.Start()
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	keep := time.Duration(config.BootTest.KeepMinutes) * time.Minute
+	stopsAt := time.Now().Add(keep)
+	job.setBootTest(func(t *BootTest) { t.State, t.StartedAt, t.StopsAt = "booting", time.Now().UTC(), stopsAt.UTC() })
+	job.setStatus("Boot test: booting %s (forwarding %s)", filepath.Base(disk), strings.Join(ports, ", "))
+	time.AfterFunc(keep, stop)
+
+	prompt := make(chan struct{}, 1)
+	go func() {
+		scanner := bufio.NewScanner(console)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			job.logf("console: %s", line)
+			if bootTestLoginPrompt.MatchString(line) {
+				select {
+				case prompt <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	timeout := time.Duration(config.BootTest.TimeoutMinutes) * time.Minute
+	select {
+	case <-prompt:
+		finish("booted", fmt.Sprintf("%s booted to a login prompt; %s stays up until %s for checks through %s",
+			filepath.Base(disk), container, stopsAt.Format("15:04"), strings.Join(ports, ", ")))
+	case <-time.After(timeout):
+		finish("running", fmt.Sprintf("no login prompt on %s's serial console within %s; it stays up until %s for checks through %s",
+			filepath.Base(disk), timeout, stopsAt.Format("15:04"), strings.Join(ports, ", ")))
+	case err := <-exited:
+		stop()
+		if ctx.Err() != nil {
+			finish("stopped", "stopped before the guest booted")
+		} else {
+			finish("failed", fmt.Sprintf("qemu exited before the guest booted (%v); see the console lines in the log", err))
+		}
+		return
+	}
+	if err := <-exited; ctx.Err() == nil {
+		job.setBootTest(func(t *BootTest) { t.State, t.Message = "stopped", fmt.Sprintf("the guest shut down (%v)", err) })
+	} else {
+		job.setBootTest(func(t *BootTest) { t.State = "stopped" })
+	}
+	stop()
+}
+
+// Handler for POST /api/jobs/{id}/boot-test: boot a finished job's disk in a
+// local container. Takes {"ports": ["2222:22"]}, by default 2222:22, or
+// 3389:3389 for Windows.
+func jobBootTestHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	var body struct {
+		Ports []string `json:"ports"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Invalid JSON body", Details: err.Error()})
+			return
+		}
+	}
+	for _, port := range body.Ports {
+		if !bootTestPortPattern.MatchString(port) {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Invalid port forward: %s"), port), Remediation: "Give each as host:guest, e.g. 2222:22."})
+			return
+		}
+	}
+	if job.state() != jobCompleted {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Only completed jobs have disks to boot: %s"), job.ID)})
+		return
+	}
+	bootTests.Lock()
+	_, running := bootTests.stop[job.ID]
+	bootTests.Unlock()
+	if running {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Job %s already has a boot test running"), job.ID),
+			Remediation: fmt.Sprintf(tr("Stop it with DELETE /api/jobs/%s/boot-test first."), job.ID)})
+		return
+	}
+	disk, image, ok := bootTestDisk(job)
+	if !ok {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Job %s has no local disk or containerdisk to boot"), job.ID),
+			Remediation: "Boot tests run the disks of containerdisk and local jobs, or the files a job uploaded while they are still in the workspace."})
+		return
+	}
+	runtime := bootTestRuntime()
+	if runtime == "" {
+		writeAPIError(w, http.StatusServiceUnavailable, APIError{Code: errCodeProviderUnavailable, Message: "No Docker or Podman to run the boot test with",
+			Remediation: "Install the docker or podman CLI in Porter's container and mount the engine's socket, or set bootTest.runtime in porter.json."})
+		return
+	}
+	ports := body.Ports
+	if len(ports) == 0 {
+		ports = []string{"2222:22"}
+		if _, productName := readinessForDisk(job, disk); isWindowsGuest(hardwareForDisk(disk), productName) {
+			ports = []string{"3389:3389"}
+		}
+	}
+
+	job.mu.Lock()
+	job.BootTest = &BootTest{State: "starting", Runtime: runtime, Container: "porter-boot-" + job.ID, Disk: disk, Image: image, Ports: ports}
+	job.done = make(chan struct{})
+	job.mu.Unlock()
+	job.setState(jobRunning)
+	job.logf("Boot test of %s with %s, forwarding %s", disk, runtime, strings.Join(ports, ", "))
+	go runBootTest(job, runtime, disk, image, ports)
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+// Handler for DELETE /api/jobs/{id}/boot-test: stop a job's boot test and
+// remove its container
+func jobBootTestStopHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	bootTests.Lock()
+	stop, running := bootTests.stop[job.ID]
+	bootTests.Unlock()
+	if !running {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Job %s has no boot test running"), job.ID)})
+		return
+	}
+	stop()
+	job.logf("Boot test stopped")
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
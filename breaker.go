@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cloud listings (accounts, buckets, regions, objects, credential checks) go
+// through providerCall, which gives each call a timeout and keeps a circuit
+// breaker per provider. After providerBreakerThreshold failures in a row the
+// provider is marked temporarily unavailable for providerBreakerCooldown, and
+// its listings fail straight away rather than waiting on the CLI again. The
+// first call after the cooldown is let through: success closes the breaker,
+// failure opens it for another cooldown. Uploads themselves are not affected.
+
+const (
+	providerCallTimeout      = 30 * time.Second
+	providerBreakerThreshold = 3
+	providerBreakerCooldown  = 2 * time.Minute
+)
+
+type providerBreaker struct {
+	failures  int
+	openUntil time.Time
+	lastError string
+}
+
+var providerBreakers = struct {
+	sync.Mutex
+	byName map[string]*providerBreaker
+}{byName: map[string]*providerBreaker{}}
+
+// Returned instead of calling a provider whose breaker is open
+type providerUnavailableError struct {
+	Provider string
+	Until    time.Time
+	Cause    string
+}
+
+func (e *providerUnavailableError) Error() string {
+	return fmt.Sprintf("%s is temporarily unavailable after %d failed calls (last: %s); retrying after %s",
+		e.Provider, providerBreakerThreshold, e.Cause, e.Until.Format(time.RFC3339))
+}
+
+// Run one listing call against a provider, with a timeout and through its breaker
+func providerCall(ctx context.Context, name string, call func(ctx context.Context) error) error {
+	if err := providerAvailable(name); err != nil {
+		return err
+	}
+	callCtx, cancel := context.WithTimeout(ctx, providerCallTimeout)
+	defer cancel()
+	err := call(callCtx)
+	if err != nil && callCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		err = fmt.Errorf("%s did not respond within %s: %w", name, providerCallTimeout, err)
+	}
+	// The client going away says nothing about the provider
+	if ctx.Err() != nil {
+		return err
+	}
+	recordProviderCall(name, err)
+	return err
+}
+
+// Run a listing command through providerCall and return its output. A failure
+// carries what the command printed.
+func providerOutput(ctx context.Context, name, bin string, args ...string) ([]byte, error) {
+	var out []byte
+	err := providerCall(ctx, name, func(ctx context.Context) error {
+		var err error
+		out, err = toolCommand(ctx, bin, args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
+	return out, err
+}
+
+// An error if the provider's breaker is open
+func providerAvailable(name string) error {
+	providerBreakers.Lock()
+	defer providerBreakers.Unlock()
+	b := providerBreakers.byName[name]
+	if b == nil || !time.Now().Before(b.openUntil) {
+		return nil
+	}
+	return &providerUnavailableError{Provider: name, Until: b.openUntil, Cause: b.lastError}
+}
+
+func recordProviderCall(name string, err error) {
+	providerBreakers.Lock()
+	defer providerBreakers.Unlock()
+	b := providerBreakers.byName[name]
+	if err == nil {
+		if b != nil && b.failures >= providerBreakerThreshold {
+			fmt.Printf("✅ %s is responding again\n", name)
+		}
+		delete(providerBreakers.byName, name)
+		return
+	}
+	if b == nil {
+		b = &providerBreaker{}
+		providerBreakers.byName[name] = b
+	}
+	b.failures++
+	b.lastError = err.Error()
+	if b.failures >= providerBreakerThreshold {
+		b.openUntil = time.Now().Add(providerBreakerCooldown)
+		fmt.Printf("⚠️ %s failed %d calls in a row, marking it unavailable until %s: %s\n",
+			name, b.failures, b.openUntil.Format(time.RFC3339), err)
+	}
+}
+
+// When a provider's breaker closes again, nil if it is closed
+func providerUnavailableUntil(name string) *time.Time {
+	var unavailable *providerUnavailableError
+	if errors.As(providerAvailable(name), &unavailable) {
+		return &unavailable.Until
+	}
+	return nil
+}
+
+// Report a failed provider call: 503 with Retry-After while the provider's
+// breaker is open, otherwise 502 with apiErr and the error as its details
+func writeProviderError(w http.ResponseWriter, err error, apiErr APIError) {
+	var unavailable *providerUnavailableError
+	if errors.As(err, &unavailable) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(unavailable.Until).Seconds())+1))
+		writeAPIError(w, http.StatusServiceUnavailable, APIError{Code: errCodeProviderUnavailable,
+			Message: apiErr.Message, Details: err.Error(),
+			Remediation: fmt.Sprintf(tr("Porter stopped calling %s after repeated failures. %s"), unavailable.Provider, tr(apiErr.Remediation))})
+		return
+	}
+	apiErr.Code, apiErr.Details = errCodeProviderFailed, err.Error()
+	writeAPIError(w, http.StatusBadGateway, apiErr)
+}
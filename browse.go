@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// An object already present at an upload destination
+type DestinationObject struct {
+	Name         string `json:"name"`
+	Size         int64  `json:"size"`
+	LastModified string `json:"lastModified"`
+}
+
+// Handler to list objects already present at a destination (bucket/container prefix or local directory)
+func destinationObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	cloud := q.Get("cloud")
+	prefix := strings.TrimPrefix(q.Get("prefix"), "/")
+	bucket := q.Get("bucket")
+	subscription := q.Get("account")
+	containerFull := q.Get("container")
+	region := q.Get("region")
+	shareURL := q.Get("url")
+	pathStyle := q.Get("pathStyle") == "true"
+	host := q.Get("host")
+	// Remote folders for rsync keep their leading slash
+	remoteDir := q.Get("prefix")
+
+	// Fill blanks from a destination profile, mirroring the upload form
+	if profileName := q.Get("profile"); profileName != "" {
+		profile, ok := findDestinationProfile(profileName)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound,
+				Message:     fmt.Sprintf(tr("Unknown destination profile: %s"), profileName),
+				Remediation: "Use a profile defined under 'destinations' in porter.json."})
+			return
+		}
+		if profile.Cloud != "" {
+			cloud = profile.Cloud
+		}
+		if prefix == "" {
+			prefix = strings.TrimPrefix(profile.Target, "/")
+		}
+		if bucket == "" {
+			bucket = profile.Bucket
+		}
+		if subscription == "" {
+			subscription = profile.Account
+		}
+		if containerFull == "" {
+			containerFull = profile.Container
+		}
+		if region == "" {
+			region = profile.Region
+		}
+		if shareURL == "" {
+			shareURL = profile.URL
+		}
+		if !pathStyle {
+			pathStyle = profile.PathStyle
+		}
+		if host == "" {
+			host = profile.Host
+		}
+		if remoteDir == "" {
+			remoteDir = profile.Target
+		}
+	}
+
+	// The listing to run, through the circuit breaker of the service it calls
+	var list func(ctx context.Context) ([]DestinationObject, error)
+	breaker := cloud
+	switch cloud {
+	case "aws":
+		if bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing S3 bucket", Remediation: "Pass the bucket query parameter."})
+			return
+		}
+		endpoint := uploadSettings{URL: shareURL, Region: region, PathStyle: pathStyle}.s3Endpoint()
+		breaker = endpoint.breakerName()
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listS3Objects(ctx, endpoint, bucket, prefix)
+		}
+		if mocked("aws") {
+			list = func(context.Context) ([]DestinationObject, error) {
+				return listMockObjects(filepath.Join(config.Mock.Dir, "s3", bucket), prefix)
+			}
+			breaker = ""
+		}
+	case "spaces":
+		if bucket == "" || region == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing Space or region", Remediation: "Pass the bucket (Space name) and region query parameters."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listS3Objects(ctx, spacesS3Settings(uploadSettings{Region: region}).s3Endpoint(), bucket, prefix)
+		}
+	case "b2":
+		if bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing B2 bucket", Remediation: "Pass the bucket query parameter, and region for the S3-compatible API."})
+			return
+		}
+		if region != "" {
+			list = func(ctx context.Context) ([]DestinationObject, error) {
+				return listS3Objects(ctx, b2S3Settings(uploadSettings{Region: region}).s3Endpoint(), bucket, prefix)
+			}
+		} else {
+			list = func(ctx context.Context) ([]DestinationObject, error) { return listB2Files(ctx, bucket, prefix) }
+		}
+	case "gcp":
+		if bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing GCS bucket", Remediation: "Pass the bucket query parameter."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) { return listGCSObjects(ctx, bucket, prefix) }
+	case "ibm":
+		if bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing COS bucket", Remediation: "Pass the bucket (and region) query parameters."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listCOSObjects(ctx, region, bucket, prefix)
+		}
+	case "alibaba":
+		if bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing OSS bucket", Remediation: "Pass the bucket (and region) query parameters."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listOSSObjects(ctx, region, bucket, prefix)
+		}
+	case "oracle":
+		if bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing OCI bucket", Remediation: "Pass the bucket (and region) query parameters."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listOCIObjects(ctx, region, bucket, prefix)
+		}
+	case "swift":
+		if bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing Swift container", Remediation: "Pass the container name as the bucket query parameter (and region)."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listSwiftObjects(ctx, region, bucket, prefix)
+		}
+	case "webdav":
+		if shareURL == "" {
+			shareURL = os.Getenv("WEBDAV_URL")
+		}
+		if shareURL == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing WebDAV share URL", Remediation: "Pass the url query parameter or set WEBDAV_URL."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listWebDAVObjects(ctx, shareURL, prefix)
+		}
+	case "ftp":
+		if shareURL == "" {
+			shareURL = os.Getenv("FTP_URL")
+		}
+		if shareURL == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing FTP server URL", Remediation: "Pass the url query parameter or set FTP_URL."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listFTPObjects(ctx, shareURL, prefix)
+		}
+	case "smb":
+		if shareURL == "" {
+			shareURL = os.Getenv("SMB_URL")
+		}
+		if shareURL == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing SMB share", Remediation: "Pass the url query parameter (smb://host/share) or set SMB_URL."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listSMBObjects(ctx, shareURL, prefix)
+		}
+	case "nfs":
+		if shareURL == "" {
+			shareURL = os.Getenv("NFS_URL")
+		}
+		if shareURL == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing NFS export", Remediation: "Pass the url query parameter (nfs://server/export) or set NFS_URL."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listNFSObjects(ctx, shareURL, prefix)
+		}
+	case "http":
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "HTTP endpoints can't be listed", Remediation: "List the files through the service's own API."})
+		return
+	case "porter":
+		if shareURL == "" {
+			shareURL = os.Getenv("PORTER_PEER_URL")
+		}
+		if shareURL == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing receiving Porter URL", Remediation: "Pass the url query parameter or set PORTER_PEER_URL."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listPeerObjects(ctx, shareURL, prefix)
+		}
+	case "artifactory", "nexus":
+		if shareURL == "" {
+			shareURL = os.Getenv(artifactServerEnv(cloud))
+		}
+		if shareURL == "" || bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message:     "Missing server URL or repository",
+				Remediation: fmt.Sprintf(tr("Pass the url and bucket (repository) query parameters, or set %s."), artifactServerEnv(cloud))})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listArtifactRepoObjects(ctx, cloud, shareURL, bucket, prefix)
+		}
+	case "rsync":
+		if host == "" || remoteDir == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing SSH host or folder", Remediation: "Pass the host and prefix (remote folder) query parameters."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) { return listRsyncObjects(ctx, host, remoteDir) }
+	case "vsphere", "datastore":
+		if shareURL == "" {
+			shareURL = os.Getenv("GOVC_URL")
+		}
+		if bucket == "" {
+			bucket = os.Getenv("GOVC_DATASTORE")
+		}
+		if shareURL == "" || bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing vCenter URL or datastore", Remediation: "Pass the url and bucket (datastore) query parameters, or set GOVC_URL and GOVC_DATASTORE."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listDatastoreObjects(ctx, shareURL, bucket, prefix)
+		}
+	case "proxmox":
+		if shareURL == "" {
+			shareURL = os.Getenv("PROXMOX_URL")
+		}
+		if host == "" {
+			host = os.Getenv("PROXMOX_NODE")
+		}
+		if bucket == "" {
+			bucket = os.Getenv("PROXMOX_STORAGE")
+		}
+		if shareURL == "" || host == "" || bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing Proxmox API URL, node or storage", Remediation: "Pass the url, host (node) and bucket (storage) query parameters, or set PROXMOX_URL, PROXMOX_NODE and PROXMOX_STORAGE."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listProxmoxDisks(ctx, shareURL, host, bucket, prefix)
+		}
+	case "xcpng":
+		if shareURL == "" {
+			shareURL = os.Getenv("XCPNG_URL")
+		}
+		if bucket == "" {
+			bucket = os.Getenv("XCPNG_SR")
+		}
+		if shareURL == "" || bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing XCP-ng pool URL or storage repository", Remediation: "Pass the url and bucket (SR) query parameters, or set XCPNG_URL and XCPNG_SR."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listXAPIDisks(ctx, shareURL, bucket, prefix)
+		}
+	case "ovirt":
+		if shareURL == "" {
+			shareURL = os.Getenv("OVIRT_URL")
+		}
+		if bucket == "" {
+			bucket = os.Getenv("OVIRT_STORAGE_DOMAIN")
+		}
+		if shareURL == "" || bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing oVirt engine URL or storage domain", Remediation: "Pass the url and bucket (storage domain) query parameters, or set OVIRT_URL and OVIRT_STORAGE_DOMAIN."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listOVirtDisks(ctx, shareURL, bucket, prefix)
+		}
+	case "nutanix":
+		if shareURL == "" {
+			shareURL = os.Getenv("NUTANIX_URL")
+		}
+		if shareURL == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing Nutanix Prism URL", Remediation: "Pass the url query parameter, or set NUTANIX_URL."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listNutanixImages(ctx, shareURL, prefix)
+		}
+	case "library":
+		if shareURL == "" {
+			shareURL = os.Getenv("GOVC_URL")
+		}
+		if shareURL == "" || bucket == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Missing vCenter URL or content library", Remediation: "Pass the url and bucket (library) query parameters."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listContentLibraryItems(ctx, shareURL, bucket, prefix)
+		}
+	case "azure":
+		parts := strings.Split(containerFull, "/")
+		if len(parts) != 2 {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Invalid Azure container format '%s'"), containerFull),
+				Remediation: "Pass the container as 'storageAccount/container'."})
+			return
+		}
+		list = func(ctx context.Context) ([]DestinationObject, error) {
+			return listAzureBlobs(ctx, subscription, parts[0], parts[1], prefix)
+		}
+		if mocked("azure") {
+			list = func(context.Context) ([]DestinationObject, error) {
+				return listMockObjects(filepath.Join(config.Mock.Dir, "azure", parts[0], parts[1]), prefix)
+			}
+			breaker = ""
+		}
+	case "local", "xva", "utm", "vagrant", "containerdisk", "incus", "bundle":
+		dir := q.Get("prefix")
+		if dir == "" {
+			dir = "/data"
+		}
+		list = func(context.Context) ([]DestinationObject, error) { return listLocalObjects(dir) }
+		breaker = ""
+	default:
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Unknown cloud target: %s"), cloud), Remediation: fmt.Sprintf(tr("Use one of %s."), strings.Join(providerNames(), ", "))})
+		return
+	}
+
+	var objects []DestinationObject
+	run := func(ctx context.Context) error {
+		var err error
+		objects, err = list(ctx)
+		return err
+	}
+	var err error
+	if breaker == "" {
+		err = run(r.Context())
+	} else {
+		err = providerCall(r.Context(), breaker, run)
+	}
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list destination objects",
+			Remediation: "Check the destination exists and your credentials can list it."})
+		return
+	}
+
+	fmt.Printf("Found %d object(s) at %s destination\n", len(objects), cloud)
+	writeJSON(w, http.StatusOK, map[string][]DestinationObject{"objects": listOrEmptyObjects(objects)})
+}
+
+// List objects under a prefix in an S3 bucket
+func listS3Objects(ctx context.Context, endpoint *s3Endpoint, bucket, prefix string) ([]DestinationObject, error) {
+	args := []string{"s3api", "list-objects-v2", "--bucket", bucket,
+		"--query", "Contents[].{name:Key,size:Size,lastModified:LastModified}",
+		"--output", "json"}
+	if prefix != "" {
+		args = append(args, "--prefix", prefix)
+	}
+	out, err := endpoint.command(ctx, args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("aws s3api list-objects-v2 failed: %w", err)
+	}
+	var objects []DestinationObject
+	// An empty bucket yields "null", which decodes to a nil slice
+	if err := json.Unmarshal(out, &objects); err != nil {
+		return nil, fmt.Errorf("failed to parse S3 listing: %w", err)
+	}
+	return objects, nil
+}
+
+// List blobs under a prefix in an Azure storage container
+func listAzureBlobs(ctx context.Context, subscription, storageAccount, container, prefix string) ([]DestinationObject, error) {
+	args := []string{"storage", "blob", "list",
+		"--account-name", storageAccount,
+		"--container-name", container,
+		"--auth-mode", "login",
+		"--num-results", "*",
+		"--query", "[].{name:name,size:properties.contentLength,lastModified:properties.lastModified}",
+		"-o", "json"}
+	if subscription != "" {
+		args = append(args, "--subscription", subscription)
+	}
+	if prefix != "" {
+		args = append(args, "--prefix", prefix)
+	}
+	out, err := toolCommand(ctx, "az", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("az storage blob list failed: %w", err)
+	}
+	var objects []DestinationObject
+	if err := json.Unmarshal(out, &objects); err != nil {
+		return nil, fmt.Errorf("failed to parse Azure blob listing: %w", err)
+	}
+	return objects, nil
+}
+
+// List files in a local destination directory
+func listLocalObjects(dir string) ([]DestinationObject, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var objects []DestinationObject
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || info.IsDir() {
+			continue
+		}
+		objects = append(objects, DestinationObject{
+			Name:         filepath.Join(dir, entry.Name()),
+			Size:         info.Size(),
+			LastModified: info.ModTime().UTC().Format(time.RFC3339),
+		})
+	}
+	return objects, nil
+}
+
+func listOrEmptyObjects(list []DestinationObject) []DestinationObject {
+	if list == nil {
+		return []DestinationObject{}
+	}
+	return list
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Bulk submission: one pipeline job per row of a CSV or JSON inventory, so a whole
+// migration wave can be queued in one call. CSV needs a header row naming JobSpec
+// fields (name, source, cloud, profile, bucket, account, container, target, format,
+// priority, expireDays); a "destination" column is read as the bucket (aws),
+// "storageAccount/container" (azure) or directory (local). A JSON inventory is an
+// array of job specs.
+
+// Parse an inventory CSV into job specs
+func parseInventoryCSV(r io.Reader) ([]JobSpec, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("expected a header row and at least one VM")
+	}
+
+	header := rows[0]
+	var specs []JobSpec
+	for i, row := range rows[1:] {
+		var spec JobSpec
+		var destination string
+		for col, value := range row {
+			value = strings.TrimSpace(value)
+			if col >= len(header) || value == "" {
+				continue
+			}
+			switch strings.ToLower(strings.TrimSpace(header[col])) {
+			case "name", "vm", "vm name":
+				spec.Name = value
+			case "source", "path", "url":
+				spec.Source = value
+			case "cloud":
+				spec.Cloud = value
+			case "profile":
+				spec.Profile = value
+			case "bucket":
+				spec.Bucket = value
+			case "account", "subscription":
+				spec.Account = value
+			case "container":
+				spec.Container = value
+			case "target", "prefix":
+				spec.Target = value
+			case "storageclass", "storage_class":
+				spec.StorageClass = value
+			case "region":
+				spec.Region = value
+			case "resourcegroup", "resource_group":
+				spec.ResourceGroup = value
+			case "osname", "os_name", "os":
+				spec.OSName = value
+			case "datastore":
+				spec.Datastore = value
+			case "host", "node":
+				spec.Host = value
+			case "resourcepool", "resource_pool", "pool":
+				spec.ResourcePool = value
+			case "network":
+				spec.Network = value
+			case "boxprovider", "box_provider":
+				spec.BoxProvider = value
+			case "archiveformat", "archive_format":
+				spec.ArchiveFormat = value
+			case "imageref", "image_ref":
+				spec.ImageRef = value
+			case "version":
+				spec.Version = value
+			case "gallery":
+				spec.Gallery = value
+			case "targetregions", "target_regions":
+				spec.TargetRegions = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == ';' })
+			case "shareaccounts", "share_accounts":
+				spec.ShareAccounts = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == ';' })
+			case "format":
+				spec.Format = value
+			case "subformat":
+				spec.Subformat = value
+			case "extractmaxmb", "extract_max_mb":
+				if spec.ExtractMaxMB, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid extractMaxMB '%s'", i+2, value)
+				}
+			case "extractskip", "extract_skip":
+				spec.ExtractSkip = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == ';' })
+			case "virtualsystem", "virtual_system":
+				spec.VirtualSystem = value
+			case "checksums":
+				spec.Checksums = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == ';' })
+			case "compress":
+				spec.Compress = value
+			case "encrypt":
+				if spec.Encrypt, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid encrypt '%s'", i+2, value)
+				}
+			case "bandwidthmbps", "bandwidth_mbps":
+				if spec.BandwidthMBps, err = strconv.ParseFloat(value, 64); err != nil {
+					return nil, fmt.Errorf("row %d: invalid bandwidthMBps '%s'", i+2, value)
+				}
+			case "bandwidthclass", "bandwidth_class":
+				spec.BandwidthClass = value
+			case "createimage", "create_image":
+				if spec.CreateImage, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid createImage '%s'", i+2, value)
+				}
+			case "awsimport", "aws_import":
+				spec.AWSImport = value
+			case "template":
+				if spec.Template, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid template '%s'", i+2, value)
+				}
+			case "generation":
+				if spec.Generation, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid generation '%s'", i+2, value)
+				}
+			case "secureboot", "secure_boot":
+				on, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: invalid secureBoot '%s'", i+2, value)
+				}
+				spec.SecureBoot = &on
+			case "tpm":
+				on, err := strconv.ParseBool(value)
+				if err != nil {
+					return nil, fmt.Errorf("row %d: invalid tpm '%s'", i+2, value)
+				}
+				spec.TPM = &on
+			case "pathstyle", "path_style":
+				if spec.PathStyle, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid pathStyle '%s'", i+2, value)
+				}
+			case "destination":
+				destination = value
+			case "priority":
+				if spec.Priority, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid priority '%s'", i+2, value)
+				}
+			case "expiredays", "expire_days":
+				if spec.ExpireDays, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("row %d: invalid expireDays '%s'", i+2, value)
+				}
+			default:
+				return nil, fmt.Errorf("unknown column '%s'", header[col])
+			}
+		}
+		if destination != "" {
+			switch spec.Cloud {
+			case "aws", "spaces", "b2", "gcp", "ibm", "alibaba", "oracle", "swift", "artifactory", "nexus", "library", "proxmox", "xcpng":
+				spec.Bucket = destination
+			case "azure":
+				spec.Container = destination
+			case "azuredisk":
+				spec.ResourceGroup = destination
+			case "webdav", "ftp", "smb", "nfs", "http", "porter", "nutanix":
+				spec.URL = destination
+			case "rsync":
+				spec.Host = destination
+			case "vsphere", "datastore", "ovirt":
+				spec.Datastore = destination
+			default:
+				spec.Target = destination
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// Handler for POST /api/jobs/bulk: validate every row, then queue one job per row.
+// Nothing is queued if any row is invalid.
+func jobsBulkHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Failed to read request body", Details: err.Error()})
+		return
+	}
+	claim, status, apiErr := claimIdempotencyKey(r, body)
+	if apiErr != nil {
+		writeAPIError(w, status, *apiErr)
+		return
+	}
+	defer claim.release()
+	if previous, ok := claim.replayed(w); ok {
+		var queued []*Job
+		for _, job := range previous {
+			queued = append(queued, job.snapshot())
+		}
+		writeJSON(w, http.StatusAccepted, map[string][]*Job{"jobs": listOrEmptyJobs(queued)})
+		return
+	}
+
+	var specs []JobSpec
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "text/csv" {
+		if specs, err = parseInventoryCSV(bytes.NewReader(body)); err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Invalid inventory CSV", Details: err.Error(),
+				Remediation: "Start with a header row such as 'name,source,cloud,destination'."})
+			return
+		}
+	} else if err := json.Unmarshal(body, &specs); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "Invalid inventory", Details: err.Error(),
+			Remediation: "Send a JSON array of job specs, or CSV with Content-Type: text/csv."})
+		return
+	}
+	if len(specs) == 0 {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "The inventory is empty"})
+		return
+	}
+
+	var settings []uploadSettings
+	var problems []string
+	for i, spec := range specs {
+		apiErr := validatePipelineSpec(spec)
+		var s uploadSettings
+		if apiErr == nil {
+			s, apiErr = resolveUploadSettings(spec)
+		}
+		if apiErr != nil {
+			label := spec.Name
+			if label == "" {
+				label = spec.Source
+			}
+			problems = append(problems, fmt.Sprintf("row %d (%s): %s", i+1, label, apiErr.Message))
+			continue
+		}
+		settings = append(settings, s)
+	}
+	if len(problems) > 0 {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message:     fmt.Sprintf(tr("%d of %d inventory rows are invalid; no jobs were queued"), len(problems), len(specs)),
+			Details:     strings.Join(problems, "\n"),
+			Remediation: "Fix the listed rows and submit the inventory again."})
+		return
+	}
+
+	var queued []*Job
+	for i, spec := range specs {
+		job := jobs.submit(spec, settings[i])
+		claim.record(job)
+		queued = append(queued, job.snapshot())
+	}
+	fmt.Printf("Queued %d job(s) from bulk inventory\n", len(queued))
+	writeJSON(w, http.StatusAccepted, map[string][]*Job{"jobs": queued})
+}
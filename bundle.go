@@ -0,0 +1,328 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Air-gapped bundles: a "bundle" job writes every file it is given into one tar
+// (<name>.porter-bundle.tar) along with the OVF each disk came from, a
+// SHA256SUMS file and manifest.json, for carrying to a Porter instance with no
+// network path to this one. A "bundle-import" job on that instance verifies
+// every artifact against the manifest and registers the disks as converted
+// files (and the OVFs as extracted ones), ready to upload from there.
+//
+// Disks are streamed into the tar as they are hashed, so the manifest is the
+// last entry.
+
+const bundleSuffix = ".porter-bundle.tar"
+
+type bundleManifest struct {
+	Version   int              `json:"version"`
+	Name      string           `json:"name"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Host      string           `json:"host,omitempty"`
+	JobID     string           `json:"jobId"`
+	Artifacts []bundleArtifact `json:"artifacts"`
+}
+
+type bundleArtifact struct {
+	// Path in the bundle, artifacts/<file>
+	Path   string `json:"path"`
+	Source string `json:"source"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Format string `json:"format,omitempty"`
+	// Path in the bundle of the OVF the disk was extracted from, and its hardware
+	OVF      string      `json:"ovf,omitempty"`
+	Hardware ovfHardware `json:"hardware"`
+}
+
+// A bundle being written by a job; the archive is created with the first file
+type bundleWriter struct {
+	path     string
+	out      *os.File
+	tw       *tar.Writer
+	manifest bundleManifest
+	// Names already used in the bundle, and the bundle path of each OVF added
+	names map[string]bool
+	ovfs  map[string]string
+	// A file that failed part way leaves the tar unusable
+	err error
+}
+
+func newBundleWriter(job *Job, s uploadSettings) *bundleWriter {
+	name := job.Spec.Name
+	if name == "" {
+		name = "porter-bundle-" + job.ID
+	}
+	name = strings.ReplaceAll(name, "/", "-")
+	host, _ := os.Hostname()
+	return &bundleWriter{
+		path:     filepath.Join(s.Target, name+bundleSuffix),
+		manifest: bundleManifest{Version: 1, Name: name, Host: host, JobID: job.ID},
+		names:    map[string]bool{},
+		ovfs:     map[string]string{},
+	}
+}
+
+// A name under dir not yet used in the bundle
+func (b *bundleWriter) uniqueName(dir, base string) string {
+	name := path.Join(dir, base)
+	for i := 2; b.names[name]; i++ {
+		name = path.Join(dir, fmt.Sprintf("%d-%s", i, base))
+	}
+	b.names[name] = true
+	return name
+}
+
+// Stream a file into the bundle, returning its SHA-256
+func (b *bundleWriter) writeFile(job *Job, name, file string) (int64, string, error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	if err := b.tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return 0, "", err
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(b.tw, sum), &jobReader{job: job, r: src}); err != nil {
+		return 0, "", err
+	}
+	return info.Size(), hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// Add one file (and the OVF it came from) to the bundle, returning the bundle's
+// path and the file's SHA-256
+func (b *bundleWriter) add(job *Job, file string) (string, string, error) {
+	if b.err != nil {
+		return "", "", fmt.Errorf("not adding %s: bundle %s is incomplete after an earlier failure", file, b.path)
+	}
+	if b.out == nil {
+		if err := os.MkdirAll(filepath.Dir(b.path), 0755); err != nil {
+			return "", "", err
+		}
+		if _, err := os.Stat(b.path); err == nil {
+			return "", "", fmt.Errorf("bundle %s already exists; choose another name", b.path)
+		}
+		out, err := os.Create(b.path)
+		if err != nil {
+			return "", "", err
+		}
+		b.out, b.tw = out, tar.NewWriter(out)
+	}
+
+	artifact := bundleArtifact{
+		Path:     b.uniqueName("artifacts", filepath.Base(file)),
+		Source:   file,
+		Format:   diskFormatForPath(file),
+		Hardware: hardwareForDisk(file),
+	}
+	if ovf := ovfForDisk(file); ovf != "" {
+		if _, ok := b.ovfs[ovf]; !ok {
+			name := b.uniqueName("ovf", filepath.Base(ovf))
+			if _, _, err := b.writeFile(job, name, ovf); err != nil {
+				b.err = err
+				return "", "", fmt.Errorf("adding %s to bundle failed: %w", ovf, err)
+			}
+			b.ovfs[ovf] = name
+		}
+		artifact.OVF = b.ovfs[ovf]
+	}
+
+	job.setStatus("Adding %s to bundle %s", filepath.Base(file), b.path)
+	size, sum, err := b.writeFile(job, artifact.Path, file)
+	if err != nil {
+		b.err = err
+		return "", "", fmt.Errorf("adding %s to bundle failed: %w", file, err)
+	}
+	artifact.Size, artifact.SHA256 = size, sum
+	b.manifest.Artifacts = append(b.manifest.Artifacts, artifact)
+	return b.path, sum, nil
+}
+
+// Write the checksums and manifest and close the bundle. A bundle with nothing in
+// it, or of a cancelled job, is removed.
+func (b *bundleWriter) finish(job *Job) error {
+	if b.out == nil {
+		return nil
+	}
+	err := job.ctx.Err()
+	if err == nil {
+		err = b.err
+	}
+	if err == nil && len(b.manifest.Artifacts) == 0 {
+		err = errors.New("no files were added")
+	}
+	if err == nil {
+		var sums strings.Builder
+		for _, a := range b.manifest.Artifacts {
+			fmt.Fprintf(&sums, "%s  %s\n", a.SHA256, a.Path)
+		}
+		b.manifest.CreatedAt = time.Now().UTC()
+		manifest, _ := json.MarshalIndent(b.manifest, "", "  ")
+		err = addTarFiles(job, b.tw, []tarFile{
+			{name: "SHA256SUMS", data: []byte(sums.String())},
+			{name: "manifest.json", data: manifest},
+		})
+	}
+	if err == nil {
+		err = b.tw.Close()
+	}
+	if err == nil {
+		err = b.out.Sync()
+	}
+	b.out.Close()
+	if err != nil {
+		os.Remove(b.path)
+		return fmt.Errorf("writing bundle %s failed: %w", b.path, err)
+	}
+	var size int64
+	if info, err := os.Stat(b.path); err == nil {
+		size = info.Size()
+	}
+	job.logf("Wrote bundle %s with %d artifact(s)", b.path, len(b.manifest.Artifacts))
+	sources := make([]string, len(b.manifest.Artifacts))
+	for i, a := range b.manifest.Artifacts {
+		sources[i] = a.Source
+	}
+	artifactCatalog.add(CatalogEntry{
+		Kind:        "upload",
+		Cloud:       "bundle",
+		Source:      strings.Join(sources, ","),
+		Destination: b.path,
+		Size:        size,
+	})
+	return nil
+}
+
+// Unpack a bundle into the converted directory, verifying every artifact against
+// its manifest, and return the directory the disks were written to
+func importBundle(job *Job, bundle string) (string, error) {
+	f, err := os.Open(bundle)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(bundle), ".tar"), ".porter-bundle")
+	dest := filepath.Join(convertDir, name)
+	if _, err := os.Stat(dest); err == nil {
+		dest += "-" + job.ID
+	}
+	staging := dest + ".partial"
+	if err := os.MkdirAll(staging, 0755); err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+
+	job.setStatus("Unpacking bundle %s", filepath.Base(bundle))
+	type unpacked struct {
+		size int64
+		sum  string
+	}
+	files := map[string]unpacked{}
+	var manifest *bundleManifest
+	tarReader := tar.NewReader(&jobReader{job: job, r: f})
+	for {
+		hdr, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("reading bundle %s failed: %w", bundle, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if !filepath.IsLocal(hdr.Name) {
+			return "", fmt.Errorf("bundle %s has an unsafe path %q", bundle, hdr.Name)
+		}
+		if hdr.Name == "manifest.json" {
+			manifest = &bundleManifest{}
+			if err := json.NewDecoder(tarReader).Decode(manifest); err != nil {
+				return "", fmt.Errorf("invalid manifest in bundle %s: %w", bundle, err)
+			}
+			continue
+		}
+		dir, _, _ := strings.Cut(hdr.Name, "/")
+		if dir != "artifacts" && dir != "ovf" {
+			continue
+		}
+		out := filepath.Join(staging, hdr.Name)
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return "", err
+		}
+		w, err := os.Create(out)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.New()
+		n, err := io.Copy(io.MultiWriter(w, sum), tarReader)
+		if err == nil {
+			err = w.Sync()
+		}
+		w.Close()
+		if err != nil {
+			return "", fmt.Errorf("unpacking %s from bundle %s failed: %w", hdr.Name, bundle, err)
+		}
+		files[hdr.Name] = unpacked{size: n, sum: hex.EncodeToString(sum.Sum(nil))}
+	}
+	if manifest == nil {
+		return "", fmt.Errorf("%s is not a Porter bundle: it has no manifest.json", bundle)
+	}
+
+	job.setStatus("Verifying %d artifact(s) from bundle %s", len(manifest.Artifacts), manifest.Name)
+	var problems []string
+	for _, a := range manifest.Artifacts {
+		got, ok := files[a.Path]
+		switch {
+		case !ok:
+			problems = append(problems, a.Path+" is missing")
+		case got.size != a.Size:
+			problems = append(problems, fmt.Sprintf("%s is %d bytes, expected %d", a.Path, got.size, a.Size))
+		case got.sum != a.SHA256:
+			problems = append(problems, fmt.Sprintf("%s has sha256 %s, expected %s", a.Path, got.sum, a.SHA256))
+		default:
+			job.logf("Verified %s (sha256 %s)", a.Path, a.SHA256)
+		}
+		if a.OVF != "" {
+			if _, ok := files[a.OVF]; !ok {
+				problems = append(problems, a.OVF+" is missing")
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return "", fmt.Errorf("bundle %s failed verification: %s", bundle, strings.Join(problems, "; "))
+	}
+
+	// Register the disks as converted files, and the OVFs where hardwareForDisk finds them
+	if err := os.Rename(filepath.Join(staging, "artifacts"), dest); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(staging, "ovf")); err == nil {
+		ovfDir := filepath.Join(extractDir, filepath.Base(dest))
+		os.MkdirAll(extractDir, 0755)
+		if err := os.Rename(filepath.Join(staging, "ovf"), ovfDir); err != nil {
+			job.warnf("Could not register the OVFs from bundle %s: %s", bundle, err)
+		}
+	}
+	job.logf("Imported %d artifact(s) from bundle %s (created %s on %s) into %s",
+		len(manifest.Artifacts), manifest.Name, manifest.CreatedAt.Format(time.RFC3339), manifest.Host, dest)
+	return dest, nil
+}
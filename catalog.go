@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An artifact Porter has written to a destination, or adopted from one
+type CatalogEntry struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	Cloud       string    `json:"cloud"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	// Azure uploads need the subscription again to delete the blob, OSS objects
+	// their region, vSphere artifacts their vCenter, and S3 objects their endpoint
+	Subscription string `json:"subscription,omitempty"`
+	Region       string `json:"region,omitempty"`
+	Endpoint     string `json:"endpoint,omitempty"`
+	PathStyle    bool   `json:"pathStyle,omitempty"`
+
+	// Checksums of the uploaded file, by algorithm
+	Checksums map[string]string `json:"checksums,omitempty"`
+
+	// When the entry was moved to the trash, and when it will be deleted; see trash.go
+	TrashedAt *time.Time `json:"trashedAt,omitempty"`
+	PurgeAt   *time.Time `json:"purgeAt,omitempty"`
+
+	// Format and virtual size of an "adopted" entry, an image found by a catalog scan
+	Format      string `json:"format,omitempty"`
+	VirtualSize int64  `json:"virtualSize,omitempty"`
+
+	// Details of a "conversion" entry, a converted disk in the conversion directory
+	Conversion *ConversionResult `json:"conversion,omitempty"`
+}
+
+// The catalog of artifacts Porter created, persisted as JSON in the state directory
+type catalog struct {
+	sync.Mutex
+	path    string
+	Entries []CatalogEntry `json:"entries"`
+}
+
+var artifactCatalog = loadCatalog(filepath.Join(stateDir, "catalog.json"))
+
+func loadCatalog(path string) *catalog {
+	c := &catalog{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: could not read catalog %s: %s\n", path, err)
+		}
+		return c
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		fmt.Printf("Warning: invalid catalog %s: %s (starting empty)\n", path, err)
+		return &catalog{path: path}
+	}
+	fmt.Printf("Loaded %d catalog entries from %s\n", len(c.Entries), path)
+	return c
+}
+
+// Write the catalog atomically; callers must hold the lock
+func (c *catalog) save() error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+// Record a new artifact, assigning it an ID and timestamp
+func (c *catalog) add(entry CatalogEntry) CatalogEntry {
+	c.Lock()
+	defer c.Unlock()
+
+	entry.ID = newID()
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+	c.Entries = append(c.Entries, entry)
+	if err := c.save(); err != nil {
+		fmt.Printf("Warning: failed to save catalog: %s\n", err)
+	}
+	return entry
+}
+
+func (c *catalog) list() []CatalogEntry {
+	c.Lock()
+	defer c.Unlock()
+	return append([]CatalogEntry{}, c.Entries...)
+}
+
+func (c *catalog) get(id string) (CatalogEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	for _, entry := range c.Entries {
+		if entry.ID == id {
+			return entry, true
+		}
+	}
+	return CatalogEntry{}, false
+}
+
+func (c *catalog) remove(id string) {
+	c.Lock()
+	defer c.Unlock()
+	for i, entry := range c.Entries {
+		if entry.ID == id {
+			c.Entries = append(c.Entries[:i], c.Entries[i+1:]...)
+			break
+		}
+	}
+	if err := c.save(); err != nil {
+		fmt.Printf("Warning: failed to save catalog: %s\n", err)
+	}
+}
+
+// Random identifier for catalog entries
+func newID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Handler to list catalog entries; those in the trash are listed with ?trashed=true
+func catalogListHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	trashed := r.URL.Query().Get("trashed") == "true"
+	entries := []CatalogEntry{}
+	for _, entry := range artifactCatalog.list() {
+		if (kind == "" || entry.Kind == kind) && entry.trashed() == trashed {
+			entries = append(entries, entry)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string][]CatalogEntry{"entries": entries})
+}
+
+// Handler to delete an uploaded artifact: it goes to the trash, unless it is
+// already there, there is no trash, or ?permanent=true asks to delete it now
+func catalogDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	entry, ok := artifactCatalog.get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown catalog entry: %s"), id)})
+		return
+	}
+
+	retention := time.Duration(config.TrashRetentionHours) * time.Hour
+	if retention > 0 && !entry.trashed() && r.URL.Query().Get("permanent") != "true" {
+		entry, err := artifactCatalog.trash(id, retention)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+				Message: fmt.Sprintf(tr("Failed to move %s to the trash"), entry.Destination), Details: err.Error()})
+			return
+		}
+		fmt.Printf("Moved %s artifact %s (%s) to the trash until %s\n", entry.Cloud, entry.ID, entry.Destination, entry.PurgeAt.Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"trashed": entry.Destination, "purgeAt": entry.PurgeAt})
+		return
+	}
+
+	fmt.Printf("Deleting %s artifact %s (%s)\n", entry.Cloud, entry.ID, entry.Destination)
+	if err := purgeArtifact(entry); err != nil {
+		writeAPIError(w, http.StatusBadGateway, APIError{Code: errCodeProviderFailed,
+			Message: fmt.Sprintf(tr("Failed to delete %s"), entry.Destination), Details: err.Error(),
+			Remediation: "Check your credentials allow deleting objects at the destination, then retry."})
+		return
+	}
+
+	fmt.Printf("✅ Deleted %s\n", entry.Destination)
+	writeJSON(w, http.StatusOK, map[string]string{"deleted": entry.Destination})
+}
+
+// Remove an artifact from its destination, including any unfinished multipart uploads for it
+func deleteArtifact(entry CatalogEntry) error {
+	if mocked(entry.Cloud) {
+		// Mock managed disks and EBS snapshots are only IDs
+		if entry.Cloud == "azuredisk" || strings.HasPrefix(entry.Destination, "snap-") {
+			return nil
+		}
+		return deleteMockObject(entry.Destination)
+	}
+	switch entry.Cloud {
+	case "b2":
+		if strings.HasPrefix(entry.Destination, "b2://") {
+			return deleteB2File(entry.Destination)
+		}
+		fallthrough
+	case "aws", "spaces":
+		if strings.HasPrefix(entry.Destination, "snap-") {
+			return deleteEBSSnapshot(entry.Region, entry.Destination)
+		}
+		bucket, key, ok := strings.Cut(strings.TrimPrefix(entry.Destination, "s3://"), "/")
+		if !ok {
+			return fmt.Errorf("invalid S3 URI '%s'", entry.Destination)
+		}
+		aborted, err := abortS3MultipartUploads(entry.s3Endpoint(), bucket, key)
+		if err != nil {
+			fmt.Printf("Warning: could not clean multipart uploads for %s: %s\n", entry.Destination, err)
+		} else if aborted > 0 {
+			fmt.Printf("Aborted %d incomplete multipart upload(s) for %s\n", aborted, entry.Destination)
+		}
+		out, err := entry.s3Endpoint().command(context.Background(), "s3", "rm", entry.Destination).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w\nOutput: %s", err, out)
+		}
+		return nil
+	case "azure":
+		storageAccount, container, blobName, err := parseAzureBlobURI(entry.Destination)
+		if err != nil {
+			return err
+		}
+		if sas, ok := azureSASFor(storageAccount, container); ok {
+			return deleteAzureBlobSAS(sas, blobName)
+		}
+		args := []string{"storage", "blob", "delete",
+			"--account-name", storageAccount,
+			"--container-name", container,
+			"--name", blobName,
+			"--auth-mode", "login"}
+		if entry.Subscription != "" {
+			args = append(args, "--subscription", entry.Subscription)
+		}
+		out, err := toolCommand(context.Background(), "az", args...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w\nOutput: %s", err, out)
+		}
+		return nil
+	case "azuredisk":
+		return deleteAzureDisk(entry.Destination)
+	case "gcp":
+		out, err := toolCommand(context.Background(), "gcloud", "storage", "rm", entry.Destination).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w\nOutput: %s", err, out)
+		}
+		return nil
+	case "ibm":
+		return deleteCOSObject(entry.Destination)
+	case "alibaba":
+		return deleteOSSObject(entry.Region, entry.Destination)
+	case "oracle":
+		return deleteOCIObject(entry.Region, entry.Destination)
+	case "swift":
+		return deleteSwiftObject(entry.Destination, entry.Region)
+	case "linode":
+		return deleteLinodeImage(entry.Destination)
+	case "vultr":
+		return deleteVultrSnapshot(entry.Destination)
+	case "webdav":
+		return deleteWebDAVFile(entry.Destination)
+	case "http":
+		return deleteHTTPFile(entry)
+	case "porter":
+		return deletePeerFile(entry.Destination)
+	case "artifactory", "nexus":
+		return deleteArtifactRepoFile(entry.Cloud, entry.Destination)
+	case "rsync":
+		return deleteRsyncFile(entry.Destination)
+	case "ftp":
+		return deleteFTPFile(entry.Destination)
+	case "smb":
+		return deleteSMBFile(entry.Destination)
+	case "nfs":
+		return deleteNFSFile(entry.Destination)
+	case "vsphere":
+		return deleteVSphereArtifact(entry.Endpoint, entry.Destination)
+	case "datastore":
+		return deleteDatastoreFile(entry.Endpoint, entry.Destination)
+	case "library":
+		return deleteContentLibraryItem(entry.Endpoint, entry.Destination)
+	case "proxmox":
+		return deleteProxmoxDisk(entry.Endpoint, entry.Destination)
+	case "xcpng":
+		return deleteXAPIDisk(entry.Endpoint, entry.Destination)
+	case "ovirt":
+		return deleteOVirtDisk(entry.Endpoint, entry.Destination)
+	case "nutanix":
+		return deleteNutanixImage(entry.Endpoint, entry.Destination)
+	case "hyperv":
+		return deleteHyperVDisk(entry.Endpoint, entry.Destination)
+	case "vagrant":
+		if err := os.Remove(entry.Destination); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return removeFromBoxCatalog(entry.Destination)
+	case "local", "xva", "incus", "bundle":
+		err := os.Remove(entry.Destination)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	case "utm", "containerdisk":
+		return os.RemoveAll(entry.Destination)
+	case "bundle-import":
+		os.RemoveAll(filepath.Join(extractDir, filepath.Base(entry.Destination)))
+		return os.RemoveAll(entry.Destination)
+	default:
+		return fmt.Errorf("deleting %s artifacts is not supported", entry.Cloud)
+	}
+}
+
+// URI recorded for Azure uploads: azure://storageAccount/container/blob
+func azureBlobURI(storageAccount, container, blobName string) string {
+	return fmt.Sprintf("azure://%s/%s/%s", storageAccount, container, blobName)
+}
+
+func parseAzureBlobURI(uri string) (storageAccount, container, blobName string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(uri, "azure://"), "/", 3)
+	if len(parts) != 3 {
+		return "", "", "", fmt.Errorf("invalid Azure blob URI '%s'", uri)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Checksums recorded for uploads, chosen per job or destination profile. GCS
+// checks objects with CRC32C and S3's additional checksums use SHA-256 (or
+// SHA-1/CRC32C), so each destination can record what it verifies against. All
+// are hex-encoded.
+var checksumAlgorithms = []string{"sha256", "sha1", "md5", "crc32c"}
+
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha1":
+		return sha1.New()
+	case "md5":
+		return md5.New()
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return sha256.New()
+}
+
+// Normalize requested checksum algorithms ("SHA256", "sha-256" → "sha256")
+func normalizeChecksums(requested []string) ([]string, *APIError) {
+	var algorithms []string
+	for _, a := range requested {
+		a = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(a), "-", ""))
+		if a == "" {
+			continue
+		}
+		if !slices.Contains(checksumAlgorithms, a) {
+			return nil, &APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Unsupported checksum: %s"), a), Remediation: fmt.Sprintf(tr("Use one or more of %s."), strings.Join(checksumAlgorithms, ", "))}
+		}
+		if !slices.Contains(algorithms, a) {
+			algorithms = append(algorithms, a)
+		}
+	}
+	return algorithms, nil
+}
+
+// Compute every requested checksum of a file in one pass, pausable and
+// cancellable through the job
+func checksumFileForJob(job *Job, file string, algorithms []string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hashes := map[string]hash.Hash{}
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, a := range algorithms {
+		hashes[a] = newChecksumHash(a)
+		writers = append(writers, hashes[a])
+	}
+	job.setStatus("Computing %s of %s", strings.Join(algorithms, ", "), filepath.Base(file))
+	if _, err := io.Copy(io.MultiWriter(writers...), &jobReader{job: job, r: f}); err != nil {
+		return nil, fmt.Errorf("computing checksums of %s failed: %w", file, err)
+	}
+	sums := map[string]string{}
+	for a, h := range hashes {
+		sums[a] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
+
+// The S3 additional checksum algorithm to upload with, from the job's checksums
+func s3ChecksumAlgorithm(algorithms []string) string {
+	for _, a := range algorithms {
+		switch a {
+		case "sha256", "sha1", "crc32c":
+			return strings.ToUpper(a)
+		}
+	}
+	return ""
+}
+
+// Compare the CRC32C and MD5 GCS stored for an object with those computed
+// locally. Composite objects have no MD5, so only what GCS reports is compared.
+func verifyGCSChecksums(job *Job, gsURI string, sums map[string]string) error {
+	if sums["crc32c"] == "" && sums["md5"] == "" {
+		return nil
+	}
+	out, err := toolCommand(job.ctx, "gcloud", "storage", "objects", "describe", gsURI,
+		"--format=json(crc32c_hash,md5_hash)").Output()
+	if err != nil {
+		return fmt.Errorf("could not read the checksums of %s: %w", gsURI, err)
+	}
+	var stored struct {
+		CRC32C string `json:"crc32c_hash"`
+		MD5    string `json:"md5_hash"`
+	}
+	if err := json.Unmarshal(out, &stored); err != nil {
+		return fmt.Errorf("unexpected gcloud storage objects describe output: %w", err)
+	}
+	for algorithm, remote := range map[string]string{"crc32c": stored.CRC32C, "md5": stored.MD5} {
+		if sums[algorithm] == "" || remote == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(remote)
+		if err != nil {
+			return fmt.Errorf("unexpected %s for %s: %s", algorithm, gsURI, remote)
+		}
+		if hex.EncodeToString(decoded) != sums[algorithm] {
+			return fmt.Errorf("%s mismatch for %s: local %s, GCS %s", algorithm, gsURI, sums[algorithm], hex.EncodeToString(decoded))
+		}
+		job.logf("Verified %s of %s (%s)", algorithm, gsURI, sums[algorithm])
+	}
+	return nil
+}
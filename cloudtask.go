@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cloud-side tasks: an upload is only halfway to a usable image when the cloud
+// still has to import it (AWS import-image, Azure image creation, ECS and VPC
+// image imports). While a job waits on one, the task's status and percentage
+// (where the cloud reports one) are shown in the job's progress as
+// progress.task, and the status line follows them.
+type CloudTask struct {
+	// What the task is, e.g. "AWS import-image"
+	Kind       string `json:"kind"`
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	Percentage int    `json:"percentage,omitempty"`
+}
+
+// How often cloud-side tasks are polled
+var cloudTaskPollInterval = 30 * time.Second
+
+// Show a cloud-side task in the job's progress, or clear it with nil. The log
+// gets a line when the status changes or the percentage passes a multiple of 10.
+func (j *Job) setCloudTask(task *CloudTask) {
+	j.mu.Lock()
+	previous := j.Progress.Task
+	if task != nil {
+		t := *task
+		j.Progress.Task = &t
+		j.Progress.Status = t.String()
+	} else {
+		j.Progress.Task = nil
+	}
+	j.lastProgress = time.Now()
+	progress := j.Progress
+	j.mu.Unlock()
+
+	if task != nil && (previous == nil || previous.Status != task.Status || previous.Percentage/10 != task.Percentage/10) {
+		j.logf("%s", task)
+	}
+	publishLegacyProgress(progress)
+	j.publish(JobEvent{Type: "progress", Progress: &progress})
+}
+
+func (t CloudTask) String() string {
+	s := fmt.Sprintf("%s %s: %s", t.Kind, t.ID, t.Status)
+	if t.Percentage > 0 {
+		s += fmt.Sprintf(" (%d%%)", t.Percentage)
+	}
+	return s
+}
+
+// Poll a cloud-side task until poll reports it done, poll fails, the job is
+// cancelled or the timeout passes
+func waitForCloudTask(job *Job, task CloudTask, timeout time.Duration, poll func(*CloudTask) (bool, error)) error {
+	defer job.setCloudTask(nil)
+	job.setCloudTask(&task)
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case <-job.ctx.Done():
+			return job.ctx.Err()
+		case <-time.After(cloudTaskPollInterval):
+		}
+		done, err := poll(&task)
+		if err != nil {
+			return err
+		}
+		job.setCloudTask(&task)
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s %s was still %s after %s", task.Kind, task.ID, task.Status, timeout)
+		}
+	}
+}
+
+// Run a command that creates something in the cloud and only returns when it
+// is done, polling the cloud for its status meanwhile. Poll errors (e.g. the
+// resource not existing yet) leave the status as it was.
+func runCloudTaskCommand(job *Job, cmd *exec.Cmd, task CloudTask, poll func(*CloudTask) error) error {
+	defer job.setCloudTask(nil)
+	job.setCloudTask(&task)
+	done := make(chan error, 1)
+	go func() { done <- runJobCommand(job, cmd) }()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(cloudTaskPollInterval):
+		}
+		if poll(&task) == nil {
+			job.setCloudTask(&task)
+		}
+	}
+}
+
+// Parse a progress the cloud reports as a string ("45", "45%"), 0 if none
+func parsePercentage(s string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "%")))
+	if err != nil || n < 0 || n > 100 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Image comparison: whether two images (say, a re-run conversion and the
+// original, or a repatriated copy and the disk it came from) hold the same data.
+// The image tool (qemu-img compare) checks what the guest sees, so images in
+// different formats can match; block checksums of the files show whether they
+// are byte-for-byte identical and, if not, where they differ.
+
+const (
+	defaultCompareBlockSize = 64 << 20
+	// Differing blocks listed in a comparison; the rest are only counted
+	compareMaxMismatches = 100
+)
+
+// One side of a comparison
+type ComparedImage struct {
+	Path        string `json:"path"`
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtualSize"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+}
+
+// A block of the files whose checksums differ
+type BlockMismatch struct {
+	Offset    int64  `json:"offset"`
+	Length    int64  `json:"length"`
+	ChecksumA string `json:"checksumA"`
+	ChecksumB string `json:"checksumB"`
+}
+
+type ImageComparison struct {
+	A ComparedImage `json:"a"`
+	B ComparedImage `json:"b"`
+	// The guest sees the same data in both (the image tool's compare)
+	IdenticalContent bool `json:"identicalContent"`
+	// Guest offset of the first differing byte, when the content differs
+	FirstMismatch *int64 `json:"firstMismatch,omitempty"`
+	// The files are byte-for-byte identical
+	IdenticalFiles  bool            `json:"identicalFiles"`
+	BlockSize       int64           `json:"blockSize"`
+	Blocks          int64           `json:"blocks"`
+	DifferingBlocks int64           `json:"differingBlocks"`
+	Mismatches      []BlockMismatch `json:"mismatches,omitempty"`
+	Summary         string          `json:"summary"`
+}
+
+func describeComparedImage(ctx context.Context, path string) (ComparedImage, error) {
+	info, err := imageTools().info(ctx, path)
+	if err != nil {
+		return ComparedImage{Path: path}, err
+	}
+	return ComparedImage{Path: path, Format: info.Format, VirtualSize: info.VirtualSize}, nil
+}
+
+// Read both files block by block, recording their checksums and the blocks
+// that differ. A block past the end of the shorter file counts as differing.
+func compareImageBlocks(ctx context.Context, result *ImageComparison) error {
+	fa, err := os.Open(result.A.Path)
+	if err != nil {
+		return err
+	}
+	defer fa.Close()
+	fb, err := os.Open(result.B.Path)
+	if err != nil {
+		return err
+	}
+	defer fb.Close()
+
+	sumA, sumB := sha256.New(), sha256.New()
+	bufA, bufB := make([]byte, result.BlockSize), make([]byte, result.BlockSize)
+	for offset := int64(0); ; offset += result.BlockSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		na, err := io.ReadFull(fa, bufA)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		nb, err := io.ReadFull(fb, bufB)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if na == 0 && nb == 0 {
+			break
+		}
+		result.A.Size += int64(na)
+		result.B.Size += int64(nb)
+		sumA.Write(bufA[:na])
+		sumB.Write(bufB[:nb])
+		result.Blocks++
+		blockA, blockB := sha256.Sum256(bufA[:na]), sha256.Sum256(bufB[:nb])
+		if blockA == blockB {
+			continue
+		}
+		result.DifferingBlocks++
+		if len(result.Mismatches) < compareMaxMismatches {
+			result.Mismatches = append(result.Mismatches, BlockMismatch{Offset: offset, Length: int64(max(na, nb)),
+				ChecksumA: hex.EncodeToString(blockA[:]), ChecksumB: hex.EncodeToString(blockB[:])})
+		}
+	}
+	result.A.Checksum = hex.EncodeToString(sumA.Sum(nil))
+	result.B.Checksum = hex.EncodeToString(sumB.Sum(nil))
+	result.IdenticalFiles = result.DifferingBlocks == 0
+	return nil
+}
+
+func compareImages(ctx context.Context, a, b string, blockSize int64) (ImageComparison, error) {
+	result := ImageComparison{BlockSize: blockSize}
+	var err error
+	if result.A, err = describeComparedImage(ctx, a); err != nil {
+		return result, err
+	}
+	if result.B, err = describeComparedImage(ctx, b); err != nil {
+		return result, err
+	}
+	if result.FirstMismatch, err = imageTools().compare(ctx, result.A, result.B); err != nil {
+		return result, err
+	}
+	result.IdenticalContent = result.FirstMismatch == nil
+	if err := compareImageBlocks(ctx, &result); err != nil {
+		return result, fmt.Errorf("comparing the files failed: %w", err)
+	}
+
+	switch {
+	case result.IdenticalFiles:
+		result.Summary = "The images are byte-for-byte identical"
+	case result.IdenticalContent:
+		result.Summary = fmt.Sprintf("The images hold the same data, but the files differ in %d of %d blocks (format or layout)",
+			result.DifferingBlocks, result.Blocks)
+	default:
+		result.Summary = fmt.Sprintf("The images differ from guest offset %d; the files differ in %d of %d blocks",
+			*result.FirstMismatch, result.DifferingBlocks, result.Blocks)
+	}
+	if result.A.VirtualSize != result.B.VirtualSize {
+		result.Summary += fmt.Sprintf(" (virtual sizes %d and %d bytes)", result.A.VirtualSize, result.B.VirtualSize)
+	}
+	return result, nil
+}
+
+// Handler for GET /api/compare?a=...&b=...[&blockSizeMB=64]: compare two images
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	a, b := query.Get("a"), query.Get("b")
+	if a == "" || b == "" {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "Two images are needed", Remediation: "Pass the image paths as the 'a' and 'b' query parameters."})
+		return
+	}
+	blockSize := int64(defaultCompareBlockSize)
+	if value := query.Get("blockSizeMB"); value != "" {
+		mb, err := strconv.Atoi(value)
+		if err != nil || mb < 1 || mb > 1024 {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Invalid blockSizeMB: %s"), value), Remediation: "Pass a block size between 1 and 1024 MB."})
+			return
+		}
+		blockSize = int64(mb) << 20
+	}
+	for _, path := range []string{a, b} {
+		if _, err := os.Stat(path); err != nil {
+			writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Image not found: %s"), path), Details: err.Error()})
+			return
+		}
+	}
+	if tool := imageTools(); !tool.available() {
+		writeAPIError(w, http.StatusServiceUnavailable, APIError{Code: errCodeInternal,
+			Message:     fmt.Sprintf(tr("Comparing images needs %s, which is not available"), tool.name()),
+			Remediation: "Install qemu-utils in the Porter image, or set imageTool in porter.json to an image service."})
+		return
+	}
+	release, err := tryLockWorkspace("comparison", []string{a, b}, nil)
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message: "Image in use", Details: err.Error(),
+			Remediation: "Wait for the conversion or download writing it to finish, then try again."})
+		return
+	}
+	defer release()
+
+	fmt.Printf("Comparing %s and %s\n", a, b)
+	result, err := compareImages(r.Context(), a, b, blockSize)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+			Message: "Could not compare the images", Details: err.Error(),
+			Remediation: "Check that both images are complete and readable."})
+		return
+	}
+	fmt.Printf("Comparison of %s and %s: %s\n", a, b, result.Summary)
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Default location of the instance configuration file. Override with PORTER_CONFIG.
+const defaultConfigPath = "/app/porter.json"
+
+// Config holds instance-wide settings loaded from porter.json
+type Config struct {
+	// Named destination profiles selectable in the upload form
+	Destinations map[string]DestinationProfile `json:"destinations"`
+
+	// Minutes between sweeps for orphaned multipart uploads (0 disables the sweeper)
+	MultipartSweepIntervalMinutes int `json:"multipartSweepIntervalMinutes"`
+
+	// Number of jobs that may run at the same time; further jobs wait in the queue
+	MaxConcurrentJobs int `json:"maxConcurrentJobs"`
+
+	// Daily windows during which queued uploads may start (none = any time), and
+	// periods during which they may not
+	TransferWindows  []TimeWindow `json:"transferWindows,omitempty"`
+	BlackoutPeriods  []TimeWindow `json:"blackoutPeriods,omitempty"`
+	ScheduleTimezone string       `json:"scheduleTimezone,omitempty"`
+	// Also pause running uploads when a window closes, resuming them when it reopens
+	PauseOutsideWindow bool `json:"pauseOutsideWindow,omitempty"`
+
+	// Conversion format used when none is chosen, and the formats users may pick
+	// (empty = all supported formats)
+	DefaultFormat  string   `json:"defaultFormat"`
+	AllowedFormats []string `json:"allowedFormats,omitempty"`
+
+	// Site-specific guest steps, and overrides for the install-cloud-agent step:
+	// Linux packages per destination cloud and Windows installers (paths on this host)
+	GuestHooks             map[string]GuestHook `json:"guestHooks,omitempty"`
+	CloudAgentPackages     map[string][]string  `json:"cloudAgentPackages,omitempty"`
+	WindowsAgentInstallers map[string]string    `json:"windowsAgentInstallers,omitempty"`
+	// Contents of the virtio-win ISO, for the inject-virtio step
+	VirtioWinDir string `json:"virtioWinDir"`
+
+	// Address where providers that fetch images from a link (Vultr) can reach
+	// Porter, e.g. https://porter.example.com
+	PublicURL string `json:"publicURL,omitempty"`
+
+	// Tagging and Migration Hub tracking of AMIs registered from AWS jobs
+	AWSMigrationHub AWSMigrationHub `json:"awsMigrationHub"`
+
+	// Jira, ServiceNow or webhook tickets opened and updated per job; see ticket.go
+	Tickets TicketConfig `json:"tickets"`
+
+	// Webhook and email notifications of finished jobs, one each or as digests; see notify.go
+	Notifications NotificationConfig `json:"notifications"`
+
+	// Fake S3 and Azure backends and a simulated qemu-img, for rehearsals and
+	// tests without clouds; see mock.go
+	Mock MockConfig `json:"mock"`
+
+	// Default bandwidth limit in MB/s for uploads Porter streams itself, and the
+	// key (64 hex digits, default PORTER_UPLOAD_KEY) for encrypted uploads; see stream.go
+	UploadBandwidthMBps float64 `json:"uploadBandwidthMBps,omitempty"`
+	UploadEncryptionKey string  `json:"uploadEncryptionKey,omitempty"`
+	// A total upload bandwidth cap shared between classes of destination; see bandwidth.go
+	BandwidthClasses BandwidthClassConfig `json:"bandwidthClasses"`
+
+	// cosign-signed in-toto attestations of what jobs produce; see attestation.go
+	Attestation AttestationConfig `json:"attestation"`
+
+	// Language of job logs, notifications and API error messages (e.g. de;
+	// default PORTER_LANG, else English), and a directory of extra message
+	// catalogs; see messages.go
+	Language    string `json:"language,omitempty"`
+	MessagesDir string `json:"messagesDir,omitempty"`
+
+	// Receiving files from other Porter instances; see peer.go
+	PeerTransfer PeerTransferConfig `json:"peerTransfer"`
+
+	// Short-lived, destination-scoped credentials for each job; see credentials.go
+	JobCredentials JobCredentialsConfig `json:"jobCredentials"`
+
+	// HMAC key for signing transfer reports (default: PORTER_REPORT_KEY, or a key
+	// generated in the state directory)
+	ReportSigningKey string `json:"reportSigningKey,omitempty"`
+
+	// Minutes without progress before a running job is flagged as stalled (0
+	// disables), and how many times per job a stalled CLI step is restarted
+	StallMinutes  int `json:"stallMinutes"`
+	StallRestarts int `json:"stallRestarts,omitempty"`
+
+	// How disk images are inspected, converted and compared; see imaging.go
+	ImageTool ImageToolConfig `json:"imageTool"`
+	// qemu-img convert I/O tuning; see convertio.go
+	ConversionIO ConversionIO `json:"conversionIO"`
+
+	// Explicit tool paths, and a sidecar container to run tools in
+	Tools ToolsConfig `json:"tools"`
+
+	// Directories catalog scans may walk for images to adopt (default: the
+	// conversion directory and /data)
+	ScanDirectories []string `json:"scanDirectories,omitempty"`
+
+	// Hours between scans for extraction leftovers (0 disables them), and the
+	// days a directory must go untouched to be queued for cleanup
+	LeftoverScanIntervalHours int `json:"leftoverScanIntervalHours"`
+	LeftoverAgeDays           int `json:"leftoverAgeDays"`
+
+	// Hours deleted artifacts stay in the trash before they are deleted for
+	// good (0 deletes them at once); see trash.go
+	TrashRetentionHours int `json:"trashRetentionHours"`
+
+	// Local boot tests of jobs' disks under qemu in a container; see boottest.go
+	BootTest BootTestConfig `json:"bootTest"`
+
+	// Throughput (MB/s) assumed when estimating migration plan durations
+	PlanConvertMBps float64 `json:"planConvertMBps"`
+	PlanUploadMBps  float64 `json:"planUploadMBps"`
+}
+
+// Settings used when porter.json does not override them
+func defaultConfig() *Config {
+	return &Config{
+		MultipartSweepIntervalMinutes: 60,
+		MaxConcurrentJobs:             2,
+		DefaultFormat:                 "raw",
+		VirtioWinDir:                  "/app/virtio-win",
+		PlanConvertMBps:               150,
+		PlanUploadMBps:                50,
+		StallMinutes:                  15,
+		LeftoverScanIntervalHours:     24,
+		LeftoverAgeDays:               7,
+		TrashRetentionHours:           72,
+		BootTest:                      BootTestConfig{Image: defaultBootTestImage, TimeoutMinutes: 5, KeepMinutes: 30},
+		AWSMigrationHub:               AWSMigrationHub{ProgressUpdateStream: "porter"},
+	}
+}
+
+var config = loadConfig()
+
+// Load the configuration file, falling back to an empty config if it is missing or invalid
+func loadConfig() *Config {
+	path := os.Getenv("PORTER_CONFIG")
+	if path == "" {
+		path = defaultConfigPath
+	}
+
+	cfg := defaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: could not read config %s: %s\n", path, err)
+		}
+		return cfg
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		fmt.Printf("Warning: invalid config %s: %s (using defaults)\n", path, err)
+		return defaultConfig()
+	}
+	if cfg.MaxConcurrentJobs < 1 {
+		cfg.MaxConcurrentJobs = 1
+	}
+	if cfg.PlanConvertMBps <= 0 || cfg.PlanUploadMBps <= 0 {
+		fmt.Printf("Warning: plan throughput must be positive in config %s (using defaults)\n", path)
+		cfg.PlanConvertMBps, cfg.PlanUploadMBps = 150, 50
+	}
+	cfg.validateFormats(path)
+	cfg.validateImageTool(path)
+	cfg.validateConversionIO(path)
+	cfg.validateTools(path)
+	cfg.validateMock(path)
+	cfg.validateBootTest()
+	cfg.validateBandwidthClasses(path)
+	cfg.validateAttestation(path)
+	cfg.validateJobCredentials(path)
+	if cfg.AWSMigrationHub.ProgressUpdateStream == "" {
+		cfg.AWSMigrationHub.ProgressUpdateStream = "porter"
+	}
+	for _, w := range append(cfg.TransferWindows, cfg.BlackoutPeriods...) {
+		if err := w.validate(); err != nil {
+			fmt.Printf("Warning: invalid schedule in config %s: %s (ignoring transfer windows)\n", path, err)
+			cfg.TransferWindows = nil
+			cfg.BlackoutPeriods = nil
+			break
+		}
+	}
+
+	fmt.Printf("Loaded config from %s (%d destination profile(s))\n", path, len(cfg.Destinations))
+	return cfg
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// KubeVirt containerdisks, exported locally for air-gapped clusters instead of
+// pushed to a registry. The image has one layer holding the disk as
+// /disk/<name>.qcow2, owned by the qemu user (107) as KubeVirt expects. It is
+// written as an OCI image layout: either a single tar (which also has Docker's
+// manifest.json, so both `docker load` and `skopeo copy oci-archive:` read it)
+// or a directory, for `oras cp --from-oci-layout` and `skopeo copy oci:`.
+
+var containerDiskArchiveFormats = []string{"oci-archive", "oci"}
+
+const (
+	ociManifestType = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexType    = "application/vnd.oci.image.index.v1+json"
+	ociConfigType   = "application/vnd.oci.image.config.v1+json"
+	// Uncompressed: qcow2 already leaves out the disk's empty space
+	ociLayerType = "application/vnd.oci.image.layer.v1.tar"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Characters not allowed in an image repository name
+var invalidRepoChars = regexp.MustCompile(`[^a-z0-9._/-]+`)
+
+// The image reference to tag the containerdisk with: the one requested, with
+// :latest if it has no tag, or porter/<name>:latest
+func containerDiskRef(ref, name string) string {
+	if ref == "" {
+		ref = "porter/" + strings.Trim(invalidRepoChars.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	}
+	if !strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		ref += ":latest"
+	}
+	return ref
+}
+
+// Package one disk as a containerdisk in the target directory, returning the
+// archive or layout path and the image reference it is tagged with
+func packageContainerDisk(job *Job, s uploadSettings, file string) (string, string, error) {
+	name := job.Spec.Name
+	if name == "" {
+		name = hardwareForDisk(file).Name
+	}
+	name = strings.ReplaceAll(name, "/", "-")
+	ref := containerDiskRef(s.ImageRef, name)
+	if err := os.MkdirAll(s.Target, 0755); err != nil {
+		return "", "", err
+	}
+	work, err := os.MkdirTemp(s.Target, ".porter-oci-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(work)
+	blobs := filepath.Join(work, "blobs", "sha256")
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return "", "", err
+	}
+
+	disk := file
+	if !strings.EqualFold(filepath.Ext(file), ".qcow2") {
+		disk = filepath.Join(work, name+".qcow2")
+		job.setStatus("Converting %s to QCOW2 for the containerdisk", filepath.Base(file))
+		if err := convertImage(job, file, disk, "qcow2"); err != nil {
+			return "", "", err
+		}
+	}
+
+	job.setStatus("Writing containerdisk layer for %s", filepath.Base(file))
+	layer, err := writeDiskLayer(job, blobs, disk, "disk/"+name+".qcow2")
+	if err != nil {
+		return "", "", fmt.Errorf("writing the containerdisk layer for %s failed: %w", file, err)
+	}
+	if disk != file {
+		os.Remove(disk)
+	}
+
+	created := time.Now().UTC().Format(time.RFC3339)
+	imageConfig, _ := json.Marshal(map[string]interface{}{
+		"created":      created,
+		"architecture": archName(guestArch(job, file), [2]string{"amd64", "arm64"}),
+		"os":           "linux",
+		"config":       map[string]interface{}{},
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{layer.Digest}},
+		"history":      []map[string]string{{"created": created, "created_by": "porter: KubeVirt containerdisk of " + filepath.Base(file)}},
+	})
+	configDesc, err := writeBlob(blobs, ociConfigType, imageConfig)
+	if err != nil {
+		return "", "", err
+	}
+	manifest, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestType,
+		"config":        configDesc,
+		"layers":        []ociDescriptor{layer},
+		"annotations":   map[string]string{"org.opencontainers.image.created": created},
+	})
+	manifestDesc, err := writeBlob(blobs, ociManifestType, manifest)
+	if err != nil {
+		return "", "", err
+	}
+	manifestDesc.Annotations = map[string]string{
+		"io.containerd.image.name":          ref,
+		"org.opencontainers.image.ref.name": ref[strings.LastIndex(ref, ":")+1:],
+	}
+	index, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociIndexType,
+		"manifests":     []ociDescriptor{manifestDesc},
+	})
+	dockerManifest, _ := json.Marshal([]map[string]interface{}{{
+		"Config":   "blobs/sha256/" + strings.TrimPrefix(configDesc.Digest, "sha256:"),
+		"RepoTags": []string{ref},
+		"Layers":   []string{"blobs/sha256/" + strings.TrimPrefix(layer.Digest, "sha256:")},
+	}})
+	for f, data := range map[string][]byte{
+		"oci-layout":    []byte(`{"imageLayoutVersion": "1.0.0"}`),
+		"index.json":    index,
+		"manifest.json": dockerManifest,
+	} {
+		if err := os.WriteFile(filepath.Join(work, f), data, 0644); err != nil {
+			return "", "", err
+		}
+	}
+
+	dest := filepath.Join(s.Target, name+"-containerdisk")
+	if s.ArchiveFormat == "oci" {
+		if _, err := os.Stat(dest); err == nil {
+			dest += "-" + job.ID
+		}
+		if err := os.Rename(work, dest); err != nil {
+			return "", "", err
+		}
+		// MkdirTemp creates the directory readable only by Porter
+		os.Chmod(dest, 0755)
+		return dest, ref, nil
+	}
+
+	dest += ".tar"
+	files := []tarFile{
+		{name: "oci-layout", path: filepath.Join(work, "oci-layout")},
+		{name: "index.json", path: filepath.Join(work, "index.json")},
+		{name: "manifest.json", path: filepath.Join(work, "manifest.json")},
+		{name: "blobs/"},
+		{name: "blobs/sha256/"},
+	}
+	for _, desc := range []ociDescriptor{configDesc, manifestDesc, layer} {
+		blob := "blobs/sha256/" + strings.TrimPrefix(desc.Digest, "sha256:")
+		files = append(files, tarFile{name: blob, path: filepath.Join(work, blob)})
+	}
+	job.setStatus("Writing containerdisk archive %s (%s)", dest, ref)
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", "", err
+	}
+	err = writeTarFiles(job, out, files)
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(dest)
+		return "", "", fmt.Errorf("writing containerdisk archive %s failed: %w", dest, err)
+	}
+	return dest, ref, nil
+}
+
+// Write the image layer holding the disk at path in the layer, returning its
+// descriptor. The layer is uncompressed, so its digest is also its diff ID.
+func writeDiskLayer(job *Job, blobs, disk, path string) (ociDescriptor, error) {
+	src, err := os.Open(disk)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	tmp, err := os.CreateTemp(blobs, ".layer-")
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	tw := tar.NewWriter(io.MultiWriter(tmp, sum))
+	modTime := info.ModTime()
+	if err := tw.WriteHeader(&tar.Header{Name: filepath.Dir(path) + "/", Typeflag: tar.TypeDir,
+		Mode: 0555, Uid: 107, Gid: 107, ModTime: modTime}); err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: path, Mode: 0440, Uid: 107, Gid: 107,
+		Size: info.Size(), ModTime: modTime}); err != nil {
+		return ociDescriptor{}, err
+	}
+	if _, err := io.Copy(tw, &jobReader{job: job, r: src}); err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := tw.Close(); err != nil {
+		return ociDescriptor{}, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return ociDescriptor{}, err
+	}
+	layerInfo, err := tmp.Stat()
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	digest := hex.EncodeToString(sum.Sum(nil))
+	if err := os.Rename(tmp.Name(), filepath.Join(blobs, digest)); err != nil {
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{MediaType: ociLayerType, Digest: "sha256:" + digest, Size: layerInfo.Size()}, nil
+}
+
+// Store a small blob (config or manifest) under its digest
+func writeBlob(blobs, mediaType string, data []byte) (ociDescriptor, error) {
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(blobs, digest), data, 0644); err != nil {
+		return ociDescriptor{}, err
+	}
+	return ociDescriptor{MediaType: mediaType, Digest: "sha256:" + digest, Size: int64(len(data))}, nil
+}
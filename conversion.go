@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// The outcome of converting one disk: returned by /convert and in pipeline
+// jobs, and recorded in the catalog as a "conversion" entry for the output
+type ConversionResult struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+	Format string `json:"format"`
+	// qemu-img subformat written, e.g. fixed or streamOptimized
+	Subformat string `json:"subformat,omitempty"`
+	// Size of the disk the guest sees, and of the output file
+	VirtualSize int64 `json:"virtualSize"`
+	ActualSize  int64 `json:"actualSize"`
+	// Guest bytes holding data, what a compressed upload sends at most; see usage.go
+	DataSize        int64   `json:"dataSize,omitempty"`
+	DurationSeconds float64 `json:"durationSeconds"`
+	// SHA-256 of the output
+	Checksum  string    `json:"checksum"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Describe a finished conversion. The checksum is computed through the job if
+// there is one, so it can be paused and cancelled with it.
+func describeConversion(ctx context.Context, job *Job, input, output, format string, duration time.Duration) (ConversionResult, error) {
+	result := ConversionResult{Input: input, Output: output, Format: format,
+		DurationSeconds: duration.Seconds(), CreatedAt: time.Now().UTC()}
+	info, err := imageTools().info(ctx, output)
+	if err != nil {
+		return result, err
+	}
+	result.VirtualSize = info.VirtualSize
+	// The image tool reports allocated blocks; the file size is what gets uploaded
+	result.ActualSize = info.ActualSize
+	if fileInfo, err := os.Stat(output); err == nil {
+		result.ActualSize = fileInfo.Size()
+	}
+	if usage, err := imageUsage(ctx, output); err == nil {
+		result.DataSize = usage.DataSize
+	}
+
+	if job != nil {
+		sums, err := checksumFileForJob(job, output, []string{"sha256"})
+		if err != nil {
+			return result, err
+		}
+		result.Checksum = sums["sha256"]
+		return result, nil
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return result, fmt.Errorf("computing the checksum of %s failed: %w", output, err)
+	}
+	result.Checksum = hex.EncodeToString(h.Sum(nil))
+	return result, nil
+}
+
+// Record a conversion in the catalog, replacing the entry of an earlier
+// conversion to the same output
+func recordConversion(result ConversionResult) {
+	artifactCatalog.Lock()
+	var entries []CatalogEntry
+	for _, entry := range artifactCatalog.Entries {
+		if entry.Kind != "conversion" || entry.Destination != result.Output {
+			entries = append(entries, entry)
+		}
+	}
+	artifactCatalog.Entries = entries
+	artifactCatalog.Unlock()
+
+	artifactCatalog.add(CatalogEntry{
+		Kind:        "conversion",
+		Cloud:       "local",
+		Source:      result.Input,
+		Destination: result.Output,
+		Size:        result.ActualSize,
+		CreatedAt:   result.CreatedAt,
+		Checksums:   map[string]string{"sha256": result.Checksum},
+		Conversion:  &result,
+	})
+}
+
+// Sizes and duration for the page, e.g. "20.00 GB virtual, 3.02 GB data, 3.14 GB file, 2m"
+func (c ConversionResult) Summary() string {
+	data := ""
+	if c.DataSize > 0 {
+		data = fmt.Sprintf("%.2f GB data, ", float64(c.DataSize)/(1<<30))
+	}
+	return fmt.Sprintf("%.2f GB virtual, %s%.2f GB file, %s", float64(c.VirtualSize)/(1<<30),
+		data, float64(c.ActualSize)/(1<<30), formatDuration(int64(c.DurationSeconds)))
+}
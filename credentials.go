@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Short-lived credentials for each job: rather than uploading with Porter's
+// own long-lived credentials, a job gets credentials minted for it that reach
+// only its destination and expire soon after, the kind a separate worker
+// would be handed to run the upload. For AWS S3, Porter assumes
+// jobCredentials.awsRoleArn with a session policy that allows only writing
+// objects under the job's bucket and prefix. For Azure uploads through az, it
+// gets a user delegation SAS (signed with its Entra ID login rather than an
+// account key) allowing only creating and writing blobs in the job's
+// container, and uploads with it as with a SAS URL (see azuresas.go). What
+// follows the upload (AMI imports, Azure images, the cleanup of failed
+// uploads) still runs with Porter's own credentials. Credentials are renewed
+// between files once less than a quarter of their lifetime is left.
+type JobCredentialsConfig struct {
+	// IAM role to assume for AWS S3 uploads; Porter's credentials must be
+	// allowed to assume it
+	AWSRoleARN string `json:"awsRoleArn,omitempty"`
+	// Upload to Azure with a user delegation SAS instead of az's login
+	AzureSAS bool `json:"azureSas,omitempty"`
+	// How long credentials last, 15 to 720 (default 60); AWS also caps this
+	// at the role's maximum session duration
+	DurationMinutes int `json:"durationMinutes,omitempty"`
+}
+
+// AWS session credentials, as sts assume-role returns them
+type awsSession struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"SessionToken"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// Check the job credential settings
+func (c *Config) validateJobCredentials(path string) {
+	j := &c.JobCredentials
+	if j.AWSRoleARN != "" && !strings.HasPrefix(j.AWSRoleARN, "arn:") {
+		fmt.Printf("Warning: jobCredentials.awsRoleArn '%s' in config %s is not an ARN (not assuming it)\n", j.AWSRoleARN, path)
+		j.AWSRoleARN = ""
+	}
+	switch {
+	case j.DurationMinutes == 0:
+		j.DurationMinutes = 60
+	case j.DurationMinutes < 15 || j.DurationMinutes > 720:
+		fmt.Printf("Warning: jobCredentials.durationMinutes must be 15 to 720 in config %s (using 60)\n", path)
+		j.DurationMinutes = 60
+	}
+}
+
+// Mint the job's credentials for its destination, or renew them when they
+// are running out; destinations without job credentials are left alone
+func refreshJobCredentials(job *Job, s *uploadSettings) error {
+	c := config.JobCredentials
+	lifetime := time.Duration(c.DurationMinutes) * time.Minute
+	if !s.CredentialsExpire.IsZero() && time.Until(s.CredentialsExpire) > lifetime/4 {
+		return nil
+	}
+	switch {
+	case s.Cloud == "aws" && s.URL == "" && c.AWSRoleARN != "" && !mocked("aws"):
+		session, err := assumeUploadRole(job, *s, lifetime)
+		if err != nil {
+			return fmt.Errorf("could not get temporary AWS credentials from %s: %w", c.AWSRoleARN, err)
+		}
+		s.AWSSession, s.CredentialsExpire = &session, session.Expiration
+		job.logf("Uploading with temporary credentials from %s for s3://%s/%s, expiring %s",
+			c.AWSRoleARN, s.Bucket, s3UploadPrefix(*s), session.Expiration.Local().Format(time.Kitchen))
+	// A SAS the job was given is used as it is
+	case s.Cloud == "azure" && c.AzureSAS && (s.URL == "" || !s.CredentialsExpire.IsZero()) && !mocked("azure"):
+		account, container, ok := strings.Cut(s.Container, "/")
+		if !ok {
+			return fmt.Errorf("invalid Azure container format '%s'. Expected 'storageAccount/container'", s.Container)
+		}
+		expires := time.Now().Add(lifetime).UTC()
+		args := []string{"storage", "container", "generate-sas", "--account-name", account, "--name", container,
+			"--permissions", "cw", "--expiry", expires.Format("2006-01-02T15:04Z"),
+			"--auth-mode", "login", "--as-user", "--https-only", "--output", "tsv"}
+		if s.Subscription != "" {
+			args = append(args, "--subscription", s.Subscription)
+		}
+		token, err := azOutput(job.ctx, args...)
+		if err != nil {
+			return fmt.Errorf("could not get a user delegation SAS for %s: %w", s.Container, err)
+		}
+		s.URL = fmt.Sprintf("https://%s.blob.core.windows.net/%s?%s", account, container, strings.TrimPrefix(token, "?"))
+		s.CredentialsExpire = expires
+		job.logf("Uploading with a user delegation SAS for %s (create and write only), expiring %s",
+			s.Container, expires.Local().Format(time.Kitchen))
+	}
+	return nil
+}
+
+// The key prefix a job's S3 uploads are written under, "" for the bucket's root
+func s3UploadPrefix(s uploadSettings) string {
+	if prefix := strings.Trim(s.Target, "/"); prefix != "" {
+		return prefix + "/"
+	}
+	return ""
+}
+
+// Assume the upload role, limited by a session policy to writing the job's objects
+func assumeUploadRole(job *Job, s uploadSettings, lifetime time.Duration) (awsSession, error) {
+	var session awsSession
+	// The role's partition (aws, aws-cn, aws-us-gov) is that of its buckets
+	partition := "aws"
+	if parts := strings.Split(config.JobCredentials.AWSRoleARN, ":"); len(parts) > 1 {
+		partition = parts[1]
+	}
+	policy, _ := json.Marshal(map[string]interface{}{
+		"Version": "2012-10-17",
+		"Statement": []map[string]interface{}{{
+			"Effect":   "Allow",
+			"Action":   []string{"s3:PutObject", "s3:PutObjectTagging", "s3:AbortMultipartUpload", "s3:ListMultipartUploadParts"},
+			"Resource": fmt.Sprintf("arn:%s:s3:::%s/%s*", partition, s.Bucket, s3UploadPrefix(s)),
+		}},
+	})
+	args := []string{"sts", "assume-role", "--role-arn", config.JobCredentials.AWSRoleARN,
+		"--role-session-name", "porter-" + job.ID, "--duration-seconds", fmt.Sprint(int(lifetime.Seconds())),
+		"--policy", string(policy), "--query", "Credentials", "--output", "json"}
+	if s.Region != "" {
+		args = append(args, "--region", s.Region)
+	}
+	out, err := toolCommand(job.ctx, "aws", args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return session, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	} else if err != nil {
+		return session, err
+	}
+	if err := json.Unmarshal(out, &session); err != nil || session.SessionToken == "" {
+		return session, fmt.Errorf("unexpected sts assume-role output: %s", strings.TrimSpace(string(out)))
+	}
+	return session, nil
+}
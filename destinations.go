@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DestinationProfile is a named upload destination with defaults applied to every upload
+type DestinationProfile struct {
+	Cloud     string `json:"cloud"`
+	Target    string `json:"target,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Account   string `json:"account,omitempty"`
+	Container string `json:"container,omitempty"`
+
+	// Object metadata and tags, e.g. {"source": "porter", "migration-wave": "3"}
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+
+	// Storage class for GCP uploads
+	StorageClass string `json:"storageClass,omitempty"`
+	// Region and resource group for clouds that import images (region also for OCI)
+	Region        string `json:"region,omitempty"`
+	ResourceGroup string `json:"resourceGroup,omitempty"`
+	// WebDAV share, FTP server, NFS export, HTTP endpoint, vCenter or S3-compatible endpoint URL and the credentials for
+	// it (for S3, the access key and secret key)
+	URL      string `json:"url,omitempty"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// HTTP method (PUT or POST) and extra headers for http profiles, and the
+	// bearer token for http and artifactory profiles; header values and the
+	// token may name environment variables ("${API_KEY}")
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Token   string            `json:"token,omitempty"`
+	// Where an nfs profile's url is already mounted, or the options to mount it with
+	MountPath    string `json:"mountPath,omitempty"`
+	MountOptions string `json:"mountOptions,omitempty"`
+	// Path-style addressing for S3-compatible endpoints
+	PathStyle bool `json:"pathStyle,omitempty"`
+	// SSH destination for rsync uploads (user@host or user@host:port)
+	Host string `json:"host,omitempty"`
+	// vSphere placement
+	Datastore    string `json:"datastore,omitempty"`
+	ResourcePool string `json:"resourcePool,omitempty"`
+	Network      string `json:"network,omitempty"`
+	// Bandwidth class of uploads to this destination, e.g. prod or archive
+	BandwidthClass string `json:"bandwidthClass,omitempty"`
+	// Checksums to record for uploads to this destination (sha256, sha1, md5, crc32c)
+	Checksums []string `json:"checksums,omitempty"`
+	// Create Compute Engine images from GCP uploads
+	CreateImage bool `json:"createImage,omitempty"`
+	// Turn oVirt VMs into templates
+	Template bool `json:"template,omitempty"`
+	// Vagrant box provider (libvirt or virtualbox)
+	BoxProvider string `json:"boxProvider,omitempty"`
+	// KubeVirt containerdisk archive format (oci-archive or oci)
+	ArchiveFormat string `json:"archiveFormat,omitempty"`
+	// Azure Compute Gallery image definition to publish to, and its replication
+	// regions, or the regions to copy AMIs to
+	Gallery       string   `json:"gallery,omitempty"`
+	TargetRegions []string `json:"targetRegions,omitempty"`
+	// AWS accounts to share AMIs with
+	ShareAccounts []string `json:"shareAccounts,omitempty"`
+
+	// Mark uploads as transient artifacts that expire after this many days (0 = keep)
+	ExpireAfterDays int `json:"expireAfterDays,omitempty"`
+	// Prefix prepended to transient uploads so a prefix-scoped lifecycle rule can match them
+	LifecyclePrefix string `json:"lifecyclePrefix,omitempty"`
+}
+
+// The credentials of the profile for cloud whose url rawURL is under, if any
+func profileCredentials(cloud, rawURL string) (string, string, bool) {
+	for _, profile := range config.Destinations {
+		if profile.Cloud == cloud && profile.URL != "" && profile.Username != "" && urlUnder(rawURL, profile.URL) {
+			return profile.Username, profile.Password, true
+		}
+	}
+	return "", "", false
+}
+
+// Parse a destination URL; UNC paths (\\server\share) are read as smb URLs
+// and bare hosts (vcenter.corp/sdk) as URLs without a scheme
+func parseDestinationURL(rawURL string) (*url.URL, error) {
+	if strings.HasPrefix(rawURL, `\\`) {
+		rawURL = "smb:" + strings.ReplaceAll(rawURL, `\`, "/")
+	} else if !strings.Contains(rawURL, "://") && !strings.HasPrefix(rawURL, "//") {
+		rawURL = "//" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in %s", rawURL)
+	}
+	return u, nil
+}
+
+// Whether two URLs have the same scheme and host, port included
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(a.Scheme, b.Scheme) && strings.EqualFold(a.Host, b.Host)
+}
+
+// Whether rawURL is base or below it: the same scheme and host, and base's
+// path or a path under it, compared on whole segments
+func urlUnder(rawURL, base string) bool {
+	u, err := parseDestinationURL(rawURL)
+	if err != nil {
+		return false
+	}
+	b, err := parseDestinationURL(base)
+	if err != nil || !sameOrigin(u, b) {
+		return false
+	}
+	prefix := strings.TrimRight(b.Path, "/")
+	return prefix == "" || u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/")
+}
+
+// An HTTP client for a destination's API, skipping certificate checks if the
+// environment variable envVar (such as PROXMOX_INSECURE) is set
+func insecureClient(envVar string) *http.Client {
+	if os.Getenv(envVar) == "" {
+		return http.DefaultClient
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	return &http.Client{Transport: transport}
+}
+
+// Tag keys used to mark transient uploads for lifecycle rules
+const (
+	transientTagKey = "porter-transient"
+	expiresTagKey   = "porter-expires"
+)
+
+// Look up a destination profile by name
+func findDestinationProfile(name string) (DestinationProfile, bool) {
+	profile, ok := config.Destinations[name]
+	return profile, ok
+}
+
+// Sorted key=value pairs so that CLI arguments are stable between runs
+func keyValuePairs(values map[string]string) []string {
+	var pairs []string
+	for k, v := range values {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+// Build the --metadata argument for aws s3 cp (comma separated key=value)
+func awsMetadataArg(metadata map[string]string) string {
+	return strings.Join(keyValuePairs(metadata), ",")
+}
+
+// Build the --tagging argument for aws s3api put-object-tagging
+func awsTaggingArg(tags map[string]string) (string, error) {
+	type tag struct {
+		Key   string `json:"Key"`
+		Value string `json:"Value"`
+	}
+	var tagSet []tag
+	for _, pair := range keyValuePairs(tags) {
+		k, v, _ := strings.Cut(pair, "=")
+		tagSet = append(tagSet, tag{Key: k, Value: v})
+	}
+	out, err := json.Marshal(map[string][]tag{"TagSet": tagSet})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode tags: %w", err)
+	}
+	return string(out), nil
+}
+
+// Apply tags to an uploaded S3 object identified by its s3:// URI
+func tagS3Object(endpoint *s3Endpoint, s3Uri string, tags map[string]string) error {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(s3Uri, "s3://"), "/")
+	if !ok {
+		return fmt.Errorf("invalid S3 URI '%s'", s3Uri)
+	}
+	tagging, err := awsTaggingArg(tags)
+	if err != nil {
+		return err
+	}
+	cmd := endpoint.command(context.Background(), "s3api", "put-object-tagging",
+		"--bucket", bucket,
+		"--key", key,
+		"--tagging", tagging)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// Copy tags and add the transient marker plus an expiry date (YYYY-MM-DD)
+func withExpiryTags(tags map[string]string, expireDays int, now time.Time) map[string]string {
+	result := make(map[string]string, len(tags)+2)
+	for k, v := range tags {
+		result[k] = v
+	}
+	result[transientTagKey] = "true"
+	result[expiresTagKey] = now.AddDate(0, 0, expireDays).Format("2006-01-02")
+	return result
+}
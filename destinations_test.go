@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func TestURLUnder(t *testing.T) {
+	tests := []struct {
+		url, base string
+		want      bool
+	}{
+		{"https://cloud.example.com/remote.php/dav/files/ops/vms", "https://cloud.example.com/remote.php/dav", true},
+		{"https://cloud.example.com/remote.php/dav", "https://cloud.example.com/remote.php/dav/", true},
+		{"https://cloud.example.com/remote.php/davx/files", "https://cloud.example.com/remote.php/dav", false},
+		{"https://cloud.example.com.evil.tld/remote.php/dav", "https://cloud.example.com", false},
+		{"http://cloud.example.com/remote.php/dav", "https://cloud.example.com/remote.php/dav", false},
+		{"http://127.0.0.1:18080/upload", "http://127.0.0.1:1", false},
+		{"http://127.0.0.1:1/upload", "http://127.0.0.1:1", true},
+		{"HTTPS://Cloud.Example.com/dav", "https://cloud.example.com", true},
+		{`\\fs01\vms\web01`, "smb://fs01/vms", true},
+		{`\\fs01\vmsold\web01`, "smb://fs01/vms", false},
+		{"vcenter.corp/sdk", "vcenter.corp", true},
+		{"vcenter.corp.evil.tld/sdk", "vcenter.corp", false},
+		{"https:///no-host", "https://cloud.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := urlUnder(tt.url, tt.base); got != tt.want {
+			t.Errorf("urlUnder(%q, %q) = %v, want %v", tt.url, tt.base, got, tt.want)
+		}
+	}
+}
+
+func TestProfileCredentials(t *testing.T) {
+	saved := config.Destinations
+	defer func() { config.Destinations = saved }()
+	config.Destinations = map[string]DestinationProfile{
+		"nextcloud": {Cloud: "webdav", URL: "https://cloud.example.com/remote.php/dav", Username: "ops", Password: "secret"},
+		"images":    {Cloud: "http", URL: "https://images.example.com:8443/api", Username: "uploader", Password: "pw"},
+	}
+	tests := []struct {
+		cloud, url string
+		user       string
+		ok         bool
+	}{
+		{"webdav", "https://cloud.example.com/remote.php/dav/files/ops", "ops", true},
+		{"webdav", "https://cloud.example.com.attacker.net/remote.php/dav", "", false},
+		{"webdav", "https://cloud.example.com/remote.php/dav-other", "", false},
+		{"http", "https://cloud.example.com/remote.php/dav/files/ops", "", false},
+		{"http", "https://images.example.com:8443/api/disks/web01", "uploader", true},
+		{"http", "https://images.example.com/api/disks/web01", "", false},
+	}
+	for _, tt := range tests {
+		user, _, ok := profileCredentials(tt.cloud, tt.url)
+		if user != tt.user || ok != tt.ok {
+			t.Errorf("profileCredentials(%q, %q) = %q, %v, want %q, %v", tt.cloud, tt.url, user, ok, tt.user, tt.ok)
+		}
+	}
+}
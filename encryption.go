@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Encrypted volumes convert fine (qemu-img copies the ciphertext), but the VM
+// then stops at a passphrase or BitLocker recovery prompt in the target, where
+// nobody is watching the console. Disks are checked right after extraction, so
+// users hear about it before spending hours converting and uploading them.
+
+// An encrypted volume found in a disk, e.g. {"/dev/sda2", "LUKS"}
+type encryptedVolume struct {
+	Device string `json:"device"`
+	Type   string `json:"type"`
+}
+
+// Filesystem types libguestfs reports for encrypted volumes
+var encryptedVFSTypes = map[string]string{
+	"crypto_LUKS": "LUKS",
+	"BitLocker":   "BitLocker",
+}
+
+// A device, partition, volume or filesystem in a disk image, as listed by virt-filesystems
+type filesystemEntry struct {
+	Name string
+	Type string // device, partition, filesystem, pv, vg, lv
+	VFS  string
+	// MBR partition type, or "-" on GPT disks
+	MBR  string
+	Size int64
+}
+
+// List everything libguestfs can see in a disk image. Nothing is decrypted or
+// mounted: partition tables and volume headers are enough.
+func listFilesystems(ctx context.Context, disk, format string) ([]filesystemEntry, error) {
+	cmd := toolCommand(ctx, "virt-filesystems", "-a", disk, "--format", format,
+		"--all", "--long", "--csv", "--no-title")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("virt-filesystems failed for %s: %w", disk, err)
+	}
+	records, err := csv.NewReader(strings.NewReader(string(out))).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("unexpected virt-filesystems output: %w", err)
+	}
+
+	// Columns: Name,Type,VFS,Label,MBR,Size,Parent,UUID
+	var entries []filesystemEntry
+	for _, record := range records {
+		if len(record) < 6 {
+			continue
+		}
+		size, _ := strconv.ParseInt(record[5], 10, 64)
+		entries = append(entries, filesystemEntry{Name: record[0], Type: record[1], VFS: record[2], MBR: record[4], Size: size})
+	}
+	return entries, nil
+}
+
+// The encrypted volumes among a disk's filesystems
+func encryptedVolumes(entries []filesystemEntry) []encryptedVolume {
+	var volumes []encryptedVolume
+	for _, e := range entries {
+		if kind, ok := encryptedVFSTypes[e.VFS]; ok {
+			volumes = append(volumes, encryptedVolume{Device: e.Name, Type: kind})
+		}
+	}
+	return volumes
+}
+
+// Check a disk for encryption, returning a warning for the user ("" if there is
+// nothing to report, or virt-filesystems is not installed)
+func encryptionWarning(ctx context.Context, disk, format string) string {
+	if !checkBinary("virt-filesystems") {
+		return ""
+	}
+	entries, err := listFilesystems(ctx, disk, format)
+	if err != nil {
+		fmt.Printf("Warning: could not check %s for encryption: %s\n", disk, err)
+		return ""
+	}
+	return describeEncryption(filepath.Base(disk), encryptedVolumes(entries))
+}
+
+// Explain what encrypted volumes mean for a migration ("" if there are none)
+func describeEncryption(disk string, volumes []encryptedVolume) string {
+	if len(volumes) == 0 {
+		return ""
+	}
+
+	var found []string
+	kinds := map[string]bool{}
+	for _, v := range volumes {
+		found = append(found, fmt.Sprintf("%s (%s)", v.Device, v.Type))
+		kinds[v.Type] = true
+	}
+	warning := fmt.Sprintf("%s contains encrypted volumes: %s. Conversion will succeed, but the VM will not boot unattended in the target",
+		disk, strings.Join(found, ", "))
+	switch {
+	case kinds["BitLocker"] && kinds["LUKS"]:
+		warning += "; suspend BitLocker and set up LUKS key handling (e.g. a TPM or network-bound unlock) before exporting."
+	case kinds["BitLocker"]:
+		warning += "; suspend or disable BitLocker on the source VM before exporting, or have the recovery key ready."
+	default:
+		warning += "; set up unattended LUKS unlock (e.g. a TPM or network-bound Clevis/Tang key) or have console access to enter the passphrase."
+	}
+	return warning
+}
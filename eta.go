@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Job duration estimates. Porter records the throughput it achieves for each stage
+// (download, convert, upload per cloud) and uses it with the input sizes to estimate
+// how long a job will take, when a queued job will start and when a running job will
+// finish. Until a stage has been measured, the plan throughput from porter.json is used.
+
+// Measured throughput of one stage, as a moving average
+type stageThroughput struct {
+	BytesPerSecond float64 `json:"bytesPerSecond"`
+	Samples        int     `json:"samples"`
+}
+
+type throughputHistory struct {
+	sync.Mutex
+	path   string
+	Stages map[string]*stageThroughput `json:"stages"`
+}
+
+var throughput = loadThroughputHistory(filepath.Join(stateDir, "throughput.json"))
+
+func loadThroughputHistory(path string) *throughputHistory {
+	h := &throughputHistory{path: path, Stages: map[string]*stageThroughput{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: could not read throughput history %s: %s\n", path, err)
+		}
+		return h
+	}
+	if err := json.Unmarshal(data, h); err != nil || h.Stages == nil {
+		fmt.Printf("Warning: invalid throughput history %s (starting empty)\n", path)
+		return &throughputHistory{path: path, Stages: map[string]*stageThroughput{}}
+	}
+	return h
+}
+
+// Record a completed transfer of size bytes taking elapsed. Small transfers are
+// ignored since fixed overheads dominate them.
+func (h *throughputHistory) record(stage string, size int64, elapsed time.Duration) {
+	if size < 64*1024*1024 || elapsed <= 0 {
+		return
+	}
+	rate := float64(size) / elapsed.Seconds()
+
+	h.Lock()
+	defer h.Unlock()
+	s, ok := h.Stages[stage]
+	if !ok {
+		s = &stageThroughput{}
+		h.Stages[stage] = s
+	}
+	// Weight recent transfers more, so the estimate follows changes in the network
+	if s.Samples == 0 {
+		s.BytesPerSecond = rate
+	} else {
+		s.BytesPerSecond = 0.7*s.BytesPerSecond + 0.3*rate
+	}
+	s.Samples++
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err == nil {
+		err = os.WriteFile(h.path, data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save throughput history: %s\n", err)
+	}
+}
+
+// Bytes per second expected for a stage
+func (h *throughputHistory) rate(stage string) float64 {
+	h.Lock()
+	s, ok := h.Stages[stage]
+	h.Unlock()
+	if ok && s.Samples > 0 {
+		return s.BytesPerSecond
+	}
+	if stage == "convert" {
+		return config.PlanConvertMBps * 1024 * 1024
+	}
+	return config.PlanUploadMBps * 1024 * 1024
+}
+
+func uploadStage(cloud string) string {
+	return "upload:" + cloud
+}
+
+// Estimated seconds to run a job from its input sizes (for compressed uploads, the
+// data in them; see usage.go); remote sources (whose size is unknown until
+// downloaded) are not included
+func estimateJobSeconds(spec JobSpec, cloud string) int64 {
+	var seconds float64
+	if spec.Source != "" {
+		info, err := os.Stat(spec.Source)
+		if err != nil {
+			return 0
+		}
+		size := float64(info.Size())
+		switch strings.ToLower(filepath.Ext(spec.Source)) {
+		case ".ova", ".vmdk":
+			seconds += size / throughput.rate("convert")
+		}
+		seconds += size / throughput.rate(uploadStage(cloud))
+	}
+	for _, file := range spec.Files {
+		if size, err := transferSize(file, spec.Compress); err == nil {
+			seconds += float64(size) / throughput.rate(uploadStage(cloud))
+		}
+	}
+	return int64(math.Ceil(seconds))
+}
+
+// Seconds left for a running job: the estimate less the time spent, but never less
+// than the share of the estimate for the files still to go
+func (j *Job) remainingSeconds(now time.Time) int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.StartedAt == nil {
+		return j.EstimatedSeconds
+	}
+	remaining := j.EstimatedSeconds - int64(now.Sub(*j.StartedAt).Seconds())
+	if byProgress := j.EstimatedSeconds * int64(100-j.Progress.Percentage) / 100; byProgress > remaining {
+		remaining = byProgress
+	}
+	return remaining
+}
+
+// Refresh the estimated start and finish times of unfinished jobs by simulating the
+// queue: each queued job (in priority order) takes the first slot to become free
+func (m *jobManager) updateETAs() {
+	m.Lock()
+	queue := append([]*Job{}, m.queue...)
+	all := append([]*Job{}, m.order...)
+	m.Unlock()
+
+	now := time.Now().UTC()
+	var slots []time.Time
+	for _, job := range all {
+		state := job.state()
+		if state != jobRunning && state != jobPaused {
+			continue
+		}
+		eta := now.Add(time.Duration(job.remainingSeconds(now)) * time.Second)
+		job.mu.Lock()
+		job.EstimatedStart = nil
+		job.ETA = &eta
+		job.mu.Unlock()
+		slots = append(slots, eta)
+	}
+	for len(slots) < config.MaxConcurrentJobs {
+		slots = append(slots, now)
+	}
+
+	sort.SliceStable(queue, func(a, b int) bool {
+		return queue[a].priority() > queue[b].priority()
+	})
+	for _, job := range queue {
+		sort.Slice(slots, func(a, b int) bool { return slots[a].Before(slots[b]) })
+		start := slots[0]
+		job.mu.Lock()
+		eta := start.Add(time.Duration(job.EstimatedSeconds) * time.Second)
+		job.EstimatedStart = &start
+		job.ETA = &eta
+		job.mu.Unlock()
+		slots[0] = eta
+	}
+}
+
+// Short human-readable duration, e.g. "1h25m"
+func formatDuration(seconds int64) string {
+	d := time.Duration(seconds) * time.Second
+	switch {
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", int(math.Ceil(d.Minutes())))
+	default:
+		return fmt.Sprintf("%ds", seconds)
+	}
+}
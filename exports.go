@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Temporary links to local files, for providers that import images by fetching a
+// URL (Vultr). Porter serves the file itself at publicURL/exports/<token>; tokens
+// are random, expire, and are revoked once the provider has the image.
+
+type exportLink struct {
+	Path    string
+	Expires time.Time
+}
+
+var exportLinks = struct {
+	sync.Mutex
+	links map[string]exportLink
+}{links: map[string]exportLink{}}
+
+// Publish a file for ttl, returning its URL and a function revoking it
+func createExportLink(path string, ttl time.Duration) (string, func(), error) {
+	if config.PublicURL == "" {
+		return "", nil, errors.New("publicURL is not set in porter.json, so the provider cannot fetch images from Porter")
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(b)
+
+	exportLinks.Lock()
+	exportLinks.links[token] = exportLink{Path: path, Expires: time.Now().Add(ttl)}
+	exportLinks.Unlock()
+
+	revoke := func() {
+		exportLinks.Lock()
+		delete(exportLinks.links, token)
+		exportLinks.Unlock()
+	}
+	return fmt.Sprintf("%s/exports/%s", strings.TrimRight(config.PublicURL, "/"), token), revoke, nil
+}
+
+// Handler for GET /exports/{token}: serve a published file (with range support)
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.PathValue("token")
+	exportLinks.Lock()
+	link, ok := exportLinks.links[token]
+	if ok && time.Now().After(link.Expires) {
+		delete(exportLinks.links, token)
+		ok = false
+	}
+	exportLinks.Unlock()
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: "Unknown or expired export link"})
+		return
+	}
+	fmt.Printf("Serving export %s to %s\n", link.Path, r.RemoteAddr)
+	http.ServeFile(w, r, link.Path)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// qemu-img output formats Porter can convert to, in the order they are offered
+var supportedFormatOrder = []string{"raw", "vpc", "vhdx", "qcow2", "vmdk"}
+
+var supportedFormats = map[string]bool{
+	"raw":   true,
+	"vpc":   true,
+	"qcow2": true,
+	"vhdx":  true,
+	"vmdk":  true,
+}
+
+// Labels for the format picker and names for status messages
+var formatLabels = map[string]string{
+	"raw":   "RAW (for Linux/KVM)",
+	"vpc":   "VHD (for Azure/Hyper-V)",
+	"vhdx":  "VHDX (for newer Hyper-V)",
+	"qcow2": "QCOW2 (for QEMU/OpenStack)",
+	"vmdk":  "VMDK streamOptimized (for vSphere)",
+}
+
+var formatDisplayNames = map[string]string{
+	"raw":   "RAW",
+	"vpc":   "VHD (Hyper-V/Azure)",
+	"vhdx":  "VHDX (Hyper-V)",
+	"qcow2": "QCOW2 (QEMU/OpenStack)",
+	"vmdk":  "VMDK streamOptimized (vSphere)",
+}
+
+// qemu-img subformats Porter offers for an output format, the default first.
+// VMDKs default to streamOptimized, the flavour vSphere imports and OVAs carry,
+// rather than qemu-img's monolithicSparse.
+var formatSubformats = map[string][]string{
+	"vpc":  {"dynamic", "fixed"},
+	"vhdx": {"dynamic", "fixed"},
+	"vmdk": {"streamOptimized", "monolithicSparse", "monolithicFlat", "twoGbMaxExtentSparse", "twoGbMaxExtentFlat"},
+}
+
+// The subformat a conversion writes: the requested one, or the format's default
+func resolveSubformat(format, subformat string) string {
+	if subformat == "" && len(formatSubformats[format]) > 0 {
+		return formatSubformats[format][0]
+	}
+	return subformat
+}
+
+// Check a requested subformat against those the format offers
+func checkSubformat(format, subformat string) *APIError {
+	if subformat == "" {
+		return nil
+	}
+	offered := formatSubformats[format]
+	for _, s := range offered {
+		if s == subformat {
+			return nil
+		}
+	}
+	if len(offered) == 0 {
+		return &APIError{Code: errCodeUnsupportedFormat,
+			Message:     fmt.Sprintf(tr("Format %s has no subformats"), format),
+			Remediation: "Leave out 'subformat'; subformats apply to vpc, vhdx and vmdk."}
+	}
+	return &APIError{Code: errCodeUnsupportedFormat,
+		Message:     fmt.Sprintf(tr("Unsupported %s subformat: %s"), format, subformat),
+		Remediation: fmt.Sprintf(tr("Use one of %s."), strings.Join(offered, ", "))}
+}
+
+// The qemu-img -o options writing a subformat
+func subformatOptions(format, subformat string) []string {
+	subformat = resolveSubformat(format, subformat)
+	if subformat == "" {
+		return nil
+	}
+	options := []string{"subformat=" + subformat}
+	if format == "vpc" && subformat == "fixed" {
+		// Keep the exact virtual size rather than rounding it to a CHS geometry;
+		// Azure rejects VHDs whose size isn't a whole number of MB
+		options = append(options, "force_size=on")
+	}
+	return options
+}
+
+// The file extension users expect for a qemu-img output format
+func convertedExtension(format string) string {
+	if format == "vpc" {
+		return "vhd" // Use VHD extension for VPC format
+	}
+	return format // For raw, qcow2, vhdx and vmdk, use the format name directly
+}
+
+// The formats users may choose on this instance
+func allowedFormats() []string {
+	if len(config.AllowedFormats) == 0 {
+		return supportedFormatOrder
+	}
+	return config.AllowedFormats
+}
+
+// Check a requested conversion format against the supported and allowed formats
+func checkFormat(format string) *APIError {
+	if !supportedFormats[format] {
+		return &APIError{Code: errCodeUnsupportedFormat,
+			Message:     fmt.Sprintf(tr("Unsupported conversion format: %s"), format),
+			Remediation: fmt.Sprintf(tr("Use one of %s."), strings.Join(allowedFormats(), ", "))}
+	}
+	for _, allowed := range allowedFormats() {
+		if allowed == format {
+			return nil
+		}
+	}
+	return &APIError{Code: errCodeUnsupportedFormat,
+		Message:     fmt.Sprintf(tr("Format %s is not allowed on this Porter instance"), format),
+		Remediation: fmt.Sprintf(tr("Use one of %s, or ask an administrator to change allowedFormats."), strings.Join(allowedFormats(), ", "))}
+}
+
+// Drop unknown formats from the config and make sure the default is allowed
+func (cfg *Config) validateFormats(path string) {
+	var allowed []string
+	for _, format := range cfg.AllowedFormats {
+		if supportedFormats[format] {
+			allowed = append(allowed, format)
+		} else {
+			fmt.Printf("Warning: ignoring unsupported format '%s' in allowedFormats of config %s\n", format, path)
+		}
+	}
+	cfg.AllowedFormats = allowed
+
+	if !supportedFormats[cfg.DefaultFormat] {
+		fmt.Printf("Warning: unsupported defaultFormat '%s' in config %s (using raw)\n", cfg.DefaultFormat, path)
+		cfg.DefaultFormat = "raw"
+	}
+	if len(allowed) > 0 {
+		for _, format := range allowed {
+			if format == cfg.DefaultFormat {
+				return
+			}
+		}
+		cfg.DefaultFormat = allowed[0]
+	}
+}
+
+// A choice in the format picker
+type FormatOption struct {
+	Value    string
+	Label    string
+	Selected bool
+}
+
+// The format picker's options, with the instance default selected
+func (d UIData) Formats() []FormatOption {
+	var options []FormatOption
+	for _, format := range allowedFormats() {
+		options = append(options, FormatOption{Value: format, Label: formatLabels[format], Selected: format == config.DefaultFormat})
+	}
+	return options
+}
+
+// A choice in the subformat picker, shown for its format only
+type SubformatOption struct {
+	Format string
+	Value  string
+}
+
+// The subformat picker's options for the formats users may choose
+func (d UIData) Subformats() []SubformatOption {
+	var options []SubformatOption
+	for _, format := range allowedFormats() {
+		for _, subformat := range formatSubformats[format] {
+			options = append(options, SubformatOption{Format: format, Value: subformat})
+		}
+	}
+	return options
+}
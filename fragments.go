@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Page fragments: the parts of the page that change on their own (file lists,
+// job status, provider panels) are named templates in simple_template.html that
+// can be re-rendered from GET /ui/fragments/{name} without building the whole
+// page, so refreshing one doesn't repeat the slow cloud CLI calls another needs.
+// The full page renders the same templates. Fragments are HTML, to swap into
+// the element with a matching data-fragment attribute (htmx's hx-get works the
+// same way), or their data as JSON for clients that send Accept: application/json.
+
+type pageFragment struct {
+	// The data the fragment's template needs, and only that
+	load func(r *http.Request) UIData
+	// The same data for JSON clients
+	json func(d UIData) interface{}
+}
+
+var pageFragments = map[string]pageFragment{
+	"vmdk-list": {
+		load: func(*http.Request) UIData { return UIData{VMDKs: findExistingVMDKs()} },
+		json: func(d UIData) interface{} { return map[string][]string{"vmdks": listOrEmpty(d.VMDKs)} },
+	},
+	"upload-files": {
+		load: func(*http.Request) UIData { return UIData{ConvertedFiles: findExistingConvertedFiles()} },
+		json: func(d UIData) interface{} { return map[string][]string{"files": listOrEmpty(d.ConvertedFiles)} },
+	},
+	"destination-profiles": {
+		load: func(*http.Request) UIData { return UIData{DestinationProfiles: config.Destinations} },
+		json: func(d UIData) interface{} {
+			profiles := d.DestinationProfiles
+			if profiles == nil {
+				profiles = map[string]DestinationProfile{}
+			}
+			return map[string]map[string]DestinationProfile{"profiles": profiles}
+		},
+	},
+	// Runs the Azure CLI, so it is only loaded once Azure is chosen, and a slow
+	// or failing CLI renders as a message in the list rather than an error
+	"azure-accounts": {
+		load: func(r *http.Request) UIData {
+			accounts, err := listAzureAccounts(r.Context())
+			if err != nil {
+				return UIData{AzureAccountsError: err.Error()}
+			}
+			return UIData{AzureAccounts: listOrEmpty(accounts)}
+		},
+		json: func(d UIData) interface{} {
+			return map[string]interface{}{"accounts": listOrEmpty(d.AzureAccounts), "error": d.AzureAccountsError}
+		},
+	},
+	"job-status": {
+		load: func(*http.Request) UIData { return UIData{Jobs: jobs.list()} },
+		json: func(d UIData) interface{} { return map[string][]*Job{"jobs": listOrEmptyJobs(d.Jobs)} },
+	},
+}
+
+// The page data every full render needs: status, tool availability and profiles.
+// Cloud listings are left to their fragments.
+func newUIData(message string) UIData {
+	return UIData{
+		Message:         message,
+		QemuAvailable:   imageTools().available(),
+		AwsCliAvailable: mocked("aws") || checkBinary("aws"),
+		AzCliAvailable:  mocked("azure") || checkBinary("az"),
+		DockerNotice:    dockerNotice(),
+
+		DestinationProfiles: config.Destinations,
+		Jobs:                jobs.list(),
+		BandwidthClasses:    config.BandwidthClasses.names(),
+		UploadKey:           newID(),
+	}
+}
+
+// Handler for GET /ui/fragments/{name}
+func fragmentHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	fragment, ok := pageFragments[name]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown page fragment: %s"), name)})
+		return
+	}
+	data := fragment.load(r)
+	w.Header().Set("Vary", "Accept")
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, fragment.json(data))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := templates.ExecuteTemplate(w, name, data); err != nil {
+		fmt.Printf("Error rendering fragment %s: %s\n", name, err)
+	}
+}
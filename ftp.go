@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FTP and FTPS servers, for appliance workflows that still expect an FTP drop-off,
+// through curl. ftp:// URLs switch to TLS when the server offers it (explicit
+// FTPS) and ftps:// URLs use implicit TLS; set FTP_INSECURE=1 to accept a
+// self-signed certificate. Credentials come from the ftp destination profile
+// whose url the server is under, or FTP_USERNAME and FTP_PASSWORD (anonymous
+// if neither is set).
+//
+// Files are uploaded under a temporary .part name that identifies the local
+// file's size and modification time, and renamed once complete. A failed
+// transfer is resumed from what the server already has, up to ftpUploadAttempts
+// times, and a later upload of the same file (a job rerun) resumes the .part an
+// interrupted one left behind.
+
+const ftpUploadAttempts = 5
+
+func ftpCredentials(rawURL string) (string, string) {
+	if user, pass, ok := profileCredentials("ftp", rawURL); ok {
+		return user, pass
+	}
+	return os.Getenv("FTP_USERNAME"), os.Getenv("FTP_PASSWORD")
+}
+
+// Join a server URL and a slash-separated path, escaping each segment
+func ftpURL(server, p string) string {
+	u := strings.TrimRight(server, "/")
+	for _, segment := range strings.Split(strings.Trim(p, "/"), "/") {
+		if segment != "" {
+			u += "/" + url.PathEscape(segment)
+		}
+	}
+	return u
+}
+
+// A curl command for an FTP URL. The credentials are passed in a config file
+// rather than on the command line, where other processes could see them; the
+// returned function removes it.
+func ftpCommand(ctx context.Context, rawURL string, args ...string) (*exec.Cmd, func(), error) {
+	cleanup := func() {}
+	base := []string{"--silent", "--show-error", "--ftp-pasv"}
+	if strings.HasPrefix(rawURL, "ftp://") {
+		base = append(base, "--ssl")
+	}
+	if os.Getenv("FTP_INSECURE") == "1" {
+		base = append(base, "--insecure")
+	}
+	if user, pass := ftpCredentials(rawURL); user != "" {
+		f, err := os.CreateTemp("", "porter-ftp-*.conf")
+		if err != nil {
+			return nil, nil, err
+		}
+		quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+		_, err = fmt.Fprintf(f, "user = \"%s:%s\"\n", quote.Replace(user), quote.Replace(pass))
+		f.Close()
+		cleanup = func() { os.Remove(f.Name()) }
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		base = append(base, "--config", f.Name())
+	}
+	return toolCommand(ctx, "curl", append(append(base, args...), rawURL)...), cleanup, nil
+}
+
+// Run a curl command for an FTP URL, returning its output
+func ftpOutput(ctx context.Context, rawURL string, args ...string) ([]byte, error) {
+	cmd, cleanup, err := ftpCommand(ctx, rawURL, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// The size of a file on the server, 0 if it doesn't exist
+func ftpRemoteSize(ctx context.Context, rawURL string) int64 {
+	out, err := ftpOutput(ctx, rawURL, "--head")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "Content-Length: "); ok {
+			size, _ := strconv.ParseInt(value, 10, 64)
+			return size
+		}
+	}
+	return 0
+}
+
+// Split an FTP file URL into its folder URL (with a trailing slash) and name
+func splitFTPURL(rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "ftp" && u.Scheme != "ftps") || u.Host == "" || u.Path == "" {
+		return "", "", fmt.Errorf("invalid FTP URL '%s'", rawURL)
+	}
+	i := strings.LastIndex(rawURL, "/")
+	return rawURL[:i+1], path.Base(u.Path), nil
+}
+
+// Upload one file to a folder on an FTP server, returning its URL
+func uploadToFTP(job *Job, s uploadSettings, file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	name := filepath.Base(file)
+	dest := ftpURL(s.URL, path.Join(s.Target, name))
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())))
+	partName := fmt.Sprintf("%s.%x.part", name, sum[:4])
+	part := ftpURL(s.URL, path.Join(s.Target, partName))
+	job.setStatus("Uploading %s to FTP: %s (%.2f MB)",
+		name, dest, float64(info.Size())/(1024*1024))
+
+	for attempt := 1; ; attempt++ {
+		offset := ftpRemoteSize(job.ctx, part)
+		if offset > info.Size() {
+			offset = 0
+		}
+		if offset > 0 {
+			job.logf("Resuming %s at %.2f of %.2f MB", partName,
+				float64(offset)/(1024*1024), float64(info.Size())/(1024*1024))
+		}
+		if _, err = f.Seek(offset, io.SeekStart); err != nil {
+			return "", err
+		}
+		args := []string{"--ftp-create-dirs", "--upload-file", "-"}
+		if offset > 0 {
+			args = append(args, "--append")
+		}
+		var cmd *exec.Cmd
+		var cleanup func()
+		cmd, cleanup, err = ftpCommand(job.ctx, part, args...)
+		if err != nil {
+			return "", err
+		}
+		cmd.Stdin = &jobReader{job: job, r: f}
+		err = runJobCommand(job, cmd)
+		cleanup()
+		if err == nil || job.ctx.Err() != nil || attempt == ftpUploadAttempts {
+			break
+		}
+		job.logf("FTP transfer of %s interrupted (%s); retrying (attempt %d of %d)", name, err, attempt+1, ftpUploadAttempts)
+	}
+	if err != nil {
+		return "", fmt.Errorf("FTP upload failed for %s: %w", file, err)
+	}
+	if size := ftpRemoteSize(job.ctx, part); size != info.Size() {
+		return "", fmt.Errorf("FTP upload of %s incomplete: the server has %d of %d bytes", file, size, info.Size())
+	}
+
+	// Replace any earlier upload, then move the complete file into place
+	folder, _, err := splitFTPURL(dest)
+	if err != nil {
+		return "", err
+	}
+	if _, err := ftpOutput(job.ctx, folder, "--list-only",
+		"--quote", "*DELE "+name, "--quote", "RNFR "+partName, "--quote", "RNTO "+name); err != nil {
+		return "", fmt.Errorf("renaming %s to %s failed: %w", partName, name, err)
+	}
+	return dest, nil
+}
+
+func deleteFTPFile(rawURL string) error {
+	folder, name, err := splitFTPURL(rawURL)
+	if err != nil {
+		return err
+	}
+	_, err = ftpOutput(context.Background(), folder, "--list-only", "--quote", "DELE "+name)
+	return err
+}
+
+// List the files in a folder on an FTP server, from Unix-style or IIS (DOS-style)
+// LIST output
+func listFTPObjects(ctx context.Context, server, prefix string) ([]DestinationObject, error) {
+	out, err := ftpOutput(ctx, ftpURL(server, prefix)+"/")
+	if err != nil {
+		return nil, fmt.Errorf("listing %s failed: %w", prefix, err)
+	}
+	var objects []DestinationObject
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		var size, modified, name string
+		switch {
+		// -rw-r--r-- 1 owner group 1234 Jan 02 15:04 name
+		case len(fields) >= 9 && strings.HasPrefix(fields[0], "-"):
+			size, modified = fields[4], strings.Join(fields[5:8], " ")
+			name = strings.Join(fields[8:], " ")
+		// 01-02-06  03:04PM  1234 name
+		case len(fields) >= 4 && fields[2] != "<DIR>":
+			size, modified = fields[2], fields[0]+" "+fields[1]
+			name = strings.Join(fields[3:], " ")
+		default:
+			continue
+		}
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			continue
+		}
+		objects = append(objects, DestinationObject{Name: path.Join(prefix, name), Size: n, LastModified: modified})
+	}
+	return objects, nil
+}
+
+// Confirm some FTP server is configured and reachable
+func checkFTPCredentials(ctx context.Context) error {
+	server := os.Getenv("FTP_URL")
+	if server == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "ftp" && profile.URL != "" {
+				server = profile.URL
+				break
+			}
+		}
+	}
+	if server == "" {
+		return errors.New("no FTP server configured; set FTP_URL or add an ftp destination profile")
+	}
+	_, err := listFTPObjects(ctx, server, "")
+	return err
+}
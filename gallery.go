@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Azure Compute Gallery publishing: with gallery set, the Azure image (or
+// Trusted Launch OS disk) created from a job's first disk, or the managed disk
+// it was uploaded to, is published as a version of an existing image
+// definition and replicated to targetRegions, for organizations that share
+// images through galleries. gallery is gallery/definition in the job's
+// resource group, or resourceGroup/gallery/definition. The definition must
+// suit the disk: the same Hyper-V generation and architecture, and Trusted
+// Launch for VMs with Secure Boot or a TPM. An image version holds the VM's OS disk, so a job's
+// other disks are uploaded as usual but not published.
+
+// Gallery image versions are major.minor.patch
+var galleryVersionPattern = regexp.MustCompile(`^\d+\.\d+\.\d+$`)
+
+type azureGallery struct {
+	ResourceGroup string
+	Gallery       string
+	Definition    string
+}
+
+// Parse gallery/definition or resourceGroup/gallery/definition
+func parseAzureGallery(value, resourceGroup string) (azureGallery, bool) {
+	parts := strings.Split(value, "/")
+	if len(parts) == 2 {
+		parts = append([]string{resourceGroup}, parts...)
+	}
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return azureGallery{}, false
+	}
+	return azureGallery{ResourceGroup: parts[0], Gallery: parts[1], Definition: parts[2]}, true
+}
+
+// The version to publish: version, else one from the job's creation time
+// (e.g. 2026.1015.134205)
+func galleryVersion(s uploadSettings, created time.Time) string {
+	if s.Version != "" {
+		return s.Version
+	}
+	t := created.UTC()
+	return fmt.Sprintf("%d.%d.%d", t.Year(), int(t.Month())*100+t.Day(), t.Hour()*10000+t.Minute()*100+t.Second())
+}
+
+// Publish what a job made from one of its files to the gallery, returning the
+// image version's ID, or "" for files after the first. source is the managed
+// disk's ID for azuredisk jobs, else the name of the Azure image or disk.
+func publishToGallery(job *Job, s uploadSettings, index int, file, source string, p vmPlatform) (string, error) {
+	g, _ := parseAzureGallery(s.Gallery, s.ResourceGroup)
+	if index > 0 {
+		job.logf("%s is not published to %s/%s: an image version holds the VM's OS disk, the job's first", file, g.Gallery, g.Definition)
+		return "", nil
+	}
+	version := galleryVersion(s, job.CreatedAt)
+	var subscription []string
+	if s.Subscription != "" {
+		subscription = []string{"--subscription", s.Subscription}
+	}
+	common := append([]string{"--resource-group", g.ResourceGroup, "--gallery-name", g.Gallery, "--gallery-image-definition", g.Definition}, subscription...)
+	job.setStatus("Publishing %s to Azure Compute Gallery %s as %s version %s", source, g.Gallery, g.Definition, version)
+	if mocked(s.Cloud) {
+		id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/galleries/%s/images/%s/versions/%s",
+			mockSubscription, g.ResourceGroup, g.Gallery, g.Definition, version)
+		if err := mockImport(job, "Azure gallery image version", version, "the replication of "+g.Definition+" "+version); err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+
+	out, err := azOutput(job.ctx, append(append([]string{"sig", "image-definition", "show"}, common...),
+		"--query", "{generation: hyperVGeneration, architecture: architecture, features: features}", "--output", "json")...)
+	if err != nil {
+		return "", fmt.Errorf("image definition %s/%s not found (create it first with az sig image-definition create): %w", g.Gallery, g.Definition, err)
+	}
+	var definition struct {
+		Generation   string `json:"generation"`
+		Architecture string `json:"architecture"`
+		Features     []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"features"`
+	}
+	json.Unmarshal([]byte(out), &definition)
+	if generation := fmt.Sprintf("V%d", p.Generation); definition.Generation != "" && definition.Generation != generation {
+		return "", fmt.Errorf("image definition %s is for generation %s VMs and %s needs %s; publish it to a %s definition", g.Definition, definition.Generation, file, generation, generation)
+	}
+	if arch := archName(guestArch(job, file), [2]string{"x64", "Arm64"}); definition.Architecture != "" && !strings.EqualFold(definition.Architecture, arch) {
+		return "", fmt.Errorf("image definition %s is for %s VMs and %s is %s; publish it to an %s definition", g.Definition, definition.Architecture, file, arch, arch)
+	}
+	if p.SecureBoot || p.TPM {
+		trusted := false
+		for _, feature := range definition.Features {
+			trusted = trusted || (feature.Name == "SecurityType" && strings.HasPrefix(feature.Value, "TrustedLaunch"))
+		}
+		if !trusted {
+			return "", fmt.Errorf("image definition %s is not for Trusted Launch and %s needs Secure Boot or a TPM; publish it to a definition with --features SecurityType=TrustedLaunch", g.Definition, file)
+		}
+	}
+
+	args := append(append([]string{"sig", "image-version", "create"}, common...), "--gallery-image-version", version)
+	switch {
+	case s.Cloud == "azuredisk":
+		args = append(args, "--os-snapshot", source)
+	case p.SecureBoot || p.TPM:
+		id, err := azOutput(job.ctx, append([]string{"disk", "show", "--name", source, "--resource-group", s.ResourceGroup, "--query", "id", "--output", "tsv"}, subscription...)...)
+		if err != nil {
+			return "", fmt.Errorf("finding disk %s failed: %w", source, err)
+		}
+		args = append(args, "--os-snapshot", id)
+	default:
+		id, err := azOutput(job.ctx, append([]string{"image", "show", "--name", source, "--resource-group", s.ResourceGroup, "--query", "id", "--output", "tsv"}, subscription...)...)
+		if err != nil {
+			return "", fmt.Errorf("finding image %s failed: %w", source, err)
+		}
+		args = append(args, "--managed-image", id)
+	}
+	if len(s.TargetRegions) > 0 {
+		args = append(append(args, "--target-regions"), s.TargetRegions...)
+	}
+	if len(s.Tags) > 0 {
+		args = append(append(args, "--tags"), keyValuePairs(s.Tags)...)
+	}
+	// Replication takes a while; its progress across the regions shows in the job
+	show := func(args ...string) []string {
+		return append(append([]string{"sig", "image-version", "show", "--gallery-image-version", version}, common...), args...)
+	}
+	task := CloudTask{Kind: "Azure gallery image version", ID: g.Definition + " " + version, Status: "Submitting"}
+	poll := func(t *CloudTask) error {
+		out, err := azOutput(job.ctx, show("--expand", "ReplicationStatus",
+			"--query", "{state: provisioningState, progress: replicationStatus.summary[].progress}", "--output", "json")...)
+		if err != nil {
+			return err
+		}
+		var status struct {
+			State    string `json:"state"`
+			Progress []int  `json:"progress"`
+		}
+		if err := json.Unmarshal([]byte(out), &status); err != nil {
+			return err
+		}
+		t.Status = status.State
+		if len(status.Progress) > 0 {
+			total := 0
+			for _, progress := range status.Progress {
+				total += progress
+			}
+			t.Percentage = total / len(status.Progress)
+		}
+		return nil
+	}
+	if err := runCloudTaskCommand(job, toolCommand(job.ctx, "az", args...), task, poll); err != nil {
+		return "", fmt.Errorf("publishing %s to Azure Compute Gallery %s failed: %w", source, g.Gallery, err)
+	}
+	id, err := azOutput(job.ctx, show("--query", "id", "--output", "tsv")...)
+	if err != nil {
+		return "", err
+	}
+	job.logf("Published %s as %s version %s in gallery %s", source, g.Definition, version, g.Gallery)
+	return id, nil
+}
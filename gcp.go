@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// How long gcloud lets an image import run; translating large disks takes hours
+const gceImageImportTimeout = "6h"
+
+// Google Cloud Storage classes offered for uploads and new buckets
+var gcsStorageClasses = []string{"STANDARD", "NEARLINE", "COLDLINE"}
+
+// Normalize a storage class name ("nearline" → "NEARLINE"), reporting whether it is offered
+func gcsStorageClass(class string) (string, bool) {
+	class = strings.ToUpper(strings.TrimSpace(class))
+	for _, c := range gcsStorageClasses {
+		if c == class {
+			return c, true
+		}
+	}
+	return class, false
+}
+
+// Upload one file to Google Cloud Storage, returning the gs:// URI it was written to
+func uploadToGCP(job *Job, s uploadSettings, file string) (string, error) {
+	gsURI := "gs://" + s.Bucket
+	if s.Target != "" {
+		gsURI += "/" + strings.Trim(s.Target, "/")
+	}
+	gsURI += "/" + filepath.Base(file)
+
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Uploading %s to Google Cloud Storage: %s (%.2f MB)",
+		filepath.Base(file), gsURI, float64(fileInfo.Size())/(1024*1024))
+
+	// GCS objects have no tags, so profile tags are stored as custom metadata too
+	args := []string{"storage", "cp", "--no-user-output-enabled"}
+	if s.StorageClass != "" {
+		args = append(args, "--storage-class", s.StorageClass)
+	}
+	metadata := map[string]string{}
+	for k, v := range s.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range s.Tags {
+		metadata[k] = v
+	}
+	if len(metadata) > 0 {
+		args = append(args, "--custom-metadata", strings.Join(keyValuePairs(metadata), ","))
+	}
+	cmd := toolCommand(job.ctx, "gcloud", append(args, file, gsURI)...)
+
+	// gcloud resumes interrupted uploads itself and leaves nothing billable behind
+	if err := runJobCommand(job, cmd); err != nil {
+		return "", fmt.Errorf("GCP upload failed for %s: %w", file, err)
+	}
+	return gsURI, nil
+}
+
+// Create a Compute Engine image from an uploaded disk with gcloud compute images
+// import, which boots the disk in a temporary VM to install the guest environment
+// and drivers for osName, so the image is bootable on GCE. Returns the image name.
+func createGCEImage(job *Job, s uploadSettings, gsURI string) (string, error) {
+	name := imageResourceName(job, gsURI)
+	args := []string{"compute", "images", "import", name,
+		"--source-file", gsURI,
+		"--os", s.OSName,
+		"--description", "Imported by Porter job " + job.ID + " from " + gsURI,
+		"--timeout", gceImageImportTimeout,
+		"--quiet"}
+	if s.Region != "" {
+		args = append(args, "--storage-location", s.Region)
+	}
+	job.setStatus("Creating Compute Engine image %s from %s (this can take an hour or more)", name, gsURI)
+	if err := runJobCommand(job, toolCommand(job.ctx, "gcloud", args...)); err != nil {
+		return "", fmt.Errorf("creating Compute Engine image %s from %s failed: %w", name, gsURI, err)
+	}
+	job.logf("Compute Engine image %s is ready", name)
+	return name, nil
+}
+
+// List objects under a prefix in a GCS bucket
+func listGCSObjects(ctx context.Context, bucket, prefix string) ([]DestinationObject, error) {
+	out, err := toolCommand(ctx, "gcloud", "storage", "objects", "list", "gs://"+bucket+"/"+prefix+"**",
+		"--format=json(name,size,update_time)").Output()
+	if err != nil {
+		return nil, fmt.Errorf("gcloud storage objects list failed: %w", err)
+	}
+	var listed []struct {
+		Name       string `json:"name"`
+		Size       int64  `json:"size,string"`
+		UpdateTime string `json:"update_time"`
+	}
+	if err := json.Unmarshal(out, &listed); err != nil {
+		return nil, fmt.Errorf("failed to parse GCS listing: %w", err)
+	}
+	var objects []DestinationObject
+	for _, o := range listed {
+		objects = append(objects, DestinationObject{Name: o.Name, Size: o.Size, LastModified: o.UpdateTime})
+	}
+	return objects, nil
+}
+
+func checkGCPCredentials(ctx context.Context) error {
+	return runQuiet(toolCommand(ctx, "gcloud", "auth", "print-access-token", "--quiet"))
+}
+
+// GCS bucket locations: the multi-regions, then the project's Compute Engine regions
+func listGCPLocations(ctx context.Context) ([]string, error) {
+	locations := []string{"US", "EU", "ASIA"}
+	out, err := toolCommand(ctx, "gcloud", "compute", "regions", "list", "--format=value(name)").Output()
+	if err != nil {
+		return locations, err
+	}
+	return append(locations, strings.Fields(string(out))...), nil
+}
+
+// Handler to fetch GCS buckets dynamically, with their location and default storage class
+func gcpBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := providerOutput(r.Context(), "gcp", "gcloud", "storage", "buckets", "list",
+		"--format=json(name,location,default_storage_class)")
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list GCS buckets",
+			Remediation: "Check that the gcloud CLI is installed, ~/.config/gcloud credentials are mounted and a default project is set."})
+		return
+	}
+	type bucket struct {
+		Name         string `json:"name"`
+		Location     string `json:"location"`
+		StorageClass string `json:"default_storage_class"`
+	}
+	var listed []bucket
+	if err := json.Unmarshal(out, &listed); err != nil {
+		writeAPIError(w, http.StatusBadGateway, APIError{Code: errCodeProviderFailed,
+			Message: "Failed to parse GCS bucket listing", Details: err.Error()})
+		return
+	}
+	var buckets []string
+	details := map[string]bucket{}
+	for _, b := range listed {
+		buckets = append(buckets, b.Name)
+		details[b.Name] = b
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"buckets":        listOrEmpty(buckets),
+		"details":        details,
+		"storageClasses": gcsStorageClasses,
+	})
+}
+
+// Handler for POST /gcp/buckets: create a bucket in a chosen location and default storage class
+func gcpCreateBucketHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name         string `json:"name"`
+		Location     string `json:"location"`
+		StorageClass string `json:"storageClass"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Invalid JSON body", Details: err.Error()})
+		return
+	}
+	if body.Name == "" || body.Location == "" {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "A bucket needs a name and a location", Remediation: "Pass 'name' and 'location' (e.g. EU or europe-west2)."})
+		return
+	}
+	class := "STANDARD"
+	if body.StorageClass != "" {
+		var ok bool
+		if class, ok = gcsStorageClass(body.StorageClass); !ok {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Unsupported storage class: %s"), body.StorageClass), Remediation: fmt.Sprintf(tr("Use one of %s."), strings.Join(gcsStorageClasses, ", "))})
+			return
+		}
+	}
+
+	out, err := toolCommand(context.Background(), "gcloud", "storage", "buckets", "create", "gs://"+body.Name,
+		"--location", body.Location, "--default-storage-class", class, "--uniform-bucket-level-access").CombinedOutput()
+	if err != nil {
+		writeAPIError(w, http.StatusBadGateway, APIError{Code: errCodeProviderFailed,
+			Message: fmt.Sprintf(tr("Failed to create bucket %s"), body.Name), Details: err.Error() + ": " + strings.TrimSpace(string(out)),
+			Remediation: "Bucket names are global: pick another name if it is taken, and check the location is valid."})
+		return
+	}
+	fmt.Printf("Created GCS bucket gs://%s in %s (%s)\n", body.Name, body.Location, class)
+	writeJSON(w, http.StatusCreated, map[string]string{"name": body.Name, "location": body.Location, "storageClass": class})
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Optional guest modification steps for pipeline jobs. They run against each
+// converted image with libguestfs' virt-customize, after conversion and before
+// upload, so the migrated VM needs less fixing by hand at the destination.
+type guestStep struct {
+	Description string
+	// virt-customize arguments implementing the step for a job and the inspected
+	// guest, or nil if the step does not apply to it
+	args func(job *Job, guest guestOS) ([]string, error)
+	// Optional work virt-customize cannot do, run on the image afterwards
+	after func(job *Job, guest guestOS, image, format string) error
+}
+
+var guestSteps = map[string]guestStep{
+	"reset-network": {
+		Description: "Remove persistent NIC naming, static IP configuration and stale DHCP leases (Linux guests)",
+		args: func(job *Job, guest guestOS) ([]string, error) {
+			if guest.Name != "linux" {
+				return nil, nil
+			}
+			return []string{
+				"--delete", "/etc/udev/rules.d/70-persistent-net.rules",
+				"--delete", "/etc/udev/rules.d/75-persistent-net-generator.rules",
+				"--run-command", resetNetworkScript,
+			}, nil
+		},
+	},
+	"remove-vmware-tools": {
+		Description: "Uninstall VMware Tools / open-vm-tools (Linux now, Windows at first boot)",
+		args: func(job *Job, guest guestOS) ([]string, error) {
+			switch guest.Name {
+			case "linux":
+				return []string{"--run-command", removeVMwareToolsLinuxScript}, nil
+			case "windows":
+				return []string{"--firstboot-command", removeVMwareToolsWindowsCommand}, nil
+			}
+			return nil, nil
+		},
+	},
+	"install-cloud-agent": {
+		Description: "Stage the destination cloud's guest agent (waagent, cloud-init, google-guest-agent) to install at first boot",
+		args:        cloudAgentArgs,
+	},
+	"inject-virtio": {
+		Description: "Stage virtio-win storage and network drivers in Windows guests so they boot on KVM without virt-v2v",
+		args:        virtioArgs,
+		after:       mergeVirtioRegistry,
+	},
+}
+
+// Add the guest hooks defined in porter.json as steps
+func registerGuestHooks() {
+	for name, hook := range config.GuestHooks {
+		if _, exists := guestSteps[name]; exists {
+			fmt.Printf("Warning: guest hook '%s' has the name of a built-in step (ignoring it)\n", name)
+			continue
+		}
+		hook := hook
+		guestSteps[name] = guestStep{
+			Description: hook.Description,
+			args: func(job *Job, guest guestOS) ([]string, error) {
+				if hook.OS != "" && hook.OS != guest.Name {
+					return nil, nil
+				}
+				if hook.FirstBoot {
+					return []string{"--firstboot", hook.Script}, nil
+				}
+				return []string{"--run", hook.Script}, nil
+			},
+		}
+	}
+}
+
+// A site-specific guest step: a script run inside the guest by virt-customize,
+// either now (Linux guests) or at the VM's first boot
+type GuestHook struct {
+	Description string `json:"description"`
+	Script      string `json:"script"`
+	FirstBoot   bool   `json:"firstBoot,omitempty"`
+	// Only run for this guest OS ("linux" or "windows"); empty runs for both
+	OS string `json:"os,omitempty"`
+}
+
+// The operating system in an image, as reported by virt-inspector
+type guestOS struct {
+	Name          string `xml:"name" json:"name"`
+	Distro        string `xml:"distro" json:"distro,omitempty"`
+	ProductName   string `xml:"product_name" json:"productName,omitempty"`
+	MajorVersion  int    `xml:"major_version" json:"majorVersion,omitempty"`
+	MinorVersion  int    `xml:"minor_version" json:"minorVersion,omitempty"`
+	Arch          string `xml:"arch" json:"arch,omitempty"`
+	PackageFormat string `xml:"package_format" json:"packageFormat,omitempty"`
+	Mountpoints   []struct {
+		Device string `xml:"dev,attr"`
+		Path   string `xml:",chardata"`
+	} `xml:"mountpoints>mountpoint" json:"-"`
+}
+
+// Whether the guest mounts a filesystem at path (Linux guests)
+func (g guestOS) mounts(path string) bool {
+	for _, m := range g.Mountpoints {
+		if m.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Returned when virt-inspector finds no operating system, as on data disks
+var errNoGuestOS = errors.New("no operating system found")
+
+// Inspect the (first) operating system in an image
+func inspectGuestOS(ctx context.Context, image, format string) (guestOS, error) {
+	cmd := toolCommand(ctx, "virt-inspector", "-a", image, "--format", format, "--no-applications", "--no-icon")
+	out, err := cmd.Output()
+	if err != nil {
+		return guestOS{}, fmt.Errorf("virt-inspector failed for %s: %w", image, err)
+	}
+	var doc struct {
+		OperatingSystems []guestOS `xml:"operatingsystem"`
+	}
+	if err := xml.Unmarshal(out, &doc); err != nil {
+		return guestOS{}, fmt.Errorf("unexpected virt-inspector output: %w", err)
+	}
+	if len(doc.OperatingSystems) == 0 {
+		return guestOS{}, fmt.Errorf("%w in %s", errNoGuestOS, image)
+	}
+	return doc.OperatingSystems[0], nil
+}
+
+// Switch every interface to DHCP and forget the source network. Handles ifcfg
+// (RHEL family), /etc/network/interfaces (Debian), netplan and NetworkManager.
+const resetNetworkScript = `set -e
+for f in /etc/sysconfig/network-scripts/ifcfg-*; do
+  [ -f "$f" ] || continue
+  case "$f" in */ifcfg-lo) continue ;; esac
+  sed -i -e '/^HWADDR=/d' -e '/^MACADDR=/d' -e '/^UUID=/d' -e '/^IPADDR[0-9]*=/d' \
+    -e '/^NETMASK[0-9]*=/d' -e '/^PREFIX[0-9]*=/d' -e '/^GATEWAY=/d' -e '/^DNS[0-9]*=/d' \
+    -e 's/^BOOTPROTO=.*/BOOTPROTO=dhcp/' "$f"
+done
+if [ -f /etc/network/interfaces ]; then
+  sed -i -e 's/^\(iface [^ ]* inet\) static/\1 dhcp/' \
+    -e '/^[[:space:]]*\(address\|netmask\|gateway\|network\|broadcast\|dns-nameservers\)[[:space:]]/d' /etc/network/interfaces
+fi
+if [ -d /etc/netplan ] && ls /etc/netplan/*.yaml >/dev/null 2>&1; then
+  mkdir -p /etc/netplan/porter-backup
+  mv /etc/netplan/*.yaml /etc/netplan/porter-backup/
+  printf 'network:\n  version: 2\n  ethernets:\n    all:\n      match:\n        name: "e*"\n      dhcp4: true\n' > /etc/netplan/50-porter-dhcp.yaml
+fi
+rm -f /etc/NetworkManager/system-connections/*.nmconnection /etc/NetworkManager/system-connections/*.nmconnection~
+rm -f /var/lib/dhcp/*.leases /var/lib/dhclient/*.lease* /var/lib/NetworkManager/*.lease /var/lib/NetworkManager/dhclient-*
+`
+
+func guestStepNames() []string {
+	var names []string
+	for name := range guestSteps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Handler for /api/guest-steps: the guest steps jobs can request
+func guestStepsHandler(w http.ResponseWriter, r *http.Request) {
+	type stepInfo struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	var steps []stepInfo
+	for _, name := range guestStepNames() {
+		steps = append(steps, stepInfo{Name: name, Description: guestSteps[name].Description})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"steps":     steps,
+		"available": checkBinary("virt-customize"),
+	})
+}
+
+// Check the requested guest steps exist and can run
+func checkGuestSteps(steps []string) *APIError {
+	for _, name := range steps {
+		if _, ok := guestSteps[name]; !ok {
+			return &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Unknown guest step: %s"), name),
+				Remediation: fmt.Sprintf(tr("Use one of %s."), strings.Join(guestStepNames(), ", "))}
+		}
+	}
+	if len(steps) > 0 && !checkBinary("virt-customize") {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message:     "Guest steps need virt-customize, which is not installed",
+			Remediation: "Install libguestfs-tools in the Porter image, or remove guestSteps from the job."}
+	}
+	return nil
+}
+
+// Apply a job's guest steps to one converted image, in the order requested
+func runGuestSteps(job *Job, image, format string) error {
+	job.setStatus("Inspecting guest in %s", filepath.Base(image))
+	guest, err := inspectGuestOS(job.ctx, image, format)
+	if err != nil {
+		return err
+	}
+	job.logf("Found %s guest: %s", guest.Name, guest.ProductName)
+
+	args := []string{"-a", image, "--format", format}
+	var applied []string
+	for _, name := range job.Spec.GuestSteps {
+		stepArgs, err := guestSteps[name].args(job, guest)
+		if err != nil {
+			return fmt.Errorf("guest step %s: %w", name, err)
+		}
+		if stepArgs == nil {
+			job.logf("Skipping guest step %s: not applicable to this %s guest", name, guest.Name)
+			continue
+		}
+		args = append(args, stepArgs...)
+		applied = append(applied, name)
+	}
+	if len(applied) == 0 {
+		return nil
+	}
+
+	job.setStatus("Customizing guest in %s: %s", filepath.Base(image), strings.Join(applied, ", "))
+	cmd := toolCommand(job.ctx, "virt-customize", args...)
+	if err := runJobCommand(job, cmd); err != nil {
+		return fmt.Errorf("guest customization of %s failed: %w", image, err)
+	}
+
+	for _, name := range applied {
+		if after := guestSteps[name].after; after != nil {
+			if err := after(job, guest, image, format); err != nil {
+				return fmt.Errorf("guest step %s: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Packages providing each cloud's guest agent, by package format. porter.json's
+// cloudAgentPackages replaces the list for a cloud.
+var defaultCloudAgentPackages = map[string]map[string][]string{
+	"aws":       {"deb": {"cloud-init"}, "rpm": {"cloud-init"}},
+	"azure":     {"deb": {"cloud-init", "walinuxagent"}, "rpm": {"cloud-init", "WALinuxAgent"}},
+	"azuredisk": {"deb": {"cloud-init", "walinuxagent"}, "rpm": {"cloud-init", "WALinuxAgent"}},
+	"gcp":       {"deb": {"google-guest-agent"}, "rpm": {"google-guest-agent"}},
+}
+
+// Install the destination's agent at first boot, when the VM has network access in
+// its new home. Windows agents are uploaded from windowsAgentInstallers and run then.
+func cloudAgentArgs(job *Job, guest guestOS) ([]string, error) {
+	cloud := job.settings.Cloud
+	switch guest.Name {
+	case "linux":
+		packages := config.CloudAgentPackages[cloud]
+		if packages == nil {
+			packages = defaultCloudAgentPackages[cloud][guest.PackageFormat]
+		}
+		if len(packages) == 0 {
+			return nil, nil
+		}
+		return []string{"--firstboot-install", strings.Join(packages, ",")}, nil
+	case "windows":
+		installer := config.WindowsAgentInstallers[cloud]
+		if installer == "" {
+			return nil, nil
+		}
+		staged := "/Porter/" + filepath.Base(installer)
+		command := `C:\Porter\` + filepath.Base(installer) + " /quiet /norestart"
+		if strings.HasSuffix(strings.ToLower(installer), ".msi") {
+			command = `msiexec.exe /i C:\Porter\` + filepath.Base(installer) + " /qn /norestart"
+		}
+		return []string{"--mkdir", "/Porter", "--upload", installer + ":" + staged, "--firstboot-command", command}, nil
+	}
+	return nil, nil
+}
+
+// Remove open-vm-tools or a tarball VMware Tools install, whichever is present
+const removeVMwareToolsLinuxScript = `if [ -x /usr/bin/vmware-uninstall-tools.pl ]; then /usr/bin/vmware-uninstall-tools.pl || true; fi
+if command -v dpkg >/dev/null 2>&1; then
+  pkgs=$(dpkg-query -W -f='${Package}\n' 'open-vm-tools*' 2>/dev/null || true)
+  [ -z "$pkgs" ] || DEBIAN_FRONTEND=noninteractive apt-get remove -y --purge $pkgs
+elif command -v rpm >/dev/null 2>&1; then
+  pkgs=$(rpm -qa 'open-vm-tools*')
+  [ -z "$pkgs" ] || rpm -e $pkgs
+fi
+`
+
+// VMware Tools refuses to uninstall offline on Windows, so remove it at first boot
+const removeVMwareToolsWindowsCommand = `powershell.exe -NoProfile -Command "$p = Get-ItemProperty HKLM:\Software\Microsoft\Windows\CurrentVersion\Uninstall\* | Where-Object { $_.DisplayName -eq 'VMware Tools' }; if ($p) { Start-Process msiexec.exe -ArgumentList '/x', $p.PSChildName, '/qn', '/norestart' -Wait }"`
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Generic HTTP(S) endpoints, for internal image services with their own upload
+// API. Each file is sent as the raw request body: PUT to the endpoint URL with
+// the folder and file name appended, or, when the URL contains {name}, with
+// {name} replaced by them, so https://images.internal/api/disks/{name} works
+// too. An http destination profile can choose POST instead, and adds its
+// headers (values may name environment variables, e.g. "${IMAGE_API_KEY}") and
+// credentials (username and password for basic auth, or a bearer token) to
+// every request to a URL under its url. Without a profile, HTTP_UPLOAD_TOKEN
+// is sent as a bearer token, but only to the host of HTTP_UPLOAD_URL or of an
+// http profile, so a job can't have it sent anywhere else.
+//
+// POST responses can say where the file ended up, in a Location header or a
+// JSON body with "url" or "location"; that URL is recorded as the destination.
+
+// Tries per file before the upload fails; each retry resends the whole file
+const httpUploadAttempts = 3
+
+// The http profile whose url rawURL is under, if any
+func httpProfile(rawURL string) (DestinationProfile, bool) {
+	for _, profile := range config.Destinations {
+		if profile.Cloud == "http" && profile.URL != "" && urlUnder(rawURL, httpEndpointBase(profile.URL)) {
+			return profile, true
+		}
+	}
+	return DestinationProfile{}, false
+}
+
+// An endpoint URL up to the folder {name} is placed in, if it has one
+func httpEndpointBase(endpoint string) string {
+	if before, _, ok := strings.Cut(endpoint, "{name}"); ok {
+		return before[:strings.LastIndex(before, "/")+1]
+	}
+	return endpoint
+}
+
+// Whether rawURL is on the host of HTTP_UPLOAD_URL or of an http profile, the
+// only places HTTP_UPLOAD_TOKEN is sent
+func httpTokenAllowed(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	endpoints := []string{os.Getenv("HTTP_UPLOAD_URL")}
+	for _, profile := range config.Destinations {
+		if profile.Cloud == "http" {
+			endpoints = append(endpoints, profile.URL)
+		}
+	}
+	for _, endpoint := range endpoints {
+		if e, err := url.Parse(httpEndpointBase(endpoint)); err == nil && e.Host != "" && sameOrigin(u, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the headers and credentials for a URL to a request
+func authorizeHTTPRequest(req *http.Request) {
+	profile, ok := httpProfile(req.URL.String())
+	if !ok {
+		if token := os.Getenv("HTTP_UPLOAD_TOKEN"); token != "" && httpTokenAllowed(req.URL.String()) {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return
+	}
+	for name, value := range profile.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+	switch {
+	case profile.Token != "":
+		req.Header.Set("Authorization", "Bearer "+os.ExpandEnv(profile.Token))
+	case profile.Username != "":
+		req.SetBasicAuth(profile.Username, profile.Password)
+	}
+}
+
+// The URL to send a file to, and the method to send it with
+func httpUploadTarget(s uploadSettings, file string) (string, string, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", fmt.Errorf("invalid HTTP endpoint '%s'", s.URL)
+	}
+	method := http.MethodPut
+	if profile, ok := httpProfile(s.URL); ok && profile.Method != "" {
+		method = strings.ToUpper(profile.Method)
+	}
+	name := path.Join(s.Target, filepath.Base(file))
+	if strings.Contains(s.URL, "{name}") {
+		escaped := joinEscapedURL("", name)
+		return strings.ReplaceAll(s.URL, "{name}", strings.TrimPrefix(escaped, "/")), method, nil
+	}
+	if method == http.MethodPost {
+		// POST goes to the collection; the service names the file
+		return s.URL, method, nil
+	}
+	return joinEscapedURL(s.URL, name), method, nil
+}
+
+// Upload one file to an HTTP endpoint, returning where it was written
+func uploadToHTTP(job *Job, s uploadSettings, file string) (string, error) {
+	st, err := openUploadStream(job, s, file)
+	if err != nil {
+		return "", err
+	}
+	defer st.Close()
+	dest, method, err := httpUploadTarget(s, st.Name)
+	if err != nil {
+		return "", err
+	}
+	job.setStatus("Uploading %s to %s (%.2f MB)",
+		filepath.Base(file), dest, float64(st.FileSize)/(1024*1024))
+
+	for attempt := 1; ; attempt++ {
+		var location string
+		location, err = sendHTTPUpload(job, method, dest, st)
+		if err == nil {
+			if location != "" {
+				dest = location
+			}
+			st.finish()
+			return dest, nil
+		}
+		var status httpStatusError
+		// Client errors (bad credentials, rejected files) won't go away on retry
+		if job.ctx.Err() != nil || attempt == httpUploadAttempts ||
+			(errors.As(err, &status) && status.code < 500 && status.code != http.StatusTooManyRequests) {
+			return "", fmt.Errorf("HTTP upload failed for %s: %w", file, err)
+		}
+		job.logf("Upload of %s failed (%s); retrying", filepath.Base(file), err)
+		if err := st.open(); err != nil {
+			return "", err
+		}
+	}
+}
+
+// An error status from an HTTP endpoint
+type httpStatusError struct {
+	code    int
+	message string
+}
+
+func (e httpStatusError) Error() string { return e.message }
+
+// Send a file's stream as a request body, returning the location the service
+// reports for it, if any
+func sendHTTPUpload(job *Job, method, dest string, st *uploadStream) (string, error) {
+	req, err := http.NewRequestWithContext(job.ctx, method, dest, st)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = st.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": st.Name}))
+	authorizeHTTPRequest(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return "", httpStatusError{code: resp.StatusCode,
+			message: fmt.Sprintf("%s %s: %s: %s", method, dest, resp.Status, strings.TrimSpace(string(data)))}
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" {
+		var body struct {
+			URL      string `json:"url"`
+			Location string `json:"location"`
+		}
+		if json.Unmarshal(data, &body) == nil {
+			location = body.URL
+			if location == "" {
+				location = body.Location
+			}
+		}
+	}
+	if location == "" {
+		return "", nil
+	}
+	// Relative locations are relative to the upload URL
+	resolved, err := req.URL.Parse(location)
+	if err != nil {
+		return "", nil
+	}
+	return resolved.String(), nil
+}
+
+// Delete an uploaded file; uploads POSTed to a service that didn't say where
+// they went can't be, since their URL is the service's collection
+func deleteHTTPFile(entry CatalogEntry) error {
+	if entry.Destination == entry.Endpoint {
+		return fmt.Errorf("the service at %s did not report a URL for this upload; delete it on the service", entry.Endpoint)
+	}
+	req, err := http.NewRequest(http.MethodDelete, entry.Destination, nil)
+	if err != nil {
+		return err
+	}
+	authorizeHTTPRequest(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return fmt.Errorf("DELETE %s: %s: %s", entry.Destination, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+// Confirm some endpoint is configured and accepts Porter's credentials. Any
+// answer but 401 or 403 counts, since upload APIs rarely answer HEAD usefully.
+func checkHTTPCredentials(ctx context.Context) error {
+	endpoint := os.Getenv("HTTP_UPLOAD_URL")
+	if endpoint == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "http" && profile.URL != "" {
+				endpoint = profile.URL
+				break
+			}
+		}
+	}
+	if endpoint == "" {
+		return errors.New("no HTTP endpoint configured; set HTTP_UPLOAD_URL or add an http destination profile")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, strings.SplitN(endpoint, "{name}", 2)[0], nil)
+	if err != nil {
+		return err
+	}
+	authorizeHTTPRequest(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%s rejected Porter's credentials: %s", endpoint, resp.Status)
+	}
+	return nil
+}
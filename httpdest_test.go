@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAuthorizeHTTPRequest(t *testing.T) {
+	saved := config.Destinations
+	defer func() { config.Destinations = saved }()
+	config.Destinations = map[string]DestinationProfile{
+		"images": {Cloud: "http", URL: "https://images.example.com/api/disks/{name}?overwrite=true", Token: "profile-token",
+			Headers: map[string]string{"X-Team": "migration"}},
+	}
+	t.Setenv("HTTP_UPLOAD_URL", "https://uploads.example.com:8443/incoming")
+	t.Setenv("HTTP_UPLOAD_TOKEN", "env-token")
+	tests := []struct {
+		url, auth, team string
+	}{
+		{"https://images.example.com/api/disks/web01.qcow2?overwrite=true", "Bearer profile-token", "migration"},
+		{"https://images.example.com/api/disks-old/web01.qcow2", "Bearer env-token", ""},
+		{"https://images.example.com.evil.tld/api/disks/web01.qcow2", "", ""},
+		{"http://images.example.com/api/disks/web01.qcow2", "", ""},
+		{"https://uploads.example.com:8443/incoming/web01.qcow2", "Bearer env-token", ""},
+		{"https://uploads.example.com/incoming/web01.qcow2", "", ""},
+		{"https://attacker.example.net/", "", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodPut, tt.url, nil)
+		authorizeHTTPRequest(req)
+		if auth, team := req.Header.Get("Authorization"), req.Header.Get("X-Team"); auth != tt.auth || team != tt.team {
+			t.Errorf("%s: Authorization %q, X-Team %q; want %q, %q", tt.url, auth, team, tt.auth, tt.team)
+		}
+	}
+}
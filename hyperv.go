@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Microsoft Hyper-V: a VHDX (or VHD) is copied to a folder on the host through
+// its administrative share (D:\Hyper-V\web01 is \\host\D$\Hyper-V\web01), then
+// PowerShell run over WinRM creates the VM around it, with the generation,
+// Secure Boot and TPM the disk needs, the source VM's CPUs and memory, and its
+// network adapter on the virtual switch named by network. Further disks of the
+// same VM are added to it on SCSI.
+//
+// The WinRM URL (https://hyperv01:5986/wsman, or just the host) comes from the
+// request, a hyperv profile or HYPERV_URL, and the folder from the request or
+// HYPERV_PATH. The same account copies the disk and runs the commands: the
+// credentials entered with the upload, those of the hyperv profile whose url
+// the host is under, or HYPERV_USERNAME and HYPERV_PASSWORD.
+
+// A local folder on the host, as the VM's disks are kept: D:\Hyper-V\web01
+var windowsPathPattern = regexp.MustCompile(`^[A-Za-z]:\\`)
+
+// The credentials for a Hyper-V host
+func hypervCredentials(rawURL, username, password string) (string, string) {
+	if username != "" {
+		return username, password
+	}
+	if username, password, ok := profileCredentials("hyperv", rawURL); ok {
+		return username, password
+	}
+	return os.Getenv("HYPERV_USERNAME"), os.Getenv("HYPERV_PASSWORD")
+}
+
+func hypervClient(s uploadSettings) (*winrmClient, error) {
+	username, password := hypervCredentials(s.URL, s.Username, s.Password)
+	if username == "" {
+		return nil, errors.New("no Hyper-V credentials; enter them, add a hyperv profile or set HYPERV_USERNAME and HYPERV_PASSWORD")
+	}
+	return newWinRMClient(s.URL, username, password)
+}
+
+// The administrative share and folder under it for a path on the host
+func hypervShare(client *winrmClient, dir string) (string, string) {
+	host := client.URL
+	if u, err := url.Parse(client.URL); err == nil {
+		host = u.Hostname()
+	}
+	drive, rest, _ := strings.Cut(dir, `\`)
+	return "smb://" + host + "/" + strings.TrimSuffix(drive, ":") + "$", strings.ReplaceAll(strings.Trim(rest, `\`), `\`, "/")
+}
+
+// Copy a disk to the host and create the VM around it (or add the disk to
+// it), returning the disk's path on the host and the VM's ID
+func uploadToHyperV(job *Job, s uploadSettings, file string) (string, string, error) {
+	if !isHyperVDisk(file) {
+		return "", "", fmt.Errorf("%s is not a VHDX or VHD; convert it to vhdx for Hyper-V", filepath.Base(file))
+	}
+	client, err := hypervClient(s)
+	if err != nil {
+		return "", "", err
+	}
+	first := len(job.Files) == 0 || file == job.Files[0]
+	hw := hardwareForDisk(file)
+	var p vmPlatform
+	if first {
+		if p, err = platformForDisk(job, s, file); err != nil {
+			return "", "", err
+		}
+	}
+
+	copied := s
+	copied.URL, copied.Target = hypervShare(client, s.Target)
+	copied.Username, copied.Password = client.Username, client.Password
+	if _, err := uploadToSMB(job, copied, file); err != nil {
+		return "", "", err
+	}
+	disk := strings.TrimRight(s.Target, `\`) + `\` + filepath.Base(file)
+
+	name := job.Spec.Name
+	if name == "" {
+		name = hw.Name
+	}
+	var b strings.Builder
+	b.WriteString("$ErrorActionPreference = 'Stop'\n")
+	fmt.Fprintf(&b, "$disk = %s\n", psQuote(disk))
+	if first {
+		job.setStatus("Creating Hyper-V VM %s on %s", name, client.URL)
+		fmt.Fprintf(&b, "if (Get-VM -Name %s -ErrorAction SilentlyContinue) { throw ('A VM named {0} already exists on this host' -f %s) }\n",
+			psQuote(name), psQuote(name))
+		_, productName := readinessForDisk(job, file)
+		writeHyperVVM(&b, name, hw, isWindowsGuest(hw, productName), p, s.Network)
+		fmt.Fprintf(&b, "Set-VM -Name %s -Notes %s\n", psQuote(name), psQuote("Created by Porter job "+job.ID))
+		fmt.Fprintf(&b, "$vm = Get-VM -Name %s\n", psQuote(name))
+	} else {
+		job.setStatus("Adding %s to Hyper-V VM %s", filepath.Base(file), name)
+		fmt.Fprintf(&b, "$vm = Get-VM -Name %s\n", psQuote(name))
+		b.WriteString("if (-not (Get-VMScsiController -VM $vm)) { Add-VMScsiController -VM $vm }\n")
+		b.WriteString("Add-VMHardDiskDrive -VM $vm -ControllerType SCSI -Path $disk\n")
+	}
+	b.WriteString("$vm.Id.Guid\n")
+
+	out, err := client.runPowerShell(job.ctx, b.String())
+	if err != nil {
+		return disk, "", fmt.Errorf("creating the Hyper-V VM failed (%s is on the host): %w", disk, err)
+	}
+	vmID := strings.TrimSpace(out)
+	job.logf("Hyper-V VM %s (%s) has %s", name, vmID, disk)
+	return disk, vmID, nil
+}
+
+// Delete a disk from the host, along with the VM Porter created around it if
+// that is off. VMs that are running, or weren't created by Porter, are left
+// alone and the disk kept.
+func deleteHyperVDisk(endpoint, disk string) error {
+	client, err := hypervClient(uploadSettings{URL: endpoint})
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("$ErrorActionPreference = 'Stop'\n")
+	fmt.Fprintf(&b, "$disk = %s\n", psQuote(disk))
+	b.WriteString("foreach ($vm in Get-VM | Where-Object { $_.HardDrives.Path -contains $disk }) {\n")
+	b.WriteString("  if ($vm.Notes -notlike 'Created by Porter job *') { throw ('{0} is attached to VM {1}, which Porter did not create' -f $disk, $vm.Name) }\n")
+	b.WriteString("  if ($vm.State -ne 'Off') { throw ('VM {0} is {1}; turn it off to delete it' -f $vm.Name, $vm.State) }\n")
+	b.WriteString("  Remove-VM -VM $vm -Force\n")
+	b.WriteString("}\n")
+	b.WriteString("if (Test-Path -LiteralPath $disk) { Remove-Item -LiteralPath $disk }\n")
+	_, err = client.runPowerShell(context.Background(), b.String())
+	return err
+}
+
+// Confirm a Hyper-V host is configured and accepts Porter's credentials
+func checkHyperVCredentials(ctx context.Context) error {
+	server := os.Getenv("HYPERV_URL")
+	if server == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "hyperv" && profile.URL != "" {
+				server = profile.URL
+				break
+			}
+		}
+	}
+	if server == "" {
+		return errors.New("no Hyper-V host configured; set HYPERV_URL or add a hyperv destination profile")
+	}
+	client, err := hypervClient(uploadSettings{URL: server})
+	if err != nil {
+		return err
+	}
+	_, err = client.runPowerShell(ctx, "$ErrorActionPreference = 'Stop'\nGet-VMHost | Out-Null\n")
+	return err
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// IBM Cloud: images are uploaded to a Cloud Object Storage bucket with the
+// ibmcloud CLI and, with createImage, imported as a VPC custom image through the
+// VPC API. The VPC image service needs an IAM authorization to read the bucket.
+
+const ibmVPCAPIVersion = "2024-04-30"
+
+// How long to wait for a custom image import to finish
+const ibmImageImportTimeout = 2 * time.Hour
+
+// An IAM access token: from IBMCLOUD_API_KEY if set, otherwise the CLI login
+func ibmIAMToken(ctx context.Context) (string, error) {
+	if apiKey := os.Getenv("IBMCLOUD_API_KEY"); apiKey != "" {
+		form := url.Values{"grant_type": {"urn:ibm:params:oauth:grant-type:apikey"}, "apikey": {apiKey}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://iam.cloud.ibm.com/identity/token", strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := doJSONRequest(req, &token); err != nil {
+			return "", fmt.Errorf("IAM token request failed: %w", err)
+		}
+		return token.AccessToken, nil
+	}
+
+	out, err := toolCommand(ctx, "ibmcloud", "iam", "oauth-tokens", "--output", "json").Output()
+	if err != nil {
+		return "", fmt.Errorf("ibmcloud iam oauth-tokens failed (log in or set IBMCLOUD_API_KEY): %w", err)
+	}
+	var tokens struct {
+		IAMToken string `json:"iam_token"`
+	}
+	if err := json.Unmarshal(out, &tokens); err != nil {
+		return "", fmt.Errorf("unexpected ibmcloud iam oauth-tokens output: %w", err)
+	}
+	return strings.TrimPrefix(tokens.IAMToken, "Bearer "), nil
+}
+
+// Call the VPC API in a region, decoding the JSON response into out
+func ibmVPCRequest(ctx context.Context, method, region, path string, body, out interface{}) error {
+	token, err := ibmIAMToken(ctx)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("https://%s.iaas.cloud.ibm.com/v1%s?version=%s&generation=2", region, path, ibmVPCAPIVersion)
+	return jsonAPIRequest(ctx, method, endpoint, token, body, out)
+}
+
+// Upload one image to IBM COS, returning the cos:// URI of the object
+func uploadToIBM(job *Job, s uploadSettings, file string) (string, error) {
+	key := filepath.Base(file)
+	if s.Target != "" {
+		key = strings.Trim(s.Target, "/") + "/" + key
+	}
+	cosURI := fmt.Sprintf("cos://%s/%s/%s", s.Region, s.Bucket, key)
+
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Uploading %s to IBM Cloud Object Storage: %s (%.2f MB)",
+		filepath.Base(file), cosURI, float64(fileInfo.Size())/(1024*1024))
+
+	cmd := toolCommand(job.ctx, "ibmcloud", "cos", "upload",
+		"--bucket", s.Bucket, "--key", key, "--file", file, "--region", s.Region)
+	pending := pendingUploads.start("ibm", cosURI, "")
+	if err := runJobCommand(job, cmd); err != nil {
+		abandonUpload(pending)
+		return "", fmt.Errorf("IBM COS upload failed for %s: %w", file, err)
+	}
+	pendingUploads.finish(pending.ID)
+	return cosURI, nil
+}
+
+// Import an uploaded COS object as a VPC custom image and wait for it to become
+// available, returning the ID of the image
+func createIBMImage(job *Job, s uploadSettings, file, cosURI string) (string, error) {
+	name := imageResourceName(job, file)
+	request := map[string]interface{}{
+		"name":             name,
+		"file":             map[string]string{"href": cosURI},
+		"operating_system": map[string]string{"name": s.OSName},
+	}
+	if s.ResourceGroup != "" {
+		request["resource_group"] = map[string]string{"id": s.ResourceGroup}
+	}
+	job.setStatus("Creating VPC custom image %s in %s", name, s.Region)
+	var image struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := ibmVPCRequest(job.ctx, http.MethodPost, s.Region, "/images", request, &image); err != nil {
+		return "", fmt.Errorf("creating VPC image from %s failed: %w", cosURI, err)
+	}
+	job.logf("Importing custom image %s (%s)", name, image.ID)
+
+	task := CloudTask{Kind: "VPC image import", ID: image.ID, Status: image.Status}
+	err := waitForCloudTask(job, task, ibmImageImportTimeout, func(t *CloudTask) (bool, error) {
+		if err := ibmVPCRequest(job.ctx, http.MethodGet, s.Region, "/images/"+image.ID, nil, &image); err != nil {
+			return false, fmt.Errorf("checking VPC image %s failed: %w", image.ID, err)
+		}
+		t.Status = image.Status
+		switch image.Status {
+		case "available":
+			return true, nil
+		case "failed":
+			return false, fmt.Errorf("VPC image import of %s failed; check the image's status reasons in the IBM Cloud console", cosURI)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return image.ID, err
+	}
+	job.logf("Custom image %s is available", image.ID)
+	return image.ID, nil
+}
+
+// Split a cos://region/bucket/key URI
+func parseCOSURI(uri string) (region, bucket, key string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(uri, "cos://"), "/", 3)
+	if len(parts) != 3 || !strings.HasPrefix(uri, "cos://") {
+		return "", "", "", fmt.Errorf("invalid COS URI '%s'", uri)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+func deleteCOSObject(uri string) error {
+	region, bucket, key, err := parseCOSURI(uri)
+	if err != nil {
+		return err
+	}
+	out, err := toolCommand(context.Background(), "ibmcloud", "cos", "object-delete", "--bucket", bucket, "--key", key,
+		"--region", region, "--force").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// List objects under a prefix in an IBM COS bucket
+func listCOSObjects(ctx context.Context, region, bucket, prefix string) ([]DestinationObject, error) {
+	args := []string{"cos", "objects", "--bucket", bucket, "--output", "json"}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	if prefix != "" {
+		args = append(args, "--prefix", prefix)
+	}
+	out, err := toolCommand(ctx, "ibmcloud", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ibmcloud cos objects failed: %w", err)
+	}
+	var listed struct {
+		Contents []struct {
+			Key          string `json:"Key"`
+			Size         int64  `json:"Size"`
+			LastModified string `json:"LastModified"`
+		} `json:"Contents"`
+	}
+	if err := json.Unmarshal(out, &listed); err != nil {
+		return nil, fmt.Errorf("failed to parse COS listing: %w", err)
+	}
+	var objects []DestinationObject
+	for _, o := range listed.Contents {
+		objects = append(objects, DestinationObject{Name: o.Key, Size: o.Size, LastModified: o.LastModified})
+	}
+	return objects, nil
+}
+
+func checkIBMCredentials(ctx context.Context) error {
+	_, err := ibmIAMToken(ctx)
+	return err
+}
+
+func listIBMRegions(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Regions []struct {
+			Name string `json:"name"`
+		} `json:"regions"`
+	}
+	if err := ibmVPCRequest(ctx, http.MethodGet, "us-south", "/regions", nil, &resp); err != nil {
+		return nil, err
+	}
+	var regions []string
+	for _, r := range resp.Regions {
+		regions = append(regions, r.Name)
+	}
+	return regions, nil
+}
+
+// Handler to fetch IBM resource groups (ID and name) for image placement
+func ibmResourceGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := providerOutput(r.Context(), "ibm", "ibmcloud", "resource", "groups", "--output", "json")
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list IBM resource groups",
+			Remediation: "Check that the ibmcloud CLI is installed and logged in (mount ~/.bluemix)."})
+		return
+	}
+	var groups []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(out, &groups); err != nil {
+		writeAPIError(w, http.StatusBadGateway, APIError{Code: errCodeProviderFailed,
+			Message: "Failed to parse IBM resource groups", Details: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"resourceGroups": groups})
+}
+
+// Handler to fetch IBM COS buckets dynamically, with each bucket's location and
+// storage class
+func ibmBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	out, err := providerOutput(r.Context(), "ibm", "ibmcloud", "cos", "buckets-extended", "--output", "json")
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list IBM COS buckets",
+			Remediation: "Check that the ibmcloud CLI and its cloud-object-storage plugin are installed and configured with your COS instance CRN."})
+		return
+	}
+	var listed struct {
+		Buckets []struct {
+			Name               string `json:"Name"`
+			LocationConstraint string `json:"LocationConstraint"`
+		} `json:"Buckets"`
+	}
+	if err := json.Unmarshal(out, &listed); err != nil {
+		writeAPIError(w, http.StatusBadGateway, APIError{Code: errCodeProviderFailed,
+			Message: "Failed to parse IBM COS bucket listing", Details: err.Error()})
+		return
+	}
+	type bucket struct {
+		Location     string `json:"location"`
+		StorageClass string `json:"default_storage_class"`
+	}
+	var buckets []string
+	details := map[string]bucket{}
+	for _, b := range listed.Buckets {
+		buckets = append(buckets, b.Name)
+		// The location constraint is the location and the class, e.g. us-south-smart
+		if i := strings.LastIndex(b.LocationConstraint, "-"); i > 0 {
+			details[b.Name] = bucket{Location: b.LocationConstraint[:i], StorageClass: b.LocationConstraint[i+1:]}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"buckets": listOrEmpty(buckets), "details": details})
+}
+
+// Handler for /ibm/operating-systems?region=...: the OS names custom images can use
+func ibmOperatingSystemsHandler(w http.ResponseWriter, r *http.Request) {
+	region := r.URL.Query().Get("region")
+	if region == "" {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "Missing region", Remediation: "Pass the region query parameter, e.g. us-south."})
+		return
+	}
+	var resp struct {
+		OperatingSystems []struct {
+			Name string `json:"name"`
+		} `json:"operating_systems"`
+	}
+	err := providerCall(r.Context(), "ibm", func(ctx context.Context) error {
+		return ibmVPCRequest(ctx, http.MethodGet, region, "/operating_systems", nil, &resp)
+	})
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list IBM operating systems",
+			Remediation: "Check the region name and that you are logged in (or IBMCLOUD_API_KEY is set)."})
+		return
+	}
+	var names []string
+	for _, o := range resp.OperatingSystems {
+		names = append(names, o.Name)
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"operatingSystems": listOrEmpty(names)})
+}
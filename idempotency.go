@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Idempotency keys for job-creating requests (POST /api/jobs, POST /api/jobs/bulk
+// and /upload). A client sends the same Idempotency-Key header (or the upload
+// form's idempotency_key field) when it retries a request, and Porter answers
+// the retry with the jobs the first request queued instead of queueing them
+// again. Keys are remembered for idempotencyKeyTTL and saved next to the job
+// history, so they survive a restart. A key reused with a different request is
+// rejected, and one whose first request is still being handled is answered
+// with 409. So is a retry of a single-job request whose job has since dropped
+// out of the job history, rather than running the job again.
+
+const (
+	idempotencyKeyTTL    = 24 * time.Hour
+	idempotencyKeyMaxLen = 255
+)
+
+type idempotentRequest struct {
+	fingerprint string
+	jobIDs      []string
+	// Set once the first request has queued its jobs
+	recorded bool
+	created  time.Time
+}
+
+var idempotencyKeys = struct {
+	sync.Mutex
+	byKey map[string]*idempotentRequest
+}{byKey: map[string]*idempotentRequest{}}
+
+var idempotencyKeysPath = filepath.Join(stateDir, "idempotency-keys.json")
+
+// A recorded key as saved in the state directory
+type savedIdempotencyKey struct {
+	Fingerprint string    `json:"fingerprint"`
+	JobIDs      []string  `json:"jobIds"`
+	Created     time.Time `json:"created"`
+}
+
+// Write the recorded keys; callers must hold the lock
+func saveIdempotencyKeys() {
+	saved := map[string]savedIdempotencyKey{}
+	for key, req := range idempotencyKeys.byKey {
+		if req.recorded {
+			saved[key] = savedIdempotencyKey{Fingerprint: req.fingerprint, JobIDs: req.jobIDs, Created: req.created}
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		tmp := idempotencyKeysPath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, idempotencyKeysPath)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save idempotency keys: %s\n", err)
+	}
+}
+
+// Load the keys saved before Porter last stopped; run from main along with
+// the job history, so a key can name a job that didn't make it back
+func restoreIdempotencyKeys() {
+	data, err := os.ReadFile(idempotencyKeysPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: could not read idempotency keys %s: %s\n", idempotencyKeysPath, err)
+		}
+		return
+	}
+	var saved map[string]savedIdempotencyKey
+	if err := json.Unmarshal(data, &saved); err != nil {
+		fmt.Printf("Warning: invalid idempotency keys %s: %s (starting empty)\n", idempotencyKeysPath, err)
+		return
+	}
+	idempotencyKeys.Lock()
+	defer idempotencyKeys.Unlock()
+	for key, k := range saved {
+		if time.Since(k.Created) <= idempotencyKeyTTL {
+			idempotencyKeys.byKey[key] = &idempotentRequest{fingerprint: k.Fingerprint, jobIDs: k.JobIDs, recorded: true, created: k.Created}
+		}
+	}
+}
+
+// A request's hold on its idempotency key. A nil claim (no key sent) does nothing.
+type idempotencyClaim struct {
+	key     string
+	request *idempotentRequest
+	// The jobs of the earlier request this one repeats, nil if it is the first
+	previous []*Job
+}
+
+// The idempotency key a request was sent with, if any
+func idempotencyKey(r *http.Request) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	if r.PostForm != nil {
+		return r.PostForm.Get("idempotency_key")
+	}
+	return ""
+}
+
+// Claim the request's idempotency key. The payload (the body, or the encoded
+// form) identifies the request, so the key can't be reused for a different one.
+// Fails with the status and error to report.
+func claimIdempotencyKey(r *http.Request, payload []byte) (*idempotencyClaim, int, *APIError) {
+	key := idempotencyKey(r)
+	if key == "" {
+		return nil, 0, nil
+	}
+	if len(key) > idempotencyKeyMaxLen {
+		return nil, http.StatusBadRequest, &APIError{Code: errCodeInvalidRequest,
+			Message: "Idempotency key is too long", Remediation: "Use a key of at most 255 characters, such as a UUID."}
+	}
+	sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), payload...))
+	fingerprint := hex.EncodeToString(sum[:])
+
+	idempotencyKeys.Lock()
+	defer idempotencyKeys.Unlock()
+	expired := false
+	for k, req := range idempotencyKeys.byKey {
+		if req.recorded && time.Since(req.created) > idempotencyKeyTTL {
+			delete(idempotencyKeys.byKey, k)
+			expired = true
+		}
+	}
+	if expired {
+		saveIdempotencyKeys()
+	}
+	req, ok := idempotencyKeys.byKey[key]
+	if !ok {
+		req = &idempotentRequest{fingerprint: fingerprint, created: time.Now()}
+		idempotencyKeys.byKey[key] = req
+		return &idempotencyClaim{key: key, request: req}, 0, nil
+	}
+	if req.fingerprint != fingerprint {
+		return nil, http.StatusUnprocessableEntity, &APIError{Code: errCodeIdempotencyKeyReused,
+			Message:     "Idempotency key was already used for a different request",
+			Remediation: "Send a new key for each new job submission, and the same key only when retrying the same request."}
+	}
+	if !req.recorded {
+		return nil, http.StatusConflict, &APIError{Code: errCodeConflict,
+			Message:     "A request with this idempotency key is still being handled",
+			Remediation: "Wait a moment and retry with the same key to get its jobs."}
+	}
+	claim := &idempotencyClaim{key: key, previous: []*Job{}}
+	for _, id := range req.jobIDs {
+		if job, ok := jobs.get(id); ok {
+			claim.previous = append(claim.previous, job)
+		}
+	}
+	fmt.Printf("Idempotency key %s repeated; returning %d existing job(s)\n", key, len(claim.previous))
+	return claim, 0, nil
+}
+
+// The answer to a retried single-job request whose job is no longer in the history
+var errIdempotentJobPruned = APIError{Code: errCodeConflict,
+	Message:     "The job queued by the request with this idempotency key no longer exists",
+	Remediation: "Send a new key to queue the job again."}
+
+// The jobs queued by the earlier request with the same key, and whether there was one
+func (c *idempotencyClaim) replayed(w http.ResponseWriter) ([]*Job, bool) {
+	if c == nil || c.previous == nil {
+		return nil, false
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	return c.previous, true
+}
+
+// Remember the jobs the request queued, for retries with the same key
+func (c *idempotencyClaim) record(queued ...*Job) {
+	if c == nil || c.request == nil {
+		return
+	}
+	idempotencyKeys.Lock()
+	defer idempotencyKeys.Unlock()
+	for _, job := range queued {
+		c.request.jobIDs = append(c.request.jobIDs, job.ID)
+	}
+	c.request.recorded = true
+	saveIdempotencyKeys()
+}
+
+// Free the key if the request failed before queueing anything, so the client
+// can retry it once fixed. Deferred by the handlers.
+func (c *idempotencyClaim) release() {
+	if c == nil || c.request == nil {
+		return
+	}
+	idempotencyKeys.Lock()
+	defer idempotencyKeys.Unlock()
+	if !c.request.recorded && idempotencyKeys.byKey[c.key] == c.request {
+		delete(idempotencyKeys.byKey, c.key)
+	}
+}
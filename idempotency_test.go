@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Keep the test's idempotency keys in memory and in a temp state dir
+func withIdempotencyState(t *testing.T) {
+	savedPath := idempotencyKeysPath
+	idempotencyKeysPath = filepath.Join(t.TempDir(), "idempotency-keys.json")
+	idempotencyKeys.Lock()
+	idempotencyKeys.byKey = map[string]*idempotentRequest{}
+	idempotencyKeys.Unlock()
+	t.Cleanup(func() {
+		idempotencyKeysPath = savedPath
+		idempotencyKeys.Lock()
+		idempotencyKeys.byKey = map[string]*idempotentRequest{}
+		idempotencyKeys.Unlock()
+	})
+}
+
+func keyedRequest(key, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/api/jobs", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	return r
+}
+
+func TestIdempotencyReplay(t *testing.T) {
+	withIdempotencyState(t)
+	job := &Job{ID: "idempotency-test-job", State: jobQueued}
+	jobs.Lock()
+	jobs.jobs[job.ID] = job
+	jobs.Unlock()
+	t.Cleanup(func() {
+		jobs.Lock()
+		delete(jobs.jobs, job.ID)
+		jobs.Unlock()
+	})
+
+	first, _, apiErr := claimIdempotencyKey(keyedRequest("retry-key", `{}`), []byte(`{}`))
+	if apiErr != nil || first == nil || first.previous != nil {
+		t.Fatalf("first claim = %+v, %v; want a new claim", first, apiErr)
+	}
+	// A second request with the key while the first is still being handled
+	if _, status, apiErr := claimIdempotencyKey(keyedRequest("retry-key", `{}`), []byte(`{}`)); apiErr == nil || status != http.StatusConflict {
+		t.Errorf("claim while in flight = %d, %v; want 409", status, apiErr)
+	}
+	first.record(job)
+	first.release()
+
+	tests := []struct {
+		name    string
+		key     string
+		payload string
+		status  int
+		jobs    []string
+	}{
+		{"retry", "retry-key", `{}`, 0, []string{job.ID}},
+		{"retry again", "retry-key", `{}`, 0, []string{job.ID}},
+		{"different request", "retry-key", `{"name":"other"}`, http.StatusUnprocessableEntity, nil},
+		{"no key", "", `{}`, 0, nil},
+	}
+	for _, tt := range tests {
+		claim, status, apiErr := claimIdempotencyKey(keyedRequest(tt.key, tt.payload), []byte(tt.payload))
+		if status != tt.status || (apiErr != nil) != (tt.status != 0) {
+			t.Errorf("%s: status %d, error %v; want %d", tt.name, status, apiErr, tt.status)
+			continue
+		}
+		w := httptest.NewRecorder()
+		previous, replayed := claim.replayed(w)
+		if replayed != (tt.jobs != nil) || len(previous) != len(tt.jobs) {
+			t.Errorf("%s: replayed %v with %d job(s), want %v", tt.name, replayed, len(previous), tt.jobs)
+			continue
+		}
+		for i, id := range tt.jobs {
+			if previous[i].ID != id {
+				t.Errorf("%s: replayed job %s, want %s", tt.name, previous[i].ID, id)
+			}
+		}
+		if got := w.Header().Get("Idempotent-Replayed"); (got == "true") != replayed {
+			t.Errorf("%s: Idempotent-Replayed = %q", tt.name, got)
+		}
+	}
+
+	// A request that failed before queueing anything frees its key
+	failed, _, _ := claimIdempotencyKey(keyedRequest("failed-key", `{}`), []byte(`{}`))
+	failed.release()
+	if again, _, apiErr := claimIdempotencyKey(keyedRequest("failed-key", `{}`), []byte(`{}`)); apiErr != nil || again.previous != nil {
+		t.Errorf("claim after a failed request = %+v, %v; want a new claim", again, apiErr)
+	}
+}
+
+func TestIdempotencyReplayOfPrunedJob(t *testing.T) {
+	withIdempotencyState(t)
+	body := `{"cloud":"local","files":["/data/web01.vmdk"]}`
+	claim, _, apiErr := claimIdempotencyKey(keyedRequest("pruned-key", body), []byte("\n"+body))
+	if apiErr != nil {
+		t.Fatal(apiErr)
+	}
+	claim.record(&Job{ID: "pruned-job"})
+	claim.release()
+
+	// Porter restarts, and the job didn't make it back from the history
+	idempotencyKeys.Lock()
+	idempotencyKeys.byKey = map[string]*idempotentRequest{}
+	idempotencyKeys.Unlock()
+	restoreIdempotencyKeys()
+
+	queued := len(jobs.list())
+	w := httptest.NewRecorder()
+	jobsCreateHandler(w, keyedRequest("pruned-key", body))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("replay of a pruned job = %d %s, want 409", w.Code, w.Body)
+	}
+	var apiErrBody APIError
+	if err := json.Unmarshal(w.Body.Bytes(), &apiErrBody); err != nil || apiErrBody.Code != errCodeConflict {
+		t.Errorf("replay of a pruned job answered %s", w.Body)
+	}
+	if got := len(jobs.list()); got != queued {
+		t.Errorf("replay of a pruned job queued %d job(s)", got-queued)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Image tools: everything Porter does with disk images (inspecting, converting,
+// comparing) goes through an imageTool, chosen by imageTool.backend in
+// porter.json. The default runs qemu-img; "remote" sends the work to an image
+// service over HTTP, for environments where Porter may not run subprocesses.
+// The service must see Porter's workspace (/app/extracted, /app/converted and
+// any uploaded sources) at the same paths, such as through a shared volume.
+type ImageToolConfig struct {
+	// "qemu-img" (default) or "remote"
+	Backend string `json:"backend,omitempty"`
+	// Base URL of the image service, and an optional bearer token for it
+	// (default PORTER_IMAGE_SERVICE_TOKEN)
+	URL   string `json:"url,omitempty"`
+	Token string `json:"token,omitempty"`
+}
+
+// What an image tool reports about an image
+type imageInfo struct {
+	Format string `json:"format"`
+	// Size of the disk the guest sees, and of the allocated blocks
+	VirtualSize int64 `json:"virtualSize"`
+	ActualSize  int64 `json:"actualSize"`
+}
+
+// A run of the guest's disk, as qemu-img map reports it: whether it holds data
+// in the file and whether it reads as zeros
+type imageExtent struct {
+	Start  int64 `json:"start"`
+	Length int64 `json:"length"`
+	Data   bool  `json:"data"`
+	Zero   bool  `json:"zero"`
+}
+
+// One conversion: formats are qemu-img format names, options are -o options
+type imageConversion struct {
+	Input        string   `json:"input"`
+	InputFormat  string   `json:"inputFormat"`
+	Output       string   `json:"output"`
+	OutputFormat string   `json:"outputFormat"`
+	Options      []string `json:"options,omitempty"`
+}
+
+type imageTool interface {
+	// Name for messages, and whether the tool can be used at all
+	name() string
+	available() bool
+	info(ctx context.Context, path string) (imageInfo, error)
+	// Map which parts of the guest's disk hold data; see usage.go
+	extents(ctx context.Context, path string) ([]imageExtent, error)
+	// Convert an image; with a job, progress goes to its log and the conversion
+	// is paused, resumed and cancelled with it
+	convert(ctx context.Context, job *Job, c imageConversion) error
+	// Compare what the guest sees in two images, returning the offset of the
+	// first difference, or nil if they match
+	compare(ctx context.Context, a, b ComparedImage) (*int64, error)
+}
+
+// The image tool configured in porter.json
+func imageTools() imageTool {
+	if config.Mock.Enabled {
+		return mockImageTool{}
+	}
+	if config.ImageTool.Backend == "remote" {
+		return remoteImageTool{config.ImageTool}
+	}
+	return qemuImageTool{}
+}
+
+// Check the imageTool settings, falling back to qemu-img if they are unusable
+func (c *Config) validateImageTool(path string) {
+	switch c.ImageTool.Backend {
+	case "", "qemu-img":
+	case "remote":
+		if c.ImageTool.URL == "" {
+			fmt.Printf("Warning: imageTool.url is required for the remote image backend in config %s (using qemu-img)\n", path)
+			c.ImageTool = ImageToolConfig{}
+		}
+	default:
+		fmt.Printf("Warning: unknown imageTool.backend '%s' in config %s (using qemu-img)\n", c.ImageTool.Backend, path)
+		c.ImageTool = ImageToolConfig{}
+	}
+}
+
+// qemu-img, run as a subprocess
+type qemuImageTool struct{}
+
+func (qemuImageTool) name() string { return "qemu-img" }
+
+func (qemuImageTool) available() bool { return checkBinary("qemu-img") }
+
+func (qemuImageTool) info(ctx context.Context, path string) (imageInfo, error) {
+	out, err := toolCommand(ctx, "qemu-img", "info", "--output=json", path).Output()
+	if err != nil {
+		return imageInfo{}, fmt.Errorf("qemu-img info failed for %s: %w", path, err)
+	}
+	var info struct {
+		Format      string `json:"format"`
+		VirtualSize int64  `json:"virtual-size"`
+		ActualSize  int64  `json:"actual-size"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return imageInfo{}, fmt.Errorf("unexpected qemu-img info output: %w", err)
+	}
+	return imageInfo{Format: info.Format, VirtualSize: info.VirtualSize, ActualSize: info.ActualSize}, nil
+}
+
+func (qemuImageTool) extents(ctx context.Context, path string) ([]imageExtent, error) {
+	out, err := toolCommand(ctx, "qemu-img", "map", "--output=json", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("qemu-img map failed for %s: %w", path, err)
+	}
+	var extents []imageExtent
+	if err := json.Unmarshal(out, &extents); err != nil {
+		return nil, fmt.Errorf("unexpected qemu-img map output: %w", err)
+	}
+	return extents, nil
+}
+
+func (qemuImageTool) convert(ctx context.Context, job *Job, c imageConversion) error {
+	args := []string{"convert", "-f", c.InputFormat, "-O", c.OutputFormat}
+	for _, option := range c.Options {
+		args = append(args, "-o", option)
+	}
+	tuning, described := conversionIOArgs(c)
+	args = append(args, tuning...)
+	cmd := toolCommand(ctx, "qemu-img", append(args, c.Input, c.Output)...)
+	if job != nil {
+		if described != "" {
+			job.logf("Converting %s with %s", filepath.Base(c.Input), described)
+		}
+		return runJobCommand(job, cmd)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+var contentMismatch = regexp.MustCompile(`Content mismatch at offset (\d+)`)
+
+func (qemuImageTool) compare(ctx context.Context, a, b ComparedImage) (*int64, error) {
+	out, err := toolCommand(ctx, "qemu-img", "compare", "-f", a.Format, "-F", b.Format, a.Path, b.Path).CombinedOutput()
+	if err == nil {
+		return nil, nil
+	}
+	// Exit status 1 means the images differ; anything else is a failure
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		return nil, fmt.Errorf("qemu-img compare failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	offset := int64(0)
+	if m := contentMismatch.FindSubmatch(out); m != nil {
+		offset, _ = strconv.ParseInt(string(m[1]), 10, 64)
+	}
+	return &offset, nil
+}
+
+// An image service reached over HTTP. Its API:
+//
+//	POST   /v1/info         {"path"} → {"format", "virtualSize", "actualSize"}
+//	POST   /v1/map          {"path"} → [{"start", "length", "data", "zero"}] (as qemu-img map)
+//	POST   /v1/compare      {"a", "aFormat", "b", "bFormat"} → {"identical", "firstMismatch"}
+//	POST   /v1/convert      an imageConversion → {"id"}
+//	GET    /v1/convert/{id} → {"state": "running", "done" or "failed", "progress" (percent), "error"}
+//	DELETE /v1/convert/{id} cancels a conversion
+type remoteImageTool struct {
+	settings ImageToolConfig
+}
+
+// How often a running remote conversion is checked on
+const remoteConvertPollInterval = 5 * time.Second
+
+func (t remoteImageTool) name() string { return "the image service at " + t.settings.URL }
+
+func (t remoteImageTool) available() bool { return t.settings.URL != "" }
+
+func (t remoteImageTool) request(ctx context.Context, method, endpoint string, body, out interface{}) error {
+	req, err := newJSONRequest(ctx, method, strings.TrimRight(t.settings.URL, "/")+endpoint, body)
+	if err != nil {
+		return err
+	}
+	token := t.settings.Token
+	if token == "" {
+		token = os.Getenv("PORTER_IMAGE_SERVICE_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if err := doJSONRequest(req, out); err != nil {
+		return fmt.Errorf("image service: %w", err)
+	}
+	return nil
+}
+
+func (t remoteImageTool) info(ctx context.Context, path string) (imageInfo, error) {
+	var info imageInfo
+	if err := t.request(ctx, http.MethodPost, "/v1/info", map[string]string{"path": path}, &info); err != nil {
+		return info, fmt.Errorf("inspecting %s failed: %w", path, err)
+	}
+	return info, nil
+}
+
+func (t remoteImageTool) extents(ctx context.Context, path string) ([]imageExtent, error) {
+	var extents []imageExtent
+	if err := t.request(ctx, http.MethodPost, "/v1/map", map[string]string{"path": path}, &extents); err != nil {
+		return nil, fmt.Errorf("mapping %s failed: %w", path, err)
+	}
+	return extents, nil
+}
+
+func (t remoteImageTool) compare(ctx context.Context, a, b ComparedImage) (*int64, error) {
+	var result struct {
+		Identical     bool  `json:"identical"`
+		FirstMismatch int64 `json:"firstMismatch"`
+	}
+	err := t.request(ctx, http.MethodPost, "/v1/compare", map[string]string{
+		"a": a.Path, "aFormat": a.Format, "b": b.Path, "bFormat": b.Format,
+	}, &result)
+	if err != nil || result.Identical {
+		return nil, err
+	}
+	return &result.FirstMismatch, nil
+}
+
+func (t remoteImageTool) convert(ctx context.Context, job *Job, c imageConversion) error {
+	var started struct {
+		ID string `json:"id"`
+	}
+	if err := t.request(ctx, http.MethodPost, "/v1/convert", c, &started); err != nil {
+		return err
+	}
+	endpoint := "/v1/convert/" + url.PathEscape(started.ID)
+	lastProgress := -1
+	for {
+		select {
+		case <-ctx.Done():
+			// Don't leave the service converting for nobody
+			cancelCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			t.request(cancelCtx, http.MethodDelete, endpoint, nil, nil)
+			cancel()
+			return ctx.Err()
+		case <-time.After(remoteConvertPollInterval):
+		}
+		var status struct {
+			State    string `json:"state"`
+			Progress int    `json:"progress"`
+			Error    string `json:"error"`
+		}
+		if err := t.request(ctx, http.MethodGet, endpoint, nil, &status); err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			return err
+		}
+		switch status.State {
+		case "done":
+			return nil
+		case "failed":
+			return fmt.Errorf("image service: %s", status.Error)
+		}
+		if job != nil && status.Progress != lastProgress {
+			job.progressed()
+			if status.Progress/10 != lastProgress/10 {
+				job.logf("Converting %s: %d%%", c.Input, status.Progress)
+			}
+			lastProgress = status.Progress
+		}
+		// A paused job stops checking; the service finishes the conversion meanwhile
+		if job != nil {
+			job.waitIfPaused()
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LXD / Incus VM images: each disk is packaged as a unified image tarball,
+// <name>-incus.tar holding metadata.yaml and the disk as rootfs.img in QCOW2,
+// which `incus image import` (or `lxc image import`) takes as it is. The
+// metadata describes the VM from its OVF, and BIOS and non-Secure Boot disks
+// say they need Secure Boot off. With imageRef ([remote:]alias) the image is
+// also imported into that remote (the incus CLI's, default local) under the
+// alias, so it is ready for `incus launch <remote>:<alias> --vm`.
+
+// The fingerprint `image import` reports
+var incusFingerprintPattern = regexp.MustCompile(`fingerprint: ([0-9a-f]{64})`)
+
+// The CLI to import images with: incus, else LXD's lxc
+func incusCLI() string {
+	if _, err := exec.LookPath(toolPath("incus")); err != nil {
+		if _, err := exec.LookPath(toolPath("lxc")); err == nil {
+			return "lxc"
+		}
+	}
+	return "incus"
+}
+
+// The image's metadata.yaml
+func incusMetadata(job *Job, hw ovfHardware, arch string, secureBoot bool) []byte {
+	description := hw.Annotation
+	if description == "" {
+		description = fmt.Sprintf("%s: %d vCPU, %d MB memory, %s firmware", hw.Name, hw.CPUs, hw.MemoryMB, hw.Firmware)
+	}
+	description = strings.Join(strings.Fields(description), " ") + " (packaged by Porter job " + job.ID + ")"
+	osName := hw.OSType
+	if osName == "" {
+		osName = "unknown"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "architecture: %s\n", archName(arch, [2]string{"x86_64", "aarch64"}))
+	fmt.Fprintf(&b, "creation_date: %d\n", time.Now().Unix())
+	b.WriteString("properties:\n")
+	fmt.Fprintf(&b, "  description: %q\n", description)
+	fmt.Fprintf(&b, "  name: %q\n", hw.Name)
+	fmt.Fprintf(&b, "  os: %q\n", osName)
+	if !secureBoot {
+		b.WriteString("requirements:\n  secureboot: \"false\"\n")
+	}
+	b.WriteString("templates: {}\n")
+	return []byte(b.String())
+}
+
+// Package one disk as an Incus VM image in the target directory, importing it
+// into a remote if asked to; returns the tarball's path and the remote:alias
+func packageIncusImage(job *Job, s uploadSettings, file string) (string, string, error) {
+	hw := hardwareForDisk(file)
+	if job.Spec.Name != "" {
+		hw.Name = job.Spec.Name
+	}
+	name := strings.ReplaceAll(hw.Name, "/", "-")
+	if err := os.MkdirAll(s.Target, 0755); err != nil {
+		return "", "", err
+	}
+	work, err := os.MkdirTemp(s.Target, ".porter-incus-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(work)
+
+	disk := file
+	if !strings.EqualFold(filepath.Ext(file), ".qcow2") {
+		disk = filepath.Join(work, "rootfs.img")
+		job.setStatus("Converting %s to QCOW2 for the Incus image", filepath.Base(file))
+		if err := convertImage(job, file, disk, "qcow2"); err != nil {
+			return "", "", err
+		}
+	}
+	firmware, _ := readinessForDisk(job, file)
+	uefi := hw.Firmware == "efi"
+	if firmware != "" {
+		uefi = firmware == "uefi"
+	}
+	if !uefi {
+		job.warnf("%s boots through BIOS; launch it with security.csm=true and security.secureboot=false", filepath.Base(file))
+	}
+
+	dest := filepath.Join(s.Target, name+"-incus.tar")
+	job.setStatus("Packaging %s as Incus VM image %s", filepath.Base(file), dest)
+	files := []tarFile{
+		{name: "metadata.yaml", data: incusMetadata(job, hw, guestArch(job, file), uefi && hw.SecureBoot)},
+		{name: "rootfs.img", path: disk},
+	}
+	out, err := os.Create(dest)
+	if err == nil {
+		err = writeTarFiles(job, out, files)
+		if err == nil {
+			err = out.Sync()
+		}
+		out.Close()
+	}
+	if err != nil {
+		os.Remove(dest)
+		return "", "", fmt.Errorf("packaging %s as an Incus image failed: %w", file, err)
+	}
+	if s.ImageRef == "" {
+		return dest, "", nil
+	}
+
+	remote, alias, ok := strings.Cut(s.ImageRef, ":")
+	if !ok {
+		remote, alias = "", s.ImageRef
+	}
+	cli := incusCLI()
+	args := []string{"image", "import", dest}
+	if remote != "" {
+		args = append(args, remote+":")
+	}
+	args = append(args, "--alias", alias)
+	job.setStatus("Importing %s into %s as %s", filepath.Base(dest), cli, s.ImageRef)
+	output, err := toolCommand(job.ctx, cli, args...).CombinedOutput()
+	if err != nil {
+		return dest, "", fmt.Errorf("%s image import failed (the image is at %s): %w: %s", cli, dest, err, strings.TrimSpace(string(output)))
+	}
+	if m := incusFingerprintPattern.FindSubmatch(output); m != nil {
+		job.logf("Imported %s as %s (fingerprint %s)", filepath.Base(dest), s.ImageRef, m[1])
+	}
+	return dest, s.ImageRef, nil
+}
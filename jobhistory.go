@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Job history: jobs are saved to the state directory shortly after one is
+// queued or changes state, and restored when Porter starts, so the jobs API
+// and the web UI still show them after a restart. Only the latest
+// jobHistoryLimit jobs are kept, in memory as well as on disk. A job that was queued or running when
+// Porter stopped can't carry on, so it is restored as failed with a message
+// saying so; finished jobs keep their results and can be re-imported or turned
+// into images as before.
+
+var jobHistoryPath = filepath.Join(stateDir, "jobs.json")
+
+// Jobs kept in the history (the latest), and log lines kept per job
+const (
+	jobHistoryLimit    = 500
+	jobHistoryLogLines = 200
+)
+
+// Changes are written at most this often, so a burst of transitions (a bulk
+// submission, a queue starting up) costs one write rather than one each
+const jobHistorySaveDelay = 2 * time.Second
+
+// Serialises writes of the history file
+var jobHistoryMu sync.Mutex
+
+// The pending write of the history, if one is scheduled
+var jobHistorySave struct {
+	sync.Mutex
+	timer *time.Timer
+}
+
+// Schedule a write of the history, unless one is already due
+func (m *jobManager) saveHistory() {
+	jobHistorySave.Lock()
+	defer jobHistorySave.Unlock()
+	if jobHistorySave.timer != nil {
+		return
+	}
+	jobHistorySave.timer = time.AfterFunc(jobHistorySaveDelay, func() {
+		jobHistorySave.Lock()
+		jobHistorySave.timer = nil
+		jobHistorySave.Unlock()
+		m.writeHistory()
+	})
+}
+
+// Write the history atomically
+func (m *jobManager) writeHistory() {
+	list := m.list()
+	if len(list) > jobHistoryLimit {
+		list = list[len(list)-jobHistoryLimit:]
+	}
+	for _, job := range list {
+		if len(job.Log) > jobHistoryLogLines {
+			job.Log = job.Log[len(job.Log)-jobHistoryLogLines:]
+		}
+	}
+	data, err := json.MarshalIndent(map[string][]*Job{"jobs": list}, "", "  ")
+	if err != nil {
+		fmt.Printf("Warning: failed to save job history: %s\n", err)
+		return
+	}
+
+	jobHistoryMu.Lock()
+	defer jobHistoryMu.Unlock()
+	tmp := jobHistoryPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		fmt.Printf("Warning: failed to save job history: %s\n", err)
+		return
+	}
+	if err := os.Rename(tmp, jobHistoryPath); err != nil {
+		fmt.Printf("Warning: failed to save job history: %s\n", err)
+	}
+}
+
+// Load the jobs saved before Porter last stopped; run from main before
+// anything is queued
+func (m *jobManager) restoreHistory() {
+	data, err := os.ReadFile(jobHistoryPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: could not read job history %s: %s\n", jobHistoryPath, err)
+		}
+		return
+	}
+	var history struct {
+		Jobs []*Job `json:"jobs"`
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		fmt.Printf("Warning: invalid job history %s: %s (starting empty)\n", jobHistoryPath, err)
+		return
+	}
+
+	interrupted := 0
+	now := time.Now().UTC()
+	m.Lock()
+	for _, job := range history.Jobs {
+		if job.ID == "" || m.jobs[job.ID] != nil {
+			continue
+		}
+		// A boot test reopens a completed job; its container is not Porter's to
+		// follow any more
+		if job.BootTest != nil && job.BootTest.State != "failed" && job.BootTest.State != "stopped" {
+			job.BootTest.State = "stopped"
+			job.BootTest.Message = "Porter restarted; remove container " + job.BootTest.Container + " if it is still running"
+			if job.State == jobRunning {
+				job.State = jobCompleted
+			}
+		}
+		if job.State != jobCompleted && job.State != jobFailed && job.State != jobCancelled {
+			job.Message = fmt.Sprintf("Interrupted: Porter restarted while this job was %s. Submit it again to rerun it.", job.State)
+			job.State = jobFailed
+			job.FinishedAt = &now
+			job.EstimatedStart, job.ETA = nil, nil
+			interrupted++
+		}
+		// Re-imports and images need the destination settings; profiles may
+		// have changed since, in which case those aren't offered
+		job.settings, _ = resolveUploadSettings(job.Spec)
+		job.ctx, job.cancel = context.WithCancel(context.Background())
+		job.done = make(chan struct{})
+		close(job.done)
+		job.subscribers = map[chan JobEvent]bool{}
+		if job.Results == nil {
+			job.Results = []UploadResult{}
+		}
+		m.jobs[job.ID] = job
+		m.order = append(m.order, job)
+	}
+	m.prune()
+	m.Unlock()
+	fmt.Printf("Restored %d job(s) from %s", len(history.Jobs), jobHistoryPath)
+	if interrupted > 0 {
+		fmt.Printf(" (%d interrupted by the restart)", interrupted)
+	}
+	fmt.Println()
+}
+
+// Forget the oldest finished jobs beyond jobHistoryLimit; queued and running
+// jobs are kept whatever their age. Callers must hold the lock.
+func (m *jobManager) prune() {
+	excess := len(m.order) - jobHistoryLimit
+	if excess <= 0 {
+		return
+	}
+	kept := m.order[:0]
+	for _, job := range m.order {
+		if excess > 0 {
+			switch job.state() {
+			case jobCompleted, jobFailed, jobCancelled:
+				delete(m.jobs, job.ID)
+				excess--
+				continue
+			}
+		}
+		kept = append(kept, job)
+	}
+	clear(m.order[len(kept):])
+	m.order = kept
+}
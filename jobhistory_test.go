@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJobManagerPrune(t *testing.T) {
+	m := &jobManager{jobs: map[string]*Job{}}
+	add := func(id, state string) {
+		job := &Job{ID: id, State: state}
+		m.jobs[id] = job
+		m.order = append(m.order, job)
+	}
+	// The oldest job is still running and outlives the finished ones after it
+	add("running", jobRunning)
+	add("failed", jobFailed)
+	add("cancelled", jobCancelled)
+	for i := 0; i < jobHistoryLimit; i++ {
+		add(fmt.Sprintf("job-%d", i), jobCompleted)
+	}
+	m.prune()
+
+	if len(m.order) != jobHistoryLimit || len(m.jobs) != jobHistoryLimit {
+		t.Fatalf("kept %d job(s) (%d by ID), want %d", len(m.order), len(m.jobs), jobHistoryLimit)
+	}
+	for _, id := range []string{"failed", "cancelled", "job-0"} {
+		if _, ok := m.jobs[id]; ok {
+			t.Errorf("job %s was kept", id)
+		}
+	}
+	if m.order[0].ID != "running" || m.order[1].ID != "job-1" {
+		t.Errorf("kept jobs start %s, %s; want running, job-1", m.order[0].ID, m.order[1].ID)
+	}
+	last := fmt.Sprintf("job-%d", jobHistoryLimit-1)
+	if m.order[len(m.order)-1].ID != last {
+		t.Errorf("newest kept job is %s, want %s", m.order[len(m.order)-1].ID, last)
+	}
+}
@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobPaused    = "paused"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// JobSpec describes what a job should do; it is the body of POST /api/jobs and the
+// spec of an exported pipeline (so fields carry both json and yaml tags)
+type JobSpec struct {
+	Cloud      string   `json:"cloud" yaml:"cloud"`
+	Files      []string `json:"files" yaml:"files"`
+	Target     string   `json:"target,omitempty" yaml:"target,omitempty"`
+	Account    string   `json:"account,omitempty" yaml:"account,omitempty"`
+	Container  string   `json:"container,omitempty" yaml:"container,omitempty"`
+	Bucket     string   `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Profile    string   `json:"profile,omitempty" yaml:"profile,omitempty"`
+	ExpireDays int      `json:"expireDays,omitempty" yaml:"expireDays,omitempty"`
+	Priority   int      `json:"priority,omitempty" yaml:"priority,omitempty"`
+	// Start immediately even outside the configured transfer windows
+	IgnoreWindow bool `json:"ignoreWindow,omitempty" yaml:"ignoreWindow,omitempty"`
+	// Storage class for GCP uploads (STANDARD, NEARLINE or COLDLINE)
+	StorageClass string `json:"storageClass,omitempty" yaml:"storageClass,omitempty"`
+	// Where clouds that import images put them: region, resource group, and the
+	// operating system to register the image as (e.g. ubuntu-22-04-amd64 on IBM Cloud)
+	Region        string `json:"region,omitempty" yaml:"region,omitempty"`
+	ResourceGroup string `json:"resourceGroup,omitempty" yaml:"resourceGroup,omitempty"`
+	OSName        string `json:"osName,omitempty" yaml:"osName,omitempty"`
+	// WebDAV share, FTP server or vCenter URL (e.g. https://cloud.example.com/remote.php/dav/files/alice
+	// or ftps://ftp.example.com), or an S3-compatible endpoint for the aws target (e.g. http://minio.local:9000)
+	URL string `json:"url,omitempty" yaml:"url,omitempty"`
+	// Path-style S3 addressing (https://endpoint/bucket/key), which MinIO and Ceph RGW usually need
+	PathStyle bool `json:"pathStyle,omitempty" yaml:"pathStyle,omitempty"`
+	// vSphere placement: datastore, resource pool and the network OVA NICs connect to
+	Datastore    string `json:"datastore,omitempty" yaml:"datastore,omitempty"`
+	ResourcePool string `json:"resourcePool,omitempty" yaml:"resourcePool,omitempty"`
+	Network      string `json:"network,omitempty" yaml:"network,omitempty"`
+	// SSH destination (user@host or user@host:port) for rsync uploads
+	Host string `json:"host,omitempty" yaml:"host,omitempty"`
+	// Credentials for an SMB share (DOMAIN\user); the password is not kept in the job
+	Username string `json:"username,omitempty" yaml:"username,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+	// Checksums to compute and record for each file (sha256, sha1, md5, crc32c)
+	Checksums []string `json:"checksums,omitempty" yaml:"checksums,omitempty"`
+	// Upload stream stages (see stream.go): gzip compression and encryption
+	// for http, webdav and local destinations, and a bandwidth limit in MB/s
+	Compress      string  `json:"compress,omitempty" yaml:"compress,omitempty"`
+	Encrypt       bool    `json:"encrypt,omitempty" yaml:"encrypt,omitempty"`
+	BandwidthMBps float64 `json:"bandwidthMBps,omitempty" yaml:"bandwidthMBps,omitempty"`
+	// Class sharing the instance's bandwidth cap (see bandwidth.go); default the profile's
+	BandwidthClass string `json:"bandwidthClass,omitempty" yaml:"bandwidthClass,omitempty"`
+	// Create an image from the upload where the cloud imports images: an AMI
+	// (aws ec2 import-image), an Azure image, a Compute Engine image (gcloud
+	// compute images import, with osName as --os), a VPC or ECS custom image, or
+	// a Proxmox, XCP-ng or oVirt VM
+	CreateImage bool `json:"createImage,omitempty" yaml:"createImage,omitempty"`
+	// How AWS AMIs are imported: image (ec2 import-image), snapshot
+	// (import-snapshot and register-image) or ebs (raw disks written into a
+	// snapshot with the EBS direct APIs, without a bucket; see awsebs.go);
+	// default image, or snapshot for aarch64 guests (see awssnapshot.go)
+	AWSImport string `json:"awsImport,omitempty" yaml:"awsImport,omitempty"`
+	// Turn the oVirt VM created with createImage into a template
+	Template bool `json:"template,omitempty" yaml:"template,omitempty"`
+	// Hyper-V generation (1 or 2) for Azure images and Hyper-V scripts, and
+	// whether to enable Secure Boot and a TPM; unset follows the disk (see platform.go)
+	Generation int   `json:"generation,omitempty" yaml:"generation,omitempty"`
+	SecureBoot *bool `json:"secureBoot,omitempty" yaml:"secureBoot,omitempty"`
+	TPM        *bool `json:"tpm,omitempty" yaml:"tpm,omitempty"`
+	// Vagrant box provider: libvirt (default) or virtualbox
+	BoxProvider string `json:"boxProvider,omitempty" yaml:"boxProvider,omitempty"`
+	// KubeVirt containerdisk export: oci-archive (default) or oci, and the image reference to tag it with
+	ArchiveFormat string `json:"archiveFormat,omitempty" yaml:"archiveFormat,omitempty"`
+	ImageRef      string `json:"imageRef,omitempty" yaml:"imageRef,omitempty"`
+	// Version to publish to an artifact repository or Azure Compute Gallery as
+	// (default: from the job's creation time)
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+	// Azure Compute Gallery image definition to publish Azure images and
+	// managed disks to ([resourceGroup/]gallery/definition); see gallery.go
+	Gallery string `json:"gallery,omitempty" yaml:"gallery,omitempty"`
+	// Regions to replicate a gallery image version to, or to copy AMIs to;
+	// see amicopy.go
+	TargetRegions []string `json:"targetRegions,omitempty" yaml:"targetRegions,omitempty"`
+	// AWS accounts to share AMIs and their copies with
+	ShareAccounts []string `json:"shareAccounts,omitempty" yaml:"shareAccounts,omitempty"`
+
+	// Pipeline jobs name a VM and an OVA/VMDK path or http(s) URL instead of files;
+	// the source is extracted and converted to format (raw by default) before upload
+	Name   string `json:"name,omitempty" yaml:"name,omitempty"`
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+	Format string `json:"format,omitempty" yaml:"format,omitempty"`
+	// qemu-img subformat of the converted disks (e.g. fixed VHDX, monolithicFlat VMDK)
+	Subformat string `json:"subformat,omitempty" yaml:"subformat,omitempty"`
+	// Guest modification steps applied to converted images (see guest.go)
+	GuestSteps []string `json:"guestSteps,omitempty" yaml:"guestSteps,omitempty"`
+	// OVA extraction filters (see ovafilter.go): skip entries over extractMaxMB
+	// or of the extractSkip types (e.g. iso), and extract only the disks of
+	// one VirtualSystem (its ID or name) of an OVA holding several VMs
+	ExtractMaxMB  int      `json:"extractMaxMB,omitempty" yaml:"extractMaxMB,omitempty"`
+	ExtractSkip   []string `json:"extractSkip,omitempty" yaml:"extractSkip,omitempty"`
+	VirtualSystem string   `json:"virtualSystem,omitempty" yaml:"virtualSystem,omitempty"`
+	// Existing migration ticket to update (Jira issue key, ServiceNow number or
+	// sys_id) instead of opening one; see ticket.go
+	Ticket string `json:"ticket,omitempty" yaml:"ticket,omitempty"`
+}
+
+type JobProgress struct {
+	Current    int    `json:"current"`
+	Total      int    `json:"total"`
+	Percentage int    `json:"percentage"`
+	Status     string `json:"status"`
+	// Smoothed transfer or conversion rate; see stall.go
+	ThroughputMBps float64 `json:"throughputMBps,omitempty"`
+	// The cloud-side task (e.g. an image import) the job is waiting on; see cloudtask.go
+	Task *CloudTask `json:"task,omitempty"`
+}
+
+// Outcome of uploading one file
+type UploadResult struct {
+	File        string `json:"file"`
+	Destination string `json:"destination,omitempty"`
+	Error       string `json:"error,omitempty"`
+	// SHA-256 of verified local copies
+	Checksum string `json:"checksum,omitempty"`
+	Verified bool   `json:"verified,omitempty"`
+	// The checksums the job was asked for, by algorithm
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// Image created from the upload by clouds that import images (e.g. an IBM VPC image ID)
+	Image string `json:"image,omitempty"`
+	// Why an image import failed and what fixes it, for known failures; see awsimport.go
+	Diagnosis *ImportDiagnosis `json:"diagnosis,omitempty"`
+	// Copies of the image in other regions; see amicopy.go
+	Copies []ImageCopy `json:"copies,omitempty"`
+	// Size of the source file and when its transfer ran, for the transfer report
+	Size       int64      `json:"size,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// An event streamed to job subscribers
+type JobEvent struct {
+	Type     string       `json:"type"`
+	State    string       `json:"state,omitempty"`
+	Message  string       `json:"message,omitempty"`
+	Progress *JobProgress `json:"progress,omitempty"`
+	Job      *Job         `json:"job,omitempty"`
+}
+
+// A background upload job
+type Job struct {
+	ID         string         `json:"id"`
+	State      string         `json:"state"`
+	Spec       JobSpec        `json:"spec"`
+	Priority   int            `json:"priority"`
+	Progress   JobProgress    `json:"progress"`
+	Files      []string       `json:"files,omitempty"`
+	Results    []UploadResult `json:"results"`
+	Message    string         `json:"message,omitempty"`
+	Warnings   []string       `json:"warnings,omitempty"`
+	Log        []string       `json:"log"`
+	CreatedAt  time.Time      `json:"createdAt"`
+	StartedAt  *time.Time     `json:"startedAt,omitempty"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+
+	// Readiness of a pipeline job's disks for its cloud; see readiness.go
+	Readiness []DiskReadiness `json:"readiness,omitempty"`
+
+	// The disks a pipeline job converted; see conversion.go
+	Conversions []ConversionResult `json:"conversions,omitempty"`
+
+	// Estimated run time from input sizes and past throughput, and the expected
+	// start (while queued) and finish times; see eta.go
+	EstimatedSeconds int64      `json:"estimatedSeconds,omitempty"`
+	EstimatedStart   *time.Time `json:"estimatedStart,omitempty"`
+	ETA              *time.Time `json:"eta,omitempty"`
+
+	// AMI registered from an AWS job's upload, and its Migration Hub task; see migrationhub.go
+	ImageID       string `json:"imageId,omitempty"`
+	MigrationTask string `json:"migrationTask,omitempty"`
+
+	// The migration ticket opened or updated for the job; see ticket.go
+	Ticket string `json:"ticket,omitempty"`
+
+	// No progress for stallMinutes, and how often a stalled step was restarted; see stall.go
+	Stalled       bool `json:"stalled,omitempty"`
+	StallRestarts int  `json:"stallRestarts,omitempty"`
+
+	// A local boot test of the job's disk; see boottest.go
+	BootTest *BootTest `json:"bootTest,omitempty"`
+
+	mu          sync.Mutex
+	settings    uploadSettings
+	ctx         context.Context
+	cancel      context.CancelFunc
+	done        chan struct{}
+	subscribers map[chan JobEvent]bool
+
+	// Pause support: the CLI process in flight and a channel closed on resume
+	cmd              *exec.Cmd
+	resumed          chan struct{}
+	pausedBySchedule bool
+
+	// Stall detection: when the job last progressed, bytes through Porter's own
+	// copies, the previous check's byte counts, and a command killed to be rerun
+	lastProgress  time.Time
+	waiting       bool
+	bytesCopied   atomic.Int64
+	lastCopied    int64
+	lastProcBytes int64
+	sampledCmd    *exec.Cmd
+	restarting    *exec.Cmd
+
+	// Checksums of files taken while they were streamed to the destination; see stream.go
+	streamedSums map[string]map[string]string
+}
+
+// Record a problem that does not stop the job but needs the user's attention
+func (j *Job) warnf(format string, args ...interface{}) {
+	warning := fmt.Sprintf(tr(format), args...)
+	j.mu.Lock()
+	j.Warnings = append(j.Warnings, warning)
+	j.mu.Unlock()
+	j.logf("Warning: %s", warning)
+}
+
+// Keep the in-memory log bounded for long-running jobs
+const maxJobLogLines = 1000
+
+// Append a line to the job log and stream it to subscribers
+func (j *Job) logf(format string, args ...interface{}) {
+	line := fmt.Sprintf(tr(format), args...)
+	fmt.Printf("[job %s] %s\n", j.ID, line)
+
+	j.mu.Lock()
+	j.Log = append(j.Log, line)
+	if len(j.Log) > maxJobLogLines {
+		j.Log = j.Log[len(j.Log)-maxJobLogLines:]
+	}
+	j.mu.Unlock()
+	j.publish(JobEvent{Type: "log", Message: line})
+}
+
+// Update the status line shown in progress displays
+func (j *Job) setStatus(format string, args ...interface{}) {
+	status := fmt.Sprintf(tr(format), args...)
+	j.mu.Lock()
+	j.Progress.Status = status
+	j.lastProgress = time.Now()
+	progress := j.Progress
+	j.mu.Unlock()
+
+	j.logf("%s", status)
+	publishLegacyProgress(progress)
+	j.publish(JobEvent{Type: "progress", Progress: &progress})
+}
+
+// Update how many files have been processed
+func (j *Job) setCurrent(current int) {
+	j.mu.Lock()
+	j.Progress.Current = current
+	j.lastProgress = time.Now()
+	if j.Progress.Total > 0 {
+		j.Progress.Percentage = (current * 100) / j.Progress.Total
+	}
+	progress := j.Progress
+	j.mu.Unlock()
+
+	publishLegacyProgress(progress)
+	j.publish(JobEvent{Type: "progress", Progress: &progress})
+}
+
+func (j *Job) setState(state string) {
+	j.mu.Lock()
+	j.State = state
+	now := time.Now().UTC()
+	switch state {
+	case jobRunning:
+		j.StartedAt = &now
+		j.lastProgress = now
+	case jobCompleted, jobFailed, jobCancelled:
+		j.FinishedAt = &now
+		j.EstimatedStart, j.ETA = nil, nil
+	}
+	started := j.StartedAt != nil
+	j.mu.Unlock()
+	j.publish(JobEvent{Type: "state", State: state})
+	migrationPlan.trackJob(j)
+	saveTransferReport(j)
+	if state == jobCompleted && config.Attestation.Mode != "" {
+		go attestJob(j)
+	}
+	jobs.saveHistory()
+	// Jobs cancelled while queued never get a ticket
+	if started {
+		queueTicketUpdate(j, state)
+		switch state {
+		case jobCompleted, jobFailed, jobCancelled:
+			queueNotification(j, state)
+		}
+	}
+}
+
+func (j *Job) state() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.State
+}
+
+func (j *Job) finished() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.State == jobCompleted || j.State == jobFailed || j.State == jobCancelled
+}
+
+// A consistent copy of the job for JSON encoding
+func (j *Job) snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &Job{
+		ID:          j.ID,
+		State:       j.State,
+		Spec:        j.Spec,
+		Priority:    j.Priority,
+		Progress:    j.Progress,
+		Files:       j.Files,
+		Results:     append([]UploadResult{}, j.Results...),
+		Message:     j.Message,
+		Warnings:    append([]string{}, j.Warnings...),
+		Readiness:   append([]DiskReadiness{}, j.Readiness...),
+		Conversions: append([]ConversionResult{}, j.Conversions...),
+		Log:         append([]string{}, j.Log...),
+		CreatedAt:   j.CreatedAt,
+		StartedAt:   j.StartedAt,
+		FinishedAt:  j.FinishedAt,
+
+		EstimatedSeconds: j.EstimatedSeconds,
+		EstimatedStart:   j.EstimatedStart,
+		ETA:              j.ETA,
+
+		ImageID:       j.ImageID,
+		MigrationTask: j.MigrationTask,
+		Ticket:        j.Ticket,
+		Stalled:       j.Stalled,
+		StallRestarts: j.StallRestarts,
+		BootTest:      j.BootTest,
+	}
+}
+
+// Subscribe to job events; call the returned function to unsubscribe
+func (j *Job) subscribe() (chan JobEvent, func()) {
+	ch := make(chan JobEvent, 64)
+	j.mu.Lock()
+	j.subscribers[ch] = true
+	j.mu.Unlock()
+	return ch, func() {
+		j.mu.Lock()
+		delete(j.subscribers, ch)
+		j.mu.Unlock()
+	}
+}
+
+// Send an event to subscribers, dropping it for any that are not keeping up
+func (j *Job) publish(event JobEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Keep /upload/progress working for the page's progress overlay
+func publishLegacyProgress(progress JobProgress) {
+	uploadProgress.Lock()
+	uploadProgress.Current = progress.Current
+	uploadProgress.Total = progress.Total
+	uploadProgress.Status = progress.Status
+	uploadProgress.Unlock()
+}
+
+// The job queue. Queued jobs start in priority order (then oldest first)
+// while fewer than maxConcurrentJobs are running.
+type jobManager struct {
+	sync.Mutex
+	jobs    map[string]*Job
+	order   []*Job
+	queue   []*Job
+	running int
+}
+
+var jobs = &jobManager{jobs: map[string]*Job{}}
+
+// Create and enqueue a job for an already-validated spec
+func (m *jobManager) submit(spec JobSpec, settings uploadSettings) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	// The settings carry the password; the spec is shown and exported
+	spec.Password = ""
+	job := &Job{
+		ID:               newID(),
+		State:            jobQueued,
+		Spec:             spec,
+		Priority:         spec.Priority,
+		Progress:         JobProgress{Total: len(spec.Files), Status: tr("Queued")},
+		Files:            spec.Files,
+		EstimatedSeconds: estimateJobSeconds(spec, settings.Cloud),
+		Results:          []UploadResult{},
+		Log:              []string{},
+		CreatedAt:        time.Now().UTC(),
+		settings:         settings,
+		ctx:              ctx,
+		cancel:           cancel,
+		done:             make(chan struct{}),
+		subscribers:      map[chan JobEvent]bool{},
+	}
+
+	m.Lock()
+	m.jobs[job.ID] = job
+	m.order = append(m.order, job)
+	m.queue = append(m.queue, job)
+	m.prune()
+	m.Unlock()
+
+	if spec.Source != "" {
+		fmt.Printf("Queued job %s: pipeline %s → %s (priority %d)\n", job.ID, spec.Source, settings.Cloud, job.Priority)
+	} else {
+		fmt.Printf("Queued job %s: upload %d file(s) to %s (priority %d)\n", job.ID, len(spec.Files), settings.Cloud, job.Priority)
+	}
+	if spec.Name != "" && migrationPlan.link("", job) {
+		job.logf("Linked to migration plan entry for VM %s", spec.Name)
+	}
+	if job.waitsForWindow() {
+		job.setStatus("Waiting for transfer window (%s)", describeSchedule())
+	}
+	m.schedule()
+	m.updateETAs()
+	m.saveHistory()
+	return job
+}
+
+func (m *jobManager) get(id string) (*Job, bool) {
+	m.Lock()
+	defer m.Unlock()
+	job, ok := m.jobs[id]
+	return job, ok
+}
+
+func (m *jobManager) list() []*Job {
+	m.Lock()
+	defer m.Unlock()
+	var list []*Job
+	for _, job := range m.order {
+		list = append(list, job.snapshot())
+	}
+	return list
+}
+
+// Start queued jobs while there are free slots
+func (m *jobManager) schedule() {
+	m.Lock()
+	defer m.Unlock()
+
+	sort.SliceStable(m.queue, func(a, b int) bool {
+		return m.queue[a].priority() > m.queue[b].priority()
+	})
+	for i := 0; m.running < config.MaxConcurrentJobs && i < len(m.queue); {
+		job := m.queue[i]
+		if job.waitsForWindow() {
+			i++
+			continue
+		}
+		m.queue = append(m.queue[:i], m.queue[i+1:]...)
+		m.running++
+		go m.run(job)
+	}
+}
+
+// Whether the job must stay queued until the transfer window opens
+func (j *Job) waitsForWindow() bool {
+	return !j.Spec.IgnoreWindow && !transfersAllowed(time.Now())
+}
+
+func (m *jobManager) run(job *Job) {
+	defer func() {
+		m.Lock()
+		m.running--
+		m.Unlock()
+		close(job.done)
+		m.schedule()
+	}()
+
+	job.setState(jobRunning)
+	runUploadJob(job)
+}
+
+// Cancel a queued or running job
+func (m *jobManager) cancelJob(job *Job) {
+	m.Lock()
+	for i, queued := range m.queue {
+		if queued == job {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			m.Unlock()
+			job.cancel()
+			job.setState(jobCancelled)
+			job.logf("Job cancelled before it started")
+			close(job.done)
+			return
+		}
+	}
+	m.Unlock()
+
+	job.logf("Cancelling job...")
+	job.cancel()
+	// A stopped process must be continued so it can handle the kill and exit
+	job.resume()
+}
+
+// Change a job's priority; this affects its position while queued
+func (m *jobManager) setPriority(job *Job, priority int) {
+	job.mu.Lock()
+	job.Priority = priority
+	job.mu.Unlock()
+	job.logf("Priority changed to %d", priority)
+	m.schedule()
+}
+
+func (j *Job) priority() int {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Priority
+}
+
+// Upload every file in the job, recording results in the catalog
+func runUploadJob(job *Job) {
+	s := job.settings
+	files := job.Spec.Files
+	if job.Spec.Source != "" {
+		prepared, err := prepareSource(job)
+		if err != nil {
+			state, prefix := jobFailed, tr("❌ Pipeline failed: ")
+			if job.ctx.Err() != nil {
+				state, prefix = jobCancelled, tr("🛑 Pipeline cancelled: ")
+			}
+			job.logf("%s", err)
+			job.mu.Lock()
+			job.Message = prefix + err.Error()
+			job.mu.Unlock()
+			job.setStatus("%s%s", prefix, err)
+			job.setState(state)
+			return
+		}
+		files = prepared
+		job.mu.Lock()
+		job.Files = files
+		job.Progress.Total = len(files)
+		// Now the converted sizes are known, estimate the rest of the job from them
+		job.EstimatedSeconds = int64(time.Since(*job.StartedAt).Seconds()) + estimateJobSeconds(JobSpec{Files: files, Compress: s.Compress}, s.Cloud)
+		job.mu.Unlock()
+	}
+	job.logf("Starting upload of %d file(s) to %s", len(files), s.Cloud)
+
+	var message strings.Builder
+	var successCount, failCount int
+	var bundle *bundleWriter
+	if s.Cloud == "bundle" {
+		bundle = newBundleWriter(job, s)
+	}
+
+	for i, file := range files {
+		job.waitIfPaused()
+		if job.ctx.Err() != nil {
+			break
+		}
+		job.setCurrent(i)
+		job.logf("[%d/%d] Uploading %s to %s", i+1, len(files), file, s.Cloud)
+		logImageUsage(job, s, file)
+		checkGuestArch(job, s, file)
+
+		// A file still being converted or extracted is waited for; only cancelling fails
+		releaseFile, lockErr := job.lockWorkspace([]string{file}, nil)
+		if lockErr != nil {
+			break
+		}
+
+		var dest, label, checksum, image string
+		var copies []ImageCopy
+		var err error
+		started := time.Now()
+		switch s.Cloud {
+		case "aws":
+			label = "AWS upload succeeded"
+			if s.AWSImport == awsImportEBS {
+				label = "EBS snapshot written"
+				awsImportMethod(job, s, file)
+				dest, err = uploadToEBS(job, s, file)
+				if err == nil && s.CreateImage {
+					label = "AMI registered"
+					image, err = registerAMI(job, s, file, dest, awsBootMode(job, file))
+				}
+			} else {
+				if err = refreshJobCredentials(job, &s); err == nil {
+					dest, err = uploadToAWS(job, s, file)
+				}
+				if err == nil && s.CreateImage {
+					label = "AMI imported"
+					image, err = importAWSImage(job, s, file, dest, "")
+				}
+			}
+			if err == nil && image != "" {
+				copies = copyAMI(job, s, file, image)
+			}
+		case "azure":
+			label = "Azure upload succeeded"
+			var platform vmPlatform
+			if s.CreateImage {
+				platform, err = platformForDisk(job, s, file)
+			}
+			if err == nil {
+				err = refreshJobCredentials(job, &s)
+			}
+			if err == nil {
+				dest, err = uploadToAzure(job, s, file)
+			}
+			if err == nil && s.CreateImage {
+				label = "Azure image created"
+				image, err = createAzureImage(job, s, file, dest, platform)
+			} else if err == nil && azurePageBlob(s, file) {
+				job.logf("Create an Azure image from %s later with POST /api/jobs/%s/azure-image", dest, job.ID)
+			}
+			if err == nil && s.Gallery != "" {
+				var version string
+				if version, err = publishToGallery(job, s, i, file, image, platform); version != "" {
+					label, image = "Published to Azure Compute Gallery", version
+				}
+			}
+		case "azuredisk":
+			label = "Azure managed disk created"
+			var platform vmPlatform
+			platform, err = platformForDisk(job, s, file)
+			if err == nil {
+				dest, err = uploadToAzureDisk(job, s, file, platform)
+			}
+			if err == nil && s.Gallery != "" {
+				var version string
+				if version, err = publishToGallery(job, s, i, file, dest, platform); version != "" {
+					label, image = "Published to Azure Compute Gallery", version
+				}
+			}
+		case "gcp":
+			label = "GCP upload succeeded"
+			dest, err = uploadToGCP(job, s, file)
+			if err == nil && s.CreateImage {
+				label = "GCE image created"
+				image, err = createGCEImage(job, s, dest)
+			}
+		case "ibm":
+			label = "IBM COS upload succeeded"
+			dest, err = uploadToIBM(job, s, file)
+			if err == nil && s.CreateImage {
+				label = "IBM VPC custom image created"
+				image, err = createIBMImage(job, s, file, dest)
+			}
+		case "alibaba":
+			label = "Alibaba OSS upload succeeded"
+			dest, err = uploadToAlibaba(job, s, file)
+			if err == nil && s.CreateImage {
+				label = "Alibaba ECS image imported"
+				image, err = importAlibabaImage(job, s, file, dest)
+			}
+		case "oracle":
+			dest, err = uploadToOracle(job, s, file)
+		case "spaces":
+			dest, err = uploadToSpaces(job, s, file)
+		case "b2":
+			dest, err = uploadToB2(job, s, file)
+		case "swift":
+			label = "Swift upload succeeded"
+			dest, err = uploadToSwift(job, s, file)
+		case "linode":
+			label = "Linode custom image created"
+			dest, err = uploadToLinode(job, s, file)
+			image = dest
+		case "vultr":
+			label = "Vultr snapshot created"
+			dest, err = uploadToVultr(job, s, file)
+			image = dest
+		case "webdav":
+			label = "WebDAV upload succeeded"
+			dest, err = uploadToWebDAV(job, s, file)
+		case "http":
+			label = "HTTP upload succeeded"
+			dest, err = uploadToHTTP(job, s, file)
+		case "porter":
+			label = "Sent to the receiving Porter (checksum verified)"
+			dest, checksum, err = uploadToPorter(job, s, file)
+		case "artifactory", "nexus":
+			label = "Published to the artifact repository (checksum verified)"
+			dest, checksum, err = uploadToArtifactRepo(job, s, file)
+		case "rsync":
+			label = "rsync upload succeeded"
+			dest, err = uploadToRsync(job, s, file)
+		case "ftp":
+			label = "FTP upload succeeded"
+			dest, err = uploadToFTP(job, s, file)
+		case "smb":
+			label = "Copied to SMB share"
+			dest, err = uploadToSMB(job, s, file)
+			if err == nil && isHyperVDisk(file) && s.Compress == "" && !s.Encrypt {
+				writeHyperVScript(job, s, file)
+			}
+		case "nfs":
+			label = "Copied to NFS export (checksum verified)"
+			dest, checksum, err = uploadToNFS(job, s, file)
+		case "vsphere":
+			label = "vSphere import succeeded"
+			dest, image, err = uploadToVSphere(job, s, file)
+		case "datastore":
+			label = "Copied to vSphere datastore"
+			dest, err = uploadToDatastore(job, s, file)
+		case "library":
+			label = "Published to vSphere content library"
+			dest, err = publishToContentLibrary(job, s, file)
+		case "proxmox":
+			label = "Proxmox upload succeeded"
+			if s.CreateImage {
+				label = "Proxmox VM created"
+			}
+			dest, image, err = uploadToProxmox(job, s, file)
+		case "xcpng":
+			label = "Imported into the XCP-ng pool"
+			if s.CreateImage {
+				label = "XCP-ng VM imported"
+			}
+			dest, image, err = uploadToXAPI(job, s, file)
+		case "ovirt":
+			label = "oVirt upload succeeded"
+			if s.Template {
+				label = "oVirt template created"
+			} else if s.CreateImage {
+				label = "oVirt VM created"
+			}
+			dest, image, err = uploadToOVirt(job, s, file)
+		case "nutanix":
+			label = "Added to the Nutanix image service"
+			dest, err = uploadToNutanix(job, s, file)
+		case "hyperv":
+			label = "Hyper-V VM created"
+			dest, image, err = uploadToHyperV(job, s, file)
+		case "xva":
+			label = "Packaged as XVA"
+			dest, err = packageXVA(job, s, file)
+		case "utm":
+			label = "Packaged as UTM bundle"
+			dest, err = packageUTM(job, s, file)
+		case "vagrant":
+			label = "Packaged as Vagrant box"
+			dest, err = packageVagrantBox(job, s, file)
+		case "containerdisk":
+			label = "Exported as KubeVirt containerdisk"
+			dest, image, err = packageContainerDisk(job, s, file)
+		case "incus":
+			label = "Packaged as Incus VM image"
+			dest, image, err = packageIncusImage(job, s, file)
+		case "bundle":
+			label = "Added to bundle"
+			dest, checksum, err = bundle.add(job, file)
+		case "bundle-import":
+			label = "Bundle verified and imported"
+			dest, err = importBundle(job, file)
+		case "local":
+			label = "Saved locally (checksum verified)"
+			dest, checksum, err = copyToLocal(job, s, file)
+			if err == nil && isHyperVDisk(file) {
+				writeHyperVScript(job, s, file)
+			}
+		default:
+			err = fmt.Errorf("unknown cloud target for %s", file)
+		}
+		// Streamed uploads hashed the file as they sent it
+		sums := job.streamedChecksums(file)
+		if err == nil && len(s.Checksums) > 0 && sums == nil {
+			sums, err = checksumFileForJob(job, file, s.Checksums)
+			if err == nil && s.Cloud == "gcp" {
+				err = verifyGCSChecksums(job, dest, sums)
+			}
+		}
+		releaseFile()
+
+		result := UploadResult{File: file, Destination: dest, Checksum: checksum, Verified: checksum != "", Image: image, Checksums: sums, Copies: copies}
+		startedAt, finishedAt := started.UTC(), time.Now().UTC()
+		result.StartedAt, result.FinishedAt = &startedAt, &finishedAt
+		if info, statErr := os.Stat(file); statErr == nil {
+			result.Size = info.Size()
+		}
+		if err != nil {
+			if job.ctx.Err() != nil {
+				err = fmt.Errorf("upload of %s cancelled", file)
+			}
+			result.Error = err.Error()
+			var importErr *importError
+			if errors.As(err, &importErr) {
+				result.Diagnosis = importErr.Diagnosis
+			}
+			job.logf("%s", err)
+			message.WriteString(err.Error() + "\n")
+			failCount++
+		} else {
+			size := result.Size
+			throughput.record(uploadStage(s.Cloud), size, time.Since(started))
+			entry := CatalogEntry{
+				Kind:        "upload",
+				Cloud:       s.Cloud,
+				Source:      file,
+				Destination: dest,
+				Size:        size,
+				Checksums:   sums,
+			}
+			switch s.Cloud {
+			case "azure", "azuredisk":
+				entry.Subscription = s.Subscription
+			case "aws":
+				entry.Endpoint, entry.Region, entry.PathStyle = s.URL, s.Region, s.PathStyle
+			case "spaces":
+				entry.Endpoint, entry.Region = spacesEndpoint(s.Region), s.Region
+			case "b2":
+				if s.Region != "" {
+					entry.Endpoint, entry.Region = b2S3Endpoint(s.Region), s.Region
+				}
+			case "alibaba", "oracle", "swift":
+				entry.Region = s.Region
+			case "vsphere", "datastore", "library", "proxmox", "xcpng", "ovirt", "nutanix", "hyperv", "http", "porter":
+				entry.Endpoint = s.URL
+			case "bundle-import":
+				entry.Kind = "import"
+			}
+			// Bundles are catalogued as a whole once written
+			if bundle == nil {
+				artifactCatalog.add(entry)
+			}
+
+			successMsg := fmt.Sprintf(tr("✅ %s: %s to %s"), tr(label), file, dest)
+			if image != "" {
+				successMsg += fmt.Sprintf(tr(" (image %s)"), image)
+			}
+			job.logf("%s", successMsg)
+			message.WriteString(successMsg + "\n")
+			successCount++
+		}
+
+		job.mu.Lock()
+		job.Results = append(job.Results, result)
+		job.mu.Unlock()
+	}
+
+	if bundle != nil {
+		if err := bundle.finish(job); err != nil {
+			job.logf("%s", err)
+			message.WriteString("❌ " + err.Error() + "\n")
+			failCount += successCount
+			successCount = 0
+		}
+	}
+
+	// Create a summary message
+	summaryMsg := fmt.Sprintf(tr("Upload summary: %d successful, %d failed"), successCount, failCount)
+	job.logf("%s", summaryMsg)
+
+	// Determine status message based on results
+	var messagePrefix, state string
+	switch {
+	case job.ctx.Err() != nil:
+		messagePrefix = "🛑 Upload cancelled. "
+		state = jobCancelled
+	case failCount == 0:
+		messagePrefix = "✅ All uploads completed successfully! "
+		state = jobCompleted
+	case successCount == 0:
+		messagePrefix = "❌ All uploads failed. "
+		state = jobFailed
+	default:
+		messagePrefix = "⚠️ Some uploads completed, some failed. "
+		state = jobFailed
+	}
+
+	job.mu.Lock()
+	job.Message = fmt.Sprintf("%s%s\n\n%s", tr(messagePrefix), summaryMsg, message.String())
+	job.mu.Unlock()
+
+	job.setCurrent(len(files))
+	job.setStatus("Upload completed: %d successful, %d failed", successCount, failCount)
+	job.setState(state)
+}
+
+// Build a job spec from the upload form
+func jobSpecFromForm(r *http.Request) (JobSpec, *APIError) {
+	spec := JobSpec{
+		Cloud:     r.FormValue("cloud"),
+		Files:     r.Form["files"],
+		Target:    r.FormValue("target"),
+		Account:   r.FormValue("account"),
+		Container: r.FormValue("container"),
+		Bucket:    r.FormValue("bucket"),
+		Profile:   r.FormValue("profile"),
+
+		StorageClass:   r.FormValue("storage_class"),
+		Region:         r.FormValue("region"),
+		ResourceGroup:  r.FormValue("resource_group"),
+		OSName:         r.FormValue("os_name"),
+		URL:            r.FormValue("url"),
+		PathStyle:      r.FormValue("path_style") == "true",
+		Host:           r.FormValue("host"),
+		Username:       r.FormValue("username"),
+		Password:       r.FormValue("password"),
+		Datastore:      r.FormValue("datastore"),
+		ResourcePool:   r.FormValue("resource_pool"),
+		Network:        r.FormValue("network"),
+		Name:           r.FormValue("name"),
+		BoxProvider:    r.FormValue("box_provider"),
+		ArchiveFormat:  r.FormValue("archive_format"),
+		ImageRef:       r.FormValue("image_ref"),
+		Version:        r.FormValue("version"),
+		Gallery:        r.FormValue("gallery"),
+		TargetRegions:  strings.Fields(strings.ReplaceAll(r.FormValue("target_regions"), ",", " ")),
+		ShareAccounts:  strings.Fields(strings.ReplaceAll(r.FormValue("share_accounts"), ",", " ")),
+		IgnoreWindow:   r.FormValue("ignore_window") == "true",
+		CreateImage:    r.FormValue("create_image") == "true",
+		AWSImport:      r.FormValue("aws_import"),
+		Template:       r.FormValue("template") == "true",
+		Checksums:      r.Form["checksums"],
+		Compress:       r.FormValue("compress"),
+		Encrypt:        r.FormValue("encrypt") == "true",
+		BandwidthClass: r.FormValue("bandwidth_class"),
+	}
+	if bandwidth := r.FormValue("bandwidth_mbps"); bandwidth != "" {
+		n, err := strconv.ParseFloat(bandwidth, 64)
+		if err != nil {
+			return spec, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Invalid bandwidth limit: %s"), bandwidth),
+				Remediation: "Use a number of MB/s, or leave blank for no limit."}
+		}
+		spec.BandwidthMBps = n
+	}
+	if generation := r.FormValue("generation"); generation != "" {
+		n, err := strconv.Atoi(generation)
+		if err != nil {
+			return spec, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Invalid generation: %s"), generation),
+				Remediation: "Use 1 or 2, or leave blank to follow the disk's firmware."}
+		}
+		spec.Generation = n
+	}
+	// Tri-state: blank follows the disk
+	for field, dest := range map[string]**bool{"secure_boot": &spec.SecureBoot, "tpm": &spec.TPM} {
+		if value := r.FormValue(field); value != "" {
+			on := value == "true"
+			*dest = &on
+		}
+	}
+	if days := r.FormValue("expire_days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return spec, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Invalid expiry days: %s"), days),
+				Remediation: "Use a whole number of days, or leave blank to keep uploads."}
+		}
+		spec.ExpireDays = n
+	}
+	return spec, nil
+}
+
+// Handler to list jobs
+func jobsListHandler(w http.ResponseWriter, r *http.Request) {
+	jobs.updateETAs()
+	writeJSON(w, http.StatusOK, map[string][]*Job{"jobs": listOrEmptyJobs(jobs.list())})
+}
+
+// Handler to submit a job from a JSON spec, or from an exported YAML pipeline spec
+// (Content-Type: application/yaml). Repeated ?source= parameters replace the spec's
+// files so a pipeline can be re-run against a different source.
+func jobsCreateHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Failed to read request body", Details: err.Error()})
+		return
+	}
+	claim, status, apiErr := claimIdempotencyKey(r, append([]byte(r.URL.RawQuery+"\n"), body...))
+	if apiErr != nil {
+		writeAPIError(w, status, *apiErr)
+		return
+	}
+	defer claim.release()
+	if previous, ok := claim.replayed(w); ok {
+		if len(previous) == 0 {
+			writeAPIError(w, http.StatusConflict, errIdempotentJobPruned)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, previous[0].snapshot())
+		return
+	}
+
+	var spec JobSpec
+	if isYAMLRequest(r) {
+		pipeline, apiErr := decodePipelineSpec(bytes.NewReader(body))
+		if apiErr != nil {
+			writeAPIError(w, http.StatusBadRequest, *apiErr)
+			return
+		}
+		spec = pipeline.Spec
+	} else if err := json.Unmarshal(body, &spec); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "Invalid job spec", Details: err.Error()})
+		return
+	}
+	if sources := r.URL.Query()["source"]; len(sources) > 0 {
+		if spec.Source != "" {
+			spec.Source = sources[0]
+		} else {
+			spec.Files = sources
+		}
+	}
+	if apiErr := validatePipelineSpec(spec); apiErr != nil {
+		writeAPIError(w, http.StatusBadRequest, *apiErr)
+		return
+	}
+	settings, apiErr := resolveUploadSettings(spec)
+	if apiErr != nil {
+		writeAPIError(w, http.StatusBadRequest, *apiErr)
+		return
+	}
+
+	job := jobs.submit(spec, settings)
+	claim.record(job)
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+// Handler to fetch one job
+func jobGetHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	jobs.updateETAs()
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
+
+// Handler to cancel a job
+func jobCancelHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	if job.finished() {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Job has already finished: %s"), job.ID)})
+		return
+	}
+	jobs.cancelJob(job)
+	writeJSON(w, http.StatusAccepted, job.snapshot())
+}
+
+func listOrEmptyJobs(list []*Job) []*Job {
+	if list == nil {
+		return []*Job{}
+	}
+	return list
+}
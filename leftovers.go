@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Extraction leftovers: directories under the extraction directory (pipeline
+// job work folders, bundle OVFs, or folders users extracted into) that nothing
+// needs any more, because extracting or converting them failed, or because all
+// their disks were converted and the conversions uploaded. A background scan
+// every leftoverScanIntervalHours (porter.json, default 24) queues directories
+// untouched for leftoverAgeDays (default 7) for cleanup; nothing is deleted
+// until the cleanup is confirmed through the API, and dismissed directories are
+// not queued again unless they change.
+
+// A directory queued for cleanup
+type LeftoverDir struct {
+	ID           string    `json:"id"`
+	Path         string    `json:"path"`
+	Size         int64     `json:"size"`
+	Reason       string    `json:"reason"`
+	LastModified time.Time `json:"lastModified"`
+	DetectedAt   time.Time `json:"detectedAt"`
+}
+
+type leftoverQueue struct {
+	sync.Mutex
+	path    string
+	Pending []LeftoverDir `json:"pending"`
+	// Dismissed directories, with their last modification when dismissed
+	Dismissed map[string]time.Time `json:"dismissed,omitempty"`
+}
+
+var leftovers = loadLeftoverQueue(filepath.Join(stateDir, "leftovers.json"))
+
+func loadLeftoverQueue(path string) *leftoverQueue {
+	q := &leftoverQueue{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return q
+	}
+	if err := json.Unmarshal(data, q); err != nil {
+		fmt.Printf("Warning: invalid leftover queue %s: %s (starting empty)\n", path, err)
+		return &leftoverQueue{path: path}
+	}
+	return q
+}
+
+// Write the queue; callers must hold the lock
+func (q *leftoverQueue) save() {
+	data, err := json.MarshalIndent(q, "", "  ")
+	if err == nil {
+		os.MkdirAll(filepath.Dir(q.path), 0755)
+		err = os.WriteFile(q.path, data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save leftover queue: %s\n", err)
+	}
+}
+
+func (q *leftoverQueue) list() []LeftoverDir {
+	q.Lock()
+	defer q.Unlock()
+	return append([]LeftoverDir{}, q.Pending...)
+}
+
+func (q *leftoverQueue) get(id string) (LeftoverDir, bool) {
+	q.Lock()
+	defer q.Unlock()
+	for _, dir := range q.Pending {
+		if dir.ID == id {
+			return dir, true
+		}
+	}
+	return LeftoverDir{}, false
+}
+
+// Take a directory off the queue, remembering it as dismissed if asked to
+func (q *leftoverQueue) remove(id string, dismiss bool) {
+	q.Lock()
+	defer q.Unlock()
+	for i, dir := range q.Pending {
+		if dir.ID != id {
+			continue
+		}
+		q.Pending = append(q.Pending[:i], q.Pending[i+1:]...)
+		if dismiss {
+			if q.Dismissed == nil {
+				q.Dismissed = map[string]time.Time{}
+			}
+			q.Dismissed[dir.Path] = dir.LastModified
+		}
+		break
+	}
+	q.save()
+}
+
+// Replace the queue with the directories found by a scan, keeping the IDs of
+// those already queued
+func (q *leftoverQueue) update(found []LeftoverDir) []LeftoverDir {
+	q.Lock()
+	defer q.Unlock()
+	queued := map[string]LeftoverDir{}
+	for _, dir := range q.Pending {
+		queued[dir.Path] = dir
+	}
+	var pending []LeftoverDir
+	for _, dir := range found {
+		if modified, ok := q.Dismissed[dir.Path]; ok && modified.Equal(dir.LastModified) {
+			continue
+		}
+		if earlier, ok := queued[dir.Path]; ok {
+			dir.ID, dir.DetectedAt = earlier.ID, earlier.DetectedAt
+		} else {
+			fmt.Printf("Queued %s for cleanup (%.2f GB): %s\n", dir.Path, float64(dir.Size)/(1<<30), dir.Reason)
+		}
+		pending = append(pending, dir)
+	}
+	// Forget dismissals of directories that are gone
+	for path := range q.Dismissed {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			delete(q.Dismissed, path)
+		}
+	}
+	q.Pending = pending
+	q.save()
+	return append([]LeftoverDir{}, pending...)
+}
+
+// Why a directory under the extraction directory can be cleaned up, or "" if it
+// can't. Directories in use by a job, owned by a catalog entry, or modified in
+// the last maxAge are kept.
+func leftoverReason(dir string, now time.Time, maxAge time.Duration) (LeftoverDir, string) {
+	found := LeftoverDir{Path: dir}
+	var vmdks []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			if info.ModTime().After(found.LastModified) {
+				found.LastModified = info.ModTime()
+			}
+			if !d.IsDir() {
+				found.Size += info.Size()
+			}
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(path), ".vmdk") {
+			vmdks = append(vmdks, path)
+		}
+		return nil
+	})
+	found.LastModified = found.LastModified.UTC()
+	if now.Sub(found.LastModified) < maxAge {
+		return found, ""
+	}
+
+	name := filepath.Base(dir)
+	var failedJob string
+	for _, job := range jobs.list() {
+		if !strings.HasSuffix(name, "-"+job.ID) && !strings.HasPrefix(job.Spec.Source, dir+"/") {
+			continue
+		}
+		if !job.finished() {
+			return found, ""
+		}
+		if job.State == jobFailed || job.State == jobCancelled {
+			failedJob = job.ID
+		}
+	}
+
+	// Which disks were converted, and which conversions uploaded
+	converted := map[string]string{}
+	uploaded := map[string]bool{}
+	for _, entry := range artifactCatalog.list() {
+		switch entry.Kind {
+		case "import":
+			// Imported bundles' OVFs go when their catalog entry is deleted
+			if filepath.Base(entry.Destination) == name {
+				return found, ""
+			}
+		case "conversion":
+			if entry.Conversion != nil {
+				converted[entry.Conversion.Input] = entry.Destination
+			}
+		case "upload":
+			uploaded[entry.Source] = true
+		}
+	}
+
+	switch {
+	case failedJob != "":
+		return found, fmt.Sprintf("job %s failed or was cancelled", failedJob)
+	case len(vmdks) == 0:
+		return found, "no disks: extraction failed or was incomplete"
+	}
+	for _, vmdk := range vmdks {
+		output, ok := converted[vmdk]
+		if !ok || !uploaded[output] {
+			return found, ""
+		}
+	}
+	return found, "all disks converted and uploaded"
+}
+
+// Scan the extraction directory for leftovers and queue them for cleanup
+func scanLeftovers() []LeftoverDir {
+	maxAge := time.Duration(config.LeftoverAgeDays) * 24 * time.Hour
+	entries, err := os.ReadDir(extractDir)
+	if err != nil {
+		fmt.Printf("Warning: scanning %s for leftovers failed: %s\n", extractDir, err)
+		return leftovers.list()
+	}
+	now := time.Now()
+	var found []LeftoverDir
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(extractDir, entry.Name())
+		if leftover, reason := leftoverReason(dir, now, maxAge); reason != "" {
+			leftover.ID, leftover.Reason, leftover.DetectedAt = newID(), reason, now.UTC()
+			found = append(found, leftover)
+		}
+	}
+	return leftovers.update(found)
+}
+
+// Periodically queue extraction leftovers for cleanup
+func runLeftoverScanner() {
+	interval := time.Duration(config.LeftoverScanIntervalHours) * time.Hour
+	if interval <= 0 {
+		fmt.Println("Extraction leftover scanner disabled")
+		return
+	}
+	for {
+		scanLeftovers()
+		time.Sleep(interval)
+	}
+}
+
+// Handler for GET /api/leftovers: directories queued for cleanup
+func leftoversListHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]LeftoverDir{"leftovers": leftovers.list()})
+}
+
+// Handler for POST /api/leftovers/scan: scan for leftovers now
+func leftoversScanHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]LeftoverDir{"leftovers": scanLeftovers()})
+}
+
+// Handler for POST /api/leftovers/{id}/confirm: delete a queued directory,
+// after checking it is still unused
+func leftoverConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	dir, ok := leftovers.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown leftover: %s"), r.PathValue("id"))})
+		return
+	}
+	release, err := tryLockWorkspace("leftover cleanup", nil, []string{dir.Path})
+	if err != nil {
+		respondWorkspaceBusy(w, r, err)
+		return
+	}
+	defer release()
+	current, reason := leftoverReason(dir.Path, time.Now(), time.Duration(config.LeftoverAgeDays)*24*time.Hour)
+	if reason == "" || !current.LastModified.Equal(dir.LastModified) {
+		leftovers.remove(dir.ID, false)
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message:     fmt.Sprintf(tr("%s changed or is in use since it was queued"), dir.Path),
+			Remediation: "It was taken off the queue; a later scan queues it again if it is still a leftover."})
+		return
+	}
+	if err := os.RemoveAll(dir.Path); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+			Message: fmt.Sprintf(tr("Failed to delete %s"), dir.Path), Details: err.Error()})
+		return
+	}
+	leftovers.remove(dir.ID, false)
+	fmt.Printf("Deleted extraction leftover %s (%.2f GB)\n", dir.Path, float64(dir.Size)/(1<<30))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": dir.Path, "freedBytes": dir.Size})
+}
+
+// Handler for DELETE /api/leftovers/{id}: keep a directory and stop suggesting it
+func leftoverDismissHandler(w http.ResponseWriter, r *http.Request) {
+	dir, ok := leftovers.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown leftover: %s"), r.PathValue("id"))})
+		return
+	}
+	leftovers.remove(dir.ID, true)
+	writeJSON(w, http.StatusOK, map[string]string{"dismissed": dir.Path})
+}
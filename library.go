@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// vSphere Content Libraries: each disk is repacked as a streamOptimized VMDK with
+// a generated OVF (CPUs, memory, firmware and guest type from the disk's OVF) and
+// published into a library as an OVF template, so appliances Porter migrated
+// out can be deployed again from any vCenter subscribed to it. The library
+// (bucket) must exist unless a datastore is given to create it on; the item is
+// named after the VM, with the version appended if one is given. The vCenter and
+// credentials are found as for the vsphere target.
+
+// Publish one disk to a content library, returning the item as library/item
+func publishToContentLibrary(job *Job, s uploadSettings, file string) (string, error) {
+	if err := ensureContentLibrary(job, s); err != nil {
+		return "", err
+	}
+	hw := hardwareForDisk(file)
+	if job.Spec.Name != "" {
+		hw.Name = job.Spec.Name
+	}
+	item := strings.ReplaceAll(hw.Name, "/", "-")
+	if s.Version != "" {
+		item += "-" + s.Version
+	}
+
+	work, err := os.MkdirTemp(filepath.Dir(file), ".porter-library-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(work)
+	disk := filepath.Join(work, item+"-disk1.vmdk")
+	job.setStatus("Converting %s to a streamOptimized VMDK for the content library", filepath.Base(file))
+	if err := convertImage(job, file, disk, "vmdk", "subformat=streamOptimized"); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(disk)
+	if err != nil {
+		return "", err
+	}
+	capacity, err := imageVirtualSize(job, disk)
+	if err != nil {
+		return "", err
+	}
+	descriptor := filepath.Join(work, item+".ovf")
+	if err := os.WriteFile(descriptor, vsphereOVF(hw, filepath.Base(disk), info.Size(), capacity), 0644); err != nil {
+		return "", err
+	}
+
+	dest := path.Join(s.Bucket, item)
+	job.setStatus("Publishing %s to content library %s as %s (%.2f MB)",
+		filepath.Base(file), s.Bucket, item, float64(info.Size())/(1024*1024))
+	if err := runJobCommand(job, govcCommand(job.ctx, s.URL, "library.import", "-n="+item, s.Bucket, descriptor)); err != nil {
+		return "", fmt.Errorf("publishing %s to content library %s failed: %w", file, s.Bucket, err)
+	}
+	job.logf("Published %s as OVF template %s", filepath.Base(file), dest)
+	return dest, nil
+}
+
+// Make sure the library exists, creating it on the datastore if one is given
+func ensureContentLibrary(job *Job, s uploadSettings) error {
+	if runQuiet(govcCommand(job.ctx, s.URL, "library.info", s.Bucket)) == nil {
+		return nil
+	}
+	if s.Datastore == "" {
+		return fmt.Errorf("content library %s not found on %s; create it or give a datastore to create it on", s.Bucket, s.URL)
+	}
+	job.logf("Creating content library %s on datastore %s", s.Bucket, s.Datastore)
+	if err := runJobCommand(job, govcCommand(job.ctx, s.URL, "library.create", "-ds="+s.Datastore, s.Bucket)); err != nil {
+		return fmt.Errorf("creating content library %s failed: %w", s.Bucket, err)
+	}
+	return nil
+}
+
+// Delete a published library item (library/item)
+func deleteContentLibraryItem(endpoint, item string) error {
+	out, err := govcCommand(context.Background(), endpoint, "library.rm", item).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// List the items in a content library whose names start with prefix
+func listContentLibraryItems(ctx context.Context, endpoint, library, prefix string) ([]DestinationObject, error) {
+	out, err := govcCommand(ctx, endpoint, "library.ls", library+"/*").Output()
+	if err != nil {
+		return nil, fmt.Errorf("govc library.ls failed: %w", err)
+	}
+	var objects []DestinationObject
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// Items are listed as /library/item
+		name := path.Base(strings.TrimSpace(scanner.Text()))
+		if name != "" && name != "." && strings.HasPrefix(name, prefix) {
+			objects = append(objects, DestinationObject{Name: name})
+		}
+	}
+	return objects, nil
+}
+
+// An OVF vCenter deploys as a VM: one SCSI disk and an E1000e network card,
+// which every guest has drivers for, with the source VM's firmware and guest type
+func vsphereOVF(hw ovfHardware, diskFile string, fileSize, capacity int64) []byte {
+	osType := hw.OSType
+	if osType == "" {
+		osType = "otherGuest64"
+	}
+	controller := "lsilogic"
+	if strings.Contains(strings.ToLower(osType), "windows") {
+		controller = "lsilogicsas"
+	}
+	var firmware string
+	if hw.Firmware == "efi" {
+		firmware = `
+      <vmw:Config ovf:required="false" vmw:key="firmware" vmw:value="efi"/>`
+		if hw.SecureBoot {
+			firmware += `
+      <vmw:Config ovf:required="false" vmw:key="bootOptions.efiSecureBootEnabled" vmw:value="true"/>`
+		}
+	}
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData" xmlns:vmw="http://www.vmware.com/schema/ovf">
+  <References>
+    <File ovf:id="file1" ovf:href="%[2]s" ovf:size="%[3]d"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disks</Info>
+    <Disk ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:capacity="%[4]d" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+  </DiskSection>
+  <NetworkSection>
+    <Info>Logical networks</Info>
+    <Network ovf:name="VM Network"><Description>The VM Network network</Description></Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="%[1]s">
+    <Info>A virtual machine packaged by Porter</Info>
+    <Name>%[1]s</Name>
+    <OperatingSystemSection ovf:id="%[9]d" vmw:osType="%[7]s">
+      <Info>The guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>%[1]s</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>vmx-13</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:AllocationUnits>hertz * 10^6</rasd:AllocationUnits>
+        <rasd:ElementName>%[5]d virtual CPU(s)</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>%[5]d</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>byte * 2^20</rasd:AllocationUnits>
+        <rasd:ElementName>%[6]dMB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>%[6]d</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Address>0</rasd:Address>
+        <rasd:ElementName>SCSI controller 0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>%[8]s</rasd:ResourceSubType>
+        <rasd:ResourceType>6</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:ElementName>Hard disk 1</rasd:ElementName>
+        <rasd:HostResource>ovf:/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>7</rasd:AddressOnParent>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Connection>VM Network</rasd:Connection>
+        <rasd:ElementName>Network adapter 1</rasd:ElementName>
+        <rasd:InstanceID>5</rasd:InstanceID>
+        <rasd:ResourceSubType>E1000e</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>%[10]s
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`, xmlEscape(hw.Name), xmlEscape(diskFile), fileSize, capacity, hw.CPUs, hw.MemoryMB,
+		xmlEscape(osType), controller, ovfOSID(osType), firmware))
+}
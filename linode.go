@@ -0,0 +1,197 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Linode (Akamai) custom images: Porter creates an image upload with the Linode
+// API and PUTs the gzip-compressed raw disk to the link it returns. Needs a
+// personal access token with Images read/write in LINODE_TOKEN.
+
+const linodeAPI = "https://api.linode.com/v4"
+
+// Linode accepts raw images of up to 6 GB (uncompressed)
+const linodeMaxImageBytes = 6 << 30
+
+func linodeToken() (string, error) {
+	token := os.Getenv("LINODE_TOKEN")
+	if token == "" {
+		return "", errors.New("LINODE_TOKEN is not set")
+	}
+	return token, nil
+}
+
+// Upload one raw image as a Linode custom image, returning its ID (e.g. private/12345)
+func uploadToLinode(job *Job, s uploadSettings, file string) (string, error) {
+	token, err := linodeToken()
+	if err != nil {
+		return "", err
+	}
+	if err := requireRawImage(file, "Linode"); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	if info.Size() > linodeMaxImageBytes {
+		return "", fmt.Errorf("%s is %.1f GB; Linode images are limited to 6 GB", filepath.Base(file), float64(info.Size())/(1<<30))
+	}
+
+	// The upload link needs the compressed size up front, so compress to a file first
+	job.setStatus("Compressing %s for Linode", filepath.Base(file))
+	compressed, err := gzipForJob(job, file)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(compressed)
+
+	var created struct {
+		Image struct {
+			ID string `json:"id"`
+		} `json:"image"`
+		UploadTo string `json:"upload_to"`
+	}
+	request := map[string]string{
+		"label":       linodeImageLabel(job, file),
+		"region":      s.Region,
+		"description": "Imported by Porter job " + job.ID,
+	}
+	if err := jsonAPIRequest(job.ctx, http.MethodPost, linodeAPI+"/images/upload", token, request, &created); err != nil {
+		return "", fmt.Errorf("creating Linode image upload failed: %w", err)
+	}
+
+	f, err := os.Open(compressed)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	cinfo, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	job.setStatus("Uploading %s to Linode image %s (%.2f MB compressed)",
+		filepath.Base(file), created.Image.ID, float64(cinfo.Size())/(1024*1024))
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPut, created.UploadTo, &jobReader{job: job, r: f})
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = cinfo.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if err := doJSONRequest(req, nil); err != nil {
+		return "", fmt.Errorf("Linode image upload failed for %s: %w", file, err)
+	}
+
+	// Linode processes the upload before the image can be used
+	for {
+		var image struct {
+			Status string `json:"status"`
+		}
+		if err := jsonAPIRequest(job.ctx, http.MethodGet, linodeAPI+"/images/"+created.Image.ID, token, nil, &image); err != nil {
+			return "", fmt.Errorf("checking Linode image %s failed: %w", created.Image.ID, err)
+		}
+		if image.Status == "available" {
+			job.logf("Linode image %s is available", created.Image.ID)
+			return created.Image.ID, nil
+		}
+		job.setStatus("Linode image %s is %s", created.Image.ID, strings.ReplaceAll(image.Status, "_", " "))
+		select {
+		case <-job.ctx.Done():
+			return "", job.ctx.Err()
+		case <-time.After(15 * time.Second):
+		}
+	}
+}
+
+// Linode and Vultr only take raw disk images
+func requireRawImage(file, provider string) error {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".raw", ".img":
+		return nil
+	}
+	return fmt.Errorf("%s only imports raw disk images, not %s; convert to RAW", provider, filepath.Base(file))
+}
+
+// Gzip a file next to itself, pausable and cancellable through the job
+func gzipForJob(job *Job, file string) (string, error) {
+	src, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst := file + ".gz"
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, &jobReader{job: job, r: src})
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return "", fmt.Errorf("compressing %s failed: %w", file, err)
+	}
+	return dst, nil
+}
+
+// Linode image labels are up to 50 characters
+func linodeImageLabel(job *Job, file string) string {
+	label := job.Spec.Name
+	if label == "" {
+		label = baseNameWithoutExt(file)
+	}
+	if len(label) > 50-len(job.ID)-1 {
+		label = label[:50-len(job.ID)-1]
+	}
+	return label + "-" + job.ID
+}
+
+func deleteLinodeImage(id string) error {
+	token, err := linodeToken()
+	if err != nil {
+		return err
+	}
+	return jsonAPIRequest(context.Background(), http.MethodDelete, linodeAPI+"/images/"+id, token, nil, nil)
+}
+
+func checkLinodeCredentials(ctx context.Context) error {
+	token, err := linodeToken()
+	if err != nil {
+		return err
+	}
+	return jsonAPIRequest(ctx, http.MethodGet, linodeAPI+"/profile", token, nil, nil)
+}
+
+func listLinodeRegions(ctx context.Context) ([]string, error) {
+	token, err := linodeToken()
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := jsonAPIRequest(ctx, http.MethodGet, linodeAPI+"/regions", token, nil, &resp); err != nil {
+		return nil, err
+	}
+	var regions []string
+	for _, r := range resp.Data {
+		regions = append(regions, r.ID)
+	}
+	return regions, nil
+}
@@ -1,19 +1,20 @@
 package main
 
 import (
-	"archive/tar"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"mime/multipart"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 // Use external template file
@@ -54,12 +55,12 @@ func uploadProgressHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send JSON response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, response)
 }
 
 type UIData struct {
 	Message         string
+	Warnings        []string
 	VMDKs           []string
 	ConvertedFiles  []string
 	QemuAvailable   bool
@@ -67,12 +68,26 @@ type UIData struct {
 	AzCliAvailable  bool
 	DockerNotice    string
 
-	AzureAccounts   []string
-	AzureContainers []string
+	// Loaded by the azure-accounts fragment rather than with the page
+	AzureAccounts      []string
+	AzureAccountsError string
+	AzureContainers    []string
+
+	DestinationProfiles map[string]DestinationProfile
+	Jobs                []*Job
+	// Classes sharing the upload bandwidth cap, if one is set
+	BandwidthClasses []string
+
+	// The results of the conversion just run, if any
+	Conversions []ConversionResult
+
+	// Sent back with the upload form, so a resubmitted form doesn't upload twice
+	UploadKey string
 }
 
 const extractDir = "/app/extracted"
 const convertDir = "/app/converted"
+const stateDir = "/app/state"
 
 // Find VMDKs in the extracted directory
 func findExistingVMDKs() []string {
@@ -88,12 +103,13 @@ func findExistingVMDKs() []string {
 
 // Find converted files in the converted directory
 func findExistingConvertedFiles() []string {
-	// Look for raw, vhd, vhdx and qcow2 files
+	// Look for raw, vhd, vhdx, qcow2 and vmdk files
 	rawFiles := findFilesWithExtension(convertDir, ".raw")
 	vhdFiles := findFilesWithExtension(convertDir, ".vhd")
 	vhdxFiles := findFilesWithExtension(convertDir, ".vhdx")
 	qcow2Files := findFilesWithExtension(convertDir, ".qcow2")
-	allFiles := append(append(append(rawFiles, vhdFiles...), vhdxFiles...), qcow2Files...)
+	vmdkFiles := findFilesWithExtension(convertDir, ".vmdk")
+	allFiles := append(append(append(append(rawFiles, vhdFiles...), vhdxFiles...), qcow2Files...), vmdkFiles...)
 
 	// For display purposes, let's return nice paths relative to the conversion directory
 	for i, file := range allFiles {
@@ -187,6 +203,9 @@ func main() {
 	// Ensure directories exist
 	os.MkdirAll(extractDir, 0755)
 	os.MkdirAll(convertDir, 0755)
+	os.MkdirAll(stateDir, 0755)
+	jobs.restoreHistory()
+	restoreIdempotencyKeys()
 
 	// Log any existing files found
 	existingVMDKs := findExistingVMDKs()
@@ -213,7 +232,73 @@ func main() {
 	http.HandleFunc("/azure/accounts", azureAccountsHandler)
 	http.HandleFunc("/azure/containers", azureContainersHandler)
 	http.HandleFunc("/aws/buckets", awsBucketsHandler)
+	http.HandleFunc("GET /gcp/buckets", gcpBucketsHandler)
+	http.HandleFunc("POST /gcp/buckets", gcpCreateBucketHandler)
+	http.HandleFunc("GET /ibm/buckets", ibmBucketsHandler)
+	http.HandleFunc("GET /alibaba/buckets", alibabaBucketsHandler)
+	http.HandleFunc("GET /oracle/buckets", oracleBucketsHandler)
+	http.HandleFunc("GET /spaces/buckets", spacesBucketsHandler)
+	http.HandleFunc("GET /b2/buckets", b2BucketsHandler)
+	http.HandleFunc("GET /swift/containers", swiftContainersHandler)
+	http.HandleFunc("POST /smb/folders", smbFoldersHandler)
+	http.HandleFunc("GET /ibm/resource-groups", ibmResourceGroupsHandler)
+	http.HandleFunc("GET /ibm/operating-systems", ibmOperatingSystemsHandler)
+	http.HandleFunc("GET /exports/{token}", exportHandler)
 	http.HandleFunc("/upload/progress", uploadProgressHandler)
+	http.HandleFunc("GET /ui/fragments/{name}", fragmentHandler)
+	http.HandleFunc("/api/destinations/objects", destinationObjectsHandler)
+	http.HandleFunc("GET /api/providers", providersHandler)
+	http.HandleFunc("GET /api/guest-steps", guestStepsHandler)
+	http.HandleFunc("GET /api/readiness", readinessHandler)
+	http.HandleFunc("GET /api/compare", compareHandler)
+	http.HandleFunc("GET /api/usage", usageHandler)
+	http.HandleFunc("GET /api/catalog", catalogListHandler)
+	http.HandleFunc("DELETE /api/catalog/{id}", catalogDeleteHandler)
+	http.HandleFunc("POST /api/catalog/{id}/restore", catalogRestoreHandler)
+	http.HandleFunc("POST /api/catalog/scan", catalogScanHandler)
+	http.HandleFunc("GET /api/leftovers", leftoversListHandler)
+	http.HandleFunc("POST /api/leftovers/scan", leftoversScanHandler)
+	http.HandleFunc("POST /api/leftovers/{id}/confirm", leftoverConfirmHandler)
+	http.HandleFunc("DELETE /api/leftovers/{id}", leftoverDismissHandler)
+	http.HandleFunc("GET /api/notifications/dead-letters", deadLettersListHandler)
+	http.HandleFunc("POST /api/notifications/dead-letters/{id}/redeliver", deadLetterRedeliverHandler)
+	http.HandleFunc("DELETE /api/notifications/dead-letters/{id}", deadLetterDeleteHandler)
+	http.HandleFunc("GET /api/jobs", jobsListHandler)
+	http.HandleFunc("POST /api/jobs", jobsCreateHandler)
+	http.HandleFunc("POST /api/jobs/bulk", jobsBulkHandler)
+	http.HandleFunc("GET /api/jobs/{id}", jobGetHandler)
+	http.HandleFunc("POST /api/jobs/{id}/cancel", jobCancelHandler)
+	http.HandleFunc("POST /api/jobs/{id}/pause", jobPauseHandler)
+	http.HandleFunc("POST /api/jobs/{id}/resume", jobResumeHandler)
+	http.HandleFunc("GET /api/jobs/{id}/ws", jobWebSocketHandler)
+	http.HandleFunc("GET /api/jobs/{id}/export", jobExportHandler)
+	http.HandleFunc("GET /api/jobs/{id}/report", jobReportHandler)
+	http.HandleFunc("GET /api/jobs/{id}/attestation", jobAttestationHandler)
+	http.HandleFunc("POST /api/reports/verify", reportVerifyHandler)
+	http.HandleFunc("POST /api/jobs/{id}/image", jobImageHandler)
+	http.HandleFunc("POST /api/jobs/{id}/reimport", jobReimportHandler)
+	http.HandleFunc("POST /api/jobs/{id}/azure-image", jobAzureImageHandler)
+	http.HandleFunc("POST /api/jobs/{id}/boot-test", jobBootTestHandler)
+	http.HandleFunc("DELETE /api/jobs/{id}/boot-test", jobBootTestStopHandler)
+	http.HandleFunc("GET /api/peer", peerInfoHandler)
+	http.HandleFunc("GET /api/peer/files", peerFilesHandler)
+	http.HandleFunc("DELETE /api/peer/files/{path...}", peerFileDeleteHandler)
+	http.HandleFunc("POST /api/peer/transfers", peerTransferCreateHandler)
+	http.HandleFunc("PATCH /api/peer/transfers/{id}", peerTransferChunkHandler)
+	http.HandleFunc("POST /api/peer/transfers/{id}/complete", peerTransferCompleteHandler)
+	http.HandleFunc("GET /api/plan", planListHandler)
+	http.HandleFunc("POST /api/plan/import", planImportHandler)
+	http.HandleFunc("POST /api/plan/{id}/link", planLinkHandler)
+	http.HandleFunc("DELETE /api/plan/{id}", planDeleteHandler)
+
+	registerGuestHooks()
+	go runMultipartSweeper()
+	go runLeftoverScanner()
+	go runTrashPurger()
+	go runTicketUpdates()
+	go runNotifications()
+	go runStallMonitor()
+	go runScheduler()
 
 	fmt.Println("🚀 Porter is running on http://localhost:8080")
 	http.ListenAndServe(":8080", nil)
@@ -221,29 +306,55 @@ func main() {
 
 // Handler to fetch Azure accounts
 func azureAccountsHandler(w http.ResponseWriter, r *http.Request) {
-	accounts := listAzureAccounts()
-	if accounts == nil {
-		fmt.Println("Warning: No Azure accounts found or error occurred")
-		accounts = []string{}
-	} else {
-		fmt.Printf("Found %d Azure accounts\n", len(accounts))
-		for i, acc := range accounts {
-			fmt.Printf("  Account %d: %s\n", i+1, acc)
-		}
+	accounts, err := listAzureAccounts(r.Context())
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list Azure accounts",
+			Remediation: "Check the Azure CLI is logged in (az login) and responding."})
+		return
 	}
-	json.NewEncoder(w).Encode(map[string][]string{"accounts": accounts})
+	for i, acc := range accounts {
+		fmt.Printf("  Account %d: %s\n", i+1, acc)
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"accounts": listOrEmpty(accounts)})
 }
 
-// Handler to fetch AWS S3 buckets dynamically
+// Handler to fetch AWS S3 buckets dynamically, from an S3-compatible endpoint
+// with ?url= (and ?region=, ?pathStyle=true) or ?profile=
 func awsBucketsHandler(w http.ResponseWriter, r *http.Request) {
-	cmd := exec.Command("aws", "s3api", "list-buckets", "--query", "Buckets[].Name", "--output", "text")
-	out, err := cmd.CombinedOutput()
+	q := r.URL.Query()
+	s := uploadSettings{URL: q.Get("url"), Region: q.Get("region"), PathStyle: q.Get("pathStyle") == "true"}
+	if name := q.Get("profile"); name != "" {
+		if profile, ok := findDestinationProfile(name); ok && profile.Cloud == "aws" {
+			s = uploadSettings{URL: profile.URL, Region: profile.Region, PathStyle: profile.PathStyle}
+		}
+	}
+	if s.URL != "" {
+		if apiErr := validateS3EndpointURL(s.URL); apiErr != nil {
+			writeAPIError(w, http.StatusBadRequest, *apiErr)
+			return
+		}
+	}
+	if mocked("aws") {
+		writeJSON(w, http.StatusOK, map[string][]string{"buckets": listMockBuckets()})
+		return
+	}
+	endpoint := s.s3Endpoint()
+	var out []byte
+	err := providerCall(r.Context(), endpoint.breakerName(), func(ctx context.Context) error {
+		var err error
+		out, err = endpoint.command(ctx, "s3api", "list-buckets", "--query", "Buckets[].Name", "--output", "text").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
 	if err != nil {
-		http.Error(w, "Failed to list S3 buckets: "+err.Error(), http.StatusInternalServerError)
+		writeProviderError(w, err, APIError{Message: "Failed to list S3 buckets",
+			Remediation: "Check that the aws CLI is installed and ~/.aws credentials are mounted."})
 		return
 	}
 	buckets := strings.Fields(string(out))
-	json.NewEncoder(w).Encode(map[string][]string{"buckets": buckets})
+	writeJSON(w, http.StatusOK, map[string][]string{"buckets": listOrEmpty(buckets)})
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -251,35 +362,25 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 	existingVMDKs := findExistingVMDKs()
 	existingConverted := findExistingConvertedFiles()
 
-	// Get Azure accounts
-	accounts := listAzureAccounts()
-
 	// Prepare message based on what was found
-	message := "Ready"
+	message := tr("Ready")
 	if len(existingVMDKs) > 0 || len(existingConverted) > 0 {
-		parts := []string{"Ready"}
+		parts := []string{message}
 
 		if len(existingVMDKs) > 0 {
-			parts = append(parts, fmt.Sprintf("Found %d existing VMDK file(s)", len(existingVMDKs)))
+			parts = append(parts, fmt.Sprintf(tr("Found %d existing VMDK file(s)"), len(existingVMDKs)))
 		}
 
 		if len(existingConverted) > 0 {
-			parts = append(parts, fmt.Sprintf("Found %d existing converted file(s)", len(existingConverted)))
+			parts = append(parts, fmt.Sprintf(tr("Found %d existing converted file(s)"), len(existingConverted)))
 		}
 
 		message = strings.Join(parts, ". ")
 	}
 
-	data := UIData{
-		Message:         message,
-		VMDKs:           existingVMDKs,
-		ConvertedFiles:  existingConverted,
-		QemuAvailable:   checkBinary("qemu-img"),
-		AwsCliAvailable: checkBinary("aws"),
-		AzCliAvailable:  checkBinary("az"),
-		DockerNotice:    dockerNotice(),
-		AzureAccounts:   accounts,
-	}
+	data := newUIData(message)
+	data.VMDKs = existingVMDKs
+	data.ConvertedFiles = existingConverted
 	templates.Execute(w, data)
 }
 
@@ -292,14 +393,15 @@ func extractHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		errMsg := "Invalid request method. Expected POST."
 		fmt.Println(errMsg)
-		http.Error(w, errMsg, http.StatusMethodNotAllowed)
+		respondError(w, r, http.StatusMethodNotAllowed, APIError{Code: errCodeMethodNotAllowed, Message: errMsg})
 		return
 	}
 
 	if !strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
 		errMsg := "Invalid content type. Expected multipart/form-data."
 		fmt.Println(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+		respondError(w, r, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: errMsg,
+			Remediation: "Send the OVA as a multipart/form-data field named 'ova'."})
 		return
 	}
 
@@ -308,14 +410,15 @@ func extractHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		errMsg := fmt.Sprintf("Error parsing form: %s", err.Error())
 		fmt.Println(errMsg)
-		http.Error(w, errMsg, http.StatusInternalServerError)
+		respondError(w, r, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Error parsing form", Details: err.Error()})
 		return
 	}
 
 	if r.MultipartForm == nil || r.MultipartForm.File == nil {
 		errMsg := "No files uploaded in the form"
 		fmt.Println(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+		respondError(w, r, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: errMsg,
+			Remediation: "Attach an OVA file in the 'ova' form field."})
 		return
 	}
 
@@ -339,74 +442,84 @@ func extractHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			errMsg := fmt.Sprintf("Error reading OVA (tried both 'ova' and 'ovaFile' fields): %s", err.Error())
 			fmt.Println(errMsg)
-			http.Error(w, errMsg, http.StatusInternalServerError)
+			respondError(w, r, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "Error reading OVA (tried both 'ova' and 'ovaFile' fields)", Details: err.Error(),
+				Remediation: "Attach an OVA file in the 'ova' form field."})
 			return
 		}
 	}
 	defer file.Close()
 
 	if !hasFreeSpace(extractDir, 10) {
-		http.Error(w, "Not enough free disk space to extract OVA!", http.StatusInsufficientStorage)
+		respondError(w, r, http.StatusInsufficientStorage, APIError{Code: errCodeInsufficientStorage,
+			Message:     "Not enough free disk space to extract OVA!",
+			Remediation: fmt.Sprintf(tr("Free up at least 10GB in %s or mount a larger volume there."), extractDir)})
 		return
 	}
 
-	fmt.Printf("Extracting OVA file: %s (size: %d bytes)\n", handler.Filename, handler.Size)
-
-	tr := tar.NewReader(file)
-	var vmdks []string
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
+	// Optional extraction filters (see ovafilter.go)
+	maxMB := 0
+	if value := r.FormValue("max_size_mb"); value != "" {
+		if maxMB, err = strconv.Atoi(value); err != nil {
+			maxMB = -1
 		}
-		if err != nil {
-			errMsg := fmt.Sprintf("Error extracting OVA: %s", err.Error())
-			fmt.Println(errMsg)
-			http.Error(w, errMsg, http.StatusInternalServerError)
-			return
-		}
-
-		target := filepath.Join(extractDir, hdr.Name)
-		if hdr.FileInfo().IsDir() {
-			os.MkdirAll(target, hdr.FileInfo().Mode())
-		} else {
-			os.MkdirAll(filepath.Dir(target), 0755)
-			f, err := os.Create(target)
-			if err != nil {
-				errMsg := fmt.Sprintf("Error creating file %s: %s", target, err.Error())
-				fmt.Println(errMsg)
-				http.Error(w, errMsg, http.StatusInternalServerError)
-				return
-			}
+	}
+	skipTypes := strings.FieldsFunc(r.FormValue("skip_types"), func(c rune) bool { return c == ',' || c == ' ' || c == ';' })
+	if apiErr := checkOVAFilter(maxMB, skipTypes); apiErr != nil {
+		respondError(w, r, http.StatusBadRequest, *apiErr)
+		return
+	}
+	filter := newOVAFilter(maxMB, skipTypes, strings.TrimSpace(r.FormValue("virtual_system")))
 
-			_, err = io.Copy(f, tr)
-			f.Close()
-			if err != nil {
-				errMsg := fmt.Sprintf("Error writing to file %s: %s", target, err.Error())
-				fmt.Println(errMsg)
-				http.Error(w, errMsg, http.StatusInternalServerError)
-				return
-			}
+	fmt.Printf("Extracting OVA file: %s (size: %d bytes)\n", handler.Filename, handler.Size)
 
-			if strings.HasSuffix(hdr.Name, ".vmdk") {
-				vmdks = append(vmdks, target)
-				fmt.Printf("Extracted VMDK: %s\n", target)
-			}
-		}
+	vmdks, err := extractOVA(file, extractDir, filter, func(path string) (func(), error) {
+		return tryLockWorkspace("extraction of "+handler.Filename, nil, []string{path})
+	})
+	var busy *workspaceBusyError
+	if errors.As(err, &busy) {
+		fmt.Printf("Error extracting OVA: %s\n", err)
+		respondWorkspaceBusy(w, r, err)
+		return
+	}
+	if errors.Is(err, errInvalidOVA) {
+		fmt.Printf("Error extracting OVA: %s\n", err)
+		respondError(w, r, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "Error extracting OVA", Details: err.Error(),
+			Remediation: "Check that the file is a valid (uncorrupted) OVA tar archive."})
+		return
+	}
+	if errors.Is(err, errOVAFilter) {
+		fmt.Printf("Error extracting OVA: %s\n", err)
+		respondError(w, r, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "Error extracting OVA", Details: err.Error(),
+			Remediation: "Check the VirtualSystem against the OVA's OVF descriptor, or extract without it."})
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error extracting OVA: %s\n", err)
+		respondError(w, r, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+			Message: "Error extracting OVA", Details: err.Error(),
+			Remediation: fmt.Sprintf(tr("Check that %s is writable."), extractDir)})
+		return
 	}
 
 	fmt.Printf("OVA extraction completed. Found %d VMDKs\n", len(vmdks))
 
-	statusMessage := fmt.Sprintf("Successfully extracted %d VMDK(s) from %s", len(vmdks), handler.Filename)
-	data := UIData{
-		Message:         statusMessage,
-		VMDKs:           vmdks,
-		QemuAvailable:   checkBinary("qemu-img"),
-		AwsCliAvailable: checkBinary("aws"),
-		AzCliAvailable:  checkBinary("az"),
-		DockerNotice:    dockerNotice(),
-		AzureAccounts:   listOrEmpty(listAzureAccounts()),
+	statusMessage := fmt.Sprintf(tr("Successfully extracted %d VMDK(s) from %s"), len(vmdks), handler.Filename)
+	if filter != nil && len(filter.Skipped) > 0 {
+		statusMessage += fmt.Sprintf(tr(" (%d file(s) left out: %s)"), len(filter.Skipped), strings.Join(filter.Skipped, "; "))
+	}
+	var warnings []string
+	for _, vmdk := range vmdks {
+		if warning := encryptionWarning(r.Context(), vmdk, "vmdk"); warning != "" {
+			fmt.Printf("Warning: %s\n", warning)
+			warnings = append(warnings, warning)
+		}
 	}
+	data := newUIData(statusMessage)
+	data.Warnings = warnings
+	data.VMDKs = vmdks
 	templates.Execute(w, data)
 }
 
@@ -416,135 +529,119 @@ func convertHandler(w http.ResponseWriter, r *http.Request) {
 	format := r.FormValue("format")
 	selectedFiles := r.Form["vmdks"]
 
-	// Set default format to raw if not specified
+	// Use the instance default format if not specified
 	if format == "" {
-		format = "raw"
+		format = config.DefaultFormat
 	}
 
-	// Validate format is supported
-	supportedFormats := map[string]bool{
-		"raw":   true,
-		"vpc":   true,
-		"qcow2": true,
-		"vhdx":  true,
+	// Validate format is supported and allowed on this instance
+	if apiErr := checkFormat(format); apiErr != nil {
+		respondError(w, r, http.StatusBadRequest, *apiErr)
+		return
 	}
-
-	if !supportedFormats[format] {
-		http.Error(w, "Unsupported conversion format: "+format, http.StatusBadRequest)
+	subformat := r.FormValue("subformat")
+	if apiErr := checkSubformat(format, subformat); apiErr != nil {
+		respondError(w, r, http.StatusBadRequest, *apiErr)
 		return
 	}
+	subformat = resolveSubformat(format, subformat)
 
 	if len(selectedFiles) == 0 {
-		// Return to the main page with a friendly message instead of an error
-		data := UIData{
-			Message:         "No VMDK files selected for conversion. Please extract an OVA or select files to convert.",
-			VMDKs:           findExistingVMDKs(),
-			ConvertedFiles:  findExistingConvertedFiles(),
-			QemuAvailable:   checkBinary("qemu-img"),
-			AwsCliAvailable: checkBinary("aws"),
-			AzCliAvailable:  checkBinary("az"),
-			DockerNotice:    dockerNotice(),
-			AzureAccounts:   listOrEmpty(listAzureAccounts()),
+		if wantsJSON(r) {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "No VMDK files selected for conversion", Remediation: "Pass one or more 'vmdks' form values."})
+			return
 		}
+		// Return to the main page with a friendly message instead of an error
+		data := newUIData(tr("No VMDK files selected for conversion. Please extract an OVA or select files to convert."))
+		data.VMDKs = findExistingVMDKs()
+		data.ConvertedFiles = findExistingConvertedFiles()
 		templates.Execute(w, data)
 		return
 	}
 
 	if !hasFreeSpace(convertDir, 10) {
-		http.Error(w, "Not enough free disk space to convert VMDKs!", http.StatusInsufficientStorage)
+		respondError(w, r, http.StatusInsufficientStorage, APIError{Code: errCodeInsufficientStorage,
+			Message:     "Not enough free disk space to convert VMDKs!",
+			Remediation: fmt.Sprintf(tr("Free up at least 10GB in %s or mount a larger volume there."), convertDir)})
 		return
 	}
 
 	fmt.Printf("Starting conversion of %d VMDK(s) to %s format\n", len(selectedFiles), format)
 
+	var conversions []ConversionResult
 	var converted []string
 	for i, input := range selectedFiles {
 		fmt.Printf("[%d/%d] Converting %s to %s format\n", i+1, len(selectedFiles), input, format)
 
-		// Determine the actual file extension users would expect based on the format
-		var fileExtension string
-		if format == "vpc" {
-			fileExtension = "vhd" // Use VHD extension for VPC format
-		} else if format == "vhdx" {
-			fileExtension = "vhdx" // Use VHDX extension for VHDX format
-		} else {
-			fileExtension = format // For raw and other formats, use the format name directly
+		// Use qemu's internal format for the conversion
+		conversion := vmdkConversion(input, convertDir, format, subformat)
+		output := conversion.Output
+		release, err := tryLockWorkspace("conversion of "+filepath.Base(input), []string{input}, []string{output})
+		if err != nil {
+			respondWorkspaceBusy(w, r, err)
+			return
 		}
-
-		// Use qemu's internal format for the conversion command
-		output := filepath.Join(convertDir, filepath.Base(input)+"."+fileExtension)
-		os.MkdirAll(convertDir, 0755)
-
-		cmd := exec.Command("qemu-img", "convert", "-f", "vmdk", "-O", format, input, output)
-		out, err := cmd.CombinedOutput()
+		started := time.Now()
+		tool := imageTools()
+		err = tool.convert(context.Background(), nil, conversion)
+		release()
 		if err != nil {
-			errMsg := fmt.Sprintf("Conversion failed for %s: %s\nOutput: %s\n", input, err, string(out))
-			fmt.Println(errMsg)
-			http.Error(w, errMsg, http.StatusInternalServerError)
+			fmt.Printf("Conversion failed for %s: %s\n", input, err)
+			respondError(w, r, http.StatusInternalServerError, APIError{Code: errCodeProviderFailed,
+				Message: fmt.Sprintf(tr("Conversion failed for %s"), input), Details: err.Error(),
+				Remediation: fmt.Sprintf(tr("Check that the VMDK is complete and that %s is available."), tool.name())})
 			return
 		}
 
-		// Get file size for reporting
-		fileInfo, err := os.Stat(output)
-		var fileSize int64
-		if err == nil {
-			fileSize = fileInfo.Size()
-			fmt.Printf("Converted %s to %s (%.2f MB)\n", input, output, float64(fileSize)/(1024*1024))
-		} else {
-			fmt.Printf("Converted %s to %s (size unknown)\n", input, output)
+		result, err := describeConversion(r.Context(), nil, input, output, format, time.Since(started))
+		if err != nil {
+			respondError(w, r, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+				Message: fmt.Sprintf(tr("Failed to inspect the converted disk %s"), output), Details: err.Error()})
+			return
 		}
+		result.Subformat = subformat
+		recordConversion(result)
+		fmt.Printf("Converted %s to %s (%s)\n", input, output, result.Summary())
 
+		conversions = append(conversions, result)
 		converted = append(converted, output)
 	}
 
 	fmt.Printf("All conversions completed successfully\n")
 
-	// Create a user-friendly format name for display
-	formatDisplayName := format
-	if format == "vpc" {
-		formatDisplayName = "VHD (Hyper-V/Azure)"
-	} else if format == "raw" {
-		formatDisplayName = "RAW"
-	} else if format == "qcow2" {
-		formatDisplayName = "QCOW2 (QEMU/OpenStack)"
-	} else if format == "vhdx" {
-		formatDisplayName = "VHDX (Hyper-V)"
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, map[string][]ConversionResult{"conversions": conversions})
+		return
 	}
 
-	data := UIData{
-		Message:         fmt.Sprintf("Successfully converted %d file(s) to %s format", len(converted), formatDisplayName),
-		ConvertedFiles:  converted,
-		VMDKs:           selectedFiles, // Keep the VMDK list so user can convert again if needed
-		QemuAvailable:   checkBinary("qemu-img"),
-		AwsCliAvailable: checkBinary("aws"),
-		AzCliAvailable:  checkBinary("az"),
-		DockerNotice:    dockerNotice(),
-		AzureAccounts:   listOrEmpty(listAzureAccounts()),
-	}
+	// Create a user-friendly format name for display
+	formatDisplayName := formatDisplayNames[format]
+
+	data := newUIData(fmt.Sprintf(tr("Successfully converted %d file(s) to %s format"), len(converted), formatDisplayName))
+	data.Conversions = conversions
+	data.ConvertedFiles = converted
+	// Keep the VMDK list so user can convert again if needed
+	data.VMDKs = selectedFiles
 	templates.Execute(w, data)
 }
 
 // Upload to cloud/local
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
-	cloud := r.FormValue("cloud")
-	files := r.Form["files"]
-	target := r.FormValue("target")
-	subscription := r.FormValue("account")
-	containerFull := r.FormValue("container")
-	bucket := r.FormValue("bucket")
-
-	// Initialize progress tracking
-	uploadProgress.Lock()
-	uploadProgress.Current = 0
-	uploadProgress.Total = len(files)
-	uploadProgress.Status = "Starting upload..."
-	uploadProgress.Unlock()
-
-	fmt.Printf("Starting upload of %d file(s) to %s\n", len(files), cloud)
+	spec, apiErr := jobSpecFromForm(r)
+	if apiErr != nil {
+		respondError(w, r, http.StatusBadRequest, *apiErr)
+		return
+	}
 
 	// If no files selected, show a friendly error message in the UI rather than a plain HTTP error
-	if len(files) == 0 {
+	if len(spec.Files) == 0 {
+		if wantsJSON(r) {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "No files selected for upload", Remediation: "Pass one or more 'files' form values."})
+			return
+		}
 		existingVMDKs := findExistingVMDKs()
 		existingConverted := findExistingConvertedFiles()
 		var message string
@@ -555,316 +652,69 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 			message = "Please select at least one file to upload."
 		}
 
-		data := UIData{
-			Message:         message,
-			VMDKs:           existingVMDKs,
-			ConvertedFiles:  existingConverted,
-			QemuAvailable:   checkBinary("qemu-img"),
-			AwsCliAvailable: checkBinary("aws"),
-			AzCliAvailable:  checkBinary("az"),
-			DockerNotice:    dockerNotice(),
-			AzureAccounts:   listOrEmpty(listAzureAccounts()),
-		}
+		data := newUIData(message)
+		data.VMDKs = existingVMDKs
+		data.ConvertedFiles = existingConverted
 		templates.Execute(w, data)
 		return
 	}
 
-	var message strings.Builder
-	var successCount, failCount int
-
-	for i, file := range files {
-		switch cloud {
-		case "aws":
-			// Build S3 URI from selected bucket and optional target path
-			s3Uri := "s3://" + bucket
-			if target != "" {
-				s3Uri += "/" + strings.TrimPrefix(target, "/")
-			}
-			s3Uri += "/" + filepath.Base(file)
-
-			fmt.Printf("[%d/%d] Uploading %s to AWS S3: %s\n", i+1, len(files), file, s3Uri)
-
-			// Get file size for progress reporting
-			fileInfo, err := os.Stat(file)
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to get file info for %s: %s\n", file, err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-			fileSize := fileInfo.Size()
-
-			// Update progress tracking
-			uploadProgress.Lock()
-			uploadProgress.Current = i
-			uploadProgress.Status = fmt.Sprintf("Uploading %s to AWS S3: %s (%.2f MB)",
-				filepath.Base(file), s3Uri, float64(fileSize)/(1024*1024))
-			uploadProgress.Unlock()
-
-			// Use aws s3 cp with progress options
-			cmd := exec.Command("aws", "s3", "cp", "--no-progress", file, s3Uri)
-
-			// Create a pipe to capture stdout in real-time
-			stdoutPipe, err := cmd.StdoutPipe()
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to create stdout pipe: %s\n", err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-
-			// Create a pipe for stderr as well
-			stderrPipe, err := cmd.StderrPipe()
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to create stderr pipe: %s\n", err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-
-			// Start the command
-			err = cmd.Start()
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to start AWS upload: %s\n", err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-
-			// Print progress information during upload
-			go func() {
-				buffer := make([]byte, 1024)
-				for {
-					n, err := stdoutPipe.Read(buffer)
-					if n > 0 {
-						fmt.Print(string(buffer[:n]))
-					}
-					if err != nil {
-						break
-					}
-				}
-			}()
-
-			go func() {
-				buffer := make([]byte, 1024)
-				for {
-					n, err := stderrPipe.Read(buffer)
-					if n > 0 {
-						fmt.Print(string(buffer[:n]))
-					}
-					if err != nil {
-						break
-					}
-				}
-			}()
-
-			// Wait for the command to complete
-			err = cmd.Wait()
-			if err != nil {
-				errMsg := fmt.Sprintf("AWS upload failed for %s: %s\n", file, err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-
-			successMsg := fmt.Sprintf("✅ AWS upload succeeded: %s to %s\n", file, s3Uri)
-			fmt.Println(successMsg)
-			message.WriteString(successMsg)
-			successCount++
-
-		case "azure":
-			// Parse the storage account and container from the combined value
-			parts := strings.Split(containerFull, "/")
-			if len(parts) != 2 {
-				errMsg := fmt.Sprintf("Invalid Azure container format '%s'. Expected 'storageAccount/container'\n", containerFull)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg)
-				failCount++
-				continue
-			}
-
-			storageAccount := parts[0]
-			container := parts[1]
-
-			blobName := filepath.Base(file)
-			if target != "" {
-				blobName = strings.TrimPrefix(target, "/") + "/" + blobName
-			}
-
-			fmt.Printf("[%d/%d] Uploading %s to Azure: %s/%s/%s\n",
-				i+1, len(files), file, storageAccount, container, blobName)
-
-			// Get file size for progress reporting
-			fileInfo, err := os.Stat(file)
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to get file info for %s: %s\n", file, err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-			fileSize := fileInfo.Size()
-
-			// Update progress tracking
-			uploadProgress.Lock()
-			uploadProgress.Current = i
-			uploadProgress.Status = fmt.Sprintf("Uploading %s to Azure: %s/%s/%s (%.2f MB)",
-				filepath.Base(file), storageAccount, container, blobName, float64(fileSize)/(1024*1024))
-			uploadProgress.Unlock()
-
-			// Use az storage blob upload for uploading
-			cmd := exec.Command("az", "storage", "blob", "upload",
-				"--subscription", subscription,
-				"--account-name", storageAccount,
-				"--container-name", container,
-				"--auth-mode", "login",
-				"--name", blobName,
-				"--file", file)
-
-			// Create a pipe to capture stdout in real-time
-			stdoutPipe, err := cmd.StdoutPipe()
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to create stdout pipe: %s\n", err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-
-			// Create a pipe for stderr as well
-			stderrPipe, err := cmd.StderrPipe()
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to create stderr pipe: %s\n", err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-
-			// Start the command
-			err = cmd.Start()
-			if err != nil {
-				errMsg := fmt.Sprintf("Failed to start Azure upload: %s\n", err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-
-			// Print progress information during upload
-			go func() {
-				buffer := make([]byte, 1024)
-				for {
-					n, err := stdoutPipe.Read(buffer)
-					if n > 0 {
-						fmt.Print(string(buffer[:n]))
-					}
-					if err != nil {
-						break
-					}
-				}
-			}()
-
-			go func() {
-				buffer := make([]byte, 1024)
-				for {
-					n, err := stderrPipe.Read(buffer)
-					if n > 0 {
-						fmt.Print(string(buffer[:n]))
-					}
-					if err != nil {
-						break
-					}
-				}
-			}()
-
-			// Wait for the command to complete
-			err = cmd.Wait()
-			if err != nil {
-				errMsg := fmt.Sprintf("Azure upload failed for %s: %s\n", file, err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
-
-			successMsg := fmt.Sprintf("✅ Azure upload succeeded: %s to %s/%s/%s\n",
-				file, storageAccount, container, blobName)
-			fmt.Println(successMsg)
-			message.WriteString(successMsg)
-			successCount++
-		case "local":
-			if target == "" {
-				target = "/data"
-			}
+	claim, status, apiErr := claimIdempotencyKey(r, []byte(r.PostForm.Encode()))
+	if apiErr != nil {
+		respondError(w, r, status, *apiErr)
+		return
+	}
+	defer claim.release()
 
-			fmt.Printf("[%d/%d] Saving %s to local filesystem: %s\n", i+1, len(files), file, target)
-
-			// Update progress tracking
-			uploadProgress.Lock()
-			uploadProgress.Current = i
-			uploadProgress.Status = fmt.Sprintf("Copying %s to local filesystem: %s",
-				filepath.Base(file), target)
-			uploadProgress.Unlock()
-
-			os.MkdirAll(target, 0755)
-			dst := filepath.Join(target, filepath.Base(file))
-			err := copyFile(file, dst)
-			if err != nil {
-				errMsg := fmt.Sprintf("Local copy failed for %s: %s\n", file, err)
-				fmt.Println(errMsg)
-				message.WriteString(errMsg + "\n")
-				failCount++
-				continue
-			}
+	// A resubmitted form (or retried request) follows the job the first one started
+	var job *Job
+	if previous, ok := claim.replayed(w); ok {
+		if len(previous) == 0 {
+			respondError(w, r, http.StatusConflict, errIdempotentJobPruned)
+			return
+		}
+		job = previous[0]
+	} else {
+		settings, apiErr := resolveUploadSettings(spec)
+		if apiErr != nil {
+			respondError(w, r, http.StatusBadRequest, *apiErr)
+			return
+		}
 
-			successMsg := fmt.Sprintf("✅ Saved locally: %s\n", dst)
-			fmt.Println(successMsg)
-			message.WriteString(successMsg)
-			successCount++
+		// Initialize progress tracking
+		publishLegacyProgress(JobProgress{Total: len(spec.Files), Status: "Starting upload..."})
 
-		default:
-			errMsg := fmt.Sprintf("Unknown cloud target for %s\n", file)
-			fmt.Println(errMsg)
-			message.WriteString(errMsg + "\n")
-			failCount++
+		// Run the upload as a job and wait for it so the page can show the results
+		job = jobs.submit(spec, settings)
+		claim.record(job)
+	}
+	// The page follows the job through the jobs API rather than waiting for it
+	if r.FormValue("wait") == "false" {
+		writeJSON(w, http.StatusAccepted, job.snapshot())
+		return
+	}
+	if job.waitsForWindow() {
+		message := fmt.Sprintf(tr("🕒 Upload of %d file(s) queued as job %s (estimated duration %s). It will start in the next transfer window (%s)."),
+			len(spec.Files), job.ID, formatDuration(job.snapshot().EstimatedSeconds), describeSchedule())
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusAccepted, job.snapshot())
+			return
 		}
+		data := newUIData(message)
+		data.ConvertedFiles = spec.Files
+		templates.Execute(w, data)
+		return
 	}
+	<-job.done
+	result := job.snapshot()
 
-	// Create a summary message
-	summaryMsg := fmt.Sprintf("Upload summary: %d successful, %d failed", successCount, failCount)
-	fmt.Println(summaryMsg)
-
-	// Update progress tracking to completed
-	uploadProgress.Lock()
-	uploadProgress.Current = uploadProgress.Total
-	uploadProgress.Status = fmt.Sprintf("Upload completed: %d successful, %d failed", successCount, failCount)
-	uploadProgress.Unlock()
-
-	// Determine status message based on results
-	var messagePrefix string
-	if failCount == 0 {
-		messagePrefix = "✅ All uploads completed successfully! "
-	} else if successCount == 0 {
-		messagePrefix = "❌ All uploads failed. "
-	} else {
-		messagePrefix = "⚠️ Some uploads completed, some failed. "
+	if wantsJSON(r) {
+		writeJSON(w, http.StatusOK, result)
+		return
 	}
 
-	data := UIData{
-		Message:         fmt.Sprintf("%s%s\n\n%s", messagePrefix, summaryMsg, message.String()),
-		ConvertedFiles:  files,
-		QemuAvailable:   checkBinary("qemu-img"),
-		AwsCliAvailable: checkBinary("aws"),
-		AzCliAvailable:  checkBinary("az"),
-		DockerNotice:    dockerNotice(),
-		AzureAccounts:   listOrEmpty(listAzureAccounts()),
-	}
+	data := newUIData(result.Message)
+	data.ConvertedFiles = spec.Files
 	templates.Execute(w, data)
 }
 
@@ -873,10 +723,16 @@ func azureContainersHandler(w http.ResponseWriter, r *http.Request) {
 	subscription := r.URL.Query().Get("account")
 	fmt.Printf("Looking for containers in subscription: '%s'\n", subscription)
 
-	containers, err := listAzureContainers(subscription)
+	var containers []string
+	err := providerCall(r.Context(), "azure", func(ctx context.Context) error {
+		var err error
+		containers, err = listAzureContainers(ctx, subscription)
+		return err
+	})
 	if err != nil {
 		fmt.Printf("Error listing containers for subscription '%s': %s\n", subscription, err)
-		http.Error(w, "Failed to list containers: "+err.Error(), http.StatusInternalServerError)
+		writeProviderError(w, err, APIError{Message: "Failed to list containers",
+			Remediation: "Check that you are logged in with 'az login' and can list storage accounts in the subscription."})
 		return
 	}
 
@@ -885,7 +741,7 @@ func azureContainersHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("  Container %d: %s\n", i+1, container)
 	}
 
-	json.NewEncoder(w).Encode(map[string][]string{"containers": containers})
+	writeJSON(w, http.StatusOK, map[string][]string{"containers": listOrEmpty(containers)})
 }
 
 // Helpers
@@ -907,11 +763,6 @@ func copyFile(src, dst string) error {
 	return out.Sync()
 }
 
-func checkBinary(bin string) bool {
-	_, err := exec.LookPath(bin)
-	return err == nil
-}
-
 func dockerNotice() string {
 	notice := ""
 	if _, err := os.Stat("/.dockerenv"); err == nil {
@@ -923,7 +774,7 @@ func dockerNotice() string {
 	} else {
 		notice = "✅ Running locally. Ensure qemu-img, aws CLI, and az CLI are installed."
 	}
-	return notice
+	return tr(notice)
 }
 
 func hasFreeSpace(path string, neededGB int64) bool {
@@ -935,13 +786,22 @@ func hasFreeSpace(path string, neededGB int64) bool {
 	return available >= uint64(neededGB*1024*1024*1024)
 }
 
-func listAzureAccounts() []string {
-	cmd := exec.Command("az", "account", "list", "--query", "[].name", "-o", "tsv")
-	out, err := cmd.CombinedOutput()
+func listAzureAccounts(ctx context.Context) ([]string, error) {
+	if mocked("azure") {
+		return []string{mockSubscription}, nil
+	}
+	var out []byte
+	err := providerCall(ctx, "azure", func(ctx context.Context) error {
+		var err error
+		out, err = toolCommand(ctx, "az", "account", "list", "--query", "[].name", "-o", "tsv").CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("az account list failed: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
 	if err != nil {
-		fmt.Printf("Error listing Azure accounts: %s\nOutput: %s\n", err, string(out))
-		// Return empty list instead of nil for better UI handling
-		return []string{}
+		fmt.Printf("Error listing Azure accounts: %s\n", err)
+		return nil, err
 	}
 	// Split by newlines instead of whitespace to preserve account names with spaces
 	accounts := strings.Split(strings.TrimSpace(string(out)), "\n")
@@ -960,13 +820,16 @@ func listAzureAccounts() []string {
 		fmt.Println("No Azure accounts found")
 	}
 
-	return result
+	return result, nil
 }
 
 // First list storage accounts in the subscription, then list containers in each storage account
-func listAzureContainers(subscription string) ([]string, error) {
+func listAzureContainers(ctx context.Context, subscription string) ([]string, error) {
+	if mocked("azure") {
+		return listMockContainers(), nil
+	}
 	// Step 1: List storage accounts in the subscription
-	cmdAccounts := exec.Command("az", "storage", "account", "list",
+	cmdAccounts := toolCommand(ctx, "az", "storage", "account", "list",
 		"--subscription", subscription,
 		"--query", "[].name",
 		"-o", "tsv")
@@ -978,7 +841,8 @@ func listAzureContainers(subscription string) ([]string, error) {
 
 	storageAccounts := strings.Split(strings.TrimSpace(string(outAccounts)), "\n")
 	if len(storageAccounts) == 0 || (len(storageAccounts) == 1 && storageAccounts[0] == "") {
-		return nil, fmt.Errorf("no storage accounts found in subscription '%s'", subscription)
+		fmt.Printf("No storage accounts found in subscription '%s'\n", subscription)
+		return nil, nil
 	}
 
 	fmt.Printf("Found %d storage accounts in subscription '%s'\n", len(storageAccounts), subscription)
@@ -991,7 +855,7 @@ func listAzureContainers(subscription string) ([]string, error) {
 		}
 
 		fmt.Printf("Listing containers for storage account '%s'\n", storageAccount)
-		cmdContainers := exec.Command("az", "storage", "container", "list",
+		cmdContainers := toolCommand(ctx, "az", "storage", "container", "list",
 			"--subscription", subscription,
 			"--account-name", storageAccount,
 			"--auth-mode", "login",
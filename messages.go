@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Message catalogs: job logs, statuses and warnings, job summaries,
+// notifications and API error messages are written in English in the code and
+// looked up in the catalog of the instance's language (language in
+// porter.json, else PORTER_LANG) as they are shown. A catalog is a JSON object
+// from English messages, as the code writes them with their fmt verbs, to
+// translations using the same verbs (or indexed ones, such as %[2]s, to
+// reorder them). Porter ships catalogs in /app/messages; ones in messagesDir
+// add to them and override them. Messages a catalog lacks stay in English, as
+// do values clients match on: states, error codes and field names.
+
+// Built-in catalogs, one <language>.json per language
+const builtinMessagesDir = "/app/messages"
+
+// Translations of English messages in the instance's language
+var messageCatalog = loadMessageCatalog(messageLanguage())
+
+// The instance's language, e.g. de or pt-BR; "" or en is English
+func messageLanguage() string {
+	lang := config.Language
+	if lang == "" {
+		lang = os.Getenv("PORTER_LANG")
+	}
+	// Locale names such as de_DE.UTF-8 become language tags
+	lang, _, _ = strings.Cut(lang, ".")
+	return strings.ReplaceAll(lang, "_", "-")
+}
+
+// Load the catalogs for a language: its base language (de for de-AT) first,
+// then the language itself, each from the built-in directory and then
+// messagesDir
+func loadMessageCatalog(lang string) map[string]string {
+	catalog := map[string]string{}
+	if lang == "" || strings.EqualFold(lang, "en") {
+		return catalog
+	}
+	names := []string{lang}
+	if base, _, ok := strings.Cut(lang, "-"); ok {
+		names = []string{base, lang}
+	}
+	found := false
+	for _, name := range names {
+		for _, dir := range []string{builtinMessagesDir, config.MessagesDir} {
+			if dir == "" {
+				continue
+			}
+			path := filepath.Join(dir, name+".json")
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				continue
+			}
+			var messages map[string]string
+			if err == nil {
+				err = json.Unmarshal(data, &messages)
+			}
+			if err != nil {
+				fmt.Printf("Warning: invalid message catalog %s: %s\n", path, err)
+				continue
+			}
+			for message, translation := range messages {
+				if translation != "" {
+					catalog[message] = translation
+				}
+			}
+			found = true
+		}
+	}
+	if !found {
+		fmt.Printf("Warning: no message catalog for language %s (messages stay in English)\n", lang)
+		return catalog
+	}
+	fmt.Printf("Loaded %d translated message(s) for language %s\n", len(catalog), lang)
+	return catalog
+}
+
+// A message in the instance's language, or as it is if it has no translation
+func tr(message string) string {
+	if translation, ok := messageCatalog[message]; ok {
+		return translation
+	}
+	return message
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Tracking of AMIs registered from Porter uploads in AWS Migration Hub, so
+// Porter-driven imports show up next to Application Migration Service (MGN)
+// migrations in the organization's official tracking.
+type AWSMigrationHub struct {
+	// Report to Migration Hub as well as tagging the AMI
+	Enabled bool `json:"enabled"`
+	// The account's Migration Hub home region (Migration Hub calls go there)
+	HomeRegion string `json:"homeRegion,omitempty"`
+	// Progress update stream Porter reports under, created if missing
+	ProgressUpdateStream string `json:"progressUpdateStream,omitempty"`
+	// Extra AMI tags, e.g. {"map-migrated": "mig12345"} for MAP credits
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// Migration Hub task names may not contain ':' or '|'
+func migrationTaskName(job *Job) string {
+	name := "porter-" + job.ID
+	if job.Spec.Name != "" {
+		name = job.Spec.Name + "-" + job.ID
+	}
+	return strings.NewReplacer(":", "-", "|", "-").Replace(name)
+}
+
+// Tag an AMI registered from a job's upload with where it came from, and (if
+// enabled) record the job as a completed migration task in Migration Hub with
+// the AMI as its artifact. discoveredServerID links the task to a server from
+// Application Discovery Service.
+func trackAWSImage(ctx context.Context, job *Job, imageID, region, discoveredServerID string) error {
+	if mocked("aws") {
+		job.logf("Mock mode: not tagging or tracking %s", imageID)
+		return nil
+	}
+	tags := map[string]string{
+		"porter:job-id":      job.ID,
+		"porter:migrated-at": time.Now().UTC().Format(time.RFC3339),
+	}
+	if source := job.Spec.Source; source != "" {
+		tags["porter:source"] = source
+	}
+	if job.Spec.Name != "" {
+		tags["porter:vm"] = job.Spec.Name
+	}
+	for k, v := range config.AWSMigrationHub.Tags {
+		tags[k] = v
+	}
+	tagging, err := awsTagListArg(tags)
+	if err != nil {
+		return err
+	}
+	args := []string{"ec2", "create-tags", "--resources", imageID, "--tags", tagging}
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	if err := runQuiet(toolCommand(ctx, "aws", args...)); err != nil {
+		return fmt.Errorf("tagging %s failed: %w", imageID, err)
+	}
+	job.logf("Tagged %s with %d migration tag(s)", imageID, len(tags))
+
+	hub := config.AWSMigrationHub
+	if !hub.Enabled {
+		return nil
+	}
+
+	// The artifact is named by ARN, which needs the AMI's region and account
+	if region == "" {
+		out, err := toolCommand(ctx, "aws", "configure", "get", "region").Output()
+		if err != nil || strings.TrimSpace(string(out)) == "" {
+			return fmt.Errorf("no region given for %s and none configured for the AWS CLI", imageID)
+		}
+		region = strings.TrimSpace(string(out))
+	}
+	out, err := toolCommand(ctx, "aws", "sts", "get-caller-identity", "--query", "Account", "--output", "text").Output()
+	if err != nil {
+		return fmt.Errorf("could not look up the AWS account: %w", err)
+	}
+	arn := fmt.Sprintf("arn:aws:ec2:%s:%s:image/%s", region, strings.TrimSpace(string(out)), imageID)
+
+	task := migrationTaskName(job)
+	hubArgs := func(args ...string) []string {
+		args = append([]string{"migrationhub"}, args...)
+		args = append(args, "--progress-update-stream", hub.ProgressUpdateStream, "--migration-task-name", task)
+		if hub.HomeRegion != "" {
+			args = append(args, "--region", hub.HomeRegion)
+		}
+		return args
+	}
+
+	// Creating a stream that already exists fails harmlessly
+	streamArgs := []string{"migrationhub", "create-progress-update-stream", "--progress-update-stream-name", hub.ProgressUpdateStream}
+	if hub.HomeRegion != "" {
+		streamArgs = append(streamArgs, "--region", hub.HomeRegion)
+	}
+	toolCommand(ctx, "aws", streamArgs...).Run()
+
+	steps := [][]string{hubArgs("import-migration-task")}
+	if discoveredServerID != "" {
+		steps = append(steps, hubArgs("associate-discovered-resource",
+			"--discovered-resource", "ConfigurationId="+discoveredServerID+",Description=Source VM"))
+	}
+	steps = append(steps,
+		hubArgs("associate-created-artifact", "--created-artifact", "Name="+arn+",Description=Imported by Porter"),
+		hubArgs("notify-migration-task-state", "--task", "Status=COMPLETED,ProgressPercent=100",
+			"--update-date-time", time.Now().UTC().Format(time.RFC3339), "--next-update-seconds", "0"))
+	for _, args := range steps {
+		if err := runQuiet(toolCommand(ctx, "aws", args...)); err != nil {
+			return fmt.Errorf("migrationhub %s failed: %w", args[1], err)
+		}
+	}
+	job.logf("Recorded migration task %s in Migration Hub stream %s", task, hub.ProgressUpdateStream)
+
+	job.mu.Lock()
+	job.MigrationTask = task
+	job.mu.Unlock()
+	return nil
+}
+
+// Build the JSON --tags argument for aws ec2 create-tags
+func awsTagListArg(tags map[string]string) (string, error) {
+	type tag struct {
+		Key   string `json:"Key"`
+		Value string `json:"Value"`
+	}
+	var list []tag
+	for _, pair := range keyValuePairs(tags) {
+		k, v, _ := strings.Cut(pair, "=")
+		list = append(list, tag{Key: k, Value: v})
+	}
+	out, err := json.Marshal(list)
+	return string(out), err
+}
+
+// Handler for POST /api/jobs/{id}/image: record the AMI registered from a
+// completed AWS job, tagging it and reporting it to Migration Hub
+func jobImageHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	var body struct {
+		ImageID            string `json:"imageId"`
+		Region             string `json:"region"`
+		DiscoveredServerID string `json:"discoveredServerId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Invalid JSON body", Details: err.Error()})
+		return
+	}
+	if !strings.HasPrefix(body.ImageID, "ami-") {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Invalid AMI ID: %s"), body.ImageID), Remediation: "Pass the 'imageId' (ami-...) registered from the job's upload."})
+		return
+	}
+	if job.settings.Cloud != "aws" || job.state() != jobCompleted {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message: fmt.Sprintf(tr("Only completed AWS jobs have images to record: %s"), job.ID)})
+		return
+	}
+
+	if err := trackAWSImage(r.Context(), job, body.ImageID, body.Region, body.DiscoveredServerID); err != nil {
+		job.logf("Migration tracking for %s failed: %s", body.ImageID, err)
+		writeAPIError(w, http.StatusBadGateway, APIError{Code: errCodeProviderFailed,
+			Message: fmt.Sprintf(tr("Could not record %s"), body.ImageID), Details: err.Error(),
+			Remediation: "Check that the AWS credentials allow ec2:CreateTags and the migrationhub actions, and that homeRegion is the Migration Hub home region."})
+		return
+	}
+	job.mu.Lock()
+	job.ImageID = body.ImageID
+	job.mu.Unlock()
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
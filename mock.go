@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Mock mode (mock in porter.json), for rehearsing pipelines, demos and
+// integration tests without credentials, clouds or hours of conversion. AWS S3
+// and Azure Blob uploads go to fake buckets and containers (directories under
+// dir, holding sparse files of the uploaded sizes), AMI imports and Azure
+// images are simulated with made-up IDs, and images are inspected and
+// converted by a simulated qemu-img that writes sparse outputs. Transfers and
+// conversions take as long as they would at mbps, and with failureRate that
+// share of simulated uploads, conversions and imports fail, to rehearse
+// failure handling, retries and re-imports. Other destinations and guest steps
+// run for real.
+type MockConfig struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// Where fake buckets and containers are kept (default /app/state/mock)
+	Dir string `json:"dir,omitempty"`
+	// Simulated throughput in MB/s (0 = instant)
+	MBps float64 `json:"mbps,omitempty"`
+	// Chance, from 0 to 1, that a simulated operation fails
+	FailureRate float64 `json:"failureRate,omitempty"`
+}
+
+// Destinations mock mode fakes
+var mockedClouds = []string{"aws", "azure", "azuredisk"}
+
+// The fake bucket and container the upload form offers until others are created
+const (
+	mockBucket       = "porter-mock"
+	mockSubscription = "Porter mock subscription"
+	mockContainer    = "porterstorage/vhds"
+)
+
+// How long each simulated step of a cloud-side import takes
+const mockImportStep = 500 * time.Millisecond
+
+func mocked(cloud string) bool {
+	return config.Mock.Enabled && slices.Contains(mockedClouds, cloud)
+}
+
+// Check the mock settings
+func (c *Config) validateMock(path string) {
+	if !c.Mock.Enabled {
+		return
+	}
+	if c.Mock.Dir == "" {
+		c.Mock.Dir = filepath.Join(stateDir, "mock")
+	}
+	if c.Mock.FailureRate < 0 || c.Mock.FailureRate > 1 {
+		fmt.Printf("Warning: mock.failureRate must be between 0 and 1 in config %s (not failing on purpose)\n", path)
+		c.Mock.FailureRate = 0
+	}
+	if c.Mock.MBps < 0 {
+		c.Mock.MBps = 0
+	}
+	fmt.Printf("Mock mode: AWS S3 and Azure uploads go to %s and qemu-img is simulated; nothing is sent to a cloud\n", c.Mock.Dir)
+}
+
+// Fail with the configured chance, as a flaky provider would
+func mockChaos(what string) error {
+	if config.Mock.FailureRate > 0 && rand.Float64() < config.Mock.FailureRate {
+		return fmt.Errorf("simulated failure of %s (mock failureRate %g)", what, config.Mock.FailureRate)
+	}
+	return nil
+}
+
+// Take as long as moving size bytes at the simulated speed would, counting
+// them as the job's progress; pausable and cancellable like a real transfer
+func mockTransfer(job *Job, size int64) error {
+	if config.Mock.MBps <= 0 || job == nil {
+		return nil
+	}
+	rate := config.Mock.MBps * 1024 * 1024
+	chunk := int64(rate / 4)
+	for done := int64(0); done < size; done += chunk {
+		job.waitIfPaused()
+		n := min(chunk, size-done)
+		select {
+		case <-job.ctx.Done():
+			return job.ctx.Err()
+		case <-time.After(time.Duration(float64(n) / rate * float64(time.Second))):
+		}
+		job.bytesCopied.Add(n)
+		job.progressed()
+	}
+	return nil
+}
+
+// Write a sparse file of a size, standing in for an image or uploaded object
+func writeMockFile(path string, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(size)
+}
+
+// Where a fake S3 object or Azure blob is kept
+func mockObjectPath(uri string) (string, error) {
+	if rest, ok := strings.CutPrefix(uri, "s3://"); ok {
+		return filepath.Join(config.Mock.Dir, "s3", filepath.FromSlash(rest)), nil
+	}
+	account, container, blob, err := parseAzureBlobURI(uri)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config.Mock.Dir, "azure", account, container, filepath.FromSlash(blob)), nil
+}
+
+// Simulate uploading a file to an S3 or Azure URI
+func mockUpload(job *Job, uri, file string) (string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", err
+	}
+	if err := mockTransfer(job, info.Size()); err != nil {
+		return "", err
+	}
+	if err := mockChaos("the upload of " + filepath.Base(file)); err != nil {
+		return "", err
+	}
+	target, err := mockObjectPath(uri)
+	if err != nil {
+		return "", err
+	}
+	if err := writeMockFile(target, info.Size()); err != nil {
+		return "", err
+	}
+	job.logf("Mock mode: stored %s as %s", filepath.Base(file), uri)
+	return uri, nil
+}
+
+func deleteMockObject(uri string) error {
+	target, err := mockObjectPath(uri)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List the fake objects under a prefix in a bucket or container directory
+func listMockObjects(dir, prefix string) ([]DestinationObject, error) {
+	var objects []DestinationObject
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, path)
+		if name := filepath.ToSlash(rel); strings.HasPrefix(name, prefix) {
+			objects = append(objects, DestinationObject{Name: name, Size: info.Size(),
+				LastModified: info.ModTime().UTC().Format(time.RFC3339)})
+		}
+		return nil
+	})
+	return objects, err
+}
+
+// The fake S3 buckets, creating the default one on first use
+func listMockBuckets() []string {
+	root := filepath.Join(config.Mock.Dir, "s3")
+	os.MkdirAll(filepath.Join(root, mockBucket), 0755)
+	var buckets []string
+	entries, _ := os.ReadDir(root)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			buckets = append(buckets, entry.Name())
+		}
+	}
+	return buckets
+}
+
+// The fake Azure containers (account/container), creating the default one on first use
+func listMockContainers() []string {
+	root := filepath.Join(config.Mock.Dir, "azure")
+	os.MkdirAll(filepath.Join(root, filepath.FromSlash(mockContainer)), 0755)
+	var containers []string
+	matches, _ := filepath.Glob(filepath.Join(root, "*", "*"))
+	for _, match := range matches {
+		if info, err := os.Stat(match); err == nil && info.IsDir() {
+			rel, _ := filepath.Rel(root, match)
+			containers = append(containers, filepath.ToSlash(rel))
+		}
+	}
+	return containers
+}
+
+// Simulate a cloud-side import, showing its progress as the real one does
+func mockImport(job *Job, kind, id, what string) error {
+	task := CloudTask{Kind: kind, ID: id, Status: "active"}
+	defer job.setCloudTask(nil)
+	for task.Percentage = 0; task.Percentage < 100; task.Percentage += 25 {
+		job.setCloudTask(&task)
+		select {
+		case <-job.ctx.Done():
+			return job.ctx.Err()
+		case <-time.After(mockImportStep):
+		}
+	}
+	return mockChaos(what)
+}
+
+// Simulate an AMI import. Simulated failures look like AWS failing on its side,
+// so they are retried as those are.
+func mockAWSImport(job *Job, s3Uri, bootMode string) (string, error) {
+	job.setStatus("Mock mode: importing %s as an AMI (%s boot)", s3Uri, bootMode)
+	id := fmt.Sprintf("import-ami-%017x", rand.Int63())
+	if err := mockImport(job, "AWS import-image", id, "the import of "+s3Uri); err != nil {
+		if job.ctx.Err() != nil {
+			return "", err
+		}
+		message := fmt.Sprintf("AWS import of %s failed: ServerInternalError: %s", s3Uri, err)
+		return "", &importError{Message: message, Diagnosis: diagnoseAWSImport(message)}
+	}
+	imageID := fmt.Sprintf("ami-%017x", rand.Int63())
+	job.logf("AMI %s is available", imageID)
+	return imageID, nil
+}
+
+// The simulated qemu-img: formats are told by file extension, sizes are file
+// sizes, and conversions write a sparse output the size of the input
+type mockImageTool struct{}
+
+func (mockImageTool) name() string { return "simulated qemu-img (mock mode)" }
+
+func (mockImageTool) available() bool { return true }
+
+func (mockImageTool) info(ctx context.Context, path string) (imageInfo, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return imageInfo{}, err
+	}
+	format := diskFormatForPath(path)
+	if format == "" {
+		format = "raw"
+	}
+	return imageInfo{Format: format, VirtualSize: info.Size(), ActualSize: info.Size()}, nil
+}
+
+// All of the disk holds data, as the sizes are the file's
+func (mockImageTool) extents(ctx context.Context, path string) ([]imageExtent, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return []imageExtent{{Length: info.Size(), Data: true}}, nil
+}
+
+func (mockImageTool) convert(ctx context.Context, job *Job, c imageConversion) error {
+	info, err := os.Stat(c.Input)
+	if err != nil {
+		return err
+	}
+	if job != nil {
+		job.logf("Mock mode: simulating qemu-img convert -f %s -O %s %s", c.InputFormat, c.OutputFormat, filepath.Base(c.Input))
+	}
+	if err := mockTransfer(job, info.Size()); err != nil {
+		return err
+	}
+	if err := mockChaos("the conversion of " + filepath.Base(c.Input)); err != nil {
+		return err
+	}
+	return writeMockFile(c.Output, info.Size())
+}
+
+func (mockImageTool) compare(ctx context.Context, a, b ComparedImage) (*int64, error) {
+	infoA, err := os.Stat(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	infoB, err := os.Stat(b.Path)
+	if err != nil {
+		return nil, err
+	}
+	if infoA.Size() == infoB.Size() {
+		return nil, nil
+	}
+	offset := min(infoA.Size(), infoB.Size())
+	return &offset, nil
+}
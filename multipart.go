@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An upload Porter has started but not yet finished. Records that outlive the upload
+// (e.g. after a crash) identify multipart uploads and uncommitted blocks Porter owns.
+type pendingUpload struct {
+	ID          string `json:"id"`
+	Cloud       string `json:"cloud"`
+	Destination string `json:"destination"`
+	// Azure subscription, or the region of an OCI or Swift upload
+	Subscription string `json:"subscription,omitempty"`
+	// S3-compatible endpoint or region of an S3 upload
+	S3        *s3Endpoint `json:"s3,omitempty"`
+	StartedAt time.Time   `json:"startedAt"`
+}
+
+type pendingUploadStore struct {
+	sync.Mutex
+	path    string
+	Uploads []pendingUpload `json:"uploads"`
+
+	// Uploads running in this process; everything else in the list is orphaned
+	active map[string]bool
+}
+
+var pendingUploads = loadPendingUploads(filepath.Join(stateDir, "pending-uploads.json"))
+
+func loadPendingUploads(path string) *pendingUploadStore {
+	s := &pendingUploadStore{path: path, active: map[string]bool{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return s
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		fmt.Printf("Warning: invalid pending upload list %s: %s (starting empty)\n", path, err)
+		return &pendingUploadStore{path: path, active: map[string]bool{}}
+	}
+	if len(s.Uploads) > 0 {
+		fmt.Printf("Found %d unfinished upload(s) from a previous run\n", len(s.Uploads))
+	}
+	return s
+}
+
+// Write the pending upload list; callers must hold the lock
+func (s *pendingUploadStore) save() {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		os.MkdirAll(filepath.Dir(s.path), 0755)
+		err = os.WriteFile(s.path, data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save pending uploads: %s\n", err)
+	}
+}
+
+// Record an upload as started
+func (s *pendingUploadStore) start(cloud, destination, subscription string) pendingUpload {
+	return s.add(pendingUpload{Cloud: cloud, Destination: destination, Subscription: subscription})
+}
+
+// Record an S3 upload as started, with the endpoint it is going to
+func (s *pendingUploadStore) startS3(destination string, endpoint *s3Endpoint) pendingUpload {
+	// Cleanup runs with Porter's own credentials, which outlive a job's
+	if endpoint != nil && endpoint.session != nil {
+		own := *endpoint
+		own.session = nil
+		endpoint = &own
+	}
+	return s.add(pendingUpload{Cloud: "aws", Destination: destination, S3: endpoint})
+}
+
+func (s *pendingUploadStore) add(upload pendingUpload) pendingUpload {
+	s.Lock()
+	defer s.Unlock()
+	upload.ID = newID()
+	upload.StartedAt = time.Now().UTC()
+	s.Uploads = append(s.Uploads, upload)
+	s.active[upload.ID] = true
+	s.save()
+	return upload
+}
+
+func (s *pendingUploadStore) finish(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.active, id)
+	for i, upload := range s.Uploads {
+		if upload.ID == id {
+			s.Uploads = append(s.Uploads[:i], s.Uploads[i+1:]...)
+			break
+		}
+	}
+	s.save()
+}
+
+// Stop treating an upload as running so the sweeper picks it up
+func (s *pendingUploadStore) release(id string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.active, id)
+}
+
+// Pending uploads that are not running in this process
+func (s *pendingUploadStore) orphaned() []pendingUpload {
+	s.Lock()
+	defer s.Unlock()
+	var orphans []pendingUpload
+	for _, upload := range s.Uploads {
+		if !s.active[upload.ID] {
+			orphans = append(orphans, upload)
+		}
+	}
+	return orphans
+}
+
+// Clean up after a failed or cancelled upload. If cleanup fails the record is
+// kept so the sweeper can retry later.
+func abandonUpload(upload pendingUpload) {
+	if err := cleanupIncompleteUpload(upload); err != nil {
+		fmt.Printf("Warning: failed to clean up incomplete upload %s: %s (will retry)\n", upload.Destination, err)
+		pendingUploads.release(upload.ID)
+		return
+	}
+	pendingUploads.finish(upload.ID)
+}
+
+// Clean up the storage left behind by a failed or cancelled upload
+func cleanupIncompleteUpload(upload pendingUpload) error {
+	switch upload.Cloud {
+	case "aws":
+		bucket, key, ok := strings.Cut(strings.TrimPrefix(upload.Destination, "s3://"), "/")
+		if !ok {
+			return fmt.Errorf("invalid S3 URI '%s'", upload.Destination)
+		}
+		aborted, err := abortS3MultipartUploads(upload.S3, bucket, key)
+		if aborted > 0 {
+			fmt.Printf("Aborted %d incomplete multipart upload(s) for %s\n", aborted, upload.Destination)
+		}
+		return err
+	case "azure":
+		storageAccount, container, blobName, err := parseAzureBlobURI(upload.Destination)
+		if err != nil {
+			return err
+		}
+		if sas, ok := azureSASFor(storageAccount, container); ok {
+			return discardAzureBlocksSAS(sas, blobName)
+		}
+		return discardAzureUncommittedBlocks(upload.Subscription, storageAccount, container, blobName)
+	case "azuredisk":
+		return deleteAzureDisk(upload.Destination)
+	case "oracle":
+		aborted, err := abortOCIMultipartUploads(upload.Subscription, upload.Destination)
+		if aborted > 0 {
+			fmt.Printf("Aborted %d incomplete multipart upload(s) for %s\n", aborted, upload.Destination)
+		}
+		return err
+	case "swift":
+		return deleteSwiftSegments(upload.Destination, upload.Subscription)
+	default:
+		return nil
+	}
+}
+
+// Abort any incomplete S3 multipart uploads for exactly this key, returning how many were aborted
+func abortS3MultipartUploads(endpoint *s3Endpoint, bucket, key string) (int, error) {
+	out, err := endpoint.command(context.Background(), "s3api", "list-multipart-uploads",
+		"--bucket", bucket,
+		"--prefix", key,
+		"--query", fmt.Sprintf("Uploads[?Key=='%s'].UploadId", strings.ReplaceAll(key, "'", "\\'")),
+		"--output", "text").Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list multipart uploads: %w", err)
+	}
+
+	aborted := 0
+	for _, uploadID := range strings.Fields(string(out)) {
+		if uploadID == "None" {
+			continue
+		}
+		out, err := endpoint.command(context.Background(), "s3api", "abort-multipart-upload",
+			"--bucket", bucket,
+			"--key", key,
+			"--upload-id", uploadID).CombinedOutput()
+		if err != nil {
+			return aborted, fmt.Errorf("failed to abort upload %s: %w\nOutput: %s", uploadID, err, out)
+		}
+		aborted++
+	}
+	return aborted, nil
+}
+
+// Azure has no API to delete uncommitted blocks directly. If the blob was never committed,
+// committing an empty blob under the same name discards the blocks, and deleting it cleans up.
+// A blob that already exists is left alone; its uncommitted blocks expire after 7 days.
+func discardAzureUncommittedBlocks(subscription, storageAccount, container, blobName string) error {
+	common := []string{
+		"--account-name", storageAccount,
+		"--container-name", container,
+		"--name", blobName,
+		"--auth-mode", "login"}
+	if subscription != "" {
+		common = append(common, "--subscription", subscription)
+	}
+
+	out, err := toolCommand(context.Background(), "az", append([]string{"storage", "blob", "exists", "--query", "exists", "-o", "tsv"}, common...)...).Output()
+	if err != nil {
+		return fmt.Errorf("failed to check blob: %w", err)
+	}
+	if strings.TrimSpace(string(out)) == "true" {
+		return nil
+	}
+
+	if out, err := toolCommand(context.Background(), "az", append([]string{"storage", "blob", "upload", "--data", "", "--overwrite"}, common...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to discard uncommitted blocks: %w\nOutput: %s", err, out)
+	}
+	if out, err := toolCommand(context.Background(), "az", append([]string{"storage", "blob", "delete"}, common...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete placeholder blob: %w\nOutput: %s", err, out)
+	}
+	fmt.Printf("Discarded uncommitted blocks for %s\n", azureBlobURI(storageAccount, container, blobName))
+	return nil
+}
+
+// Periodically clean up uploads Porter started that never finished, e.g. after a crash
+func runMultipartSweeper() {
+	interval := time.Duration(config.MultipartSweepIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		fmt.Println("Multipart upload sweeper disabled")
+		return
+	}
+
+	for {
+		for _, upload := range pendingUploads.orphaned() {
+			fmt.Printf("Sweeping orphaned %s upload %s (started %s)\n", upload.Cloud, upload.Destination, upload.StartedAt.Format(time.RFC3339))
+			if err := cleanupIncompleteUpload(upload); err != nil {
+				fmt.Printf("Warning: failed to clean up %s: %s\n", upload.Destination, err)
+				continue
+			}
+			pendingUploads.finish(upload.ID)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Names and URLs built the same way for several destinations
+
+var resourceNameInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// A name for the image, disk or VM a job creates from a file: the job's name
+// (or the file's), then the job ID, as lowercase letters, digits and hyphens
+// starting with a letter and at most 63 long. IBM VPC, Compute Engine and
+// Azure names all accept it.
+func imageResourceName(job *Job, file string) string {
+	name := job.Spec.Name
+	if name == "" {
+		name = baseNameWithoutExt(file)
+	}
+	name = strings.Trim(resourceNameInvalid.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if name == "" || name[0] < 'a' || name[0] > 'z' {
+		name = "porter-" + name
+	}
+	name += "-" + job.ID
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
+
+// Join a base URL and a slash-separated path, escaping each segment
+func joinEscapedURL(base, p string) string {
+	u := strings.TrimRight(base, "/")
+	for _, segment := range strings.Split(strings.Trim(p, "/"), "/") {
+		if segment != "" {
+			u += "/" + url.PathEscape(segment)
+		}
+	}
+	return u
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// NFS exports, written like the local filesystem target once mounted. Exports
+// are nfs://server/export/path, or server:/export/path. An nfs destination
+// profile can name a mountPath where its url is already mounted (by the host or
+// a Kubernetes volume); otherwise Porter mounts the export under nfsMountRoot
+// for as long as uploads, listings or deletes need it, with the profile's
+// mountOptions or NFS_MOUNT_OPTIONS. Mounting needs mount.nfs and the
+// SYS_ADMIN capability.
+
+const nfsMountRoot = "/app/mnt"
+
+type nfsExport struct {
+	Server string
+	Path   string
+}
+
+// Parse nfs://server/path or server:/path
+func parseNFSURL(rawURL string) (nfsExport, error) {
+	if server, p, ok := strings.Cut(rawURL, ":/"); ok && !strings.Contains(rawURL, "://") && !strings.Contains(server, "/") {
+		rawURL = "nfs://" + server + "/" + p
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "nfs" || u.Host == "" {
+		return nfsExport{}, fmt.Errorf("invalid NFS export '%s'", rawURL)
+	}
+	return nfsExport{Server: u.Host, Path: path.Clean("/" + u.Path)}, nil
+}
+
+func (e nfsExport) String() string {
+	return "nfs://" + e.Server + e.Path
+}
+
+// The nfs:// URL of a file under the export
+func (e nfsExport) fileURL(p string) string {
+	return "nfs://" + e.Server + path.Join(e.Path, p)
+}
+
+// Whether the export is at or under another
+func (e nfsExport) under(base nfsExport) bool {
+	return e.Server == base.Server && (e.Path == base.Path || base.Path == "/" || strings.HasPrefix(e.Path, base.Path+"/"))
+}
+
+// The nfs profile whose url an export is at or under
+func nfsProfile(export nfsExport) (nfsExport, DestinationProfile, bool) {
+	for _, profile := range config.Destinations {
+		if profile.Cloud != "nfs" || profile.URL == "" {
+			continue
+		}
+		if base, err := parseNFSURL(profile.URL); err == nil && export.under(base) {
+			return base, profile, true
+		}
+	}
+	return nfsExport{}, DestinationProfile{}, false
+}
+
+// Mounts Porter made, by mount point, with the number of callers using each
+var nfsMounts = struct {
+	sync.Mutex
+	users map[string]int
+}{users: map[string]int{}}
+
+// Whether a directory is a mount point, from /proc/self/mountinfo
+func isMountPoint(dir string) bool {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 4 && fields[4] == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Make the folder an NFS URL names available locally, returning its path and a
+// function to call when done with it. A profile's export is mounted as a whole,
+// so everything under it shares one mount.
+func mountNFS(ctx context.Context, rawURL string) (string, func(), error) {
+	export, err := parseNFSURL(rawURL)
+	if err != nil {
+		return "", nil, err
+	}
+	mountExport, options := export, os.Getenv("NFS_MOUNT_OPTIONS")
+	if base, profile, ok := nfsProfile(export); ok {
+		rel := strings.TrimPrefix(strings.TrimPrefix(export.Path, base.Path), "/")
+		if profile.MountPath != "" {
+			return filepath.Join(profile.MountPath, rel), func() {}, nil
+		}
+		mountExport = base
+		if profile.MountOptions != "" {
+			options = profile.MountOptions
+		}
+	}
+	rel := strings.TrimPrefix(strings.TrimPrefix(export.Path, mountExport.Path), "/")
+	sum := sha256.Sum256([]byte(mountExport.String()))
+	dir := filepath.Join(nfsMountRoot, fmt.Sprintf("%x", sum[:6]))
+
+	nfsMounts.Lock()
+	defer nfsMounts.Unlock()
+	// A mount left behind by an earlier run is reused
+	if nfsMounts.users[dir] == 0 && !isMountPoint(dir) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", nil, err
+		}
+		args := []string{"-t", "nfs"}
+		if options != "" {
+			args = append(args, "-o", options)
+		}
+		source := mountExport.Server + ":" + mountExport.Path
+		fmt.Printf("Mounting %s at %s\n", source, dir)
+		if out, err := exec.CommandContext(ctx, "mount", append(args, source, dir)...).CombinedOutput(); err != nil {
+			return "", nil, fmt.Errorf("mounting %s failed: %w: %s", source, err, strings.TrimSpace(string(out)))
+		}
+	}
+	nfsMounts.users[dir]++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			nfsMounts.Lock()
+			defer nfsMounts.Unlock()
+			nfsMounts.users[dir]--
+			if nfsMounts.users[dir] > 0 {
+				return
+			}
+			delete(nfsMounts.users, dir)
+			if out, err := exec.Command("umount", dir).CombinedOutput(); err != nil {
+				// Something still has files open; detach it and let the kernel finish
+				fmt.Printf("Warning: unmounting %s failed (%s); detaching it\n", dir, strings.TrimSpace(string(out)))
+				exec.Command("umount", "-l", dir).Run()
+			}
+			os.Remove(dir)
+		})
+	}
+	return filepath.Join(dir, rel), release, nil
+}
+
+// Free space in bytes on the filesystem holding path
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Copy one file to a folder on an NFS export, returning its nfs:// URL and sha256
+func uploadToNFS(job *Job, s uploadSettings, file string) (string, string, error) {
+	export, err := parseNFSURL(s.URL)
+	if err != nil {
+		return "", "", err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Mounting %s", export)
+	dir, release, err := mountNFS(job.ctx, s.URL)
+	if err != nil {
+		return "", "", err
+	}
+	defer release()
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		return "", "", fmt.Errorf("checking free space on %s failed: %w", export, err)
+	}
+	if free < info.Size() {
+		return "", "", fmt.Errorf("not enough space on %s for %s: %.2f GB free, %.2f GB needed",
+			export, filepath.Base(file), float64(free)/(1<<30), float64(info.Size())/(1<<30))
+	}
+	job.logf("%s has %.2f GB free", export, float64(free)/(1<<30))
+
+	target := filepath.Join(dir, s.Target)
+	if target != dir && !strings.HasPrefix(target, dir+"/") {
+		return "", "", fmt.Errorf("folder '%s' is outside the export", s.Target)
+	}
+	local := s
+	local.Target = target
+	_, sum, err := copyToLocal(job, local, file)
+	if err != nil {
+		return "", "", err
+	}
+	return export.fileURL(path.Join(s.Target, filepath.Base(file))), sum, nil
+}
+
+func deleteNFSFile(rawURL string) error {
+	export, err := parseNFSURL(rawURL)
+	if err != nil {
+		return err
+	}
+	dir, release, err := mountNFS(context.Background(), export.fileURL(".."))
+	if err != nil {
+		return err
+	}
+	defer release()
+	err = os.Remove(filepath.Join(dir, path.Base(export.Path)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// List the files in a folder on an export, named relative to the export
+func listNFSObjects(ctx context.Context, exportURL, prefix string) ([]DestinationObject, error) {
+	dir, release, err := mountNFS(ctx, exportURL)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	objects, err := listLocalObjects(filepath.Join(dir, prefix))
+	for i := range objects {
+		objects[i].Name = path.Join(prefix, filepath.Base(objects[i].Name))
+	}
+	return objects, err
+}
+
+// Confirm some export is configured and can be mounted
+func checkNFSCredentials(ctx context.Context) error {
+	exportURL := os.Getenv("NFS_URL")
+	if exportURL == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "nfs" && profile.URL != "" {
+				exportURL = profile.URL
+				break
+			}
+		}
+	}
+	if exportURL == "" {
+		return errors.New("no NFS export configured; set NFS_URL or add an nfs destination profile")
+	}
+	dir, release, err := mountNFS(ctx, exportURL)
+	if err != nil {
+		return err
+	}
+	defer release()
+	_, err = freeSpace(dir)
+	return err
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Completion notifications: when configured, each job that finishes (after
+// starting) is announced to a webhook and/or by email. In digest mode the
+// completions are collected over a window instead and sent as one summary when
+// it closes, so a bulk wave of hundreds of jobs makes one message rather than
+// hundreds. Notifications are sent in the background and never fail a job.
+type NotificationConfig struct {
+	// Webhook to post each notification to as JSON; its "text" field suits
+	// Slack and Teams incoming webhooks
+	URL string `json:"url,omitempty"`
+	// Bearer token for the webhook (default PORTER_NOTIFY_TOKEN)
+	Token string `json:"token,omitempty"`
+	// Shared secret webhook payloads are signed with (default
+	// PORTER_NOTIFY_SECRET); see webhook.go
+	Secret string `json:"secret,omitempty"`
+	// Tries per webhook delivery before it goes to the dead-letter log
+	// (default 6)
+	WebhookAttempts int `json:"webhookAttempts,omitempty"`
+	// Email through an SMTP server (host:port) from one address to others; the
+	// password defaults to PORTER_SMTP_PASSWORD
+	SMTPServer string   `json:"smtpServer,omitempty"`
+	From       string   `json:"from,omitempty"`
+	To         []string `json:"to,omitempty"`
+	Username   string   `json:"username,omitempty"`
+	Password   string   `json:"password,omitempty"`
+	// Minutes to collect completions for before sending them as one digest
+	// (0 sends one notification per job)
+	DigestMinutes int `json:"digestMinutes,omitempty"`
+	// Only notify about jobs that failed or were cancelled
+	FailuresOnly bool `json:"failuresOnly,omitempty"`
+}
+
+// Timeout per webhook delivery attempt
+const notificationTimeout = 30 * time.Second
+
+// A finished job as notifications describe it
+type notifiedJob struct {
+	ID           string   `json:"id"`
+	VM           string   `json:"vm"`
+	Cloud        string   `json:"cloud"`
+	State        string   `json:"state"`
+	Message      string   `json:"message,omitempty"`
+	Destinations []string `json:"destinations,omitempty"`
+	Errors       []string `json:"errors,omitempty"`
+	Report       string   `json:"report,omitempty"`
+}
+
+// Finished jobs waiting to be notified, in order
+var notificationEvents = make(chan notifiedJob, 1000)
+
+func notificationsEnabled() bool {
+	return config.Notifications.URL != "" || config.Notifications.SMTPServer != ""
+}
+
+// Queue a notification for a job that finished
+func queueNotification(job *Job, state string) {
+	if !notificationsEnabled() || (config.Notifications.FailuresOnly && state == jobCompleted) {
+		return
+	}
+	select {
+	case notificationEvents <- describeNotifiedJob(job, state):
+	default:
+		fmt.Printf("Warning: notification queue full, not reporting job %s %s\n", job.ID, state)
+	}
+}
+
+func describeNotifiedJob(job *Job, state string) notifiedJob {
+	snap := job.snapshot()
+	n := notifiedJob{ID: snap.ID, VM: snap.Spec.Name, Cloud: snap.Spec.Cloud, State: state, Message: strings.TrimSpace(snap.Message)}
+	if n.VM == "" && len(snap.Files) > 0 {
+		n.VM = baseNameWithoutExt(snap.Files[0])
+	}
+	for _, r := range snap.Results {
+		if r.Error != "" {
+			n.Errors = append(n.Errors, r.File+": "+r.Error)
+		} else {
+			n.Destinations = append(n.Destinations, r.Destination)
+		}
+	}
+	if config.PublicURL != "" {
+		n.Report = strings.TrimRight(config.PublicURL, "/") + "/api/jobs/" + snap.ID + "/report?format=text"
+	}
+	return n
+}
+
+// Send queued notifications, one per job or as digests; run in the background from main
+func runNotifications() {
+	window := time.Duration(config.Notifications.DigestMinutes) * time.Minute
+	var pending []notifiedJob
+	var opened time.Time
+	var flush <-chan time.Time
+	for {
+		select {
+		case n := <-notificationEvents:
+			if window <= 0 {
+				sendNotification(fmt.Sprintf(tr("Porter job %s %s: %s to %s"), n.ID, n.State, n.VM, n.Cloud), notificationText(n), []notifiedJob{n})
+				continue
+			}
+			// The first completion opens the window
+			if len(pending) == 0 {
+				opened = time.Now()
+				flush = time.After(window)
+			}
+			pending = append(pending, n)
+		case <-flush:
+			subject, text := digestText(pending, opened, time.Now())
+			sendNotification(subject, text, pending)
+			pending, flush = nil, nil
+		}
+	}
+}
+
+// The text announcing one job
+func notificationText(n notifiedJob) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, tr("Porter job %s (%s to %s) %s.\n"), n.ID, n.VM, n.Cloud, n.State)
+	if n.Message != "" {
+		fmt.Fprintf(&b, "%s\n", n.Message)
+	}
+	for _, d := range n.Destinations {
+		fmt.Fprintf(&b, "- %s\n", d)
+	}
+	for _, e := range n.Errors {
+		fmt.Fprintf(&b, tr("- failed: %s\n"), e)
+	}
+	if n.Report != "" {
+		fmt.Fprintf(&b, tr("Transfer report: %s\n"), n.Report)
+	}
+	return b.String()
+}
+
+// Jobs listed per state in a digest; the rest are counted
+const digestListLimit = 50
+
+// The subject and text summarising the jobs that finished in a window,
+// failures first
+func digestText(jobs []notifiedJob, from, to time.Time) (string, string) {
+	byState := map[string][]notifiedJob{}
+	for _, n := range jobs {
+		byState[n.State] = append(byState[n.State], n)
+	}
+	var counts []string
+	for _, state := range []string{jobCompleted, jobFailed, jobCancelled} {
+		if len(byState[state]) > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", len(byState[state]), state))
+		}
+	}
+	subject := fmt.Sprintf(tr("Porter: %d jobs finished (%s)"), len(jobs), strings.Join(counts, ", "))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, tr("%d jobs finished between %s and %s: %s.\n"), len(jobs),
+		from.UTC().Format("2006-01-02 15:04"), to.UTC().Format("15:04 MST"), strings.Join(counts, ", "))
+	for _, state := range []string{jobFailed, jobCancelled, jobCompleted} {
+		list := byState[state]
+		if len(list) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\n%s:\n", strings.ToUpper(state[:1])+state[1:])
+		for i, n := range list {
+			if i == digestListLimit {
+				fmt.Fprintf(&b, tr("- and %d more\n"), len(list)-i)
+				break
+			}
+			fmt.Fprintf(&b, "- %s (%s to %s)", n.ID, n.VM, n.Cloud)
+			if state != jobCompleted && n.Message != "" {
+				fmt.Fprintf(&b, ": %s", strings.SplitN(n.Message, "\n", 2)[0])
+			}
+			b.WriteString("\n")
+		}
+	}
+	return subject, b.String()
+}
+
+// Deliver a notification to the webhook and by email, logging failures
+func sendNotification(subject, text string, jobs []notifiedJob) {
+	if config.Notifications.URL != "" {
+		// Retries can take minutes, so webhooks are delivered on their own
+		go deliverWebhook(newWebhookDelivery(subject, text, jobs))
+	}
+	if config.Notifications.SMTPServer != "" {
+		if err := sendNotificationEmail(subject, text); err != nil {
+			fmt.Printf("Warning: notification email failed: %s\n", err)
+		}
+	}
+}
+
+func sendNotificationEmail(subject, text string) error {
+	cfg := config.Notifications
+	if cfg.From == "" || len(cfg.To) == 0 {
+		return fmt.Errorf("set 'from' and 'to' to send notification email")
+	}
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		password := cfg.Password
+		if password == "" {
+			password = os.Getenv("PORTER_SMTP_PASSWORD")
+		}
+		host, _, _ := net.SplitHostPort(cfg.SMTPServer)
+		auth = smtp.PlainAuth("", cfg.Username, password, host)
+	}
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s",
+		cfg.From, strings.Join(cfg.To, ", "), subject, time.Now().Format(time.RFC1123Z), strings.ReplaceAll(text, "\n", "\r\n"))
+	return smtp.SendMail(cfg.SMTPServer, auth, cfg.From, cfg.To, []byte(message))
+}
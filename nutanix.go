@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Nutanix AHV: each disk is added to the image service through Prism's v3 API,
+// ready to clone VM disks from. The image is created empty, its data sent with
+// a PUT to the image's file, and the task and image polled until the image is
+// complete. The image is named after the source VM (the job's name, or the
+// VM's name in its OVF) and described with the VM's OVF annotation, or its
+// hardware if it has none.
+//
+// The Prism Central or Element URL (https://prism.example.com:9440) comes from
+// the request, a nutanix profile or NUTANIX_URL; credentials from the request,
+// the profile whose url it is under or NUTANIX_USERNAME and NUTANIX_PASSWORD.
+// Set NUTANIX_INSECURE=1 for Prism's self-signed certificate.
+
+// How long to wait for Prism to finish an image
+const nutanixImageTimeout = 2 * time.Hour
+
+// The credentials for a Prism URL
+func nutanixCredentials(rawURL, username, password string) (string, string) {
+	if username != "" {
+		return username, password
+	}
+	if username, password, ok := profileCredentials("nutanix", rawURL); ok {
+		return username, password
+	}
+	return os.Getenv("NUTANIX_USERNAME"), os.Getenv("NUTANIX_PASSWORD")
+}
+
+// Call Prism's v3 API with a JSON body (if not nil), decoding the response
+// into out (if not nil)
+func nutanixRequest(ctx context.Context, s uploadSettings, method, endpoint string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(s.URL, "/")+"/api/nutanix/v3"+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	username, password := nutanixCredentials(s.URL, s.Username, s.Password)
+	req.SetBasicAuth(username, password)
+	return nutanixDo(req, out)
+}
+
+func nutanixDo(req *http.Request, out interface{}) error {
+	resp, err := insecureClient("NUTANIX_INSECURE").Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		// Errors come as a message list
+		var failure struct {
+			MessageList []struct {
+				Message string `json:"message"`
+				Reason  string `json:"reason"`
+			} `json:"message_list"`
+		}
+		if json.Unmarshal(data, &failure) == nil && len(failure.MessageList) > 0 {
+			return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, failure.MessageList[0].Message)
+		}
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// The image name and description for a disk
+func nutanixImageText(job *Job, file string) (string, string) {
+	hw := hardwareForDisk(file)
+	name := job.Spec.Name
+	if name == "" {
+		name = hw.Name
+	}
+	// A VM with several disks gets an image per disk
+	if len(job.Files) > 1 {
+		name += " " + baseNameWithoutExt(diskVMDKName(file))
+	}
+	description := hw.Annotation
+	if description == "" {
+		description = fmt.Sprintf("%s: %d vCPU, %d MB memory, %s firmware", hw.Name, hw.CPUs, hw.MemoryMB, hw.Firmware)
+		if hw.OSType != "" {
+			description += ", guest OS " + hw.OSType
+		}
+	}
+	return name, description + " (imported by Porter job " + job.ID + ")"
+}
+
+// Upload one disk to the Nutanix image service, returning the image's UUID
+func uploadToNutanix(job *Job, s uploadSettings, file string) (string, error) {
+	if _, err := os.Stat(file); err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	name, description := nutanixImageText(job, file)
+	var created struct {
+		Status struct {
+			ExecutionContext struct {
+				TaskUUID string `json:"task_uuid"`
+			} `json:"execution_context"`
+		} `json:"status"`
+		Metadata struct {
+			UUID string `json:"uuid"`
+		} `json:"metadata"`
+	}
+	image := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"name":        name,
+			"description": description,
+			"resources":   map[string]string{"image_type": "DISK_IMAGE"},
+		},
+		"metadata":    map[string]string{"kind": "image"},
+		"api_version": "3.1.0",
+	}
+	job.setStatus("Creating Nutanix image %s", name)
+	if err := nutanixRequest(job.ctx, s, http.MethodPost, "/images", image, &created); err != nil {
+		return "", fmt.Errorf("creating Nutanix image %s failed: %w", name, err)
+	}
+	id := created.Metadata.UUID
+	if err := waitForNutanixTask(job, s, created.Status.ExecutionContext.TaskUUID, "creating image "+name); err != nil {
+		return "", err
+	}
+
+	st, err := openUploadStream(job, s, file)
+	if err != nil {
+		return "", err
+	}
+	defer st.Close()
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPut,
+		strings.TrimRight(s.URL, "/")+"/api/nutanix/v3/images/"+id+"/file", st)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = st.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	username, password := nutanixCredentials(s.URL, s.Username, s.Password)
+	req.SetBasicAuth(username, password)
+	job.setStatus("Sending %s to Nutanix image %s", filepath.Base(file), name)
+	if err := nutanixDo(req, nil); err != nil {
+		// Don't leave an empty image behind
+		if deleteErr := deleteNutanixImage(s.URL, id); deleteErr != nil {
+			job.warnf("Deleting the empty image %s failed: %s", id, deleteErr)
+		}
+		return "", fmt.Errorf("uploading %s to Nutanix image %s failed: %w", file, name, err)
+	}
+	st.finish()
+
+	// Prism checks and stores the image after the upload
+	task := CloudTask{Kind: "Nutanix image", ID: id, Status: "PENDING"}
+	err = waitForCloudTask(job, task, nutanixImageTimeout, func(t *CloudTask) (bool, error) {
+		var status struct {
+			Status struct {
+				State       string `json:"state"`
+				MessageList []struct {
+					Message string `json:"message"`
+				} `json:"message_list"`
+			} `json:"status"`
+		}
+		if err := nutanixRequest(job.ctx, s, http.MethodGet, "/images/"+id, nil, &status); err != nil {
+			return false, err
+		}
+		t.Status = status.Status.State
+		if t.Status == "ERROR" {
+			if len(status.Status.MessageList) > 0 {
+				return false, fmt.Errorf("Nutanix image %s failed: %s", name, status.Status.MessageList[0].Message)
+			}
+			return false, fmt.Errorf("Nutanix image %s failed", name)
+		}
+		return t.Status == "COMPLETE", nil
+	})
+	if err != nil {
+		return "", err
+	}
+	job.logf("Nutanix image %s (%s) is ready", name, id)
+	return id, nil
+}
+
+// Wait for a Prism task, showing its progress in the job
+func waitForNutanixTask(job *Job, s uploadSettings, id, what string) error {
+	if id == "" {
+		return nil
+	}
+	task := CloudTask{Kind: "Nutanix task", ID: id, Status: "QUEUED"}
+	return waitForCloudTask(job, task, nutanixImageTimeout, func(t *CloudTask) (bool, error) {
+		var status struct {
+			Status             string `json:"status"`
+			PercentageComplete int    `json:"percentage_complete"`
+			ErrorDetail        string `json:"error_detail"`
+		}
+		if err := nutanixRequest(job.ctx, s, http.MethodGet, "/tasks/"+id, nil, &status); err != nil {
+			return false, err
+		}
+		t.Status, t.Percentage = status.Status, status.PercentageComplete
+		switch status.Status {
+		case "SUCCEEDED":
+			return true, nil
+		case "FAILED", "ABORTED":
+			return false, fmt.Errorf("%s failed: %s", what, status.ErrorDetail)
+		}
+		return false, nil
+	})
+}
+
+// Delete an uploaded image by its UUID
+func deleteNutanixImage(endpoint, dest string) error {
+	return nutanixRequest(context.Background(), uploadSettings{URL: endpoint}, http.MethodDelete, "/images/"+url.PathEscape(path.Base(dest)), nil, nil)
+}
+
+// List the images whose names start with prefix
+func listNutanixImages(ctx context.Context, server, prefix string) ([]DestinationObject, error) {
+	var images struct {
+		Entities []struct {
+			Spec struct {
+				Name string `json:"name"`
+			} `json:"spec"`
+			Status struct {
+				Resources struct {
+					SizeBytes int64 `json:"size_bytes"`
+				} `json:"resources"`
+			} `json:"status"`
+			Metadata struct {
+				UUID           string `json:"uuid"`
+				LastUpdateTime string `json:"last_update_time"`
+			} `json:"metadata"`
+		} `json:"entities"`
+	}
+	request := map[string]interface{}{"kind": "image", "length": 500}
+	if err := nutanixRequest(ctx, uploadSettings{URL: server}, http.MethodPost, "/images/list", request, &images); err != nil {
+		return nil, err
+	}
+	var objects []DestinationObject
+	for _, image := range images.Entities {
+		if strings.HasPrefix(image.Spec.Name, prefix) {
+			objects = append(objects, DestinationObject{Name: image.Spec.Name + " (" + image.Metadata.UUID + ")",
+				Size: image.Status.Resources.SizeBytes, LastModified: image.Metadata.LastUpdateTime})
+		}
+	}
+	return objects, nil
+}
+
+// Confirm Prism is configured and accepts Porter's credentials
+func checkNutanixCredentials(ctx context.Context) error {
+	server := os.Getenv("NUTANIX_URL")
+	if server == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "nutanix" && profile.URL != "" {
+				server = profile.URL
+				break
+			}
+		}
+	}
+	if server == "" {
+		return errors.New("no Nutanix Prism configured; set NUTANIX_URL or add a nutanix destination profile")
+	}
+	return nutanixRequest(ctx, uploadSettings{URL: server}, http.MethodGet, "/users/me", nil, nil)
+}
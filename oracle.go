@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Oracle Cloud Infrastructure Object Storage, through the oci CLI with the
+// credentials in ~/.oci/config. Objects are addressed as
+// oci://<bucket>@<namespace>/<key>, the form OCI's own tools use. Bucket listing
+// needs a compartment: the one requested, OCI_COMPARTMENT_ID, or the tenancy
+// (root compartment) from ~/.oci/config.
+
+// An oci CLI command, in the given region if set
+func ociCommand(region string, args ...string) []string {
+	if region != "" {
+		args = append(args, "--region", region)
+	}
+	return args
+}
+
+// The tenancy's Object Storage namespace
+func ociNamespace(ctx context.Context, region string) (string, error) {
+	out, err := toolCommand(ctx, "oci", ociCommand(region, "os", "ns", "get")...).Output()
+	if err != nil {
+		return "", fmt.Errorf("oci os ns get failed: %w", err)
+	}
+	var resp struct {
+		Data string `json:"data"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil || resp.Data == "" {
+		return "", fmt.Errorf("unexpected oci os ns get output: %s", strings.TrimSpace(string(out)))
+	}
+	return resp.Data, nil
+}
+
+func parseOCIObjectURI(uri string) (bucket, namespace, key string, err error) {
+	location, key, ok := strings.Cut(strings.TrimPrefix(uri, "oci://"), "/")
+	bucket, namespace, ok2 := strings.Cut(location, "@")
+	if !ok || !ok2 || !strings.HasPrefix(uri, "oci://") {
+		return "", "", "", fmt.Errorf("invalid OCI object URI '%s'", uri)
+	}
+	return bucket, namespace, key, nil
+}
+
+// Upload one file to an Object Storage bucket, returning its oci:// URI
+func uploadToOracle(job *Job, s uploadSettings, file string) (string, error) {
+	namespace, err := ociNamespace(job.ctx, s.Region)
+	if err != nil {
+		return "", err
+	}
+	key := filepath.Base(file)
+	if s.Target != "" {
+		key = strings.Trim(s.Target, "/") + "/" + key
+	}
+	uri := "oci://" + s.Bucket + "@" + namespace + "/" + key
+
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Uploading %s to OCI Object Storage: %s (%.2f MB)",
+		filepath.Base(file), uri, float64(fileInfo.Size())/(1024*1024))
+
+	// Objects have no tags, so profile tags are stored as metadata too
+	args := []string{"os", "object", "put", "--namespace", namespace, "--bucket-name", s.Bucket,
+		"--name", key, "--file", file, "--force", "--no-retry"}
+	metadata := map[string]string{}
+	for k, v := range s.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range s.Tags {
+		metadata[k] = v
+	}
+	if len(metadata) > 0 {
+		data, _ := json.Marshal(metadata)
+		args = append(args, "--metadata", string(data))
+	}
+	cmd := toolCommand(job.ctx, "oci", ociCommand(s.Region, args...)...)
+	pending := pendingUploads.start("oracle", uri, s.Region)
+	if err := runJobCommand(job, cmd); err != nil {
+		abandonUpload(pending)
+		return "", fmt.Errorf("OCI Object Storage upload failed for %s: %w", file, err)
+	}
+	pendingUploads.finish(pending.ID)
+	return uri, nil
+}
+
+func deleteOCIObject(region, uri string) error {
+	bucket, namespace, key, err := parseOCIObjectURI(uri)
+	if err != nil {
+		return err
+	}
+	out, err := toolCommand(context.Background(), "oci", ociCommand(region, "os", "object", "delete", "--namespace", namespace,
+		"--bucket-name", bucket, "--object-name", key, "--force")...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// Abort the multipart uploads the oci CLI left behind for an object
+func abortOCIMultipartUploads(region, uri string) (int, error) {
+	bucket, namespace, key, err := parseOCIObjectURI(uri)
+	if err != nil {
+		return 0, err
+	}
+	out, err := toolCommand(context.Background(), "oci", ociCommand(region, "os", "multipart", "list", "--namespace", namespace,
+		"--bucket-name", bucket, "--all")...).Output()
+	if err != nil {
+		return 0, fmt.Errorf("oci os multipart list failed: %w", err)
+	}
+	// No incomplete uploads prints nothing
+	var resp struct {
+		Data []struct {
+			Object   string `json:"object"`
+			UploadID string `json:"upload-id"`
+		} `json:"data"`
+	}
+	if len(strings.TrimSpace(string(out))) > 0 {
+		if err := json.Unmarshal(out, &resp); err != nil {
+			return 0, fmt.Errorf("unexpected oci os multipart list output: %w", err)
+		}
+	}
+	aborted := 0
+	for _, upload := range resp.Data {
+		if upload.Object != key {
+			continue
+		}
+		if out, err := toolCommand(context.Background(), "oci", ociCommand(region, "os", "multipart", "abort", "--namespace", namespace,
+			"--bucket-name", bucket, "--object-name", key, "--upload-id", upload.UploadID, "--force")...).CombinedOutput(); err != nil {
+			return aborted, fmt.Errorf("aborting upload %s failed: %w\nOutput: %s", upload.UploadID, err, out)
+		}
+		aborted++
+	}
+	return aborted, nil
+}
+
+// List objects under a prefix in a bucket
+func listOCIObjects(ctx context.Context, region, bucket, prefix string) ([]DestinationObject, error) {
+	namespace, err := ociNamespace(ctx, region)
+	if err != nil {
+		return nil, err
+	}
+	out, err := toolCommand(ctx, "oci", ociCommand(region, "os", "object", "list", "--namespace", namespace,
+		"--bucket-name", bucket, "--prefix", prefix, "--all", "--fields", "name,size,timeModified")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("oci os object list failed: %w", err)
+	}
+	var resp struct {
+		Data []struct {
+			Name         string `json:"name"`
+			Size         int64  `json:"size"`
+			TimeModified string `json:"time-modified"`
+		} `json:"data"`
+	}
+	if len(strings.TrimSpace(string(out))) > 0 {
+		if err := json.Unmarshal(out, &resp); err != nil {
+			return nil, fmt.Errorf("failed to parse OCI object listing: %w", err)
+		}
+	}
+	var objects []DestinationObject
+	for _, o := range resp.Data {
+		objects = append(objects, DestinationObject{Name: o.Name, Size: o.Size, LastModified: o.TimeModified})
+	}
+	return objects, nil
+}
+
+// The compartment to list buckets in when none is given: OCI_COMPARTMENT_ID, or
+// the tenancy of the DEFAULT profile in ~/.oci/config
+func defaultOCICompartment() (string, error) {
+	if id := os.Getenv("OCI_COMPARTMENT_ID"); id != "" {
+		return id, nil
+	}
+	home, _ := os.UserHomeDir()
+	f, err := os.Open(filepath.Join(home, ".oci", "config"))
+	if err != nil {
+		return "", errors.New("no compartment given, OCI_COMPARTMENT_ID is not set and ~/.oci/config could not be read")
+	}
+	defer f.Close()
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			section = strings.Trim(line, "[]")
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && section == "DEFAULT" && strings.TrimSpace(key) == "tenancy" {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", errors.New("no tenancy in the DEFAULT profile of ~/.oci/config")
+}
+
+func checkOracleCredentials(ctx context.Context) error {
+	_, err := ociNamespace(ctx, "")
+	return err
+}
+
+func listOracleRegions(ctx context.Context) ([]string, error) {
+	out, err := toolCommand(ctx, "oci", "iam", "region-subscription", "list").Output()
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data []struct {
+			RegionName string `json:"region-name"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, err
+	}
+	var regions []string
+	for _, r := range resp.Data {
+		regions = append(regions, r.RegionName)
+	}
+	return regions, nil
+}
+
+// Handler for GET /oracle/buckets: the namespace and the buckets in a compartment
+// (?compartment=, default as above) and region (?region=, default from ~/.oci/config)
+func oracleBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	region := r.URL.Query().Get("region")
+	compartment := r.URL.Query().Get("compartment")
+	if compartment == "" {
+		var err error
+		if compartment, err = defaultOCICompartment(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: "No compartment to list buckets in", Details: err.Error(),
+				Remediation: "Pass ?compartment=<compartment OCID>, set OCI_COMPARTMENT_ID, or mount ~/.oci with a DEFAULT profile."})
+			return
+		}
+	}
+	var namespace string
+	var out []byte
+	err := providerCall(r.Context(), "oracle", func(ctx context.Context) error {
+		var err error
+		if namespace, err = ociNamespace(ctx, region); err != nil {
+			return fmt.Errorf("could not read the Object Storage namespace: %w", err)
+		}
+		out, err = toolCommand(ctx, "oci", ociCommand(region, "os", "bucket", "list", "--namespace", namespace,
+			"--compartment-id", compartment, "--all")...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list OCI buckets",
+			Remediation: "Check that the oci CLI is installed, ~/.oci (config and API key) is mounted, and the user's policies allow inspecting buckets in the compartment."})
+		return
+	}
+	var resp struct {
+		Data []struct {
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	if len(strings.TrimSpace(string(out))) > 0 {
+		if err := json.Unmarshal(out, &resp); err != nil {
+			writeAPIError(w, http.StatusBadGateway, APIError{Code: errCodeProviderFailed,
+				Message: "Failed to parse OCI bucket listing", Details: err.Error()})
+			return
+		}
+	}
+	var buckets []string
+	for _, b := range resp.Data {
+		buckets = append(buckets, b.Name)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"namespace": namespace, "buckets": listOrEmpty(buckets)})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// OVA extraction filters, applied while the tar is streamed so that what they
+// leave out is never written: entries larger than a size, entries of some
+// types (e.g. the install ISOs bundled with appliances), and, for OVAs holding
+// several VMs, the files only other VirtualSystems use. The OVF descriptor
+// comes first in an OVA, so the files a VirtualSystem references are known
+// before any disk arrives. The descriptor and manifest are always extracted.
+
+var errOVAFilter = errors.New("OVA extraction filter")
+
+type ovaFilter struct {
+	// Skip entries larger than this many bytes; 0 for no limit
+	MaxBytes int64
+	// Lower-case extensions to skip, without the dot (e.g. iso)
+	SkipTypes []string
+	// Only extract the referenced files of the VirtualSystem with this ID or name
+	VirtualSystem string
+	// The entries left out, each with its reason
+	Skipped []string
+
+	// Files from the OVF's References, true for those VirtualSystem uses
+	referenced map[string]bool
+}
+
+// The parts of an OVF that tie VirtualSystems to the files they use: items
+// point at a disk (ovf:/disk/<diskId>) or a file (ovf:/file/<id>), and disks at files
+type ovfReferences struct {
+	Files []struct {
+		ID   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"References>File"`
+	Disks []struct {
+		DiskID  string `xml:"diskId,attr"`
+		FileRef string `xml:"fileRef,attr"`
+	} `xml:"DiskSection>Disk"`
+	Systems    []ovfSystemReferences `xml:"VirtualSystem"`
+	Collection []ovfSystemReferences `xml:"VirtualSystemCollection>VirtualSystem"`
+}
+
+type ovfSystemReferences struct {
+	ID    string `xml:"id,attr"`
+	Name  string `xml:"Name"`
+	Items []struct {
+		HostResource []string `xml:"HostResource"`
+	} `xml:"VirtualHardwareSection>Item"`
+	// OVF 2.0 lists disks as storage items
+	StorageItems []struct {
+		HostResource []string `xml:"HostResource"`
+	} `xml:"VirtualHardwareSection>StorageItem"`
+}
+
+// The filter for a job's source, or nil if it has none
+func newOVAFilter(maxMB int, skipTypes []string, virtualSystem string) *ovaFilter {
+	if maxMB <= 0 && len(skipTypes) == 0 && virtualSystem == "" {
+		return nil
+	}
+	f := &ovaFilter{MaxBytes: int64(maxMB) << 20, VirtualSystem: virtualSystem}
+	for _, t := range skipTypes {
+		f.SkipTypes = append(f.SkipTypes, strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), ".")))
+	}
+	return f
+}
+
+// Check the extraction filter fields of a job spec
+func checkOVAFilter(maxMB int, skipTypes []string) *APIError {
+	if maxMB < 0 {
+		return &APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Invalid extractMaxMB %d"), maxMB),
+			Remediation: "Pass a size in MB above which OVA entries are skipped, or 0 for no limit."}
+	}
+	for _, t := range skipTypes {
+		switch strings.ToLower(strings.TrimPrefix(strings.TrimSpace(t), ".")) {
+		case "":
+			return &APIError{Code: errCodeInvalidRequest, Message: "Empty type in extractSkip"}
+		case "vmdk", "ovf", "mf":
+			return &APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("OVA extraction cannot skip %s files"), t),
+				Remediation: "Skip other types (e.g. iso, nvram), or choose the disks with virtualSystem."}
+		}
+	}
+	return nil
+}
+
+// Why an entry of the given name and size is left out, or "" to extract it
+func (f *ovaFilter) skip(name string, size int64) (string, error) {
+	if f == nil {
+		return "", nil
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+	if ext == "ovf" || ext == "mf" {
+		return "", nil
+	}
+	if f.VirtualSystem != "" {
+		if f.referenced == nil && ext == "vmdk" {
+			return "", fmt.Errorf("%w: %s comes before the OVF descriptor, so its VirtualSystem is unknown", errOVAFilter, name)
+		}
+		for href, used := range f.referenced {
+			// Large files may be split into chunks (disk.vmdk.000000000)
+			if !used && (name == href || strings.HasPrefix(name, href+".")) {
+				return fmt.Sprintf("not used by VirtualSystem %s", f.VirtualSystem), nil
+			}
+		}
+	}
+	for _, t := range f.SkipTypes {
+		if ext == t {
+			return "skipped type " + t, nil
+		}
+	}
+	if f.MaxBytes > 0 && size > f.MaxBytes {
+		return fmt.Sprintf("larger than %d MB", f.MaxBytes>>20), nil
+	}
+	return "", nil
+}
+
+// Read the files VirtualSystem uses from an extracted OVF descriptor
+func (f *ovaFilter) loadOVF(ovf string) error {
+	if f == nil || f.VirtualSystem == "" || f.referenced != nil {
+		return nil
+	}
+	data, err := os.ReadFile(ovf)
+	if err != nil {
+		return err
+	}
+	var refs ovfReferences
+	if err := xml.Unmarshal(data, &refs); err != nil {
+		return fmt.Errorf("%w: %s is not a valid OVF descriptor: %s", errInvalidOVA, filepath.Base(ovf), err)
+	}
+	var system *ovfSystemReferences
+	var names []string
+	systems := append(refs.Systems, refs.Collection...)
+	for i, vs := range systems {
+		if strings.EqualFold(vs.ID, f.VirtualSystem) || strings.EqualFold(vs.Name, f.VirtualSystem) {
+			system = &systems[i]
+			break
+		}
+		names = append(names, vs.ID)
+	}
+	if system == nil {
+		return fmt.Errorf("%w: no VirtualSystem %s in %s (it has %s)", errOVAFilter, f.VirtualSystem, filepath.Base(ovf), strings.Join(names, ", "))
+	}
+
+	hrefs := map[string]string{}
+	f.referenced = map[string]bool{}
+	for _, file := range refs.Files {
+		hrefs[file.ID] = file.Href
+		f.referenced[file.Href] = false
+	}
+	diskFiles := map[string]string{}
+	for _, disk := range refs.Disks {
+		diskFiles[disk.DiskID] = disk.FileRef
+	}
+	var resources []string
+	for _, item := range system.Items {
+		resources = append(resources, item.HostResource...)
+	}
+	for _, item := range system.StorageItems {
+		resources = append(resources, item.HostResource...)
+	}
+	for _, resource := range resources {
+		// ovf:/disk/vmdisk1, ovf:/file/file2 or, in older OVFs, /disk/vmdisk1
+		kind, id, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(resource), "ovf:"), "/"), "/")
+		switch kind {
+		case "disk":
+			id = diskFiles[id]
+		case "file":
+		default:
+			continue
+		}
+		if href, ok := hrefs[id]; ok {
+			f.referenced[href] = true
+		}
+	}
+	return nil
+}
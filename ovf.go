@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Virtual hardware read from the OVF descriptor that came with a disk, for
+// targets that create a VM rather than just a disk (XVA packages, UTM bundles)
+type ovfHardware struct {
+	Name     string `json:"name"`
+	CPUs     int    `json:"cpus"`
+	MemoryMB int64  `json:"memoryMB"`
+	// "efi" or "bios"
+	Firmware string `json:"firmware"`
+	// UEFI Secure Boot and a virtual TPM, as vSphere configures them
+	SecureBoot bool `json:"secureBoot,omitempty"`
+	TPM        bool `json:"tpm,omitempty"`
+	// e.g. ubuntu64Guest or windows2019srv_64Guest
+	OSType string `json:"osType,omitempty"`
+	// The VM's notes (vSphere annotation)
+	Annotation string `json:"annotation,omitempty"`
+}
+
+// Used when a disk has no OVF (e.g. a VMDK uploaded on its own)
+var defaultOVFHardware = ovfHardware{CPUs: 2, MemoryMB: 2048, Firmware: "bios"}
+
+// The parts of an OVF envelope Porter reads. Elements and attributes are matched by
+// local name, so the ovf:, rasd: and vmw: namespaces don't need spelling out.
+type ovfEnvelope struct {
+	VirtualSystem struct {
+		ID                     string `xml:"id,attr"`
+		Name                   string `xml:"Name"`
+		OperatingSystemSection struct {
+			OSType string `xml:"osType,attr"`
+		} `xml:"OperatingSystemSection"`
+		AnnotationSection struct {
+			Annotation string `xml:"Annotation"`
+		} `xml:"AnnotationSection"`
+		VirtualHardwareSection struct {
+			Items []struct {
+				ResourceType    int    `xml:"ResourceType"`
+				ResourceSubType string `xml:"ResourceSubType"`
+				VirtualQuantity int64  `xml:"VirtualQuantity"`
+				AllocationUnits string `xml:"AllocationUnits"`
+			} `xml:"Item"`
+			Configs []struct {
+				Key   string `xml:"key,attr"`
+				Value string `xml:"value,attr"`
+			} `xml:"Config"`
+			ExtraConfigs []struct {
+				Key   string `xml:"key,attr"`
+				Value string `xml:"value,attr"`
+			} `xml:"ExtraConfig"`
+		} `xml:"VirtualHardwareSection"`
+	} `xml:"VirtualSystem"`
+}
+
+// CIM resource types of the OVF hardware items Porter reads
+const (
+	ovfResourceCPU    = 3
+	ovfResourceMemory = 4
+)
+
+func parseOVF(path string) (ovfHardware, error) {
+	hw := defaultOVFHardware
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return hw, err
+	}
+	var envelope ovfEnvelope
+	if err := xml.Unmarshal(data, &envelope); err != nil {
+		return hw, err
+	}
+	vs := envelope.VirtualSystem
+	hw.Name = vs.Name
+	if hw.Name == "" {
+		hw.Name = vs.ID
+	}
+	hw.OSType = vs.OperatingSystemSection.OSType
+	hw.Annotation = strings.TrimSpace(vs.AnnotationSection.Annotation)
+	for _, item := range vs.VirtualHardwareSection.Items {
+		switch item.ResourceType {
+		case ovfResourceCPU:
+			if item.VirtualQuantity > 0 {
+				hw.CPUs = int(item.VirtualQuantity)
+			}
+		case ovfResourceMemory:
+			if item.VirtualQuantity > 0 {
+				hw.MemoryMB = ovfMegabytes(item.VirtualQuantity, item.AllocationUnits)
+			}
+		}
+		if item.ResourceSubType == "vmware.vtpm" {
+			hw.TPM = true
+		}
+	}
+	for _, c := range vs.VirtualHardwareSection.Configs {
+		switch {
+		case c.Key == "firmware" && c.Value == "efi":
+			hw.Firmware = "efi"
+		case c.Key == "bootOptions.efiSecureBootEnabled" && c.Value == "true":
+			hw.SecureBoot = true
+		}
+	}
+	// Older exports only record these as VMX settings
+	for _, c := range vs.VirtualHardwareSection.ExtraConfigs {
+		switch {
+		case c.Key == "uefi.secureBoot.enabled" && strings.EqualFold(c.Value, "true"):
+			hw.SecureBoot = true
+		case c.Key == "vtpm.present" && strings.EqualFold(c.Value, "true"):
+			hw.TPM = true
+		}
+	}
+	return hw, nil
+}
+
+// Convert a memory quantity in OVF allocation units ("byte * 2^20", "MegaBytes", ...) to MB
+func ovfMegabytes(quantity int64, units string) int64 {
+	units = strings.ToLower(strings.ReplaceAll(units, " ", ""))
+	switch {
+	case strings.Contains(units, "2^30") || strings.HasPrefix(units, "giga"):
+		return quantity * 1024
+	case strings.Contains(units, "2^10") || strings.HasPrefix(units, "kilo"):
+		return quantity / 1024
+	case units == "byte" || units == "bytes":
+		return quantity / (1024 * 1024)
+	}
+	return quantity
+}
+
+// The OVF in the extracted directory that references a disk's VMDK, if any
+func ovfForDisk(disk string) string {
+	base := diskVMDKName(disk)
+	var found string
+	filepath.Walk(extractDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found != "" || info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".ovf") {
+			return nil
+		}
+		if data, err := os.ReadFile(path); err == nil && strings.Contains(string(data), `"`+base+`"`) {
+			found = path
+		}
+		return nil
+	})
+	return found
+}
+
+// Converted disks are named after their VMDK, e.g. disk1.vmdk.qcow2
+func diskVMDKName(disk string) string {
+	base := filepath.Base(disk)
+	if i := strings.Index(base, ".vmdk"); i > 0 {
+		base = base[:i+len(".vmdk")]
+	}
+	return base
+}
+
+// The hardware of the VM a disk came from: the OVF in the extracted directory that
+// references the disk's VMDK, or the defaults if there is none
+func hardwareForDisk(disk string) ovfHardware {
+	found := ovfForDisk(disk)
+	hw := defaultOVFHardware
+	if found != "" {
+		parsed, err := parseOVF(found)
+		if err == nil {
+			hw = parsed
+		}
+	}
+	if hw.Name == "" {
+		hw.Name = baseNameWithoutExt(diskVMDKName(disk))
+	}
+	return hw
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// oVirt and Red Hat Virtualization: each disk is created on a storage domain
+// (the datastore) through the engine's REST API and its data sent to an
+// ovirt-imageio server with an image transfer, QCOW2 disks as they are and RAW
+// disks preallocated. With createImage a VM is created in the cluster (the
+// resource pool) with the source VM's CPUs, memory and firmware, the disk
+// attached as its boot disk and, if a vNIC profile (network) is given, a
+// network card; with template as well, the VM is turned into a template
+// instead, for VMs to be cloned from.
+//
+// The engine URL (https://engine.example.com/ovirt-engine) comes from the
+// request, an ovirt profile or OVIRT_URL; credentials (admin@internal) from the
+// request, the profile whose url it is under or OVIRT_USERNAME and
+// OVIRT_PASSWORD. Set OVIRT_INSECURE=1 for engines and hosts with certificates
+// from the engine's own CA.
+
+// How long to wait for disks, transfers and VMs to be ready
+const ovirtTimeout = 30 * time.Minute
+
+// The credentials for an engine URL
+func ovirtCredentials(rawURL, username, password string) (string, string) {
+	if username != "" {
+		return username, password
+	}
+	if username, password, ok := profileCredentials("ovirt", rawURL); ok {
+		return username, password
+	}
+	return os.Getenv("OVIRT_USERNAME"), os.Getenv("OVIRT_PASSWORD")
+}
+
+// Call the engine's REST API with a JSON body (if not nil), decoding the
+// response into out (if not nil)
+func ovirtRequest(ctx context.Context, s uploadSettings, method, endpoint string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(s.URL, "/")+"/api"+endpoint, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	username, password := ovirtCredentials(s.URL, s.Username, s.Password)
+	req.SetBasicAuth(username, password)
+	resp, err := insecureClient("OVIRT_INSECURE").Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		// Faults say what went wrong in detail
+		var fault struct {
+			Reason string `json:"reason"`
+			Detail string `json:"detail"`
+		}
+		if json.Unmarshal(data, &fault) == nil && fault.Detail != "" {
+			return fmt.Errorf("%s %s: %s: %s %s", method, endpoint, resp.Status, fault.Reason, fault.Detail)
+		}
+		return fmt.Errorf("%s %s: %s: %s", method, endpoint, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Poll an engine object until ready says it is, failing if it reports an error
+func waitForOVirt(job *Job, what string, ready func() (bool, error)) error {
+	deadline := time.Now().Add(ovirtTimeout)
+	for {
+		done, err := ready()
+		if err != nil || done {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s was not ready after %s", what, ovirtTimeout)
+		}
+		select {
+		case <-job.ctx.Done():
+			return job.ctx.Err()
+		case <-time.After(3 * time.Second):
+		}
+	}
+}
+
+// Wait for a disk to be unlocked, failing if it became illegal
+func waitForOVirtDisk(job *Job, s uploadSettings, id string) error {
+	return waitForOVirt(job, "disk "+id, func() (bool, error) {
+		var disk struct {
+			Status string `json:"status"`
+		}
+		if err := ovirtRequest(job.ctx, s, http.MethodGet, "/disks/"+id, nil, &disk); err != nil {
+			return false, err
+		}
+		if disk.Status == "illegal" {
+			return false, fmt.Errorf("disk %s became illegal", id)
+		}
+		return disk.Status == "ok", nil
+	})
+}
+
+// Upload one disk to an oVirt storage domain, returning <domain>/<disk-id> and
+// the ID of the VM or template created from it, if any
+func uploadToOVirt(job *Job, s uploadSettings, file string) (string, string, error) {
+	format := diskFormatForPath(file)
+	if format != "qcow2" && format != "raw" {
+		return "", "", fmt.Errorf("oVirt takes QCOW2 or RAW disks, not %s; convert to qcow2", filepath.Base(file))
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	size := info.Size()
+	if format == "qcow2" {
+		if size, err = imageVirtualSize(job, file); err != nil {
+			return "", "", err
+		}
+	}
+	var platform vmPlatform
+	if s.CreateImage {
+		if platform, err = platformForDisk(job, s, file); err != nil {
+			return "", "", err
+		}
+	}
+	hw := hardwareForDisk(file)
+	if job.Spec.Name != "" {
+		hw.Name = job.Spec.Name
+	}
+
+	// QCOW2 disks stay sparse; RAW disks are allocated up front
+	diskFormat, sparse := "cow", true
+	if format == "raw" {
+		diskFormat, sparse = "raw", false
+	}
+	disk := map[string]interface{}{
+		"name":             strings.TrimSuffix(filepath.Base(file), filepath.Ext(file)),
+		"description":      "Imported by Porter job " + job.ID + " from " + hw.Name,
+		"format":           diskFormat,
+		"sparse":           sparse,
+		"provisioned_size": size,
+		"storage_domains":  map[string]interface{}{"storage_domain": []map[string]string{{"name": s.Datastore}}},
+	}
+	if format == "qcow2" {
+		// Block storage domains allocate this much for the upload
+		disk["initial_size"] = info.Size()
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	job.setStatus("Creating oVirt disk for %s on %s", filepath.Base(file), s.Datastore)
+	if err := ovirtRequest(job.ctx, s, http.MethodPost, "/disks", disk, &created); err != nil {
+		return "", "", fmt.Errorf("creating an oVirt disk for %s failed: %w", file, err)
+	}
+	dest := s.Datastore + "/" + created.ID
+	if err := waitForOVirtDisk(job, s, created.ID); err != nil {
+		return "", "", err
+	}
+	if err := transferToOVirt(job, s, file, created.ID, diskFormat); err != nil {
+		// Don't leave an empty disk behind
+		if deleteErr := deleteOVirtDisk(s.URL, dest); deleteErr != nil {
+			job.warnf("Deleting the partial disk %s failed: %s", created.ID, deleteErr)
+		}
+		return "", "", err
+	}
+	job.logf("Uploaded %s as oVirt disk %s", filepath.Base(file), dest)
+	if !s.CreateImage {
+		return dest, "", nil
+	}
+	id, err := createOVirtVM(job, s, file, hw, created.ID, platform)
+	return dest, id, err
+}
+
+// Send a disk's data with an image transfer and finalize it
+func transferToOVirt(job *Job, s uploadSettings, file, diskID, diskFormat string) error {
+	var transfer struct {
+		ID          string `json:"id"`
+		Phase       string `json:"phase"`
+		TransferURL string `json:"transfer_url"`
+		ProxyURL    string `json:"proxy_url"`
+	}
+	request := map[string]interface{}{"disk": map[string]string{"id": diskID}, "direction": "upload", "format": diskFormat}
+	if err := ovirtRequest(job.ctx, s, http.MethodPost, "/imagetransfers", request, &transfer); err != nil {
+		return fmt.Errorf("starting the image transfer for %s failed: %w", file, err)
+	}
+	endpoint := "/imagetransfers/" + transfer.ID
+	err := waitForOVirt(job, "image transfer "+transfer.ID, func() (bool, error) {
+		if err := ovirtRequest(job.ctx, s, http.MethodGet, endpoint, nil, &transfer); err != nil {
+			return false, err
+		}
+		return transfer.Phase == "transferring", nil
+	})
+	if err != nil {
+		ovirtRequest(context.Background(), s, http.MethodPost, endpoint+"/cancel", map[string]string{}, nil)
+		return err
+	}
+
+	// The host's imageio server is the direct path; the engine's proxy is for
+	// when Porter can't reach the hosts
+	target := transfer.TransferURL
+	if target == "" {
+		target = transfer.ProxyURL
+	}
+	job.setStatus("Sending %s to oVirt disk %s through imageio", filepath.Base(file), diskID)
+	if err := putImageio(job, s, target, file); err != nil {
+		ovirtRequest(context.Background(), s, http.MethodPost, endpoint+"/cancel", map[string]string{}, nil)
+		return fmt.Errorf("imageio upload of %s failed: %w", file, err)
+	}
+
+	// Finalizing checks the image and unlocks the disk; the transfer is gone once it has
+	if err := ovirtRequest(job.ctx, s, http.MethodPost, endpoint+"/finalize", map[string]string{}, nil); err != nil {
+		return fmt.Errorf("finalizing the image transfer for %s failed: %w", file, err)
+	}
+	err = waitForOVirt(job, "image transfer "+transfer.ID, func() (bool, error) {
+		err := ovirtRequest(job.ctx, s, http.MethodGet, endpoint, nil, &transfer)
+		if err != nil && strings.Contains(err.Error(), "404") {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		switch transfer.Phase {
+		case "finished_success":
+			return true, nil
+		case "finished_failure":
+			return false, fmt.Errorf("oVirt rejected the uploaded image of %s", file)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	return waitForOVirtDisk(job, s, diskID)
+}
+
+// PUT a whole image to an imageio URL
+func putImageio(job *Job, s uploadSettings, target, file string) error {
+	st, err := openUploadStream(job, s, file)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPut, target, st)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = st.Size
+	resp, err := insecureClient("OVIRT_INSECURE").Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	st.finish()
+	return nil
+}
+
+// Create a VM with an uploaded disk as its boot disk, turning it into a
+// template if asked to, returning the VM's or template's ID
+func createOVirtVM(job *Job, s uploadSettings, file string, hw ovfHardware, diskID string, p vmPlatform) (string, error) {
+	_, productName := readinessForDisk(job, file)
+	windows := isWindowsGuest(hw, productName)
+	osType, diskInterface, nicInterface := "other_linux", "virtio_scsi", "virtio"
+	if windows {
+		// Windows boots from SATA with an e1000 card before VirtIO drivers are installed
+		osType, diskInterface, nicInterface = "windows_2019x64", "sata", "e1000"
+		if requiresTrustedBoot(hw.OSType, productName) {
+			osType = "windows_2022"
+		}
+	}
+	bios := "q35_sea_bios"
+	if p.Generation == 2 {
+		bios = "q35_ovmf"
+		if p.SecureBoot {
+			bios = "q35_secure_boot"
+		}
+	}
+	vm := map[string]interface{}{
+		"name":        hw.Name,
+		"description": "Created by Porter job " + job.ID,
+		"cluster":     map[string]string{"name": s.ResourcePool},
+		"template":    map[string]string{"name": "Blank"},
+		"memory":      int64(hw.MemoryMB) << 20,
+		"cpu":         map[string]interface{}{"topology": map[string]int{"sockets": 1, "cores": hw.CPUs, "threads": 1}},
+		"bios":        map[string]string{"type": bios},
+		"os":          map[string]string{"type": osType},
+	}
+	if p.TPM {
+		vm["tpm_enabled"] = true
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	job.setStatus("Creating oVirt VM %s in cluster %s", hw.Name, s.ResourcePool)
+	if err := ovirtRequest(job.ctx, s, http.MethodPost, "/vms", vm, &created); err != nil {
+		return "", fmt.Errorf("creating oVirt VM %s failed: %w", hw.Name, err)
+	}
+	err := waitForOVirt(job, "VM "+hw.Name, func() (bool, error) {
+		var status struct {
+			Status string `json:"status"`
+		}
+		err := ovirtRequest(job.ctx, s, http.MethodGet, "/vms/"+created.ID, nil, &status)
+		return status.Status == "down", err
+	})
+	if err != nil {
+		return created.ID, err
+	}
+
+	attachment := map[string]interface{}{
+		"disk":      map[string]string{"id": diskID},
+		"interface": diskInterface,
+		"bootable":  true,
+		"active":    true,
+	}
+	if err := ovirtRequest(job.ctx, s, http.MethodPost, "/vms/"+created.ID+"/diskattachments", attachment, nil); err != nil {
+		return created.ID, fmt.Errorf("attaching disk %s to VM %s failed: %w", diskID, hw.Name, err)
+	}
+	if s.Network != "" {
+		profile, err := ovirtVNICProfile(job.ctx, s)
+		if err != nil {
+			return created.ID, err
+		}
+		nic := map[string]interface{}{"name": "nic1", "interface": nicInterface, "vnic_profile": map[string]string{"id": profile}}
+		if err := ovirtRequest(job.ctx, s, http.MethodPost, "/vms/"+created.ID+"/nics", nic, nil); err != nil {
+			return created.ID, fmt.Errorf("adding a network card to VM %s failed: %w", hw.Name, err)
+		}
+	}
+	if err := waitForOVirtDisk(job, s, diskID); err != nil {
+		return created.ID, err
+	}
+	job.logf("oVirt VM %s (%s) is ready in cluster %s", hw.Name, created.ID, s.ResourcePool)
+	if !s.Template {
+		return created.ID, nil
+	}
+
+	// The template gets a copy of the disk, so the VM is removed with its own
+	var template struct {
+		ID string `json:"id"`
+	}
+	job.setStatus("Creating oVirt template %s from VM %s", hw.Name, created.ID)
+	request := map[string]interface{}{"name": hw.Name, "description": "Created by Porter job " + job.ID, "vm": map[string]string{"id": created.ID}}
+	if err := ovirtRequest(job.ctx, s, http.MethodPost, "/templates", request, &template); err != nil {
+		return created.ID, fmt.Errorf("creating oVirt template %s failed: %w", hw.Name, err)
+	}
+	err = waitForOVirt(job, "template "+hw.Name, func() (bool, error) {
+		var status struct {
+			Status string `json:"status"`
+		}
+		err := ovirtRequest(job.ctx, s, http.MethodGet, "/templates/"+template.ID, nil, &status)
+		return status.Status == "ok", err
+	})
+	if err != nil {
+		return template.ID, err
+	}
+	if err := ovirtRequest(job.ctx, s, http.MethodDelete, "/vms/"+created.ID, nil, nil); err != nil {
+		job.warnf("Removing VM %s after creating template %s failed: %s", created.ID, hw.Name, err)
+	}
+	job.logf("oVirt template %s (%s) is ready", hw.Name, template.ID)
+	return template.ID, nil
+}
+
+// The ID of the vNIC profile named by the network setting
+func ovirtVNICProfile(ctx context.Context, s uploadSettings) (string, error) {
+	var profiles struct {
+		VNICProfile []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"vnic_profile"`
+	}
+	if err := ovirtRequest(ctx, s, http.MethodGet, "/vnicprofiles", nil, &profiles); err != nil {
+		return "", err
+	}
+	for _, p := range profiles.VNICProfile {
+		if p.Name == s.Network {
+			return p.ID, nil
+		}
+	}
+	return "", fmt.Errorf("no vNIC profile named %s", s.Network)
+}
+
+// Delete an uploaded disk (<domain>/<disk-id>). A disk attached to a VM goes
+// with it only once detached; templates keep their own copy.
+func deleteOVirtDisk(endpoint, dest string) error {
+	return ovirtRequest(context.Background(), uploadSettings{URL: endpoint}, http.MethodDelete, "/disks/"+url.PathEscape(path.Base(dest)), nil, nil)
+}
+
+// List the disks on a storage domain whose names start with prefix
+func listOVirtDisks(ctx context.Context, server, domain, prefix string) ([]DestinationObject, error) {
+	s := uploadSettings{URL: server}
+	var domains struct {
+		StorageDomain []struct {
+			ID string `json:"id"`
+		} `json:"storage_domain"`
+	}
+	if err := ovirtRequest(ctx, s, http.MethodGet, "/storagedomains?search="+url.QueryEscape("name="+domain), nil, &domains); err != nil {
+		return nil, err
+	}
+	if len(domains.StorageDomain) == 0 {
+		return nil, fmt.Errorf("no storage domain named %s", domain)
+	}
+	var disks struct {
+		Disk []struct {
+			ID         string `json:"id"`
+			Name       string `json:"name"`
+			ActualSize int64  `json:"actual_size,string"`
+		} `json:"disk"`
+	}
+	if err := ovirtRequest(ctx, s, http.MethodGet, "/storagedomains/"+domains.StorageDomain[0].ID+"/disks", nil, &disks); err != nil {
+		return nil, err
+	}
+	var objects []DestinationObject
+	for _, disk := range disks.Disk {
+		if strings.HasPrefix(disk.Name, prefix) {
+			objects = append(objects, DestinationObject{Name: disk.Name + " (" + disk.ID + ")", Size: disk.ActualSize})
+		}
+	}
+	return objects, nil
+}
+
+// Confirm an engine is configured and accepts Porter's credentials
+func checkOVirtCredentials(ctx context.Context) error {
+	server := os.Getenv("OVIRT_URL")
+	if server == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "ovirt" && profile.URL != "" {
+				server = profile.URL
+				break
+			}
+		}
+	}
+	if server == "" {
+		return errors.New("no oVirt engine configured; set OVIRT_URL or add an ovirt destination profile")
+	}
+	return ovirtRequest(ctx, uploadSettings{URL: server}, http.MethodGet, "", nil, nil)
+}
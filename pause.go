@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Pausing a job stops the CLI process doing the transfer (SIGSTOP) so no more data is
+// sent, while it keeps its in-memory state such as completed multipart parts. Resuming
+// continues it (SIGCONT). Porter's own copies block between reads while paused, and no
+// new file is started until the job is resumed.
+
+// Pause a running job
+func (j *Job) pause() error {
+	j.mu.Lock()
+	if j.State != jobRunning {
+		state := j.State
+		j.mu.Unlock()
+		return fmt.Errorf("only running jobs can be paused (job is %s)", state)
+	}
+	j.State = jobPaused
+	j.resumed = make(chan struct{})
+	cmd := j.cmd
+	j.mu.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		signalProcessGroup(cmd, syscall.SIGSTOP)
+	}
+	j.logf("Job paused")
+	j.publish(JobEvent{Type: "state", State: jobPaused})
+	return nil
+}
+
+// Resume a paused job
+func (j *Job) resume() error {
+	j.mu.Lock()
+	if j.State != jobPaused {
+		state := j.State
+		j.mu.Unlock()
+		return fmt.Errorf("only paused jobs can be resumed (job is %s)", state)
+	}
+	j.State = jobRunning
+	close(j.resumed)
+	cmd := j.cmd
+	j.mu.Unlock()
+
+	if cmd != nil && cmd.Process != nil {
+		signalProcessGroup(cmd, syscall.SIGCONT)
+	}
+	j.logf("Job resumed")
+	j.publish(JobEvent{Type: "state", State: jobRunning})
+	return nil
+}
+
+// Block while the job is paused; returns early if the job is cancelled
+func (j *Job) waitIfPaused() {
+	j.mu.Lock()
+	if j.State != jobPaused {
+		j.mu.Unlock()
+		return
+	}
+	resumed := j.resumed
+	j.mu.Unlock()
+
+	select {
+	case <-resumed:
+	case <-j.ctx.Done():
+	}
+}
+
+// Track the CLI process currently running for the job so pause/resume can signal it.
+// The process gets its own process group so helper processes are stopped with it.
+func (j *Job) attachCommand(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	j.mu.Lock()
+	j.cmd = cmd
+	j.mu.Unlock()
+}
+
+// Called once the process has started; stops it straight away if the job was paused meanwhile
+func (j *Job) commandStarted(cmd *exec.Cmd) {
+	j.mu.Lock()
+	paused := j.State == jobPaused
+	j.mu.Unlock()
+	if paused {
+		signalProcessGroup(cmd, syscall.SIGSTOP)
+	}
+}
+
+func (j *Job) detachCommand() {
+	j.mu.Lock()
+	j.cmd = nil
+	j.mu.Unlock()
+}
+
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) {
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil {
+		fmt.Printf("Warning: failed to send %s to process %d: %s\n", sig, cmd.Process.Pid, err)
+	}
+}
+
+// A reader that blocks while its job is paused and fails once it is cancelled
+type jobReader struct {
+	job *Job
+	r   io.Reader
+}
+
+func (jr *jobReader) Read(p []byte) (int, error) {
+	jr.job.waitIfPaused()
+	if err := jr.job.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := jr.r.Read(p)
+	jr.job.bytesCopied.Add(int64(n))
+	return n, err
+}
+
+// Like copyFile, but pausable and cancellable through the job. Returns the SHA-256
+// of the data read from src.
+func copyFileForJob(job *Job, src, dst string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), &jobReader{job: job, r: in})
+	if err != nil {
+		return "", err
+	}
+	if err := out.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// SHA-256 of a file, pausable and cancellable through the job
+func hashFileForJob(job *Job, file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, &jobReader{job: job, r: f}); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Handler to pause a running job
+func jobPauseHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	if err := job.pause(); err != nil {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
+
+// Handler to resume a paused job
+func jobResumeHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	if err := job.resume(); err != nil {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, job.snapshot())
+}
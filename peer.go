@@ -0,0 +1,642 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Porter-to-Porter transfers, for sites where neither side exposes object
+// storage: a Porter near the data (cloud "porter") pushes what it converted
+// straight to another Porter at the destination, over the receiver's HTTP(S)
+// API. The receiver enables this with peerTransfer in porter.json: the token
+// senders present as a bearer token (default PORTER_PEER_TOKEN) and the
+// directory received files are written under (default /data/incoming). Each
+// file received is added to its catalog, so its own jobs can pick it up.
+// Senders take the token from the porter destination profile whose url the
+// receiver is under, else PORTER_PEER_TOKEN; receivers that are neither under
+// a profile nor PORTER_PEER_URL get no token.
+//
+// Files are sent in chunks to a transfer named after the destination path and
+// the local file's size and modification time. The receiver only keeps whole
+// chunks, so an interrupted transfer, or a failed job's rerun, resumes from
+// where the receiver is. Once everything is sent, the receiver checks the file
+// against the SHA-256 the sender computed and moves it into place.
+
+const (
+	peerChunkSize = 64 << 20
+	// Tries per chunk before the upload fails
+	peerChunkAttempts = 3
+	// Where the receiver keeps transfers in progress, under its directory
+	peerPartialDir = ".porter-transfers"
+)
+
+// Transfer IDs are hex, chosen by the sender
+var peerTransferIDPattern = regexp.MustCompile(`^[0-9a-f]{16,64}$`)
+
+// Receiving files from other Porter instances
+type PeerTransferConfig struct {
+	// Bearer token senders must present (default PORTER_PEER_TOKEN); without
+	// one, this instance doesn't receive transfers
+	Token string `json:"token,omitempty"`
+	// Where received files are written (default /data/incoming)
+	Directory string `json:"directory,omitempty"`
+}
+
+func (c PeerTransferConfig) token() string {
+	if c.Token != "" {
+		return os.ExpandEnv(c.Token)
+	}
+	return os.Getenv("PORTER_PEER_TOKEN")
+}
+
+func (c PeerTransferConfig) directory() string {
+	if c.Directory != "" {
+		return c.Directory
+	}
+	return "/data/incoming"
+}
+
+// A transfer as the sender starts it and the receiver keeps it, next to its
+// partial file. Offset is how much the receiver has.
+type peerTransfer struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	Source    string    `json:"source,omitempty"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Transfers a request is writing to, so that a retried chunk can't interleave
+// with one the receiver is still reading
+var peerBusy = struct {
+	sync.Mutex
+	ids map[string]bool
+}{ids: map[string]bool{}}
+
+// Claim a transfer, returning a function releasing it, or false if a request
+// already holds it
+func claimPeerTransfer(id string) (func(), bool) {
+	peerBusy.Lock()
+	defer peerBusy.Unlock()
+	if peerBusy.ids[id] {
+		return nil, false
+	}
+	peerBusy.ids[id] = true
+	return func() {
+		peerBusy.Lock()
+		delete(peerBusy.ids, id)
+		peerBusy.Unlock()
+	}, true
+}
+
+// A sender's slash-separated name, cleaned, or false if it would leave the
+// receiving directory
+func cleanPeerName(name string) (string, bool) {
+	clean := path.Clean(name)
+	if name == "" || path.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") ||
+		strings.Split(clean, "/")[0] == peerPartialDir {
+		return "", false
+	}
+	return clean, true
+}
+
+// Where a sender's name is written on the receiver
+func peerPath(name string) (string, bool) {
+	clean, ok := cleanPeerName(name)
+	if !ok {
+		return "", false
+	}
+	return filepath.Join(config.PeerTransfer.directory(), filepath.FromSlash(clean)), true
+}
+
+// The partial file and state of a transfer on the receiver
+func peerTransferFiles(id string) (string, string) {
+	dir := filepath.Join(config.PeerTransfer.directory(), peerPartialDir)
+	return filepath.Join(dir, id+".part"), filepath.Join(dir, id+".json")
+}
+
+// A transfer in progress on the receiver, with its offset
+func readPeerTransfer(id string) (peerTransfer, error) {
+	partial, state := peerTransferFiles(id)
+	var t peerTransfer
+	data, err := os.ReadFile(state)
+	if err != nil {
+		return t, err
+	}
+	if err := json.Unmarshal(data, &t); err != nil {
+		return t, err
+	}
+	info, err := os.Stat(partial)
+	if err != nil {
+		return t, err
+	}
+	t.Offset = info.Size()
+	return t, nil
+}
+
+// Check a request carries the receiver's token, writing the error if not
+func authorizePeer(w http.ResponseWriter, r *http.Request) bool {
+	token := config.PeerTransfer.token()
+	if token == "" {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: "This Porter does not receive transfers",
+			Remediation: "Set peerTransfer.token in porter.json, or PORTER_PEER_TOKEN, on the receiving instance."})
+		return false
+	}
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, APIError{Code: errCodeUnauthorized, Message: "Missing or invalid peer transfer token",
+			Remediation: "Send the receiver's peerTransfer token: set token in the porter destination profile, or PORTER_PEER_TOKEN."})
+		return false
+	}
+	return true
+}
+
+// Handler for GET /api/peer: confirm a sender's token, and report the space
+// left for transfers
+func peerInfoHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizePeer(w, r) {
+		return
+	}
+	dir := config.PeerTransfer.directory()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal, Message: fmt.Sprintf(tr("Cannot create %s"), dir), Details: err.Error()})
+		return
+	}
+	free, _ := freeSpace(dir)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"directory": dir, "availableBytes": free})
+}
+
+// Handler for GET /api/peer/files: list received files, optionally in a
+// folder (?prefix=), by the names senders gave them
+func peerFilesHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizePeer(w, r) {
+		return
+	}
+	dir := config.PeerTransfer.directory()
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+		var ok bool
+		if dir, ok = peerPath(prefix); !ok {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Invalid folder: %s"), prefix)})
+			return
+		}
+	}
+	objects, err := listLocalObjects(dir)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal, Message: fmt.Sprintf(tr("Failed to list %s"), dir), Details: err.Error()})
+		return
+	}
+	for i := range objects {
+		rel, _ := filepath.Rel(config.PeerTransfer.directory(), objects[i].Name)
+		objects[i].Name = filepath.ToSlash(rel)
+	}
+	writeJSON(w, http.StatusOK, map[string][]DestinationObject{"objects": listOrEmptyObjects(objects)})
+}
+
+// Handler for DELETE /api/peer/files/{path...}: delete a received file and its
+// catalog entry
+func peerFileDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizePeer(w, r) {
+		return
+	}
+	dst, ok := peerPath(r.PathValue("path"))
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Invalid file name: %s"), r.PathValue("path"))})
+		return
+	}
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal, Message: fmt.Sprintf(tr("Failed to delete %s"), dst), Details: err.Error()})
+		return
+	}
+	for _, entry := range artifactCatalog.list() {
+		if entry.Kind == "received" && entry.Destination == dst {
+			artifactCatalog.remove(entry.ID)
+		}
+	}
+	fmt.Printf("Deleted received file %s\n", dst)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler for POST /api/peer/transfers: start a transfer, or find the one a
+// sender started before, returning how much of the file is here
+func peerTransferCreateHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizePeer(w, r) {
+		return
+	}
+	var body peerTransfer
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Invalid JSON body", Details: err.Error()})
+		return
+	}
+	if !peerTransferIDPattern.MatchString(body.ID) {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Invalid transfer ID: %s"), body.ID)})
+		return
+	}
+	if _, ok := cleanPeerName(body.Name); !ok || body.Size < 0 {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Invalid file name: %s"), body.Name),
+			Remediation: "Name files by a relative path within the receiving directory."})
+		return
+	}
+	release, ok := claimPeerTransfer(body.ID)
+	if !ok {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Transfer %s is receiving a chunk; try again shortly"), body.ID)})
+		return
+	}
+	defer release()
+
+	t, err := readPeerTransfer(body.ID)
+	switch {
+	case err == nil && (t.Name != body.Name || t.Size != body.Size):
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Transfer %s is of %s (%d bytes)"), t.ID, t.Name, t.Size)})
+		return
+	case err != nil:
+		t = peerTransfer{ID: body.ID, Name: body.Name, Size: body.Size, Source: body.Source, CreatedAt: time.Now().UTC()}
+		partial, state := peerTransferFiles(t.ID)
+		data, _ := json.Marshal(t)
+		if err = os.MkdirAll(filepath.Dir(partial), 0755); err == nil {
+			err = os.WriteFile(partial, nil, 0644)
+		}
+		if err == nil {
+			err = os.WriteFile(state, data, 0644)
+		}
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal, Message: fmt.Sprintf(tr("Cannot start transfer %s"), t.ID), Details: err.Error()})
+			return
+		}
+		fmt.Printf("Receiving %s (%.2f MB) from %s\n", t.Name, float64(t.Size)/(1024*1024), t.Source)
+	}
+	if free, err := freeSpace(config.PeerTransfer.directory()); err == nil && free < t.Size-t.Offset {
+		writeAPIError(w, http.StatusInsufficientStorage, APIError{Code: errCodeInsufficientStorage,
+			Message:     fmt.Sprintf(tr("%s needs %.2f MB more, and only %.2f MB are free"), t.Name, float64(t.Size-t.Offset)/(1024*1024), float64(free)/(1024*1024)),
+			Remediation: "Free space in the receiving directory, or point peerTransfer.directory at a larger volume."})
+		return
+	}
+	writeJSON(w, http.StatusOK, t)
+}
+
+// Handler for PATCH /api/peer/transfers/{id}: append a chunk at the offset
+// given in Upload-Offset. A chunk that doesn't arrive in full is dropped, so
+// the transfer only ever holds whole chunks.
+func peerTransferChunkHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizePeer(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+	if !peerTransferIDPattern.MatchString(id) {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Invalid transfer ID: %s"), id),
+			Remediation: "Transfer IDs are 16 to 64 lowercase hex digits."})
+		return
+	}
+	release, ok := claimPeerTransfer(id)
+	if !ok {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Transfer %s is receiving a chunk already"), id)})
+		return
+	}
+	defer release()
+	t, err := readPeerTransfer(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown transfer: %s"), id),
+			Remediation: "Start the transfer again with POST /api/peer/transfers."})
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Missing or invalid Upload-Offset header"})
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(t.Offset, 10))
+	if offset != t.Offset {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Transfer %s is at offset %d, not %d"), id, t.Offset, offset)})
+		return
+	}
+	if r.ContentLength < 0 || offset+r.ContentLength > t.Size {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Chunks need a Content-Length within the file's %d bytes"), t.Size)})
+		return
+	}
+
+	partial, _ := peerTransferFiles(id)
+	f, err := os.OpenFile(partial, os.O_WRONLY, 0)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal, Message: fmt.Sprintf(tr("Cannot open transfer %s"), id), Details: err.Error()})
+		return
+	}
+	defer f.Close()
+	var n int64
+	if _, err = f.Seek(offset, io.SeekStart); err == nil {
+		n, err = io.Copy(f, io.LimitReader(r.Body, r.ContentLength))
+	}
+	if err == nil && n != r.ContentLength {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(offset)
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Chunk at offset %d of transfer %s not received"), offset, id), Details: err.Error()})
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset+n, 10))
+	writeJSON(w, http.StatusOK, map[string]int64{"offset": offset + n})
+}
+
+// Handler for POST /api/peer/transfers/{id}/complete: check the received file
+// against the sender's {"sha256": ...}, move it into place and catalog it. On
+// a mismatch the transfer is discarded, so it is sent again from the start.
+func peerTransferCompleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizePeer(w, r) {
+		return
+	}
+	var body struct {
+		SHA256 string `json:"sha256"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.SHA256 == "" {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Pass the file's SHA-256 as {\"sha256\": ...}"})
+		return
+	}
+	id := r.PathValue("id")
+	if !peerTransferIDPattern.MatchString(id) {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Invalid transfer ID: %s"), id),
+			Remediation: "Transfer IDs are 16 to 64 lowercase hex digits."})
+		return
+	}
+	release, ok := claimPeerTransfer(id)
+	if !ok {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Transfer %s is receiving a chunk"), id)})
+		return
+	}
+	defer release()
+	t, err := readPeerTransfer(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown transfer: %s"), id)})
+		return
+	}
+	if t.Offset != t.Size {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("Transfer %s has %d of %d bytes"), id, t.Offset, t.Size)})
+		return
+	}
+
+	partial, state := peerTransferFiles(id)
+	sum, err := fileSHA256(partial)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal, Message: fmt.Sprintf(tr("Cannot read transfer %s"), id), Details: err.Error()})
+		return
+	}
+	if !strings.EqualFold(sum, body.SHA256) {
+		os.Remove(partial)
+		os.Remove(state)
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message:     fmt.Sprintf(tr("Checksum mismatch for %s: sent sha256 %s, received sha256 %s"), t.Name, body.SHA256, sum),
+			Remediation: "The transfer was discarded; send the file again."})
+		return
+	}
+	dst, _ := peerPath(t.Name)
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err == nil {
+		err = os.Rename(partial, dst)
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal, Message: fmt.Sprintf(tr("Cannot move %s into place"), t.Name), Details: err.Error()})
+		return
+	}
+	os.Remove(state)
+	if !artifactCatalog.has(dst) {
+		artifactCatalog.add(CatalogEntry{Kind: "received", Cloud: "local", Source: t.Source, Destination: dst, Size: t.Size,
+			Checksums: map[string]string{"sha256": sum}})
+	}
+	fmt.Printf("Received %s from %s (sha256 %s)\n", dst, t.Source, sum)
+	writeJSON(w, http.StatusOK, map[string]string{"path": dst, "sha256": sum})
+}
+
+// The bearer token for a receiver: from the porter profile it is under, else
+// PORTER_PEER_TOKEN if it is under a profile without a token or under
+// PORTER_PEER_URL. PORTER_PEER_TOKEN is also what this instance accepts as a
+// receiver, so it is never sent to a URL nobody configured.
+func peerToken(rawURL string) string {
+	configured := false
+	for _, profile := range config.Destinations {
+		if profile.Cloud != "porter" || profile.URL == "" || !urlUnder(rawURL, profile.URL) {
+			continue
+		}
+		if profile.Token != "" {
+			return os.ExpandEnv(profile.Token)
+		}
+		configured = true
+	}
+	if peer := os.Getenv("PORTER_PEER_URL"); peer != "" && urlUnder(rawURL, peer) {
+		configured = true
+	}
+	if !configured {
+		return ""
+	}
+	return os.Getenv("PORTER_PEER_TOKEN")
+}
+
+// Send a request to a receiver and decode its JSON answer into v; error
+// statuses become httpStatusErrors with the receiver's message
+func peerRequest(req *http.Request, v interface{}) error {
+	if token := peerToken(req.URL.String()); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		message := strings.TrimSpace(string(data))
+		var apiErr APIError
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Message != "" {
+			message = apiErr.Message
+			if apiErr.Remediation != "" {
+				message += " (" + apiErr.Remediation + ")"
+			}
+		}
+		return httpStatusError{code: resp.StatusCode, message: fmt.Sprintf("%s %s: %s: %s", req.Method, req.URL, resp.Status, message)}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Start or resume a transfer on the receiver, returning how much of the file it has
+func startPeerTransfer(ctx context.Context, peer string, t peerTransfer) (int64, error) {
+	data, _ := json.Marshal(t)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+"/api/peer/transfers", bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var started peerTransfer
+	if err := peerRequest(req, &started); err != nil {
+		return 0, err
+	}
+	return started.Offset, nil
+}
+
+// Send the chunk of a file at offset, returning the receiver's new offset
+func sendPeerChunk(job *Job, st *uploadStream, peer, id string, offset, size int64) (int64, error) {
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPatch, peer+"/api/peer/transfers/"+id,
+		&jobReader{job: job, r: st.throttled(io.NewSectionReader(st.f, offset, size))})
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	var answer struct {
+		Offset int64 `json:"offset"`
+	}
+	if err := peerRequest(req, &answer); err != nil {
+		return 0, err
+	}
+	return answer.Offset, nil
+}
+
+// Send one file to another Porter instance, returning its URL there and the
+// SHA-256 the receiver verified
+func uploadToPorter(job *Job, s uploadSettings, file string) (string, string, error) {
+	st, err := openUploadStream(job, s, file)
+	if err != nil {
+		return "", "", err
+	}
+	defer st.Close()
+	info, err := st.f.Stat()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	peer := strings.TrimRight(s.URL, "/")
+	name := path.Join(s.Target, st.Name)
+	host, _ := os.Hostname()
+	id := sha256.Sum256([]byte(fmt.Sprintf("%s %d %d", name, info.Size(), info.ModTime().UnixNano())))
+	t := peerTransfer{ID: hex.EncodeToString(id[:16]), Name: name, Size: info.Size(), Source: host + ":" + file}
+	job.setStatus("Sending %s to %s (%.2f MB)", filepath.Base(file), peer, float64(t.Size)/(1024*1024))
+
+	offset, err := startPeerTransfer(job.ctx, peer, t)
+	if err != nil {
+		return "", "", fmt.Errorf("Porter transfer failed for %s: %w", file, err)
+	}
+	if offset > 0 {
+		job.logf("Resuming transfer of %s: %s already has %.2f of %.2f MB", filepath.Base(file), peer,
+			float64(offset)/(1024*1024), float64(t.Size)/(1024*1024))
+	}
+
+	// What the receiver confirmed is hashed from the file, just after it was sent
+	h := sha256.New()
+	var hashed int64
+	catchUp := func(offset int64) error {
+		if offset < hashed {
+			h.Reset()
+			hashed = 0
+		}
+		n, err := io.Copy(h, io.NewSectionReader(st.f, hashed, offset-hashed))
+		hashed += n
+		return err
+	}
+	for failures := 0; offset < t.Size; {
+		if n := offset / peerChunkSize; n > 0 && n%10 == 0 {
+			job.setStatus("Sending %s to %s: %.2f of %.2f MB", filepath.Base(file), peer,
+				float64(offset)/(1024*1024), float64(t.Size)/(1024*1024))
+		}
+		next, err := sendPeerChunk(job, st, peer, t.ID, offset, min(int64(peerChunkSize), t.Size-offset))
+		if err != nil {
+			if failures++; job.ctx.Err() != nil || failures == peerChunkAttempts {
+				return "", "", fmt.Errorf("Porter transfer failed for %s at %.2f MB: %w", file, float64(offset)/(1024*1024), err)
+			}
+			job.logf("Sending %s failed at %.2f MB (%s); resuming", filepath.Base(file), float64(offset)/(1024*1024), err)
+			// The receiver keeps whole chunks, so carry on from what it has
+			if offset, err = startPeerTransfer(job.ctx, peer, t); err != nil {
+				return "", "", fmt.Errorf("Porter transfer failed for %s: %w", file, err)
+			}
+			continue
+		}
+		offset, failures = next, 0
+		if err := catchUp(offset); err != nil {
+			return "", "", err
+		}
+	}
+	if err := catchUp(t.Size); err != nil {
+		return "", "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	job.setStatus("Verifying %s on %s", filepath.Base(file), peer)
+	data, _ := json.Marshal(map[string]string{"sha256": sum})
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPost, peer+"/api/peer/transfers/"+t.ID+"/complete", bytes.NewReader(data))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var received struct {
+		Path string `json:"path"`
+	}
+	if err := peerRequest(req, &received); err != nil {
+		return "", "", fmt.Errorf("Porter transfer failed for %s: %w", file, err)
+	}
+	job.logf("%s received by %s as %s", filepath.Base(file), peer, received.Path)
+	return joinEscapedURL(peer+"/api/peer/files", name), sum, nil
+}
+
+// Delete a file sent to another Porter instance
+func deletePeerFile(rawURL string) error {
+	req, err := http.NewRequest(http.MethodDelete, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	return peerRequest(req, nil)
+}
+
+// List the files a receiver holds in a folder
+func listPeerObjects(ctx context.Context, peer, prefix string) ([]DestinationObject, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(peer, "/")+"/api/peer/files?prefix="+url.QueryEscape(prefix), nil)
+	if err != nil {
+		return nil, err
+	}
+	var listing struct {
+		Objects []DestinationObject `json:"objects"`
+	}
+	if err := peerRequest(req, &listing); err != nil {
+		return nil, err
+	}
+	return listing.Objects, nil
+}
+
+// Confirm some receiver is configured and accepts Porter's token
+func checkPeerCredentials(ctx context.Context) error {
+	peer := os.Getenv("PORTER_PEER_URL")
+	if peer == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "porter" && profile.URL != "" {
+				peer = profile.URL
+				break
+			}
+		}
+	}
+	if peer == "" {
+		return errors.New("no receiving Porter configured; set PORTER_PEER_URL or add a porter destination profile")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(peer, "/")+"/api/peer", nil)
+	if err != nil {
+		return err
+	}
+	return peerRequest(req, nil)
+}
@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+func TestPeerToken(t *testing.T) {
+	saved := config.Destinations
+	defer func() { config.Destinations = saved }()
+	config.Destinations = map[string]DestinationProfile{
+		"dr-site": {Cloud: "porter", URL: "https://porter-dr.example.com:8443", Token: "dr-token"},
+		"lab":     {Cloud: "porter", URL: "http://lab.example.com/porter"},
+		"images":  {Cloud: "http", URL: "https://images.example.com", Token: "http-token"},
+	}
+	t.Setenv("PORTER_PEER_URL", "https://porter.dc2.example.com")
+	t.Setenv("PORTER_PEER_TOKEN", "instance-token")
+	tests := []struct {
+		url, want string
+	}{
+		{"https://porter-dr.example.com:8443/api/peer/transfers", "dr-token"},
+		{"https://porter-dr.example.com/api/peer/transfers", ""},
+		{"https://porter-dr.example.com:8443.evil.tld/api/peer/transfers", ""},
+		{"http://porter-dr.example.com:8443/api/peer/transfers", ""},
+		{"http://lab.example.com/porter/api/peer/files", "instance-token"},
+		{"http://lab.example.com/api/peer/files", ""},
+		{"https://porter.dc2.example.com/api/peer/transfers/0123456789abcdef", "instance-token"},
+		{"https://porter.dc2.example.com.evil.tld/api/peer/transfers", ""},
+		{"https://images.example.com/api/peer/files", ""},
+		{"https://attacker.example.net/api/peer/transfers", ""},
+		{"not a url", ""},
+	}
+	for _, tt := range tests {
+		if got := peerToken(tt.url); got != tt.want {
+			t.Errorf("peerToken(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestCleanPeerName(t *testing.T) {
+	tests := []struct {
+		name, want string
+		ok         bool
+	}{
+		{"web01.vmdk", "web01.vmdk", true},
+		{"wave3/web01.vmdk", "wave3/web01.vmdk", true},
+		{"wave3//./web01.vmdk", "wave3/web01.vmdk", true},
+		{"wave3/../web01.vmdk", "web01.vmdk", true},
+		{"", "", false},
+		{".", "", false},
+		{"..", "", false},
+		{"../etc/passwd", "", false},
+		{"wave3/../../etc/passwd", "", false},
+		{"/etc/passwd", "", false},
+		{peerPartialDir + "/0123456789abcdef", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := cleanPeerName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("cleanPeerName(%q) = %q, %v, want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPeerTransferIDPattern(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"0123456789abcdef", true},
+		{"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", true},
+		{"0123456789abcde", false},
+		{"0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef0", false},
+		{"0123456789ABCDEF", false},
+		{"../../../../etc/x", false},
+		{"0123456789abcdef/..", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := peerTransferIDPattern.MatchString(tt.id); got != tt.want {
+			t.Errorf("peerTransferIDPattern.MatchString(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Exported job definitions. A pipeline spec wraps the job spec with a version header so
+// one carefully configured migration can be saved and re-submitted for the next VM:
+//
+//	apiVersion: porter/v1
+//	kind: Pipeline
+//	metadata:
+//	  name: upload-web01
+//	  exportedFrom: 4881ea067fbe98b8
+//	spec:
+//	  cloud: aws
+//	  files: [/app/converted/web01.vmdk]
+//	  bucket: migration-staging
+const (
+	pipelineAPIVersion = "porter/v1"
+	pipelineKind       = "Pipeline"
+)
+
+type PipelineSpec struct {
+	APIVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Metadata   PipelineMetadata `yaml:"metadata,omitempty"`
+	Spec       JobSpec          `yaml:"spec"`
+}
+
+type PipelineMetadata struct {
+	Name         string `yaml:"name,omitempty"`
+	ExportedFrom string `yaml:"exportedFrom,omitempty"`
+	ExportedAt   string `yaml:"exportedAt,omitempty"`
+}
+
+// Build the pipeline spec that reproduces a job
+func exportPipeline(job *Job) PipelineSpec {
+	name := "upload"
+	switch {
+	case job.Spec.Name != "":
+		name = job.Spec.Name
+	case job.Spec.Source != "":
+		name = baseNameWithoutExt(job.Spec.Source)
+	case len(job.Spec.Files) > 0:
+		name = "upload-" + baseNameWithoutExt(job.Spec.Files[0])
+	}
+	return PipelineSpec{
+		APIVersion: pipelineAPIVersion,
+		Kind:       pipelineKind,
+		Metadata: PipelineMetadata{
+			Name:         name,
+			ExportedFrom: job.ID,
+			ExportedAt:   time.Now().UTC().Format(time.RFC3339),
+		},
+		Spec: job.Spec,
+	}
+}
+
+// Parse and check a submitted pipeline spec
+func decodePipelineSpec(r io.Reader) (PipelineSpec, *APIError) {
+	var pipeline PipelineSpec
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&pipeline); err != nil {
+		return pipeline, &APIError{Code: errCodeInvalidRequest, Message: "Invalid pipeline spec", Details: err.Error()}
+	}
+	if pipeline.APIVersion != pipelineAPIVersion || pipeline.Kind != pipelineKind {
+		return pipeline, &APIError{Code: errCodeInvalidRequest,
+			Message:     fmt.Sprintf(tr("Unsupported pipeline spec %s/%s"), pipeline.APIVersion, pipeline.Kind),
+			Remediation: fmt.Sprintf(tr("Use apiVersion '%s' and kind '%s', as produced by GET /api/jobs/{id}/export."), pipelineAPIVersion, pipelineKind)}
+	}
+	return pipeline, nil
+}
+
+func baseNameWithoutExt(file string) string {
+	base := filepath.Base(file)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+func isYAMLRequest(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/yaml" || mediaType == "application/x-yaml" || mediaType == "text/yaml"
+}
+
+// Handler for /api/jobs/{id}/export: download a job as a YAML pipeline spec
+func jobExportHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+	pipeline := exportPipeline(job)
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(pipeline); err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+			Message: fmt.Sprintf(tr("Failed to export job %s"), job.ID), Details: err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.yaml\"", pipeline.Metadata.Name))
+	w.Write(out.Bytes())
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A VM in the migration plan, imported from RVTools or vSphere
+type PlanEntry struct {
+	ID            string `json:"id"`
+	VM            string `json:"vm"`
+	PowerState    string `json:"powerState,omitempty"`
+	GuestOS       string `json:"guestOS,omitempty"`
+	CPUs          int    `json:"cpus,omitempty"`
+	MemoryMB      int64  `json:"memoryMB,omitempty"`
+	ProvisionedMB int64  `json:"provisionedMB"`
+	InUseMB       int64  `json:"inUseMB"`
+
+	// Rough durations from the configured throughput; see planEstimates
+	EstimatedConvertSeconds int64 `json:"estimatedConvertSeconds"`
+	EstimatedUploadSeconds  int64 `json:"estimatedUploadSeconds"`
+
+	// The pipeline job migrating this VM and its last known state ("planned" until linked)
+	JobID  string `json:"jobId,omitempty"`
+	Status string `json:"status"`
+	// The VM's migration ticket, reused by later jobs for it; see ticket.go
+	Ticket string `json:"ticket,omitempty"`
+
+	ImportedAt time.Time `json:"importedAt"`
+}
+
+// The migration plan, persisted as JSON in the state directory
+type plan struct {
+	sync.Mutex
+	path    string
+	Entries []PlanEntry `json:"entries"`
+}
+
+var migrationPlan = loadPlan(filepath.Join(stateDir, "plan.json"))
+
+func loadPlan(path string) *plan {
+	p := &plan{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Warning: could not read migration plan %s: %s\n", path, err)
+		}
+		return p
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		fmt.Printf("Warning: invalid migration plan %s: %s (starting empty)\n", path, err)
+		return &plan{path: path}
+	}
+	fmt.Printf("Loaded %d migration plan entries from %s\n", len(p.Entries), path)
+	return p
+}
+
+// Write the plan atomically; callers must hold the lock
+func (p *plan) save() {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err == nil {
+		os.MkdirAll(filepath.Dir(p.path), 0755)
+		tmp := p.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, p.path)
+		}
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save migration plan: %s\n", err)
+	}
+}
+
+// Add imported VMs, updating the sizes of VMs already in the plan (and keeping their job links)
+func (p *plan) merge(entries []PlanEntry) (added, updated int) {
+	p.Lock()
+	defer p.Unlock()
+	for _, entry := range entries {
+		planEstimates(&entry, "")
+		found := false
+		for i := range p.Entries {
+			if p.Entries[i].VM == entry.VM {
+				entry.ID, entry.JobID, entry.Status = p.Entries[i].ID, p.Entries[i].JobID, p.Entries[i].Status
+				entry.Ticket = p.Entries[i].Ticket
+				p.Entries[i] = entry
+				found = true
+				updated++
+				break
+			}
+		}
+		if !found {
+			entry.ID = newID()
+			entry.Status = "planned"
+			p.Entries = append(p.Entries, entry)
+			added++
+		}
+	}
+	p.save()
+	return added, updated
+}
+
+func (p *plan) list() []PlanEntry {
+	p.Lock()
+	defer p.Unlock()
+	return append([]PlanEntry{}, p.Entries...)
+}
+
+// Link a job to the plan entry with the given ID, or (if id is empty) to the unlinked
+// entry for the job's VM name. Returns false if there is no such entry.
+func (p *plan) link(id string, job *Job) bool {
+	p.Lock()
+	defer p.Unlock()
+	for i := range p.Entries {
+		entry := &p.Entries[i]
+		if (id != "" && entry.ID == id) || (id == "" && entry.JobID == "" && entry.VM == job.Spec.Name) {
+			entry.JobID = job.ID
+			entry.Status = job.state()
+			p.save()
+			return true
+		}
+	}
+	return false
+}
+
+// Record a linked job's latest state so completion survives restarts
+func (p *plan) trackJob(job *Job) {
+	p.Lock()
+	defer p.Unlock()
+	for i := range p.Entries {
+		if p.Entries[i].JobID == job.ID {
+			p.Entries[i].Status = job.state()
+			p.save()
+			return
+		}
+	}
+}
+
+// The plan entry linked to a job, nil if none
+func (p *plan) entryFor(jobID string) *PlanEntry {
+	p.Lock()
+	defer p.Unlock()
+	for _, entry := range p.Entries {
+		if entry.JobID == jobID {
+			return &entry
+		}
+	}
+	return nil
+}
+
+// The ticket of the plan entry linked to a job, if any
+func (p *plan) ticketFor(jobID string) string {
+	if entry := p.entryFor(jobID); entry != nil {
+		return entry.Ticket
+	}
+	return ""
+}
+
+// Remember the ticket opened for a job on its plan entry
+func (p *plan) setTicket(jobID, ticket string) {
+	p.Lock()
+	defer p.Unlock()
+	for i := range p.Entries {
+		if p.Entries[i].JobID == jobID && p.Entries[i].Ticket == "" {
+			p.Entries[i].Ticket = ticket
+			p.save()
+			return
+		}
+	}
+}
+
+func (p *plan) remove(id string) bool {
+	p.Lock()
+	defer p.Unlock()
+	for i, entry := range p.Entries {
+		if entry.ID == id {
+			p.Entries = append(p.Entries[:i], p.Entries[i+1:]...)
+			p.save()
+			return true
+		}
+	}
+	return false
+}
+
+// Estimate conversion (reading the used data) and upload (the full provisioned disk,
+// as raw images are) durations from measured or configured throughput
+func planEstimates(entry *PlanEntry, cloud string) {
+	inUse := entry.InUseMB
+	if inUse == 0 {
+		inUse = entry.ProvisionedMB
+	}
+	const mb = 1024 * 1024
+	entry.EstimatedConvertSeconds = int64(float64(inUse*mb) / throughput.rate("convert"))
+	entry.EstimatedUploadSeconds = int64(float64(entry.ProvisionedMB*mb) / throughput.rate(uploadStage(cloud)))
+}
+
+// Parse the vInfo tab of an RVTools export saved as CSV
+func parseRVToolsCSV(r io.Reader) ([]PlanEntry, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) < 2 {
+		return nil, fmt.Errorf("expected a header row and at least one VM")
+	}
+
+	columns := map[string]int{}
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+	field := func(row []string, names ...string) string {
+		for _, name := range names {
+			if i, ok := columns[name]; ok && i < len(row) {
+				return strings.TrimSpace(row[i])
+			}
+		}
+		return ""
+	}
+	number := func(row []string, names ...string) int64 {
+		value := strings.NewReplacer(",", "", " ", "").Replace(field(row, names...))
+		n, _ := strconv.ParseInt(value, 10, 64)
+		return n
+	}
+	if _, ok := columns["vm"]; !ok {
+		return nil, fmt.Errorf("no 'VM' column; export the vInfo tab of RVTools as CSV")
+	}
+
+	var entries []PlanEntry
+	now := time.Now().UTC()
+	for _, row := range rows[1:] {
+		vm := field(row, "vm")
+		if vm == "" || strings.EqualFold(field(row, "template"), "true") {
+			continue
+		}
+		entries = append(entries, PlanEntry{
+			VM:            vm,
+			PowerState:    field(row, "powerstate"),
+			GuestOS:       field(row, "os according to the vmware tools", "os according to the configuration file"),
+			CPUs:          int(number(row, "cpus")),
+			MemoryMB:      number(row, "memory"),
+			ProvisionedMB: number(row, "provisioned mib", "provisioned mb"),
+			InUseMB:       number(row, "in use mib", "in use mb"),
+			ImportedAt:    now,
+		})
+	}
+	return entries, nil
+}
+
+// Read the live inventory from vCenter with govc (configured through GOVC_URL and
+// related environment variables)
+func listVSphereVMs() ([]PlanEntry, error) {
+	cmd := toolCommand(context.Background(), "govc", "vm.info", "-json", "-r", "*")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("govc vm.info failed: %w", err)
+	}
+
+	// govc's JSON casing differs between versions; encoding/json matches either
+	var info struct {
+		VirtualMachines []struct {
+			Name    string
+			Runtime struct{ PowerState string }
+			Summary struct {
+				Config struct {
+					NumCpu        int
+					MemorySizeMB  int64
+					GuestFullName string
+					Template      bool
+				}
+				Storage struct{ Committed, Uncommitted int64 }
+			}
+		}
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, fmt.Errorf("unexpected govc output: %w", err)
+	}
+
+	var entries []PlanEntry
+	now := time.Now().UTC()
+	for _, vm := range info.VirtualMachines {
+		if vm.Summary.Config.Template {
+			continue
+		}
+		storage := vm.Summary.Storage
+		entries = append(entries, PlanEntry{
+			VM:            vm.Name,
+			PowerState:    vm.Runtime.PowerState,
+			GuestOS:       vm.Summary.Config.GuestFullName,
+			CPUs:          vm.Summary.Config.NumCpu,
+			MemoryMB:      vm.Summary.Config.MemorySizeMB,
+			ProvisionedMB: (storage.Committed + storage.Uncommitted) / (1024 * 1024),
+			InUseMB:       storage.Committed / (1024 * 1024),
+			ImportedAt:    now,
+		})
+	}
+	return entries, nil
+}
+
+// Plan entries with totals for the whole migration
+type planSummary struct {
+	Entries                 []PlanEntry    `json:"entries"`
+	VMs                     int            `json:"vms"`
+	ProvisionedMB           int64          `json:"provisionedMB"`
+	EstimatedConvertSeconds int64          `json:"estimatedConvertSeconds"`
+	EstimatedUploadSeconds  int64          `json:"estimatedUploadSeconds"`
+	ByStatus                map[string]int `json:"byStatus"`
+}
+
+// Handler to show the migration plan
+func planListHandler(w http.ResponseWriter, r *http.Request) {
+	summary := planSummary{Entries: migrationPlan.list(), ByStatus: map[string]int{}}
+	for i := range summary.Entries {
+		entry := &summary.Entries[i]
+		// Refresh estimates as throughput is measured, using the linked job's cloud if any
+		var cloud string
+		if job, ok := jobs.get(entry.JobID); ok {
+			cloud = job.settings.Cloud
+		}
+		planEstimates(entry, cloud)
+		summary.VMs++
+		summary.ProvisionedMB += entry.ProvisionedMB
+		summary.EstimatedConvertSeconds += entry.EstimatedConvertSeconds
+		summary.EstimatedUploadSeconds += entry.EstimatedUploadSeconds
+		summary.ByStatus[entry.Status]++
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+// Handler to import VMs into the plan: an RVTools vInfo CSV as the body, or
+// ?source=vsphere to read the live inventory with govc
+func planImportHandler(w http.ResponseWriter, r *http.Request) {
+	var entries []PlanEntry
+	var err error
+	if r.URL.Query().Get("source") == "vsphere" {
+		if entries, err = listVSphereVMs(); err != nil {
+			writeAPIError(w, http.StatusBadGateway, APIError{Code: errCodeProviderFailed,
+				Message: "Failed to read the vSphere inventory", Details: err.Error(),
+				Remediation: "Check that govc is installed and GOVC_URL, GOVC_USERNAME and GOVC_PASSWORD are set."})
+			return
+		}
+	} else if entries, err = parseRVToolsCSV(r.Body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "Invalid RVTools export", Details: err.Error(),
+			Remediation: "Export the vInfo tab of RVTools to CSV and send it as the request body."})
+		return
+	}
+
+	added, updated := migrationPlan.merge(entries)
+	fmt.Printf("Migration plan import: %d VM(s) added, %d updated\n", added, updated)
+	writeJSON(w, http.StatusOK, map[string]int{"added": added, "updated": updated})
+}
+
+// Handler to link a plan entry to an existing job
+func planLinkHandler(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		JobID string `json:"jobId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Invalid request body", Details: err.Error()})
+		return
+	}
+	job, ok := jobs.get(body.JobID)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), body.JobID)})
+		return
+	}
+	if !migrationPlan.link(r.PathValue("id"), job) {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown plan entry: %s"), r.PathValue("id"))})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handler to remove a VM from the plan
+func planDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if !migrationPlan.remove(r.PathValue("id")) {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown plan entry: %s"), r.PathValue("id"))})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
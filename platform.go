@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The virtual platform a migrated VM needs: Hyper-V and Azure generation 1
+// (BIOS) or 2 (UEFI), Secure Boot and a virtual TPM. These follow the firmware
+// readiness checks found on the disk (or the OVF's, for jobs without them) and
+// the OVF's Secure Boot and vTPM settings. Windows 11 and Windows Server 2022
+// guests always get generation 2 with Secure Boot and a TPM, since they refuse
+// to run without them. Jobs can set generation, secureBoot and tpm explicitly,
+// but not a generation the disk can't boot as.
+type vmPlatform struct {
+	Generation int  `json:"generation"`
+	SecureBoot bool `json:"secureBoot"`
+	TPM        bool `json:"tpm"`
+}
+
+// Whether a guest needs Secure Boot and a TPM, from its OVF guest type (e.g.
+// windows11_64Guest, or windows2019srvNext_64Guest for Server 2022) or the
+// product name inspection found
+func requiresTrustedBoot(osType, productName string) bool {
+	osType, productName = strings.ToLower(osType), strings.ToLower(productName)
+	for _, guest := range []string{"windows11", "windows2019srvnext", "windows2022srv"} {
+		if strings.HasPrefix(osType, guest) {
+			return true
+		}
+	}
+	for _, product := range []string{"windows 11", "windows server 2022", "windows server 2025"} {
+		if strings.Contains(productName, product) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether a disk's guest is Windows
+func isWindowsGuest(hw ovfHardware, productName string) bool {
+	return strings.Contains(strings.ToLower(hw.OSType), "windows") || strings.Contains(strings.ToLower(productName), "windows")
+}
+
+// The firmware and product name the job's readiness checks found for a disk
+func readinessForDisk(job *Job, file string) (firmware, productName string) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	for _, report := range job.Readiness {
+		if diskVMDKName(report.Disk) != diskVMDKName(file) {
+			continue
+		}
+		if report.Guest != nil {
+			productName = report.Guest.ProductName
+		}
+		return report.Firmware, productName
+	}
+	return "", ""
+}
+
+// Work out the platform a disk needs, applying the job's settings
+func platformForDisk(job *Job, s uploadSettings, file string) (vmPlatform, error) {
+	hw := hardwareForDisk(file)
+	uefi := hw.Firmware == "efi"
+	firmware, productName := readinessForDisk(job, file)
+	if firmware != "" {
+		uefi = firmware == "uefi"
+	}
+	name := filepath.Base(file)
+
+	p := vmPlatform{Generation: 1}
+	if uefi {
+		p = vmPlatform{Generation: 2, SecureBoot: hw.SecureBoot, TPM: hw.TPM}
+	}
+	trusted := requiresTrustedBoot(hw.OSType, productName)
+	switch {
+	case trusted && uefi:
+		p.SecureBoot, p.TPM = true, true
+	case trusted:
+		job.warnf("%s is Windows 11 or Server 2022 but boots through BIOS, so it can only run as generation 1 without Secure Boot or a TPM; convert its disk with mbr2gpt and switch it to UEFI before migrating", name)
+	}
+
+	switch {
+	case s.Generation == 2 && !uefi:
+		return p, fmt.Errorf("%s boots through BIOS, so it cannot run as generation 2; leave generation unset or use 1", name)
+	case s.Generation == 1 && uefi:
+		return p, fmt.Errorf("%s boots through UEFI, so it cannot run as generation 1; leave generation unset or use 2", name)
+	}
+	if s.SecureBoot != nil {
+		p.SecureBoot = *s.SecureBoot
+	}
+	if s.TPM != nil {
+		p.TPM = *s.TPM
+	}
+	if p.Generation == 1 && (p.SecureBoot || p.TPM) {
+		return p, fmt.Errorf("%s boots through BIOS, and Secure Boot and TPMs need generation 2 (UEFI)", name)
+	}
+	if trusted && uefi && !(p.SecureBoot && p.TPM) {
+		job.warnf("%s is Windows 11 or Server 2022, which won't boot or update without Secure Boot and a TPM", name)
+	}
+	job.logf("%s: generation %d, Secure Boot %s, TPM %s", name, p.Generation, onOff(p.SecureBoot), onOff(p.TPM))
+	return p, nil
+}
+
+func onOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// Hyper-V disks, which get a script creating their VM when copied
+func isHyperVDisk(file string) bool {
+	ext := strings.ToLower(filepath.Ext(file))
+	return ext == ".vhdx" || ext == ".vhd"
+}
+
+// Quote a string for PowerShell
+func psQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// A PowerShell script creating a Hyper-V VM with the platform a disk needs,
+// run from the folder the disk is in
+func hyperVScript(job *Job, hw ovfHardware, windows bool, p vmPlatform, disk string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Created by Porter job %s: creates the Hyper-V VM for %s\n", job.ID, disk)
+	b.WriteString("$ErrorActionPreference = 'Stop'\n")
+	fmt.Fprintf(&b, "$disk = Join-Path $PSScriptRoot %s\n", psQuote(disk))
+	writeHyperVVM(&b, hw.Name, hw, windows, p, "")
+	return b.String()
+}
+
+// The commands creating a VM named name with $disk as its boot disk, connected
+// to vmSwitch if one is named
+func writeHyperVVM(b *strings.Builder, name string, hw ovfHardware, windows bool, p vmPlatform, vmSwitch string) {
+	vm := psQuote(name)
+	fmt.Fprintf(b, "New-VM -Name %s -Generation %d -MemoryStartupBytes %dMB -VHDPath $disk", vm, p.Generation, hw.MemoryMB)
+	if vmSwitch != "" {
+		fmt.Fprintf(b, " -SwitchName %s", psQuote(vmSwitch))
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(b, "Set-VMProcessor -VMName %s -Count %d\n", vm, hw.CPUs)
+	if p.Generation == 2 {
+		if p.SecureBoot {
+			// Linux shims are signed by Microsoft's UEFI CA rather than the Windows key
+			template := "MicrosoftUEFICertificateAuthority"
+			if windows {
+				template = "MicrosoftWindows"
+			}
+			fmt.Fprintf(b, "Set-VMFirmware -VMName %s -EnableSecureBoot On -SecureBootTemplate %s\n", vm, template)
+		} else {
+			fmt.Fprintf(b, "Set-VMFirmware -VMName %s -EnableSecureBoot Off\n", vm)
+		}
+	}
+	if p.TPM {
+		fmt.Fprintf(b, "Set-VMKeyProtector -VMName %s -NewLocalKeyProtector\n", vm)
+		fmt.Fprintf(b, "Enable-VMTPM -VMName %s\n", vm)
+	}
+}
+
+// Write <disk>.hyperv.ps1 beside a VHD or VHDX copied to a local folder or SMB
+// share. The disk is already there, so failures are warnings.
+func writeHyperVScript(job *Job, s uploadSettings, file string) {
+	p, err := platformForDisk(job, s, file)
+	if err != nil {
+		job.warnf("No Hyper-V script for %s: %s", filepath.Base(file), err)
+		return
+	}
+	hw := hardwareForDisk(file)
+	_, productName := readinessForDisk(job, file)
+	name := filepath.Base(file) + ".hyperv.ps1"
+	script := hyperVScript(job, hw, isWindowsGuest(hw, productName), p, filepath.Base(file))
+
+	if s.Cloud == "local" {
+		if err := os.WriteFile(filepath.Join(s.Target, name), []byte(script), 0644); err != nil {
+			job.warnf("Writing the Hyper-V script for %s failed: %s", filepath.Base(file), err)
+			return
+		}
+		job.logf("Wrote %s to create the Hyper-V VM", filepath.Join(s.Target, name))
+		return
+	}
+
+	share, err := parseSMBURL(s.URL)
+	if err != nil {
+		job.warnf("Copying the Hyper-V script for %s failed: %s", filepath.Base(file), err)
+		return
+	}
+	local := filepath.Join(os.TempDir(), "porter-"+job.ID+"-"+name)
+	if err := os.WriteFile(local, []byte(script), 0644); err != nil {
+		job.warnf("Writing the Hyper-V script for %s failed: %s", filepath.Base(file), err)
+		return
+	}
+	defer os.Remove(local)
+	remote := path.Join(strings.Trim(path.Join(share.Path, s.Target), "/"), name)
+	creds := resolveSMBCredentials(s.URL, smbCredentials{s.Username, s.Password})
+	out, err := runSMBClient(job.ctx, share, creds, []string{"put " + smbQuote(local) + " " + smbQuote(remote)})
+	if err == nil {
+		if status := smbErrorPattern.Find(out); status != nil {
+			err = fmt.Errorf("%s", status)
+		}
+	}
+	if err != nil {
+		job.warnf("Copying the Hyper-V script for %s failed: %s", filepath.Base(file), err)
+		return
+	}
+	job.logf("Copied %s to create the Hyper-V VM", share.fileURL(remote))
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A destination Porter can upload to, and how to check that it is usable here
+type provider struct {
+	Name  string
+	Label string
+	// CLI the provider shells out to ("" if none is needed)
+	Binary string
+	// Conversion formats the destination's image import accepts
+	Formats []string
+	// Confirm credentials work, and list the regions available with them (both optional)
+	checkCredentials func(ctx context.Context) error
+	listRegions      func(ctx context.Context) ([]string, error)
+}
+
+var providers = []provider{
+	{
+		Name:             "aws",
+		Label:            "AWS S3",
+		Binary:           "aws",
+		Formats:          []string{"raw", "vpc", "vhdx"},
+		checkCredentials: checkAWSCredentials,
+		listRegions:      listAWSRegions,
+	},
+	{
+		Name:             "azure",
+		Label:            "Azure Blob Storage",
+		Binary:           "az",
+		Formats:          []string{"vpc"},
+		checkCredentials: checkAzureCredentials,
+		listRegions:      listAzureRegions,
+	},
+	{
+		Name:             "azuredisk",
+		Label:            "Azure managed disk",
+		Binary:           "az",
+		Formats:          []string{"vpc"},
+		checkCredentials: checkAzureCredentials,
+		listRegions:      listAzureRegions,
+	},
+	{
+		Name:             "gcp",
+		Label:            "Google Cloud Storage",
+		Binary:           "gcloud",
+		Formats:          []string{"raw", "vpc", "vhdx", "qcow2"},
+		checkCredentials: checkGCPCredentials,
+		listRegions:      listGCPLocations,
+	},
+	{
+		Name:             "ibm",
+		Label:            "IBM Cloud Object Storage / VPC",
+		Binary:           "ibmcloud",
+		Formats:          []string{"qcow2", "vpc"},
+		checkCredentials: checkIBMCredentials,
+		listRegions:      listIBMRegions,
+	},
+	{
+		Name:             "alibaba",
+		Label:            "Alibaba Cloud OSS / ECS",
+		Binary:           "aliyun",
+		Formats:          []string{"raw", "vpc", "qcow2"},
+		checkCredentials: checkAlibabaCredentials,
+		listRegions:      listAlibabaRegions,
+	},
+	{
+		Name:             "spaces",
+		Label:            "DigitalOcean Spaces",
+		Binary:           "aws",
+		Formats:          []string{"raw", "qcow2", "vhdx", "vmdk"},
+		checkCredentials: checkSpacesCredentials,
+		listRegions:      listSpacesRegions,
+	},
+	{
+		Name:             "b2",
+		Label:            "Backblaze B2",
+		Binary:           "b2",
+		Formats:          []string{"raw", "qcow2", "vhdx", "vmdk"},
+		checkCredentials: checkB2Credentials,
+		listRegions:      listB2Regions,
+	},
+	{
+		Name:             "swift",
+		Label:            "OpenStack Swift",
+		Binary:           "swift",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkSwiftCredentials,
+	},
+	{
+		Name:             "oracle",
+		Label:            "Oracle Cloud Object Storage",
+		Binary:           "oci",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkOracleCredentials,
+		listRegions:      listOracleRegions,
+	},
+	{
+		Name:             "linode",
+		Label:            "Linode custom images",
+		Formats:          []string{"raw"},
+		checkCredentials: checkLinodeCredentials,
+		listRegions:      listLinodeRegions,
+	},
+	{
+		Name:             "vultr",
+		Label:            "Vultr snapshots",
+		Formats:          []string{"raw"},
+		checkCredentials: checkVultrCredentials,
+	},
+	{
+		Name:             "webdav",
+		Label:            "WebDAV / Nextcloud",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkWebDAVCredentials,
+	},
+	{
+		Name:             "http",
+		Label:            "HTTP(S) endpoint",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkHTTPCredentials,
+	},
+	{
+		Name:             "porter",
+		Label:            "Another Porter instance",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkPeerCredentials,
+	},
+	{
+		Name:             "artifactory",
+		Label:            "JFrog Artifactory",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkArtifactRepoCredentials("artifactory"),
+	},
+	{
+		Name:             "nexus",
+		Label:            "Sonatype Nexus",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkArtifactRepoCredentials("nexus"),
+	},
+	{
+		Name:             "rsync",
+		Label:            "rsync over SSH",
+		Binary:           "rsync",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkRsyncCredentials,
+	},
+	{
+		Name:             "ftp",
+		Label:            "FTP / FTPS",
+		Binary:           "curl",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkFTPCredentials,
+	},
+	{
+		Name:             "smb",
+		Label:            "SMB / CIFS share",
+		Binary:           "smbclient",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkSMBCredentials,
+	},
+	{
+		Name:             "nfs",
+		Label:            "NFS export",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkNFSCredentials,
+	},
+	{
+		Name:             "vsphere",
+		Label:            "VMware vSphere",
+		Binary:           "govc",
+		Formats:          []string{"vmdk"},
+		checkCredentials: checkVSphereCredentials,
+	},
+	{
+		Name:             "datastore",
+		Label:            "vSphere datastore folder",
+		Binary:           "govc",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkVSphereCredentials,
+	},
+	{
+		Name:             "proxmox",
+		Label:            "Proxmox VE",
+		Formats:          []string{"qcow2", "raw", "vmdk"},
+		checkCredentials: checkProxmoxCredentials,
+	},
+	{
+		Name:             "library",
+		Label:            "vSphere Content Library",
+		Binary:           "govc",
+		Formats:          supportedFormatOrder,
+		checkCredentials: checkVSphereCredentials,
+	},
+	{
+		Name:             "xcpng",
+		Label:            "XCP-ng / XenServer pool",
+		Formats:          []string{"raw", "vpc"},
+		checkCredentials: checkXAPICredentials,
+	},
+	{
+		Name:             "ovirt",
+		Label:            "oVirt / Red Hat Virtualization",
+		Formats:          []string{"qcow2", "raw"},
+		checkCredentials: checkOVirtCredentials,
+	},
+	{
+		Name:             "nutanix",
+		Label:            "Nutanix AHV image service",
+		Formats:          []string{"qcow2", "raw", "vmdk"},
+		checkCredentials: checkNutanixCredentials,
+	},
+	{
+		Name:             "hyperv",
+		Label:            "Microsoft Hyper-V (WinRM)",
+		Binary:           "smbclient",
+		Formats:          []string{"vhdx", "vpc"},
+		checkCredentials: checkHyperVCredentials,
+	},
+	{
+		Name:    "xva",
+		Label:   "XCP-ng / XenServer XVA package",
+		Formats: supportedFormatOrder,
+	},
+	{
+		Name:    "utm",
+		Label:   "UTM bundle (Mac)",
+		Formats: supportedFormatOrder,
+	},
+	{
+		Name:    "vagrant",
+		Label:   "Vagrant box",
+		Formats: supportedFormatOrder,
+	},
+	{
+		Name:    "containerdisk",
+		Label:   "KubeVirt containerdisk (OCI)",
+		Formats: supportedFormatOrder,
+	},
+	{
+		Name:    "incus",
+		Label:   "LXD / Incus VM image",
+		Formats: supportedFormatOrder,
+	},
+	{
+		Name:    "bundle",
+		Label:   "Air-gapped bundle",
+		Formats: supportedFormatOrder,
+	},
+	{
+		Name:    "bundle-import",
+		Label:   "Import air-gapped bundle",
+		Formats: supportedFormatOrder,
+	},
+	{
+		Name:    "local",
+		Label:   "Local filesystem",
+		Formats: supportedFormatOrder,
+	},
+}
+
+func findProvider(name string) (provider, bool) {
+	for _, p := range providers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return provider{}, false
+}
+
+func providerNames() []string {
+	var names []string
+	for _, p := range providers {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// What a client needs to know to offer a provider
+type ProviderStatus struct {
+	Name             string   `json:"name"`
+	Label            string   `json:"label"`
+	Usable           bool     `json:"usable"`
+	BinaryAvailable  bool     `json:"binaryAvailable"`
+	CredentialsValid bool     `json:"credentialsValid"`
+	Regions          []string `json:"regions,omitempty"`
+	Formats          []string `json:"formats"`
+	Problems         []string `json:"problems,omitempty"`
+	// Set while the provider's circuit breaker is open
+	UnavailableUntil *time.Time `json:"unavailableUntil,omitempty"`
+}
+
+// Probe one provider: binary, credentials and regions. The probes go through the
+// provider's circuit breaker, so one that keeps failing is reported as
+// temporarily unavailable without being called again.
+func (p provider) status(ctx context.Context) ProviderStatus {
+	s := ProviderStatus{Name: p.Name, Label: p.Label, BinaryAvailable: true, CredentialsValid: true}
+
+	// Only offer formats this instance allows
+	for _, format := range p.Formats {
+		if checkFormat(format) == nil {
+			s.Formats = append(s.Formats, format)
+		}
+	}
+	if s.Formats == nil {
+		s.Formats = []string{}
+	}
+
+	if mocked(p.Name) {
+		// Nothing to check against the fake backend
+		s.Problems = append(s.Problems, "simulated (mock mode)")
+	} else if p.Binary != "" && !checkBinary(p.Binary) {
+		s.BinaryAvailable, s.CredentialsValid = false, false
+		s.Problems = append(s.Problems, fmt.Sprintf("%s CLI not found in PATH", p.Binary))
+	} else {
+		if p.checkCredentials != nil {
+			if err := providerCall(ctx, p.Name, p.checkCredentials); err != nil {
+				s.CredentialsValid = false
+				s.Problems = append(s.Problems, "credentials check failed: "+err.Error())
+			}
+		}
+		if s.CredentialsValid && p.listRegions != nil {
+			var regions []string
+			err := providerCall(ctx, p.Name, func(ctx context.Context) error {
+				var err error
+				regions, err = p.listRegions(ctx)
+				return err
+			})
+			if err != nil {
+				s.Problems = append(s.Problems, "could not list regions: "+err.Error())
+			}
+			s.Regions = regions
+		}
+	}
+	s.UnavailableUntil = providerUnavailableUntil(p.Name)
+	s.Usable = s.BinaryAvailable && s.CredentialsValid && len(s.Formats) > 0
+	return s
+}
+
+// Provider probes call cloud APIs, so results are cached briefly
+const providerStatusTTL = 5 * time.Minute
+
+var providerCache struct {
+	sync.Mutex
+	statuses  []ProviderStatus
+	checkedAt time.Time
+}
+
+// Status of every provider, probed in parallel
+func providerStatuses(refresh bool) ([]ProviderStatus, time.Time) {
+	providerCache.Lock()
+	defer providerCache.Unlock()
+	if !refresh && providerCache.statuses != nil && time.Since(providerCache.checkedAt) < providerStatusTTL {
+		return providerCache.statuses, providerCache.checkedAt
+	}
+
+	statuses := make([]ProviderStatus, len(providers))
+	var wg sync.WaitGroup
+	for i, p := range providers {
+		wg.Add(1)
+		go func(i int, p provider) {
+			defer wg.Done()
+			statuses[i] = p.status(context.Background())
+		}(i, p)
+	}
+	wg.Wait()
+
+	providerCache.statuses = statuses
+	providerCache.checkedAt = time.Now().UTC()
+	return statuses, providerCache.checkedAt
+}
+
+// Handler for /api/providers; ?refresh=true skips the cache
+func providersHandler(w http.ResponseWriter, r *http.Request) {
+	statuses, checkedAt := providerStatuses(r.URL.Query().Get("refresh") == "true")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"providers": statuses,
+		"checkedAt": checkedAt,
+	})
+}
+
+func checkAWSCredentials(ctx context.Context) error {
+	return runQuiet(toolCommand(ctx, "aws", "sts", "get-caller-identity", "--output", "json"))
+}
+
+func listAWSRegions(ctx context.Context) ([]string, error) {
+	out, err := toolCommand(ctx, "aws", "ec2", "describe-regions", "--query", "Regions[].RegionName", "--output", "text").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func checkAzureCredentials(ctx context.Context) error {
+	return runQuiet(toolCommand(ctx, "az", "account", "show", "-o", "none"))
+}
+
+func listAzureRegions(ctx context.Context) ([]string, error) {
+	out, err := toolCommand(ctx, "az", "account", "list-locations", "--query", "[].name", "-o", "tsv").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// Run a command, turning a failure into an error carrying its output
+func runQuiet(cmd *exec.Cmd) error {
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Call a JSON API with a bearer token, sending body (if not nil) as JSON
+func jsonAPIRequest(ctx context.Context, method, endpoint, token string, body, out interface{}) error {
+	req, err := newJSONRequest(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return doJSONRequest(req, out)
+}
+
+// A request with body (if not nil) as JSON
+func newJSONRequest(ctx context.Context, method, endpoint string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// Send an API request, decoding a JSON response into out (if not nil) and turning
+// error statuses into errors carrying the response body
+func doJSONRequest(req *http.Request, out interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
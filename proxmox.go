@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Proxmox VE: disks are uploaded through the API to a node's storage as
+// importable disk images (the storage needs the "import" content type, Proxmox
+// VE 8.2 or later), and with createImage a VM is created that imports the disk
+// onto a VM storage (datastore), with the CPUs, memory and firmware of the
+// source VM. Windows guests get a SATA disk and an e1000 network card, which
+// they have drivers for; Linux guests get virtio. The node is the host, the
+// upload storage the bucket and the bridge the network (default vmbr0).
+//
+// The API URL (https://pve1:8006) comes from the request, a proxmox profile or
+// PROXMOX_URL; the API token ("user@realm!tokenid=secret") from the profile's
+// token or PROXMOX_TOKEN, which only goes to PROXMOX_URL and profiles' URLs.
+// Set PROXMOX_INSECURE=1 for self-signed certificates.
+
+// Characters Proxmox doesn't allow in import file names
+var proxmoxFileNameInvalid = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Characters Proxmox doesn't allow in VM names, which must be DNS names
+var proxmoxVMNameInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// The API token for a Proxmox URL: the token of the profile it is under, else
+// PROXMOX_TOKEN if it is under PROXMOX_URL or a profile without a token
+func proxmoxToken(rawURL string) string {
+	configured := false
+	for _, profile := range config.Destinations {
+		if profile.Cloud != "proxmox" || profile.URL == "" || !urlUnder(rawURL, profile.URL) {
+			continue
+		}
+		if profile.Token != "" {
+			return os.ExpandEnv(profile.Token)
+		}
+		configured = true
+	}
+	if server := os.Getenv("PROXMOX_URL"); configured || (server != "" && urlUnder(rawURL, server)) {
+		return os.Getenv("PROXMOX_TOKEN")
+	}
+	return ""
+}
+
+// Call the Proxmox API, with form parameters for POSTs, decoding the response's
+// data into out (if not nil)
+func proxmoxRequest(ctx context.Context, server, method, endpoint string, params url.Values, out interface{}) error {
+	var body io.Reader
+	if params != nil {
+		body = strings.NewReader(params.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(server, "/")+"/api2/json"+endpoint, body)
+	if err != nil {
+		return err
+	}
+	if params != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return doProxmoxRequest(req, server, out)
+}
+
+func doProxmoxRequest(req *http.Request, server string, out interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	if token := proxmoxToken(server); token != "" {
+		req.Header.Set("Authorization", "PVEAPIToken="+token)
+	}
+	resp, err := insecureClient("PROXMOX_INSECURE").Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return err
+	}
+	return json.Unmarshal(envelope.Data, out)
+}
+
+// Wait for a Proxmox task (UPID) to finish, failing if it did
+func waitForProxmoxTask(job *Job, s uploadSettings, upid, what string) error {
+	for {
+		var task struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		endpoint := "/nodes/" + url.PathEscape(s.Host) + "/tasks/" + url.PathEscape(upid) + "/status"
+		if err := proxmoxRequest(job.ctx, s.URL, http.MethodGet, endpoint, nil, &task); err != nil {
+			return fmt.Errorf("checking %s failed: %w", what, err)
+		}
+		if task.Status == "stopped" {
+			if task.ExitStatus != "OK" {
+				return fmt.Errorf("%s failed: %s", what, task.ExitStatus)
+			}
+			return nil
+		}
+		select {
+		case <-job.ctx.Done():
+			return job.ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// Upload one disk to a Proxmox storage, returning node/volume (e.g.
+// pve1/local:import/web01.qcow2) and the ID of the VM created from it, if any
+func uploadToProxmox(job *Job, s uploadSettings, file string) (string, string, error) {
+	format := diskFormatForPath(file)
+	if format != "qcow2" && format != "raw" && format != "vmdk" {
+		return "", "", fmt.Errorf("Proxmox imports QCOW2, RAW or VMDK disks, not %s; convert to qcow2", filepath.Base(file))
+	}
+	var platform vmPlatform
+	if s.CreateImage {
+		var err error
+		if platform, err = platformForDisk(job, s, file); err != nil {
+			return "", "", err
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	sums, err := checksumFileForJob(job, file, []string{"sha256"})
+	if err != nil {
+		return "", "", err
+	}
+
+	// Proxmox wants a known length, so the multipart body is framed around the file
+	name := proxmoxFileNameInvalid.ReplaceAllString(filepath.Base(file), "_")
+	if !strings.EqualFold(filepath.Ext(name), "."+format) {
+		// Proxmox tells the format from the extension, so .img becomes .raw
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + "." + format
+	}
+	var head bytes.Buffer
+	form := multipart.NewWriter(&head)
+	form.WriteField("content", "import")
+	form.WriteField("checksum", sums["sha256"])
+	form.WriteField("checksum-algorithm", "sha256")
+	if _, err := form.CreateFormFile("filename", name); err != nil {
+		return "", "", err
+	}
+	tail := "\r\n--" + form.Boundary() + "--\r\n"
+	body := io.MultiReader(bytes.NewReader(head.Bytes()), &jobReader{job: job, r: f}, strings.NewReader(tail))
+	endpoint := fmt.Sprintf("%s/api2/json/nodes/%s/storage/%s/upload", strings.TrimRight(s.URL, "/"), url.PathEscape(s.Host), url.PathEscape(s.Bucket))
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return "", "", err
+	}
+	req.ContentLength = int64(head.Len()) + info.Size() + int64(len(tail))
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	volume := s.Bucket + ":import/" + name
+	job.setStatus("Uploading %s to Proxmox %s as %s (%.2f MB)",
+		filepath.Base(file), s.Host, volume, float64(info.Size())/(1024*1024))
+	var upid string
+	if err := doProxmoxRequest(req, s.URL, &upid); err != nil {
+		return "", "", fmt.Errorf("Proxmox upload failed for %s: %w", file, err)
+	}
+	// Proxmox moves the upload into place and verifies its checksum in a task
+	if err := waitForProxmoxTask(job, s, upid, "storing "+name); err != nil {
+		return "", "", err
+	}
+	dest := s.Host + "/" + volume
+	if !s.CreateImage {
+		return dest, "", nil
+	}
+	vmid, err := createProxmoxVM(job, s, file, volume, platform)
+	if err != nil {
+		return dest, "", err
+	}
+	return dest, vmid, nil
+}
+
+// Create a VM that imports an uploaded disk, returning its ID
+func createProxmoxVM(job *Job, s uploadSettings, file, volume string, p vmPlatform) (string, error) {
+	var vmid string
+	if err := proxmoxRequest(job.ctx, s.URL, http.MethodGet, "/cluster/nextid", nil, &vmid); err != nil {
+		return "", fmt.Errorf("choosing a VM ID failed: %w", err)
+	}
+	hw := hardwareForDisk(file)
+	_, productName := readinessForDisk(job, file)
+	windows := isWindowsGuest(hw, productName)
+	name := job.Spec.Name
+	if name == "" {
+		name = hw.Name
+	}
+	name = strings.Trim(proxmoxVMNameInvalid.ReplaceAllString(strings.ToLower(name), "-"), "-")
+
+	bridge := s.Network
+	if bridge == "" {
+		bridge = "vmbr0"
+	}
+	params := url.Values{
+		"vmid":   {vmid},
+		"name":   {name},
+		"cores":  {fmt.Sprint(hw.CPUs)},
+		"memory": {fmt.Sprint(hw.MemoryMB)},
+	}
+	disk := s.Datastore + ":0,import-from=" + volume
+	switch {
+	case windows:
+		params.Set("ostype", "win10")
+		if requiresTrustedBoot(hw.OSType, productName) {
+			params.Set("ostype", "win11")
+		}
+		params.Set("sata0", disk)
+		params.Set("net0", "e1000,bridge="+bridge)
+		params.Set("boot", "order=sata0")
+	default:
+		params.Set("ostype", "l26")
+		params.Set("scsihw", "virtio-scsi-single")
+		params.Set("scsi0", disk)
+		params.Set("net0", "virtio,bridge="+bridge)
+		params.Set("boot", "order=scsi0")
+	}
+	if p.Generation == 2 {
+		params.Set("bios", "ovmf")
+		params.Set("machine", "q35")
+		keys := "0"
+		if p.SecureBoot {
+			keys = "1"
+		}
+		params.Set("efidisk0", s.Datastore+":1,efitype=4m,pre-enrolled-keys="+keys)
+	}
+	if p.TPM {
+		params.Set("tpmstate0", s.Datastore+":1,version=v2.0")
+	}
+
+	job.setStatus("Creating Proxmox VM %s (%s) on %s from %s", vmid, name, s.Host, volume)
+	var upid string
+	if err := proxmoxRequest(job.ctx, s.URL, http.MethodPost, "/nodes/"+url.PathEscape(s.Host)+"/qemu", params, &upid); err != nil {
+		return "", fmt.Errorf("creating Proxmox VM for %s failed: %w", file, err)
+	}
+	if err := waitForProxmoxTask(job, s, upid, "creating VM "+vmid); err != nil {
+		return "", err
+	}
+	job.logf("Proxmox VM %s (%s) is ready on %s", vmid, name, s.Host)
+	return vmid, nil
+}
+
+// Delete an uploaded disk (node/volume); VMs created from it keep their copy
+func deleteProxmoxDisk(endpoint, dest string) error {
+	node, volume, ok := strings.Cut(dest, "/")
+	if !ok {
+		return fmt.Errorf("invalid Proxmox volume '%s'", dest)
+	}
+	storage, _, _ := strings.Cut(volume, ":")
+	endpointPath := "/nodes/" + url.PathEscape(node) + "/storage/" + url.PathEscape(storage) + "/content/" + url.PathEscape(volume)
+	return proxmoxRequest(context.Background(), endpoint, http.MethodDelete, endpointPath, nil, nil)
+}
+
+// List the importable disks on a node's storage
+func listProxmoxDisks(ctx context.Context, server, node, storage, prefix string) ([]DestinationObject, error) {
+	var content []struct {
+		VolID string `json:"volid"`
+		Size  int64  `json:"size"`
+		CTime int64  `json:"ctime"`
+	}
+	endpoint := "/nodes/" + url.PathEscape(node) + "/storage/" + url.PathEscape(storage) + "/content?content=import"
+	if err := proxmoxRequest(ctx, server, http.MethodGet, endpoint, nil, &content); err != nil {
+		return nil, err
+	}
+	var objects []DestinationObject
+	for _, c := range content {
+		_, name, _ := strings.Cut(c.VolID, ":import/")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		objects = append(objects, DestinationObject{Name: name, Size: c.Size,
+			LastModified: time.Unix(c.CTime, 0).UTC().Format(time.RFC3339)})
+	}
+	return objects, nil
+}
+
+// Confirm a Proxmox API is configured and accepts Porter's token
+func checkProxmoxCredentials(ctx context.Context) error {
+	server := os.Getenv("PROXMOX_URL")
+	if server == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "proxmox" && profile.URL != "" {
+				server = profile.URL
+				break
+			}
+		}
+	}
+	if server == "" {
+		return errors.New("no Proxmox API configured; set PROXMOX_URL or add a proxmox destination profile")
+	}
+	var version struct {
+		Version string `json:"version"`
+	}
+	return proxmoxRequest(ctx, server, http.MethodGet, "/version", nil, &version)
+}
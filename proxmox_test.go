@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestProxmoxToken(t *testing.T) {
+	saved := config.Destinations
+	defer func() { config.Destinations = saved }()
+	config.Destinations = map[string]DestinationProfile{
+		"pve1": {Cloud: "proxmox", URL: "https://pve1.example.com:8006", Token: "root@pam!porter=profile"},
+		"pve2": {Cloud: "proxmox", URL: "https://pve2.example.com:8006"},
+	}
+	t.Setenv("PROXMOX_URL", "https://pve3.example.com:8006")
+	t.Setenv("PROXMOX_TOKEN", "root@pam!porter=env")
+	tests := []struct {
+		url, want string
+	}{
+		{"https://pve1.example.com:8006", "root@pam!porter=profile"},
+		{"https://pve1.example.com:8006.evil.tld", ""},
+		{"https://pve1.example.com", ""},
+		{"https://pve2.example.com:8006", "root@pam!porter=env"},
+		{"https://pve3.example.com:8006/", "root@pam!porter=env"},
+		{"https://attacker.example.net:8006", ""},
+	}
+	for _, tt := range tests {
+		if got := proxmoxToken(tt.url); got != tt.want {
+			t.Errorf("proxmoxToken(%q) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Readiness reports: firmware, OS, driver, partition, size and encryption checks
+// of a disk against each target cloud, rolled up into ready / needs-fixes /
+// blocked so migration engineers get a go/no-go list for a wave.
+
+const (
+	readinessReady      = "ready"
+	readinessNeedsFixes = "needs-fixes"
+	readinessBlocked    = "blocked"
+)
+
+// Check outcomes, and the readiness each one caps a target at
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// What a cloud's image import accepts. Clouds without an entry (like local) only
+// get the checks that apply everywhere.
+type cloudRequirements struct {
+	// Largest OS disk the target boots from, for BIOS and UEFI images
+	MaxBIOSDiskBytes int64
+	MaxUEFIDiskBytes int64
+	// Whether UEFI images need extra steps to import (e.g. Azure generation 2)
+	UEFINote string
+	// Oldest Windows NT version (major*10+minor) the import supports
+	MinWindowsVersion int
+	// Whether Windows guests need virtio drivers to find their boot disk
+	NeedsVirtio bool
+	// How the target provides Windows storage and network drivers, when it does
+	WindowsDrivers string
+	// Guest architectures the target runs (see arch.go), and what to do about others
+	Architectures    []string
+	ArchitectureNote string
+}
+
+const tib = int64(1) << 40
+
+var cloudReadinessRequirements = map[string]cloudRequirements{
+	"aws": {
+		MaxBIOSDiskBytes:  16 * tib,
+		MaxUEFIDiskBytes:  16 * tib,
+		UEFINote:          "import with --boot-mode uefi",
+		MinWindowsVersion: 60,
+		WindowsDrivers:    "VM Import installs the AWS PV, ENA and NVMe drivers",
+		Architectures:     []string{archX86_64, archAArch64},
+	},
+	"azure": {
+		MaxBIOSDiskBytes:  2 * tib,
+		MaxUEFIDiskBytes:  4 * tib,
+		UEFINote:          "create the image as Hyper-V generation 2",
+		MinWindowsVersion: 61,
+		WindowsDrivers:    "Hyper-V storage and network drivers are built into Windows",
+		Architectures:     []string{archX86_64},
+		ArchitectureNote:  "Azure managed images are x64 only; upload to azuredisk for an Arm64 managed disk",
+	},
+	"azuredisk": {
+		MaxBIOSDiskBytes:  2 * tib,
+		MaxUEFIDiskBytes:  4 * tib,
+		UEFINote:          "create the disk as Hyper-V generation 2",
+		MinWindowsVersion: 61,
+		WindowsDrivers:    "Hyper-V storage and network drivers are built into Windows",
+		Architectures:     []string{archX86_64, archAArch64},
+	},
+	"gcp": {
+		MaxBIOSDiskBytes:  2 * tib,
+		MaxUEFIDiskBytes:  64 * tib,
+		UEFINote:          "create the image with --guest-os-features UEFI_COMPATIBLE",
+		MinWindowsVersion: 61,
+		NeedsVirtio:       true,
+		Architectures:     []string{archX86_64},
+		ArchitectureNote:  "gcloud compute images import only creates x86_64 images",
+	},
+	"ibm": {
+		MaxBIOSDiskBytes:  250 << 30,
+		MaxUEFIDiskBytes:  250 << 30,
+		MinWindowsVersion: 62,
+		NeedsVirtio:       true,
+		Architectures:     []string{archX86_64},
+	},
+	"alibaba": {
+		MaxBIOSDiskBytes:  2 * tib,
+		MaxUEFIDiskBytes:  2 * tib,
+		UEFINote:          "set the image's boot mode to UEFI after import",
+		MinWindowsVersion: 61,
+		NeedsVirtio:       true,
+		Architectures:     []string{archX86_64, archAArch64},
+	},
+	"linode": {
+		MaxBIOSDiskBytes: linodeMaxImageBytes,
+		MaxUEFIDiskBytes: linodeMaxImageBytes,
+		NeedsVirtio:      true,
+		Architectures:    []string{archX86_64},
+	},
+	"vultr": {
+		NeedsVirtio:   true,
+		Architectures: []string{archX86_64},
+	},
+}
+
+type ReadinessCheck struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// A disk's readiness for one target cloud
+type TargetReadiness struct {
+	Cloud  string           `json:"cloud"`
+	Status string           `json:"status"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// What inspection found in a disk, and its readiness for each target
+type DiskReadiness struct {
+	Disk           string            `json:"disk"`
+	Guest          *guestOS          `json:"guest,omitempty"`
+	Firmware       string            `json:"firmware,omitempty"`
+	Architecture   string            `json:"architecture,omitempty"`
+	PartitionTable string            `json:"partitionTable,omitempty"`
+	SizeBytes      int64             `json:"sizeBytes"`
+	Encrypted      []encryptedVolume `json:"encrypted,omitempty"`
+	Targets        []TargetReadiness `json:"targets"`
+}
+
+// The libguestfs format name for a disk image, from its extension
+func diskFormatForPath(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".vmdk":
+		return "vmdk"
+	case ".vhd":
+		return "vpc"
+	case ".vhdx":
+		return "vhdx"
+	case ".qcow2":
+		return "qcow2"
+	case ".raw", ".img":
+		return "raw"
+	}
+	return ""
+}
+
+// Inspect a disk and assess it for each cloud. Guest steps the job will run are
+// taken into account (inject-virtio fixes missing virtio drivers).
+func assessDisk(ctx context.Context, disk, format string, clouds, guestSteps []string) (DiskReadiness, error) {
+	report := DiskReadiness{Disk: disk}
+
+	entries, err := listFilesystems(ctx, disk, format)
+	if err != nil {
+		return report, err
+	}
+	report.Encrypted = encryptedVolumes(entries)
+	gpt := false
+	for _, e := range entries {
+		switch {
+		case e.Type == "device":
+			report.SizeBytes += e.Size
+		case e.Type == "partition" && e.MBR == "-":
+			gpt = true
+		}
+	}
+	if len(entries) > 0 {
+		report.PartitionTable = "mbr"
+		if gpt {
+			report.PartitionTable = "gpt"
+		}
+	}
+
+	guest, err := inspectGuestOS(ctx, disk, format)
+	switch {
+	case errors.Is(err, errNoGuestOS):
+	case err != nil && len(report.Encrypted) == 0:
+		return report, err
+	case err == nil:
+		report.Guest = &guest
+		// Windows only boots GPT disks through UEFI; Linux shows an EFI system partition
+		report.Firmware = "bios"
+		if guest.mounts("/boot/efi") || (guest.Name == "windows" && gpt) {
+			report.Firmware = "uefi"
+		}
+		report.Architecture = normalizeArch(guest.Arch)
+	}
+	if report.Architecture == "" {
+		report.Architecture = ovfArch(hardwareForDisk(disk).OSType)
+	}
+
+	for _, cloud := range clouds {
+		report.Targets = append(report.Targets, assessTarget(report, cloud, guestSteps))
+	}
+	return report, nil
+}
+
+func assessTarget(report DiskReadiness, cloud string, guestSteps []string) TargetReadiness {
+	req, known := cloudReadinessRequirements[cloud]
+	target := TargetReadiness{Cloud: cloud, Status: readinessReady}
+	add := func(check, status, reason string) {
+		target.Checks = append(target.Checks, ReadinessCheck{Check: check, Status: status, Reason: reason})
+		switch {
+		case status == checkFail:
+			target.Status = readinessBlocked
+		case status == checkWarn && target.Status == readinessReady:
+			target.Status = readinessNeedsFixes
+		}
+	}
+
+	if warning := describeEncryption(filepath.Base(report.Disk), report.Encrypted); warning != "" {
+		add("encryption", checkFail, warning)
+	} else {
+		add("encryption", checkPass, "no encrypted volumes")
+	}
+
+	guest := report.Guest
+	if guest == nil {
+		if len(report.Encrypted) > 0 {
+			add("os", checkFail, "operating system hidden by encryption")
+		} else {
+			add("os", checkPass, "no operating system (data disk)")
+		}
+	} else {
+		description := strings.TrimSpace(guest.ProductName)
+		if description == "" {
+			description = guest.Name
+		}
+		version := guest.MajorVersion*10 + guest.MinorVersion
+		switch {
+		case guest.Name != "linux" && guest.Name != "windows":
+			add("os", checkFail, fmt.Sprintf("%s guests are not supported by cloud image imports", guest.Name))
+		case guest.Name == "windows" && known && version < req.MinWindowsVersion:
+			add("os", checkFail, fmt.Sprintf("%s is older than %s supports", description, cloud))
+		default:
+			add("os", checkPass, description)
+		}
+
+		if guest.Name == "windows" {
+			switch {
+			case req.NeedsVirtio && hasGuestStep(guestSteps, "inject-virtio"):
+				add("drivers", checkPass, "virtio drivers are injected by the inject-virtio step")
+			case req.NeedsVirtio:
+				add("drivers", checkWarn, "Windows needs virtio storage drivers to boot here; add the inject-virtio guest step")
+			case req.WindowsDrivers != "":
+				add("drivers", checkPass, req.WindowsDrivers)
+			}
+		}
+
+		switch {
+		case report.Firmware == "uefi" && known && req.MaxUEFIDiskBytes == 0:
+			add("firmware", checkFail, "UEFI images cannot be imported; convert the guest to BIOS boot first")
+		case report.Firmware == "uefi" && req.UEFINote != "":
+			add("firmware", checkWarn, "UEFI boot: "+req.UEFINote)
+		default:
+			add("firmware", checkPass, strings.ToUpper(report.Firmware)+" boot")
+		}
+	}
+
+	if report.Architecture != "" && len(req.Architectures) > 0 {
+		if slices.Contains(req.Architectures, report.Architecture) {
+			add("architecture", checkPass, report.Architecture)
+		} else {
+			add("architecture", checkFail, archMismatch(filepath.Base(report.Disk), report.Architecture, cloud, req))
+		}
+	}
+
+	if report.PartitionTable == "mbr" && report.SizeBytes > 2*tib {
+		add("partitions", checkFail, "MBR partition tables cannot address more than 2 TiB; convert the disk to GPT")
+	} else if report.PartitionTable != "" {
+		add("partitions", checkPass, strings.ToUpper(report.PartitionTable)+" partition table")
+	}
+
+	if known && guest != nil {
+		limit := req.MaxBIOSDiskBytes
+		if report.Firmware == "uefi" {
+			limit = req.MaxUEFIDiskBytes
+		}
+		if limit > 0 && report.SizeBytes > limit {
+			add("size", checkFail, fmt.Sprintf("%.1f TiB OS disk exceeds the %.0f TiB %s limit; shrink it first",
+				float64(report.SizeBytes)/float64(tib), float64(limit)/float64(tib), cloud))
+		} else {
+			add("size", checkPass, fmt.Sprintf("%.2f GB", float64(report.SizeBytes)/(1<<30)))
+		}
+	}
+	return target
+}
+
+func hasGuestStep(steps []string, name string) bool {
+	for _, step := range steps {
+		if step == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Assess a pipeline job's disks for its cloud, warning about anything short of ready
+func checkJobReadiness(job *Job, disks []string, format string) {
+	if !checkBinary("virt-filesystems") || !checkBinary("virt-inspector") {
+		job.logf("Skipping readiness checks: libguestfs-tools is not installed")
+		return
+	}
+	for _, disk := range disks {
+		job.setStatus("Checking readiness of %s for %s", filepath.Base(disk), job.settings.Cloud)
+		report, err := assessDisk(job.ctx, disk, format, []string{job.settings.Cloud}, job.Spec.GuestSteps)
+		if err != nil {
+			job.logf("Could not check readiness of %s: %s", disk, err)
+			continue
+		}
+		job.mu.Lock()
+		job.Readiness = append(job.Readiness, report)
+		job.mu.Unlock()
+
+		target := report.Targets[0]
+		for _, check := range target.Checks {
+			if check.Status != checkPass {
+				job.warnf("%s is %s for %s: %s", filepath.Base(disk), target.Status, target.Cloud, check.Reason)
+			}
+		}
+	}
+}
+
+// Handler for /api/readiness?disk=...&cloud=...: readiness reports for one or more
+// disks (VMDKs or converted images) against the given clouds, or every provider
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	disks := query["disk"]
+	if len(disks) == 0 {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "No disks given", Remediation: "Pass one or more 'disk' query parameters with VMDK or image paths."})
+		return
+	}
+	clouds := query["cloud"]
+	if len(clouds) == 0 {
+		clouds = providerNames()
+	}
+	for _, cloud := range clouds {
+		if _, ok := findProvider(cloud); !ok {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Unknown cloud: %s"), cloud), Remediation: fmt.Sprintf(tr("Use one of %s."), strings.Join(providerNames(), ", "))})
+			return
+		}
+	}
+	if !checkBinary("virt-filesystems") || !checkBinary("virt-inspector") {
+		writeAPIError(w, http.StatusServiceUnavailable, APIError{Code: errCodeInternal,
+			Message:     "Readiness checks need virt-filesystems and virt-inspector, which are not installed",
+			Remediation: "Install libguestfs-tools in the Porter image."})
+		return
+	}
+
+	var reports []DiskReadiness
+	for _, disk := range disks {
+		format := diskFormatForPath(disk)
+		if format == "" {
+			writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Unrecognized disk format: %s"), disk), Remediation: "Pass a .vmdk, .raw, .img, .vhd, .vhdx or .qcow2 file."})
+			return
+		}
+		if _, err := os.Stat(disk); err != nil {
+			writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Disk not found: %s"), disk), Details: err.Error()})
+			return
+		}
+		report, err := assessDisk(r.Context(), disk, format, clouds, nil)
+		if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+				Message: fmt.Sprintf(tr("Could not inspect %s"), disk), Details: err.Error(),
+				Remediation: "Check that the disk is complete and readable."})
+			return
+		}
+		reports = append(reports, report)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"disks": reports})
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Transfer integrity reports: when a job finishes, Porter writes a record of what
+// it moved (sources, destinations, sizes, hashes and times) to the state
+// directory, signed with HMAC-SHA256 so it can be kept as evidence of the
+// migration and checked later for tampering. The signature covers the report's
+// compact JSON; the text form is a rendering of the same report and carries the
+// same signature.
+//
+// The key is reportSigningKey in porter.json, or PORTER_REPORT_KEY, or otherwise a
+// random key Porter generates once and keeps in the state directory. Reports name
+// the key by ID (the first 16 hex digits of its SHA-256) so an auditor holding
+// the key can tell which one signed them.
+
+var reportDir = filepath.Join(stateDir, "reports")
+
+type transferReport struct {
+	Version    int                `json:"version"`
+	JobID      string             `json:"jobId"`
+	Name       string             `json:"name,omitempty"`
+	Cloud      string             `json:"cloud"`
+	Profile    string             `json:"profile,omitempty"`
+	State      string             `json:"state"`
+	Host       string             `json:"host,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt"`
+	StartedAt  *time.Time         `json:"startedAt,omitempty"`
+	FinishedAt *time.Time         `json:"finishedAt,omitempty"`
+	Transfers  []transferRecord   `json:"transfers"`
+	Totals     transferReportSums `json:"totals"`
+	Warnings   []string           `json:"warnings,omitempty"`
+}
+
+type transferRecord struct {
+	Source      string            `json:"source"`
+	Destination string            `json:"destination,omitempty"`
+	Size        int64             `json:"size"`
+	Hashes      map[string]string `json:"hashes,omitempty"`
+	Verified    bool              `json:"verified"`
+	Image       string            `json:"image,omitempty"`
+	StartedAt   *time.Time        `json:"startedAt,omitempty"`
+	FinishedAt  *time.Time        `json:"finishedAt,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+type transferReportSums struct {
+	Files     int   `json:"files"`
+	Succeeded int   `json:"succeeded"`
+	Failed    int   `json:"failed"`
+	Bytes     int64 `json:"bytes"`
+}
+
+type reportSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"keyId"`
+	Value     string `json:"value"`
+}
+
+type signedTransferReport struct {
+	Report    transferReport  `json:"report"`
+	Signature reportSignature `json:"signature"`
+}
+
+// The HMAC key reports are signed with
+func reportSigningKey() ([]byte, error) {
+	if config.ReportSigningKey != "" {
+		return []byte(config.ReportSigningKey), nil
+	}
+	if key := os.Getenv("PORTER_REPORT_KEY"); key != "" {
+		return []byte(key), nil
+	}
+	path := filepath.Join(stateDir, "report-signing.key")
+	if data, err := os.ReadFile(path); err == nil && len(data) > 0 {
+		return []byte(strings.TrimSpace(string(data))), nil
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	key := hex.EncodeToString(b)
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("could not save the report signing key: %w", err)
+	}
+	fmt.Printf("Generated a report signing key in %s\n", path)
+	return []byte(key), nil
+}
+
+func reportKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func signReport(report transferReport, key []byte) (reportSignature, error) {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return reportSignature{}, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return reportSignature{Algorithm: "HMAC-SHA256", KeyID: reportKeyID(key), Value: hex.EncodeToString(mac.Sum(nil))}, nil
+}
+
+// Build the report of a finished job
+func buildTransferReport(job *Job) transferReport {
+	snap := job.snapshot()
+	host, _ := os.Hostname()
+	report := transferReport{
+		Version:    1,
+		JobID:      snap.ID,
+		Name:       snap.Spec.Name,
+		Cloud:      snap.Spec.Cloud,
+		Profile:    snap.Spec.Profile,
+		State:      snap.State,
+		Host:       host,
+		CreatedAt:  snap.CreatedAt,
+		StartedAt:  snap.StartedAt,
+		FinishedAt: snap.FinishedAt,
+		Transfers:  []transferRecord{},
+		Warnings:   snap.Warnings,
+	}
+	for _, r := range snap.Results {
+		record := transferRecord{
+			Source:      r.File,
+			Destination: r.Destination,
+			Size:        r.Size,
+			Verified:    r.Verified,
+			Image:       r.Image,
+			StartedAt:   r.StartedAt,
+			FinishedAt:  r.FinishedAt,
+			Error:       r.Error,
+		}
+		if len(r.Checksums) > 0 || r.Checksum != "" {
+			record.Hashes = map[string]string{}
+			for algorithm, sum := range r.Checksums {
+				record.Hashes[algorithm] = sum
+			}
+			// Local copies and bundles record the SHA-256 they verified
+			if r.Checksum != "" {
+				record.Hashes["sha256"] = r.Checksum
+			}
+		}
+		report.Transfers = append(report.Transfers, record)
+		report.Totals.Files++
+		if r.Error == "" {
+			report.Totals.Succeeded++
+			report.Totals.Bytes += r.Size
+		} else {
+			report.Totals.Failed++
+		}
+	}
+	return report
+}
+
+// Sign and save the report of a job that has just finished
+func saveTransferReport(job *Job) {
+	if !job.finished() {
+		return
+	}
+	key, err := reportSigningKey()
+	if err != nil {
+		job.warnf("No transfer report written: %s", err)
+		return
+	}
+	report := buildTransferReport(job)
+	signature, err := signReport(report, key)
+	if err == nil {
+		var data []byte
+		data, _ = json.MarshalIndent(signedTransferReport{Report: report, Signature: signature}, "", "  ")
+		if err = os.MkdirAll(reportDir, 0755); err == nil {
+			err = os.WriteFile(filepath.Join(reportDir, job.ID+".json"), data, 0644)
+		}
+	}
+	if err != nil {
+		job.warnf("Could not save the transfer report: %s", err)
+		return
+	}
+	job.logf("Signed transfer report written (key %s)", signature.KeyID)
+}
+
+func loadTransferReport(id string) (signedTransferReport, error) {
+	var signed signedTransferReport
+	if !filepath.IsLocal(id) || strings.ContainsAny(id, `/\`) {
+		return signed, os.ErrNotExist
+	}
+	data, err := os.ReadFile(filepath.Join(reportDir, id+".json"))
+	if err != nil {
+		return signed, err
+	}
+	return signed, json.Unmarshal(data, &signed)
+}
+
+// Render a report as plain text for printing or attaching to a change record
+func transferReportText(signed signedTransferReport) string {
+	r := signed.Report
+	var b strings.Builder
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return "-"
+		}
+		return t.UTC().Format(time.RFC3339)
+	}
+	fmt.Fprintf(&b, "PORTER TRANSFER INTEGRITY REPORT\n")
+	fmt.Fprintf(&b, "================================\n\n")
+	fmt.Fprintf(&b, "Job:          %s\n", r.JobID)
+	if r.Name != "" {
+		fmt.Fprintf(&b, "Name:         %s\n", r.Name)
+	}
+	fmt.Fprintf(&b, "Destination:  %s", r.Cloud)
+	if r.Profile != "" {
+		fmt.Fprintf(&b, " (profile %s)", r.Profile)
+	}
+	fmt.Fprintf(&b, "\nState:        %s\n", r.State)
+	fmt.Fprintf(&b, "Host:         %s\n", r.Host)
+	fmt.Fprintf(&b, "Created:      %s\n", r.CreatedAt.UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Started:      %s\n", formatTime(r.StartedAt))
+	fmt.Fprintf(&b, "Finished:     %s\n", formatTime(r.FinishedAt))
+	fmt.Fprintf(&b, "Totals:       %d file(s), %d succeeded, %d failed, %d bytes transferred\n",
+		r.Totals.Files, r.Totals.Succeeded, r.Totals.Failed, r.Totals.Bytes)
+
+	for i, t := range r.Transfers {
+		fmt.Fprintf(&b, "\n[%d] %s\n", i+1, t.Source)
+		if t.Error != "" {
+			fmt.Fprintf(&b, "    FAILED:      %s\n", t.Error)
+		} else {
+			fmt.Fprintf(&b, "    Destination: %s\n", t.Destination)
+		}
+		fmt.Fprintf(&b, "    Size:        %d bytes\n", t.Size)
+		if t.Image != "" {
+			fmt.Fprintf(&b, "    Image:       %s\n", t.Image)
+		}
+		fmt.Fprintf(&b, "    Started:     %s\n", formatTime(t.StartedAt))
+		fmt.Fprintf(&b, "    Finished:    %s\n", formatTime(t.FinishedAt))
+		if len(t.Hashes) == 0 {
+			fmt.Fprintf(&b, "    Hashes:      not recorded (request checksums for the job)\n")
+		}
+		algorithms := make([]string, 0, len(t.Hashes))
+		for algorithm := range t.Hashes {
+			algorithms = append(algorithms, algorithm)
+		}
+		sort.Strings(algorithms)
+		for _, algorithm := range algorithms {
+			fmt.Fprintf(&b, "    %-12s %s\n", strings.ToUpper(algorithm)+":", t.Hashes[algorithm])
+		}
+		if t.Verified {
+			fmt.Fprintf(&b, "    Verified:    copy checked against the source\n")
+		}
+	}
+	for _, w := range r.Warnings {
+		fmt.Fprintf(&b, "\nWarning: %s", w)
+	}
+	if len(r.Warnings) > 0 {
+		b.WriteString("\n")
+	}
+
+	fmt.Fprintf(&b, "\nSignature\n---------\n")
+	fmt.Fprintf(&b, "Algorithm:    %s\n", signed.Signature.Algorithm)
+	fmt.Fprintf(&b, "Key ID:       %s\n", signed.Signature.KeyID)
+	fmt.Fprintf(&b, "Value:        %s\n", signed.Signature.Value)
+	fmt.Fprintf(&b, "The signature covers the JSON form of this report (GET /api/jobs/%s/report);\n", r.JobID)
+	fmt.Fprintf(&b, "check it with POST /api/reports/verify.\n")
+	return b.String()
+}
+
+// Handler for GET /api/jobs/{id}/report: download a finished job's signed transfer
+// report as JSON, or as text with ?format=text
+func jobReportHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if job, ok := jobs.get(id); ok && !job.finished() {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message: fmt.Sprintf(tr("Job has not finished: %s"), id), Remediation: "Download the report once the job completes, fails or is cancelled."})
+		return
+	}
+	signed, err := loadTransferReport(id)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("No transfer report for job: %s"), id)})
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "text", "txt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"porter-report-%s.txt\"", id))
+		fmt.Fprint(w, transferReportText(signed))
+	case "", "json":
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"porter-report-%s.json\"", id))
+		writeJSON(w, http.StatusOK, signed)
+	default:
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Unsupported report format: %s"), r.URL.Query().Get("format")), Remediation: "Use format=json or format=text."})
+	}
+}
+
+// Handler for POST /api/reports/verify: check the signature of a JSON report
+// against this instance's key
+func reportVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	var signed signedTransferReport
+	if err := json.NewDecoder(r.Body).Decode(&signed); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "Invalid report", Details: err.Error(), Remediation: "Send the JSON report as downloaded from /api/jobs/{id}/report."})
+		return
+	}
+	key, err := reportSigningKey()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+			Message: "No report signing key", Details: err.Error()})
+		return
+	}
+	expected, err := signReport(signed.Report, key)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+			Message: "Failed to sign report", Details: err.Error()})
+		return
+	}
+	result := map[string]interface{}{"valid": false, "keyId": expected.KeyID, "jobId": signed.Report.JobID}
+	switch {
+	case signed.Signature.KeyID != expected.KeyID:
+		result["reason"] = "signed with a different key (" + signed.Signature.KeyID + ")"
+	case !hmac.Equal([]byte(signed.Signature.Value), []byte(expected.Value)):
+		result["reason"] = "signature does not match: the report was modified"
+	default:
+		result["valid"] = true
+	}
+	writeJSON(w, http.StatusOK, result)
+}
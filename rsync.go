@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rsync over SSH to a remote (typically KVM) host. rsync updates an existing copy
+// in place and only sends the blocks that changed, so re-uploading a revised
+// conversion of the same disk is much faster than the first transfer; --fuzzy
+// also lets a renamed image use a similar file already in the folder as its basis.
+// Authenticates with the SSH keys in ~/.ssh.
+//
+// Interrupted transfers resume rather than restart: a transfer that drops is
+// retried up to rsyncAttempts times, and an attempt (or a later job) that finds
+// an unfinished copy on the host appends to it with --append-verify, which
+// checks the whole file once done. rsync only sets the copy's modification time
+// when it completes, so a smaller copy with a different time is unfinished.
+
+const (
+	rsyncAttempts = 5
+	// Seconds without data before rsync gives up on a connection
+	rsyncIOTimeout = 300
+)
+
+// rsync exit statuses for a dropped or stalled connection, worth retrying
+var rsyncRetryable = map[int]bool{10: true, 12: true, 30: true, 35: true, 255: true}
+
+// Split user@host[:port] into the SSH destination and port
+func splitSSHHost(host string) (string, string) {
+	if i := strings.LastIndex(host, ":"); i > strings.LastIndex(host, "]") {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// The ssh command (and options) rsync and Porter use to reach a host
+func sshArgs(port string) []string {
+	args := []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=accept-new"}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	return args
+}
+
+// Quote a string for the remote shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Copy one file to a folder on a remote host with rsync, returning the
+// ssh://user@host[:port]/path URL it was written to
+func uploadToRsync(job *Job, s uploadSettings, file string) (string, error) {
+	userHost, port := splitSSHHost(s.Host)
+	dir := strings.TrimRight(s.Target, "/")
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Syncing %s to %s:%s (%.2f MB, only changed blocks are sent)",
+		filepath.Base(file), userHost, dir, float64(info.Size())/(1024*1024))
+
+	ssh := sshArgs(port)
+	mkdir := toolCommand(job.ctx, ssh[0], append(ssh[1:], userHost, "mkdir -p -- "+shellQuote(dir))...)
+	if out, err := mkdir.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("creating %s on %s failed: %w: %s", dir, userHost, err, strings.TrimSpace(string(out)))
+	}
+
+	remote := path.Join(dir, filepath.Base(file))
+	for attempt := 1; ; attempt++ {
+		args := []string{"--times", "--inplace", "--partial", "--no-whole-file", "--fuzzy", "--protect-args", "--stats",
+			fmt.Sprintf("--timeout=%d", rsyncIOTimeout)}
+		if size, modTime, ok := rsyncRemoteFile(job.ctx, port, userHost, remote); ok && size < info.Size() && modTime != info.ModTime().Unix() {
+			job.logf("Resuming %s at %.2f of %.2f GB", filepath.Base(file), float64(size)/(1<<30), float64(info.Size())/(1<<30))
+			args = append(args, "--append-verify")
+		}
+		cmd := toolCommand(job.ctx, "rsync", append(args, "-e", strings.Join(ssh, " "), file, userHost+":"+dir+"/")...)
+		err = runJobCommand(job, cmd)
+		var exitErr *exec.ExitError
+		if err == nil || job.ctx.Err() != nil || attempt == rsyncAttempts ||
+			!errors.As(err, &exitErr) || !rsyncRetryable[exitErr.ExitCode()] {
+			break
+		}
+		job.logf("rsync of %s interrupted (%s); resuming (attempt %d of %d)", filepath.Base(file), err, attempt+1, rsyncAttempts)
+	}
+	if err != nil {
+		return "", fmt.Errorf("rsync to %s failed for %s: %w", userHost, file, err)
+	}
+
+	dest := url.URL{Scheme: "ssh", Host: userHost, Path: path.Join("/", dir, filepath.Base(file))}
+	if user, hostname, ok := strings.Cut(userHost, "@"); ok {
+		dest.User, dest.Host = url.User(user), hostname
+	}
+	if port != "" {
+		dest.Host += ":" + port
+	}
+	if !path.IsAbs(dir) {
+		// Relative folders are under the remote user's home directory
+		dest.Path = "/~" + dest.Path
+	}
+	return dest.String(), nil
+}
+
+// The size and modification time (Unix seconds) of a file on a remote host, if it exists
+func rsyncRemoteFile(ctx context.Context, port, userHost, file string) (int64, int64, bool) {
+	ssh := sshArgs(port)
+	out, err := toolCommand(ctx, ssh[0], append(ssh[1:], userHost, "stat -c '%s %Y' -- "+shellQuote(file))...).Output()
+	if err != nil {
+		return 0, 0, false
+	}
+	var size, modTime int64
+	if _, err := fmt.Sscan(string(out), &size, &modTime); err != nil {
+		return 0, 0, false
+	}
+	return size, modTime, true
+}
+
+// Split an ssh://user@host[:port]/path URL written by uploadToRsync
+func parseSSHURL(rawURL string) (userHost, port, file string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "ssh" || u.Host == "" {
+		return "", "", "", fmt.Errorf("invalid SSH URL '%s'", rawURL)
+	}
+	userHost = u.Hostname()
+	if u.User != nil {
+		userHost = u.User.Username() + "@" + userHost
+	}
+	file = u.Path
+	if strings.HasPrefix(file, "/~/") {
+		file = strings.TrimPrefix(file, "/~/")
+	}
+	return userHost, u.Port(), file, nil
+}
+
+func deleteRsyncFile(rawURL string) error {
+	userHost, port, file, err := parseSSHURL(rawURL)
+	if err != nil {
+		return err
+	}
+	ssh := sshArgs(port)
+	out, err := toolCommand(context.Background(), ssh[0], append(ssh[1:], userHost, "rm -f -- "+shellQuote(file))...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// List the files in a folder on a remote host: size, modification time and name per line
+func listRsyncObjects(ctx context.Context, host, dir string) ([]DestinationObject, error) {
+	userHost, port := splitSSHHost(host)
+	ssh := sshArgs(port)
+	out, err := toolCommand(ctx, ssh[0], append(ssh[1:], userHost,
+		"find "+shellQuote(dir)+" -maxdepth 1 -type f -printf '%s %TY-%Tm-%TdT%TH:%TM:%TS %f\\n'")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing %s on %s failed: %w", dir, userHost, err)
+	}
+	var objects []DestinationObject
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		var size int64
+		fmt.Sscan(fields[0], &size)
+		objects = append(objects, DestinationObject{Name: fields[2], Size: size, LastModified: fields[1]})
+	}
+	return objects, nil
+}
+
+func checkRsyncCredentials(ctx context.Context) error {
+	entries, err := filepath.Glob(filepath.Join(os.Getenv("HOME"), ".ssh", "id_*"))
+	if err != nil || len(entries) == 0 {
+		return errors.New("no SSH keys found in ~/.ssh; mount the keys authorized on the remote host")
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// S3-compatible services (MinIO, Wasabi, Ceph RGW) as the AWS target: the aws CLI
+// is pointed at the endpoint URL with --endpoint-url. Keys for the endpoint come
+// from an aws destination profile whose url matches it (username = access key,
+// password = secret key), otherwise from the usual AWS credential chain.
+//
+// The CLI has no flag or variable for path-style addressing
+// (https://endpoint/bucket/key rather than https://bucket.endpoint/key), which
+// most self-hosted services need, so it is set in a config file Porter writes and
+// passes as AWS_CONFIG_FILE. That file replaces ~/.aws/config for the command;
+// credentials still come from ~/.aws/credentials, the environment or the profile.
+
+// Where an S3 upload went, when it was not the CLI's default AWS endpoint and region
+type s3Endpoint struct {
+	URL       string `json:"url,omitempty"`
+	Region    string `json:"region,omitempty"`
+	PathStyle bool   `json:"pathStyle,omitempty"`
+	// A job's temporary credentials, used instead of Porter's own
+	session *awsSession
+}
+
+// The endpoint of an upload's settings, nil for the CLI's defaults
+func (s uploadSettings) s3Endpoint() *s3Endpoint {
+	if s.URL == "" && s.Region == "" && !s.PathStyle && s.AWSSession == nil {
+		return nil
+	}
+	return &s3Endpoint{URL: s.URL, Region: s.Region, PathStyle: s.PathStyle, session: s.AWSSession}
+}
+
+// Check an endpoint URL is an absolute http(s) URL
+func validateS3EndpointURL(rawURL string) *APIError {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message:     fmt.Sprintf(tr("Invalid S3 endpoint URL: %s"), rawURL),
+			Remediation: "Use the service's S3 API URL, e.g. https://s3.eu-central-1.wasabisys.com or http://minio.local:9000."}
+	}
+	return nil
+}
+
+// An aws CLI command against the endpoint (nil for AWS itself)
+func (e *s3Endpoint) command(ctx context.Context, args ...string) *exec.Cmd {
+	if e == nil {
+		return toolCommand(ctx, "aws", args...)
+	}
+	if e.URL != "" {
+		args = append(args, "--endpoint-url", e.URL)
+	}
+	if e.Region != "" {
+		args = append(args, "--region", e.Region)
+	}
+	cmd := toolCommand(ctx, "aws", args...)
+	if e.session != nil {
+		setToolEnv(cmd, "AWS_ACCESS_KEY_ID="+e.session.AccessKeyID, "AWS_SECRET_ACCESS_KEY="+e.session.SecretAccessKey,
+			"AWS_SESSION_TOKEN="+e.session.SessionToken)
+	} else if e.URL != "" {
+		if accessKey, secretKey, ok := s3Credentials(e.URL); ok {
+			setToolEnv(cmd, "AWS_ACCESS_KEY_ID="+accessKey, "AWS_SECRET_ACCESS_KEY="+secretKey)
+		}
+	}
+	if e.PathStyle {
+		configFile, err := pathStyleAWSConfig()
+		if err != nil {
+			fmt.Printf("Warning: could not write the path-style AWS config: %s\n", err)
+		} else {
+			setToolEnv(cmd, "AWS_CONFIG_FILE="+configFile)
+		}
+	}
+	return cmd
+}
+
+// Keys for an S3-compatible endpoint: an aws profile with its url, or Spaces or B2 keys
+func s3Credentials(endpointURL string) (string, string, bool) {
+	if accessKey, secretKey, ok := profileCredentials("aws", endpointURL); ok {
+		return accessKey, secretKey, true
+	}
+	if accessKey, secretKey, ok := spacesCredentials(endpointURL); ok {
+		return accessKey, secretKey, true
+	}
+	return b2S3Credentials(endpointURL)
+}
+
+// Write the AWS config that turns on path-style addressing, for the default
+// profile and AWS_PROFILE
+func pathStyleAWSConfig() (string, error) {
+	sections := []string{"default"}
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" && profile != "default" {
+		sections = append(sections, "profile "+profile)
+	}
+	var config strings.Builder
+	for _, section := range sections {
+		fmt.Fprintf(&config, "[%s]\ns3 =\n    addressing_style = path\n\n", section)
+	}
+	path := filepath.Join(stateDir, "aws-path-style.config")
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return "", err
+	}
+	return path, os.WriteFile(path, []byte(config.String()), 0644)
+}
+
+// The circuit breaker for calls to the endpoint, so a broken S3-compatible
+// service doesn't make AWS itself unavailable
+func (e *s3Endpoint) breakerName() string {
+	if e == nil || e.URL == "" {
+		return "aws"
+	}
+	return "s3 " + e.URL
+}
+
+// The endpoint recorded for a catalog entry
+func (entry CatalogEntry) s3Endpoint() *s3Endpoint {
+	if entry.Endpoint == "" && entry.Region == "" && !entry.PathStyle {
+		return nil
+	}
+	return &s3Endpoint{URL: entry.Endpoint, Region: entry.Region, PathStyle: entry.PathStyle}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A recurring daily period, e.g. {"start": "22:00", "end": "06:00", "days": ["mon", "tue"]}.
+// Windows whose end is before their start span midnight; days refers to the day the window starts.
+type TimeWindow struct {
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Days  []string `json:"days,omitempty"`
+}
+
+// Parse "HH:MM" into minutes after midnight
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w TimeWindow) validate() error {
+	if _, err := parseClock(w.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(w.End); err != nil {
+		return err
+	}
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("invalid day '%s', expected mon..sun", day)
+		}
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (w TimeWindow) onDay(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether t falls inside the window
+func (w TimeWindow) contains(t time.Time) bool {
+	start, err1 := parseClock(w.Start)
+	end, err2 := parseClock(w.End)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+
+	if start <= end {
+		return w.onDay(t.Weekday()) && now >= start && now < end
+	}
+	// Spans midnight: the late part belongs to today, the early part to yesterday's window
+	if now >= start {
+		return w.onDay(t.Weekday())
+	}
+	return now < end && w.onDay(t.AddDate(0, 0, -1).Weekday())
+}
+
+// The configured schedule time zone (defaults to the server's local time)
+func scheduleLocation() *time.Location {
+	if config.ScheduleTimezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(config.ScheduleTimezone)
+	if err != nil {
+		fmt.Printf("Warning: invalid scheduleTimezone '%s': %s (using local time)\n", config.ScheduleTimezone, err)
+		return time.Local
+	}
+	return loc
+}
+
+// Whether upload jobs may transfer at time t: inside a transfer window (if any are
+// configured) and outside every blackout period
+func transfersAllowed(t time.Time) bool {
+	t = t.In(scheduleLocation())
+	for _, blackout := range config.BlackoutPeriods {
+		if blackout.contains(t) {
+			return false
+		}
+	}
+	if len(config.TransferWindows) == 0 {
+		return true
+	}
+	for _, window := range config.TransferWindows {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Human-readable description of the transfer schedule for status messages
+func describeSchedule() string {
+	var parts []string
+	for _, w := range config.TransferWindows {
+		parts = append(parts, describeWindow(w))
+	}
+	desc := "any time"
+	if len(parts) > 0 {
+		desc = strings.Join(parts, ", ")
+	}
+	if len(config.BlackoutPeriods) > 0 {
+		var blackouts []string
+		for _, w := range config.BlackoutPeriods {
+			blackouts = append(blackouts, describeWindow(w))
+		}
+		desc += " except " + strings.Join(blackouts, ", ")
+	}
+	return desc
+}
+
+func describeWindow(w TimeWindow) string {
+	desc := w.Start + "–" + w.End
+	if len(w.Days) > 0 {
+		desc += " (" + strings.Join(w.Days, ",") + ")"
+	}
+	return desc
+}
+
+// Re-evaluate the queue every minute so jobs start when a window opens, and
+// optionally pause running jobs while transfers are not allowed
+func runScheduler() {
+	if len(config.TransferWindows) == 0 && len(config.BlackoutPeriods) == 0 {
+		return
+	}
+	fmt.Printf("Transfer schedule: %s (%s)\n", describeSchedule(), scheduleLocation())
+
+	for {
+		allowed := transfersAllowed(time.Now())
+		if config.PauseOutsideWindow {
+			jobs.applySchedulePause(!allowed)
+		}
+		jobs.schedule()
+		time.Sleep(time.Minute)
+	}
+}
+
+// Pause running jobs when the window closes and resume the ones the scheduler paused when it reopens
+func (m *jobManager) applySchedulePause(pause bool) {
+	m.Lock()
+	var all []*Job
+	all = append(all, m.order...)
+	m.Unlock()
+
+	for _, job := range all {
+		if job.Spec.IgnoreWindow {
+			continue
+		}
+		job.mu.Lock()
+		state, byScheduler := job.State, job.pausedBySchedule
+		job.mu.Unlock()
+
+		if pause && state == jobRunning {
+			if job.pause() == nil {
+				job.mu.Lock()
+				job.pausedBySchedule = true
+				job.mu.Unlock()
+				job.logf("Paused: outside the transfer window (%s)", describeSchedule())
+			}
+		} else if !pause && state == jobPaused && byScheduler {
+			job.mu.Lock()
+			job.pausedBySchedule = false
+			job.mu.Unlock()
+			job.resume()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindowValidate(t *testing.T) {
+	tests := []struct {
+		window TimeWindow
+		ok     bool
+	}{
+		{TimeWindow{Start: "22:00", End: "06:00"}, true},
+		{TimeWindow{Start: "09:00", End: "17:30", Days: []string{"mon", "Fri"}}, true},
+		{TimeWindow{Start: "24:00", End: "06:00"}, false},
+		{TimeWindow{Start: "22:00", End: "6"}, false},
+		{TimeWindow{Start: "", End: "06:00"}, false},
+		{TimeWindow{Start: "22:00", End: "06:00", Days: []string{"monday"}}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.window.validate(); (err == nil) != tt.ok {
+			t.Errorf("%+v.validate() = %v, want ok %v", tt.window, err, tt.ok)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	// 2026-10-12 is a Monday
+	at := func(day int, clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2026, 10, day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+	office := TimeWindow{Start: "09:00", End: "17:00", Days: []string{"mon", "tue", "wed", "thu", "fri"}}
+	nights := TimeWindow{Start: "22:00", End: "06:00", Days: []string{"fri"}}
+	tests := []struct {
+		window TimeWindow
+		at     time.Time
+		want   bool
+	}{
+		{office, at(12, "09:00"), true},
+		{office, at(12, "16:59"), true},
+		{office, at(12, "17:00"), false},
+		{office, at(12, "08:59"), false},
+		{office, at(17, "12:00"), false},
+		{TimeWindow{Start: "09:00", End: "17:00"}, at(18, "12:00"), true},
+		// Friday night's window runs into Saturday morning, and Thursday's doesn't exist
+		{nights, at(16, "23:00"), true},
+		{nights, at(17, "05:59"), true},
+		{nights, at(17, "06:00"), false},
+		{nights, at(16, "05:00"), false},
+		{nights, at(17, "23:00"), false},
+		{TimeWindow{Start: "bad", End: "06:00"}, at(12, "01:00"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.window.contains(tt.at); got != tt.want {
+			t.Errorf("%+v.contains(%s) = %v, want %v", tt.window, tt.at.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestTransfersAllowed(t *testing.T) {
+	saved := *config
+	defer func() { *config = saved }()
+	config.ScheduleTimezone = "UTC"
+	config.TransferWindows = []TimeWindow{{Start: "20:00", End: "07:00"}}
+	config.BlackoutPeriods = []TimeWindow{{Start: "00:00", End: "02:00", Days: []string{"sun"}}}
+	tests := []struct {
+		at   time.Time
+		want bool
+	}{
+		{time.Date(2026, 10, 14, 21, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, 10, 18, 1, 0, 0, 0, time.UTC), false},
+		{time.Date(2026, 10, 18, 3, 0, 0, 0, time.UTC), true},
+	}
+	for _, tt := range tests {
+		if got := transfersAllowed(tt.at); got != tt.want {
+			t.Errorf("transfersAllowed(%s) = %v, want %v", tt.at.Format(time.RFC3339), got, tt.want)
+		}
+	}
+}
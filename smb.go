@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SMB/CIFS shares (such as a Hyper-V host's VM share), through smbclient. Shares
+// are smb://host[:port]/share, or \\host\share. Credentials are entered with
+// the upload, or come from the smb destination profile whose url the share is
+// under, or SMB_USERNAME and SMB_PASSWORD; a user name of DOMAIN\user sets the
+// domain. Without any, the share is accessed as a guest. smbclient reads them
+// from an authentication file, and its commands from stdin, so neither shows up
+// in the process list.
+
+type smbCredentials struct {
+	Username string
+	Password string
+}
+
+// Credentials entered for a share win over the profile's and the environment's
+func resolveSMBCredentials(share string, entered smbCredentials) smbCredentials {
+	if entered.Username != "" {
+		return entered
+	}
+	if user, pass, ok := profileCredentials("smb", share); ok {
+		return smbCredentials{user, pass}
+	}
+	return smbCredentials{os.Getenv("SMB_USERNAME"), os.Getenv("SMB_PASSWORD")}
+}
+
+// A parsed share URL: the //host/share service, port and the path under the share
+type smbShare struct {
+	Service string
+	Port    string
+	Path    string
+}
+
+// Parse smb://host[:port]/share[/path] or \\host\share[\path]
+func parseSMBURL(rawURL string) (smbShare, error) {
+	if strings.HasPrefix(rawURL, `\\`) {
+		rawURL = "smb:" + strings.ReplaceAll(rawURL, `\`, "/")
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "smb" || u.Hostname() == "" {
+		return smbShare{}, fmt.Errorf("invalid SMB share '%s'", rawURL)
+	}
+	share, rest, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if share == "" {
+		return smbShare{}, fmt.Errorf("SMB URL '%s' has no share name", rawURL)
+	}
+	return smbShare{Service: "//" + u.Hostname() + "/" + share, Port: u.Port(), Path: strings.Trim(rest, "/")}, nil
+}
+
+// The smb:// URL of a file under a share
+func (s smbShare) fileURL(p string) string {
+	host, share, _ := strings.Cut(strings.TrimPrefix(s.Service, "//"), "/")
+	if s.Port != "" {
+		host += ":" + s.Port
+	}
+	return (&url.URL{Scheme: "smb", Host: host, Path: path.Join("/", share, p)}).String()
+}
+
+// Quote a path for an smbclient command, with Windows separators
+func smbQuote(p string) string {
+	return `"` + strings.ReplaceAll(p, "/", `\`) + `"`
+}
+
+// An smbclient command running commands against a share; the returned
+// function removes its authentication file
+func smbCommand(ctx context.Context, share smbShare, creds smbCredentials, commands []string) (*exec.Cmd, func(), error) {
+	cleanup := func() {}
+	args := []string{share.Service}
+	if share.Port != "" {
+		args = append(args, "--port", share.Port)
+	}
+	if creds.Username == "" {
+		args = append(args, "--no-pass")
+	} else {
+		f, err := os.CreateTemp("", "porter-smb-*.auth")
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.Remove(f.Name()) }
+		user, domain := creds.Username, ""
+		if d, u, ok := strings.Cut(user, `\`); ok {
+			domain, user = d, u
+		}
+		_, err = fmt.Fprintf(f, "username = %s\npassword = %s\n", user, creds.Password)
+		if err == nil && domain != "" {
+			_, err = fmt.Fprintf(f, "domain = %s\n", domain)
+		}
+		f.Close()
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		args = append(args, "--authentication-file", f.Name())
+	}
+	cmd := toolCommand(ctx, "smbclient", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(commands, "\n") + "\n")
+	return cmd, cleanup, nil
+}
+
+// smbclient reports some failed commands only in its output
+var smbErrorPattern = regexp.MustCompile(`NT_STATUS_[A-Z_]+`)
+
+// Run smbclient commands against a share, returning the output
+func runSMBClient(ctx context.Context, share smbShare, creds smbCredentials, commands []string) ([]byte, error) {
+	cmd, cleanup, err := smbCommand(ctx, share, creds, commands)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return out, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// Upload one file into a folder on a share, returning its smb:// URL
+func uploadToSMB(job *Job, s uploadSettings, file string) (string, error) {
+	share, err := parseSMBURL(s.URL)
+	if err != nil {
+		return "", err
+	}
+	dir := strings.Trim(path.Join(share.Path, s.Target), "/")
+	name := filepath.Base(file)
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Copying %s to %s\\%s (%.2f MB)", name,
+		strings.ReplaceAll(share.Service, "/", `\`), strings.ReplaceAll(dir, "/", `\`), float64(info.Size())/(1024*1024))
+
+	creds := resolveSMBCredentials(s.URL, smbCredentials{s.Username, s.Password})
+
+	// Create each folder along the way; mkdir fails harmlessly on existing ones
+	var mkdirs []string
+	current := ""
+	for _, segment := range strings.Split(dir, "/") {
+		if segment != "" {
+			current = path.Join(current, segment)
+			mkdirs = append(mkdirs, "mkdir "+smbQuote(current))
+		}
+	}
+	if len(mkdirs) > 0 {
+		if out, err := runSMBClient(job.ctx, share, creds, mkdirs); err != nil {
+			return "", fmt.Errorf("connecting to %s failed: %w", share.Service, err)
+		} else if status := smbErrorPattern.Find(out); status != nil && string(status) != "NT_STATUS_OBJECT_NAME_COLLISION" {
+			return "", fmt.Errorf("creating %s on %s failed: %s", dir, share.Service, status)
+		}
+	}
+
+	put := "put " + smbQuote(file) + " " + smbQuote(path.Join(dir, name))
+	cmd, cleanup, err := smbCommand(job.ctx, share, creds, []string{put})
+	if err != nil {
+		return "", err
+	}
+	err = runJobCommand(job, cmd)
+	cleanup()
+	if err != nil {
+		return "", fmt.Errorf("SMB copy failed for %s: %w", file, err)
+	}
+	// smbclient doesn't always fail on a failed put, so check what arrived
+	files, _, err := listSMBFolder(job.ctx, share, creds, dir)
+	if err != nil {
+		return "", fmt.Errorf("checking the copy of %s failed: %w", file, err)
+	}
+	for _, f := range files {
+		if f.Name == path.Join(dir, name) && f.Size == info.Size() {
+			return share.fileURL(path.Join(dir, name)), nil
+		}
+	}
+	return "", fmt.Errorf("SMB copy of %s is missing or incomplete on %s; see the job log", file, share.Service)
+}
+
+func deleteSMBFile(rawURL string) error {
+	share, err := parseSMBURL(rawURL)
+	if err != nil {
+		return err
+	}
+	out, err := runSMBClient(context.Background(), share, resolveSMBCredentials(rawURL, smbCredentials{}),
+		[]string{"del " + smbQuote(share.Path)})
+	if err != nil {
+		return err
+	}
+	if status := smbErrorPattern.Find(out); status != nil && string(status) != "NT_STATUS_NO_SUCH_FILE" {
+		return fmt.Errorf("deleting %s failed: %s", share.Path, status)
+	}
+	return nil
+}
+
+// "  name   A   1234  Mon Jan  1 12:00:00 2024" lines of smbclient's ls
+var smbListLine = regexp.MustCompile(`^\s+(.+?)\s+([A-Z]*)\s+(\d+)\s+(\w{3} \w{3} [ \d]\d [\d:]{8} \d{4})$`)
+
+// List a folder on a share: files and subfolders
+func listSMBFolder(ctx context.Context, share smbShare, creds smbCredentials, dir string) (files []DestinationObject, folders []string, err error) {
+	command := "ls"
+	if dir != "" {
+		command = "ls " + smbQuote(strings.TrimRight(dir, "/")+"/*")
+	}
+	out, err := runSMBClient(ctx, share, creds, []string{command})
+	if err != nil {
+		return nil, nil, err
+	}
+	// An empty folder lists as NT_STATUS_NO_SUCH_FILE
+	if status := smbErrorPattern.Find(out); status != nil && string(status) != "NT_STATUS_NO_SUCH_FILE" {
+		return nil, nil, fmt.Errorf("listing %s failed: %s", dir, status)
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		m := smbListLine.FindStringSubmatch(line)
+		if m == nil || m[1] == "." || m[1] == ".." {
+			continue
+		}
+		if strings.Contains(m[2], "D") {
+			folders = append(folders, path.Join(dir, m[1]))
+			continue
+		}
+		size, _ := strconv.ParseInt(m[3], 10, 64)
+		files = append(files, DestinationObject{Name: path.Join(dir, m[1]), Size: size, LastModified: m[4]})
+	}
+	return files, folders, nil
+}
+
+func listSMBObjects(ctx context.Context, shareURL, prefix string) ([]DestinationObject, error) {
+	share, err := parseSMBURL(shareURL)
+	if err != nil {
+		return nil, err
+	}
+	files, _, err := listSMBFolder(ctx, share, resolveSMBCredentials(shareURL, smbCredentials{}), path.Join(share.Path, prefix))
+	// Names relative to the share URL
+	for i := range files {
+		files[i].Name = strings.TrimPrefix(strings.TrimPrefix(files[i].Name, share.Path), "/")
+	}
+	return files, err
+}
+
+// Confirm some share is configured and reachable
+func checkSMBCredentials(ctx context.Context) error {
+	shareURL := os.Getenv("SMB_URL")
+	if shareURL == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "smb" && profile.URL != "" {
+				shareURL = profile.URL
+				break
+			}
+		}
+	}
+	if shareURL == "" {
+		return errors.New("no SMB share configured; set SMB_URL or add an smb destination profile")
+	}
+	_, err := listSMBObjects(ctx, shareURL, "")
+	return err
+}
+
+// Handler for POST /smb/folders: the subfolders of a folder on a share, for
+// picking the upload folder. Takes url, path, username and password as JSON,
+// so credentials entered in the form stay out of URLs and logs.
+func smbFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		URL      string `json:"url"`
+		Path     string `json:"path"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: "Invalid request body", Details: err.Error()})
+		return
+	}
+	if req.URL == "" {
+		req.URL = os.Getenv("SMB_URL")
+	}
+	share, err := parseSMBURL(req.URL)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest, Message: err.Error(),
+			Remediation: `Pass the share as smb://host/share or \\host\share.`})
+		return
+	}
+	creds := resolveSMBCredentials(req.URL, smbCredentials{req.Username, req.Password})
+	dir := path.Join(share.Path, strings.Trim(req.Path, "/"))
+	var folders []string
+	err = providerCall(r.Context(), "smb", func(ctx context.Context) error {
+		_, folders, err = listSMBFolder(ctx, share, creds, dir)
+		return err
+	})
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list the SMB share",
+			Remediation: "Check the share name, that the host is reachable on port 445, and the user name (DOMAIN\\user) and password."})
+		return
+	}
+	// Folders relative to the share URL, as the upload's folder
+	for i, folder := range folders {
+		folders[i] = strings.TrimPrefix(strings.TrimPrefix(folder, share.Path), "/")
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"folders": listOrEmpty(folders)})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// DigitalOcean Spaces, through the aws CLI against the region's S3-compatible
+// endpoint (https://<region>.digitaloceanspaces.com); see s3compat.go. Spaces
+// access keys come from SPACES_ACCESS_KEY_ID and SPACES_SECRET_ACCESS_KEY, or
+// from a spaces destination profile's username and password.
+
+// Regions with Spaces
+var spacesRegions = []string{"nyc3", "sfo2", "sfo3", "ams3", "fra1", "sgp1", "syd1", "blr1"}
+
+var spacesRegionPattern = regexp.MustCompile(`^[a-z]+[0-9]$`)
+
+const spacesDomain = ".digitaloceanspaces.com"
+
+func spacesEndpoint(region string) string {
+	return "https://" + region + spacesDomain
+}
+
+// Keys for a Spaces endpoint, from the environment or a spaces profile for its
+// region (or for any region)
+func spacesCredentials(endpointURL string) (string, string, bool) {
+	if !strings.HasSuffix(endpointURL, spacesDomain) {
+		return "", "", false
+	}
+	if id, secret := os.Getenv("SPACES_ACCESS_KEY_ID"), os.Getenv("SPACES_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return id, secret, true
+	}
+	for _, profile := range config.Destinations {
+		if profile.Cloud == "spaces" && profile.Username != "" &&
+			(profile.Region == "" || spacesEndpoint(profile.Region) == endpointURL) {
+			return profile.Username, profile.Password, true
+		}
+	}
+	return "", "", false
+}
+
+// The settings of an upload to a Space as an S3-compatible upload
+func spacesS3Settings(s uploadSettings) uploadSettings {
+	s.URL, s.PathStyle = spacesEndpoint(s.Region), false
+	return s
+}
+
+// Upload one file to a Space, returning its s3:// URI
+func uploadToSpaces(job *Job, s uploadSettings, file string) (string, error) {
+	s = spacesS3Settings(s)
+	// Spaces has no object tags or S3 additional checksums, so tags are stored as metadata
+	if len(s.Tags) > 0 {
+		metadata := map[string]string{}
+		for k, v := range s.Metadata {
+			metadata[k] = v
+		}
+		for k, v := range s.Tags {
+			metadata[k] = v
+		}
+		s.Metadata, s.Tags = metadata, nil
+	}
+	s.Checksums = nil
+	return uploadToAWS(job, s, file)
+}
+
+// The Spaces in a region
+func listSpaces(ctx context.Context, region string) ([]string, error) {
+	s := spacesS3Settings(uploadSettings{Region: region})
+	out, err := s.s3Endpoint().command(ctx, "s3api", "list-buckets", "--query", "Buckets[].Name", "--output", "text").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	var spaces []string
+	for _, name := range strings.Fields(string(out)) {
+		if name != "None" {
+			spaces = append(spaces, name)
+		}
+	}
+	return spaces, nil
+}
+
+func checkSpacesCredentials(ctx context.Context) error {
+	if _, _, ok := spacesCredentials(spacesEndpoint(spacesRegions[0])); !ok {
+		return errors.New("SPACES_ACCESS_KEY_ID and SPACES_SECRET_ACCESS_KEY are not set and no spaces profile has keys")
+	}
+	_, err := listSpaces(ctx, spacesRegions[0])
+	return err
+}
+
+func listSpacesRegions(ctx context.Context) ([]string, error) {
+	return spacesRegions, nil
+}
+
+// Handler for GET /spaces/buckets?region=: the Spaces in a region
+func spacesBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	region := r.URL.Query().Get("region")
+	if !spacesRegionPattern.MatchString(region) {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Missing or invalid Spaces region: %s"), region), Remediation: fmt.Sprintf(tr("Pass region, one of %s."), strings.Join(spacesRegions, ", "))})
+		return
+	}
+	if _, _, ok := spacesCredentials(spacesEndpoint(region)); !ok {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message:     "No Spaces access keys",
+			Remediation: "Set SPACES_ACCESS_KEY_ID and SPACES_SECRET_ACCESS_KEY, or add a spaces destination profile with the key as username and the secret as password."})
+		return
+	}
+	var spaces []string
+	err := providerCall(r.Context(), "spaces", func(ctx context.Context) error {
+		var err error
+		spaces, err = listSpaces(ctx, region)
+		return err
+	})
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: fmt.Sprintf(tr("Failed to list Spaces in %s"), region),
+			Remediation: "Check the Spaces access key is valid and has access to the region."})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"buckets": listOrEmpty(spaces)})
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Pipeline stages that turn a job's source (an OVA or VMDK, as a local path or an
+// http(s) URL) into disk images ready to upload: download → extract → convert.
+// The extract and convert handlers share the same building blocks.
+
+var errInvalidOVA = errors.New("invalid OVA archive")
+
+// The conversion of a VMDK into outputDir, writing subformat (or the format's
+// default; see formats.go)
+func vmdkConversion(input, outputDir, format, subformat string) imageConversion {
+	os.MkdirAll(outputDir, 0755)
+	return imageConversion{Input: input, InputFormat: "vmdk", OutputFormat: format,
+		Output:  filepath.Join(outputDir, filepath.Base(input)+"."+convertedExtension(format)),
+		Options: subformatOptions(format, subformat)}
+}
+
+// Convert a disk image of any format Porter knows to another format (with
+// optional qemu-img -o options), removing the partial output on failure
+func convertImage(job *Job, input, output, format string, options ...string) error {
+	inputFormat := diskFormatForPath(input)
+	if inputFormat == "" {
+		return fmt.Errorf("cannot convert %s: unrecognized disk format", filepath.Base(input))
+	}
+	err := imageTools().convert(job.ctx, job, imageConversion{Input: input, InputFormat: inputFormat,
+		Output: output, OutputFormat: format, Options: options})
+	if err != nil {
+		os.Remove(output)
+		return fmt.Errorf("converting %s to %s failed: %w", input, format, err)
+	}
+	return nil
+}
+
+// Rewrite a qcow2 image as a VMDK of a subformat, removing the qcow2
+func repackVMDK(job *Job, qcow2, subformat string) (string, error) {
+	output := strings.TrimSuffix(qcow2, ".qcow2") + ".vmdk"
+	subformat = resolveSubformat("vmdk", subformat)
+	job.setStatus("Packing %s as a %s VMDK", filepath.Base(qcow2), subformat)
+	err := imageTools().convert(job.ctx, job, imageConversion{Input: qcow2, InputFormat: "qcow2",
+		Output: output, OutputFormat: "vmdk", Options: subformatOptions("vmdk", subformat)})
+	if err != nil {
+		return "", fmt.Errorf("packing %s as VMDK failed: %w", qcow2, err)
+	}
+	os.Remove(qcow2)
+	return output, nil
+}
+
+// Extract an OVA tar stream into dir, returning the VMDKs it contained.
+// Archive errors wrap errInvalidOVA, filter errors errOVAFilter; anything else
+// is a local I/O failure. Entries filter leaves out (if it isn't nil) are
+// never written. Each file is written under a lock from lock, or none if the
+// caller holds dir.
+func extractOVA(r io.Reader, dir string, filter *ovaFilter, lock func(path string) (func(), error)) ([]string, error) {
+	tr := tar.NewReader(r)
+	var vmdks []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return vmdks, fmt.Errorf("%w: %s", errInvalidOVA, err)
+		}
+
+		target := filepath.Join(dir, hdr.Name)
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return vmdks, fmt.Errorf("%w: entry '%s' escapes the extraction directory", errInvalidOVA, hdr.Name)
+		}
+		if hdr.FileInfo().IsDir() {
+			os.MkdirAll(target, hdr.FileInfo().Mode())
+			continue
+		}
+		reason, err := filter.skip(hdr.Name, hdr.Size)
+		if err != nil {
+			return vmdks, err
+		}
+		if reason != "" {
+			filter.Skipped = append(filter.Skipped, fmt.Sprintf("%s (%.2f MB): %s", hdr.Name, float64(hdr.Size)/(1024*1024), reason))
+			fmt.Printf("Skipped %s: %s\n", hdr.Name, reason)
+			continue
+		}
+
+		os.MkdirAll(filepath.Dir(target), 0755)
+		release := func() {}
+		if lock != nil {
+			if release, err = lock(target); err != nil {
+				return vmdks, err
+			}
+		}
+		f, err := os.Create(target)
+		if err != nil {
+			release()
+			return vmdks, fmt.Errorf("error creating file %s: %w", target, err)
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		release()
+		if err != nil {
+			return vmdks, fmt.Errorf("error writing to file %s: %w", target, err)
+		}
+		if strings.EqualFold(filepath.Ext(hdr.Name), ".ovf") {
+			if err := filter.loadOVF(target); err != nil {
+				return vmdks, err
+			}
+		}
+
+		if strings.HasSuffix(hdr.Name, ".vmdk") {
+			vmdks = append(vmdks, target)
+			fmt.Printf("Extracted VMDK: %s\n", target)
+		}
+	}
+	return vmdks, nil
+}
+
+func isRemoteSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// Download a source URL into dir, pausable and cancellable through the job
+func downloadSource(job *Job, source, dir string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid source URL '%s': %w", source, err)
+	}
+	dst := filepath.Join(dir, filepath.Base(u.Path))
+	os.MkdirAll(dir, 0755)
+
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodGet, source, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", source, resp.Status)
+	}
+
+	job.setStatus("Downloading %s (%.2f MB)", source, float64(resp.ContentLength)/(1024*1024))
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, &jobReader{job: job, r: resp.Body}); err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", source, err)
+	}
+	return dst, out.Sync()
+}
+
+// The working directory name for a pipeline job's extracted and converted files
+func pipelineWorkName(job *Job) string {
+	name := job.Spec.Name
+	if name == "" {
+		name = baseNameWithoutExt(job.Spec.Source)
+	}
+	return filepath.Base(name) + "-" + job.ID
+}
+
+// Run the source stages of a pipeline job, returning the files to upload.
+// OVAs are extracted and VMDKs converted to the spec's format (raw by default);
+// other disk images are uploaded as they are.
+func prepareSource(job *Job) ([]string, error) {
+	source := job.Spec.Source
+	work := pipelineWorkName(job)
+	job.logf("Preparing source %s", source)
+
+	if isRemoteSource(source) {
+		if !hasFreeSpace(extractDir, 10) {
+			return nil, fmt.Errorf("not enough free disk space in %s to download %s", extractDir, source)
+		}
+		started := time.Now()
+		release, err := job.lockWorkspace(nil, []string{filepath.Join(extractDir, work)})
+		if err != nil {
+			return nil, err
+		}
+		local, err := downloadSource(job, source, filepath.Join(extractDir, work))
+		release()
+		if err != nil {
+			return nil, err
+		}
+		if info, err := os.Stat(local); err == nil {
+			throughput.record("download", info.Size(), time.Since(started))
+		}
+		source = local
+	}
+
+	var vmdks []string
+	switch strings.ToLower(filepath.Ext(source)) {
+	case ".ova":
+		if job.settings.Cloud == "vsphere" && len(job.Spec.GuestSteps) == 0 {
+			// vCenter deploys the OVA itself
+			return []string{source}, nil
+		}
+		if !hasFreeSpace(extractDir, 10) {
+			return nil, fmt.Errorf("not enough free disk space in %s to extract %s", extractDir, source)
+		}
+		release, err := job.lockWorkspace([]string{source}, []string{filepath.Join(extractDir, work)})
+		if err != nil {
+			return nil, err
+		}
+		job.setStatus("Extracting %s", filepath.Base(source))
+		f, err := os.Open(source)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		filter := newOVAFilter(job.Spec.ExtractMaxMB, job.Spec.ExtractSkip, job.Spec.VirtualSystem)
+		vmdks, err = extractOVA(&jobReader{job: job, r: f}, filepath.Join(extractDir, work), filter, nil)
+		f.Close()
+		release()
+		if err != nil {
+			return nil, fmt.Errorf("extracting %s failed: %w", source, err)
+		}
+		if filter != nil {
+			for _, skipped := range filter.Skipped {
+				job.logf("Not extracted: %s", skipped)
+			}
+		}
+		if len(vmdks) == 0 {
+			return nil, fmt.Errorf("%s contains no VMDK disks", source)
+		}
+	case ".vmdk":
+		vmdks = []string{source}
+	default:
+		if len(job.Spec.GuestSteps) > 0 {
+			return nil, fmt.Errorf("guest steps need an OVA or VMDK source, not %s", filepath.Base(source))
+		}
+		return []string{source}, nil
+	}
+
+	checkJobReadiness(job, vmdks, "vmdk")
+
+	format := job.Spec.Format
+	if format == "" {
+		format = config.DefaultFormat
+	}
+	var converted []string
+	for i, vmdk := range vmdks {
+		if !hasFreeSpace(convertDir, 10) {
+			return nil, fmt.Errorf("not enough free disk space in %s to convert %s", convertDir, vmdk)
+		}
+		// Guest steps cannot write streamOptimized VMDKs, so customize a qcow2 and repack it
+		convertFormat := format
+		if format == "vmdk" && len(job.Spec.GuestSteps) > 0 {
+			convertFormat = "qcow2"
+		}
+		job.setStatus("[%d/%d] Converting %s to %s format", i+1, len(vmdks), filepath.Base(vmdk), format)
+		output, err := convertVMDKForJob(job, vmdk, filepath.Join(convertDir, work), convertFormat, format)
+		if err != nil {
+			return nil, err
+		}
+		converted = append(converted, output)
+	}
+	return converted, nil
+}
+
+// Convert one VMDK of a pipeline job into outputDir, running guest steps and
+// repacking as needed, with the VMDK locked for reading and outputDir for writing
+func convertVMDKForJob(job *Job, vmdk, outputDir, convertFormat, format string) (string, error) {
+	release, err := job.lockWorkspace([]string{vmdk}, []string{outputDir})
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	subformat := ""
+	if convertFormat == format {
+		subformat = job.Spec.Subformat
+	}
+	conversion := vmdkConversion(vmdk, outputDir, convertFormat, subformat)
+	output := conversion.Output
+	started := time.Now()
+	if err := imageTools().convert(job.ctx, job, conversion); err != nil {
+		return "", fmt.Errorf("conversion failed for %s: %w", vmdk, err)
+	}
+	if info, err := os.Stat(vmdk); err == nil {
+		throughput.record("convert", info.Size(), time.Since(started))
+	}
+	if len(job.Spec.GuestSteps) > 0 {
+		if err := runGuestSteps(job, output, convertFormat); err != nil {
+			return "", err
+		}
+	}
+	if convertFormat != format {
+		if output, err = repackVMDK(job, output, job.Spec.Subformat); err != nil {
+			return "", err
+		}
+	}
+	result, err := describeConversion(job.ctx, job, vmdk, output, format, time.Since(started))
+	if err != nil {
+		return "", err
+	}
+	result.Subformat = resolveSubformat(format, job.Spec.Subformat)
+	recordConversion(result)
+	job.mu.Lock()
+	job.Conversions = append(job.Conversions, result)
+	job.mu.Unlock()
+	job.logf("Converted %s to %s (%s, sha256 %s)", vmdk, output, result.Summary(), result.Checksum)
+	return output, nil
+}
+
+// Check the pipeline fields of a job spec
+func validatePipelineSpec(spec JobSpec) *APIError {
+	if len(spec.Files) == 0 && spec.Source == "" {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message: "No files selected for upload", Remediation: "Pass one or more paths in 'files', or an OVA/VMDK path or URL in 'source'."}
+	}
+	if len(spec.Files) > 0 && spec.Source != "" {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message: "A job takes either 'files' or 'source', not both"}
+	}
+	if spec.Format != "" {
+		if apiErr := checkFormat(spec.Format); apiErr != nil {
+			return apiErr
+		}
+	}
+	if spec.Subformat != "" {
+		format := spec.Format
+		if format == "" {
+			format = config.DefaultFormat
+		}
+		if apiErr := checkSubformat(format, spec.Subformat); apiErr != nil {
+			return apiErr
+		}
+	}
+	if len(spec.GuestSteps) > 0 && spec.Source == "" {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message:     "Guest steps apply to pipeline jobs",
+			Remediation: "Pass the OVA or VMDK in 'source' so Porter can customize the converted image."}
+	}
+	if apiErr := checkGuestSteps(spec.GuestSteps); apiErr != nil {
+		return apiErr
+	}
+	if (spec.ExtractMaxMB != 0 || len(spec.ExtractSkip) > 0 || spec.VirtualSystem != "") && spec.Source == "" {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message:     "Extraction filters apply to pipeline jobs",
+			Remediation: "Pass the OVA in 'source' so Porter can filter its contents while extracting."}
+	}
+	if apiErr := checkOVAFilter(spec.ExtractMaxMB, spec.ExtractSkip); apiErr != nil {
+		return apiErr
+	}
+	if spec.Source != "" && !isRemoteSource(spec.Source) {
+		if _, err := os.Stat(spec.Source); err != nil {
+			return &APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Source not found: %s"), spec.Source), Details: err.Error()}
+		}
+	}
+	return nil
+}
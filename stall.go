@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Stall detection: a running job that shows no sign of progress for
+// stallMinutes (porter.json, default 15) is flagged as stalled, with a job
+// warning, a "stalled" event and a ticket update, instead of showing the same
+// percentage forever while a CLI hangs. Progress is anything the job does:
+// status changes, lines of CLI output, bytes through Porter's own copies, and
+// bytes read by the CLI process in flight (from /proc), so a throttled transfer
+// that crawls along is never taken for a hung one. The same byte counts give
+// the job's smoothed throughput. With stallRestarts, a stalled CLI step is
+// killed and run again, up to that many times per job.
+
+const (
+	stallCheckInterval = 30 * time.Second
+	// Weight of the latest sample in the smoothed throughput
+	throughputSmoothing = 0.3
+)
+
+// Record that the job did something; clears the stalled flag on the next check
+func (j *Job) progressed() {
+	j.mu.Lock()
+	j.lastProgress = time.Now()
+	j.mu.Unlock()
+}
+
+// Mark the job as waiting on something other than its own work (another job's
+// files), which doesn't count as stalling
+func (j *Job) setWaiting(waiting bool) {
+	j.mu.Lock()
+	j.waiting = waiting
+	j.lastProgress = time.Now()
+	j.mu.Unlock()
+}
+
+// Bytes read by a process group so far, from /proc/<pid>/io; 0 where /proc is
+// not available
+func processGroupBytes(pgid int) int64 {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid pgrp ...; comm may contain spaces
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		if len(fields) < 3 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		io, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "io"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(io), "\n") {
+			if value, ok := strings.CutPrefix(line, "rchar: "); ok {
+				n, _ := strconv.ParseInt(value, 10, 64)
+				total += n
+			}
+		}
+	}
+	return total
+}
+
+// Check a job for progress since the last check, updating its throughput and
+// flagging it as stalled (or no longer stalled)
+func (j *Job) checkStall(now time.Time, threshold time.Duration) {
+	j.mu.Lock()
+	if j.State != jobRunning || j.waiting {
+		j.lastProgress = now
+		j.mu.Unlock()
+		return
+	}
+	cmd := j.cmd
+	j.mu.Unlock()
+
+	var procBytes int64
+	if cmd != nil && cmd.Process != nil {
+		procBytes = processGroupBytes(cmd.Process.Pid)
+	}
+	copied := j.bytesCopied.Load()
+
+	j.mu.Lock()
+	// Porter's copies may feed the CLI (FTP uploads read from stdin), so take
+	// the larger of the two counts rather than adding them
+	moved := copied - j.lastCopied
+	procBase := j.lastProcBytes
+	if cmd != j.sampledCmd {
+		procBase = 0
+	}
+	if procBytes-procBase > moved {
+		moved = procBytes - procBase
+	}
+	j.lastCopied, j.lastProcBytes, j.sampledCmd = copied, procBytes, cmd
+	if moved > 0 {
+		j.lastProgress = now
+	}
+	sample := float64(moved) / stallCheckInterval.Seconds() / (1024 * 1024)
+	j.Progress.ThroughputMBps = throughputSmoothing*sample + (1-throughputSmoothing)*j.Progress.ThroughputMBps
+	if j.Progress.ThroughputMBps < 0.01 {
+		j.Progress.ThroughputMBps = 0
+	}
+	progress := j.Progress
+	idle := now.Sub(j.lastProgress)
+	wasStalled := j.Stalled
+	stalled := threshold > 0 && idle >= threshold
+	j.Stalled = stalled
+	restart := stalled && !wasStalled && j.StallRestarts < config.StallRestarts && cmd != nil && cmd.Stdin == nil
+	if restart {
+		j.StallRestarts++
+		j.restarting = cmd
+		j.Stalled = false
+		j.lastProgress = now
+	}
+	restarts := j.StallRestarts
+	j.mu.Unlock()
+
+	j.publish(JobEvent{Type: "progress", Progress: &progress})
+	switch {
+	case stalled && !wasStalled:
+		step := ""
+		if progress.Status != "" {
+			step = fmt.Sprintf(" during \"%s\"", progress.Status)
+		}
+		j.warnf("No progress for %s%s; the step may be hung", formatDuration(int64(idle.Seconds())), step)
+		fmt.Printf("ALERT: job %s stalled\n", j.ID)
+		j.publish(JobEvent{Type: "stalled", Message: progress.Status})
+		queueTicketUpdate(j, "stalled")
+		if restart {
+			j.logf("Restarting the stalled %s (restart %d of %d)", filepath.Base(cmd.Path), restarts, config.StallRestarts)
+			signalProcessGroup(cmd, syscall.SIGKILL)
+		}
+	case wasStalled && !stalled:
+		j.logf("Progress resumed")
+	}
+}
+
+// Whether a command that exited was killed by the stall check to be run again
+func (j *Job) takeRestart(cmd *exec.Cmd) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.restarting != cmd {
+		return false
+	}
+	j.restarting = nil
+	return true
+}
+
+// A fresh copy of a command, to run it again
+func cloneCommand(job *Job, cmd *exec.Cmd) *exec.Cmd {
+	clone := exec.CommandContext(job.ctx, cmd.Path, cmd.Args[1:]...)
+	clone.Env, clone.Dir = cmd.Env, cmd.Dir
+	return clone
+}
+
+// Check running jobs for stalls; run in the background from main
+func runStallMonitor() {
+	for {
+		time.Sleep(stallCheckInterval)
+		threshold := time.Duration(config.StallMinutes) * time.Minute
+		jobs.Lock()
+		running := append([]*Job{}, jobs.order...)
+		jobs.Unlock()
+		now := time.Now()
+		for _, job := range running {
+			job.checkStall(now, threshold)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 #!/bin/bash
 
 # Create data directories if they don't exist
-mkdir -p ~/porter-data/extracted ~/porter-data/converted
+mkdir -p ~/porter-data/extracted ~/porter-data/converted ~/porter-data/state
 
 # Stop any existing Porter containers
 docker ps -q --filter "name=porter" | xargs -r docker stop
@@ -12,8 +12,33 @@ docker build -t porter .
 docker run -d --name porter \
   -v ~/.aws:/root/.aws:ro \
   -v ~/.azure:/root/.azure:ro \
+  -v ~/.config/gcloud:/root/.config/gcloud:ro \
+  -v ~/.bluemix:/root/.bluemix \
+  -v ~/.aliyun:/root/.aliyun:ro \
+  -v ~/.oci:/root/.oci:ro \
+  -v ~/.ssh:/root/.ssh:ro \
+  -e LINODE_TOKEN -e VULTR_API_KEY -e SPACES_ACCESS_KEY_ID -e SPACES_SECRET_ACCESS_KEY \
+  -e B2_APPLICATION_KEY_ID -e B2_APPLICATION_KEY \
+  -e OS_AUTH_URL -e OS_USERNAME -e OS_PASSWORD -e OS_PROJECT_NAME -e OS_USER_DOMAIN_NAME -e OS_PROJECT_DOMAIN_NAME -e OS_REGION_NAME \
+  -e WEBDAV_URL -e WEBDAV_USERNAME -e WEBDAV_PASSWORD \
+  -e FTP_URL -e FTP_USERNAME -e FTP_PASSWORD -e FTP_INSECURE \
+  -e SMB_URL -e SMB_USERNAME -e SMB_PASSWORD \
+  -e NFS_URL -e NFS_MOUNT_OPTIONS \
+  -e ARTIFACTORY_URL -e ARTIFACTORY_TOKEN -e ARTIFACTORY_USERNAME -e ARTIFACTORY_PASSWORD \
+  -e NEXUS_URL -e NEXUS_USERNAME -e NEXUS_PASSWORD \
+  -e HTTP_UPLOAD_URL -e HTTP_UPLOAD_TOKEN \
+  -e GOVC_URL -e GOVC_USERNAME -e GOVC_PASSWORD -e GOVC_INSECURE \
+  -e PROXMOX_URL -e PROXMOX_TOKEN -e PROXMOX_NODE -e PROXMOX_STORAGE -e PROXMOX_INSECURE \
+  -e XCPNG_URL -e XCPNG_USERNAME -e XCPNG_PASSWORD -e XCPNG_SR -e XCPNG_INSECURE \
+  -e OVIRT_URL -e OVIRT_USERNAME -e OVIRT_PASSWORD -e OVIRT_STORAGE_DOMAIN -e OVIRT_CLUSTER -e OVIRT_INSECURE \
+  -e NUTANIX_URL -e NUTANIX_USERNAME -e NUTANIX_PASSWORD -e NUTANIX_INSECURE \
+  -e HYPERV_URL -e HYPERV_USERNAME -e HYPERV_PASSWORD -e HYPERV_PATH -e HYPERV_INSECURE \
+  -e AZURE_STORAGE_SAS_URL \
+  -e COSIGN_KEY -e COSIGN_PASSWORD -e SIGSTORE_ID_TOKEN \
+  -e PORTER_TICKET_TOKEN \
   -v ~/porter-data/extracted:/app/extracted \
   -v ~/porter-data/converted:/app/converted \
+  -v ~/porter-data/state:/app/state \
   -p 8080:8080 \
   porter
 
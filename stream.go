@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Upload streams: destinations Porter sends data to itself (HTTP endpoints,
+// WebDAV, local copies, XCP-ng, oVirt and Nutanix) read each file once,
+// through a chain of stages applied as the data streams: pausing and
+// cancelling, throttling, hashing, compression and encryption. Turning on
+// several costs no extra read of the file, and the checksums a job records are
+// taken on the way rather than in a second pass as for CLI uploads.
+//
+// Compression (gzip) and encryption change what is stored, so they are only
+// offered where the result is a plain file; the name gets .gz and .enc. The
+// recorded checksums are of the disk itself, so a decompressed or decrypted
+// copy can be checked against them. Encryption is AES-256-CTR, then
+// HMAC-SHA256 over the result: a file holds the random 16-byte IV, the
+// ciphertext, and the 32-byte HMAC of both, with the cipher and MAC keys
+// derived from the upload key (see uploadStreamKeys), so a file that was
+// tampered with or cut short fails its check before it is decrypted. The
+// README shows how to check and decrypt one with openssl.
+
+// A stage wraps the reader before it
+type streamStage func(r io.Reader) io.Reader
+
+// Compression formats streams can apply
+var streamCompressions = []string{"gzip"}
+
+// Destinations that store what they're sent as a file, and so can take a
+// compressed or encrypted stream
+var streamTransformClouds = []string{"http", "webdav", "local"}
+
+// Destinations whose uploads go through an uploadStream, so bandwidth limits
+// and classes apply to them. Azure uploads do when they use a SAS URL rather
+// than the az CLI.
+var streamedClouds = []string{"local", "nfs", "http", "webdav", "porter", "azuredisk", "xcpng", "ovirt", "nutanix"}
+
+// Whether Porter streams a job's uploads itself
+func streamedUpload(s uploadSettings) bool {
+	return slices.Contains(streamedClouds, s.Cloud) || (s.Cloud == "azure" && s.URL != "")
+}
+
+// An open upload stream of one file
+type uploadStream struct {
+	io.Reader
+	// What the destination receives: the file's name with .gz and .enc added
+	// as they apply, and its size (-1 when compression makes it unknown)
+	Name string
+	Size int64
+	// The size of the file itself
+	FileSize int64
+
+	job    *Job
+	s      uploadSettings
+	file   string
+	f      *os.File
+	hashes map[string]hash.Hash
+	// SHA-256 of the bytes streamed, after compression and encryption
+	sent hash.Hash
+	// The cipher and MAC keys of encrypted streams
+	encKey, macKey []byte
+	pipes          []*io.PipeReader
+	// Readers counted against the job's bandwidth class; see bandwidth.go
+	classed []*classReader
+}
+
+// Open a file to stream to a destination with the job's stages
+func openUploadStream(job *Job, s uploadSettings, file string) (*uploadStream, error) {
+	st := &uploadStream{job: job, s: s, file: file, Name: filepath.Base(file)}
+	if s.Compress != "" {
+		st.Name += ".gz"
+	}
+	if s.Encrypt {
+		st.Name += ".enc"
+	}
+	return st, st.open()
+}
+
+// (Re)start the stream from the beginning of the file
+func (st *uploadStream) open() error {
+	st.Close()
+	if st.s.Encrypt {
+		var err error
+		if st.encKey, st.macKey, err = uploadStreamKeys(); err != nil {
+			return fmt.Errorf("cannot encrypt %s: %w", filepath.Base(st.file), err)
+		}
+	}
+	f, err := os.Open(st.file)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to get file info for %s: %w", st.file, err)
+	}
+	st.f, st.Size, st.FileSize = f, info.Size(), info.Size()
+	st.hashes = map[string]hash.Hash{}
+	for _, algorithm := range st.s.Checksums {
+		st.hashes[algorithm] = newChecksumHash(algorithm)
+	}
+	st.sent = sha256.New()
+
+	var r io.Reader = f
+	for _, stage := range st.stages() {
+		r = stage(r)
+	}
+	st.Reader = r
+	return nil
+}
+
+// The stages the settings call for, in order
+func (st *uploadStream) stages() []streamStage {
+	stages := []streamStage{func(r io.Reader) io.Reader { return &jobReader{job: st.job, r: r} }}
+	if uploadBandwidth(st.s) > 0 || bandwidthClass(st.s) != "" {
+		stages = append(stages, st.throttled)
+	}
+	if len(st.hashes) > 0 {
+		stages = append(stages, func(r io.Reader) io.Reader {
+			writers := make([]io.Writer, 0, len(st.hashes))
+			for _, h := range st.hashes {
+				writers = append(writers, h)
+			}
+			return io.TeeReader(r, io.MultiWriter(writers...))
+		})
+	}
+	if st.s.Compress == "gzip" {
+		st.Size = -1
+		stages = append(stages, st.gzip)
+	}
+	if st.s.Encrypt {
+		if st.Size >= 0 {
+			st.Size += aes.BlockSize + sha256.Size
+		}
+		stages = append(stages, st.encrypt)
+	}
+	return append(stages, func(r io.Reader) io.Reader { return io.TeeReader(r, st.sent) })
+}
+
+// Whether what's sent differs from the file
+func (st *uploadStream) transformed() bool {
+	return st.s.Compress != "" || st.s.Encrypt
+}
+
+// A reader limited to the upload bandwidth and the job's bandwidth class, for
+// the stream and for parts of the file sent outside it (resumable chunks)
+func (st *uploadStream) throttled(r io.Reader) io.Reader {
+	if rate := uploadBandwidth(st.s); rate > 0 {
+		r = &throttledReader{r: r, rate: rate * 1024 * 1024, clock: systemClock{}}
+	}
+	if class := bandwidthClass(st.s); class != "" {
+		c := newClassReader(r, class, systemClock{})
+		st.classed = append(st.classed, c)
+		r = c
+	}
+	return r
+}
+
+// Compress through a pipe, so the stream is read as it is compressed
+func (st *uploadStream) gzip(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	st.pipes = append(st.pipes, pr)
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// Encrypt with the stream's keys: a fresh IV, the ciphertext, then the HMAC
+// of both
+func (st *uploadStream) encrypt(r io.Reader) io.Reader {
+	block, err := aes.NewCipher(st.encKey)
+	if err != nil {
+		return &failingReader{err}
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return &failingReader{err}
+	}
+	return &macTrailer{
+		r:   io.MultiReader(bytes.NewReader(iv), cipher.StreamReader{S: cipher.NewCTR(block, iv), R: r}),
+		mac: hmac.New(sha256.New, st.macKey),
+	}
+}
+
+// Passes a reader through, then adds the HMAC of everything it read
+type macTrailer struct {
+	r       io.Reader
+	mac     hash.Hash
+	trailer *bytes.Reader
+}
+
+func (m *macTrailer) Read(p []byte) (int, error) {
+	if m.trailer == nil {
+		n, err := m.r.Read(p)
+		m.mac.Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		m.trailer = bytes.NewReader(m.mac.Sum(nil))
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return m.trailer.Read(p)
+}
+
+type failingReader struct{ err error }
+
+func (r *failingReader) Read([]byte) (int, error) { return 0, r.err }
+
+// Once the stream has been sent in full: the checksums of the file, which are
+// recorded for the job so they aren't computed again, and the SHA-256 of what
+// was sent
+func (st *uploadStream) finish() (map[string]string, string) {
+	var sums map[string]string
+	if len(st.hashes) > 0 {
+		sums = map[string]string{}
+		for algorithm, h := range st.hashes {
+			sums[algorithm] = hex.EncodeToString(h.Sum(nil))
+		}
+		st.job.mu.Lock()
+		if st.job.streamedSums == nil {
+			st.job.streamedSums = map[string]map[string]string{}
+		}
+		st.job.streamedSums[st.file] = sums
+		st.job.mu.Unlock()
+	}
+	return sums, hex.EncodeToString(st.sent.Sum(nil))
+}
+
+func (st *uploadStream) Close() error {
+	// Unblock compression still writing into a pipe nobody reads
+	for _, pr := range st.pipes {
+		pr.CloseWithError(io.ErrClosedPipe)
+	}
+	st.pipes = nil
+	for _, c := range st.classed {
+		c.Close()
+	}
+	st.classed = nil
+	if st.f == nil {
+		return nil
+	}
+	err := st.f.Close()
+	st.f = nil
+	return err
+}
+
+// Write a stream to a file, synced to disk
+func writeStreamToFile(st *uploadStream, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, st); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// Checksums recorded while a file was streamed, nil if it wasn't
+func (j *Job) streamedChecksums(file string) map[string]string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.streamedSums[file]
+}
+
+// The time and waits that pace streams, so tests can pace them without waiting
+type pacingClock interface {
+	Now() time.Time
+	Sleep(time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// Limits a stream to a rate in bytes per second
+type throttledReader struct {
+	r     io.Reader
+	rate  float64
+	clock pacingClock
+	// When the bytes read so far are due
+	next time.Time
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// Small reads keep the waits short and the rate even
+	if limit := int(t.rate / 10); limit > 0 && len(p) > limit {
+		p = p[:limit]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		now := t.clock.Now()
+		t.next = throttleDeadline(t.next, now, n, t.rate)
+		t.clock.Sleep(t.next.Sub(now))
+	}
+	return n, err
+}
+
+// When n more bytes at rate bytes per second are due, after bytes due at
+// next. Time lost oversleeping is made up, but time spent not reading (paused,
+// outside a transfer window, or waiting on the destination) is not credit
+// for a burst.
+func throttleDeadline(next, now time.Time, n int, rate float64) time.Time {
+	if next.Before(now.Add(-time.Second / 10)) {
+		next = now
+	}
+	return next.Add(time.Duration(float64(n) / rate * float64(time.Second)))
+}
+
+// The upload bandwidth limit in MB/s: the job's, else the instance's (0 = none)
+func uploadBandwidth(s uploadSettings) float64 {
+	if s.BandwidthMBps > 0 {
+		return s.BandwidthMBps
+	}
+	return config.UploadBandwidthMBps
+}
+
+// The AES-256 key for encrypted uploads, from uploadEncryptionKey in
+// porter.json or PORTER_UPLOAD_KEY (64 hex digits)
+func uploadEncryptionKey() ([]byte, error) {
+	encoded := config.UploadEncryptionKey
+	if encoded == "" {
+		encoded = os.Getenv("PORTER_UPLOAD_KEY")
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("no upload encryption key is configured")
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("the upload encryption key must be 64 hex digits (32 bytes)")
+	}
+	return key, nil
+}
+
+// The cipher and MAC keys of encrypted uploads, derived from the upload key
+// as the HMAC-SHA256s of "porter upload encryption" and "porter upload
+// authentication"
+func uploadStreamKeys() ([]byte, []byte, error) {
+	key, err := uploadEncryptionKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	return derive("porter upload encryption"), derive("porter upload authentication"), nil
+}
+
+// Check a job's stream settings
+func validateStreamSettings(s uploadSettings) *APIError {
+	if s.Compress != "" && !slices.Contains(streamCompressions, s.Compress) {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Unsupported compression: %s"), s.Compress), Remediation: "Use gzip, or leave 'compress' out."}
+	}
+	if (s.Compress != "" || s.Encrypt) && !slices.Contains(streamTransformClouds, s.Cloud) {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message:     "Compression and encryption are only available for http, webdav and local destinations",
+			Remediation: fmt.Sprintf(tr("Leave out 'compress' and 'encrypt' for %s, whose imports need the disk as it is."), s.Cloud)}
+	}
+	if s.Encrypt {
+		if _, err := uploadEncryptionKey(); err != nil {
+			return &APIError{Code: errCodeInvalidRequest, Message: fmt.Sprintf(tr("Cannot encrypt the upload: %s"), err.Error()),
+				Remediation: "Set uploadEncryptionKey in porter.json or PORTER_UPLOAD_KEY, e.g. from openssl rand -hex 32."}
+		}
+	}
+	if s.BandwidthMBps < 0 {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message: "Invalid bandwidthMBps", Remediation: "Use a positive limit in MB/s, or leave it out for none."}
+	}
+	// Other destinations upload with their CLIs, which Porter can't pace
+	if (s.BandwidthMBps > 0 || s.BandwidthClass != "") && !streamedUpload(s) {
+		return &APIError{Code: errCodeInvalidRequest,
+			Message:     fmt.Sprintf(tr("Bandwidth limits and classes only apply to uploads Porter streams itself, not to %s"), s.Cloud),
+			Remediation: fmt.Sprintf(tr("Leave out 'bandwidthMBps' and 'bandwidthClass' (and the destination profile's bandwidthClass) for %s jobs."), s.Cloud)}
+	}
+	return nil
+}
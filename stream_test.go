@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// Reads as fast as it is asked
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// A clock that only moves when slept on or advanced, and records the sleeps
+type fakeClock struct {
+	now    time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+}
+
+// The time slept since the sleeps were last taken
+func (c *fakeClock) take() time.Duration {
+	var total time.Duration
+	for _, d := range c.sleeps {
+		if d > 0 {
+			total += d
+		}
+	}
+	c.sleeps = nil
+	return total
+}
+
+func TestThrottleDeadline(t *testing.T) {
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		next time.Time
+		n    int
+		want time.Time
+	}{
+		{"first read", time.Time{}, 1 << 20, now.Add(time.Second)},
+		{"still sending", now.Add(300 * time.Millisecond), 1 << 19, now.Add(800 * time.Millisecond)},
+		{"overslept a little", now.Add(-50 * time.Millisecond), 1 << 20, now.Add(950 * time.Millisecond)},
+		{"after a pause", now.Add(-time.Minute), 1 << 20, now.Add(time.Second)},
+	}
+	for _, tt := range tests {
+		if got := throttleDeadline(tt.next, now, tt.n, 1<<20); !got.Equal(tt.want) {
+			t.Errorf("%s: throttleDeadline = %s, want %s", tt.name, got.Sub(now), tt.want.Sub(now))
+		}
+	}
+}
+
+func TestThrottledReaderPacing(t *testing.T) {
+	tests := []struct {
+		name string
+		// Time passing between the first 100 kB and the next 200 kB
+		pause time.Duration
+		want  time.Duration
+	}{
+		{"steady", 0, 200 * time.Millisecond},
+		{"slow destination", 50 * time.Millisecond, 150 * time.Millisecond},
+		{"after a pause", 5 * time.Second, 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		clock := &fakeClock{now: time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)}
+		r := &throttledReader{r: zeroReader{}, rate: 1000000, clock: clock}
+		io.ReadFull(r, make([]byte, 100000))
+		if got := clock.take(); got != 100*time.Millisecond {
+			t.Fatalf("%s: 100 kB at 1 MB/s waited %s, want 100ms", tt.name, got)
+		}
+		clock.now = clock.now.Add(tt.pause)
+		io.ReadFull(r, make([]byte, 200000))
+		if got := clock.take(); got != tt.want {
+			t.Errorf("%s: 200 kB at 1 MB/s waited %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
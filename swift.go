@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpenStack Swift, through the swift CLI (python-swiftclient), which takes its
+// Keystone credentials from the usual OS_* variables (OS_AUTH_URL, OS_USERNAME,
+// OS_PASSWORD, OS_PROJECT_NAME, the domain names, or an application credential).
+// Files larger than swiftSegmentSize are uploaded as static large objects: the
+// segments go to <container>_segments and the object is a manifest listing them.
+// Objects are swift://container/name.
+
+// Single objects are limited to 5 GB by default, so larger disks are segmented
+const swiftSegmentSize = 1 << 30
+
+// Arguments for the swift CLI, in the upload's region if one is set
+func swiftArgs(region string, args ...string) []string {
+	if region != "" {
+		args = append([]string{"--os-region-name", region}, args...)
+	}
+	return args
+}
+
+func swiftCommand(ctx context.Context, region string, args ...string) *exec.Cmd {
+	return toolCommand(ctx, "swift", swiftArgs(region, args...)...)
+}
+
+// Split a swift://container/name URI
+func parseSwiftURI(uri string) (container, name string, err error) {
+	container, name, ok := strings.Cut(strings.TrimPrefix(uri, "swift://"), "/")
+	if !ok || !strings.HasPrefix(uri, "swift://") {
+		return "", "", fmt.Errorf("invalid Swift URI '%s'", uri)
+	}
+	return container, name, nil
+}
+
+// Upload one file to a Swift container, returning its swift:// URI
+func uploadToSwift(job *Job, s uploadSettings, file string) (string, error) {
+	name := filepath.Base(file)
+	if s.Target != "" {
+		name = strings.Trim(s.Target, "/") + "/" + name
+	}
+	uri := "swift://" + s.Bucket + "/" + name
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Uploading %s to Swift: %s (%.2f MB)",
+		filepath.Base(file), uri, float64(fileInfo.Size())/(1024*1024))
+
+	args := []string{"upload", "--object-name", name,
+		"--segment-size", strconv.Itoa(swiftSegmentSize), "--use-slo"}
+	// Swift has no object tags, so tags are stored as metadata too
+	for _, meta := range []map[string]string{s.Metadata, s.Tags} {
+		for _, pair := range keyValuePairs(meta) {
+			k, v, _ := strings.Cut(pair, "=")
+			args = append(args, "--header", "X-Object-Meta-"+k+":"+v)
+		}
+	}
+	args = append(args, s.Bucket, file)
+	pending := pendingUploads.start("swift", uri, s.Region)
+	if err := runJobCommand(job, swiftCommand(job.ctx, s.Region, args...)); err != nil {
+		abandonUpload(pending)
+		return "", fmt.Errorf("Swift upload failed for %s: %w", file, err)
+	}
+	pendingUploads.finish(pending.ID)
+	return uri, nil
+}
+
+// Delete an object; the CLI deletes a large object's segments with it
+func deleteSwiftObject(uri, region string) error {
+	container, name, err := parseSwiftURI(uri)
+	if err != nil {
+		return err
+	}
+	out, err := swiftCommand(context.Background(), region, "delete", container, name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// Delete the segments a failed large object upload left behind. If the object
+// exists (an earlier upload), its segments are left alone.
+func deleteSwiftSegments(uri, region string) error {
+	container, name, err := parseSwiftURI(uri)
+	if err != nil {
+		return err
+	}
+	if swiftCommand(context.Background(), region, "stat", container, name).Run() == nil {
+		return nil
+	}
+	out, err := swiftCommand(context.Background(), region, "delete", container+"_segments", "--prefix", name+"/").CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "not found") {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// List objects under a prefix in a container
+func listSwiftObjects(ctx context.Context, region, container, prefix string) ([]DestinationObject, error) {
+	args := []string{"list", "--long"}
+	if prefix != "" {
+		args = append(args, "--prefix", prefix)
+	}
+	args = append(args, container)
+	out, err := swiftCommand(ctx, region, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("swift list failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	// Lines are "size date time content-type name", then a line of totals
+	var objects []DestinationObject
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		modified, err := time.Parse("2006-01-02 15:04:05", fields[1]+" "+fields[2])
+		if err != nil {
+			continue
+		}
+		name := strings.Join(fields[4:], " ")
+		objects = append(objects, DestinationObject{Name: name, Size: size,
+			LastModified: modified.UTC().Format(time.RFC3339)})
+	}
+	return objects, nil
+}
+
+func checkSwiftCredentials(ctx context.Context) error {
+	if os.Getenv("OS_AUTH_URL") == "" {
+		return errors.New("OS_AUTH_URL is not set; pass your OpenStack RC file's OS_* variables with -e")
+	}
+	return runQuiet(swiftCommand(ctx, "", "auth"))
+}
+
+// Handler for GET /swift/containers?region=: the containers in the project
+func swiftContainersHandler(w http.ResponseWriter, r *http.Request) {
+	if os.Getenv("OS_AUTH_URL") == "" {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message:     "No OpenStack credentials",
+			Remediation: "Pass the OS_* variables from your OpenStack RC file (OS_AUTH_URL, OS_USERNAME, OS_PASSWORD, OS_PROJECT_NAME, ...) with -e."})
+		return
+	}
+	out, err := providerOutput(r.Context(), "swift", "swift", swiftArgs(r.URL.Query().Get("region"), "list")...)
+	if err != nil {
+		writeProviderError(w, err, APIError{Message: "Failed to list Swift containers",
+			Remediation: "Check the OS_* credentials and that the project has object storage in the region."})
+		return
+	}
+	var containers []string
+	for _, name := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		// Hide the containers holding large object segments
+		if name != "" && !strings.HasSuffix(name, "_segments") {
+			containers = append(containers, name)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"containers": listOrEmpty(containers)})
+}
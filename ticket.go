@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Migration tickets: when configured, each job opens a ticket in Jira or
+// ServiceNow (or posts to a webhook) when it starts, with the VM's details, and
+// adds its outcome when it finishes. A job can name an existing ticket to update
+// instead (JobSpec.Ticket), and a job linked to a migration plan entry reuses
+// the entry's ticket, so reruns for a VM land on the same ticket. Ticket calls
+// run one at a time in the background and never fail a job; errors become job
+// warnings.
+type TicketConfig struct {
+	// "jira", "servicenow" or "webhook"; empty disables tickets
+	System string `json:"system"`
+	// Jira base URL (https://example.atlassian.net), ServiceNow instance URL
+	// (https://example.service-now.com), or the webhook URL
+	URL string `json:"url"`
+	// Jira: account email and API token (or a personal access token alone).
+	// ServiceNow: user name and password. Webhook: an optional bearer token.
+	// The token defaults to PORTER_TICKET_TOKEN.
+	Username string `json:"username,omitempty"`
+	Token    string `json:"token,omitempty"`
+	// Jira project key and issue type (default Task)
+	Project   string `json:"project,omitempty"`
+	IssueType string `json:"issueType,omitempty"`
+	// ServiceNow table (default incident)
+	Table string `json:"table,omitempty"`
+	// Only update tickets named by jobs or plan entries, never open new ones
+	UpdateOnly bool `json:"updateOnly,omitempty"`
+}
+
+const ticketCallTimeout = 30 * time.Second
+
+// A job event to report to the ticket system
+type ticketEvent struct {
+	job   *Job
+	state string
+}
+
+// Ticket updates are sent in order, so a job's ticket is open before its outcome is added
+var ticketEvents = make(chan ticketEvent, 100)
+
+func ticketsEnabled() bool {
+	return config.Tickets.System != ""
+}
+
+func ticketToken() string {
+	if config.Tickets.Token != "" {
+		return config.Tickets.Token
+	}
+	return os.Getenv("PORTER_TICKET_TOKEN")
+}
+
+// Queue a ticket update for a job that started or finished
+func queueTicketUpdate(job *Job, state string) {
+	if !ticketsEnabled() {
+		return
+	}
+	select {
+	case ticketEvents <- ticketEvent{job: job, state: state}:
+	default:
+		fmt.Printf("Warning: ticket queue full, not reporting job %s %s\n", job.ID, state)
+	}
+}
+
+// Send queued ticket updates; run in the background from main
+func runTicketUpdates() {
+	for event := range ticketEvents {
+		ctx, cancel := context.WithTimeout(context.Background(), ticketCallTimeout)
+		if err := updateTicket(ctx, event.job, event.state); err != nil {
+			event.job.warnf("Updating the %s ticket failed: %s", config.Tickets.System, err)
+		}
+		cancel()
+	}
+}
+
+func updateTicket(ctx context.Context, job *Job, state string) error {
+	job.mu.Lock()
+	ticket := job.Ticket
+	job.mu.Unlock()
+	if ticket == "" {
+		ticket = job.Spec.Ticket
+	}
+	if ticket == "" {
+		ticket = migrationPlan.ticketFor(job.ID)
+	}
+	summary, details := ticketText(job, state)
+
+	var err error
+	switch config.Tickets.System {
+	case "jira":
+		ticket, err = updateJiraIssue(ctx, ticket, summary, details)
+	case "servicenow":
+		ticket, err = updateServiceNowRecord(ctx, ticket, summary, details)
+	case "webhook":
+		ticket, err = postTicketWebhook(ctx, job, ticket, state, details)
+	default:
+		return fmt.Errorf("unknown ticket system '%s' (use jira, servicenow or webhook)", config.Tickets.System)
+	}
+	if err != nil || ticket == "" {
+		return err
+	}
+	job.mu.Lock()
+	opened := job.Ticket == ""
+	job.Ticket = ticket
+	job.mu.Unlock()
+	if opened {
+		job.logf("Migration ticket: %s", ticket)
+		migrationPlan.setTicket(job.ID, ticket)
+	}
+	return nil
+}
+
+// The ticket's summary and the text to add for a job event
+func ticketText(job *Job, state string) (string, string) {
+	snap := job.snapshot()
+	vm := snap.Spec.Name
+	if vm == "" && len(snap.Files) > 0 {
+		vm = baseNameWithoutExt(snap.Files[0])
+	}
+	summary := fmt.Sprintf("Migrate VM %s to %s", vm, snap.Spec.Cloud)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Porter job %s %s.\n", snap.ID, state)
+	if snap.Spec.Source != "" {
+		fmt.Fprintf(&b, "Source: %s\n", snap.Spec.Source)
+	}
+	fmt.Fprintf(&b, "Destination: %s\n", snap.Spec.Cloud)
+	if snap.Message != "" {
+		fmt.Fprintf(&b, "\n%s\n", strings.TrimSpace(snap.Message))
+	}
+	if len(snap.Conversions) > 0 {
+		hw := hardwareForDisk(snap.Conversions[0].Input)
+		fmt.Fprintf(&b, "\nVM: %s, %d vCPU, %d MB memory, %s firmware", hw.Name, hw.CPUs, hw.MemoryMB, hw.Firmware)
+		if hw.OSType != "" {
+			fmt.Fprintf(&b, ", guest OS %s", hw.OSType)
+		}
+		b.WriteString("\nDisks:\n")
+		for _, c := range snap.Conversions {
+			fmt.Fprintf(&b, "- %s (%s, %s, sha256 %s)\n", c.Output, c.Format, c.Summary(), c.Checksum)
+		}
+	}
+	if len(snap.Results) > 0 {
+		b.WriteString("\nResults:\n")
+		for _, r := range snap.Results {
+			if r.Error != "" {
+				fmt.Fprintf(&b, "- %s: failed: %s\n", r.File, r.Error)
+				continue
+			}
+			fmt.Fprintf(&b, "- %s -> %s", r.File, r.Destination)
+			if r.Image != "" {
+				fmt.Fprintf(&b, " (image %s)", r.Image)
+			}
+			b.WriteString("\n")
+		}
+	}
+	for _, w := range snap.Warnings {
+		fmt.Fprintf(&b, "Warning: %s\n", w)
+	}
+	if snap.FinishedAt != nil && config.PublicURL != "" {
+		fmt.Fprintf(&b, "\nTransfer report: %s/api/jobs/%s/report?format=text\n", strings.TrimRight(config.PublicURL, "/"), snap.ID)
+	}
+	return summary, b.String()
+}
+
+// Authenticate a request to Jira or ServiceNow: basic auth with a user name,
+// otherwise the token as a bearer token
+func authorizeTicketRequest(req *http.Request) {
+	if config.Tickets.Username != "" {
+		req.SetBasicAuth(config.Tickets.Username, ticketToken())
+	} else if token := ticketToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func ticketRequest(ctx context.Context, method, endpoint string, body, out interface{}) error {
+	req, err := newJSONRequest(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	authorizeTicketRequest(req)
+	return doJSONRequest(req, out)
+}
+
+// Open a Jira issue, or comment on an existing one, returning its key
+func updateJiraIssue(ctx context.Context, key, summary, details string) (string, error) {
+	base := strings.TrimRight(config.Tickets.URL, "/") + "/rest/api/2/issue"
+	if key != "" {
+		return key, ticketRequest(ctx, http.MethodPost, base+"/"+url.PathEscape(key)+"/comment",
+			map[string]string{"body": details}, nil)
+	}
+	if config.Tickets.UpdateOnly {
+		return "", nil
+	}
+	issueType := config.Tickets.IssueType
+	if issueType == "" {
+		issueType = "Task"
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	err := ticketRequest(ctx, http.MethodPost, base, map[string]interface{}{
+		"fields": map[string]interface{}{
+			"project":     map[string]string{"key": config.Tickets.Project},
+			"issuetype":   map[string]string{"name": issueType},
+			"summary":     summary,
+			"description": details,
+			"labels":      []string{"porter-migration"},
+		},
+	}, &created)
+	return created.Key, err
+}
+
+var serviceNowSysID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Open a ServiceNow record, or add a work note to an existing one (by sys_id or
+// number), returning its sys_id
+func updateServiceNowRecord(ctx context.Context, id, summary, details string) (string, error) {
+	table := config.Tickets.Table
+	if table == "" {
+		table = "incident"
+	}
+	base := strings.TrimRight(config.Tickets.URL, "/") + "/api/now/table/" + url.PathEscape(table)
+	var record struct {
+		Result struct {
+			SysID string `json:"sys_id"`
+		} `json:"result"`
+	}
+	if id != "" && !serviceNowSysID.MatchString(id) {
+		var found struct {
+			Result []struct {
+				SysID string `json:"sys_id"`
+			} `json:"result"`
+		}
+		query := url.Values{"sysparm_query": {"number=" + id}, "sysparm_fields": {"sys_id"}, "sysparm_limit": {"1"}}
+		if err := ticketRequest(ctx, http.MethodGet, base+"?"+query.Encode(), nil, &found); err != nil {
+			return "", err
+		}
+		if len(found.Result) == 0 {
+			return "", fmt.Errorf("no %s record numbered %s", table, id)
+		}
+		id = found.Result[0].SysID
+	}
+	if id != "" {
+		return id, ticketRequest(ctx, http.MethodPatch, base+"/"+id, map[string]string{"work_notes": details}, &record)
+	}
+	if config.Tickets.UpdateOnly {
+		return "", nil
+	}
+	err := ticketRequest(ctx, http.MethodPost, base, map[string]string{
+		"short_description": summary,
+		"description":       details,
+	}, &record)
+	return record.Result.SysID, err
+}
+
+// Post the event to a webhook. A response with a "ticket" field names the
+// ticket the receiver opened, which later events for the job carry.
+func postTicketWebhook(ctx context.Context, job *Job, ticket, state, details string) (string, error) {
+	snap := job.snapshot()
+	payload := map[string]interface{}{
+		"event":   state,
+		"ticket":  ticket,
+		"text":    details,
+		"job":     snap,
+		"planned": migrationPlan.entryFor(job.ID),
+	}
+	if len(snap.Conversions) > 0 {
+		payload["vm"] = hardwareForDisk(snap.Conversions[0].Input)
+	}
+	req, err := newJSONRequest(ctx, http.MethodPost, config.Tickets.URL, payload)
+	if err != nil {
+		return "", err
+	}
+	if token := ticketToken(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	// Receivers that don't open tickets can answer with anything
+	var opened struct {
+		Ticket string `json:"ticket"`
+	}
+	if json.Unmarshal(data, &opened) == nil && opened.Ticket != "" {
+		return opened.Ticket, nil
+	}
+	return ticket, nil
+}
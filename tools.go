@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// Where Porter finds the command-line tools it runs (tools in porter.json).
+// paths names explicit binaries for hosts that keep them outside PATH, e.g.
+// {"qemu-img": "/opt/qemu/bin/qemu-img", "aws": "/usr/local/aws-cli/v2/current/bin/aws"}.
+// With a container, tools run in that sidecar container through
+// "docker exec -i" (or runtime, e.g. podman), so tooling can live in its own
+// image: all of them, or only those in containerTools. The sidecar must see
+// Porter's workspace (/app and the temporary directory) and the credentials
+// the tools need at the same paths, and pausing or cancelling a job stops the
+// exec client but not the tool in the sidecar. mount and umount always run in
+// Porter's container, since the mounts must be visible there.
+type ToolsConfig struct {
+	Paths          map[string]string `json:"paths,omitempty"`
+	Container      string            `json:"container,omitempty"`
+	ContainerTools []string          `json:"containerTools,omitempty"`
+	Runtime        string            `json:"runtime,omitempty"`
+}
+
+// Tools that must run where Porter runs
+var localOnlyTools = []string{"mount", "umount"}
+
+// Check the tools settings, ignoring paths that don't exist
+func (c *Config) validateTools(path string) {
+	for name, bin := range c.Tools.Paths {
+		if c.delegatesTool(name) {
+			continue
+		}
+		if info, err := os.Stat(bin); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+			fmt.Printf("Warning: tools.paths.%s '%s' in config %s is not an executable file (using %s from PATH)\n", name, bin, path, name)
+			delete(c.Tools.Paths, name)
+		}
+	}
+	if c.Tools.Container == "" {
+		return
+	}
+	if c.Tools.Runtime == "" {
+		c.Tools.Runtime = "docker"
+	}
+	which := "all tools"
+	if len(c.Tools.ContainerTools) > 0 {
+		which = strings.Join(c.Tools.ContainerTools, ", ")
+	}
+	fmt.Printf("Running %s with %s exec in container %s\n", which, c.Tools.Runtime, c.Tools.Container)
+}
+
+// Whether a tool runs in the sidecar container
+func (c *Config) delegatesTool(name string) bool {
+	if c.Tools.Container == "" || slices.Contains(localOnlyTools, name) {
+		return false
+	}
+	return len(c.Tools.ContainerTools) == 0 || slices.Contains(c.Tools.ContainerTools, name)
+}
+
+// The binary to run for a tool
+func toolPath(name string) string {
+	if bin := config.Tools.Paths[name]; bin != "" {
+		return bin
+	}
+	return name
+}
+
+// Like exec.CommandContext, running the tool where the tools settings say
+func toolCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if !config.delegatesTool(name) {
+		return exec.CommandContext(ctx, toolPath(name), args...)
+	}
+	execArgs := []string{"exec", "-i", config.Tools.Container, toolPath(name)}
+	return exec.CommandContext(ctx, config.Tools.Runtime, append(execArgs, args...)...)
+}
+
+// Set environment variables for a tool command, on top of Porter's own. Tools
+// in the sidecar get them on top of the container's own, passed on by name
+// with exec's -e so that secrets stay out of the exec command line.
+func setToolEnv(cmd *exec.Cmd, vars ...string) {
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env, vars...)
+	delegated := config.Tools.Container != "" && len(cmd.Args) > 1 &&
+		cmd.Args[0] == config.Tools.Runtime && cmd.Args[1] == "exec"
+	if !delegated {
+		return
+	}
+	var names []string
+	for _, v := range vars {
+		name, _, _ := strings.Cut(v, "=")
+		names = append(names, "-e", name)
+	}
+	cmd.Args = slices.Insert(cmd.Args, 2, names...)
+}
+
+// Whether a tool can be run: on PATH or at its configured path, or, in the
+// sidecar, whether the container runtime is
+func checkBinary(bin string) bool {
+	if config.delegatesTool(bin) {
+		_, err := exec.LookPath(config.Tools.Runtime)
+		return err == nil
+	}
+	_, err := exec.LookPath(toolPath(bin))
+	return err == nil
+}
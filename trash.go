@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+)
+
+// Trash: deleting a catalog entry moves it to the trash for trashRetentionHours
+// (porter.json, default 72; 0 deletes at once), where it can be restored until
+// a background purge deletes it for good. Files Porter wrote locally are renamed
+// aside (to <name>.trash-<id>, so file lists and catalog scans skip them);
+// artifacts at remote destinations stay where they are until purged, since few
+// destinations can move them cheaply. Deleting an entry that is already in the
+// trash, or with ?permanent=true, deletes it at once.
+
+// Destinations whose artifacts are local files or directories
+var localArtifactClouds = []string{"local", "xva", "vagrant", "bundle", "utm", "containerdisk", "incus"}
+
+// How often the trash is checked for entries due to be purged
+const trashPurgeInterval = 10 * time.Minute
+
+func (e CatalogEntry) trashed() bool {
+	return e.TrashedAt != nil
+}
+
+// Where a local artifact is kept while in the trash
+func (e CatalogEntry) trashPath() string {
+	return e.Destination + ".trash-" + e.ID
+}
+
+// Move an entry to the trash, returning it as updated
+func (c *catalog) trash(id string, retention time.Duration) (CatalogEntry, error) {
+	c.Lock()
+	defer c.Unlock()
+	i := c.index(id)
+	if i < 0 {
+		return CatalogEntry{}, fmt.Errorf("unknown catalog entry %s", id)
+	}
+	entry := c.Entries[i]
+	if slices.Contains(localArtifactClouds, entry.Cloud) {
+		if err := os.Rename(entry.Destination, entry.trashPath()); err != nil && !os.IsNotExist(err) {
+			return entry, err
+		}
+	}
+	now := time.Now().UTC()
+	purge := now.Add(retention)
+	entry.TrashedAt, entry.PurgeAt = &now, &purge
+	c.Entries[i] = entry
+	if err := c.save(); err != nil {
+		fmt.Printf("Warning: failed to save catalog: %s\n", err)
+	}
+	return entry, nil
+}
+
+// Take an entry out of the trash, returning it as restored
+func (c *catalog) restore(id string) (CatalogEntry, error) {
+	c.Lock()
+	defer c.Unlock()
+	i := c.index(id)
+	if i < 0 {
+		return CatalogEntry{}, fmt.Errorf("unknown catalog entry %s", id)
+	}
+	entry := c.Entries[i]
+	if slices.Contains(localArtifactClouds, entry.Cloud) {
+		if _, err := os.Stat(entry.Destination); err == nil {
+			return entry, fmt.Errorf("%s has been written again since it was deleted", entry.Destination)
+		}
+		if err := os.Rename(entry.trashPath(), entry.Destination); err != nil && !os.IsNotExist(err) {
+			return entry, err
+		}
+	}
+	entry.TrashedAt, entry.PurgeAt = nil, nil
+	c.Entries[i] = entry
+	if err := c.save(); err != nil {
+		fmt.Printf("Warning: failed to save catalog: %s\n", err)
+	}
+	return entry, nil
+}
+
+// Position of an entry; callers must hold the lock
+func (c *catalog) index(id string) int {
+	return slices.IndexFunc(c.Entries, func(e CatalogEntry) bool { return e.ID == id })
+}
+
+// Delete an artifact for good, from the trash if it is there
+func purgeArtifact(entry CatalogEntry) error {
+	if entry.trashed() && slices.Contains(localArtifactClouds, entry.Cloud) {
+		entry.Destination = entry.trashPath()
+	}
+	if err := deleteArtifact(entry); err != nil {
+		return err
+	}
+	artifactCatalog.remove(entry.ID)
+	return nil
+}
+
+// Purge trashed entries whose retention has passed; run in the background from main
+func runTrashPurger() {
+	for {
+		for _, entry := range artifactCatalog.list() {
+			if !entry.trashed() || time.Now().Before(*entry.PurgeAt) {
+				continue
+			}
+			fmt.Printf("Purging %s artifact %s (%s) from the trash\n", entry.Cloud, entry.ID, entry.Destination)
+			if err := purgeArtifact(entry); err != nil {
+				fmt.Printf("Warning: failed to purge %s: %s\n", entry.Destination, err)
+			}
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
+
+// Handler to take an artifact out of the trash
+func catalogRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	entry, ok := artifactCatalog.get(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown catalog entry: %s"), id)})
+		return
+	}
+	if !entry.trashed() {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict, Message: fmt.Sprintf(tr("%s is not in the trash"), entry.Destination)})
+		return
+	}
+	entry, err := artifactCatalog.restore(id)
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message: fmt.Sprintf(tr("Failed to restore %s"), entry.Destination), Details: err.Error(),
+			Remediation: "If a file has been written at that path since, move it out of the way, then retry."})
+		return
+	}
+	fmt.Printf("Restored %s from the trash\n", entry.Destination)
+	writeJSON(w, http.StatusOK, entry)
+}
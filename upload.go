@@ -0,0 +1,863 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Resolved destination settings shared by every file in an upload job
+type uploadSettings struct {
+	Cloud        string
+	Target       string
+	Subscription string
+	Container    string // "storageAccount/container"
+	Bucket       string
+	StorageClass string
+	// For clouds that import images
+	Region        string
+	ResourceGroup string
+	OSName        string
+	URL           string // WebDAV share, FTP server, NFS export, HTTP endpoint, vCenter or S3-compatible endpoint
+	PathStyle     bool
+	Host          string // rsync SSH destination
+	Username      string // SMB share credentials entered with the upload
+	Password      string
+	Datastore     string
+	ResourcePool  string
+	Network       string
+	Checksums     []string
+	Compress      string
+	Encrypt       bool
+	BandwidthMBps float64
+	// Class sharing the instance's bandwidth cap; see bandwidth.go
+	BandwidthClass string
+	CreateImage    bool
+	AWSImport      string
+	Template       bool
+	BoxProvider    string
+	ArchiveFormat  string
+	ImageRef       string
+	Version        string
+	Gallery        string
+	TargetRegions  []string
+	ShareAccounts  []string
+	// Hyper-V generation (0 follows the disk's firmware), Secure Boot and TPM
+	Generation int
+	SecureBoot *bool
+	TPM        *bool
+	Metadata   map[string]string
+	Tags       map[string]string
+	// Short-lived credentials minted for the job; see credentials.go
+	AWSSession        *awsSession
+	CredentialsExpire time.Time
+}
+
+// Apply the destination profile and expiry options to an upload request
+func resolveUploadSettings(spec JobSpec) (uploadSettings, *APIError) {
+	s := uploadSettings{
+		Cloud:          spec.Cloud,
+		Target:         spec.Target,
+		Subscription:   spec.Account,
+		Container:      spec.Container,
+		Bucket:         spec.Bucket,
+		StorageClass:   spec.StorageClass,
+		Region:         spec.Region,
+		ResourceGroup:  spec.ResourceGroup,
+		OSName:         spec.OSName,
+		URL:            spec.URL,
+		PathStyle:      spec.PathStyle,
+		Host:           spec.Host,
+		Username:       spec.Username,
+		Password:       spec.Password,
+		Datastore:      spec.Datastore,
+		ResourcePool:   spec.ResourcePool,
+		Network:        spec.Network,
+		Checksums:      spec.Checksums,
+		Compress:       spec.Compress,
+		Encrypt:        spec.Encrypt,
+		BandwidthMBps:  spec.BandwidthMBps,
+		BandwidthClass: spec.BandwidthClass,
+		CreateImage:    spec.CreateImage,
+		AWSImport:      spec.AWSImport,
+		Template:       spec.Template,
+		BoxProvider:    spec.BoxProvider,
+		ArchiveFormat:  spec.ArchiveFormat,
+		ImageRef:       spec.ImageRef,
+		Version:        spec.Version,
+		Gallery:        spec.Gallery,
+		TargetRegions:  spec.TargetRegions,
+		ShareAccounts:  spec.ShareAccounts,
+		Generation:     spec.Generation,
+		SecureBoot:     spec.SecureBoot,
+		TPM:            spec.TPM,
+	}
+
+	// Apply the selected destination profile, filling in anything the request left blank
+	expireDays := spec.ExpireDays
+	var lifecyclePrefix string
+	if spec.Profile != "" {
+		profile, ok := findDestinationProfile(spec.Profile)
+		if !ok {
+			return s, &APIError{Code: errCodeNotFound,
+				Message:     fmt.Sprintf(tr("Unknown destination profile: %s"), spec.Profile),
+				Remediation: "Use a profile defined under 'destinations' in porter.json."}
+		}
+		if profile.Cloud != "" {
+			s.Cloud = profile.Cloud
+		}
+		if s.Target == "" {
+			s.Target = profile.Target
+		}
+		if s.Bucket == "" {
+			s.Bucket = profile.Bucket
+		}
+		if s.Subscription == "" {
+			s.Subscription = profile.Account
+		}
+		if s.Container == "" {
+			s.Container = profile.Container
+		}
+		if s.StorageClass == "" {
+			s.StorageClass = profile.StorageClass
+		}
+		if s.Region == "" {
+			s.Region = profile.Region
+		}
+		if s.ResourceGroup == "" {
+			s.ResourceGroup = profile.ResourceGroup
+		}
+		if s.URL == "" {
+			s.URL = profile.URL
+		}
+		if !s.PathStyle {
+			s.PathStyle = profile.PathStyle
+		}
+		if s.Host == "" {
+			s.Host = profile.Host
+		}
+		if s.Datastore == "" {
+			s.Datastore = profile.Datastore
+		}
+		if s.ResourcePool == "" {
+			s.ResourcePool = profile.ResourcePool
+		}
+		if s.Network == "" {
+			s.Network = profile.Network
+		}
+		if len(s.Checksums) == 0 {
+			s.Checksums = profile.Checksums
+		}
+		if !s.CreateImage {
+			s.CreateImage = profile.CreateImage
+		}
+		if !s.Template {
+			s.Template = profile.Template
+		}
+		if s.BoxProvider == "" {
+			s.BoxProvider = profile.BoxProvider
+		}
+		if s.ArchiveFormat == "" {
+			s.ArchiveFormat = profile.ArchiveFormat
+		}
+		if s.BandwidthClass == "" {
+			s.BandwidthClass = profile.BandwidthClass
+		}
+		if s.Gallery == "" {
+			s.Gallery = profile.Gallery
+		}
+		if len(s.TargetRegions) == 0 {
+			s.TargetRegions = profile.TargetRegions
+		}
+		if len(s.ShareAccounts) == 0 {
+			s.ShareAccounts = profile.ShareAccounts
+		}
+		s.Metadata = profile.Metadata
+		s.Tags = profile.Tags
+		if expireDays == 0 {
+			expireDays = profile.ExpireAfterDays
+		}
+		lifecyclePrefix = profile.LifecyclePrefix
+		fmt.Printf("Using destination profile '%s' (%d metadata, %d tags)\n", spec.Profile, len(s.Metadata), len(s.Tags))
+	}
+
+	// Optionally mark the upload as a transient artifact so lifecycle rules can expire it
+	if expireDays < 0 {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     fmt.Sprintf(tr("Invalid expiry days: %d"), expireDays),
+			Remediation: "Use a whole number of days, or leave blank to keep uploads."}
+	}
+	if expireDays > 0 {
+		s.Tags = withExpiryTags(s.Tags, expireDays, time.Now())
+		if lifecyclePrefix != "" {
+			s.Target = path.Join(lifecyclePrefix, s.Target)
+		}
+		fmt.Printf("Marking upload as transient: expires after %d day(s), target '%s'\n", expireDays, s.Target)
+	}
+
+	if _, ok := findProvider(s.Cloud); !ok {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message: fmt.Sprintf(tr("Unknown cloud target: %s"), s.Cloud), Remediation: fmt.Sprintf(tr("Use one of %s."), strings.Join(providerNames(), ", "))}
+	}
+	if s.Cloud == "gcp" && s.StorageClass != "" {
+		class, ok := gcsStorageClass(s.StorageClass)
+		if !ok {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Unsupported storage class: %s"), s.StorageClass), Remediation: fmt.Sprintf(tr("Use one of %s."), strings.Join(gcsStorageClasses, ", "))}
+		}
+		s.StorageClass = class
+	}
+	checksums, apiErr := normalizeChecksums(s.Checksums)
+	if apiErr != nil {
+		return s, apiErr
+	}
+	s.Checksums = checksums
+	if apiErr := validateBandwidthClass(s); apiErr != nil {
+		return s, apiErr
+	}
+	if apiErr := validateStreamSettings(s); apiErr != nil {
+		return s, apiErr
+	}
+	if s.Cloud == "gcp" && s.CreateImage && s.OSName == "" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "Creating a Compute Engine image needs the operating system the disk contains",
+			Remediation: "Pass 'osName' as a gcloud compute images import --os value (e.g. ubuntu-2204, rhel-9, windows-2019); see 'gcloud compute images import --help'."}
+	}
+	if s.Generation != 0 && s.Generation != 1 && s.Generation != 2 {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     fmt.Sprintf(tr("Invalid generation %d"), s.Generation),
+			Remediation: "Use 1 (BIOS) or 2 (UEFI), or leave it out to follow the disk's firmware."}
+	}
+	if s.Generation == 1 && ((s.SecureBoot != nil && *s.SecureBoot) || (s.TPM != nil && *s.TPM)) {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "Secure Boot and TPMs need generation 2",
+			Remediation: "Use generation 2 for UEFI disks, or turn off secureBoot and tpm."}
+	}
+	if s.Cloud == "azure" {
+		if s.URL == "" {
+			s.URL = os.Getenv("AZURE_STORAGE_SAS_URL")
+		}
+		if s.URL != "" {
+			sas, err := parseAzureSAS(s.URL)
+			if err != nil {
+				return s, &APIError{Code: errCodeInvalidRequest, Message: err.Error(),
+					Remediation: "Pass a container SAS URL, such as https://account.blob.core.windows.net/container?sv=...&sig=..., with create and write permissions."}
+			}
+			s.Container = sas.Account + "/" + sas.Container
+		}
+	}
+	if s.Cloud == "azuredisk" && s.ResourceGroup == "" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "Uploading to an Azure managed disk needs a resource group",
+			Remediation: "Pass 'resourceGroup' to create the disk in, and optionally 'region' and 'storageClass' (the disk SKU, e.g. Premium_LRS)."}
+	}
+	if s.Cloud == "azure" && s.CreateImage && s.ResourceGroup == "" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "Creating an Azure image needs a resource group",
+			Remediation: "Pass 'resourceGroup', or leave out 'createImage' to only upload the VHD."}
+	}
+	if s.Gallery != "" {
+		if !(s.Cloud == "azure" && s.CreateImage) && s.Cloud != "azuredisk" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "Only Azure images and managed disks are published to a gallery",
+				Remediation: "Use azure with 'createImage', or azuredisk, or leave out 'gallery'."}
+		}
+		if _, ok := parseAzureGallery(s.Gallery, s.ResourceGroup); !ok {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Invalid gallery: %s"), s.Gallery),
+				Remediation: "Use gallery/definition, or resourceGroup/gallery/definition for a gallery in another resource group."}
+		}
+		if s.Version != "" && !galleryVersionPattern.MatchString(s.Version) {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Invalid gallery image version: %s"), s.Version), Remediation: "Use major.minor.patch, such as 1.4.0."}
+		}
+	} else if len(s.TargetRegions) > 0 && s.Cloud != "aws" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message: "Target regions are for gallery image versions and AMI copies", Remediation: "Pass 'gallery' as well, or leave out 'targetRegions'."}
+	}
+	if len(s.TargetRegions) > 0 || len(s.ShareAccounts) > 0 {
+		if apiErr := validateAMICopies(s); apiErr != nil {
+			return s, apiErr
+		}
+	}
+	if s.Cloud == "aws" && s.URL != "" {
+		if apiErr := validateS3EndpointURL(s.URL); apiErr != nil {
+			return s, apiErr
+		}
+		if s.CreateImage {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "AMIs can only be imported from AWS S3, not an S3-compatible endpoint",
+				Remediation: "Leave out 'url' to upload to AWS S3, or leave out 'createImage' to only upload."}
+		}
+	}
+	if s.AWSImport != "" {
+		if s.AWSImport != awsImportImage && s.AWSImport != awsImportSnapshot && s.AWSImport != awsImportEBS {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Unknown awsImport: %s"), s.AWSImport),
+				Remediation: "Use image (ec2 import-image), snapshot (import-snapshot and register-image) or ebs (EBS direct snapshot writes, without a bucket)."}
+		}
+		// An ebs upload without createImage leaves the snapshot
+		if s.Cloud != "aws" || (!s.CreateImage && s.AWSImport != awsImportEBS) {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message: "awsImport chooses how AMIs are imported", Remediation: "Use it with the aws cloud and 'createImage', or leave it out."}
+		}
+		if s.AWSImport == awsImportEBS && s.URL != "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message: "EBS snapshots are written to AWS, not an S3-compatible endpoint", Remediation: "Leave out 'url', or upload with another awsImport."}
+		}
+	}
+	if s.Cloud == "ibm" && (s.Region == "" || s.Bucket == "") {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "IBM Cloud uploads need a region and a COS bucket",
+			Remediation: "Pass 'region' (e.g. us-south) and 'bucket' (see GET /ibm/buckets)."}
+	}
+	if s.Cloud == "ibm" && s.CreateImage && s.OSName == "" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "Creating a VPC custom image needs an operating system name",
+			Remediation: "Pass 'osName' (see GET /ibm/operating-systems?region=...), or leave out 'createImage' to only upload to COS."}
+	}
+	if s.Cloud == "alibaba" && (s.Region == "" || s.Bucket == "") {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "Alibaba Cloud uploads need a region and an OSS bucket",
+			Remediation: "Pass 'region' (e.g. ap-southeast-1) and 'bucket' (see GET /alibaba/buckets)."}
+	}
+	if s.Cloud == "alibaba" && s.CreateImage && s.OSName == "" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "Importing an ECS image needs the image's platform",
+			Remediation: "Pass 'osName' with the ECS platform (e.g. Ubuntu, CentOS, Windows Server 2019), or leave out 'createImage' to only upload to OSS."}
+	}
+	if s.Cloud == "spaces" && (!spacesRegionPattern.MatchString(s.Region) || s.Bucket == "") {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "DigitalOcean Spaces uploads need a region and a Space",
+			Remediation: fmt.Sprintf(tr("Pass 'region' (one of %s) and 'bucket' with the Space name (see GET /spaces/buckets?region=...)."), strings.Join(spacesRegions, ", "))}
+	}
+	if s.Cloud == "b2" && (s.Bucket == "" || (s.Region != "" && !b2RegionPattern.MatchString(s.Region))) {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "Backblaze B2 uploads need a bucket",
+			Remediation: "Pass 'bucket' (see GET /b2/buckets), and 'region' (e.g. us-west-004) to use the S3-compatible API rather than the native one."}
+	}
+	if s.Cloud == "swift" && s.Bucket == "" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message: "Swift uploads need a container", Remediation: "Pass 'bucket' with the container name (see GET /swift/containers) and optionally 'region'."}
+	}
+	if s.Cloud == "oracle" && s.Bucket == "" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message: "OCI uploads need an Object Storage bucket", Remediation: "Pass 'bucket' (see GET /oracle/buckets) and optionally 'region'."}
+	}
+	if s.Cloud == "linode" && s.Region == "" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message: "Linode uploads need a region", Remediation: "Pass 'region', e.g. us-east or eu-west."}
+	}
+	if s.Cloud == "webdav" && s.URL == "" {
+		s.URL = os.Getenv("WEBDAV_URL")
+		if s.URL == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "WebDAV uploads need a share URL",
+				Remediation: "Pass 'url' (e.g. https://cloud.example.com/remote.php/dav/files/alice), use a webdav profile, or set WEBDAV_URL."}
+		}
+	}
+	if s.Cloud == "ftp" {
+		if s.URL == "" {
+			s.URL = os.Getenv("FTP_URL")
+		}
+		if !strings.HasPrefix(s.URL, "ftp://") && !strings.HasPrefix(s.URL, "ftps://") {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "FTP uploads need an ftp:// or ftps:// server URL",
+				Remediation: "Pass 'url' (e.g. ftp://ftp.example.com or ftps://ftp.example.com:990), use an ftp profile, or set FTP_URL."}
+		}
+	}
+	if s.Cloud == "smb" {
+		if s.URL == "" {
+			s.URL = os.Getenv("SMB_URL")
+		}
+		if _, err := parseSMBURL(s.URL); err != nil {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "SMB uploads need a share",
+				Remediation: `Pass 'url' as smb://host/share or \\host\share (e.g. smb://hyperv01/VMs), use an smb profile, or set SMB_URL.`}
+		}
+	}
+	if s.Cloud == "nfs" {
+		if s.URL == "" {
+			s.URL = os.Getenv("NFS_URL")
+		}
+		if _, err := parseNFSURL(s.URL); err != nil {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "NFS uploads need an export",
+				Remediation: "Pass 'url' as nfs://server/export or server:/export (e.g. nfs://filer01/vmstore), use an nfs profile, or set NFS_URL."}
+		}
+	}
+	if s.Cloud == "http" {
+		if s.URL == "" {
+			s.URL = os.Getenv("HTTP_UPLOAD_URL")
+		}
+		if !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "HTTP uploads need an endpoint URL",
+				Remediation: "Pass 'url' as an http(s) URL (e.g. https://images.internal/api/disks, or .../disks/{name} to place the file name), use an http profile, or set HTTP_UPLOAD_URL."}
+		}
+	}
+	if s.Cloud == "porter" {
+		if s.URL == "" {
+			s.URL = os.Getenv("PORTER_PEER_URL")
+		}
+		if !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "Porter-to-Porter transfers need the receiving Porter's URL",
+				Remediation: "Pass 'url' (e.g. https://porter.dc2.example.com), use a porter profile, or set PORTER_PEER_URL."}
+		}
+		if _, ok := cleanPeerName(path.Join(s.Target, "disk")); !ok {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Invalid folder for a Porter-to-Porter transfer: %s"), s.Target),
+				Remediation: "Use a folder relative to the receiver's directory, e.g. wave3/web01, or leave 'target' out."}
+		}
+	}
+	if s.Cloud == "artifactory" || s.Cloud == "nexus" {
+		if s.URL == "" {
+			s.URL = os.Getenv(artifactServerEnv(s.Cloud))
+		}
+		if !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") || s.Bucket == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Publishing to %s needs the server URL and a repository"), s.Cloud),
+				Remediation: fmt.Sprintf(tr("Pass 'url' (or set %s) and the repository as 'bucket', or use a %s profile."), artifactServerEnv(s.Cloud), s.Cloud)}
+		}
+		if strings.ContainsAny(s.Version, "/\\") {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Invalid version: %s"), s.Version), Remediation: "Use a version without slashes, such as 1.4.0."}
+		}
+	}
+	if s.Cloud == "rsync" && (s.Host == "" || s.Target == "") {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message:     "rsync uploads need an SSH host and a remote folder",
+			Remediation: "Pass 'host' (user@host or user@host:port) and 'target' (e.g. /var/lib/libvirt/images)."}
+	}
+	if s.Cloud == "vsphere" || s.Cloud == "datastore" {
+		if s.URL == "" {
+			s.URL = os.Getenv("GOVC_URL")
+		}
+		if s.Datastore == "" {
+			s.Datastore = os.Getenv("GOVC_DATASTORE")
+		}
+		if s.URL == "" || s.Datastore == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "vSphere uploads need a vCenter URL and a datastore",
+				Remediation: "Pass 'url' (e.g. https://vcenter.example.com/sdk) and 'datastore', use a vsphere or datastore profile, or set GOVC_URL and GOVC_DATASTORE."}
+		}
+	}
+	if s.Cloud == "proxmox" {
+		for field, env := range map[*string]string{&s.URL: "PROXMOX_URL", &s.Host: "PROXMOX_NODE", &s.Bucket: "PROXMOX_STORAGE"} {
+			if *field == "" {
+				*field = os.Getenv(env)
+			}
+		}
+		if s.URL == "" || s.Host == "" || s.Bucket == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "Proxmox uploads need the API URL, a node and a storage",
+				Remediation: "Pass 'url' (e.g. https://pve1:8006), 'host' with the node and 'bucket' with a storage that allows disk image imports, use a proxmox profile, or set PROXMOX_URL, PROXMOX_NODE and PROXMOX_STORAGE."}
+		}
+		if s.CreateImage && s.Datastore == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "Creating a Proxmox VM needs the storage for its disks",
+				Remediation: "Pass 'datastore' (e.g. local-lvm), or leave out 'createImage' to only upload the disk."}
+		}
+	}
+	if s.Cloud == "xcpng" {
+		if s.URL == "" {
+			s.URL = os.Getenv("XCPNG_URL")
+		}
+		if s.Bucket == "" {
+			s.Bucket = os.Getenv("XCPNG_SR")
+		}
+		if s.URL == "" || s.Bucket == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "XCP-ng uploads need the pool master URL and a storage repository",
+				Remediation: "Pass 'url' (e.g. https://xcp1) and 'bucket' with the SR's name or UUID, use an xcpng profile, or set XCPNG_URL and XCPNG_SR."}
+		}
+	}
+	if s.Cloud == "ovirt" {
+		for field, env := range map[*string]string{&s.URL: "OVIRT_URL", &s.Datastore: "OVIRT_STORAGE_DOMAIN", &s.ResourcePool: "OVIRT_CLUSTER"} {
+			if *field == "" {
+				*field = os.Getenv(env)
+			}
+		}
+		if s.URL == "" || s.Datastore == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "oVirt uploads need the engine URL and a storage domain",
+				Remediation: "Pass 'url' (e.g. https://engine.example.com/ovirt-engine) and 'datastore' with the storage domain, use an ovirt profile, or set OVIRT_URL and OVIRT_STORAGE_DOMAIN."}
+		}
+		if s.CreateImage && s.ResourcePool == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "Creating an oVirt VM needs a cluster",
+				Remediation: "Pass 'resourcePool' with the cluster name, set OVIRT_CLUSTER, or leave out 'createImage' to only upload the disk."}
+		}
+		if s.Template && !s.CreateImage {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "Templates are made from the VM createImage creates",
+				Remediation: "Pass 'createImage' along with 'template'."}
+		}
+	}
+	if s.Cloud == "nutanix" {
+		if s.URL == "" {
+			s.URL = os.Getenv("NUTANIX_URL")
+		}
+		if s.URL == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "Nutanix uploads need the Prism URL",
+				Remediation: "Pass 'url' (e.g. https://prism.example.com:9440), use a nutanix profile, or set NUTANIX_URL."}
+		}
+	}
+	if s.Cloud == "hyperv" {
+		for field, env := range map[*string]string{&s.URL: "HYPERV_URL", &s.Target: "HYPERV_PATH"} {
+			if *field == "" {
+				*field = os.Getenv(env)
+			}
+		}
+		if s.URL == "" || !windowsPathPattern.MatchString(s.Target) {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "Hyper-V uploads need the host's WinRM URL and a folder on the host",
+				Remediation: `Pass 'url' (e.g. https://hyperv01:5986/wsman) and 'target' with a local folder (e.g. D:\Hyper-V\web01), use a hyperv profile, or set HYPERV_URL and HYPERV_PATH.`}
+		}
+	}
+	if s.Cloud == "library" {
+		if s.URL == "" {
+			s.URL = os.Getenv("GOVC_URL")
+		}
+		if s.URL == "" || s.Bucket == "" {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     "Content library publishing needs a vCenter URL and a library",
+				Remediation: "Pass 'url' (e.g. https://vcenter.example.com/sdk) and 'bucket' with the library name, use a library profile, or set GOVC_URL."}
+		}
+	}
+	if s.Cloud == "vagrant" {
+		if s.BoxProvider == "" {
+			s.BoxProvider = "libvirt"
+		}
+		if !slices.Contains(vagrantBoxProviders, s.BoxProvider) {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Unknown Vagrant box provider '%s'"), s.BoxProvider),
+				Remediation: fmt.Sprintf(tr("Use one of: %s"), strings.Join(vagrantBoxProviders, ", "))}
+		}
+		if s.Version != "" && !vagrantVersionPattern.MatchString(s.Version) {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message: fmt.Sprintf(tr("Invalid box version: %s"), s.Version), Remediation: "Use numbers separated by dots, such as 1.4.0."}
+		}
+	}
+	if s.Cloud == "bundle-import" && spec.Source != "" {
+		return s, &APIError{Code: errCodeInvalidRequest,
+			Message: "Bundle imports take bundle paths in 'files', not a 'source'"}
+	}
+	if s.Cloud == "containerdisk" {
+		if s.ArchiveFormat == "" {
+			s.ArchiveFormat = "oci-archive"
+		}
+		if !slices.Contains(containerDiskArchiveFormats, s.ArchiveFormat) {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Unknown containerdisk archive format '%s'"), s.ArchiveFormat),
+				Remediation: fmt.Sprintf(tr("Use one of: %s"), strings.Join(containerDiskArchiveFormats, ", "))}
+		}
+	}
+	if s.Cloud == "incus" && s.ImageRef != "" {
+		if _, alias, ok := strings.Cut(s.ImageRef, ":"); (ok && alias == "") || strings.ContainsAny(s.ImageRef, " /") {
+			return s, &APIError{Code: errCodeInvalidRequest,
+				Message:     fmt.Sprintf(tr("Invalid Incus image reference '%s'"), s.ImageRef),
+				Remediation: "Use [remote:]alias, e.g. prod:web01, or leave out 'imageRef' to only write the image."}
+		}
+	}
+	switch s.Cloud {
+	case "local", "xva", "utm", "vagrant", "containerdisk", "incus", "bundle":
+		if s.Target == "" {
+			s.Target = "/data"
+		}
+	}
+	return s, nil
+}
+
+// Upload one file to AWS S3, returning the s3:// URI it was written to
+func uploadToAWS(job *Job, s uploadSettings, file string) (string, error) {
+	// Build S3 URI from selected bucket and optional target path
+	s3Uri := "s3://" + s.Bucket
+	if s.Target != "" {
+		s3Uri += "/" + strings.TrimPrefix(s.Target, "/")
+	}
+	s3Uri += "/" + filepath.Base(file)
+
+	// Get file size for progress reporting
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	service := "AWS S3"
+	if s.URL != "" {
+		service = s.URL
+	}
+	job.setStatus("Uploading %s to %s: %s (%.2f MB)",
+		filepath.Base(file), service, s3Uri, float64(fileInfo.Size())/(1024*1024))
+
+	// Use aws s3 cp with progress options
+	args := []string{"s3", "cp", "--no-progress"}
+	if len(s.Metadata) > 0 {
+		args = append(args, "--metadata", awsMetadataArg(s.Metadata))
+	}
+	// Have S3 verify and store an additional checksum of each part
+	if algorithm := s3ChecksumAlgorithm(s.Checksums); algorithm != "" {
+		args = append(args, "--checksum-algorithm", algorithm)
+	}
+	if mocked("aws") {
+		return mockUpload(job, s3Uri, file)
+	}
+	endpoint := s.s3Endpoint()
+	cmd := endpoint.command(job.ctx, append(args, file, s3Uri)...)
+
+	pending := pendingUploads.startS3(s3Uri, endpoint)
+	if err := runJobCommand(job, cmd); err != nil {
+		abandonUpload(pending)
+		return "", fmt.Errorf("AWS upload failed for %s: %w", file, err)
+	}
+	pendingUploads.finish(pending.ID)
+
+	// aws s3 cp cannot tag objects, so apply profile tags once the object exists
+	if len(s.Tags) > 0 {
+		if err := tagS3Object(endpoint, s3Uri, s.Tags); err != nil {
+			return "", fmt.Errorf("AWS upload of %s succeeded but tagging failed: %w", file, err)
+		}
+	}
+	return s3Uri, nil
+}
+
+// Upload one file to Azure Blob Storage, returning the azure:// URI it was written to
+func uploadToAzure(job *Job, s uploadSettings, file string) (string, error) {
+	if s.URL != "" {
+		return uploadToAzureSAS(job, s, file)
+	}
+	// Parse the storage account and container from the combined value
+	parts := strings.Split(s.Container, "/")
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid Azure container format '%s'. Expected 'storageAccount/container'", s.Container)
+	}
+	storageAccount := parts[0]
+	container := parts[1]
+
+	blobName := filepath.Base(file)
+	if s.Target != "" {
+		blobName = strings.TrimPrefix(s.Target, "/") + "/" + blobName
+	}
+
+	// Get file size for progress reporting
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Uploading %s to Azure: %s/%s/%s (%.2f MB)",
+		filepath.Base(file), storageAccount, container, blobName, float64(fileInfo.Size())/(1024*1024))
+
+	// Use az storage blob upload for uploading
+	args := []string{"storage", "blob", "upload",
+		"--subscription", s.Subscription,
+		"--account-name", storageAccount,
+		"--container-name", container,
+		"--auth-mode", "login",
+		"--name", blobName,
+		"--file", file}
+	if len(s.Metadata) > 0 {
+		args = append(append(args, "--metadata"), keyValuePairs(s.Metadata)...)
+	}
+	if len(s.Tags) > 0 {
+		args = append(append(args, "--tags"), keyValuePairs(s.Tags)...)
+	}
+	if azurePageBlob(s, file) {
+		args = append(args, "--type", "page")
+	}
+	blobURI := azureBlobURI(storageAccount, container, blobName)
+	if mocked("azure") {
+		return mockUpload(job, blobURI, file)
+	}
+	cmd := toolCommand(job.ctx, "az", args...)
+
+	pending := pendingUploads.start("azure", blobURI, s.Subscription)
+	if err := runJobCommand(job, cmd); err != nil {
+		abandonUpload(pending)
+		return "", fmt.Errorf("Azure upload failed for %s: %w", file, err)
+	}
+	pendingUploads.finish(pending.ID)
+	return blobURI, nil
+}
+
+// Whether to upload a file to Azure as a page blob. Images and managed disks
+// are created from page blobs, so VHDs always go up as one, and an image can
+// still be created after the upload (see azureimage.go).
+func azurePageBlob(s uploadSettings, file string) bool {
+	return s.CreateImage || strings.EqualFold(filepath.Ext(file), ".vhd")
+}
+
+// Create an Azure image from an uploaded VHD, with the Hyper-V generation the
+// disk needs. Trusted Launch (Secure Boot and vTPM) VMs can't use managed
+// images, so for those a Trusted Launch managed OS disk is created instead, to
+// create the VM from. Returns the image or disk name.
+func createAzureImage(job *Job, s uploadSettings, file, blobURI string, p vmPlatform) (string, error) {
+	if !strings.EqualFold(filepath.Ext(file), ".vhd") {
+		return "", fmt.Errorf("Azure images are created from VHDs, not %s; convert to vpc", filepath.Base(file))
+	}
+	account, container, blob, err := parseAzureBlobURI(blobURI)
+	if err != nil {
+		return "", err
+	}
+	source := joinEscapedURL("https://"+account+".blob.core.windows.net", path.Join(container, blob))
+	osType := azureOSType(job, s, file)
+	name := imageResourceName(job, file)
+	generation := fmt.Sprintf("V%d", p.Generation)
+
+	kind := "image"
+	args := []string{"image", "create", "--name", name, "--source", source}
+	if p.SecureBoot || p.TPM {
+		kind = "Trusted Launch OS disk"
+		args = []string{"disk", "create", "--name", name, "--source", source, "--security-type", "TrustedLaunch"}
+	}
+	args = append(args, "--subscription", s.Subscription, "--resource-group", s.ResourceGroup,
+		"--os-type", osType, "--hyper-v-generation", generation)
+	if s.Region != "" {
+		args = append(args, "--location", s.Region)
+	}
+	job.setStatus("Creating Azure %s %s (generation %d) from %s", kind, name, p.Generation, source)
+	if mocked("azure") {
+		if err := mockImport(job, "Azure "+kind, name, "the creation of Azure "+kind+" "+name); err != nil {
+			return "", err
+		}
+		job.logf("Azure %s %s is ready", kind, name)
+		return name, nil
+	}
+	// az waits for the creation, meanwhile its provisioning state (and, for disks,
+	// how much has been copied) shows in the job's progress
+	resource := "image"
+	if kind != "image" {
+		resource = "disk"
+	}
+	task := CloudTask{Kind: "Azure " + kind, ID: name, Status: "Submitting"}
+	poll := func(t *CloudTask) error {
+		out, err := toolCommand(job.ctx, "az", resource, "show", "--name", name, "--resource-group", s.ResourceGroup,
+			"--subscription", s.Subscription, "--query", "{state: provisioningState, percent: completionPercent}", "--output", "json").Output()
+		if err != nil {
+			return err
+		}
+		var status struct {
+			State   string   `json:"state"`
+			Percent *float64 `json:"percent"`
+		}
+		if err := json.Unmarshal(out, &status); err != nil {
+			return err
+		}
+		t.Status = status.State
+		if status.Percent != nil {
+			t.Percentage = int(*status.Percent)
+		}
+		return nil
+	}
+	if err := runCloudTaskCommand(job, toolCommand(job.ctx, "az", args...), task, poll); err != nil {
+		return "", fmt.Errorf("creating Azure %s %s from %s failed: %w", kind, name, source, err)
+	}
+	if kind != "image" {
+		job.logf("Create the VM with: az vm create -g %s -n <vm> --attach-os-disk %s --os-type %s --security-type TrustedLaunch --enable-secure-boot %t --enable-vtpm %t",
+			s.ResourceGroup, name, osType, p.SecureBoot, p.TPM)
+	}
+	job.logf("Azure %s %s is ready", kind, name)
+	return name, nil
+}
+
+// The --os-type of an Azure image or disk: osName, else from the guest
+func azureOSType(job *Job, s uploadSettings, file string) string {
+	if s.OSName != "" {
+		return s.OSName
+	}
+	hw := hardwareForDisk(file)
+	_, productName := readinessForDisk(job, file)
+	if isWindowsGuest(hw, productName) {
+		return "Windows"
+	}
+	return "Linux"
+}
+
+// Copy one file into a local directory, returning the destination path and its
+// SHA-256. The copy is read back and compared against the checksum of what was
+// written, and keeps the source's permissions and modification time, since these
+// copies often feed straight into hypervisor imports.
+func copyToLocal(job *Job, s uploadSettings, file string) (string, string, error) {
+	job.setStatus("Copying %s to local filesystem: %s", filepath.Base(file), s.Target)
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	st, err := openUploadStream(job, s, file)
+	if err != nil {
+		return "", "", err
+	}
+	defer st.Close()
+	os.MkdirAll(s.Target, 0755)
+	dst := filepath.Join(s.Target, st.Name)
+	if err := writeStreamToFile(st, dst); err != nil {
+		return "", "", fmt.Errorf("local copy failed for %s: %w", file, err)
+	}
+	_, srcSum := st.finish()
+
+	job.setStatus("Verifying checksum of %s", dst)
+	dstSum, err := hashFileForJob(job, dst)
+	if err != nil {
+		return dst, "", fmt.Errorf("failed to verify local copy %s: %w", dst, err)
+	}
+	if dstSum != srcSum {
+		return dst, "", fmt.Errorf("checksum mismatch for local copy %s: written sha256 %s, copy sha256 %s", dst, srcSum, dstSum)
+	}
+	job.logf("Verified %s (sha256 %s)", dst, dstSum)
+
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return dst, dstSum, fmt.Errorf("failed to preserve permissions on %s: %w", dst, err)
+	}
+	if err := os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		return dst, dstSum, fmt.Errorf("failed to preserve modification time on %s: %w", dst, err)
+	}
+	return dst, dstSum, nil
+}
+
+// Run a CLI command for a job, streaming its output into the job log
+func runJobCommand(job *Job, cmd *exec.Cmd) error {
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
+	}
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stderr pipe: %w", err)
+	}
+	job.attachCommand(cmd)
+	defer job.detachCommand()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start %s: %w", filepath.Base(cmd.Path), err)
+	}
+	job.commandStarted(cmd)
+
+	done := make(chan struct{}, 2)
+	logLines := func(r io.Reader) {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			job.logf("%s", scanner.Text())
+			job.progressed()
+		}
+		done <- struct{}{}
+	}
+	go logLines(stdoutPipe)
+	go logLines(stderrPipe)
+	<-done
+	<-done
+
+	err = cmd.Wait()
+	if err != nil && job.takeRestart(cmd) {
+		return runJobCommand(job, cloneCommand(job, cmd))
+	}
+	return err
+}
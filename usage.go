@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Disk usage: how much of a disk holds data. A disk provisioned at 500 GB with
+// 38 GB written is still a 500 GB RAW file, and all of it is sent unless the
+// upload is compressed (the zeros compress to almost nothing) or the disk is
+// converted to a format that leaves the empty space out (QCOW2, dynamic VHD and
+// VHDX, sparse VMDK). The image tool's map (qemu-img map) tells the data from
+// the zeros, which explains the gap between a disk's size and what it costs to
+// move, and lets estimates for compressed uploads count only the data.
+
+// Savings smaller than this are not worth a recommendation
+const usageRecommendMinSavings = 1 << 30
+
+type ImageUsage struct {
+	Path        string `json:"path"`
+	Format      string `json:"format"`
+	VirtualSize int64  `json:"virtualSize"`
+	FileSize    int64  `json:"fileSize"`
+	// Guest bytes stored in the file, and those that read as zeros (never
+	// written, discarded or zeroed)
+	DataSize    int64   `json:"dataSize"`
+	ZeroSize    int64   `json:"zeroSize"`
+	DataPercent float64 `json:"dataPercent"`
+	Extents     int     `json:"extents"`
+	// Bytes an upload sends: the file as it is, and compressed, which is at
+	// most the data since the zeros compress away
+	UploadSize           int64  `json:"uploadSize"`
+	CompressedUploadSize int64  `json:"compressedUploadSize"`
+	Recommendation       string `json:"recommendation,omitempty"`
+	Summary              string `json:"summary"`
+}
+
+func formatGB(bytes int64) string {
+	return fmt.Sprintf("%.1f GB", float64(bytes)/(1<<30))
+}
+
+// Map a disk's data and work out what uploading it sends
+func imageUsage(ctx context.Context, path string) (ImageUsage, error) {
+	usage := ImageUsage{Path: path}
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return usage, err
+	}
+	usage.FileSize = fileInfo.Size()
+	info, err := imageTools().info(ctx, path)
+	if err != nil {
+		return usage, err
+	}
+	usage.Format, usage.VirtualSize = info.Format, info.VirtualSize
+	extents, err := imageTools().extents(ctx, path)
+	if err != nil {
+		return usage, err
+	}
+	usage.Extents = len(extents)
+	for _, extent := range extents {
+		if extent.Data && !extent.Zero {
+			usage.DataSize += extent.Length
+		} else {
+			usage.ZeroSize += extent.Length
+		}
+	}
+	if usage.VirtualSize > 0 {
+		usage.DataPercent = float64(usage.DataSize) * 100 / float64(usage.VirtualSize)
+	}
+	usage.UploadSize = usage.FileSize
+	usage.CompressedUploadSize = min(usage.FileSize, usage.DataSize)
+
+	usage.Summary = fmt.Sprintf("%s of %s holds data (%.0f%%); uploading the %s file sends all of it, or at most %s compressed",
+		formatGB(usage.DataSize), formatGB(usage.VirtualSize), usage.DataPercent,
+		formatGB(usage.FileSize), formatGB(usage.CompressedUploadSize))
+	// Only files that carry their empty space gain from compressing
+	if usage.FileSize > 2*usage.DataSize && usage.FileSize-usage.DataSize >= usageRecommendMinSavings {
+		usage.Recommendation = fmt.Sprintf("Only %s of the %s file holds data: compress the upload (compress: gzip, for HTTP, WebDAV and local destinations) or convert the disk to QCOW2 to send about %s instead",
+			formatGB(usage.DataSize), formatGB(usage.FileSize), formatGB(usage.CompressedUploadSize))
+	}
+	return usage, nil
+}
+
+// Bytes an upload of a file will send: the file, or its data when compressed
+func transferSize(file, compress string) (int64, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, err
+	}
+	if compress == "" || diskFormatForPath(file) == "" || !imageTools().available() {
+		return info.Size(), nil
+	}
+	usage, err := imageUsage(context.Background(), file)
+	if err != nil {
+		return info.Size(), nil
+	}
+	return usage.CompressedUploadSize, nil
+}
+
+// Log how much of a disk a job is about to upload holds data, with the
+// recommendation when the upload would send mostly zeros
+func logImageUsage(job *Job, s uploadSettings, file string) {
+	if diskFormatForPath(file) == "" || !imageTools().available() {
+		return
+	}
+	usage, err := imageUsage(job.ctx, file)
+	if err != nil {
+		job.logf("Could not map the data in %s: %s", file, err)
+		return
+	}
+	job.logf("%s: %s", file, usage.Summary)
+	if usage.Recommendation != "" && s.Compress == "" {
+		job.logf("Tip: %s", usage.Recommendation)
+	}
+}
+
+// Handler for GET /api/usage?path=...
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeAPIError(w, http.StatusBadRequest, APIError{Code: errCodeInvalidRequest,
+			Message: "No image given", Remediation: "Pass the image's path as the 'path' query parameter."})
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Image not found: %s"), path), Details: err.Error()})
+		return
+	}
+	if tool := imageTools(); !tool.available() {
+		writeAPIError(w, http.StatusServiceUnavailable, APIError{Code: errCodeInternal,
+			Message:     fmt.Sprintf(tr("Mapping images needs %s, which is not available"), tool.name()),
+			Remediation: "Install qemu-utils in the Porter image, or set imageTool in porter.json to an image service."})
+		return
+	}
+	release, err := tryLockWorkspace("usage report", []string{path}, nil)
+	if err != nil {
+		writeAPIError(w, http.StatusConflict, APIError{Code: errCodeConflict,
+			Message: "Image in use", Details: err.Error(),
+			Remediation: "Wait for the conversion or download writing it to finish, then try again."})
+		return
+	}
+	defer release()
+
+	usage, err := imageUsage(r.Context(), path)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, APIError{Code: errCodeInternal,
+			Message: "Could not map the image", Details: err.Error(),
+			Remediation: "Check that the image is complete and readable."})
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
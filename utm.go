@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// UTM bundles for running appliances on a Mac: a <name>.utm directory holding
+// config.plist (UTM's QEMU configuration, version 4) and the disk as qcow2 under
+// Data/. The CPUs, memory and firmware come from the disk's OVF. Disks from
+// vSphere are x86_64, which UTM emulates on Apple Silicon: fine for trying an
+// appliance out, but much slower than native.
+
+// Plist values for config.plist
+type (
+	plistDict  map[string]interface{}
+	plistArray []interface{}
+)
+
+func writePlistValue(b *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		b.WriteString("<string>")
+		xml.EscapeText(b, []byte(v))
+		b.WriteString("</string>")
+	case int:
+		fmt.Fprintf(b, "<integer>%d</integer>", v)
+	case int64:
+		fmt.Fprintf(b, "<integer>%d</integer>", v)
+	case bool:
+		if v {
+			b.WriteString("<true/>")
+		} else {
+			b.WriteString("<false/>")
+		}
+	case plistArray:
+		b.WriteString("<array>")
+		for _, item := range v {
+			writePlistValue(b, item)
+		}
+		b.WriteString("</array>")
+	case plistDict:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("<dict>")
+		for _, k := range keys {
+			b.WriteString("<key>")
+			xml.EscapeText(b, []byte(k))
+			b.WriteString("</key>")
+			writePlistValue(b, v[k])
+		}
+		b.WriteString("</dict>")
+	}
+}
+
+// A locally administered MAC address for the VM's network card
+func randomMAC() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	b[0] = b[0]&0xfe | 0x02
+	return fmt.Sprintf("%02X:%02X:%02X:%02X:%02X:%02X", b[0], b[1], b[2], b[3], b[4], b[5])
+}
+
+// UTM's config.plist for an x86_64 VM booting one qcow2 disk
+func utmConfig(hw ovfHardware, diskID string) []byte {
+	// Guests from VMware rarely have virtio drivers for Windows
+	diskInterface, nic, display := "VirtIO", "virtio-net-pci", "virtio-vga"
+	if strings.Contains(strings.ToLower(hw.OSType), "windows") {
+		diskInterface, nic, display = "IDE", "e1000", "VGA"
+	}
+	config := plistDict{
+		"Backend":              "QEMU",
+		"ConfigurationVersion": 4,
+		"Information": plistDict{
+			"Name":       hw.Name,
+			"UUID":       strings.ToUpper(newUUID()),
+			"IconCustom": false,
+			"Notes":      "Converted by Porter",
+		},
+		"System": plistDict{
+			"Architecture":   "x86_64",
+			"Target":         "q35",
+			"CPU":            "default",
+			"CPUCount":       hw.CPUs,
+			"CPUFlagsAdd":    plistArray{},
+			"CPUFlagsRemove": plistArray{},
+			"ForceMulticore": false,
+			"JITCacheSize":   0,
+			"MemorySize":     hw.MemoryMB,
+		},
+		"QEMU": plistDict{
+			"AdditionalArguments": plistArray{},
+			"BalloonDevice":       false,
+			"DebugLog":            false,
+			"Hypervisor":          false,
+			"PS2Controller":       false,
+			"RNGDevice":           true,
+			"RTCLocalTime":        strings.Contains(strings.ToLower(hw.OSType), "windows"),
+			"TPMDevice":           false,
+			"TSO":                 false,
+			"UEFIBoot":            hw.Firmware == "efi",
+		},
+		"Drive": plistArray{plistDict{
+			"Identifier":       diskID,
+			"ImageName":        diskID + ".qcow2",
+			"ImageType":        "Disk",
+			"Interface":        diskInterface,
+			"InterfaceVersion": 1,
+			"ReadOnly":         false,
+		}},
+		"Display": plistArray{plistDict{
+			"Hardware":          display,
+			"DynamicResolution": true,
+			"NativeResolution":  false,
+			"DownscalingFilter": "Linear",
+			"UpscalingFilter":   "Nearest",
+		}},
+		"Network": plistArray{plistDict{
+			"Hardware":        nic,
+			"Mode":            "Shared",
+			"MacAddress":      randomMAC(),
+			"IsolateFromHost": false,
+			"PortForward":     plistArray{},
+		}},
+		"Input": plistDict{
+			"MaximumUsbShare": 3,
+			"UsbBusSupport":   "3.0",
+			"UsbSharing":      false,
+		},
+		"Sharing": plistDict{
+			"ClipboardSharing":       true,
+			"DirectoryShareMode":     "None",
+			"DirectoryShareReadOnly": false,
+		},
+		"Serial": plistArray{},
+		"Sound":  plistArray{},
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString(`<plist version="1.0">`)
+	writePlistValue(&b, config)
+	b.WriteString("</plist>\n")
+	return b.Bytes()
+}
+
+// Wrap one disk in a UTM bundle in the target directory, returning the bundle's path
+func packageUTM(job *Job, s uploadSettings, file string) (string, error) {
+	hw := hardwareForDisk(file)
+	if job.Spec.Name != "" {
+		hw.Name = job.Spec.Name
+	}
+	name := strings.ReplaceAll(hw.Name, "/", "-")
+	bundle := filepath.Join(s.Target, name+".utm")
+	if _, err := os.Stat(bundle); err == nil {
+		bundle = filepath.Join(s.Target, name+"-"+job.ID+".utm")
+	}
+	diskID := strings.ToUpper(newUUID())
+	disk := filepath.Join(bundle, "Data", diskID+".qcow2")
+	if err := os.MkdirAll(filepath.Dir(disk), 0755); err != nil {
+		return "", err
+	}
+
+	job.setStatus("Packaging %s as UTM bundle %s (%d vCPU, %d MB, %s)",
+		filepath.Base(file), bundle, hw.CPUs, hw.MemoryMB, hw.Firmware)
+	var err error
+	if strings.EqualFold(filepath.Ext(file), ".qcow2") {
+		_, err = copyFileForJob(job, file, disk)
+	} else {
+		err = convertImage(job, file, disk, "qcow2")
+	}
+	if err == nil {
+		err = os.WriteFile(filepath.Join(bundle, "config.plist"), utmConfig(hw, diskID), 0644)
+	}
+	if err != nil {
+		os.RemoveAll(bundle)
+		return "", fmt.Errorf("packaging %s as a UTM bundle failed: %w", file, err)
+	}
+	return bundle, nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Vagrant boxes: a .box is a gzipped tar of metadata.json, a Vagrantfile with the
+// VM's CPUs, memory and firmware (from the disk's OVF), and the disk. libvirt
+// boxes (vagrant-libvirt) carry the disk as box.img in qcow2; virtualbox boxes
+// carry a generated box.ovf and a streamOptimized VMDK.
+//
+// Each version is packaged as its own <name>-<version>-<provider>.box, and beside
+// the boxes, <name>.json is the box's catalog: Vagrant's versioned box metadata,
+// listing each version and provider packaged with the box's URL and SHA-256.
+// `vagrant box add <name>.json` checks the download against it, and a later
+// export of the same VM adds a version that `vagrant box outdated` finds.
+
+var vagrantBoxProviders = []string{"libvirt", "virtualbox"}
+
+// Versions Vagrant can compare, such as 1.4.0 or 20240601.120000
+var vagrantVersionPattern = regexp.MustCompile(`^\d+(\.\d+)*$`)
+
+// Vagrant's versioned box metadata
+type vagrantBoxCatalog struct {
+	Name        string              `json:"name"`
+	Description string              `json:"description,omitempty"`
+	Versions    []vagrantBoxVersion `json:"versions"`
+}
+
+type vagrantBoxVersion struct {
+	Version   string               `json:"version"`
+	Providers []vagrantBoxProvider `json:"providers"`
+}
+
+type vagrantBoxProvider struct {
+	Name         string `json:"name"`
+	URL          string `json:"url"`
+	ChecksumType string `json:"checksum_type"`
+	Checksum     string `json:"checksum"`
+}
+
+// A file to put in a tar archive: from disk if path is set, otherwise data. Names
+// ending in / are directories.
+type tarFile struct {
+	name string
+	path string
+	data []byte
+}
+
+// Package one disk as a Vagrant box in the target directory, returning the .box path
+func packageVagrantBox(job *Job, s uploadSettings, file string) (string, error) {
+	hw := hardwareForDisk(file)
+	if job.Spec.Name != "" {
+		hw.Name = job.Spec.Name
+	}
+	name := strings.ReplaceAll(hw.Name, "/", "-")
+	if err := os.MkdirAll(s.Target, 0755); err != nil {
+		return "", err
+	}
+	work, err := os.MkdirTemp(s.Target, ".porter-box-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(work)
+
+	var files []tarFile
+	switch s.BoxProvider {
+	case "virtualbox":
+		disk := filepath.Join(work, "box-disk001.vmdk")
+		job.setStatus("Converting %s to a streamOptimized VMDK for VirtualBox", filepath.Base(file))
+		if err := convertImage(job, file, disk, "vmdk", "subformat=streamOptimized"); err != nil {
+			return "", err
+		}
+		info, err := os.Stat(disk)
+		if err != nil {
+			return "", err
+		}
+		size, err := imageVirtualSize(job, disk)
+		if err != nil {
+			return "", err
+		}
+		files = []tarFile{
+			{name: "metadata.json", data: []byte(`{"provider": "virtualbox"}` + "\n")},
+			{name: "Vagrantfile", data: vagrantfile(hw, "virtualbox")},
+			{name: "box.ovf", data: virtualBoxOVF(hw, filepath.Base(disk), info.Size(), size)},
+			{name: filepath.Base(disk), path: disk},
+		}
+	default:
+		disk := filepath.Join(work, "box.img")
+		job.setStatus("Converting %s to QCOW2 for libvirt", filepath.Base(file))
+		if err := convertImage(job, file, disk, "qcow2"); err != nil {
+			return "", err
+		}
+		size, err := imageVirtualSize(job, disk)
+		if err != nil {
+			return "", err
+		}
+		metadata, _ := json.Marshal(map[string]interface{}{
+			"provider": "libvirt", "format": "qcow2", "virtual_size": (size + 1<<30 - 1) >> 30,
+		})
+		files = []tarFile{
+			{name: "metadata.json", data: append(metadata, '\n')},
+			{name: "Vagrantfile", data: vagrantfile(hw, "libvirt")},
+			{name: "box.img", path: disk},
+		}
+	}
+
+	version := artifactVersion(s, job.CreatedAt)
+	dest := filepath.Join(s.Target, name+"-"+version+"-"+s.BoxProvider+".box")
+	job.setStatus("Packaging %s as Vagrant box %s (%s, %d vCPU, %d MB)",
+		filepath.Base(file), dest, s.BoxProvider, hw.CPUs, hw.MemoryMB)
+	if err := writeBox(job, dest, files); err != nil {
+		os.Remove(dest)
+		return "", fmt.Errorf("packaging %s as a Vagrant box failed: %w", file, err)
+	}
+	if err := addToBoxCatalog(job, s, name, version, hw, dest); err != nil {
+		return dest, fmt.Errorf("updating the box catalog failed (the box is at %s): %w", dest, err)
+	}
+	return dest, nil
+}
+
+// Add a packaged box to its catalog under its version, replacing an earlier
+// export of the same version and provider (whose box file it overwrote)
+func addToBoxCatalog(job *Job, s uploadSettings, name, version string, hw ovfHardware, box string) error {
+	sums, err := checksumFileForJob(job, box, []string{"sha256"})
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(box)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.Target, name+".json")
+	catalog := vagrantBoxCatalog{Name: name}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("%s is not a box catalog: %w", path, err)
+		}
+	}
+	catalog.Description = fmt.Sprintf("%s: %d vCPU, %d MB memory, %s firmware (packaged by Porter)", hw.Name, hw.CPUs, hw.MemoryMB, hw.Firmware)
+
+	provider := vagrantBoxProvider{Name: s.BoxProvider, URL: "file://" + abs, ChecksumType: "sha256", Checksum: sums["sha256"]}
+	i := slices.IndexFunc(catalog.Versions, func(v vagrantBoxVersion) bool { return v.Version == version })
+	if i < 0 {
+		catalog.Versions = append(catalog.Versions, vagrantBoxVersion{Version: version})
+		i = len(catalog.Versions) - 1
+	}
+	providers := slices.DeleteFunc(catalog.Versions[i].Providers, func(p vagrantBoxProvider) bool { return p.Name == s.BoxProvider })
+	catalog.Versions[i].Providers = append(providers, provider)
+
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	job.logf("Box %s version %s is in catalog %s; add it with: vagrant box add %s", name, version, path, path)
+	return nil
+}
+
+// Drop a box's file from the catalog, and versions left without a provider
+func (c *vagrantBoxCatalog) dropBox(url string) {
+	var versions []vagrantBoxVersion
+	for _, v := range c.Versions {
+		v.Providers = slices.DeleteFunc(v.Providers, func(p vagrantBoxProvider) bool { return p.URL == url })
+		if len(v.Providers) > 0 {
+			versions = append(versions, v)
+		}
+	}
+	c.Versions = versions
+}
+
+// Drop a deleted box from its catalog, removing the catalog once it is empty
+func removeFromBoxCatalog(box string) error {
+	// A box purged from the trash is listed where it was packaged
+	if i := strings.Index(box, ".box.trash-"); i >= 0 {
+		box = box[:i+len(".box")]
+	}
+	abs, err := filepath.Abs(box)
+	if err != nil {
+		return err
+	}
+	base := filepath.Base(box)
+	for _, provider := range vagrantBoxProviders {
+		versioned, ok := strings.CutSuffix(base, "-"+provider+".box")
+		i := strings.LastIndex(versioned, "-")
+		if !ok || i < 0 || !vagrantVersionPattern.MatchString(versioned[i+1:]) {
+			continue
+		}
+		name := versioned[:i]
+		path := filepath.Join(filepath.Dir(box), name+".json")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil
+		}
+		var catalog vagrantBoxCatalog
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return nil
+		}
+		catalog.dropBox("file://" + abs)
+		if len(catalog.Versions) == 0 {
+			return os.Remove(path)
+		}
+		if data, err = json.MarshalIndent(catalog, "", "  "); err != nil {
+			return err
+		}
+		return os.WriteFile(path, append(data, '\n'), 0644)
+	}
+	return nil
+}
+
+// Write a gzipped tar of the box's files
+func writeBox(job *Job, dest string, files []tarFile) error {
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	if err := writeTarFiles(job, zw, files); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// Write files as a tar stream, pausable and cancellable through the job
+func writeTarFiles(job *Job, w io.Writer, files []tarFile) error {
+	tw := tar.NewWriter(w)
+	if err := addTarFiles(job, tw, files); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func addTarFiles(job *Job, tw *tar.Writer, files []tarFile) error {
+	for _, f := range files {
+		if strings.HasSuffix(f.name, "/") {
+			if err := tw.WriteHeader(&tar.Header{Name: f.name, Typeflag: tar.TypeDir, Mode: 0755, ModTime: time.Now()}); err != nil {
+				return err
+			}
+			continue
+		}
+		var r io.Reader
+		size, modTime := int64(len(f.data)), time.Now()
+		if f.path != "" {
+			src, err := os.Open(f.path)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			info, err := src.Stat()
+			if err != nil {
+				return err
+			}
+			size, modTime = info.Size(), info.ModTime()
+			r = &jobReader{job: job, r: src}
+		} else {
+			r = strings.NewReader(string(f.data))
+		}
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: size, ModTime: modTime}); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The virtual size in bytes of a disk image
+func imageVirtualSize(job *Job, image string) (int64, error) {
+	info, err := imageTools().info(job.ctx, image)
+	return info.VirtualSize, err
+}
+
+// The box's embedded Vagrantfile: hardware settings, and no synced folder since
+// migrated appliances rarely have the guest tools Vagrant mounts it with
+func vagrantfile(hw ovfHardware, provider string) []byte {
+	var b strings.Builder
+	b.WriteString("# Generated by Porter. Migrated VMs don't have Vagrant's default user, so set\n")
+	b.WriteString("# config.ssh.username (and a password or private key) in your own Vagrantfile.\n")
+	b.WriteString("Vagrant.configure(\"2\") do |config|\n")
+	b.WriteString("  config.vm.synced_folder \".\", \"/vagrant\", disabled: true\n")
+	switch provider {
+	case "virtualbox":
+		b.WriteString("  config.vm.provider :virtualbox do |vb|\n")
+		fmt.Fprintf(&b, "    vb.cpus = %d\n    vb.memory = %d\n", hw.CPUs, hw.MemoryMB)
+		if hw.Firmware == "efi" {
+			b.WriteString("    vb.customize [\"modifyvm\", :id, \"--firmware\", \"efi\"]\n")
+		}
+	default:
+		b.WriteString("  config.vm.provider :libvirt do |libvirt|\n")
+		fmt.Fprintf(&b, "    libvirt.cpus = %d\n    libvirt.memory = %d\n", hw.CPUs, hw.MemoryMB)
+		b.WriteString("    libvirt.disk_bus = \"sata\"\n")
+		if hw.Firmware == "efi" {
+			b.WriteString("    libvirt.loader = \"/usr/share/OVMF/OVMF_CODE.fd\"\n")
+		}
+	}
+	b.WriteString("  end\nend\n")
+	return []byte(b.String())
+}
+
+// A minimal OVF that VirtualBox imports: one SATA disk and a NAT network card
+func virtualBoxOVF(hw ovfHardware, diskFile string, fileSize, capacity int64) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<Envelope ovf:version="1.0" xml:lang="en-US" xmlns="http://schemas.dmtf.org/ovf/envelope/1" xmlns:ovf="http://schemas.dmtf.org/ovf/envelope/1" xmlns:rasd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_ResourceAllocationSettingData" xmlns:vssd="http://schemas.dmtf.org/wbem/wscim/1/cim-schema/2/CIM_VirtualSystemSettingData">
+  <References>
+    <File ovf:id="file1" ovf:href="%[2]s" ovf:size="%[3]d"/>
+  </References>
+  <DiskSection>
+    <Info>Virtual disks</Info>
+    <Disk ovf:diskId="vmdisk1" ovf:fileRef="file1" ovf:capacity="%[4]d" ovf:format="http://www.vmware.com/interfaces/specifications/vmdk.html#streamOptimized"/>
+  </DiskSection>
+  <NetworkSection>
+    <Info>Logical networks</Info>
+    <Network ovf:name="NAT"><Description>NAT network</Description></Network>
+  </NetworkSection>
+  <VirtualSystem ovf:id="%[1]s">
+    <Info>A virtual machine packaged by Porter</Info>
+    <OperatingSystemSection ovf:id="%[7]d">
+      <Info>The guest operating system</Info>
+    </OperatingSystemSection>
+    <VirtualHardwareSection>
+      <Info>Virtual hardware</Info>
+      <System>
+        <vssd:ElementName>Virtual Hardware Family</vssd:ElementName>
+        <vssd:InstanceID>0</vssd:InstanceID>
+        <vssd:VirtualSystemIdentifier>%[1]s</vssd:VirtualSystemIdentifier>
+        <vssd:VirtualSystemType>virtualbox-2.2</vssd:VirtualSystemType>
+      </System>
+      <Item>
+        <rasd:Caption>%[5]d virtual CPU</rasd:Caption>
+        <rasd:ElementName>%[5]d virtual CPU</rasd:ElementName>
+        <rasd:InstanceID>1</rasd:InstanceID>
+        <rasd:ResourceType>3</rasd:ResourceType>
+        <rasd:VirtualQuantity>%[5]d</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:AllocationUnits>MegaBytes</rasd:AllocationUnits>
+        <rasd:Caption>%[6]d MB of memory</rasd:Caption>
+        <rasd:ElementName>%[6]d MB of memory</rasd:ElementName>
+        <rasd:InstanceID>2</rasd:InstanceID>
+        <rasd:ResourceType>4</rasd:ResourceType>
+        <rasd:VirtualQuantity>%[6]d</rasd:VirtualQuantity>
+      </Item>
+      <Item>
+        <rasd:Caption>sataController0</rasd:Caption>
+        <rasd:ElementName>sataController0</rasd:ElementName>
+        <rasd:InstanceID>3</rasd:InstanceID>
+        <rasd:ResourceSubType>AHCI</rasd:ResourceSubType>
+        <rasd:ResourceType>20</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AddressOnParent>0</rasd:AddressOnParent>
+        <rasd:Caption>disk1</rasd:Caption>
+        <rasd:ElementName>disk1</rasd:ElementName>
+        <rasd:HostResource>/disk/vmdisk1</rasd:HostResource>
+        <rasd:InstanceID>4</rasd:InstanceID>
+        <rasd:Parent>3</rasd:Parent>
+        <rasd:ResourceType>17</rasd:ResourceType>
+      </Item>
+      <Item>
+        <rasd:AutomaticAllocation>true</rasd:AutomaticAllocation>
+        <rasd:Caption>Ethernet adapter on 'NAT'</rasd:Caption>
+        <rasd:Connection>NAT</rasd:Connection>
+        <rasd:ElementName>Ethernet adapter on 'NAT'</rasd:ElementName>
+        <rasd:InstanceID>5</rasd:InstanceID>
+        <rasd:ResourceSubType>E1000</rasd:ResourceSubType>
+        <rasd:ResourceType>10</rasd:ResourceType>
+      </Item>
+    </VirtualHardwareSection>
+  </VirtualSystem>
+</Envelope>
+`, xmlEscape(hw.Name), xmlEscape(diskFile), fileSize, capacity, hw.CPUs, hw.MemoryMB, ovfOSID(hw.OSType)))
+}
+
+// CIM operating system IDs VirtualBox maps to its guest types
+func ovfOSID(osType string) int {
+	osType = strings.ToLower(osType)
+	switch {
+	case strings.Contains(osType, "windows") && strings.Contains(osType, "64"):
+		return 103 // Microsoft Windows Server 2008 64-Bit, VirtualBox's generic 64-bit Windows
+	case strings.Contains(osType, "windows"):
+		return 1
+	case strings.Contains(osType, "64"):
+		return 101 // Linux 64-Bit
+	}
+	return 36 // Linux
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
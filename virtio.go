@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The inject-virtio guest step: a lighter alternative to virt-v2v for Windows guests.
+// Drivers come from an extracted virtio-win ISO (virtioWinDir). Storage drivers are
+// copied into System32\drivers and registered as boot-start services with critical
+// device entries, so Windows can mount its boot disk on virtio instead of failing
+// with INACCESSIBLE_BOOT_DEVICE (0x7B). All drivers are also staged in
+// C:\Windows\Drivers\VirtIO and installed with pnputil at first boot.
+
+// Boot-critical storage drivers and the PCI device IDs they serve
+var virtioBootDrivers = map[string][]string{
+	"viostor": {"1001", "1042"},
+	"vioscsi": {"1004", "1048"},
+}
+
+var virtioStagedDrivers = []string{"viostor", "vioscsi", "NetKVM", "Balloon"}
+
+// virtio-win directory names to try for a Windows release, most specific first
+func virtioWindowsDirs(guest guestOS) []string {
+	server := strings.Contains(guest.ProductName, "Server")
+	version := fmt.Sprintf("%d.%d", guest.MajorVersion, guest.MinorVersion)
+	switch {
+	case version == "6.1" && server:
+		return []string{"2k8R2"}
+	case version == "6.1":
+		return []string{"w7"}
+	case version == "6.2" && server:
+		return []string{"2k12"}
+	case version == "6.2":
+		return []string{"w8"}
+	case version == "6.3" && server:
+		return []string{"2k12R2"}
+	case version == "6.3":
+		return []string{"w8.1"}
+	case guest.MajorVersion == 10 && server:
+		for _, release := range []string{"2025", "2022", "2019", "2016"} {
+			if strings.Contains(guest.ProductName, release) {
+				dirs := []string{"2k" + release[2:]}
+				if release == "2025" {
+					dirs = append(dirs, "2k22")
+				}
+				return dirs
+			}
+		}
+		return []string{"2k22", "2k19", "2k16"}
+	case guest.MajorVersion == 10:
+		if strings.Contains(guest.ProductName, "Windows 11") {
+			return []string{"w11", "w10"}
+		}
+		return []string{"w10"}
+	}
+	return nil
+}
+
+// Find a driver's directory for the guest, e.g. <virtioWinDir>/viostor/w10/amd64
+func virtioDriverDir(driver string, guest guestOS) (string, bool) {
+	arch := "amd64"
+	if guest.Arch == "i386" || guest.Arch == "i686" {
+		arch = "x86"
+	}
+	for _, dir := range virtioWindowsDirs(guest) {
+		path := filepath.Join(config.VirtioWinDir, driver, dir, arch)
+		if info, err := os.Stat(path); err == nil && info.IsDir() {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+func virtioArgs(job *Job, guest guestOS) ([]string, error) {
+	if guest.Name != "windows" {
+		return nil, nil
+	}
+	if len(virtioWindowsDirs(guest)) == 0 {
+		return nil, fmt.Errorf("no virtio-win drivers for %s (Windows %d.%d)", guest.ProductName, guest.MajorVersion, guest.MinorVersion)
+	}
+
+	args := []string{"--mkdir", "/Windows/Drivers/VirtIO"}
+	for _, driver := range virtioStagedDrivers {
+		dir, ok := virtioDriverDir(driver, guest)
+		if !ok {
+			if _, boot := virtioBootDrivers[driver]; boot {
+				return nil, fmt.Errorf("%s driver for %s not found under %s; extract the virtio-win ISO there", driver, guest.ProductName, config.VirtioWinDir)
+			}
+			job.logf("virtio-win has no %s driver for %s, skipping it", driver, guest.ProductName)
+			continue
+		}
+		staged := "/Windows/Drivers/VirtIO/" + driver
+		args = append(args, "--mkdir", staged, "--copy-in", dir+":"+staged)
+		if _, boot := virtioBootDrivers[driver]; boot {
+			sys := filepath.Join(dir, driver+".sys")
+			args = append(args, "--upload", sys+":/Windows/System32/drivers/"+driver+".sys")
+		}
+	}
+	args = append(args, "--firstboot-command",
+		`pnputil.exe /add-driver C:\Windows\Drivers\VirtIO\*.inf /subdirs /install`)
+	return args, nil
+}
+
+// Registry entries that load the storage drivers at boot for virtio disks
+func virtioRegistry() string {
+	var b strings.Builder
+	b.WriteString("Windows Registry Editor Version 5.00\r\n")
+	for _, driver := range []string{"viostor", "vioscsi"} {
+		fmt.Fprintf(&b, "\r\n[HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Services\\%s]\r\n", driver)
+		b.WriteString("\"Type\"=dword:00000001\r\n\"Start\"=dword:00000000\r\n\"ErrorControl\"=dword:00000001\r\n")
+		b.WriteString("\"Group\"=\"SCSI miniport\"\r\n")
+		fmt.Fprintf(&b, "\"ImagePath\"=\"system32\\\\drivers\\\\%s.sys\"\r\n", driver)
+		for _, device := range virtioBootDrivers[driver] {
+			fmt.Fprintf(&b, "\r\n[HKEY_LOCAL_MACHINE\\SYSTEM\\CurrentControlSet\\Control\\CriticalDeviceDatabase\\pci#ven_1af4&dev_%s]\r\n", device)
+			fmt.Fprintf(&b, "\"Service\"=\"%s\"\r\n", driver)
+			b.WriteString("\"ClassGUID\"=\"{4D36E97B-E325-11CE-BFC1-08002BE10318}\"\r\n")
+		}
+	}
+	return b.String()
+}
+
+// Merge the boot driver registry entries into the guest's SYSTEM hive
+func mergeVirtioRegistry(job *Job, guest guestOS, image, format string) error {
+	regFile, err := os.CreateTemp("", "porter-virtio-*.reg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(regFile.Name())
+	_, err = regFile.WriteString(virtioRegistry())
+	regFile.Close()
+	if err != nil {
+		return err
+	}
+
+	job.setStatus("Registering virtio boot drivers in %s", filepath.Base(image))
+	cmd := toolCommand(job.ctx, "virt-win-reg", "--format", format, "--merge", image, regFile.Name())
+	if err := runJobCommand(job, cmd); err != nil {
+		return fmt.Errorf("virt-win-reg failed for %s: %w", image, err)
+	}
+	return nil
+}
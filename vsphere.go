@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// VMware vSphere: OVAs are deployed to a vCenter with ImportVApp and
+// streamOptimized VMDKs uploaded to a datastore, through govc (the govmomi CLI).
+// The datastore target copies any disk file into a datastore folder as it is,
+// for moving images between clusters or staging them for later use.
+// The vCenter comes from the request, a vsphere or datastore destination profile
+// or GOVC_URL; credentials from the profile or GOVC_USERNAME and GOVC_PASSWORD
+// (set GOVC_INSECURE=1 for self-signed certificates).
+
+// A govc command against a vCenter, with the profile's credentials if it has them
+func govcCommand(ctx context.Context, endpoint string, args ...string) *exec.Cmd {
+	cmd := toolCommand(ctx, "govc", args...)
+	if endpoint != "" {
+		setToolEnv(cmd, "GOVC_URL="+endpoint)
+		for _, cloud := range []string{"vsphere", "datastore", "library"} {
+			if user, pass, ok := profileCredentials(cloud, endpoint); ok {
+				setToolEnv(cmd, "GOVC_USERNAME="+user, "GOVC_PASSWORD="+pass)
+				break
+			}
+		}
+	}
+	return cmd
+}
+
+// VM names are unique per folder; include the job ID so repeated moves don't collide
+func vsphereVMName(job *Job, file string) string {
+	name := job.Spec.Name
+	if name == "" {
+		name = baseNameWithoutExt(file)
+	}
+	return name + "-" + job.ID
+}
+
+// Deploy an OVA/OVF as a VM, or upload a VMDK to a datastore. Returns the VM's
+// inventory name or the disk's datastore path, and the VM name for OVAs.
+func uploadToVSphere(job *Job, s uploadSettings, file string) (string, string, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	placement := []string{"-ds=" + s.Datastore}
+	if s.ResourcePool != "" {
+		placement = append(placement, "-pool="+s.ResourcePool)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(file)); ext {
+	case ".ova", ".ovf":
+		name := vsphereVMName(job, file)
+		options, err := vsphereImportOptions(job, s, file, name)
+		if err != nil {
+			return "", "", err
+		}
+		defer os.Remove(options)
+
+		args := append([]string{"import." + ext[1:], "-options=" + options, "-name=" + name}, placement...)
+		if s.Target != "" {
+			args = append(args, "-folder="+s.Target)
+		}
+		job.setStatus("Deploying %s to vCenter as VM %s (%.2f MB)",
+			filepath.Base(file), name, float64(info.Size())/(1024*1024))
+		if err := runJobCommand(job, govcCommand(job.ctx, s.URL, append(args, file)...)); err != nil {
+			return "", "", fmt.Errorf("deploying %s to vCenter failed: %w", file, err)
+		}
+		return name, name, nil
+	case ".vmdk":
+		args := append([]string{"import.vmdk", "-force"}, placement...)
+		args = append(args, file)
+		if s.Target != "" {
+			args = append(args, strings.Trim(s.Target, "/"))
+		}
+		dest := fmt.Sprintf("[%s] %s", s.Datastore, path.Join(strings.Trim(s.Target, "/"), filepath.Base(file)))
+		job.setStatus("Uploading %s to datastore %s (%.2f MB)",
+			filepath.Base(file), dest, float64(info.Size())/(1024*1024))
+		if err := runJobCommand(job, govcCommand(job.ctx, s.URL, args...)); err != nil {
+			return "", "", fmt.Errorf("uploading %s to datastore %s failed: %w", file, s.Datastore, err)
+		}
+		return dest, "", nil
+	}
+	return "", "", fmt.Errorf("vSphere imports OVA, OVF or VMDK files, not %s; convert to VMDK", filepath.Base(file))
+}
+
+// Copy a disk file into a datastore folder as it is, returning its datastore
+// path ("[datastore] folder/file"). A VMDK descriptor is copied with its flat
+// extent, so the pair can be attached to a VM; the copy's size is checked
+// afterwards.
+func uploadToDatastore(job *Job, s uploadSettings, file string) (string, error) {
+	folder := strings.Trim(s.Target, "/")
+	if folder != "" {
+		if err := runJobCommand(job, govcCommand(job.ctx, s.URL, "datastore.mkdir", "-p", "-ds="+s.Datastore, folder)); err != nil {
+			return "", fmt.Errorf("creating folder %s on datastore %s failed: %w", folder, s.Datastore, err)
+		}
+	}
+	files := []string{file}
+	if flat := strings.TrimSuffix(file, filepath.Ext(file)) + "-flat.vmdk"; strings.EqualFold(filepath.Ext(file), ".vmdk") {
+		if _, err := os.Stat(flat); err == nil {
+			files = append(files, flat)
+		}
+	}
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return "", fmt.Errorf("failed to get file info for %s: %w", f, err)
+		}
+		remote := path.Join(folder, filepath.Base(f))
+		job.setStatus("Copying %s to datastore [%s] %s (%.2f MB)",
+			filepath.Base(f), s.Datastore, remote, float64(info.Size())/(1024*1024))
+		if err := runJobCommand(job, govcCommand(job.ctx, s.URL, "datastore.upload", "-ds="+s.Datastore, f, remote)); err != nil {
+			return "", fmt.Errorf("copying %s to datastore %s failed: %w", f, s.Datastore, err)
+		}
+		objects, err := listDatastoreObjects(job.ctx, s.URL, s.Datastore, remote)
+		if err != nil {
+			return "", fmt.Errorf("checking the copy of %s failed: %w", f, err)
+		}
+		if len(objects) != 1 || objects[0].Size != info.Size() {
+			return "", fmt.Errorf("copy of %s on datastore %s is incomplete", f, s.Datastore)
+		}
+	}
+	return fmt.Sprintf("[%s] %s", s.Datastore, path.Join(folder, filepath.Base(file))), nil
+}
+
+// Write govc import options for an OVA: its name, networks mapped to the chosen
+// network, and left powered off
+func vsphereImportOptions(job *Job, s uploadSettings, file, name string) (string, error) {
+	out, err := govcCommand(job.ctx, s.URL, "import.spec", file).Output()
+	if err != nil {
+		return "", fmt.Errorf("reading the OVF of %s failed: %w", file, err)
+	}
+	var options map[string]interface{}
+	if err := json.Unmarshal(out, &options); err != nil {
+		return "", fmt.Errorf("unexpected govc import.spec output: %w", err)
+	}
+	options["Name"] = name
+	options["PowerOn"] = false
+	if mappings, ok := options["NetworkMapping"].([]interface{}); ok && s.Network != "" {
+		for _, m := range mappings {
+			if mapping, ok := m.(map[string]interface{}); ok {
+				mapping["Network"] = s.Network
+			}
+		}
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", "porter-import-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Remove a datastore file ("[datastore] path") or destroy a deployed VM
+func deleteVSphereArtifact(endpoint, dest string) error {
+	var cmd *exec.Cmd
+	if ds, file, ok := strings.Cut(strings.TrimPrefix(dest, "["), "] "); ok && strings.HasPrefix(dest, "[") {
+		cmd = govcCommand(context.Background(), endpoint, "datastore.rm", "-ds="+ds, "-f", file)
+	} else {
+		cmd = govcCommand(context.Background(), endpoint, "vm.destroy", dest)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w\nOutput: %s", err, out)
+	}
+	return nil
+}
+
+// Remove a file copied to a datastore, with the flat extent of a VMDK descriptor
+func deleteDatastoreFile(endpoint, dest string) error {
+	if err := deleteVSphereArtifact(endpoint, dest); err != nil {
+		return err
+	}
+	if !strings.HasSuffix(strings.ToLower(dest), ".vmdk") {
+		return nil
+	}
+	// -f ignores a missing extent
+	return deleteVSphereArtifact(endpoint, strings.TrimSuffix(dest, filepath.Ext(dest))+"-flat.vmdk")
+}
+
+// List the files in a datastore folder
+func listDatastoreObjects(ctx context.Context, endpoint, datastore, prefix string) ([]DestinationObject, error) {
+	out, err := govcCommand(ctx, endpoint, "datastore.ls", "-json", "-l", "-ds="+datastore, prefix).Output()
+	if err != nil {
+		return nil, fmt.Errorf("govc datastore.ls failed: %w", err)
+	}
+	var results []struct {
+		File []struct {
+			Path         string
+			FileSize     int64
+			Modification string
+		}
+	}
+	if err := json.Unmarshal(out, &results); err != nil {
+		return nil, fmt.Errorf("failed to parse datastore listing: %w", err)
+	}
+	var objects []DestinationObject
+	for _, r := range results {
+		for _, f := range r.File {
+			objects = append(objects, DestinationObject{Name: path.Join(prefix, f.Path), Size: f.FileSize, LastModified: f.Modification})
+		}
+	}
+	return objects, nil
+}
+
+func checkVSphereCredentials(ctx context.Context) error {
+	endpoint := os.Getenv("GOVC_URL")
+	if endpoint == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "vsphere" && profile.URL != "" {
+				endpoint = profile.URL
+				break
+			}
+		}
+	}
+	if endpoint == "" {
+		return errors.New("no vCenter configured; set GOVC_URL or add a vsphere destination profile")
+	}
+	return runQuiet(govcCommand(ctx, endpoint, "about"))
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Vultr snapshots: Vultr creates a snapshot by fetching a raw image from a URL,
+// so Porter publishes the file on a temporary link (see exports.go) for the
+// duration of the import. Needs an API key in VULTR_API_KEY and publicURL set to
+// an address Vultr can reach.
+
+const vultrAPI = "https://api.vultr.com/v2"
+
+// How long Vultr has to fetch and process an image
+const vultrImportTimeout = 6 * time.Hour
+
+func vultrToken() (string, error) {
+	token := os.Getenv("VULTR_API_KEY")
+	if token == "" {
+		return "", errors.New("VULTR_API_KEY is not set")
+	}
+	return token, nil
+}
+
+// Create a Vultr snapshot from one raw image, returning the snapshot ID
+func uploadToVultr(job *Job, s uploadSettings, file string) (string, error) {
+	token, err := vultrToken()
+	if err != nil {
+		return "", err
+	}
+	if err := requireRawImage(file, "Vultr"); err != nil {
+		return "", err
+	}
+	link, revoke, err := createExportLink(file, vultrImportTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer revoke()
+
+	job.setStatus("Creating Vultr snapshot from %s", filepath.Base(file))
+	var created struct {
+		Snapshot struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"snapshot"`
+	}
+	request := map[string]string{
+		"url":         link,
+		"description": vultrSnapshotDescription(job, file),
+	}
+	if err := jsonAPIRequest(job.ctx, http.MethodPost, vultrAPI+"/snapshots/create-from-url", token, request, &created); err != nil {
+		return "", fmt.Errorf("creating Vultr snapshot from %s failed: %w", file, err)
+	}
+	id := created.Snapshot.ID
+	job.logf("Vultr is fetching %s into snapshot %s", filepath.Base(file), id)
+
+	deadline := time.Now().Add(vultrImportTimeout)
+	for {
+		select {
+		case <-job.ctx.Done():
+			return "", job.ctx.Err()
+		case <-time.After(30 * time.Second):
+		}
+		var snapshot struct {
+			Snapshot struct {
+				Status string `json:"status"`
+			} `json:"snapshot"`
+		}
+		if err := jsonAPIRequest(job.ctx, http.MethodGet, vultrAPI+"/snapshots/"+id, token, nil, &snapshot); err != nil {
+			return "", fmt.Errorf("checking Vultr snapshot %s failed: %w", id, err)
+		}
+		switch snapshot.Snapshot.Status {
+		case "complete":
+			job.logf("Vultr snapshot %s is complete", id)
+			return id, nil
+		case "failed":
+			return "", fmt.Errorf("Vultr could not create snapshot %s from %s; check that publicURL is reachable from the internet", id, file)
+		}
+		job.setStatus("Vultr snapshot %s is %s", id, snapshot.Snapshot.Status)
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("Vultr snapshot %s was still %s after %s", id, snapshot.Snapshot.Status, vultrImportTimeout)
+		}
+	}
+}
+
+func vultrSnapshotDescription(job *Job, file string) string {
+	name := job.Spec.Name
+	if name == "" {
+		name = filepath.Base(file)
+	}
+	return name + " (Porter job " + job.ID + ")"
+}
+
+func deleteVultrSnapshot(id string) error {
+	token, err := vultrToken()
+	if err != nil {
+		return err
+	}
+	return jsonAPIRequest(context.Background(), http.MethodDelete, vultrAPI+"/snapshots/"+id, token, nil, nil)
+}
+
+func checkVultrCredentials(ctx context.Context) error {
+	token, err := vultrToken()
+	if err != nil {
+		return err
+	}
+	if config.PublicURL == "" {
+		return errors.New("publicURL is not set in porter.json, so Vultr cannot fetch images")
+	}
+	return jsonAPIRequest(ctx, http.MethodGet, vultrAPI+"/account", token, nil, nil)
+}
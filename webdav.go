@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// WebDAV shares (Nextcloud, ownCloud, or any WebDAV server): files are PUT under
+// the share URL, creating the target path with MKCOL. Credentials come from the
+// destination profile whose url the share is under, or WEBDAV_USERNAME and
+// WEBDAV_PASSWORD. For Nextcloud, the share URL is
+// https://<host>/remote.php/dav/files/<user> and the password an app password.
+//
+// Nextcloud and ownCloud limit the size of a single PUT (and proxies in front
+// of them often do too), so files larger than webdavChunkSize on such a share
+// are sent as chunks to an upload folder under remote.php/dav/uploads/<user>,
+// which the server assembles when the folder's .file is moved into place. The
+// upload folder is named after the destination and the local file's size and
+// modification time, so a failed job's rerun skips the chunks already there.
+
+const (
+	webdavChunkSize = 64 << 20
+	// Tries per chunk before the upload fails
+	webdavChunkAttempts = 3
+)
+
+// Nextcloud and ownCloud share URLs, .../remote.php/dav/files/<user>, and the
+// user's upload folders
+var (
+	webdavFilesURL   = regexp.MustCompile(`^(.*/remote\.php/dav)/files/([^/]+)`)
+	webdavUploadsURL = regexp.MustCompile(`^(.*/remote\.php/dav)/uploads/([^/]+)`)
+)
+
+// The username and password to use for a WebDAV URL
+func webdavCredentials(rawURL string) (string, string) {
+	// Chunks go to the user's upload folders, with the credentials for their files
+	rawURL = webdavUploadsURL.ReplaceAllString(rawURL, "$1/files/$2")
+	if user, pass, ok := profileCredentials("webdav", rawURL); ok {
+		return user, pass
+	}
+	return os.Getenv("WEBDAV_USERNAME"), os.Getenv("WEBDAV_PASSWORD")
+}
+
+// Send a WebDAV request, turning error statuses into errors carrying the response body
+func webdavRequest(ctx context.Context, method, rawURL string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if user, pass := webdavCredentials(rawURL); user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, fmt.Errorf("%s %s: %s: %s", method, rawURL, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// Create each collection along a path under the share; existing ones answer 405
+func webdavMkcolAll(ctx context.Context, share, dir string) error {
+	current := ""
+	for _, segment := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		current = path.Join(current, segment)
+		resp, err := webdavRequest(ctx, "MKCOL", joinEscapedURL(share, current)+"/", nil, nil)
+		if err != nil && (resp == nil || resp.StatusCode != http.StatusMethodNotAllowed) {
+			return fmt.Errorf("creating folder %s failed: %w", current, err)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	return nil
+}
+
+// Upload one file to a WebDAV share, returning the URL it was written to
+func uploadToWebDAV(job *Job, s uploadSettings, file string) (string, error) {
+	if err := webdavMkcolAll(job.ctx, s.URL, s.Target); err != nil {
+		return "", err
+	}
+	st, err := openUploadStream(job, s, file)
+	if err != nil {
+		return "", err
+	}
+	defer st.Close()
+	dest := joinEscapedURL(s.URL, path.Join(s.Target, st.Name))
+	info, err := st.f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+	}
+	job.setStatus("Uploading %s to WebDAV: %s (%.2f MB)",
+		filepath.Base(file), dest, float64(info.Size())/(1024*1024))
+	// Chunks are resumed from the file itself, so compressed and encrypted
+	// uploads go in one PUT
+	if m := webdavFilesURL.FindStringSubmatch(s.URL); m != nil && info.Size() > webdavChunkSize && !st.transformed() {
+		uploads := m[1] + "/uploads/" + m[2]
+		if err := uploadWebDAVChunks(job, st, info, uploads, dest); err != nil {
+			return "", fmt.Errorf("WebDAV upload failed for %s: %w", file, err)
+		}
+		return dest, nil
+	}
+
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPut, dest, st)
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = st.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	// Nextcloud and ownCloud keep the original modification time when told it
+	req.Header.Set("X-OC-Mtime", fmt.Sprint(info.ModTime().Unix()))
+	if user, pass := webdavCredentials(dest); user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("WebDAV upload failed for %s: %w", file, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("WebDAV upload failed for %s: %s: %s", file, resp.Status, strings.TrimSpace(string(data)))
+	}
+	st.finish()
+	return dest, nil
+}
+
+// Upload a file in chunks to a Nextcloud/ownCloud upload folder and have the
+// server assemble it at dest, skipping chunks an earlier attempt already sent
+func uploadWebDAVChunks(job *Job, st *uploadStream, info os.FileInfo, uploads, dest string) error {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s %d %d", dest, info.Size(), info.ModTime().UnixNano())))
+	folder := uploads + "/porter-" + hex.EncodeToString(sum[:8])
+	destination := http.Header{"Destination": {dest}}
+	resp, err := webdavRequest(job.ctx, "MKCOL", folder, nil, destination)
+	if err != nil && (resp == nil || resp.StatusCode != http.StatusMethodNotAllowed) {
+		return fmt.Errorf("creating upload folder failed: %w", err)
+	}
+	if err == nil {
+		resp.Body.Close()
+	}
+
+	// Chunks already on the server, by name
+	sent := map[string]int64{}
+	if existing, err := listWebDAVObjects(job.ctx, folder, ""); err == nil {
+		for _, chunk := range existing {
+			sent[chunk.Name] = chunk.Size
+		}
+	}
+	chunks := (info.Size() + webdavChunkSize - 1) / webdavChunkSize
+	if len(sent) > 0 {
+		job.logf("Resuming chunked upload of %s: %d of %d chunks already sent", filepath.Base(dest), len(sent), chunks)
+	}
+	for n := int64(1); n <= chunks; n++ {
+		offset := (n - 1) * webdavChunkSize
+		size := min(int64(webdavChunkSize), info.Size()-offset)
+		// Zero-padded so the chunks sort in order on servers that assemble them by name
+		name := fmt.Sprintf("%05d", n)
+		if sent[name] == size {
+			continue
+		}
+		if n%10 == 1 || n == chunks {
+			job.setStatus("Uploading %s to WebDAV: chunk %d of %d", filepath.Base(dest), n, chunks)
+		}
+		for attempt := 1; ; attempt++ {
+			err = putWebDAVChunk(job, st.throttled(io.NewSectionReader(st.f, offset, size)), size, folder+"/"+name, dest)
+			if err == nil || job.ctx.Err() != nil || attempt == webdavChunkAttempts {
+				break
+			}
+			job.logf("Chunk %d of %s failed (%s); retrying", n, filepath.Base(dest), err)
+		}
+		if err != nil {
+			return fmt.Errorf("chunk %d of %d: %w", n, chunks, err)
+		}
+	}
+
+	job.setStatus("Assembling %s on the WebDAV server", filepath.Base(dest))
+	destination.Set("OC-Total-Length", fmt.Sprint(info.Size()))
+	destination.Set("X-OC-Mtime", fmt.Sprint(info.ModTime().Unix()))
+	resp, err = webdavRequest(job.ctx, "MOVE", folder+"/.file", nil, destination)
+	if err != nil {
+		return fmt.Errorf("assembling the chunks failed: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func putWebDAVChunk(job *Job, r io.Reader, size int64, chunkURL, dest string) error {
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPut, chunkURL, &jobReader{job: job, r: r})
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Destination", dest)
+	if user, pass := webdavCredentials(chunkURL); user != "" {
+		req.SetBasicAuth(user, pass)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
+func deleteWebDAVFile(rawURL string) error {
+	resp, err := webdavRequest(context.Background(), http.MethodDelete, rawURL, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// The parts of a PROPFIND multistatus response Porter reads
+type webdavMultistatus struct {
+	Responses []struct {
+		Href string `xml:"href"`
+		Prop struct {
+			Size         int64     `xml:"getcontentlength"`
+			LastModified string    `xml:"getlastmodified"`
+			Collection   *struct{} `xml:"resourcetype>collection"`
+		} `xml:"propstat>prop"`
+	} `xml:"response"`
+}
+
+// List the files in a folder of a WebDAV share
+func listWebDAVObjects(ctx context.Context, share, prefix string) ([]DestinationObject, error) {
+	folder := joinEscapedURL(share, prefix) + "/"
+	resp, err := webdavRequest(ctx, "PROPFIND", folder, strings.NewReader(
+		`<?xml version="1.0"?><d:propfind xmlns:d="DAV:"><d:prop><d:getcontentlength/><d:getlastmodified/><d:resourcetype/></d:prop></d:propfind>`),
+		http.Header{"Depth": {"1"}, "Content-Type": {"application/xml"}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var listing webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&listing); err != nil {
+		return nil, fmt.Errorf("failed to parse WebDAV listing: %w", err)
+	}
+	var objects []DestinationObject
+	for _, r := range listing.Responses {
+		if r.Prop.Collection != nil {
+			continue
+		}
+		name, err := url.PathUnescape(path.Base(r.Href))
+		if err != nil {
+			name = path.Base(r.Href)
+		}
+		objects = append(objects, DestinationObject{
+			Name:         path.Join(prefix, name),
+			Size:         r.Prop.Size,
+			LastModified: r.Prop.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+// WebDAV has no account-wide check; confirm some share is configured and reachable
+func checkWebDAVCredentials(ctx context.Context) error {
+	share := os.Getenv("WEBDAV_URL")
+	if share == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "webdav" && profile.URL != "" {
+				share = profile.URL
+				break
+			}
+		}
+	}
+	if share == "" {
+		return errors.New("no WebDAV share configured; set WEBDAV_URL or add a webdav destination profile")
+	}
+	_, err := listWebDAVObjects(ctx, share, "")
+	return err
+}
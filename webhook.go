@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Webhook delivery: each notification posted to the webhook carries a
+// delivery ID, kept across retries so receivers can drop duplicates, and with
+// a secret set an HMAC-SHA256 signature of its timestamp and body, so
+// receivers can check it came from Porter and reject replays. Deliveries that
+// fail on network errors, timeouts, 429s or 5xx responses are retried with
+// exponential backoff (honouring Retry-After); those that still fail, or that
+// the receiver rejects outright, go to a dead-letter log in the state
+// directory, where they can be listed and redelivered through the API.
+
+const (
+	// The first retry's delay, doubling for each retry after it
+	webhookBackoff    = 10 * time.Second
+	webhookMaxBackoff = 5 * time.Minute
+	// Dead letters kept; the oldest go first
+	deadLetterLimit = 200
+)
+
+// A notification to post to the webhook
+type webhookDelivery struct {
+	ID      string
+	URL     string
+	Payload json.RawMessage
+}
+
+// A delivery that failed for good
+type DeadLetter struct {
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Subject  string          `json:"subject"`
+	Attempts int             `json:"attempts"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failedAt"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type deadLetterLog struct {
+	sync.Mutex
+	path    string
+	Letters []DeadLetter `json:"letters"`
+}
+
+var deadLetters = loadDeadLetterLog(filepath.Join(stateDir, "webhook-dead-letters.json"))
+
+func loadDeadLetterLog(path string) *deadLetterLog {
+	l := &deadLetterLog{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return l
+	}
+	if err := json.Unmarshal(data, l); err != nil {
+		fmt.Printf("Warning: invalid webhook dead-letter log %s: %s (starting empty)\n", path, err)
+		return &deadLetterLog{path: path}
+	}
+	return l
+}
+
+// Write the log; callers must hold the lock
+func (l *deadLetterLog) save() {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err == nil {
+		os.MkdirAll(filepath.Dir(l.path), 0755)
+		err = os.WriteFile(l.path, data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Warning: failed to save webhook dead-letter log: %s\n", err)
+	}
+}
+
+func (l *deadLetterLog) add(letter DeadLetter) {
+	l.Lock()
+	defer l.Unlock()
+	l.Letters = append(l.Letters, letter)
+	if len(l.Letters) > deadLetterLimit {
+		l.Letters = l.Letters[len(l.Letters)-deadLetterLimit:]
+	}
+	l.save()
+}
+
+func (l *deadLetterLog) list() []DeadLetter {
+	l.Lock()
+	defer l.Unlock()
+	return append([]DeadLetter{}, l.Letters...)
+}
+
+// Take a letter off the log, returning it
+func (l *deadLetterLog) take(id string) (DeadLetter, bool) {
+	l.Lock()
+	defer l.Unlock()
+	for i, letter := range l.Letters {
+		if letter.ID == id {
+			l.Letters = append(l.Letters[:i], l.Letters[i+1:]...)
+			l.save()
+			return letter, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+// A notification as the webhook gets it
+func newWebhookDelivery(subject, text string, jobs []notifiedJob) webhookDelivery {
+	d := webhookDelivery{ID: newID(), URL: config.Notifications.URL}
+	d.Payload, _ = json.Marshal(map[string]interface{}{
+		"id":      d.ID,
+		"subject": subject,
+		"text":    text,
+		"digest":  config.Notifications.DigestMinutes > 0,
+		"jobs":    jobs,
+	})
+	return d
+}
+
+// The signature of a payload sent at a Unix time: hex HMAC-SHA256 of
+// "<timestamp>.<body>" with the secret
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Post a delivery until it succeeds or runs out of attempts, then log it as
+// a dead letter
+func deliverWebhook(d webhookDelivery) {
+	attempts := config.Notifications.WebhookAttempts
+	if attempts <= 0 {
+		attempts = 6
+	}
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		var retry bool
+		var wait time.Duration
+		if retry, wait, err = postWebhook(d); err == nil {
+			return
+		}
+		if !retry || attempt == attempts {
+			break
+		}
+		if backoff := webhookBackoff << (attempt - 1); wait < backoff {
+			wait = backoff
+		}
+		wait = min(wait, webhookMaxBackoff)
+		fmt.Printf("Warning: notification webhook delivery %s failed (attempt %d of %d, retrying in %s): %s\n", d.ID, attempt, attempts, wait, err)
+		time.Sleep(wait)
+	}
+	fmt.Printf("Warning: notification webhook delivery %s failed after %d attempts, added to the dead-letter log: %s\n", d.ID, attempt, err)
+	var payload struct {
+		Subject string `json:"subject"`
+	}
+	json.Unmarshal(d.Payload, &payload)
+	deadLetters.add(DeadLetter{ID: d.ID, URL: d.URL, Subject: payload.Subject, Attempts: attempt,
+		Error: err.Error(), FailedAt: time.Now().UTC(), Payload: d.Payload})
+}
+
+// Post a delivery once, returning whether a failure is worth retrying and how
+// long the receiver asked to wait first
+func postWebhook(d webhookDelivery) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return false, 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Porter-Delivery", d.ID)
+	req.Header.Set("X-Porter-Timestamp", timestamp)
+	secret := config.Notifications.Secret
+	if secret == "" {
+		secret = os.Getenv("PORTER_NOTIFY_SECRET")
+	}
+	if secret != "" {
+		req.Header.Set("X-Porter-Signature", webhookSignature(secret, timestamp, d.Payload))
+	}
+	token := config.Notifications.Token
+	if token == "" {
+		token = os.Getenv("PORTER_NOTIFY_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, 0, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 300 {
+		return false, 0, nil
+	}
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	var wait time.Duration
+	if seconds, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && seconds > 0 {
+		wait = time.Duration(seconds) * time.Second
+	}
+	return retry, wait, err
+}
+
+// Handler for GET /api/notifications/dead-letters: webhook deliveries that
+// failed for good, oldest first
+func deadLettersListHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string][]DeadLetter{"deadLetters": deadLetters.list()})
+}
+
+// Handler for POST /api/notifications/dead-letters/{id}/redeliver: take a
+// dead letter off the log and deliver it again in the background, with
+// retries; if it fails again it returns to the log
+func deadLetterRedeliverHandler(w http.ResponseWriter, r *http.Request) {
+	letter, ok := deadLetters.take(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown dead letter: %s"), r.PathValue("id"))})
+		return
+	}
+	go deliverWebhook(webhookDelivery{ID: letter.ID, URL: letter.URL, Payload: letter.Payload})
+	writeJSON(w, http.StatusAccepted, map[string]string{"redelivering": letter.ID})
+}
+
+// Handler for DELETE /api/notifications/dead-letters/{id}: drop a dead letter
+func deadLetterDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	letter, ok := deadLetters.take(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown dead letter: %s"), r.PathValue("id"))})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"deleted": letter.ID})
+}
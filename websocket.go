@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// A command sent by a WebSocket client
+type jobCommand struct {
+	Command  string `json:"command"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+// Handler for /api/jobs/{id}/ws: streams job events and accepts control commands.
+//
+// Server → client: {"type": "snapshot"|"log"|"progress"|"state"|"error", ...}
+// Client → server: {"command": "cancel"|"pause"|"resume"} or {"command": "priority", "priority": 10}
+func jobWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(r.PathValue("id"))
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, APIError{Code: errCodeNotFound, Message: fmt.Sprintf(tr("Unknown job: %s"), r.PathValue("id"))})
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		fmt.Printf("WebSocket upgrade failed for job %s: %s\n", job.ID, err)
+		return
+	}
+	defer conn.Close()
+	fmt.Printf("WebSocket client connected to job %s\n", job.ID)
+
+	// Subscribe before the snapshot so no events are missed in between
+	events, unsubscribe := job.subscribe()
+	defer unsubscribe()
+
+	// Only this goroutine writes to the connection; the reader hands replies over
+	replies := make(chan JobEvent, 8)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			var cmd jobCommand
+			if err := conn.ReadJSON(&cmd); err != nil {
+				return
+			}
+			replies <- handleJobCommand(job, cmd)
+		}
+	}()
+
+	if err := conn.WriteJSON(JobEvent{Type: "snapshot", Job: job.snapshot()}); err != nil {
+		return
+	}
+
+	// Re-running a finished job's imports replaces done
+	job.mu.Lock()
+	done := job.done
+	job.mu.Unlock()
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		var event JobEvent
+		select {
+		case event = <-events:
+		case event = <-replies:
+		case <-done:
+			// Flush the final state, then close the connection cleanly
+			conn.WriteJSON(JobEvent{Type: "snapshot", Job: job.snapshot()})
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, "job finished"),
+				time.Now().Add(5*time.Second))
+			return
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+			continue
+		case <-closed:
+			fmt.Printf("WebSocket client disconnected from job %s\n", job.ID)
+			return
+		}
+		if err := conn.WriteJSON(event); err != nil {
+			return
+		}
+	}
+}
+
+// Apply a client command to a job and describe the outcome
+func handleJobCommand(job *Job, cmd jobCommand) JobEvent {
+	switch cmd.Command {
+	case "cancel":
+		if job.finished() {
+			return JobEvent{Type: "error", Message: "job has already finished"}
+		}
+		jobs.cancelJob(job)
+		return JobEvent{Type: "ack", Message: "cancel requested"}
+	case "pause":
+		if err := job.pause(); err != nil {
+			return JobEvent{Type: "error", Message: err.Error()}
+		}
+		return JobEvent{Type: "ack", Message: "paused"}
+	case "resume":
+		if err := job.resume(); err != nil {
+			return JobEvent{Type: "error", Message: err.Error()}
+		}
+		return JobEvent{Type: "ack", Message: "resumed"}
+	case "priority":
+		jobs.setPriority(job, cmd.Priority)
+		return JobEvent{Type: "ack", Message: fmt.Sprintf(tr("priority set to %d"), cmd.Priority)}
+	default:
+		return JobEvent{Type: "error", Message: fmt.Sprintf(tr("unsupported command: %s"), cmd.Command)}
+	}
+}
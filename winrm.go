@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+// A small WS-Management (WinRM) client: enough to open a remote shell, run one
+// PowerShell script in it and collect its output, over HTTPS with Basic
+// authentication. The host needs an HTTPS listener and Basic auth enabled
+// (winrm set winrm/config/service/auth @{Basic="true"}), which takes local
+// accounts. Set HYPERV_INSECURE=1 for hosts with self-signed certificates.
+
+const (
+	wsmanShellURI = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell/cmd"
+	wsmanShellNS  = "http://schemas.microsoft.com/wbem/wsman/1/windows/shell"
+	wsmanCreate   = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Create"
+	wsmanDelete   = "http://schemas.xmlsoap.org/ws/2004/09/transfer/Delete"
+	wsmanCommand  = wsmanShellNS + "/Command"
+	wsmanReceive  = wsmanShellNS + "/Receive"
+	wsmanSignal   = wsmanShellNS + "/Signal"
+	wsmanDone     = wsmanShellNS + "/CommandState/Done"
+	wsmanTimedOut = "2150858793"
+)
+
+// A WinRM endpoint and the account to use on it
+type winrmClient struct {
+	URL      string
+	Username string
+	Password string
+	client   *http.Client
+}
+
+// Normalise a host, host:port or URL to a WinRM endpoint, by default
+// https://host:5986/wsman
+func winrmEndpoint(raw string) (string, error) {
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", fmt.Errorf("invalid WinRM URL '%s'", raw)
+	}
+	if u.Port() == "" {
+		port := "5986"
+		if u.Scheme == "http" {
+			port = "5985"
+		}
+		u.Host = u.Hostname() + ":" + port
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/wsman"
+	}
+	return u.String(), nil
+}
+
+func newWinRMClient(rawURL, username, password string) (*winrmClient, error) {
+	endpoint, err := winrmEndpoint(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &winrmClient{URL: endpoint, Username: username, Password: password, client: insecureClient("HYPERV_INSECURE")}, nil
+}
+
+// The parts of WS-Management responses Porter reads, matched by local name
+type wsmanResponse struct {
+	Body struct {
+		Shell struct {
+			ShellID string `xml:"ShellId"`
+		} `xml:"Shell"`
+		ResourceCreated struct {
+			Selectors []string `xml:"ReferenceParameters>SelectorSet>Selector"`
+		} `xml:"ResourceCreated"`
+		CommandID string `xml:"CommandResponse>CommandId"`
+		Receive   struct {
+			Streams []struct {
+				Name string `xml:"Name,attr"`
+				End  bool   `xml:"End,attr"`
+				Data string `xml:",chardata"`
+			} `xml:"Stream"`
+			State struct {
+				State    string `xml:"State,attr"`
+				ExitCode int    `xml:"ExitCode"`
+			} `xml:"CommandState"`
+		} `xml:"ReceiveResponse"`
+		Fault struct {
+			Reason string `xml:"Reason>Text"`
+			Detail struct {
+				Code    string `xml:"Code,attr"`
+				Message string `xml:"Message"`
+			} `xml:"Detail>WSManFault"`
+		} `xml:"Fault"`
+	} `xml:"Body"`
+}
+
+type wsmanFault struct {
+	Code    string
+	Message string
+}
+
+func (f *wsmanFault) Error() string {
+	return fmt.Sprintf("WinRM fault %s: %s", f.Code, f.Message)
+}
+
+func wsmanMessageID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Send one WS-Management request; header and body are extra XML for the
+// SOAP header and the body
+func (c *winrmClient) send(ctx context.Context, action, header, body string) (*wsmanResponse, error) {
+	var envelope bytes.Buffer
+	fmt.Fprintf(&envelope, `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:w="http://schemas.dmtf.org/wbem/wsman/1/wsman.xsd" xmlns:rsp="%s">`, wsmanShellNS)
+	fmt.Fprintf(&envelope, `<s:Header><a:To>%s</a:To>`, html.EscapeString(c.URL))
+	envelope.WriteString(`<a:ReplyTo><a:Address s:mustUnderstand="true">http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address></a:ReplyTo>`)
+	fmt.Fprintf(&envelope, `<w:ResourceURI s:mustUnderstand="true">%s</w:ResourceURI>`, wsmanShellURI)
+	fmt.Fprintf(&envelope, `<a:Action s:mustUnderstand="true">%s</a:Action>`, action)
+	fmt.Fprintf(&envelope, `<w:MaxEnvelopeSize s:mustUnderstand="true">153600</w:MaxEnvelopeSize><a:MessageID>%s</a:MessageID>`, wsmanMessageID())
+	envelope.WriteString(`<w:Locale xml:lang="en-US" s:mustUnderstand="false"/><w:OperationTimeout>PT60S</w:OperationTimeout>`)
+	fmt.Fprintf(&envelope, `%s</s:Header><s:Body>%s</s:Body></s:Envelope>`, header, body)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, &envelope)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+	req.SetBasicAuth(c.Username, c.Password)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, fmt.Errorf("WinRM at %s refused the credentials for %s (Basic authentication needs a local account, and enabling on the host)", c.URL, c.Username)
+	}
+	var parsed wsmanResponse
+	if err := xml.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("WinRM at %s answered %s: %s", c.URL, resp.Status, strings.TrimSpace(string(data)))
+	}
+	if fault := parsed.Body.Fault; resp.StatusCode >= 300 || fault.Reason != "" {
+		message := strings.TrimSpace(fault.Detail.Message)
+		if message == "" {
+			message = strings.TrimSpace(fault.Reason)
+		}
+		return nil, &wsmanFault{Code: fault.Detail.Code, Message: message}
+	}
+	return &parsed, nil
+}
+
+func shellSelector(shellID string) string {
+	return fmt.Sprintf(`<w:SelectorSet><w:Selector Name="ShellId">%s</w:Selector></w:SelectorSet>`, html.EscapeString(shellID))
+}
+
+// Run a PowerShell script on the host, returning its standard output. A
+// script that fails (exits non-zero, or writes an error with
+// $ErrorActionPreference = 'Stop') returns its error output as the error.
+func (c *winrmClient) runPowerShell(ctx context.Context, script string) (string, error) {
+	created, err := c.send(ctx, wsmanCreate,
+		`<w:OptionSet><w:Option Name="WINRS_NOPROFILE">TRUE</w:Option><w:Option Name="WINRS_CODEPAGE">65001</w:Option></w:OptionSet>`,
+		`<rsp:Shell><rsp:InputStreams>stdin</rsp:InputStreams><rsp:OutputStreams>stdout stderr</rsp:OutputStreams></rsp:Shell>`)
+	if err != nil {
+		return "", err
+	}
+	shellID := created.Body.Shell.ShellID
+	if shellID == "" && len(created.Body.ResourceCreated.Selectors) > 0 {
+		shellID = created.Body.ResourceCreated.Selectors[0]
+	}
+	if shellID == "" {
+		return "", fmt.Errorf("WinRM at %s created no shell", c.URL)
+	}
+	shell := shellSelector(shellID)
+	// Close the shell even when the job is cancelled
+	defer c.send(context.Background(), wsmanDelete, shell, "")
+
+	started, err := c.send(ctx, wsmanCommand,
+		shell+`<w:OptionSet><w:Option Name="WINRS_CONSOLEMODE_STDIN">TRUE</w:Option><w:Option Name="WINRS_SKIP_CMD_SHELL">TRUE</w:Option></w:OptionSet>`,
+		fmt.Sprintf(`<rsp:CommandLine><rsp:Command>powershell.exe</rsp:Command><rsp:Arguments>-NoProfile -NonInteractive -EncodedCommand %s</rsp:Arguments></rsp:CommandLine>`,
+			encodePowerShell(script)))
+	if err != nil {
+		return "", err
+	}
+	commandID := started.Body.CommandID
+	defer c.send(context.Background(), wsmanSignal, shell, fmt.Sprintf(
+		`<rsp:Signal CommandId="%s"><rsp:Code>%s/signal/terminate</rsp:Code></rsp:Signal>`, commandID, wsmanShellNS))
+
+	var stdout, stderr bytes.Buffer
+	for {
+		received, err := c.send(ctx, wsmanReceive, shell, fmt.Sprintf(
+			`<rsp:Receive><rsp:DesiredStream CommandId="%s">stdout stderr</rsp:DesiredStream></rsp:Receive>`, commandID))
+		if fault, ok := err.(*wsmanFault); ok && fault.Code == wsmanTimedOut {
+			// Nothing new within the operation timeout; ask again
+			continue
+		}
+		if err != nil {
+			return stdout.String(), err
+		}
+		for _, stream := range received.Body.Receive.Streams {
+			data, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(stream.Data))
+			if stream.Name == "stderr" {
+				stderr.Write(data)
+			} else {
+				stdout.Write(data)
+			}
+		}
+		if state := received.Body.Receive.State; state.State == wsmanDone {
+			if message := cleanCLIXML(stderr.String()); state.ExitCode != 0 || message != "" {
+				if message == "" {
+					message = fmt.Sprintf("PowerShell exited with code %d", state.ExitCode)
+				}
+				return stdout.String(), fmt.Errorf("%s", message)
+			}
+			return stdout.String(), nil
+		}
+	}
+}
+
+// A script as -EncodedCommand takes it: base64 of UTF-16LE
+func encodePowerShell(script string) string {
+	units := utf16.Encode([]rune(script))
+	b := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.LittleEndian.PutUint16(b[2*i:], u)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// PowerShell writes errors to a remote stderr as CLIXML; pull out the text
+var clixmlError = regexp.MustCompile(`<S S="Error">([^<]*)</S>`)
+
+func cleanCLIXML(stderr string) string {
+	if !strings.HasPrefix(stderr, "#< CLIXML") {
+		return strings.TrimSpace(stderr)
+	}
+	var b strings.Builder
+	for _, m := range clixmlError.FindAllStringSubmatch(stderr, -1) {
+		b.WriteString(html.UnescapeString(m[1]))
+	}
+	text := strings.NewReplacer("_x000D_", "", "_x000A_", "\n").Replace(b.String())
+	return strings.TrimSpace(text)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Workspace locks keep the stages of different jobs and handlers off each
+// other's files: a file or directory being written (an OVA being extracted, an
+// image being converted or downloaded) is locked exclusively, and one being read
+// (a VMDK being converted, an image being uploaded) is shared. A lock on a
+// directory covers everything under it. Jobs wait for a conflicting lock to be
+// released; the synchronous form handlers fail with 409 Conflict instead.
+
+type workspaceLock struct {
+	path      string
+	exclusive bool
+	holder    string
+}
+
+var workspace = struct {
+	sync.Mutex
+	held []*workspaceLock
+	// Closed and replaced whenever a lock is released, to wake waiters
+	released chan struct{}
+}{released: make(chan struct{})}
+
+// Returned when a path is locked by someone else
+type workspaceBusyError struct {
+	Path   string
+	Holder string
+}
+
+func (e *workspaceBusyError) Error() string {
+	return fmt.Sprintf("%s is in use by %s", e.Path, e.Holder)
+}
+
+// Whether one path is the other or lies under it
+func pathsOverlap(a, b string) bool {
+	if a == b {
+		return true
+	}
+	return strings.HasPrefix(a, b+string(filepath.Separator)) || strings.HasPrefix(b, a+string(filepath.Separator))
+}
+
+// The first held lock that conflicts with the wanted ones, nil if none.
+// Called with workspace locked.
+func workspaceConflict(wanted []*workspaceLock) *workspaceBusyError {
+	for _, w := range wanted {
+		for _, h := range workspace.held {
+			if (w.exclusive || h.exclusive) && pathsOverlap(w.path, h.path) {
+				return &workspaceBusyError{Path: w.path, Holder: h.holder}
+			}
+		}
+	}
+	return nil
+}
+
+func workspaceLocks(holder string, reads, writes []string) []*workspaceLock {
+	var locks []*workspaceLock
+	for _, path := range reads {
+		locks = append(locks, &workspaceLock{path: filepath.Clean(path), holder: holder})
+	}
+	for _, path := range writes {
+		locks = append(locks, &workspaceLock{path: filepath.Clean(path), exclusive: true, holder: holder})
+	}
+	return locks
+}
+
+// Take all the locks at once (so two holders can't each wait on the other),
+// returning the function that releases them
+func acquireWorkspace(locks []*workspaceLock) func() {
+	workspace.held = append(workspace.held, locks...)
+	return func() {
+		workspace.Lock()
+		defer workspace.Unlock()
+		var held []*workspaceLock
+		for _, h := range workspace.held {
+			mine := false
+			for _, l := range locks {
+				if h == l {
+					mine = true
+				}
+			}
+			if !mine {
+				held = append(held, h)
+			}
+		}
+		workspace.held = held
+		close(workspace.released)
+		workspace.released = make(chan struct{})
+	}
+}
+
+// Lock paths for reading and writing without waiting
+func tryLockWorkspace(holder string, reads, writes []string) (func(), error) {
+	locks := workspaceLocks(holder, reads, writes)
+	workspace.Lock()
+	defer workspace.Unlock()
+	if busy := workspaceConflict(locks); busy != nil {
+		return nil, busy
+	}
+	return acquireWorkspace(locks), nil
+}
+
+// Lock paths for a job, waiting (and saying so in its status) while another job
+// or handler holds a conflicting lock. Fails only if the job is cancelled.
+func (j *Job) lockWorkspace(reads, writes []string) (func(), error) {
+	locks := workspaceLocks("job "+j.ID, reads, writes)
+	j.mu.Lock()
+	status := j.Progress.Status
+	j.mu.Unlock()
+	waiting := ""
+	for {
+		workspace.Lock()
+		busy := workspaceConflict(locks)
+		if busy == nil {
+			release := acquireWorkspace(locks)
+			workspace.Unlock()
+			if waiting != "" && status != "" {
+				j.setStatus("%s", status)
+			}
+			return release, nil
+		}
+		released := workspace.released
+		workspace.Unlock()
+
+		if waiting == "" {
+			j.setWaiting(true)
+			defer j.setWaiting(false)
+		}
+		if busy.Error() != waiting {
+			waiting = busy.Error()
+			j.setStatus("Waiting: %s", waiting)
+		}
+		select {
+		case <-released:
+		case <-j.ctx.Done():
+			return nil, fmt.Errorf("cancelled while waiting: %s", waiting)
+		}
+	}
+}
+
+// Report a busy path from a form handler
+func respondWorkspaceBusy(w http.ResponseWriter, r *http.Request, err error) {
+	respondError(w, r, http.StatusConflict, APIError{Code: errCodeConflict,
+		Message: "File in use", Details: err.Error(),
+		Remediation: "Wait for the extraction, conversion or upload using it to finish, then try again."})
+}
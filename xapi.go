@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XCP-ng and XenServer pools over XAPI: each disk is imported into a storage
+// repository (the bucket, by name or UUID) as a new VDI through the pool
+// master's import_raw_vdi handler, as `xe vdi-import` does, from a RAW or VHD
+// disk. With createImage the disk is packaged as an XVA (see xva.go) and
+// imported as a halted VM with the source VM's CPUs, memory and firmware.
+//
+// The pool master URL (https://xcp1) comes from the request, an xcpng profile
+// or XCPNG_URL; credentials from the request, the profile whose url it is under
+// (username and password) or XCPNG_USERNAME and XCPNG_PASSWORD. Set
+// XCPNG_INSECURE=1 for the self-signed certificates pools are installed with.
+
+// How long to wait for XAPI to finish importing an XVA once it is sent
+const xapiImportTimeout = 2 * time.Hour
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// The credentials for a pool master URL
+func xapiCredentials(rawURL, username, password string) (string, string) {
+	if username != "" {
+		return username, password
+	}
+	if username, password, ok := profileCredentials("xcpng", rawURL); ok {
+		return username, password
+	}
+	return os.Getenv("XCPNG_USERNAME"), os.Getenv("XCPNG_PASSWORD")
+}
+
+// An XML-RPC value in a response, decoded into strings, bools, arrays
+// ([]interface{}) and structs (map[string]interface{}). XAPI sends everything
+// else (int64s, floats, dates, refs) as strings.
+type xrValue struct {
+	Text    string   `xml:",chardata"`
+	String  *string  `xml:"string"`
+	Boolean *string  `xml:"boolean"`
+	Int     *string  `xml:"int"`
+	I4      *string  `xml:"i4"`
+	Double  *string  `xml:"double"`
+	Array   *xrData  `xml:"array"`
+	Struct  *xrPairs `xml:"struct"`
+}
+
+type xrData struct {
+	Values []xrValue `xml:"data>value"`
+}
+
+type xrPairs struct {
+	Members []struct {
+		Name  string  `xml:"name"`
+		Value xrValue `xml:"value"`
+	} `xml:"member"`
+}
+
+func (v xrValue) decode() interface{} {
+	switch {
+	case v.String != nil:
+		return *v.String
+	case v.Boolean != nil:
+		return *v.Boolean == "1"
+	case v.Int != nil:
+		return *v.Int
+	case v.I4 != nil:
+		return *v.I4
+	case v.Double != nil:
+		return *v.Double
+	case v.Array != nil:
+		items := make([]interface{}, len(v.Array.Values))
+		for i, item := range v.Array.Values {
+			items[i] = item.decode()
+		}
+		return items
+	case v.Struct != nil:
+		fields := map[string]interface{}{}
+		for _, m := range v.Struct.Members {
+			fields[m.Name] = m.Value.decode()
+		}
+		return fields
+	}
+	return v.Text
+}
+
+// Call an XAPI method, returning its value. XAPI failures become errors
+// carrying the error description, e.g. [SR_FULL 1073741824 ...].
+func xapiCall(ctx context.Context, server, method string, params ...interface{}) (interface{}, error) {
+	var b bytes.Buffer
+	b.WriteString(`<?xml version="1.0"?><methodCall><methodName>`)
+	xml.EscapeText(&b, []byte(method))
+	b.WriteString("</methodName><params>")
+	for _, p := range params {
+		b.WriteString("<param>")
+		writeXMLRPC(&b, p)
+		b.WriteString("</param>")
+	}
+	b.WriteString("</params></methodCall>")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(server, "/")+"/", &b)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml")
+	resp, err := insecureClient("XCPNG_INSECURE").Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s: %s", method, resp.Status, strings.TrimSpace(string(data)))
+	}
+	var response struct {
+		Value xrValue `xml:"params>param>value"`
+	}
+	if err := xml.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("%s: unexpected response: %w", method, err)
+	}
+	result, _ := response.Value.decode().(map[string]interface{})
+	if result["Status"] != "Success" {
+		return nil, fmt.Errorf("%s failed: %v", method, result["ErrorDescription"])
+	}
+	return result["Value"], nil
+}
+
+// Call an XAPI method that returns a string (a ref, UUID or status)
+func xapiString(ctx context.Context, server, method string, params ...interface{}) (string, error) {
+	value, err := xapiCall(ctx, server, method, params...)
+	if err != nil {
+		return "", err
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s returned %v, not a string", method, value)
+	}
+	return s, nil
+}
+
+// Log in to a pool, returning the session and a function to log out
+func xapiLogin(ctx context.Context, server, username, password string) (string, func(), error) {
+	username, password = xapiCredentials(server, username, password)
+	if username == "" {
+		return "", nil, fmt.Errorf("no credentials for %s; pass a username and password, use an xcpng profile, or set XCPNG_USERNAME and XCPNG_PASSWORD", server)
+	}
+	session, err := xapiString(ctx, server, "session.login_with_password", username, password, "1.0", "porter")
+	if err != nil {
+		return "", nil, err
+	}
+	logout := func() {
+		xapiCall(context.Background(), server, "session.logout", session)
+	}
+	return session, logout, nil
+}
+
+// Find a storage repository by UUID or name label
+func xapiFindSR(ctx context.Context, server, session, sr string) (string, error) {
+	if uuidPattern.MatchString(sr) {
+		return xapiString(ctx, server, "SR.get_by_uuid", session, sr)
+	}
+	value, err := xapiCall(ctx, server, "SR.get_by_name_label", session, sr)
+	if err != nil {
+		return "", err
+	}
+	refs, _ := value.([]interface{})
+	switch len(refs) {
+	case 0:
+		return "", fmt.Errorf("no storage repository named %s", sr)
+	case 1:
+		return refs[0].(string), nil
+	}
+	return "", fmt.Errorf("%d storage repositories are named %s; use the SR's UUID", len(refs), sr)
+}
+
+// Send a file to one of XAPI's HTTP import handlers (import_raw_vdi or import)
+func xapiPut(job *Job, s uploadSettings, handler string, query url.Values, file string) error {
+	st, err := openUploadStream(job, s, file)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	endpoint := strings.TrimRight(s.URL, "/") + "/" + handler + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(job.ctx, http.MethodPut, endpoint, st)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = st.Size
+	resp, err := insecureClient("XCPNG_INSECURE").Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return fmt.Errorf("PUT /%s: %s: %s", handler, resp.Status, strings.TrimSpace(string(data)))
+	}
+	st.finish()
+	return nil
+}
+
+// Import one disk into an XCP-ng pool, returning <sr>/<vdi-uuid> and, with
+// createImage, the UUID of the VM imported with it
+func uploadToXAPI(job *Job, s uploadSettings, file string) (string, string, error) {
+	session, logout, err := xapiLogin(job.ctx, s.URL, s.Username, s.Password)
+	if err != nil {
+		return "", "", fmt.Errorf("logging in to %s failed: %w", s.URL, err)
+	}
+	defer logout()
+	sr, err := xapiFindSR(job.ctx, s.URL, session, s.Bucket)
+	if err != nil {
+		return "", "", err
+	}
+	if s.CreateImage {
+		return importXVAToXAPI(job, s, session, sr, file)
+	}
+
+	format := diskFormatForPath(file)
+	if format != "raw" && format != "vpc" {
+		return "", "", fmt.Errorf("XAPI imports RAW or VHD disks, not %s; convert to raw or vpc", filepath.Base(file))
+	}
+	var size int64
+	if format == "raw" {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get file info for %s: %w", file, err)
+		}
+		size = info.Size()
+	} else if size, err = imageVirtualSize(job, file); err != nil {
+		return "", "", err
+	}
+	hw := hardwareForDisk(file)
+	name := baseNameWithoutExt(file)
+	if job.Spec.Name != "" {
+		name = job.Spec.Name
+	}
+	vdi, err := xapiString(job.ctx, s.URL, "VDI.create", session, xrStruct{
+		"name_label":       name,
+		"name_description": "Imported by Porter job " + job.ID + " from " + hw.Name,
+		"SR":               sr,
+		"virtual_size":     strconv.FormatInt(size, 10),
+		"type":             "user",
+		"sharable":         false,
+		"read_only":        false,
+		"other_config":     xrStruct{},
+		"xenstore_data":    xrStruct{},
+		"sm_config":        xrStruct{},
+		"tags":             xrArray{},
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("creating a VDI for %s failed: %w", file, err)
+	}
+	uuid, err := xapiString(job.ctx, s.URL, "VDI.get_uuid", session, vdi)
+	if err != nil {
+		return "", "", err
+	}
+	dest := s.Bucket + "/" + uuid
+
+	job.setStatus("Importing %s into %s as VDI %s (%.2f MB)",
+		filepath.Base(file), s.Bucket, uuid, float64(size)/(1024*1024))
+	query := url.Values{"session_id": {session}, "vdi": {vdi}, "format": {"raw"}}
+	if format == "vpc" {
+		query.Set("format", "vhd")
+	}
+	if err := xapiPut(job, s, "import_raw_vdi", query, file); err != nil {
+		// Don't leave an empty VDI behind
+		xapiCall(context.Background(), s.URL, "VDI.destroy", session, vdi)
+		return "", "", fmt.Errorf("importing %s into %s failed: %w", file, s.Bucket, err)
+	}
+	job.logf("Imported %s as VDI %s in %s", filepath.Base(file), uuid, s.Bucket)
+	return dest, "", nil
+}
+
+// Package a disk as an XVA and import it as a VM, returning <sr>/<vdi-uuid> of
+// its disk and the VM's UUID
+func importXVAToXAPI(job *Job, s uploadSettings, session, sr, file string) (string, string, error) {
+	work, err := os.MkdirTemp(filepath.Dir(file), ".porter-xapi-")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.RemoveAll(work)
+	packaging := s
+	packaging.Target = work
+	xva, err := packageXVA(job, packaging, file)
+	if err != nil {
+		return "", "", err
+	}
+
+	// The import runs as a task, whose result names the new VM
+	task, err := xapiString(job.ctx, s.URL, "task.create", session, "Porter import", "Importing "+filepath.Base(file)+" for job "+job.ID)
+	if err != nil {
+		return "", "", err
+	}
+	defer xapiCall(context.Background(), s.URL, "task.destroy", session, task)
+	job.setStatus("Importing %s into %s as a VM", filepath.Base(xva), s.Bucket)
+	query := url.Values{"session_id": {session}, "sr_id": {sr}, "task_id": {task}}
+	if err := xapiPut(job, s, "import", query, xva); err != nil {
+		return "", "", fmt.Errorf("importing %s into %s failed: %w", xva, s.Bucket, err)
+	}
+
+	var result string
+	err = waitForCloudTask(job, CloudTask{Kind: "XAPI import", ID: task, Status: "pending"}, xapiImportTimeout, func(t *CloudTask) (bool, error) {
+		status, err := xapiString(job.ctx, s.URL, "task.get_status", session, task)
+		if err != nil {
+			return false, err
+		}
+		t.Status = status
+		if progress, err := xapiString(job.ctx, s.URL, "task.get_progress", session, task); err == nil {
+			if f, err := strconv.ParseFloat(progress, 64); err == nil {
+				t.Percentage = int(f * 100)
+			}
+		}
+		switch status {
+		case "success":
+			result, err = xapiString(job.ctx, s.URL, "task.get_result", session, task)
+			return true, err
+		case "failure", "cancelled":
+			info, _ := xapiCall(job.ctx, s.URL, "task.get_error_info", session, task)
+			return false, fmt.Errorf("XAPI import of %s failed: %v", filepath.Base(xva), info)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	// The result is an XML-RPC array of the imported VM refs
+	var refs struct {
+		Values []xrValue `xml:"array>data>value"`
+	}
+	if err := xml.Unmarshal([]byte(result), &refs); err != nil || len(refs.Values) == 0 {
+		return "", "", fmt.Errorf("unexpected XAPI import result: %s", result)
+	}
+	vm, _ := refs.Values[0].decode().(string)
+	vmUUID, err := xapiString(job.ctx, s.URL, "VM.get_uuid", session, vm)
+	if err != nil {
+		return "", "", err
+	}
+	vdiUUID, err := xapiVMDiskUUID(job.ctx, s.URL, session, vm)
+	if err != nil {
+		return "", "", err
+	}
+	job.logf("Imported VM %s with disk %s in %s", vmUUID, vdiUUID, s.Bucket)
+	return s.Bucket + "/" + vdiUUID, vmUUID, nil
+}
+
+// The UUID of a VM's first disk
+func xapiVMDiskUUID(ctx context.Context, server, session, vm string) (string, error) {
+	value, err := xapiCall(ctx, server, "VM.get_VBDs", session, vm)
+	if err != nil {
+		return "", err
+	}
+	vbds, _ := value.([]interface{})
+	for _, vbd := range vbds {
+		if kind, err := xapiString(ctx, server, "VBD.get_type", session, vbd); err != nil || kind != "Disk" {
+			continue
+		}
+		vdi, err := xapiString(ctx, server, "VBD.get_VDI", session, vbd)
+		if err != nil {
+			return "", err
+		}
+		return xapiString(ctx, server, "VDI.get_uuid", session, vdi)
+	}
+	return "", errors.New("the imported VM has no disk")
+}
+
+// Delete an imported VDI (<sr>/<vdi-uuid>). XAPI refuses while a running VM uses it.
+func deleteXAPIDisk(endpoint, dest string) error {
+	ctx := context.Background()
+	session, logout, err := xapiLogin(ctx, endpoint, "", "")
+	if err != nil {
+		return err
+	}
+	defer logout()
+	vdi, err := xapiString(ctx, endpoint, "VDI.get_by_uuid", session, path.Base(dest))
+	if err != nil {
+		return err
+	}
+	_, err = xapiCall(ctx, endpoint, "VDI.destroy", session, vdi)
+	return err
+}
+
+// List the VDIs in a storage repository whose names start with prefix
+func listXAPIDisks(ctx context.Context, server, sr, prefix string) ([]DestinationObject, error) {
+	session, logout, err := xapiLogin(ctx, server, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer logout()
+	ref, err := xapiFindSR(ctx, server, session, sr)
+	if err != nil {
+		return nil, err
+	}
+	value, err := xapiCall(ctx, server, "SR.get_VDIs", session, ref)
+	if err != nil {
+		return nil, err
+	}
+	vdis, _ := value.([]interface{})
+	var objects []DestinationObject
+	for _, vdi := range vdis {
+		record, err := xapiCall(ctx, server, "VDI.get_record", session, vdi)
+		if err != nil {
+			return nil, err
+		}
+		fields, _ := record.(map[string]interface{})
+		name, _ := fields["name_label"].(string)
+		uuid, _ := fields["uuid"].(string)
+		if fields["is_a_snapshot"] == true || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		size, _ := strconv.ParseInt(fmt.Sprint(fields["physical_utilisation"]), 10, 64)
+		objects = append(objects, DestinationObject{Name: name + " (" + uuid + ")", Size: size})
+	}
+	return objects, nil
+}
+
+// Confirm a pool is configured and accepts Porter's credentials
+func checkXAPICredentials(ctx context.Context) error {
+	server := os.Getenv("XCPNG_URL")
+	if server == "" {
+		for _, profile := range config.Destinations {
+			if profile.Cloud == "xcpng" && profile.URL != "" {
+				server = profile.URL
+				break
+			}
+		}
+	}
+	if server == "" {
+		return errors.New("no XCP-ng pool configured; set XCPNG_URL or add an xcpng destination profile")
+	}
+	_, logout, err := xapiLogin(ctx, server, "", "")
+	if err != nil {
+		return err
+	}
+	logout()
+	return nil
+}
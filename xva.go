@@ -0,0 +1,277 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// XVA packages for XCP-ng and XenServer: a tar holding ova.xml (the VM, VBD, VDI
+// and SR records as XML-RPC) followed by each disk in 1 MiB chunks named
+// Ref:<vdi>/<index>, each with a SHA-1 .checksum. All-zero chunks are left out,
+// which XAPI reads back as zeros. The VM's CPUs, memory and firmware come from the
+// disk's OVF. Import with `xe vm-import filename=<file>.xva` or Xen Orchestra.
+
+const xvaChunkSize = 1 << 20
+
+// XML-RPC values for ova.xml. XAPI writes int64 fields as strings, and only the
+// export header uses <i4>.
+type (
+	xrStruct map[string]interface{}
+	xrArray  []interface{}
+	xrI4     int
+)
+
+// A null object reference
+const xrNullRef = "OpaqueRef:NULL"
+
+func writeXMLRPC(b *bytes.Buffer, v interface{}) {
+	b.WriteString("<value>")
+	switch v := v.(type) {
+	case string:
+		xml.EscapeText(b, []byte(v))
+	case int:
+		fmt.Fprintf(b, "%d", v)
+	case int64:
+		fmt.Fprintf(b, "%d", v)
+	case xrI4:
+		fmt.Fprintf(b, "<i4>%d</i4>", v)
+	case float64:
+		fmt.Fprintf(b, "<double>%g</double>", v)
+	case bool:
+		if v {
+			b.WriteString("<boolean>1</boolean>")
+		} else {
+			b.WriteString("<boolean>0</boolean>")
+		}
+	case time.Time:
+		fmt.Fprintf(b, "<dateTime.iso8601>%s</dateTime.iso8601>", v.UTC().Format("20060102T15:04:05Z"))
+	case xrArray:
+		b.WriteString("<array><data>")
+		for _, item := range v {
+			writeXMLRPC(b, item)
+		}
+		b.WriteString("</data></array>")
+	case xrStruct:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		b.WriteString("<struct>")
+		for _, k := range keys {
+			b.WriteString("<member><name>")
+			xml.EscapeText(b, []byte(k))
+			b.WriteString("</name>")
+			writeXMLRPC(b, v[k])
+			b.WriteString("</member>")
+		}
+		b.WriteString("</struct>")
+	}
+	b.WriteString("</value>")
+}
+
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// The ova.xml reference of a VM's i'th disk, which also names its chunks
+func xvaVDIRef(i int) string {
+	return fmt.Sprintf("Ref:%d", 3+2*i)
+}
+
+// The ova.xml of a halted HVM guest with one VBD and VDI per disk (sizes in bytes)
+func xvaOVAXML(hw ovfHardware, description string, diskSizes []int64) []byte {
+	memory := hw.MemoryMB * 1024 * 1024
+	epoch := time.Unix(0, 0)
+
+	bootParams := xrStruct{"order": "cdn", "firmware": "bios"}
+	deviceModel := "qemu-upstream-compat"
+	if hw.Firmware == "efi" {
+		bootParams["firmware"] = "uefi"
+		deviceModel = "qemu-upstream-uefi"
+	}
+
+	const vmRef, srRef = "Ref:0", "Ref:1"
+	var vbdRefs xrArray
+	var objects xrArray
+	for i, size := range diskSizes {
+		vbdRef, vdiRef := fmt.Sprintf("Ref:%d", 2+2*i), xvaVDIRef(i)
+		vbdRefs = append(vbdRefs, vbdRef)
+		objects = append(objects,
+			xrStruct{"class": "VBD", "id": vbdRef, "snapshot": xrStruct{
+				"uuid": newUUID(), "allowed_operations": xrArray{}, "current_operations": xrStruct{},
+				"VM": vmRef, "VDI": vdiRef, "device": "", "userdevice": fmt.Sprint(i),
+				"bootable": i == 0, "mode": "RW", "type": "Disk", "unpluggable": false,
+				"storage_lock": false, "empty": false, "other_config": xrStruct{},
+				"currently_attached": false, "status_code": int64(0), "status_detail": "",
+				"runtime_properties": xrStruct{}, "qos_algorithm_type": "", "qos_algorithm_params": xrStruct{},
+				"qos_supported_algorithms": xrArray{}, "metrics": xrNullRef,
+			}},
+			xrStruct{"class": "VDI", "id": vdiRef, "snapshot": xrStruct{
+				"uuid": newUUID(), "name_label": fmt.Sprintf("%s disk %d", hw.Name, i), "name_description": description,
+				"allowed_operations": xrArray{}, "current_operations": xrStruct{}, "SR": srRef, "VBDs": xrArray{vbdRef},
+				"crash_dumps": xrArray{}, "virtual_size": size, "physical_utilisation": size, "type": "user",
+				"sharable": false, "read_only": false, "other_config": xrStruct{}, "storage_lock": false,
+				"location": "", "managed": true, "missing": false, "parent": xrNullRef, "xenstore_data": xrStruct{},
+				"sm_config": xrStruct{}, "is_a_snapshot": false, "snapshot_of": xrNullRef, "snapshots": xrArray{},
+				"snapshot_time": epoch, "tags": xrArray{}, "allow_caching": false, "on_boot": "persist",
+				"metadata_of_pool": xrNullRef, "metadata_latest": false, "is_tools_iso": false, "metrics": xrNullRef,
+			}})
+	}
+
+	vm := xrStruct{
+		"uuid": newUUID(), "name_label": hw.Name, "name_description": description,
+		"allowed_operations": xrArray{}, "current_operations": xrStruct{}, "power_state": "Halted",
+		"user_version": int64(1), "is_a_template": false, "is_default_template": false, "is_control_domain": false,
+		"suspend_VDI": xrNullRef, "suspend_SR": xrNullRef, "resident_on": xrNullRef,
+		"scheduled_to_be_resident_on": xrNullRef, "affinity": xrNullRef,
+		"memory_overhead": int64(0), "memory_target": int64(0),
+		"memory_static_max": memory, "memory_dynamic_max": memory, "memory_dynamic_min": memory, "memory_static_min": memory,
+		"VCPUs_params": xrStruct{}, "VCPUs_max": int64(hw.CPUs), "VCPUs_at_startup": int64(hw.CPUs),
+		"actions_after_shutdown": "destroy", "actions_after_reboot": "restart", "actions_after_crash": "restart",
+		"consoles": xrArray{}, "VIFs": xrArray{}, "VBDs": vbdRefs, "VUSBs": xrArray{}, "crash_dumps": xrArray{},
+		"VTPMs": xrArray{}, "VGPUs": xrArray{}, "attached_PCIs": xrArray{},
+		"PV_bootloader": "", "PV_kernel": "", "PV_ramdisk": "", "PV_args": "", "PV_bootloader_args": "", "PV_legacy_args": "",
+		"HVM_boot_policy": "BIOS order", "HVM_boot_params": bootParams, "HVM_shadow_multiplier": 1.0,
+		"platform": xrStruct{"acpi": "1", "apic": "true", "pae": "true", "nx": "true", "viridian": "true",
+			"hpet": "true", "timeoffset": "0", "device-model": deviceModel, "secureboot": "false"},
+		"PCI_bus": "", "other_config": xrStruct{"base_template_name": "Other install media"},
+		"domid": int64(-1), "domarch": "", "last_boot_CPU_flags": xrStruct{}, "is_a_snapshot": false,
+		"snapshot_of": xrNullRef, "snapshots": xrArray{}, "snapshot_time": epoch, "transportable_snapshot_id": "",
+		"blobs": xrStruct{}, "tags": xrArray{}, "blocked_operations": xrStruct{}, "snapshot_info": xrStruct{},
+		"snapshot_metadata": "", "parent": xrNullRef, "children": xrArray{}, "bios_strings": xrStruct{},
+		"protection_policy": xrNullRef, "is_snapshot_from_vmpp": false, "snapshot_schedule": xrNullRef,
+		"is_vmss_snapshot": false, "appliance": xrNullRef, "start_delay": int64(0), "shutdown_delay": int64(0),
+		"order": int64(0), "version": int64(0), "generation_id": "",
+		"hardware_platform_version": int64(0), "has_vendor_device": false, "requires_reboot": false,
+		"reference_label": "", "domain_type": "hvm", "NVRAM": xrStruct{}, "guest_metrics": xrNullRef,
+		"metrics": xrNullRef, "ha_restart_priority": "", "ha_always_run": false, "xenstore_data": xrStruct{},
+		"recommendations": "", "last_booted_record": "",
+	}
+	sr := xrStruct{"uuid": newUUID(), "name_label": "Porter", "name_description": "", "content_type": "",
+		"type": "", "VDIs": xrArray{}, "PBDs": xrArray{}, "other_config": xrStruct{}, "sm_config": xrStruct{}}
+	objects = append(xrArray{
+		xrStruct{"class": "VM", "id": vmRef, "snapshot": vm},
+		xrStruct{"class": "SR", "id": srRef, "snapshot": sr},
+	}, objects...)
+
+	hostname, _ := os.Hostname()
+	header := xrStruct{
+		"version": xrStruct{
+			"hostname": hostname, "date": time.Now().UTC().Format("2006-01-02"),
+			"product_version": "8.2.0", "product_brand": "Porter", "build_number": "porter",
+			"xapi_major": xrI4(1), "xapi_minor": xrI4(1), "export_vsn": xrI4(2),
+		},
+		"objects": objects,
+	}
+	var b bytes.Buffer
+	writeXMLRPC(&b, header)
+	return b.Bytes()
+}
+
+// Package one disk as an XVA in the target directory, returning the .xva path
+func packageXVA(job *Job, s uploadSettings, file string) (string, error) {
+	hw := hardwareForDisk(file)
+	if job.Spec.Name != "" {
+		hw.Name = job.Spec.Name
+	}
+
+	// XVA chunks are of the raw disk
+	raw := file
+	if ext := strings.ToLower(filepath.Ext(file)); ext != ".raw" && ext != ".img" {
+		raw = file + ".xva-tmp.raw"
+		job.setStatus("Converting %s to RAW for the XVA", filepath.Base(file))
+		if err := convertImage(job, file, raw, "raw"); err != nil {
+			return "", err
+		}
+		defer os.Remove(raw)
+	}
+
+	info, err := os.Stat(raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to get file info for %s: %w", raw, err)
+	}
+	os.MkdirAll(s.Target, 0755)
+	dest := filepath.Join(s.Target, baseNameWithoutExt(file)+".xva")
+	job.setStatus("Packaging %s as XVA %s (%d vCPU, %d MB, %s)",
+		filepath.Base(file), dest, hw.CPUs, hw.MemoryMB, hw.Firmware)
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	tw := tar.NewWriter(out)
+	err = writeXVA(job, tw, hw, raw, info.Size())
+	if err == nil {
+		err = tw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		return "", fmt.Errorf("packaging %s as XVA failed: %w", file, err)
+	}
+	return dest, nil
+}
+
+func writeXVA(job *Job, tw *tar.Writer, hw ovfHardware, raw string, size int64) error {
+	modTime := time.Now()
+	writeEntry := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modTime}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	// ova.xml must come first
+	if err := writeEntry("ova.xml", xvaOVAXML(hw, "Packaged by Porter job "+job.ID, []int64{size})); err != nil {
+		return err
+	}
+
+	f, err := os.Open(raw)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := &jobReader{job: job, r: f}
+	chunk := make([]byte, xvaChunkSize)
+	zero := make([]byte, xvaChunkSize)
+	last := (size+xvaChunkSize-1)/xvaChunkSize - 1
+	for i := int64(0); i <= last; i++ {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// The final chunk may be short
+		data := chunk[:n]
+		if i != 0 && i != last && bytes.Equal(data, zero[:n]) {
+			continue
+		}
+		name := fmt.Sprintf("%s/%08d", xvaVDIRef(0), i)
+		sum := sha1.Sum(data)
+		if err := writeEntry(name, data); err != nil {
+			return err
+		}
+		if err := writeEntry(name+".checksum", []byte(hex.EncodeToString(sum[:]))); err != nil {
+			return err
+		}
+	}
+	return nil
+}